@@ -15,6 +15,10 @@
 extern crate pkg_config;
 
 use std::env;
+use std::fs;
+use std::path::Path;
+use std::process::Command;
+use std::time::{SystemTime, UNIX_EPOCH};
 
 /// Configures the crate to link against `lib_name`.
 ///
@@ -32,7 +36,60 @@ fn find_library(pc_name: &str, lib_name: &str, fallback: bool) {
     };
 }
 
+/// Runs `program` with `args` and returns the first line of its output, if it succeeded.
+fn first_line_of(program: &str, args: &[&str]) -> Option<String> {
+    let output = Command::new(program).args(args).output().ok()?;
+    if !output.status.success() {
+        return None;
+    }
+    String::from_utf8(output.stdout).ok()?.lines().next().map(str::to_owned)
+}
+
+/// Looks up the version of the `name` package that Cargo resolved in the lock file, if any.
+fn locked_version(name: &str) -> Option<String> {
+    let manifest_dir = env::var_os("CARGO_MANIFEST_DIR")?;
+    let lock = fs::read_to_string(Path::new(&manifest_dir).join("Cargo.lock")).ok()?;
+    let name_line = format!("name = \"{}\"", name);
+    let mut lines = lock.lines();
+    lines.find(|line| *line == name_line)?;
+    let version = lines.next()?;
+    if !version.starts_with("version = \"") {
+        return None;
+    }
+    Some(version.trim_start_matches("version = \"").trim_end_matches('"').to_owned())
+}
+
+/// Exposes details about the build to the crate via `SANDBOXFS_BUILD_*` environment variables,
+/// which the crate reads with `env!` to print them as part of `--version=json`.
+///
+/// The build system can inject the git commit via `SANDBOXFS_GIT_COMMIT` (useful when building
+/// outside of a git checkout) and can pin the build timestamp via `SOURCE_DATE_EPOCH` to get
+/// reproducible builds.
+fn emit_build_info() {
+    let git_commit = env::var("SANDBOXFS_GIT_COMMIT").ok()
+        .or_else(|| first_line_of("git", &["rev-parse", "HEAD"]))
+        .unwrap_or_else(|| "unknown".to_owned());
+    println!("cargo:rustc-env=SANDBOXFS_BUILD_GIT_COMMIT={}", git_commit);
+
+    let rustc = env::var("RUSTC").unwrap_or_else(|_| "rustc".to_owned());
+    let rustc_version = first_line_of(&rustc, &["--version"])
+        .unwrap_or_else(|| "unknown".to_owned());
+    println!("cargo:rustc-env=SANDBOXFS_BUILD_RUSTC_VERSION={}", rustc_version);
+
+    let fuse_version = locked_version("fuse").unwrap_or_else(|| "unknown".to_owned());
+    println!("cargo:rustc-env=SANDBOXFS_BUILD_FUSE_VERSION={}", fuse_version);
+
+    let timestamp = match env::var("SOURCE_DATE_EPOCH") {
+        Ok(value) => value.parse::<u64>().expect("SOURCE_DATE_EPOCH must be an integer"),
+        Err(_) => SystemTime::now().duration_since(UNIX_EPOCH)
+            .expect("System clock is before the epoch").as_secs(),
+    };
+    println!("cargo:rustc-env=SANDBOXFS_BUILD_TIMESTAMP={}", timestamp);
+}
+
 fn main () {
+    emit_build_info();
+
     // We are running on Travis, which pins us to an old macOS version that does not have
     // utimensat.  Apply a workaround so we can test most of sandboxfs.
     // TODO(https://github.com/bazelbuild/sandboxfs/issues/46): Remove this hack.
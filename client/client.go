@@ -0,0 +1,243 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License.  You may obtain a copy
+// of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.  See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// listTag is the tag used to match the responses to the list requests issued by List.
+const listTag = "list"
+
+// readsTag is the tag used to match the responses to the reads requests issued by Reads.
+const readsTag = "reads"
+
+// Mapping represents a mapping to add to a sandbox.
+type Mapping struct {
+	// Path is the path of the mapping within the sandbox, which must be absolute.
+	Path string `json:"path"`
+
+	// UnderlyingPath is the absolute path to the file or directory to expose at Path.
+	UnderlyingPath string `json:"underlying_path"`
+
+	// Writable indicates whether the mapping allows modifications.
+	Writable bool `json:"writable"`
+
+	// Noexec indicates whether files in the mapping are denied execution.
+	Noexec bool `json:"noexec,omitempty"`
+
+	// Perm, if not zero, masks the permissions reported for files in the mapping.
+	Perm int `json:"perm,omitempty"`
+
+	// Lazy defers inspecting the underlying path until the mapping is first accessed.
+	Lazy bool `json:"lazy,omitempty"`
+
+	// Optional allows the underlying path to not exist yet.  While it is missing, the mapping
+	// behaves as a missing entry: looking it up fails with ENOENT and directory listings omit
+	// it.  The mapping exposes the underlying path as soon as it appears.
+	Optional bool `json:"optional,omitempty"`
+
+	// Type, if not empty, is the type that the underlying path must have.
+	Type string `json:"type,omitempty"`
+}
+
+// ActiveMapping represents a mapping currently present in the file system, as returned by List.
+type ActiveMapping struct {
+	// Path is the absolute path of the entry within the file system.
+	Path string `json:"path"`
+
+	// UnderlyingPath is the path exposed by the mapping, or empty for scaffold directories.
+	UnderlyingPath string `json:"underlying_path,omitempty"`
+
+	// Writable indicates whether the mapping allows modifications.
+	Writable bool `json:"writable"`
+
+	// Scaffold indicates whether the entry is a directory that only exists to hold mappings.
+	Scaffold bool `json:"scaffold"`
+
+	// Noexec indicates whether files in the mapping are denied execution.
+	Noexec bool `json:"noexec"`
+
+	// Perm, if not zero, is the mask applied to the permissions of the files in the mapping.
+	Perm int `json:"perm,omitempty"`
+
+	// Unresolved indicates whether the underlying path has not been found yet, either because
+	// the mapping is optional and its underlying path did not exist or because the mapping is
+	// lazy and has not been accessed yet.
+	Unresolved bool `json:"unresolved"`
+}
+
+// ReadSet represents the files read through the file system, as returned by Reads.
+type ReadSet struct {
+	// Paths are the absolute paths within the file system of the files that were read, sorted.
+	Paths []string `json:"paths"`
+
+	// Overflowed indicates whether more files were read than sandboxfs remembers, in which case
+	// Paths is incomplete.
+	Overflowed bool `json:"overflowed"`
+}
+
+// createSandboxRequest represents a request to create a sandbox.
+type createSandboxRequest struct {
+	ID       string    `json:"id"`
+	Mappings []Mapping `json:"mappings"`
+}
+
+// unmapPathsRequest represents a request to remove mappings from a sandbox.
+type unmapPathsRequest struct {
+	ID    string   `json:"id"`
+	Paths []string `json:"paths"`
+}
+
+// request represents a single reconfiguration request.  Exactly one field must be set.
+type request struct {
+	CreateSandbox  *createSandboxRequest `json:"CreateSandbox,omitempty"`
+	DestroySandbox *string               `json:"DestroySandbox,omitempty"`
+	UnmapPaths     *unmapPathsRequest    `json:"UnmapPaths,omitempty"`
+	ListMappings   *string               `json:"ListMappings,omitempty"`
+	Reads          *string               `json:"Reads,omitempty"`
+}
+
+// response represents the result of a reconfiguration request.
+type response struct {
+	ID       *string         `json:"id"`
+	Error    *string         `json:"error"`
+	Mappings []ActiveMapping `json:"mappings"`
+	Reads    *ReadSet        `json:"reads"`
+}
+
+// Client sends reconfiguration requests to a sandboxfs instance.  Clients are safe for concurrent
+// use, though requests are sent one at a time.
+type Client struct {
+	// mu serializes requests so that each response can be matched to its request.
+	mu sync.Mutex
+
+	// input is where requests are written to.
+	input io.Writer
+
+	// decoder reads the responses.
+	decoder *json.Decoder
+
+	// closer releases the connection, if the client owns it.
+	closer io.Closer
+}
+
+// New creates a client that writes requests to input and reads responses from output, which are
+// typically the pipes connected to the --input and --output of sandboxfs.  The caller remains
+// responsible for closing them.
+func New(input io.Writer, output io.Reader) *Client {
+	return &Client{
+		input:   input,
+		decoder: json.NewDecoder(output),
+	}
+}
+
+// Dial connects to the reconfiguration socket of a sandboxfs instance started with
+// --reconfig_socket=socket.  The connection must be released with Close.
+func Dial(socket string) (*Client, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", socket, err)
+	}
+	client := New(conn, conn)
+	client.closer = conn
+	return client, nil
+}
+
+// Close releases the connection opened by Dial.  It does nothing for clients created by New.
+func (c *Client) Close() error {
+	if c.closer == nil {
+		return nil
+	}
+	return c.closer.Close()
+}
+
+// roundTrip sends req, waits for its response and checks that it belongs to the request with id.
+func (c *Client) roundTrip(req request, id string) (*response, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %v", err)
+	}
+	data = append(data, '\n')
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := c.input.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to send request to sandboxfs: %v", err)
+	}
+	var resp response
+	if err := c.decoder.Decode(&resp); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("sandboxfs closed its output before responding")
+		}
+		return nil, fmt.Errorf("failed to read response from sandboxfs: %v", err)
+	}
+	if resp.ID == nil || *resp.ID != id {
+		if resp.Error != nil {
+			return nil, fmt.Errorf("sandboxfs rejected request: %s", *resp.Error)
+		}
+		return nil, fmt.Errorf("sandboxfs replied with a bad id: got %v, want %s", resp.ID, id)
+	}
+	if resp.Error != nil {
+		return nil, fmt.Errorf("sandboxfs rejected request for %s: %s", id, *resp.Error)
+	}
+	return &resp, nil
+}
+
+// Map creates the sandbox id with the given mappings, or adds the mappings to it if it exists.
+func (c *Client) Map(id string, mappings []Mapping) error {
+	req := request{CreateSandbox: &createSandboxRequest{ID: id, Mappings: mappings}}
+	_, err := c.roundTrip(req, id)
+	return err
+}
+
+// Unmap removes the mappings at the given paths, relative to the root of the sandbox id.
+func (c *Client) Unmap(id string, paths []string) error {
+	req := request{UnmapPaths: &unmapPathsRequest{ID: id, Paths: paths}}
+	_, err := c.roundTrip(req, id)
+	return err
+}
+
+// Destroy removes the sandbox id and all of its mappings.
+func (c *Client) Destroy(id string) error {
+	_, err := c.roundTrip(request{DestroySandbox: &id}, id)
+	return err
+}
+
+// List returns all mappings in the file system, sorted by path.
+func (c *Client) List() ([]ActiveMapping, error) {
+	tag := listTag
+	resp, err := c.roundTrip(request{ListMappings: &tag}, tag)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Mappings, nil
+}
+
+// Reads returns the files read through the file system since the previous call to Reads, or since
+// sandboxfs started for the first call.  Requires sandboxfs to run with --track_reads.
+func (c *Client) Reads() (*ReadSet, error) {
+	tag := readsTag
+	resp, err := c.roundTrip(request{Reads: &tag}, tag)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Reads, nil
+}
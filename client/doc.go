@@ -0,0 +1,21 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License.  You may obtain a copy
+// of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.  See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+// Package client implements the sandboxfs reconfiguration protocol.
+//
+// A Client sends requests to a running sandboxfs instance, either through its reconfiguration
+// socket (see Dial) or through the pipes connected to its --input and --output (see New), and
+// waits for the response to each request before returning.  This takes care of the framing of the
+// messages and of matching responses to requests so that callers don't have to.
+package client
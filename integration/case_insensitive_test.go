@@ -0,0 +1,135 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License.  You may obtain a copy
+// of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.  See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package integration
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/bazelbuild/sandboxfs/integration/utils"
+)
+
+// requireCaseSensitiveRoot skips the test if the file system backing the root of the given state
+// already ignores case, in which case there is nothing for sandboxfs to fold.
+func requireCaseSensitiveRoot(t *testing.T, state *utils.MountState) {
+	t.Helper()
+
+	utils.MustWriteFile(t, state.RootPath("probe"), 0644, "")
+	defer os.Remove(state.RootPath("probe"))
+	if _, err := os.Lstat(state.RootPath("PROBE")); err == nil {
+		t.Skipf("Underlying file system is case-insensitive")
+	}
+}
+
+func TestCaseInsensitive_Lookup(t *testing.T) {
+	state := utils.MountSetup(t, "--case_insensitive", "--mapping=rw:/:%ROOT%")
+	defer state.TearDown(t)
+	requireCaseSensitiveRoot(t, state)
+
+	utils.MustMkdirAll(t, state.RootPath("Resources"), 0755)
+	utils.MustWriteFile(t, state.RootPath("Resources/Info.plist"), 0644, "the contents")
+
+	if err := utils.FileEquals(state.MountPath("resources/INFO.PLIST"), "the contents"); err != nil {
+		t.Error(err)
+	}
+	if err := utils.FileEquals(state.MountPath("Resources/Info.plist"), "the contents"); err != nil {
+		t.Error(err)
+	}
+	if err := utils.DirEntryNamesEqual(state.MountPath("resources"), []string{"Info.plist"}); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := os.Lstat(state.MountPath("resources/missing")); !os.IsNotExist(err) {
+		t.Errorf("Want lookup of missing entry to fail with ENOENT; got %v", err)
+	}
+}
+
+func TestCaseInsensitive_SeesUnderlyingChanges(t *testing.T) {
+	state := utils.MountSetup(t, "--case_insensitive", "--mapping=rw:/:%ROOT%")
+	defer state.TearDown(t)
+	requireCaseSensitiveRoot(t, state)
+
+	utils.MustWriteFile(t, state.RootPath("First"), 0644, "")
+	if _, err := os.Lstat(state.MountPath("first")); err != nil {
+		t.Fatalf("Want lookup of first to find First; got %v", err)
+	}
+
+	// A failed lookup populates the cache of folded names, which must notice later changes.
+	if _, err := os.Lstat(state.MountPath("second")); !os.IsNotExist(err) {
+		t.Fatalf("Want lookup of second to fail with ENOENT; got %v", err)
+	}
+	utils.MustWriteFile(t, state.RootPath("Second"), 0644, "")
+	if _, err := os.Lstat(state.MountPath("SECOND")); err != nil {
+		t.Errorf("Want lookup of SECOND to find Second; got %v", err)
+	}
+}
+
+func TestCaseInsensitive_CreateRefusesFoldedNames(t *testing.T) {
+	state := utils.MountSetup(t, "--case_insensitive", "--mapping=rw:/:%ROOT%")
+	defer state.TearDown(t)
+	requireCaseSensitiveRoot(t, state)
+
+	utils.MustWriteFile(t, state.MountPath("Makefile"), 0644, "")
+
+	if err := os.Mkdir(state.MountPath("MAKEFILE"), 0755); !os.IsExist(err) {
+		t.Errorf("Want creation of a directory whose name folds to an existing entry to fail with EEXIST; got %v", err)
+	}
+	fd, err := syscall.Open(state.MountPath("makefile"), syscall.O_CREAT|syscall.O_EXCL|syscall.O_WRONLY, 0644)
+	if err == nil {
+		syscall.Close(fd)
+	}
+	if err != syscall.EEXIST {
+		t.Errorf("Want exclusive creation of a file whose name folds to an existing entry to fail with EEXIST; got %v", err)
+	}
+	if err := utils.DirEntryNamesEqual(state.RootPath(), []string{"Makefile"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCaseInsensitive_RenameAndRemoveFoldedNames(t *testing.T) {
+	state := utils.MountSetup(t, "--case_insensitive", "--mapping=rw:/:%ROOT%")
+	defer state.TearDown(t)
+	requireCaseSensitiveRoot(t, state)
+
+	utils.MustWriteFile(t, state.RootPath("Original"), 0644, "")
+	if err := os.Rename(state.MountPath("ORIGINAL"), state.MountPath("Renamed")); err != nil {
+		t.Fatalf("Rename through a folded name failed: %v", err)
+	}
+	if err := utils.DirEntryNamesEqual(state.RootPath(), []string{"Renamed"}); err != nil {
+		t.Error(err)
+	}
+
+	if err := os.Remove(state.MountPath("renamed")); err != nil {
+		t.Fatalf("Remove through a folded name failed: %v", err)
+	}
+	if err := utils.DirEntryNamesEqual(state.RootPath(), nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCaseInsensitive_DisabledByDefault(t *testing.T) {
+	state := utils.MountSetup(t, "--mapping=rw:/:%ROOT%")
+	defer state.TearDown(t)
+	requireCaseSensitiveRoot(t, state)
+
+	utils.MustWriteFile(t, state.RootPath("Info.plist"), 0644, "")
+	if _, err := os.Lstat(state.MountPath("INFO.PLIST")); !os.IsNotExist(err) {
+		t.Errorf("Want lookup of differently-cased name to fail with ENOENT; got %v", err)
+	}
+	if err := os.Mkdir(state.MountPath("INFO.PLIST"), 0755); err != nil {
+		t.Errorf("Want creation of differently-cased name to succeed; got %v", err)
+	}
+}
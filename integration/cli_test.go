@@ -15,8 +15,10 @@
 package integration
 
 import (
+	"encoding/json"
 	"fmt"
 	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/bazelbuild/sandboxfs/integration/utils"
@@ -34,20 +36,133 @@ Options:
     --allow other|root|self
                         specifies who should have access to the file system
                         (default: self)
+    --allow_devices     allows creating block and character devices
+                        (dangerous; requires root)
+    --allowed_targets DIR[,DIR]
+                        only accepts mappings whose targets are within the
+                        given directories
+    --audit_log PATH    file to append a JSON record of each modification to
+    --auto_unmount      unmounts the file system when sandboxfs is killed
+                        (Linux only)
+    --case_insensitive  looks up names within the mappings ignoring case if
+                        they do not exist as given
+    --confine_symlinks  refuses to access underlying files through paths that
+                        traverse symlinks
     --cpu_profile PATH  enables CPU profiling and writes a profile to the
                         given path
+    --debug_ops OP[,OP] only traces requests for the given operations when
+                        debug logging is on
+    --debug_path_prefix PATH
+                        only traces requests on paths under the given one when
+                        debug logging is on
+    --drop_privileges_to USER
+                        switches to the given user once the file system is
+                        mounted
+    --dry_run           validates the mappings and exits without mounting
+    --enable_http_reconfig
+                        accepts reconfigurations over HTTP (requires
+                        --listen_address)
+    --enable_http_snapshot
+                        writes trace snapshots on request over HTTP (requires
+                        --listen_address)
+    --expose_underlying_inodes
+                        reports the inode numbers of mapped files instead of
+                        synthesized ones
+    --force             unmounts a stale file system at the mount point before
+                        mounting
+    --fs_name NAME      name of the file system in the mount table (default:
+                        sandboxfs)
+    --fuse_option NAME[=VALUE]
+                        adds a mount option from the allowed ones listed in
+                        the manual page
+    --gid GID           group to report as the owner of all files
     --help              prints usage information and exits
+    --hide_fifos        hides named pipes found within the mappings
+    --hide_special_files
+                        hides devices and sockets found within the mappings
     --input PATH        where to read reconfiguration data from (- for stdin)
+    --io_timeout TIMEs  how long an operation on an underlying file may take
+                        before failing with EIO
+    --lazy_mapping_validation
+                        defers inspecting the targets of plain mappings until
+                        they are first accessed
+    --listen_address HOST:PORT
+                        enables serving metrics over HTTP on the given address
+    --log_file PATH     file to append log messages to instead of stderr
+    --log_format text|json
+                        format of the log messages on stderr (default: text)
+    --log_level debug|info|warn|error
+                        maximum level of messages to log (default: RUST_LOG)
+    --log_slow_ops TIMEs
+                        logs operations that take longer than the given time
     --mapping TYPE:PATH:UNDERLYING_PATH
                         type and locations of a mapping
+    --mapping_file PATH file with one mapping per line, applied before
+                        --mapping
+    --mapping_manifest PATH[:PREFIX[:OPTIONS]]
+                        Bazel runfiles manifest whose entries to map read-only
+                        under PREFIX (default: /)
+    --max_open_files COUNT
+                        number of open underlying files at which idle
+                        read-only ones start being closed (default: 90%% of the
+                        open files limit)
+    --max_read_bytes SIZE
+                        largest read that the kernel may ask the file system
+                        for (Linux only)
+    --mount_retries COUNT
+                        number of times to retry mounting after a transient
+                        failure (default: 0)
+    --mount_retry_delay TIMEs
+                        how long to wait before the first mount retry
+                        (default: 1s)
+    --negative_ttl TIMEs
+                        how long the kernel is allowed to cache lookups of
+                        missing files (default: 0s)
+    --noappledouble     hides and denies access to AppleDouble (._*) and
+                        .DS_Store files (macOS only)
+    --noapplexattr      denies access to Apple-specific extended attributes
+                        (macOS only)
     --node_cache        enables the path-based node cache (known broken)
+    --nonempty          allows mounting over a non-empty directory (Linux only)
+    --overlay           merges mappings with the same path instead of
+                        rejecting them
     --output PATH       where to write the reconfiguration status to (- for
                         stdout)
+    --parent_death_unmount
+                        unmounts the file system when the parent process exits
+    --ready_fd FD       writes 1 to the given file descriptor once the file
+                        system is mounted
+    --reconfig_socket PATH
+                        listens for reconfiguration requests on a Unix socket
+                        at the given path
     --reconfig_threads COUNT
                         number of reconfiguration threads (default: %d)
+    --shutdown_timeout TIMEs
+                        how long to wait for open files to be closed on exit
+                        (default: 0s)
+    --stop_on_input_eof unmounts the file system once the reconfiguration
+                        input is closed
+    --subtype NAME      subtype of the file system in the mount table
+                        (default: sandboxfs)
+    --trace_profile PATH
+                        writes a trace of the operations to the given path for
+                        chrome://tracing or Perfetto
+    --trace_profile_duration TIMEs
+                        stops tracing after the given time and writes the
+                        trace right away
+    --track_reads       tracks which files are read through the file system
+    --track_reads_output PATH
+                        file to write the paths of the read files to on
+                        unmount (requires --track_reads)
     --ttl TIMEs         how long the kernel is allowed to keep file metadata
                         (default: 60s)
-    --version           prints version information and exits
+    --uid UID           user to report as the owner of all files
+    --unmount_timeout TIMEs
+                        how long to retry unmounting a busy file system on
+                        exit before detaching it
+    --version [FORMAT]  prints version information, as JSON if FORMAT is json,
+                        and exits
+    --volume_icon PATH  icon file to display for the file system (macOS only)
     --xattrs            enables support for extended attributes
 `, runtime.NumCPU())
 
@@ -75,6 +190,40 @@ func TestCli_Version(t *testing.T) {
 	}
 }
 
+func TestCli_VersionJSON(t *testing.T) {
+	stdout, stderr, err := utils.RunAndWait(0, "--version=json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stderr) > 0 {
+		t.Errorf("Got %s; want stderr to be empty", stderr)
+	}
+
+	var info map[string]string
+	if err := json.Unmarshal([]byte(stdout), &info); err != nil {
+		t.Fatalf("Got %s; want stdout to be a JSON object: %v", stdout, err)
+	}
+	for _, field := range []string{"package_version", "git_commit", "rustc_version", "fuse_version", "build_timestamp", "target_os", "target_arch"} {
+		if info[field] == "" {
+			t.Errorf("Got %s; want field %s to be present and not empty", stdout, field)
+		}
+	}
+	plain, _, err := utils.RunAndWait(0, "--version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "sandboxfs " + info["package_version"]; strings.TrimSpace(plain) != want {
+		t.Errorf("Got package_version %s; want it to match plain output %s", info["package_version"], plain)
+	}
+	wantOS := runtime.GOOS
+	if wantOS == "darwin" {
+		wantOS = "macos"
+	}
+	if info["target_os"] != wantOS {
+		t.Errorf("Got target_os %s; want %s", info["target_os"], wantOS)
+	}
+}
+
 func TestCli_ExclusiveFlagsPriority(t *testing.T) {
 	testData := []struct {
 		name string
@@ -175,17 +324,112 @@ func TestCli_Syntax(t *testing.T) {
 		{
 			"MappingMissingTarget",
 			[]string{"--mapping=ro:/foo"},
-			`bad mapping ro:/foo: expected three colon-separated fields`,
+			`bad mapping ro:/foo: expected three or four colon-separated fields`,
 		},
 		{
-			"MappingRelativeTarget",
-			[]string{"--mapping=rw:/:relative/path"},
-			`bad mapping rw:/:relative/path: path "relative/path" is not absolute`,
+			"MappingRelativePath",
+			[]string{"--mapping=rw:relative/path:/"},
+			`bad mapping rw:relative/path:/: path "relative/path" is not absolute`,
+		},
+		{
+			"MappingPathNotNormalized",
+			[]string{"--mapping=ro:/a/../b:/"},
+			`bad mapping ro:/a/../b:/: path "/a/../b" is not normalized`,
 		},
 		{
 			"MappingBadType",
 			[]string{"--mapping=row:/foo:/bar"},
-			`bad mapping row:/foo:/bar: type was row but should be ro or rw`,
+			`bad mapping row:/foo:/bar: type was row but should be ro, rw, cow or tmp`,
+		},
+		{
+			"MappingBadSize",
+			[]string{"--mapping=tmp:/tmp:lots"},
+			`bad mapping tmp:/tmp:lots: invalid size lots: invalid digit found in string`,
+		},
+		{
+			"MappingBadEscape",
+			[]string{`--mapping=ro:/a:/b\c`},
+			`bad mapping ro:/a:/b\\c: invalid escape sequence \\c`,
+		},
+		{
+			"AllowedTargetsRelativePath",
+			[]string{"--allowed_targets=/tmp,relative/dir"},
+			`invalid --allowed_targets /tmp,relative/dir: "relative/dir" is not absolute`,
+		},
+		{
+			"MaxReadBytesTooSmall",
+			[]string{"--max_read_bytes=1K"},
+			`invalid --max_read_bytes 1K: must be at least 4K and less than 4G`,
+		},
+		{
+			"DebugOpsUnknown",
+			[]string{"--debug_ops=lookup,foo"},
+			`invalid --debug_ops lookup,foo: unknown operation foo; must be one of create, flush, .*, write`,
+		},
+		{
+			"DebugPathPrefixRelative",
+			[]string{"--debug_path_prefix=out/foo"},
+			`invalid --debug_path_prefix out/foo: must be absolute`,
+		},
+		{
+			"LogSlowOpsZero",
+			[]string{"--log_slow_ops=0s"},
+			`invalid --log_slow_ops 0s: must be positive`,
+		},
+		{
+			"EnableHttpReconfigWithoutListenAddress",
+			[]string{"--enable_http_reconfig"},
+			`--enable_http_reconfig requires --listen_address`,
+		},
+		{
+			"EnableHttpSnapshotWithoutListenAddress",
+			[]string{"--enable_http_snapshot"},
+			`--enable_http_snapshot requires --listen_address`,
+		},
+		{
+			"TraceProfileWithCpuProfile",
+			[]string{"--trace_profile=/tmp/trace.json", "--cpu_profile=/tmp/cpu.prof"},
+			`--trace_profile cannot be combined with --cpu_profile`,
+		},
+		{
+			"TraceProfileDurationWithoutTraceProfile",
+			[]string{"--trace_profile_duration=30s"},
+			`--trace_profile_duration requires --trace_profile`,
+		},
+		{
+			"TraceProfileDurationZero",
+			[]string{"--trace_profile=/tmp/trace.json", "--trace_profile_duration=0s"},
+			`invalid --trace_profile_duration 0s: must be positive`,
+		},
+		{
+			"TrackReadsOutputWithoutTrackReads",
+			[]string{"--track_reads_output=/tmp/reads"},
+			`--track_reads_output requires --track_reads`,
+		},
+		{
+			"LogFormatBad",
+			[]string{"--log_format=xml"},
+			`invalid --log_format xml: must be text or json`,
+		},
+		{
+			"LogLevelBad",
+			[]string{"--log_level=trace"},
+			`invalid --log_level trace: must be debug, info, warn or error`,
+		},
+		{
+			"VersionBadFormat",
+			[]string{"--version=xml"},
+			`invalid --version xml: must be json`,
+		},
+		{
+			"FuseOptionNotAllowed",
+			[]string{"--fuse_option=allow_other"},
+			`invalid --fuse_option allow_other: `,
+		},
+		{
+			"VolumeIconWithComma",
+			[]string{"--volume_icon=/a,b.icns"},
+			`invalid --volume_icon /a,b.icns: cannot contain commas`,
 		},
 		{
 			"ReconfigThreadsBadValue",
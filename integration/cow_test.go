@@ -0,0 +1,217 @@
+// Copyright 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License.  You may obtain a copy
+// of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.  See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package integration
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/bazelbuild/sandboxfs/integration/utils"
+)
+
+// cowSetup mounts a sandboxfs instance with a copy-on-write mapping at /cow that exposes the
+// "lower" directory and writes into the "scratch" directory, both within the root, and with a
+// read/write mapping at /rw.
+func cowSetup(t *testing.T) *utils.MountState {
+	rootSetup := func(root string) error {
+		for _, dir := range []string{"lower/dir", "scratch", "rw"} {
+			if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+				return err
+			}
+		}
+		files := map[string]string{
+			"lower/file":      "original",
+			"lower/dir/file":  "nested",
+			"lower/to-delete": "gone",
+		}
+		for name, contents := range files {
+			if err := ioutil.WriteFile(filepath.Join(root, name), []byte(contents), 0644); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return utils.MountSetupWithRootSetup(t, rootSetup,
+		"--mapping=ro:/:%ROOT%",
+		"--mapping=cow:/cow:%ROOT%/lower:%ROOT%/scratch",
+		"--mapping=rw:/rw:%ROOT%/rw")
+}
+
+// readDirNames returns the sorted names of the entries in the directory given by path.
+func readDirNames(t *testing.T, path string) []string {
+	t.Helper()
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		t.Fatalf("ReadDir of %s failed: %v", path, err)
+	}
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestCow_ReadsComeFromTarget(t *testing.T) {
+	state := cowSetup(t)
+	defer state.TearDown(t)
+
+	if err := utils.FileEquals(state.MountPath("cow/file"), "original"); err != nil {
+		t.Error(err)
+	}
+	if err := utils.FileEquals(state.MountPath("cow/dir/file"), "nested"); err != nil {
+		t.Error(err)
+	}
+	if names := readDirNames(t, state.RootPath("scratch")); len(names) != 0 {
+		t.Errorf("Reads populated the scratch directory with %v", names)
+	}
+}
+
+func TestCow_WriteCopiesToScratch(t *testing.T) {
+	state := cowSetup(t)
+	defer state.TearDown(t)
+
+	file, err := os.OpenFile(state.MountPath("cow/dir/file"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	if _, err := file.WriteString(" and more"); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if err := utils.FileEquals(state.MountPath("cow/dir/file"), "nested and more"); err != nil {
+		t.Error(err)
+	}
+	if err := utils.FileEquals(state.RootPath("scratch/dir/file"), "nested and more"); err != nil {
+		t.Error(err)
+	}
+	if err := utils.FileEquals(state.RootPath("lower/dir/file"), "nested"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCow_TruncateThenWrite(t *testing.T) {
+	state := cowSetup(t)
+	defer state.TearDown(t)
+
+	if err := ioutil.WriteFile(state.MountPath("cow/file"), []byte("new"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := utils.FileEquals(state.MountPath("cow/file"), "new"); err != nil {
+		t.Error(err)
+	}
+	if err := utils.FileEquals(state.RootPath("scratch/file"), "new"); err != nil {
+		t.Error(err)
+	}
+	if err := utils.FileEquals(state.RootPath("lower/file"), "original"); err != nil {
+		t.Error(err)
+	}
+
+	if err := os.Truncate(state.MountPath("cow/dir/file"), 0); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if err := utils.FileEquals(state.MountPath("cow/dir/file"), ""); err != nil {
+		t.Error(err)
+	}
+	if err := utils.FileEquals(state.RootPath("lower/dir/file"), "nested"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCow_CreateGoesToScratch(t *testing.T) {
+	state := cowSetup(t)
+	defer state.TearDown(t)
+
+	if err := os.Mkdir(state.MountPath("cow/dir/subdir"), 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	if err := ioutil.WriteFile(state.MountPath("cow/dir/subdir/new"), []byte("created"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	if err := utils.FileEquals(state.RootPath("scratch/dir/subdir/new"), "created"); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Lstat(state.RootPath("lower/dir/subdir")); !os.IsNotExist(err) {
+		t.Errorf("Mkdir modified the target of the mapping: %v", err)
+	}
+	if names := readDirNames(t, state.MountPath("cow/dir")); !reflect.DeepEqual([]string{"file", "subdir"}, names) {
+		t.Errorf("Got entries %v in merged directory; want file and subdir", names)
+	}
+}
+
+func TestCow_DeleteHidesEntry(t *testing.T) {
+	state := cowSetup(t)
+	defer state.TearDown(t)
+
+	if err := os.Remove(state.MountPath("cow/to-delete")); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if _, err := os.Lstat(state.MountPath("cow/to-delete")); !os.IsNotExist(err) {
+		t.Errorf("Deleted entry is still visible: %v", err)
+	}
+	if names := readDirNames(t, state.MountPath("cow")); !reflect.DeepEqual([]string{"dir", "file"}, names) {
+		t.Errorf("Got entries %v after delete; want dir and file", names)
+	}
+	if err := utils.FileEquals(state.RootPath("lower/to-delete"), "gone"); err != nil {
+		t.Error(err)
+	}
+
+	if err := unix.Rmdir(state.MountPath("cow/dir")); err != unix.ENOTEMPTY {
+		t.Errorf("Want rmdir of non-empty directory to fail with ENOTEMPTY; got %v", err)
+	}
+}
+
+func TestCow_RenameWithinMapping(t *testing.T) {
+	state := cowSetup(t)
+	defer state.TearDown(t)
+
+	if err := os.Rename(state.MountPath("cow/file"), state.MountPath("cow/dir/renamed")); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if _, err := os.Lstat(state.MountPath("cow/file")); !os.IsNotExist(err) {
+		t.Errorf("Renamed entry is still visible in its old location: %v", err)
+	}
+	if err := utils.FileEquals(state.MountPath("cow/dir/renamed"), "original"); err != nil {
+		t.Error(err)
+	}
+	if err := utils.FileEquals(state.RootPath("lower/file"), "original"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCow_RenameAcrossMappingsFails(t *testing.T) {
+	state := cowSetup(t)
+	defer state.TearDown(t)
+
+	utils.MustWriteFile(t, state.RootPath("rw/file"), 0644, "plain")
+
+	for _, paths := range [][2]string{{"cow/file", "rw/file2"}, {"rw/file", "cow/file2"}} {
+		err := os.Rename(state.MountPath(paths[0]), state.MountPath(paths[1]))
+		if linkErr, ok := err.(*os.LinkError); !ok || linkErr.Err != unix.EXDEV {
+			t.Errorf("Want rename of %s to %s to fail with EXDEV; got %v", paths[0], paths[1], err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License.  You may obtain a copy
+// of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.  See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package integration
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/bazelbuild/sandboxfs/integration/utils"
+)
+
+// excludeSetup mounts a sandboxfs instance with a mapping at /src of the given type that excludes
+// entries named ".git" and entries starting with "bazel-".  Any additional arguments are passed
+// to sandboxfs after the mappings.
+func excludeSetup(t *testing.T, mappingType string, args ...string) *utils.MountState {
+	rootSetup := func(root string) error {
+		for _, dir := range []string{"src/.git", "src/pkg/.git", "src/bazel-out"} {
+			if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+				return err
+			}
+		}
+		for _, file := range []string{"src/file", "src/pkg/bazel-bin", "src/pkg/main.go"} {
+			if err := ioutil.WriteFile(filepath.Join(root, file), []byte("contents"), 0644); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	allArgs := []string{"--mapping=" + mappingType + ":/src:%ROOT%/src:!.git,!bazel-*"}
+	allArgs = append(allArgs, args...)
+	return utils.MountSetupWithRootSetup(t, rootSetup, allArgs...)
+}
+
+func TestExclude_HidesFromLookup(t *testing.T) {
+	state := excludeSetup(t, "ro")
+	defer state.TearDown(t)
+
+	for _, name := range []string{"src/.git", "src/bazel-out", "src/pkg/.git", "src/pkg/bazel-bin"} {
+		if _, err := os.Lstat(state.MountPath(name)); !os.IsNotExist(err) {
+			t.Errorf("Want excluded entry %s to not exist; got %v", name, err)
+		}
+	}
+	if err := utils.FileEquals(state.MountPath("src/pkg/main.go"), "contents"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExclude_HidesFromReadDir(t *testing.T) {
+	state := excludeSetup(t, "ro")
+	defer state.TearDown(t)
+
+	if names := readDirNames(t, state.MountPath("src")); !reflect.DeepEqual([]string{"file", "pkg"}, names) {
+		t.Errorf("Got entries %v; want file and pkg", names)
+	}
+	if names := readDirNames(t, state.MountPath("src/pkg")); !reflect.DeepEqual([]string{"main.go"}, names) {
+		t.Errorf("Got entries %v; want main.go", names)
+	}
+}
+
+func TestExclude_PreventsCreation(t *testing.T) {
+	state := excludeSetup(t, "rw")
+	defer state.TearDown(t)
+
+	if err := unix.Mkdir(state.MountPath("src/pkg/bazel-new"), 0755); err != unix.EPERM {
+		t.Errorf("Want mkdir of excluded entry to fail with EPERM; got %v", err)
+	}
+	if _, err := unix.Open(state.MountPath("src/.git/config"), unix.O_CREAT|unix.O_WRONLY, 0644); err != unix.ENOENT {
+		t.Errorf("Want create within excluded directory to fail with ENOENT; got %v", err)
+	}
+	if _, err := unix.Open(state.MountPath("src/pkg/.git"), unix.O_CREAT|unix.O_WRONLY, 0644); err != unix.EPERM {
+		t.Errorf("Want create of excluded entry to fail with EPERM; got %v", err)
+	}
+	if _, err := os.Lstat(state.RootPath("src/pkg/bazel-new")); !os.IsNotExist(err) {
+		t.Errorf("Excluded directory was created in the underlying tree: %v", err)
+	}
+
+	utils.MustWriteFile(t, state.MountPath("src/pkg/other"), 0644, "new")
+	if err := utils.FileEquals(state.RootPath("src/pkg/other"), "new"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExclude_ExplicitMappingOverrides(t *testing.T) {
+	state := excludeSetup(t, "ro", "--mapping=ro:/src/pkg/.git:%ROOT%/src/.git")
+	defer state.TearDown(t)
+
+	utils.MustWriteFile(t, state.RootPath("src/.git/HEAD"), 0644, "ref")
+	if err := utils.FileEquals(state.MountPath("src/pkg/.git/HEAD"), "ref"); err != nil {
+		t.Error(err)
+	}
+	if names := readDirNames(t, state.MountPath("src/pkg")); !reflect.DeepEqual([]string{".git", "main.go"}, names) {
+		t.Errorf("Got entries %v; want .git and main.go", names)
+	}
+	if _, err := os.Lstat(state.MountPath("src/.git")); !os.IsNotExist(err) {
+		t.Errorf("Want excluded entry src/.git to not exist; got %v", err)
+	}
+}
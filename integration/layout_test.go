@@ -15,9 +15,11 @@
 package integration
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/bazelbuild/sandboxfs/integration/utils"
@@ -84,6 +86,31 @@ func TestLayout_TargetDoesNotExist(t *testing.T) {
 	}
 }
 
+func TestLayout_RelativeTarget(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	utils.MustWriteFile(t, filepath.Join(tempDir, "file"), 0644, "contents")
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get working directory: %v", err)
+	}
+	relDir, err := filepath.Rel(wd, tempDir)
+	if err != nil {
+		t.Fatalf("Cannot compute relative path to %s: %v", tempDir, err)
+	}
+
+	state := utils.MountSetup(t, "--mapping=ro:/:%ROOT%", "--mapping=ro:/rel:./"+relDir)
+	defer state.TearDown(t)
+
+	if err := utils.FileEquals(state.MountPath("rel/file"), "contents"); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestLayout_DuplicateMapping(t *testing.T) {
 	tempDir, err := ioutil.TempDir("", "test")
 	if err != nil {
@@ -110,6 +137,27 @@ func TestLayout_DuplicateMapping(t *testing.T) {
 	}
 }
 
+func TestLayout_DuplicateMappingWithDifferentSpelling(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	wantStderr := "Cannot map .*'/a/b .* Already mapped\n"
+
+	stdout, stderr, err := utils.RunAndWait(1, "--mapping=ro:/:"+tempDir, "--mapping=ro:/a/b:"+tempDir, "--mapping=ro://a//b/:"+tempDir, "irrelevant-mount-point")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stdout) > 0 {
+		t.Errorf("Got %s; want stdout to be empty", stdout)
+	}
+	if !utils.MatchesRegexp(wantStderr, stderr) {
+		t.Errorf("Got %s; want stderr to match %s", stderr, wantStderr)
+	}
+}
+
 func TestLayout_TargetIsScaffoldDirectory(t *testing.T) {
 	tempDir, err := ioutil.TempDir("", "test")
 	if err != nil {
@@ -133,3 +181,285 @@ func TestLayout_TargetIsScaffoldDirectory(t *testing.T) {
 		t.Errorf("Got %s; want stderr to match %s", stderr, wantStderr)
 	}
 }
+
+func TestLayout_DryRun(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	utils.MustMkdirAll(t, filepath.Join(tempDir, "dir"), 0755)
+
+	stdout, stderr, err := utils.RunAndWait(0, "--dry_run", "--mapping=ro:/:"+tempDir, "--mapping=rw:/a/b:"+filepath.Join(tempDir, "dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stdout) > 0 {
+		t.Errorf("Got %s; want stdout to be empty", stdout)
+	}
+	if len(stderr) > 0 {
+		t.Errorf("Got %s; want stderr to be empty", stderr)
+	}
+}
+
+func TestLayout_DryRunReportsAllErrors(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	file := filepath.Join(tempDir, "file")
+	utils.MustWriteFile(t, file, 0644, "")
+
+	stdout, stderr, err := utils.RunAndWait(1, "--dry_run", "--mapping=ro:/:"+file, "--mapping=ro:/a:/non-existent", "--mapping=ro:/b:"+tempDir, "--mapping=ro:/b:"+tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stdout) > 0 {
+		t.Errorf("Got %s; want stdout to be empty", stdout)
+	}
+	for _, wantStderr := range []string{
+		"Failed to map root: .*file.* is not a directory",
+		"Cannot map '/a .*/non-existent",
+		"Cannot map '/b .* Already mapped",
+		"Found 3 invalid mapping",
+	} {
+		if !utils.MatchesRegexp(wantStderr, stderr) {
+			t.Errorf("Got %s; want stderr to match %s", stderr, wantStderr)
+		}
+	}
+}
+
+func TestLayout_MappingFile(t *testing.T) {
+	// The mapping file has to be written before sandboxfs starts, but its contents depend on
+	// the location of the root directory, so stage it from the root setup hook.
+	rootSetup := func(root string) error {
+		if err := os.MkdirAll(filepath.Join(root, "dir"), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, "file"), []byte("from file"), 0644); err != nil {
+			return err
+		}
+		contents := "# Leading comment.\n" +
+			"ro:/:" + root + "\n" +
+			"\n" +
+			"   rw:/mapped:" + filepath.Join(root, "dir") + "   \n"
+		return ioutil.WriteFile(filepath.Join(root, "..", "mappings"), []byte(contents), 0644)
+	}
+	state := utils.MountSetupWithRootSetup(t, rootSetup, "--mapping_file=%ROOT%/../mappings", "--mapping=ro:/cli:%ROOT%/file")
+	defer state.TearDown(t)
+
+	if err := utils.FileEquals(state.MountPath("file"), "from file"); err != nil {
+		t.Error(err)
+	}
+	if err := os.Mkdir(state.MountPath("mapped/subdir"), 0755); err != nil {
+		t.Errorf("Mkdir in writable mapping from file failed: %v", err)
+	}
+	if _, err := os.Lstat(state.RootPath("dir/subdir")); err != nil {
+		t.Errorf("Mkdir did not propagate to the underlying directory: %v", err)
+	}
+	if err := utils.FileEquals(state.MountPath("cli"), "from file"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLayout_MappingFileErrors(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	mappingFile := filepath.Join(tempDir, "mappings")
+	path1 := filepath.Join(tempDir, "1")
+	utils.MustWriteFile(t, path1, 0644, "")
+
+	testData := []struct {
+		name string
+
+		contents       string
+		extraArgs      []string
+		wantExitStatus int
+		wantStderr     string
+	}{
+		{
+			"BadSyntax",
+			"ro:/:" + tempDir + "\n# Comment\nro:/foo\n",
+			[]string{},
+			2,
+			mappingFile + ":3: bad mapping ro:/foo: expected three or four colon-separated fields",
+		},
+		{
+			"DuplicateWithinFile",
+			"ro:/:" + tempDir + "\nro:/a:" + path1 + "\nro:/a:" + path1 + "\n",
+			[]string{},
+			1,
+			"Cannot map .*'/a .* Already mapped\n",
+		},
+		{
+			"DuplicateWithCommandLine",
+			"ro:/:" + tempDir + "\nro:/a:" + path1 + "\n",
+			[]string{"--mapping=ro:/a:" + path1},
+			1,
+			"Cannot map .*'/a .* Already mapped\n",
+		},
+	}
+	for _, d := range testData {
+		t.Run(d.name, func(t *testing.T) {
+			utils.MustWriteFile(t, mappingFile, 0644, d.contents)
+
+			args := append([]string{"--mapping_file=" + mappingFile}, d.extraArgs...)
+			args = append(args, "irrelevant-mount-point")
+			stdout, stderr, err := utils.RunAndWait(d.wantExitStatus, args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stdout) > 0 {
+				t.Errorf("Got %s; want stdout to be empty", stdout)
+			}
+			if !utils.MatchesRegexp(d.wantStderr, stderr) {
+				t.Errorf("Got %s; want stderr to match %s", stderr, d.wantStderr)
+			}
+		})
+	}
+}
+
+func TestLayout_MappingFileDoesNotExist(t *testing.T) {
+	wantStderr := "Failed to open mapping file '/non-existent'.*No such file"
+
+	stdout, stderr, err := utils.RunAndWait(1, "--mapping_file=/non-existent", "irrelevant-mount-point")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stdout) > 0 {
+		t.Errorf("Got %s; want stdout to be empty", stdout)
+	}
+	if !utils.MatchesRegexp(wantStderr, stderr) {
+		t.Errorf("Got %s; want stderr to match %s", stderr, wantStderr)
+	}
+}
+
+func TestLayout_MappingManifest(t *testing.T) {
+	// Same as in TestLayout_MappingFile: the manifest refers to files in the root directory so
+	// it has to be staged from the root setup hook.
+	rootSetup := func(root string) error {
+		if err := ioutil.WriteFile(filepath.Join(root, "a"), []byte("file a"), 0644); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, "b c"), []byte("file b c"), 0644); err != nil {
+			return err
+		}
+		contents := "ws/a " + filepath.Join(root, "a") + "\n" +
+			" ws/sub/b\\sc " + filepath.Join(root, "b c") + "\n" +
+			"ws/__init__.py\n"
+		return ioutil.WriteFile(filepath.Join(root, "..", "MANIFEST"), []byte(contents), 0644)
+	}
+	state := utils.MountSetupWithRootSetup(t, rootSetup, "--mapping_manifest=%ROOT%/../MANIFEST:/runfiles")
+	defer state.TearDown(t)
+
+	if err := utils.FileEquals(state.MountPath("runfiles/ws/a"), "file a"); err != nil {
+		t.Error(err)
+	}
+	if err := utils.FileEquals(state.MountPath("runfiles/ws/sub/b c"), "file b c"); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Lstat(state.MountPath("runfiles/ws/__init__.py")); !os.IsNotExist(err) {
+		t.Errorf("Want entry for empty file to be skipped; got %v", err)
+	}
+	if err := ioutil.WriteFile(state.MountPath("runfiles/ws/a"), []byte("new"), 0644); err == nil {
+		t.Errorf("Write to file mapped from manifest succeeded; want it to be read-only")
+	}
+}
+
+func TestLayout_MappingManifestErrors(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	manifest := filepath.Join(tempDir, "MANIFEST")
+	path1 := filepath.Join(tempDir, "1")
+	utils.MustWriteFile(t, path1, 0644, "")
+
+	testData := []struct {
+		name string
+
+		contents       string
+		arg            string
+		wantExitStatus int
+		wantStderr     string
+	}{
+		{
+			"BadEntry",
+			"ws/1 " + path1 + "\nws/2 relative\n",
+			manifest,
+			2,
+			manifest + ":2: target relative is not absolute",
+		},
+		{
+			"BadPrefix",
+			"ws/1 " + path1 + "\n",
+			manifest + ":runfiles",
+			2,
+			"bad --mapping_manifest .*: prefix runfiles is not absolute",
+		},
+		{
+			"MissingTarget",
+			"ws/1 " + path1 + "\nws/2 /non-existent\n",
+			manifest,
+			1,
+			"Cannot map '/ws/2 .*/non-existent",
+		},
+		{
+			"DoesNotExist",
+			"",
+			"/non-existent",
+			1,
+			"Failed to open manifest '/non-existent'.*No such file",
+		},
+	}
+	for _, d := range testData {
+		t.Run(d.name, func(t *testing.T) {
+			utils.MustWriteFile(t, manifest, 0644, d.contents)
+
+			stdout, stderr, err := utils.RunAndWait(d.wantExitStatus, "--mapping_manifest="+d.arg, "irrelevant-mount-point")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stdout) > 0 {
+				t.Errorf("Got %s; want stdout to be empty", stdout)
+			}
+			if !utils.MatchesRegexp(d.wantStderr, stderr) {
+				t.Errorf("Got %s; want stderr to match %s", stderr, d.wantStderr)
+			}
+		})
+	}
+}
+
+func BenchmarkLayout_ManyMappings(b *testing.B) {
+	const numMappings = 50000
+	const numTargets = 1000
+
+	rootSetup := func(root string) error {
+		var contents strings.Builder
+		for i := 0; i < numTargets; i++ {
+			if err := os.MkdirAll(filepath.Join(root, fmt.Sprintf("t%d", i)), 0755); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < numMappings; i++ {
+			target := filepath.Join(root, fmt.Sprintf("t%d", i%numTargets))
+			fmt.Fprintf(&contents, "ro:/d%d/m%d:%s\n", i%100, i, target)
+		}
+		return ioutil.WriteFile(filepath.Join(root, "..", "mappings"), []byte(contents.String()), 0644)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		state := utils.MountSetupWithRootSetup(b, rootSetup, "--mapping_file=%ROOT%/../mappings")
+		if err := state.TearDown(b); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License.  You may obtain a copy
+// of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.  See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package integration
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/bazelbuild/sandboxfs/integration/utils"
+)
+
+func TestMemory_StartsEmpty(t *testing.T) {
+	state := utils.MountSetup(t, "--mapping=ro:/:%ROOT%", "--mapping=tmp:/tmp")
+	defer state.TearDown(t)
+
+	if names := readDirNames(t, state.MountPath("tmp")); len(names) != 0 {
+		t.Errorf("Got entries %v in new in-memory mapping; want none", names)
+	}
+	fileInfo, err := os.Lstat(state.MountPath("tmp"))
+	if err != nil {
+		t.Fatalf("Lstat failed: %v", err)
+	}
+	if fileInfo.Mode() != os.ModeDir|os.ModeSticky|0777 {
+		t.Errorf("Got mode %v for in-memory mapping; want drwxrwxrwt", fileInfo.Mode())
+	}
+}
+
+func TestMemory_CreateReadWrite(t *testing.T) {
+	state := utils.MountSetup(t, "--mapping=ro:/:%ROOT%", "--mapping=tmp:/tmp")
+	defer state.TearDown(t)
+
+	if err := os.MkdirAll(state.MountPath("tmp/dir/subdir"), 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	if err := ioutil.WriteFile(state.MountPath("tmp/dir/file"), []byte("first"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := utils.FileEquals(state.MountPath("tmp/dir/file"), "first"); err != nil {
+		t.Error(err)
+	}
+
+	file, err := os.OpenFile(state.MountPath("tmp/dir/file"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	if _, err := file.WriteString(" and second"); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := utils.FileEquals(state.MountPath("tmp/dir/file"), "first and second"); err != nil {
+		t.Error(err)
+	}
+
+	if err := os.Symlink("file", state.MountPath("tmp/dir/link")); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	if err := utils.FileEquals(state.MountPath("tmp/dir/link"), "first and second"); err != nil {
+		t.Error(err)
+	}
+
+	if names := readDirNames(t, state.MountPath("tmp/dir")); !reflect.DeepEqual([]string{"file", "link", "subdir"}, names) {
+		t.Errorf("Got entries %v; want file, link and subdir", names)
+	}
+	if names := readDirNames(t, state.RootPath()); len(names) != 0 {
+		t.Errorf("In-memory mapping leaked files to the host: %v", names)
+	}
+}
+
+func TestMemory_RemoveAndRename(t *testing.T) {
+	state := utils.MountSetup(t, "--mapping=ro:/:%ROOT%", "--mapping=tmp:/tmp")
+	defer state.TearDown(t)
+
+	utils.MustMkdirAll(t, state.MountPath("tmp/dir1"), 0755)
+	utils.MustMkdirAll(t, state.MountPath("tmp/dir2"), 0755)
+	utils.MustWriteFile(t, state.MountPath("tmp/dir1/file"), 0644, "contents")
+
+	if err := unix.Rmdir(state.MountPath("tmp/dir1")); err != unix.ENOTEMPTY {
+		t.Errorf("Want rmdir of non-empty directory to fail with ENOTEMPTY; got %v", err)
+	}
+
+	if err := os.Rename(state.MountPath("tmp/dir1/file"), state.MountPath("tmp/dir2/moved")); err != nil {
+		t.Fatalf("Rename across directories failed: %v", err)
+	}
+	if err := os.Rename(state.MountPath("tmp/dir2/moved"), state.MountPath("tmp/dir2/renamed")); err != nil {
+		t.Fatalf("Rename within directory failed: %v", err)
+	}
+	if err := utils.FileEquals(state.MountPath("tmp/dir2/renamed"), "contents"); err != nil {
+		t.Error(err)
+	}
+	if names := readDirNames(t, state.MountPath("tmp/dir1")); len(names) != 0 {
+		t.Errorf("Got entries %v after moving them away; want none", names)
+	}
+
+	if err := os.Remove(state.MountPath("tmp/dir1")); err != nil {
+		t.Errorf("Remove of empty directory failed: %v", err)
+	}
+	if err := os.Remove(state.MountPath("tmp/dir2/renamed")); err != nil {
+		t.Errorf("Remove of file failed: %v", err)
+	}
+	if _, err := os.Lstat(state.MountPath("tmp/dir2/renamed")); !os.IsNotExist(err) {
+		t.Errorf("Removed file is still visible: %v", err)
+	}
+}
+
+func TestMemory_SizeLimit(t *testing.T) {
+	state := utils.MountSetup(t, "--mapping=ro:/:%ROOT%", "--mapping=tmp:/tmp:1K")
+	defer state.TearDown(t)
+
+	contents := bytes.Repeat([]byte("x"), 1000)
+	if err := ioutil.WriteFile(state.MountPath("tmp/file1"), contents, 0644); err != nil {
+		t.Fatalf("WriteFile within the limit failed: %v", err)
+	}
+	err := ioutil.WriteFile(state.MountPath("tmp/file2"), contents, 0644)
+	if pathErr, ok := err.(*os.PathError); !ok || pathErr.Err != unix.ENOSPC {
+		t.Errorf("Want write beyond the limit to fail with ENOSPC; got %v", err)
+	}
+
+	// Deleting files must give their space back.
+	if err := os.Remove(state.MountPath("tmp/file1")); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := ioutil.WriteFile(state.MountPath("tmp/file2"), contents, 0644); err != nil {
+		t.Errorf("WriteFile after freeing space failed: %v", err)
+	}
+}
+
+func TestMemory_RenameAcrossMappingsFails(t *testing.T) {
+	state := utils.MountSetup(t, "--mapping=ro:/:%ROOT%", "--mapping=rw:/rw:%ROOT%", "--mapping=tmp:/tmp")
+	defer state.TearDown(t)
+
+	utils.MustWriteFile(t, state.RootPath("file"), 0644, "on disk")
+	utils.MustWriteFile(t, state.MountPath("tmp/file"), 0644, "in memory")
+
+	for _, paths := range [][2]string{{"tmp/file", "rw/file2"}, {"rw/file", "tmp/file2"}} {
+		err := os.Rename(state.MountPath(paths[0]), state.MountPath(paths[1]))
+		if linkErr, ok := err.(*os.LinkError); !ok || linkErr.Err != unix.EXDEV {
+			t.Errorf("Want rename of %s to %s to fail with EXDEV; got %v", paths[0], paths[1], err)
+		}
+	}
+}
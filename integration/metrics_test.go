@@ -0,0 +1,338 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License.  You may obtain a copy
+// of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.  See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bazelbuild/sandboxfs/client"
+	"github.com/bazelbuild/sandboxfs/integration/utils"
+)
+
+// freeAddress returns a local address with a port that is not currently in use.
+func freeAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// fetch issues a GET request against the given URL and returns the status code and body.
+func fetch(url string) (int, string, error) {
+	response, err := http.Get(url)
+	if err != nil {
+		return 0, "", err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return 0, "", err
+	}
+	return response.StatusCode, string(body), nil
+}
+
+func TestMetrics_Export(t *testing.T) {
+	address := freeAddress(t)
+	state := utils.MountSetup(t, "--listen_address="+address, "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(t)
+
+	utils.MustWriteFile(t, state.RootPath("file"), 0644, "some content")
+	if _, err := os.Lstat(state.MountPath("file")); err != nil {
+		t.Fatalf("Lstat failed: %v", err)
+	}
+	if _, err := ioutil.ReadFile(state.MountPath("file")); err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if _, err := os.Lstat(state.MountPath("missing")); !os.IsNotExist(err) {
+		t.Fatalf("Lstat of missing file returned %v; want not found", err)
+	}
+
+	status, body, err := fetch(fmt.Sprintf("http://%s/metrics", address))
+	if err != nil {
+		t.Fatalf("Failed to fetch metrics: %v", err)
+	}
+	if status != http.StatusOK {
+		t.Errorf("Got status %d; want %d", status, http.StatusOK)
+	}
+	for _, want := range []string{
+		`sandboxfs_operations_total{op="lookup"} `,
+		`sandboxfs_operations_total{op="read"} `,
+		`sandboxfs_errors_total{errno="ENOENT"} `,
+		`sandboxfs_read_size_bytes_count `,
+		`sandboxfs_nodes `,
+		`sandboxfs_open_handles `,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Metrics do not contain %q; got:\n%s", want, body)
+		}
+	}
+}
+
+// fetchNodes queries the metrics served at address and returns the value of the nodes gauge.
+func fetchNodes(t *testing.T, address string) int {
+	_, body, err := fetch(fmt.Sprintf("http://%s/metrics", address))
+	if err != nil {
+		t.Fatalf("Failed to fetch metrics: %v", err)
+	}
+	match := regexp.MustCompile(`(?m)^sandboxfs_nodes (\d+)$`).FindStringSubmatch(body)
+	if match == nil {
+		t.Fatalf("Metrics do not contain the nodes gauge; got:\n%s", body)
+	}
+	nodes, err := strconv.Atoi(match[1])
+	if err != nil {
+		t.Fatalf("Invalid nodes gauge %s: %v", match[1], err)
+	}
+	return nodes
+}
+
+func TestMetrics_NodesReleasedOnForget(t *testing.T) {
+	address := freeAddress(t)
+	state := utils.MountSetup(t, "--listen_address="+address, "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(t)
+
+	const numFiles = 1000
+	utils.MustMkdirAll(t, state.RootPath("dir"), 0755)
+	for i := 0; i < numFiles; i++ {
+		utils.MustWriteFile(t, state.RootPath("dir", fmt.Sprintf("file%d", i)), 0644, "")
+	}
+	for i := 0; i < numFiles; i++ {
+		if _, err := os.Lstat(state.MountPath("dir", fmt.Sprintf("file%d", i))); err != nil {
+			t.Fatalf("Lstat failed: %v", err)
+		}
+	}
+	if nodes := fetchNodes(t, address); nodes < numFiles {
+		t.Fatalf("Got %d nodes after visiting %d files; want at least as many", nodes, numFiles)
+	}
+
+	// Ask the kernel to evict its dentries and inodes, which makes it send forget requests for
+	// all the nodes that are not in use.
+	if err := ioutil.WriteFile("/proc/sys/vm/drop_caches", []byte("2"), 0); err != nil {
+		t.Skipf("Cannot drop kernel caches: %v", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		nodes := fetchNodes(t, address)
+		if nodes < numFiles/2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Got %d nodes after dropping kernel caches; want them released", nodes)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Files must be reachable again once their nodes have been released.
+	for i := 0; i < numFiles; i += 100 {
+		if _, err := os.Lstat(state.MountPath("dir", fmt.Sprintf("file%d", i))); err != nil {
+			t.Errorf("Lstat after release failed: %v", err)
+		}
+	}
+}
+
+func TestMetrics_UnknownPath(t *testing.T) {
+	address := freeAddress(t)
+	state := utils.MountSetup(t, "--listen_address="+address, "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(t)
+
+	status, _, err := fetch(fmt.Sprintf("http://%s/foo", address))
+	if err != nil {
+		t.Fatalf("Failed to fetch metrics: %v", err)
+	}
+	if status != http.StatusNotFound {
+		t.Errorf("Got status %d; want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestMetrics_HealthChecks(t *testing.T) {
+	address := freeAddress(t)
+	state := utils.MountSetup(t, "--listen_address="+address, "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(t)
+
+	check := func(path string, wantStatus int, wantBody string) {
+		t.Helper()
+		status, body, err := fetch(fmt.Sprintf("http://%s%s", address, path))
+		if err != nil {
+			t.Fatalf("Failed to fetch %s: %v", path, err)
+		}
+		if status != wantStatus {
+			t.Errorf("Got status %d for %s; want %d", status, path, wantStatus)
+		}
+		if !utils.MatchesRegexp(wantBody, body) {
+			t.Errorf("Got body %q for %s; want it to match %s", body, path, wantBody)
+		}
+	}
+
+	check("/healthz", http.StatusOK, "^OK\n$")
+	check("/readyz", http.StatusOK, "^OK\n$")
+
+	// Moving the root directory away makes the self-check fail, but the file system is still
+	// serving so it remains healthy.
+	if err := os.Rename(state.RootPath(), state.TempPath("moved")); err != nil {
+		t.Fatalf("Failed to move root directory: %v", err)
+	}
+	check("/healthz", http.StatusOK, "^OK\n$")
+	check("/readyz", http.StatusServiceUnavailable, "Cannot get attributes of root")
+
+	if err := os.Rename(state.TempPath("moved"), state.RootPath()); err != nil {
+		t.Fatalf("Failed to restore root directory: %v", err)
+	}
+	check("/readyz", http.StatusOK, "^OK\n$")
+}
+
+func TestMetrics_Stats(t *testing.T) {
+	address := freeAddress(t)
+	state := utils.MountSetup(t, "--listen_address="+address, "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(t)
+
+	for i := 0; i < 10; i++ {
+		if _, err := os.Lstat(state.MountPath("missing")); !os.IsNotExist(err) {
+			t.Fatalf("Lstat of missing file returned %v; want not found", err)
+		}
+	}
+
+	status, body, err := fetch(fmt.Sprintf("http://%s/stats?format=json", address))
+	if err != nil {
+		t.Fatalf("Failed to fetch stats: %v", err)
+	}
+	if status != http.StatusOK {
+		t.Errorf("Got status %d; want %d", status, http.StatusOK)
+	}
+	type summary struct {
+		Count  int  `json:"count"`
+		Errors int  `json:"errors"`
+		P50    *int `json:"p50_us"`
+		P90    *int `json:"p90_us"`
+		P99    *int `json:"p99_us"`
+	}
+	var stats struct {
+		WindowSeconds int `json:"window_seconds"`
+		Ops           []struct {
+			Op         string  `json:"op"`
+			Lifetime   summary `json:"lifetime"`
+			LastMinute summary `json:"last_minute"`
+		} `json:"ops"`
+	}
+	if err := json.Unmarshal([]byte(body), &stats); err != nil {
+		t.Fatalf("Failed to parse stats %q: %v", body, err)
+	}
+	if stats.WindowSeconds != 60 {
+		t.Errorf("Got window of %d seconds; want 60", stats.WindowSeconds)
+	}
+	found := false
+	for _, op := range stats.Ops {
+		if op.Op != "lookup" {
+			continue
+		}
+		found = true
+		for name, s := range map[string]summary{"lifetime": op.Lifetime, "last minute": op.LastMinute} {
+			if s.Count < 10 || s.Errors < 10 {
+				t.Errorf("Got %d lookups with %d errors over the %s; want at least 10 of each", s.Count, s.Errors, name)
+			}
+			if s.P50 == nil || s.P90 == nil || s.P99 == nil || *s.P50 > *s.P90 || *s.P90 > *s.P99 {
+				t.Errorf("Got invalid percentiles %v, %v and %v over the %s", s.P50, s.P90, s.P99, name)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Stats do not contain lookups; got:\n%s", body)
+	}
+
+	status, body, err = fetch(fmt.Sprintf("http://%s/stats", address))
+	if err != nil {
+		t.Fatalf("Failed to fetch stats: %v", err)
+	}
+	if status != http.StatusOK {
+		t.Errorf("Got status %d; want %d", status, http.StatusOK)
+	}
+	if !strings.Contains(body, "<td>lookup</td>") {
+		t.Errorf("Stats page does not contain lookups; got:\n%s", body)
+	}
+
+	status, _, err = fetch(fmt.Sprintf("http://%s/stats?format=xml", address))
+	if err != nil {
+		t.Fatalf("Failed to fetch stats: %v", err)
+	}
+	if status != http.StatusBadRequest {
+		t.Errorf("Got status %d; want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestMetrics_Config(t *testing.T) {
+	address := freeAddress(t)
+	rootSetup := func(root string) error {
+		return os.Mkdir(filepath.Join(root, "dir"), 0755)
+	}
+	state := utils.MountSetupWithRootSetup(t, rootSetup, "--listen_address="+address, "--ttl=7s", "--negative_ttl=3s", "--mapping=ro:/:%ROOT%", "--mapping=rw:/rw:%ROOT%/dir")
+	defer state.TearDown(t)
+
+	status, body, err := fetch(fmt.Sprintf("http://%s/config", address))
+	if err != nil {
+		t.Fatalf("Failed to fetch config: %v", err)
+	}
+	if status != http.StatusOK {
+		t.Errorf("Got status %d; want %d", status, http.StatusOK)
+	}
+	var config struct {
+		MountPoint         string                 `json:"mount_point"`
+		Options            []string               `json:"options"`
+		Allow              string                 `json:"allow"`
+		TTLSeconds         int                    `json:"ttl_seconds"`
+		NegativeTTLSeconds int                    `json:"negative_ttl_seconds"`
+		Mappings           []client.ActiveMapping `json:"mappings"`
+	}
+	if err := json.Unmarshal([]byte(body), &config); err != nil {
+		t.Fatalf("Failed to parse config %q: %v", body, err)
+	}
+
+	if config.MountPoint != state.MountPath() {
+		t.Errorf("Got mount point %s; want %s", config.MountPoint, state.MountPath())
+	}
+	found := false
+	for _, option := range config.Options {
+		if option == "default_permissions" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Got options %v; want them to include default_permissions", config.Options)
+	}
+	if config.Allow != "self" {
+		t.Errorf("Got allow %s; want self", config.Allow)
+	}
+	if config.TTLSeconds != 7 || config.NegativeTTLSeconds != 3 {
+		t.Errorf("Got TTLs %d and %d; want 7 and 3", config.TTLSeconds, config.NegativeTTLSeconds)
+	}
+	wantMappings := []client.ActiveMapping{
+		{Path: "/", UnderlyingPath: state.RootPath()},
+		{Path: "/rw", UnderlyingPath: state.RootPath("dir"), Writable: true},
+	}
+	if !reflect.DeepEqual(wantMappings, config.Mappings) {
+		t.Errorf("Got mappings %+v; want %+v", config.Mappings, wantMappings)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License.  You may obtain a copy
+// of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.  See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package integration
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/bazelbuild/sandboxfs/integration/utils"
+)
+
+// checkMode verifies that the file at path has the given permissions.
+func checkMode(t *testing.T, path string, wantPerm os.FileMode) {
+	t.Helper()
+	fileInfo, err := os.Lstat(path)
+	if err != nil {
+		t.Fatalf("Cannot stat %s: %v", path, err)
+	}
+	if fileInfo.Mode().Perm() != wantPerm {
+		t.Errorf("%s has wrong permissions; got %v, want %v", path, fileInfo.Mode().Perm(), wantPerm)
+	}
+}
+
+func TestNoexec_ExecuteBitsHidden(t *testing.T) {
+	rootSetup := func(root string) error {
+		if err := os.MkdirAll(filepath.Join(root, "deps/sub"), 0755); err != nil {
+			return err
+		}
+		return os.MkdirAll(filepath.Join(root, "out"), 0755)
+	}
+	state := utils.MountSetupWithRootSetup(t, rootSetup, "--mapping=ro:/:%ROOT%", "--mapping=ro:/deps:%ROOT%/deps:noexec", "--mapping=rw:/out:%ROOT%/out:noexec")
+	defer state.TearDown(t)
+
+	utils.MustWriteFile(t, state.RootPath("deps/sub/tool"), 0755, "#!/bin/sh\nexit 0\n")
+	utils.MustWriteFile(t, state.RootPath("tool"), 0755, "#!/bin/sh\nexit 0\n")
+
+	checkMode(t, state.MountPath("deps/sub/tool"), 0644)
+	checkMode(t, state.MountPath("deps/sub"), 0755)
+	checkMode(t, state.MountPath("deps"), 0755)
+	// Files outside of the mapping keep their permissions.
+	checkMode(t, state.MountPath("tool"), 0755)
+
+	// Files created within a writable mapping keep their permissions in the target.
+	utils.MustWriteFile(t, state.MountPath("out/new"), 0755, "#!/bin/sh\nexit 0\n")
+	checkMode(t, state.MountPath("out/new"), 0644)
+	checkMode(t, state.RootPath("out/new"), 0755)
+}
+
+func TestNoexec_ExecutionFails(t *testing.T) {
+	rootSetup := func(root string) error {
+		return os.MkdirAll(filepath.Join(root, "deps"), 0755)
+	}
+	state := utils.MountSetupWithRootSetup(t, rootSetup, "--mapping=ro:/:%ROOT%", "--mapping=ro:/deps:%ROOT%/deps:noexec")
+	defer state.TearDown(t)
+
+	utils.MustWriteFile(t, state.RootPath("deps/tool"), 0755, "#!/bin/sh\nexit 0\n")
+
+	err := exec.Command(state.MountPath("deps/tool")).Run()
+	if !os.IsPermission(err) {
+		t.Errorf("Want executing a file within a noexec mapping to fail with a permission error; got %v", err)
+	}
+}
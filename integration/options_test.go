@@ -15,11 +15,25 @@
 package integration
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/bazelbuild/sandboxfs/client"
 	"github.com/bazelbuild/sandboxfs/integration/utils"
 )
 
@@ -38,48 +52,20 @@ func TestOptions_Allow(t *testing.T) {
 	}
 	t.Logf("Using secondary unprivileged user: %v", other)
 
-	var allowRootWorks bool
-	switch runtime.GOOS {
-	case "darwin":
-		allowRootWorks = true
-	case "linux":
-		allowRootWorks = false
-	default:
-		t.Fatalf("Don't know how this test behaves in this platform")
-	}
-
 	testData := []struct {
 		name string
 
-		allowFlag   string
-		wantMountOk bool
-		okUsers     []*utils.UnixUser
-		notOkUsers  []*utils.UnixUser
+		allowFlag  string
+		okUsers    []*utils.UnixUser
+		notOkUsers []*utils.UnixUser
 	}{
-		{"Default", "", true, []*utils.UnixUser{user}, []*utils.UnixUser{root, other}},
-		{"Other", "--allow=other", true, []*utils.UnixUser{user, other, root}, []*utils.UnixUser{}},
-		{"Root", "--allow=root", allowRootWorks, []*utils.UnixUser{user, root}, []*utils.UnixUser{other}},
-		{"Self", "--allow=self", true, []*utils.UnixUser{user}, []*utils.UnixUser{root, other}},
+		{"Default", "", []*utils.UnixUser{user}, []*utils.UnixUser{root, other}},
+		{"Other", "--allow=other", []*utils.UnixUser{user, other, root}, []*utils.UnixUser{}},
+		{"Root", "--allow=root", []*utils.UnixUser{user, root}, []*utils.UnixUser{other}},
+		{"Self", "--allow=self", []*utils.UnixUser{user}, []*utils.UnixUser{root, other}},
 	}
 	for _, d := range testData {
 		t.Run(d.name, func(t *testing.T) {
-			tempDir, err := ioutil.TempDir("", "test")
-			if err != nil {
-				t.Fatalf("Failed to create temporary directory: %v", err)
-			}
-			defer os.RemoveAll(tempDir)
-
-			if !d.wantMountOk {
-				_, stderr, err := utils.RunAndWait(1, d.allowFlag, "--mapping=ro:/:/", tempDir)
-				if err != nil {
-					t.Fatal(err)
-				}
-				if !utils.MatchesRegexp("known.*broken", stderr) {
-					t.Errorf("Want error message to mention known brokenness; got %v", stderr)
-				}
-				return
-			}
-
 			args := []string{"--mapping=ro:/:%ROOT%"}
 			if d.allowFlag != "" {
 				args = append(args, d.allowFlag)
@@ -106,6 +92,1400 @@ func TestOptions_Allow(t *testing.T) {
 	}
 }
 
+func TestOptions_AllowedTargets(t *testing.T) {
+	outside, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(outside)
+
+	stdoutReader, stdoutWriter := io.Pipe()
+	state := utils.MountSetupWithOutputs(t, stdoutWriter, os.Stderr, "--allowed_targets=%ROOT%", "--mapping=rw:/:%ROOT%")
+	defer stdoutReader.Close() // Just in case the test fails half-way through.
+	defer state.TearDown(t)
+	defer stdoutWriter.Close() // Just in case the test fails half-way through.
+
+	utils.MustMkdirAll(t, state.RootPath("dir"), 0755)
+	utils.MustSymlink(t, outside, state.RootPath("link"))
+
+	c := client.New(state.Stdin, stdoutReader)
+	if err := c.Map("ok", []client.Mapping{{Path: "/dir", UnderlyingPath: state.RootPath("dir")}}); err != nil {
+		t.Fatalf("Want mapping a target within the allowed ones to work; got %v", err)
+	}
+
+	testData := []struct {
+		name string
+
+		underlyingPath string
+		wantError      string
+	}{
+		{"Outside", outside, "is not within any of the --allowed_targets"},
+		{"SymlinkToOutside", state.RootPath("link"), "resolves to.*which is not within any of the --allowed_targets"},
+	}
+	for _, d := range testData {
+		t.Run(d.name, func(t *testing.T) {
+			err := c.Map("sb", []client.Mapping{{Path: "/dir", UnderlyingPath: d.underlyingPath}})
+			if err == nil {
+				t.Errorf("Want reconfiguration to respond with %s; got OK", d.wantError)
+			} else if !utils.MatchesRegexp(d.wantError, err.Error()) {
+				t.Errorf("Want reconfiguration to respond with %s; got %v", d.wantError, err)
+			}
+		})
+	}
+}
+
+func TestOptions_AllowedTargetsDeferredTargets(t *testing.T) {
+	outside, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(outside)
+
+	stdoutReader, stdoutWriter := io.Pipe()
+	state := utils.MountSetupWithOutputs(t, stdoutWriter, os.Stderr, "--allowed_targets=%ROOT%", "--mapping=rw:/:%ROOT%")
+	defer stdoutReader.Close() // Just in case the test fails half-way through.
+	defer state.TearDown(t)
+	defer stdoutWriter.Close() // Just in case the test fails half-way through.
+
+	// Neither target exists yet, so they can only be checked against the allowed targets once
+	// they appear.
+	mappings := []client.Mapping{
+		{Path: "/optional", UnderlyingPath: state.RootPath("optional"), Optional: true},
+		{Path: "/lazy", UnderlyingPath: state.RootPath("lazy"), Lazy: true},
+	}
+	if err := client.New(state.Stdin, stdoutReader).Map("sb", mappings); err != nil {
+		t.Fatalf("Want mapping missing targets within the allowed ones to work; got %v", err)
+	}
+
+	utils.MustSymlink(t, outside, state.RootPath("optional"))
+	utils.MustSymlink(t, outside, state.RootPath("lazy"))
+	for _, name := range []string{"optional", "lazy"} {
+		_, err := os.Lstat(state.MountPath("sb", name))
+		if pathErr, ok := err.(*os.PathError); !ok || pathErr.Err != syscall.EACCES {
+			t.Errorf("Want lookup of %s resolving outside of the allowed targets to fail with EACCES; got %v", name, err)
+		}
+	}
+
+	for _, name := range []string{"optional", "lazy"} {
+		if err := os.Remove(state.RootPath(name)); err != nil {
+			t.Fatalf("Failed to remove symlink: %v", err)
+		}
+		utils.MustMkdirAll(t, state.RootPath(name), 0755)
+		if _, err := os.Lstat(state.MountPath("sb", name)); err != nil {
+			t.Errorf("Want lookup of %s resolving within the allowed targets to work; got %v", name, err)
+		}
+	}
+}
+
+func TestOptions_AllowedTargetsOnStartup(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	utils.MustMkdirAll(t, filepath.Join(tempDir, "allowed"), 0755)
+	utils.MustMkdirAll(t, filepath.Join(tempDir, "other"), 0755)
+
+	allowed := "--allowed_targets=" + filepath.Join(tempDir, "allowed")
+	target := "--mapping=ro:/:" + filepath.Join(tempDir, "allowed/../other")
+	_, stderr, err := utils.RunAndWait(1, allowed, target, "irrelevant-mount-point")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !utils.MatchesRegexp("Failed to map root.*which is not within any of the --allowed_targets", stderr) {
+		t.Errorf("Got %s; want stderr to mention that the target is not allowed", stderr)
+	}
+}
+
+// findMount scans /proc/mounts for the entry that describes mountPoint and returns its fields,
+// which are the source, the mount point, the type and the options, among others.
+func findMount(mountPoint string) ([]string, error) {
+	file, err := os.Open("/proc/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 4 && fields[1] == mountPoint {
+			return fields, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, os.ErrNotExist
+}
+
+func TestOptions_FsNameAndSubtype(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skipf("Requires /proc/mounts, which only exists on Linux")
+	}
+
+	testData := []struct {
+		name string
+
+		args       []string
+		wantFsName string
+		wantFsType string
+	}{
+		{"Defaults", []string{}, "sandboxfs", "fuse.sandboxfs"},
+		{"EmptyValues", []string{"--fs_name=", "--subtype="}, "sandboxfs", "fuse.sandboxfs"},
+		{"Custom", []string{"--fs_name=worker-1", "--subtype=build"}, "worker-1", "fuse.build"},
+	}
+	for _, d := range testData {
+		t.Run(d.name, func(t *testing.T) {
+			args := append([]string{"--mapping=ro:/:%ROOT%"}, d.args...)
+			state := utils.MountSetup(t, args...)
+			defer state.TearDown(t)
+
+			fields, err := findMount(state.MountPath())
+			if err != nil {
+				t.Fatalf("Cannot find %s in the mount table: %v", state.MountPath(), err)
+			}
+			fsName, fsType := fields[0], fields[2]
+			if fsName != d.wantFsName {
+				t.Errorf("Got file system name %s; want %s", fsName, d.wantFsName)
+			}
+			if fsType != d.wantFsType {
+				t.Errorf("Got file system type %s; want %s", fsType, d.wantFsType)
+			}
+		})
+	}
+}
+
+func TestOptions_MaxReadBytes(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skipf("Requires /proc/mounts, which only exists on Linux")
+	}
+
+	state := utils.MountSetup(t, "--max_read_bytes=64K", "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(t)
+
+	fields, err := findMount(state.MountPath())
+	if err != nil {
+		t.Fatalf("Cannot find %s in the mount table: %v", state.MountPath(), err)
+	}
+	options := strings.Split(fields[3], ",")
+	found := false
+	for _, option := range options {
+		if option == "max_read=65536" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Got mount options %v; want them to contain max_read=65536", options)
+	}
+
+	utils.MustWriteFile(t, state.RootPath("file"), 0644, strings.Repeat("x", 1<<20))
+	if err := utils.FileEquals(state.MountPath("file"), strings.Repeat("x", 1<<20)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOptions_FuseOption(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skipf("Options under test are only supported on Linux")
+	}
+
+	t.Run("Nonempty", func(t *testing.T) {
+		rootSetup := func(root string) error {
+			return ioutil.WriteFile(filepath.Join(root, "../mnt/stray"), []byte{}, 0644)
+		}
+		state := utils.MountSetupWithRootSetup(t, rootSetup, "--fuse_option=nonempty", "--mapping=ro:/:%ROOT%")
+		defer state.TearDown(t)
+
+		if err := utils.DirEntryNamesEqual(state.MountPath(), nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("AutoUnmount", func(t *testing.T) {
+		state := utils.MountSetup(t, "--fuse_option=auto_unmount", "--mapping=ro:/:%ROOT%")
+		defer state.TearDown(t)
+
+		utils.MustWriteFile(t, state.RootPath("file"), 0644, "contents")
+		if err := utils.FileEquals(state.MountPath("file"), "contents"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Noatime", func(t *testing.T) {
+		state := utils.MountSetup(t, "--fuse_option=noatime", "--mapping=ro:/:%ROOT%")
+		defer state.TearDown(t)
+
+		fields, err := findMount(state.MountPath())
+		if err != nil {
+			t.Fatalf("Cannot find %s in the mount table: %v", state.MountPath(), err)
+		}
+		options := strings.Split(fields[3], ",")
+		found := false
+		for _, option := range options {
+			if option == "noatime" {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Got mount options %v; want them to contain noatime", options)
+		}
+	})
+}
+
+func TestOptions_Nonempty(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		stdout, stderr, err := utils.RunAndWait(2, "--nonempty")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stdout) > 0 {
+			t.Errorf("Got %s; want stdout to be empty", stdout)
+		}
+		if !strings.Contains(stderr, "--nonempty is only supported on Linux") {
+			t.Errorf("Got %s; want stderr to mention that --nonempty is Linux only", stderr)
+		}
+		return
+	}
+
+	rootSetup := func(root string) error {
+		return ioutil.WriteFile(filepath.Join(root, "../mnt/stray"), []byte("stray"), 0644)
+	}
+	state := utils.MountSetupWithRootSetup(t, rootSetup, "--nonempty", "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(t)
+
+	utils.MustWriteFile(t, state.RootPath("file"), 0644, "")
+	if err := utils.DirEntryNamesEqual(state.MountPath(), []string{"file"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOptions_AutoUnmount(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		stdout, stderr, err := utils.RunAndWait(2, "--auto_unmount")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stdout) > 0 {
+			t.Errorf("Got %s; want stdout to be empty", stdout)
+		}
+		if !strings.Contains(stderr, "--auto_unmount is only supported on Linux") {
+			t.Errorf("Got %s; want stderr to mention that --auto_unmount is Linux only", stderr)
+		}
+		return
+	}
+
+	state := utils.MountSetup(t, "--auto_unmount", "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(t)
+	utils.MustWriteFile(t, state.RootPath("file"), 0644, "")
+
+	if err := state.Cmd.Process.Kill(); err != nil {
+		t.Fatalf("Failed to kill sandboxfs: %v", err)
+	}
+	state.Cmd.Wait()
+	state.Cmd = nil
+	// If auto_unmount does not work, the mount point stays stale; clean it up ourselves.
+	defer utils.Unmount(state.MountPath())
+
+	// fusermount notices the death of sandboxfs asynchronously, so give it some time.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		_, err := findMount(state.MountPath())
+		if err == os.ErrNotExist {
+			break
+		} else if err != nil {
+			t.Fatalf("Failed to read mount table: %v", err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Mount point %s still mounted after killing sandboxfs", state.MountPath())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := utils.DirEntryNamesEqual(state.MountPath(), nil); err != nil {
+		t.Errorf("Mount point did not recover after killing sandboxfs: %v", err)
+	}
+}
+
+func TestOptions_LogFormatJSON(t *testing.T) {
+	stderr := new(bytes.Buffer)
+	state := utils.MountSetupWithOutputs(t, nil, stderr, "--log_format=json", "--log_level=debug", "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(t)
+
+	utils.MustWriteFile(t, state.RootPath("file"), 0644, "")
+	if _, err := os.Lstat(state.MountPath("file")); err != nil {
+		t.Fatalf("Lstat failed: %v", err)
+	}
+	if err := state.TearDown(t); err != nil {
+		t.Fatalf("Failed to unmount file system: %v", err)
+	}
+
+	sawFuse := false
+	for _, line := range strings.Split(strings.TrimSpace(stderr.String()), "\n") {
+		var event map[string]string
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Errorf("Got stderr line %q; want a JSON object: %v", line, err)
+			continue
+		}
+		for _, field := range []string{"timestamp", "level", "component", "message"} {
+			if event[field] == "" {
+				t.Errorf("Got stderr line %q; want field %s to be present and not empty", line, field)
+			}
+		}
+		if strings.HasPrefix(event["component"], "fuse") {
+			sawFuse = true
+		}
+	}
+	if !sawFuse {
+		t.Errorf("Got %s; want the FUSE request trace to be logged as JSON too", stderr)
+	}
+}
+
+func TestOptions_LogFile(t *testing.T) {
+	stderr := new(bytes.Buffer)
+	state := utils.MountSetupWithOutputs(t, nil, stderr, "--log_file=%ROOT%/../log", "--log_level=debug", "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(t)
+	logFile := state.RootPath("../log")
+	utils.MustWriteFile(t, state.RootPath("file"), 0644, "")
+
+	contents, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("Failed to read log file: %v", err)
+	}
+	if !strings.Contains(string(contents), "Mounting file system onto") {
+		t.Errorf("Got %s; want log file to contain the mount message", contents)
+	}
+
+	// Rotate the log file as logrotate would and wait for sandboxfs to notice, which it does
+	// when it writes a message after a short period of time.
+	if err := os.Rename(logFile, logFile+".1"); err != nil {
+		t.Fatalf("Failed to rotate log file: %v", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := os.Lstat(state.MountPath("file")); err != nil {
+			t.Fatalf("Lstat failed: %v", err)
+		}
+		if contents, err := ioutil.ReadFile(logFile); err == nil && len(contents) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Log file %s not recreated after rotation", logFile)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err := state.TearDown(t); err != nil {
+		t.Fatalf("Failed to unmount file system: %v", err)
+	}
+	if stderr.Len() > 0 {
+		t.Errorf("Got %s; want stderr to be empty", stderr)
+	}
+}
+
+func TestOptions_LogFileCannotOpen(t *testing.T) {
+	_, stderr, err := utils.RunAndWait(1, "--log_file=/non-existent/log", "--mapping=ro:/:/non-existent", "/non-existent-mount-point")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stderr, "Failed to open log file /non-existent/log") {
+		t.Errorf("Got %s; want stderr to mention the log file", stderr)
+	}
+}
+
+func TestOptions_DebugFilters(t *testing.T) {
+	stderr := new(bytes.Buffer)
+	state := utils.MountSetupWithOutputs(t, nil, stderr, "--log_level=debug", "--debug_ops=lookup,readdir", "--debug_path_prefix=/dir", "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(t)
+
+	utils.MustMkdirAll(t, state.RootPath("dir"), 0755)
+	utils.MustWriteFile(t, state.RootPath("dir/file"), 0644, "")
+	utils.MustWriteFile(t, state.RootPath("other"), 0644, "")
+	for _, path := range []string{"dir/file", "other"} {
+		if _, err := os.Lstat(state.MountPath(path)); err != nil {
+			t.Fatalf("Lstat failed: %v", err)
+		}
+	}
+	if err := utils.DirEntryNamesEqual(state.MountPath(), []string{"dir", "other"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := utils.DirEntryNamesEqual(state.MountPath("dir"), []string{"file"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.TearDown(t); err != nil {
+		t.Fatalf("Failed to unmount file system: %v", err)
+	}
+
+	for _, want := range []string{"lookup /dir \\(inode", "lookup /dir/file \\(inode", "readdir /dir \\(inode"} {
+		if !utils.MatchesRegexp(want, stderr.String()) {
+			t.Errorf("Got %s; want stderr to match %s", stderr, want)
+		}
+	}
+	for _, unwanted := range []string{"lookup /other", "readdir / ", "getattr", "LOOKUP"} {
+		if strings.Contains(stderr.String(), unwanted) {
+			t.Errorf("Got %s; want stderr to not contain %s", stderr, unwanted)
+		}
+	}
+}
+
+// readAuditLog parses the audit log at path into one map per event.
+func readAuditLog(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	var events []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("Audit log line %q is not valid JSON: %v", line, err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// findAuditEvent returns the first event in events for the operation op on path, or fails the test
+// if there is none.
+func findAuditEvent(t *testing.T, events []map[string]interface{}, op string, path string) map[string]interface{} {
+	t.Helper()
+
+	for _, event := range events {
+		if event["op"] == op && event["path"] == path {
+			return event
+		}
+	}
+	t.Fatalf("No %s event for %s in audit log: %v", op, path, events)
+	return nil
+}
+
+func TestOptions_AuditLog(t *testing.T) {
+	state := utils.MountSetup(t, "--audit_log=%ROOT%/../audit", "--mapping=rw:/:%ROOT%")
+	defer state.TearDown(t)
+	auditLog := state.RootPath("../audit")
+
+	utils.MustWriteFile(t, state.MountPath("file"), 0644, "hello")
+	if err := os.Chmod(state.MountPath("file"), 0600); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	if err := os.Rename(state.MountPath("file"), state.MountPath("renamed")); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if err := os.Symlink("renamed", state.MountPath("link")); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+	if err := os.Remove(state.MountPath("link")); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	utils.MustMkdirAll(t, state.RootPath("dir"), 0755)
+	utils.MustWriteFile(t, state.RootPath("dir/inner"), 0644, "")
+	if err := syscall.Rmdir(state.MountPath("dir")); err != syscall.ENOTEMPTY {
+		t.Fatalf("Want removal of non-empty directory to fail with ENOTEMPTY; got %v", err)
+	}
+
+	// Writes are only recorded once their handles are released, which may happen asynchronously
+	// after closing the files, so wait for all events to be written on unmount.
+	if err := state.TearDown(t); err != nil {
+		t.Fatalf("Failed to unmount file system: %v", err)
+	}
+	events := readAuditLog(t, auditLog)
+
+	create := findAuditEvent(t, events, "create", "/file")
+	if create["underlying_path"] != state.RootPath("file") {
+		t.Errorf("Got underlying path %v for create; want %s", create["underlying_path"], state.RootPath("file"))
+	}
+	if create["uid"] != float64(os.Getuid()) || create["gid"] != float64(os.Getgid()) || create["pid"] == float64(0) {
+		t.Errorf("Got requester %v/%v/%v for create; want uid %d, gid %d and a pid", create["uid"], create["gid"], create["pid"], os.Getuid(), os.Getgid())
+	}
+	if create["outcome"] != "ok" {
+		t.Errorf("Got outcome %v for create; want ok", create["outcome"])
+	}
+
+	write := findAuditEvent(t, events, "write", "/file")
+	if write["bytes"] != float64(5) {
+		t.Errorf("Got %v bytes for write; want 5", write["bytes"])
+	}
+	if !reflect.DeepEqual(write["range"], []interface{}{float64(0), float64(5)}) {
+		t.Errorf("Got range %v for write; want [0, 5]", write["range"])
+	}
+
+	setattr := findAuditEvent(t, events, "setattr", "/file")
+	if attributes, ok := setattr["attributes"].(map[string]interface{}); !ok || attributes["mode"] != "0600" {
+		t.Errorf("Got attributes %v for setattr; want mode 0600", setattr["attributes"])
+	}
+
+	rename := findAuditEvent(t, events, "rename", "/file")
+	if rename["new_path"] != "/renamed" || rename["new_underlying_path"] != state.RootPath("renamed") {
+		t.Errorf("Got new paths %v and %v for rename; want /renamed and %s", rename["new_path"], rename["new_underlying_path"], state.RootPath("renamed"))
+	}
+
+	symlink := findAuditEvent(t, events, "symlink", "/link")
+	if symlink["target"] != "renamed" {
+		t.Errorf("Got target %v for symlink; want renamed", symlink["target"])
+	}
+	findAuditEvent(t, events, "unlink", "/link")
+
+	rmdir := findAuditEvent(t, events, "rmdir", "/dir")
+	if rmdir["outcome"] != "ENOTEMPTY" {
+		t.Errorf("Got outcome %v for failed rmdir; want ENOTEMPTY", rmdir["outcome"])
+	}
+}
+
+func TestOptions_AuditLogReadOnly(t *testing.T) {
+	state := utils.MountSetup(t, "--audit_log=%ROOT%/../audit", "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(t)
+	auditLog := state.RootPath("../audit")
+	utils.MustWriteFile(t, state.RootPath("file"), 0644, "contents")
+
+	if err := utils.FileEquals(state.MountPath("file"), "contents"); err != nil {
+		t.Error(err)
+	}
+	if err := utils.DirEntryNamesEqual(state.MountPath(), []string{"file"}); err != nil {
+		t.Error(err)
+	}
+
+	if err := state.TearDown(t); err != nil {
+		t.Fatalf("Failed to unmount file system: %v", err)
+	}
+	if events := readAuditLog(t, auditLog); len(events) > 0 {
+		t.Errorf("Got %v; want audit log of a read-only file system to be empty", events)
+	}
+	if _, err := os.Stat(auditLog); err != nil {
+		t.Errorf("Want audit log to exist even if empty; got %v", err)
+	}
+}
+
+func TestOptions_TrackReads(t *testing.T) {
+	state := utils.MountSetup(t, "--track_reads", "--track_reads_output=%ROOT%/../reads", "--mapping=rw:/:%ROOT%")
+	defer state.TearDown(t)
+	readsOutput := state.RootPath("../reads")
+	utils.MustMkdirAll(t, state.RootPath("dir"), 0755)
+	utils.MustWriteFile(t, state.RootPath("dir/read"), 0644, "contents")
+	utils.MustWriteFile(t, state.RootPath("dir/unread"), 0644, "contents")
+
+	if err := utils.FileEquals(state.MountPath("dir/read"), "contents"); err != nil {
+		t.Error(err)
+	}
+	if err := utils.FileEquals(state.MountPath("dir/read"), "contents"); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(state.MountPath("dir/unread")); err != nil {
+		t.Error(err)
+	}
+	utils.MustWriteFile(t, state.MountPath("written"), 0644, "new contents")
+
+	if err := state.TearDown(t); err != nil {
+		t.Fatalf("Failed to unmount file system: %v", err)
+	}
+	contents, err := ioutil.ReadFile(readsOutput)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", readsOutput, err)
+	}
+	var reads struct {
+		Paths      []string `json:"paths"`
+		Overflowed bool     `json:"overflowed"`
+	}
+	if err := json.Unmarshal(contents, &reads); err != nil {
+		t.Fatalf("Failed to parse %s: %v", readsOutput, err)
+	}
+	if want := []string{"/dir/read"}; !reflect.DeepEqual(want, reads.Paths) || reads.Overflowed {
+		t.Errorf("Got reads %+v; want paths %v without overflow", reads, want)
+	}
+}
+
+func TestOptions_TrackReadsOutputCannotCreate(t *testing.T) {
+	_, stderr, err := utils.RunAndWait(1, "--track_reads", "--track_reads_output=/non-existent/reads", "--mapping=ro:/:/", "/non-existent-mount-point")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stderr, "Failed to create reads output file /non-existent/reads") {
+		t.Errorf("Got %s; want stderr to mention the reads output file", stderr)
+	}
+}
+
+func TestOptions_FuseOptionNotAllowed(t *testing.T) {
+	testData := []struct {
+		name string
+
+		option string
+		linux  bool
+	}{
+		{"Nonempty", "nonempty", true},
+		{"AutoUnmount", "auto_unmount", true},
+		{"AllowOther", "allow_other", false},
+		{"MaxBackground", "max_background=16", false},
+	}
+	for _, d := range testData {
+		t.Run(d.name, func(t *testing.T) {
+			if d.linux && runtime.GOOS == "linux" {
+				t.Skipf("Option %s is supported on Linux", d.option)
+			}
+
+			stdout, stderr, err := utils.RunAndWait(2, "--fuse_option="+d.option)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stdout) > 0 {
+				t.Errorf("Got %s; want stdout to be empty", stdout)
+			}
+			wantStderr := "invalid --fuse_option " + d.option + ": "
+			if !strings.Contains(stderr, wantStderr) {
+				t.Errorf("Got %s; want stderr to contain %s", stderr, wantStderr)
+			}
+		})
+	}
+}
+
+func TestOptions_MacOSOnlyFlags(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skipf("Flags are supported on macOS")
+	}
+
+	icon, err := ioutil.TempFile("", "icon")
+	if err != nil {
+		t.Fatalf("Failed to create icon file: %v", err)
+	}
+	defer os.Remove(icon.Name())
+	icon.Close()
+
+	testData := []struct {
+		name string
+
+		arg  string
+		flag string
+	}{
+		{"NoAppleDouble", "--noappledouble", "noappledouble"},
+		{"NoAppleXattr", "--noapplexattr", "noapplexattr"},
+		{"VolumeIcon", "--volume_icon=" + icon.Name(), "volume_icon"},
+	}
+	for _, d := range testData {
+		t.Run(d.name, func(t *testing.T) {
+			stdout, stderr, err := utils.RunAndWait(2, d.arg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stdout) > 0 {
+				t.Errorf("Got %s; want stdout to be empty", stdout)
+			}
+			wantStderr := "--" + d.flag + " is only supported on macOS"
+			if !strings.Contains(stderr, wantStderr) {
+				t.Errorf("Got %s; want stderr to contain %s", stderr, wantStderr)
+			}
+		})
+	}
+}
+
+func TestOptions_NoAppleDouble(t *testing.T) {
+	if runtime.GOOS != "darwin" {
+		t.Skipf("Requires OSXFUSE")
+	}
+
+	state := utils.MountSetup(t, "--noappledouble", "--mapping=rw:/:%ROOT%")
+	defer state.TearDown(t)
+
+	utils.MustWriteFile(t, state.RootPath("._file"), 0644, "")
+	if _, err := os.Lstat(state.MountPath("._file")); err == nil {
+		t.Errorf("Want existing AppleDouble file to be hidden")
+	}
+	if err := ioutil.WriteFile(state.MountPath("._other"), []byte{}, 0644); err == nil {
+		t.Errorf("Want creation of AppleDouble file to fail")
+	}
+	utils.MustWriteFile(t, state.MountPath("file"), 0644, "")
+	if err := utils.DirEntryNamesEqual(state.RootPath(), []string{"._file", "file"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOptions_ConfineSymlinks(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	// Mapping targets must not traverse symlinks, and the temporary directory may (e.g. on macOS).
+	tempDir, err = filepath.EvalSymlinks(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to resolve temporary directory: %v", err)
+	}
+	target := filepath.Join(tempDir, "target")
+	outside := filepath.Join(tempDir, "outside")
+	utils.MustMkdirAll(t, filepath.Join(target, "dir"), 0755)
+	utils.MustWriteFile(t, filepath.Join(target, "file"), 0644, "original")
+	utils.MustWriteFile(t, filepath.Join(target, "dir/file"), 0644, "original")
+	utils.MustWriteFile(t, filepath.Join(target, "inside"), 0644, "inside")
+	utils.MustSymlink(t, "inside", filepath.Join(target, "link"))
+	utils.MustMkdirAll(t, outside, 0755)
+	utils.MustWriteFile(t, filepath.Join(outside, "file"), 0644, "secret")
+
+	state := utils.MountSetup(t, "--confine_symlinks", "--mapping=rw:/:"+target)
+	defer state.TearDown(t)
+
+	// Look up the files so that their nodes exist before we replace them with symlinks behind
+	// sandboxfs' back, as a malicious process racing with the sandbox could do.
+	for _, name := range []string{"file", "dir/file"} {
+		if _, err := os.Lstat(state.MountPath(name)); err != nil {
+			t.Fatalf("Lstat(%s) failed: %v", name, err)
+		}
+	}
+	if err := os.Remove(filepath.Join(target, "file")); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	utils.MustSymlink(t, filepath.Join(outside, "file"), filepath.Join(target, "file"))
+	if err := os.Rename(filepath.Join(target, "dir"), filepath.Join(target, "dir.old")); err != nil {
+		t.Fatalf("Failed to rename directory: %v", err)
+	}
+	utils.MustSymlink(t, outside, filepath.Join(target, "dir"))
+
+	for _, name := range []string{"file", "dir/file"} {
+		if _, err := ioutil.ReadFile(state.MountPath(name)); err == nil || err.(*os.PathError).Err != syscall.EXDEV {
+			t.Errorf("Want reading %s through a swapped-in symlink to fail with EXDEV; got %v", name, err)
+		}
+	}
+
+	// Symlinks within the sandbox are resolved by the kernel and must keep working.
+	if err := utils.FileEquals(state.MountPath("link"), "inside"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOptions_ConfineSymlinksModifications(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	tempDir, err = filepath.EvalSymlinks(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to resolve temporary directory: %v", err)
+	}
+	target := filepath.Join(tempDir, "target")
+	outside := filepath.Join(tempDir, "outside")
+	utils.MustMkdirAll(t, filepath.Join(target, "dir"), 0755)
+	utils.MustWriteFile(t, filepath.Join(target, "dir/file"), 0644, "original")
+	utils.MustMkdirAll(t, outside, 0755)
+	utils.MustWriteFile(t, filepath.Join(outside, "file"), 0644, "secret")
+
+	state := utils.MountSetup(t, "--confine_symlinks", "--mapping=rw:/:"+target)
+	defer state.TearDown(t)
+
+	// Look up the file so that its node exists before we replace its parent directory with a
+	// symlink behind sandboxfs' back, as a malicious process racing with the sandbox could do.
+	if _, err := os.Lstat(state.MountPath("dir/file")); err != nil {
+		t.Fatalf("Lstat failed: %v", err)
+	}
+	if err := os.Rename(filepath.Join(target, "dir"), filepath.Join(target, "dir.old")); err != nil {
+		t.Fatalf("Failed to rename directory: %v", err)
+	}
+	utils.MustSymlink(t, outside, filepath.Join(target, "dir"))
+
+	pathErrorIsEXDEV := func(err error) bool {
+		pathErr, ok := err.(*os.PathError)
+		return ok && pathErr.Err == syscall.EXDEV
+	}
+	if err := os.Mkdir(state.MountPath("dir/subdir"), 0755); !pathErrorIsEXDEV(err) {
+		t.Errorf("Want mkdir through a swapped-in symlink to fail with EXDEV; got %v", err)
+	}
+	if err := os.Chmod(state.MountPath("dir/file"), 0666); !pathErrorIsEXDEV(err) {
+		t.Errorf("Want chmod through a swapped-in symlink to fail with EXDEV; got %v", err)
+	}
+	if err := os.Truncate(state.MountPath("dir/file"), 0); !pathErrorIsEXDEV(err) {
+		t.Errorf("Want truncate through a swapped-in symlink to fail with EXDEV; got %v", err)
+	}
+	if err := os.Rename(state.MountPath("dir/file"), state.MountPath("dir/renamed")); err == nil || err.(*os.LinkError).Err != syscall.EXDEV {
+		t.Errorf("Want rename through a swapped-in symlink to fail with EXDEV; got %v", err)
+	}
+	if err := os.Remove(state.MountPath("dir/file")); !pathErrorIsEXDEV(err) {
+		t.Errorf("Want unlink through a swapped-in symlink to fail with EXDEV; got %v", err)
+	}
+
+	// None of the operations above must have touched the files outside of the target.
+	if err := utils.FileEquals(filepath.Join(outside, "file"), "secret"); err != nil {
+		t.Error(err)
+	}
+	if fileInfo, err := os.Lstat(filepath.Join(outside, "file")); err != nil {
+		t.Errorf("Lstat failed: %v", err)
+	} else if fileInfo.Mode().Perm() != 0644 {
+		t.Errorf("Got mode %v for file outside of the target; want it to be untouched", fileInfo.Mode())
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "subdir")); !os.IsNotExist(err) {
+		t.Errorf("Want subdir to not exist outside of the target; got %v", err)
+	}
+}
+
+func TestOptions_ConfineSymlinksTargetTraversesSymlink(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	utils.MustMkdirAll(t, filepath.Join(tempDir, "real/dir"), 0755)
+	utils.MustSymlink(t, "real", filepath.Join(tempDir, "link"))
+
+	target := filepath.Join(tempDir, "link/dir")
+	_, stderr, err := utils.RunAndWait(1, "--confine_symlinks", "--mapping=ro:/:"+target, "irrelevant-mount-point")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !utils.MatchesRegexp("traverses a symlink", stderr) {
+		t.Errorf("Got %s; want stderr to mention that the target traverses a symlink", stderr)
+	}
+}
+
+func TestOptions_ExposeUnderlyingInodes(t *testing.T) {
+	state := utils.MountSetup(t, "--expose_underlying_inodes", "--mapping=ro:/:%ROOT%", "--mapping=rw:/scaffold/mapped:%ROOT%/dir")
+	defer state.TearDown(t)
+
+	utils.MustMkdirAll(t, state.RootPath("dir/subdir"), 0755)
+	utils.MustWriteFile(t, state.RootPath("dir/file"), 0644, "")
+
+	for _, path := range []string{"dir", "dir/subdir", "dir/file"} {
+		var inside, outside syscall.Stat_t
+		if err := syscall.Lstat(state.MountPath(path), &inside); err != nil {
+			t.Fatalf("Failed to stat %s within the mount point: %v", path, err)
+		}
+		if err := syscall.Lstat(state.RootPath(path), &outside); err != nil {
+			t.Fatalf("Failed to stat %s outside of the mount point: %v", path, err)
+		}
+		if inside.Ino != outside.Ino {
+			t.Errorf("Got inode %d for %s; want underlying inode %d", inside.Ino, path, outside.Ino)
+		}
+	}
+
+	var stat syscall.Stat_t
+	if err := syscall.Lstat(state.MountPath("scaffold"), &stat); err != nil {
+		t.Fatalf("Failed to stat scaffold directory: %v", err)
+	}
+	if stat.Ino < 1<<63 {
+		t.Errorf("Got inode %d for scaffold directory; want a number in the upper half of the range", stat.Ino)
+	}
+}
+
+func TestOptions_ForcedOwner(t *testing.T) {
+	state := utils.MountSetup(t, "--uid=12345", "--gid=23456", "--mapping=rw:/:%ROOT%")
+	defer state.TearDown(t)
+
+	utils.MustMkdirAll(t, state.RootPath("dir"), 0755)
+	utils.MustWriteFile(t, state.RootPath("dir/file"), 0644, "")
+
+	for _, path := range []string{"dir", "dir/file"} {
+		var inside, outside syscall.Stat_t
+		if err := syscall.Lstat(state.MountPath(path), &inside); err != nil {
+			t.Fatalf("Failed to stat %s within the mount point: %v", path, err)
+		}
+		if inside.Uid != 12345 || inside.Gid != 23456 {
+			t.Errorf("Got ownership %v:%v for %s; want 12345:23456", inside.Uid, inside.Gid, path)
+		}
+		if err := syscall.Lstat(state.RootPath(path), &outside); err != nil {
+			t.Fatalf("Failed to stat %s outside of the mount point: %v", path, err)
+		}
+		if int(outside.Uid) != os.Getuid() || int(outside.Gid) != os.Getgid() {
+			t.Errorf("Underlying ownership of %s changed to %v:%v", path, outside.Uid, outside.Gid)
+		}
+	}
+
+	if os.Getuid() == 0 {
+		// Only root can issue chown requests for files it does not own as far as the kernel is
+		// concerned, so these reach sandboxfs only in this case.
+		if err := os.Lchown(state.MountPath("dir/file"), 12345, 23456); err != nil {
+			t.Errorf("Lchown to the forced identity failed: %v", err)
+		}
+		if err := syscall.Lchown(state.MountPath("dir/file"), 1, 1); err != syscall.EPERM {
+			t.Errorf("Want Lchown to another identity to fail with EPERM; got %v", err)
+		}
+		var stat syscall.Stat_t
+		if err := syscall.Lstat(state.RootPath("dir/file"), &stat); err != nil {
+			t.Fatalf("Failed to stat dir/file outside of the mount point: %v", err)
+		}
+		if int(stat.Uid) != os.Getuid() || int(stat.Gid) != os.Getgid() {
+			t.Errorf("Underlying ownership of dir/file changed to %v:%v", stat.Uid, stat.Gid)
+		}
+	}
+}
+
+// startWithReadyFd starts sandboxfs with the given arguments and with --ready_fd pointing to the
+// write end of a pipe, and returns the command along with the pipe's read end.
+func startWithReadyFd(t *testing.T, args ...string) (*exec.Cmd, *os.File) {
+	t.Helper()
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	defer readyWriter.Close()
+
+	// The first entry in ExtraFiles becomes file descriptor 3 in the child.
+	cmd := exec.Command(utils.GetConfig().SandboxfsBinary, append([]string{"--ready_fd=3"}, args...)...)
+	cmd.ExtraFiles = []*os.File{readyWriter}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		readyReader.Close()
+		t.Fatalf("Failed to start sandboxfs: %v", err)
+	}
+	return cmd, readyReader
+}
+
+func TestOptions_ReadyFd(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	mountPoint := filepath.Join(tempDir, "mnt")
+	utils.MustMkdirAll(t, mountPoint, 0755)
+	utils.MustWriteFile(t, filepath.Join(tempDir, "file"), 0644, "")
+
+	cmd, ready := startWithReadyFd(t, "--mapping=ro:/:"+tempDir, mountPoint)
+	defer ready.Close()
+	defer func() {
+		if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			t.Errorf("Failed to deliver signal to sandboxfs process: %v", err)
+		}
+		cmd.Wait()
+	}()
+
+	notification, err := ioutil.ReadAll(ready)
+	if err != nil {
+		t.Fatalf("Failed to read readiness notification: %v", err)
+	}
+	if string(notification) != "1" {
+		t.Fatalf("Got readiness notification %q; want 1", notification)
+	}
+	// No polling: the file system must be usable as soon as readiness has been reported.
+	if _, err := os.Lstat(filepath.Join(mountPoint, "file")); err != nil {
+		t.Errorf("File system not ready after readiness notification: %v", err)
+	}
+}
+
+func TestOptions_ReadyFdClosedOnFailure(t *testing.T) {
+	cmd, ready := startWithReadyFd(t, "--mapping=ro:/:/non-existent", "/non-existent-mount-point")
+	defer ready.Close()
+
+	notification, err := ioutil.ReadAll(ready)
+	if err != nil {
+		t.Fatalf("Failed to read readiness notification: %v", err)
+	}
+	if len(notification) > 0 {
+		t.Errorf("Got readiness notification %q; want none", notification)
+	}
+	if err := cmd.Wait(); err == nil {
+		t.Errorf("Want sandboxfs to fail; got success")
+	}
+}
+
+func TestOptions_ForceStaleMount(t *testing.T) {
+	state := utils.MountSetup(t, "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(t)
+	utils.MustWriteFile(t, state.RootPath("file"), 0644, "")
+
+	// Killing sandboxfs abruptly leaves the mount point behind in a stale state, which we must
+	// clean up on our own if the test fails before a new instance takes over.
+	if err := state.Cmd.Process.Kill(); err != nil {
+		t.Fatalf("Failed to kill sandboxfs: %v", err)
+	}
+	state.Cmd.Wait()
+	state.Cmd = nil
+	defer utils.Unmount(state.MountPath())
+
+	mapping := "--mapping=ro:/:" + state.RootPath()
+	wantStderr := "holds a stale FUSE mount.*use --force"
+	_, stderr, err := utils.RunAndWait(1, mapping, state.MountPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !utils.MatchesRegexp(wantStderr, stderr) {
+		t.Errorf("Got %s; want stderr to match %s", stderr, wantStderr)
+	}
+
+	cmd, ready := startWithReadyFd(t, "--force", mapping, state.MountPath())
+	defer ready.Close()
+	defer func() {
+		if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			t.Errorf("Failed to deliver signal to sandboxfs process: %v", err)
+		}
+		cmd.Wait()
+	}()
+	if notification, err := ioutil.ReadAll(ready); err != nil || string(notification) != "1" {
+		t.Fatalf("sandboxfs with --force did not become ready; got %q, %v", notification, err)
+	}
+	if _, err := os.Lstat(state.MountPath("file")); err != nil {
+		t.Errorf("File system not usable after forced remount: %v", err)
+	}
+}
+
+func TestOptions_IoTimeout(t *testing.T) {
+	// Use a stopped sandboxfs instance as the underlying file system of another one to simulate
+	// an unresponsive underlying file system, like a hung NFS server.
+	slow := utils.MountSetup(t, "--mapping=ro:/:%ROOT%")
+	defer slow.TearDown(t)
+	utils.MustWriteFile(t, slow.RootPath("file"), 0644, "")
+
+	address := freeAddress(t)
+	state := utils.MountSetup(t, "--io_timeout=1s", "--listen_address="+address, "--mapping=ro:/:%ROOT%", "--mapping=ro:/slow:"+slow.MountPath())
+	defer state.TearDown(t)
+	utils.MustWriteFile(t, state.RootPath("file"), 0644, "")
+
+	if err := slow.Cmd.Process.Signal(syscall.SIGSTOP); err != nil {
+		t.Fatalf("Failed to stop sandboxfs process: %v", err)
+	}
+	defer func() {
+		if err := slow.Cmd.Process.Signal(syscall.SIGCONT); err != nil {
+			t.Errorf("Failed to resume sandboxfs process: %v", err)
+		}
+	}()
+
+	start := time.Now()
+	if _, err := os.Lstat(state.MountPath("slow/file")); err == nil || err.(*os.PathError).Err != syscall.EIO {
+		t.Errorf("Want Lstat on stalled underlying file system to fail with EIO; got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Errorf("Lstat on stalled underlying file system took %v; want close to 1s", elapsed)
+	}
+
+	// The stalled operation must not prevent serving the rest of the file system.
+	if _, err := os.Lstat(state.MountPath("file")); err != nil {
+		t.Errorf("Lstat on healthy mapping failed: %v", err)
+	}
+
+	_, body, err := fetch(fmt.Sprintf("http://%s/metrics", address))
+	if err != nil {
+		t.Fatalf("Failed to fetch metrics: %v", err)
+	}
+	want := `sandboxfs_io_timeouts_total{mapping="/slow"} [1-9]`
+	if !utils.MatchesRegexp(want, body) {
+		t.Errorf("Metrics do not match %s; got:\n%s", want, body)
+	}
+}
+
+func TestOptions_LogSlowOps(t *testing.T) {
+	// Use a stopped sandboxfs instance as the underlying file system of another one to make an
+	// operation slow, and let it time out so that we know how long it takes and how it fails.
+	slow := utils.MountSetup(t, "--mapping=ro:/:%ROOT%")
+	defer slow.TearDown(t)
+	utils.MustWriteFile(t, slow.RootPath("file"), 0644, "")
+
+	stderr := new(bytes.Buffer)
+	state := utils.MountSetupWithOutputs(t, nil, stderr, "--io_timeout=2s", "--log_slow_ops=1s", "--log_level=warn", "--mapping=ro:/:%ROOT%", "--mapping=ro:/slow:"+slow.MountPath())
+	defer state.TearDown(t)
+	utils.MustWriteFile(t, state.RootPath("file"), 0644, "")
+
+	if err := slow.Cmd.Process.Signal(syscall.SIGSTOP); err != nil {
+		t.Fatalf("Failed to stop sandboxfs process: %v", err)
+	}
+	os.Lstat(state.MountPath("slow/file"))
+	if err := slow.Cmd.Process.Signal(syscall.SIGCONT); err != nil {
+		t.Fatalf("Failed to resume sandboxfs process: %v", err)
+	}
+
+	// Fast operations must not be logged.
+	if _, err := os.Lstat(state.MountPath("file")); err != nil {
+		t.Errorf("Lstat on healthy mapping failed: %v", err)
+	}
+
+	if err := state.TearDown(t); err != nil {
+		t.Fatalf("Failed to unmount file system: %v", err)
+	}
+	want := fmt.Sprintf(`Slow lookup on /slow/file \(underlying %s/file\) took .* and returned errno %d`, slow.MountPath(), syscall.EIO)
+	if !utils.MatchesRegexp(want, stderr.String()) {
+		t.Errorf("Got %s; want stderr to match %s", stderr, want)
+	}
+	if strings.Contains(stderr.String(), "on /file") {
+		t.Errorf("Got %s; want fast operations to not be logged", stderr)
+	}
+}
+
+func TestOptions_LazyMappingValidation(t *testing.T) {
+	// Targets given via --mapping are created before the root setup hook runs, so use a mapping
+	// file to be able to map a missing target.
+	rootSetup := func(root string) error {
+		if err := os.MkdirAll(filepath.Join(root, "dir"), 0755); err != nil {
+			return err
+		}
+		contents := "ro:/dir:" + filepath.Join(root, "dir") + "\n" +
+			"ro:/missing:" + filepath.Join(root, "missing") + "\n"
+		return ioutil.WriteFile(filepath.Join(root, "..", "mappings"), []byte(contents), 0644)
+	}
+	state := utils.MountSetupWithRootSetup(t, rootSetup, "--lazy_mapping_validation", "--mapping_file=%ROOT%/../mappings")
+	defer state.TearDown(t)
+
+	if err := utils.DirEntryNamesEqual(state.MountPath(), []string{"dir"}); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Lstat(state.MountPath("missing")); !os.IsNotExist(err) {
+		t.Errorf("Want lookup of mapping with a missing target to fail with ENOENT; got %v", err)
+	}
+
+	// The mapping becomes usable as soon as its target appears.
+	utils.MustWriteFile(t, state.RootPath("missing"), 0644, "contents")
+	if err := utils.FileEquals(state.MountPath("missing"), "contents"); err != nil {
+		t.Error(err)
+	}
+	if err := utils.DirEntryNamesEqual(state.MountPath(), []string{"dir", "missing"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOptions_MaxOpenFiles(t *testing.T) {
+	address := freeAddress(t)
+	state := utils.MountSetup(t, "--max_open_files=10", "--listen_address="+address, "--mapping=rw:/:%ROOT%")
+	defer state.TearDown(t)
+
+	writer, err := os.OpenFile(state.MountPath("written"), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	defer writer.Close()
+
+	// Open many more files for reading than the limit allows to force sandboxfs to close the
+	// descriptors of the idle ones.
+	const count = 50
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("file%d", i)
+		utils.MustWriteFile(t, state.RootPath(name), 0644, name)
+		file, err := os.Open(state.MountPath(name))
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", name, err)
+		}
+		files = append(files, file)
+	}
+
+	// Reading from the handles whose descriptors were closed must transparently reopen them.
+	for i, file := range files {
+		content, err := ioutil.ReadAll(file)
+		if err != nil {
+			t.Fatalf("Failed to read from file%d: %v", i, err)
+		}
+		if want := fmt.Sprintf("file%d", i); string(content) != want {
+			t.Errorf("Got content %q for file%d; want %q", content, i, want)
+		}
+	}
+
+	// Writable handles must never lose their descriptors.
+	if _, err := writer.WriteString("still open"); err != nil {
+		t.Fatalf("Failed to write to file opened before reaching the limit: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close file opened before reaching the limit: %v", err)
+	}
+	if err := utils.FileEquals(state.RootPath("written"), "still open"); err != nil {
+		t.Error(err)
+	}
+
+	_, body, err := fetch(fmt.Sprintf("http://%s/metrics", address))
+	if err != nil {
+		t.Fatalf("Failed to fetch metrics: %v", err)
+	}
+	match := regexp.MustCompile(`sandboxfs_open_fds_peak ([0-9]+)`).FindStringSubmatch(body)
+	if match == nil {
+		t.Fatalf("Metrics do not report the peak of open files; got:\n%s", body)
+	}
+	if peak, _ := strconv.Atoi(match[1]); peak <= 0 || peak >= count {
+		t.Errorf("Got peak of %d open files; want it to be bounded by --max_open_files", peak)
+	}
+}
+
+func TestOptions_MaxOpenFilesKeepsRemovedFilesOpen(t *testing.T) {
+	state := utils.MountSetup(t, "--max_open_files=10", "--mapping=rw:/:%ROOT%")
+	defer state.TearDown(t)
+
+	utils.MustWriteFile(t, state.RootPath("deleted"), 0644, "deleted contents")
+	utils.MustWriteFile(t, state.RootPath("replaced"), 0644, "replaced contents")
+	utils.MustWriteFile(t, state.RootPath("replacement"), 0644, "replacement contents")
+
+	deleted, err := os.Open(state.MountPath("deleted"))
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	defer deleted.Close()
+	replaced, err := os.Open(state.MountPath("replaced"))
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	defer replaced.Close()
+
+	// Open many more files than the limit allows so that the descriptors of the files above are
+	// closed while idle.
+	const count = 50
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("file%d", i)
+		utils.MustWriteFile(t, state.RootPath(name), 0644, name)
+		file, err := os.Open(state.MountPath(name))
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", name, err)
+		}
+		defer file.Close()
+	}
+
+	if err := os.Remove(state.MountPath("deleted")); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	if err := os.Rename(state.MountPath("replacement"), state.MountPath("replaced")); err != nil {
+		t.Fatalf("Failed to rename file: %v", err)
+	}
+
+	for file, want := range map[*os.File]string{deleted: "deleted contents", replaced: "replaced contents"} {
+		content, err := ioutil.ReadAll(file)
+		if err != nil {
+			t.Fatalf("Failed to read from %s after it lost its name: %v", file.Name(), err)
+		}
+		if string(content) != want {
+			t.Errorf("Got content %q for %s; want %q", content, file.Name(), want)
+		}
+	}
+	if err := utils.FileEquals(state.MountPath("replaced"), "replacement contents"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOptions_NegativeTtl(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skipf("OSXFUSE does not honor entry TTLs")
+	}
+
+	state := utils.MountSetup(t, "--negative_ttl=600s", "--mapping=rw:/:%ROOT%")
+	defer state.TearDown(t)
+
+	for _, name := range []string{"external", "file", "dir"} {
+		if _, err := os.Lstat(state.MountPath(name)); !os.IsNotExist(err) {
+			t.Fatalf("Want lookup of missing %s to fail with ENOENT; got %v", name, err)
+		}
+	}
+
+	// Entries that appear behind the kernel's back stay hidden while the lookup is cached.
+	utils.MustWriteFile(t, state.RootPath("external"), 0644, "")
+	if _, err := os.Lstat(state.MountPath("external")); !os.IsNotExist(err) {
+		t.Errorf("Want cached lookup of external to fail with ENOENT; got %v", err)
+	}
+
+	// Entries created through the mount point replace the cached lookups.
+	utils.MustWriteFile(t, state.MountPath("file"), 0644, "")
+	if _, err := os.Lstat(state.MountPath("file")); err != nil {
+		t.Errorf("Want file created through the mount point to be visible; got %v", err)
+	}
+	utils.MustMkdirAll(t, state.MountPath("dir"), 0755)
+	if _, err := os.Lstat(state.MountPath("dir")); err != nil {
+		t.Errorf("Want directory created through the mount point to be visible; got %v", err)
+	}
+}
+
+func TestOptions_ParentDeathUnmount(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	mountPoint := filepath.Join(tempDir, "mnt")
+	utils.MustMkdirAll(t, mountPoint, 0755)
+	utils.MustWriteFile(t, filepath.Join(tempDir, "file"), 0644, "")
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	defer readyReader.Close()
+
+	// Run sandboxfs under an intermediate shell that we can kill abruptly, just like a build
+	// worker that dies without getting a chance to clean up after itself.
+	parent := exec.Command("/bin/sh", "-c", `"$0" "$@" & wait`, utils.GetConfig().SandboxfsBinary,
+		"--parent_death_unmount", "--ready_fd=3", "--mapping=ro:/:"+tempDir, mountPoint)
+	parent.ExtraFiles = []*os.File{readyWriter}
+	parent.Stderr = os.Stderr
+	if err := parent.Start(); err != nil {
+		readyWriter.Close()
+		t.Fatalf("Failed to start parent shell: %v", err)
+	}
+	readyWriter.Close()
+	defer func() {
+		if _, err := os.Lstat(filepath.Join(mountPoint, "file")); err == nil {
+			utils.Unmount(mountPoint)
+		}
+	}()
+
+	// The shell keeps its own copy of the descriptor open so we cannot wait for EOF.
+	notification := make([]byte, 1)
+	if _, err := io.ReadFull(readyReader, notification); err != nil || string(notification) != "1" {
+		parent.Process.Kill()
+		parent.Wait()
+		t.Fatalf("sandboxfs did not become ready; got %q, %v", notification, err)
+	}
+	if err := parent.Process.Kill(); err != nil {
+		t.Fatalf("Failed to kill parent shell: %v", err)
+	}
+	parent.Wait()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		_, err := os.Lstat(filepath.Join(mountPoint, "file"))
+		if os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("File system still mounted after its parent died; got %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestOptions_DropPrivilegesTo(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skipf("--drop_privileges_to is only supported on Linux")
+	}
+	utils.RequireRoot(t, "Requires root privileges to drop them")
+
+	user := utils.GetConfig().UnprivilegedUser
+	if user == nil {
+		t.Skipf("unprivileged user not set; must contain the name of an unprivileged user with FUSE access")
+	}
+	t.Logf("Using unprivileged user: %v", user)
+
+	// The output file lives in a directory that the unprivileged user cannot access, so it can
+	// only be written to because it is opened before dropping privileges.
+	privateDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(privateDir)
+	output := filepath.Join(privateDir, "output")
+
+	rootSetup := func(root string) error {
+		// Let the unprivileged user reach and modify the root of the mapping.
+		if err := os.Chmod(filepath.Dir(root), 0755); err != nil {
+			return err
+		}
+		if err := os.Chown(root, user.UID, user.GID); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(root, "secret"), []byte("root only"), 0600)
+	}
+	state := utils.MountSetupWithRootSetup(t, rootSetup, "--allow=other", "--drop_privileges_to="+user.Username, "--output="+output, "--mapping=rw:/:%ROOT%")
+	defer state.TearDown(t)
+
+	if _, err := ioutil.ReadFile(state.MountPath("secret")); !os.IsPermission(err) {
+		t.Errorf("Want reading a root-only file after dropping privileges to fail with a permission error; got %v", err)
+	}
+
+	utils.MustWriteFile(t, state.MountPath("new"), 0644, "")
+	var stat syscall.Stat_t
+	if err := syscall.Lstat(state.RootPath("new"), &stat); err != nil {
+		t.Fatalf("Failed to stat new file outside of the mount point: %v", err)
+	}
+	if int(stat.Uid) != user.UID || int(stat.Gid) != user.GID {
+		t.Errorf("Got ownership %v:%v for new file; want %v:%v", stat.Uid, stat.Gid, user.UID, user.GID)
+	}
+
+	if _, err := os.Lstat(output); err != nil {
+		t.Errorf("Output file not created before dropping privileges: %v", err)
+	}
+}
+
 func TestOptions_Syntax(t *testing.T) {
 	testData := []struct {
 		name string
@@ -114,6 +1494,22 @@ func TestOptions_Syntax(t *testing.T) {
 		wantStderr string
 	}{
 		{"AllowBadValue", []string{"--allow=foo"}, "foo.*must be one of.*other"},
+		{"DropPrivilegesToUnknownUser", []string{"--drop_privileges_to=this-user-does-not-exist"}, "invalid --drop_privileges_to this-user-does-not-exist: Unknown user|--drop_privileges_to is only supported on Linux"},
+		{"FsNameWithComma", []string{"--fs_name=a,b"}, "invalid --fs_name a,b: cannot contain commas or whitespace"},
+		{"FsNameWithSpace", []string{"--fs_name=a b"}, "invalid --fs_name a b: cannot contain commas or whitespace"},
+		{"GidNotNumeric", []string{"--gid=wheel"}, "invalid --gid wheel"},
+		{"IoTimeoutZero", []string{"--io_timeout=0s"}, "invalid --io_timeout 0s: must be positive"},
+		{"ListenAddressBadValue", []string{"--listen_address=foo"}, "invalid --listen_address foo"},
+		{"MaxOpenFilesBadValue", []string{"--max_open_files=-1"}, "invalid --max_open_files -1"},
+		{"MaxOpenFilesZero", []string{"--max_open_files=0"}, "invalid --max_open_files 0: must be positive"},
+		{"MountRetriesBadValue", []string{"--mount_retries=-1"}, "invalid --mount_retries -1"},
+		{"MountRetryDelayBadValue", []string{"--mount_retry_delay=1m"}, "invalid time specification 1m"},
+		{"NegativeTtlBadValue", []string{"--negative_ttl=1m"}, "invalid time specification 1m"},
+		{"ReadyFdBadValue", []string{"--ready_fd=foo"}, "invalid --ready_fd foo"},
+		{"ReadyFdNegative", []string{"--ready_fd=-1"}, "invalid --ready_fd -1: must not be negative"},
+		{"ReconfigSocketWithInput", []string{"--reconfig_socket=/tmp/socket", "--input=/dev/null"}, "--reconfig_socket cannot be combined with --input"},
+		{"SubtypeWithComma", []string{"--subtype=a,rw"}, "invalid --subtype a,rw: cannot contain commas or whitespace"},
+		{"UidNegative", []string{"--uid=-1"}, "invalid --uid -1"},
 	}
 	for _, d := range testData {
 		t.Run(d.name, func(t *testing.T) {
@@ -0,0 +1,163 @@
+// Copyright 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License.  You may obtain a copy
+// of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.  See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package integration
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/bazelbuild/sandboxfs/integration/utils"
+)
+
+// overlaySetup mounts a sandboxfs instance with an overlay at /lib that merges the "base" and
+// "extra" directories within the root, in that order.  topType is the type of the mapping for
+// the "extra" directory.
+func overlaySetup(t *testing.T, topType string) *utils.MountState {
+	rootSetup := func(root string) error {
+		for _, dir := range []string{"base/dir", "extra/dir"} {
+			if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+				return err
+			}
+		}
+		files := map[string]string{
+			"base/only-base":   "base",
+			"base/common":      "from base",
+			"base/dir/nested":  "base",
+			"extra/only-extra": "extra",
+			"extra/common":     "from extra",
+		}
+		for name, contents := range files {
+			if err := ioutil.WriteFile(filepath.Join(root, name), []byte(contents), 0644); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return utils.MountSetupWithRootSetup(t, rootSetup,
+		"--overlay",
+		"--mapping=ro:/:%ROOT%",
+		"--mapping=ro:/lib:%ROOT%/base",
+		"--mapping="+topType+":/lib:%ROOT%/extra")
+}
+
+func TestOverlay_MergesLayers(t *testing.T) {
+	state := overlaySetup(t, "rw")
+	defer state.TearDown(t)
+
+	if names := readDirNames(t, state.MountPath("lib")); !reflect.DeepEqual([]string{"common", "dir", "only-base", "only-extra"}, names) {
+		t.Errorf("Got entries %v in overlay; want common, dir, only-base and only-extra", names)
+	}
+	if err := utils.FileEquals(state.MountPath("lib/common"), "from extra"); err != nil {
+		t.Error(err)
+	}
+	if err := utils.FileEquals(state.MountPath("lib/only-base"), "base"); err != nil {
+		t.Error(err)
+	}
+	if err := utils.FileEquals(state.MountPath("lib/dir/nested"), "base"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOverlay_WritesGoToTopLayer(t *testing.T) {
+	state := overlaySetup(t, "rw")
+	defer state.TearDown(t)
+
+	file, err := os.OpenFile(state.MountPath("lib/dir/nested"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	if _, err := file.WriteString(" and extra"); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := ioutil.WriteFile(state.MountPath("lib/new"), []byte("created"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	if err := utils.FileEquals(state.RootPath("extra/dir/nested"), "base and extra"); err != nil {
+		t.Error(err)
+	}
+	if err := utils.FileEquals(state.RootPath("base/dir/nested"), "base"); err != nil {
+		t.Error(err)
+	}
+	if err := utils.FileEquals(state.RootPath("extra/new"), "created"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOverlay_DeleteHidesLowerEntry(t *testing.T) {
+	state := overlaySetup(t, "rw")
+	defer state.TearDown(t)
+
+	for _, name := range []string{"only-base", "common"} {
+		if err := os.Remove(state.MountPath("lib", name)); err != nil {
+			t.Fatalf("Remove of %s failed: %v", name, err)
+		}
+		if _, err := os.Lstat(state.MountPath("lib", name)); !os.IsNotExist(err) {
+			t.Errorf("Deleted entry %s is still visible: %v", name, err)
+		}
+	}
+	if names := readDirNames(t, state.MountPath("lib")); !reflect.DeepEqual([]string{"dir", "only-extra"}, names) {
+		t.Errorf("Got entries %v after delete; want dir and only-extra", names)
+	}
+	if err := utils.FileEquals(state.RootPath("base/only-base"), "base"); err != nil {
+		t.Error(err)
+	}
+	if err := utils.FileEquals(state.RootPath("base/common"), "from base"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOverlay_ReadOnlyTopLayer(t *testing.T) {
+	state := overlaySetup(t, "ro")
+	defer state.TearDown(t)
+
+	if err := utils.FileEquals(state.MountPath("lib/common"), "from extra"); err != nil {
+		t.Error(err)
+	}
+	if err := unix.Unlink(state.MountPath("lib/only-base")); err != unix.EROFS {
+		t.Errorf("Want unlink in read-only overlay to fail with EROFS; got %v", err)
+	}
+	if err := unix.Mkdir(state.MountPath("lib/new"), 0755); err != unix.EROFS {
+		t.Errorf("Want mkdir in read-only overlay to fail with EROFS; got %v", err)
+	}
+	if err := utils.FileEquals(state.RootPath("base/only-base"), "base"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOverlay_RequiresFlag(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	wantStderr := "Cannot map .*'/lib .* Already mapped"
+	_, stderr, err := utils.RunAndWait(1, "--mapping=ro:/lib:"+tempDir, "--mapping=ro:/lib:"+tempDir, "irrelevant-mount-point")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !utils.MatchesRegexp(wantStderr, stderr) {
+		t.Errorf("Got %s; want stderr to match %s", stderr, wantStderr)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License.  You may obtain a copy
+// of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.  See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package integration
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bazelbuild/sandboxfs/integration/utils"
+)
+
+func TestPerm_MaskApplied(t *testing.T) {
+	rootSetup := func(root string) error {
+		return os.MkdirAll(filepath.Join(root, "src/sub"), 0775)
+	}
+	state := utils.MountSetupWithRootSetup(t, rootSetup, "--mapping=ro:/:%ROOT%", "--mapping=ro:/src:%ROOT%/src:perm=0555")
+	defer state.TearDown(t)
+
+	utils.MustWriteFile(t, state.RootPath("src/sub/file"), 0664, "")
+	utils.MustWriteFile(t, state.RootPath("src/tool"), 0775, "")
+	utils.MustWriteFile(t, state.RootPath("file"), 0664, "")
+
+	checkMode(t, state.MountPath("src"), 0555)
+	checkMode(t, state.MountPath("src/sub"), 0555)
+	checkMode(t, state.MountPath("src/sub/file"), 0444)
+	checkMode(t, state.MountPath("src/tool"), 0555)
+	// Files outside of the mapping keep their permissions.
+	checkMode(t, state.MountPath("file"), 0664)
+}
+
+func TestPerm_ChmodKeepsUnderlyingMode(t *testing.T) {
+	rootSetup := func(root string) error {
+		return os.MkdirAll(filepath.Join(root, "out"), 0755)
+	}
+	state := utils.MountSetupWithRootSetup(t, rootSetup, "--mapping=ro:/:%ROOT%", "--mapping=rw:/out:%ROOT%/out:perm=0750")
+	defer state.TearDown(t)
+
+	utils.MustWriteFile(t, state.MountPath("out/file"), 0644, "")
+	checkMode(t, state.MountPath("out/file"), 0640)
+	checkMode(t, state.RootPath("out/file"), 0644)
+
+	if err := os.Chmod(state.MountPath("out/file"), 0666); err != nil {
+		t.Fatalf("Failed to chmod file: %v", err)
+	}
+	checkMode(t, state.MountPath("out/file"), 0640)
+	checkMode(t, state.RootPath("out/file"), 0666)
+}
@@ -15,10 +15,15 @@
 package integration
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/bazelbuild/sandboxfs/integration/utils"
 )
@@ -60,3 +65,184 @@ func TestProfiling_OptionalSupport(t *testing.T) {
 		}
 	}
 }
+
+// traceEvent represents a single operation in the trace written by --trace_profile.
+type traceEvent struct {
+	Name string `json:"name"`
+	Ph   string `json:"ph"`
+	Tid  int    `json:"tid"`
+	Args struct {
+		Errno int `json:"errno"`
+	} `json:"args"`
+}
+
+// readTrace reads and parses the trace written by --trace_profile to path.
+func readTrace(t *testing.T, path string) []traceEvent {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", path, err)
+	}
+	var trace struct {
+		TraceEvents []traceEvent `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(contents, &trace); err != nil {
+		t.Fatalf("Failed to parse %s: %v", path, err)
+	}
+	return trace.TraceEvents
+}
+
+func TestProfiling_TraceProfile(t *testing.T) {
+	state := utils.MountSetup(t, "--trace_profile=%ROOT%/../trace.json", "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(t)
+	trace := state.RootPath("../trace.json")
+	utils.MustWriteFile(t, state.RootPath("file"), 0644, "contents")
+
+	if err := utils.FileEquals(state.MountPath("file"), "contents"); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(state.MountPath("missing")); !os.IsNotExist(err) {
+		t.Errorf("Want missing file to not exist; got %v", err)
+	}
+
+	// The trace is only written once the file system is unmounted.
+	if err := state.TearDown(t); err != nil {
+		t.Fatalf("Failed to unmount file system: %v", err)
+	}
+	failedLookups := 0
+	reads := 0
+	for _, event := range readTrace(t, trace) {
+		if event.Ph != "X" {
+			t.Errorf("Got event %+v; want complete events only", event)
+		}
+		switch {
+		case event.Name == "lookup" && event.Args.Errno != 0:
+			failedLookups++
+		case event.Name == "read":
+			reads++
+		}
+	}
+	if failedLookups == 0 || reads == 0 {
+		t.Errorf("Got %d failed lookups and %d reads in trace; want at least one of each", failedLookups, reads)
+	}
+}
+
+func TestProfiling_TraceProfileDuration(t *testing.T) {
+	state := utils.MountSetup(t, "--trace_profile=%ROOT%/../trace.json", "--trace_profile_duration=1s", "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(t)
+	trace := state.RootPath("../trace.json")
+
+	if _, err := os.Stat(state.MountPath("")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The trace must be written while the file system is still mounted.
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		contents, err := ioutil.ReadFile(trace)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", trace, err)
+		}
+		if strings.HasSuffix(string(contents), "\n") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Trace %s not written after its duration elapsed", trace)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if len(readTrace(t, trace)) == 0 {
+		t.Errorf("Got empty trace; want at least the operations issued at mount time")
+	}
+}
+
+func TestProfiling_TraceProfileCannotCreate(t *testing.T) {
+	_, stderr, err := utils.RunAndWait(1, "--trace_profile=/non-existent/trace.json", "--mapping=ro:/:/", "/non-existent-mount-point")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stderr, "Failed to create trace profile /non-existent/trace.json") {
+		t.Errorf("Got %s; want stderr to mention the trace profile", stderr)
+	}
+}
+
+// postSnapshot requests snapshots of the profiles of the instance serving HTTP on address and
+// returns the status code and body of the response.
+func postSnapshot(t *testing.T, address string) (int, string) {
+	response, err := http.Post(fmt.Sprintf("http://%s/debug/snapshot", address), "text/plain", nil)
+	if err != nil {
+		t.Fatalf("Failed to request snapshot: %v", err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("Failed to read snapshot response: %v", err)
+	}
+	return response.StatusCode, string(body)
+}
+
+func TestProfiling_TraceProfileSnapshot(t *testing.T) {
+	address := freeAddress(t)
+	state := utils.MountSetup(t, "--listen_address="+address, "--enable_http_snapshot", "--trace_profile=%ROOT%/../trace.json", "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(t)
+	trace := state.RootPath("../trace.json")
+	utils.MustWriteFile(t, state.RootPath("file"), 0644, "contents")
+
+	var snapshots []string
+	for i := 0; i < 2; i++ {
+		if err := utils.FileEquals(state.MountPath("file"), "contents"); err != nil {
+			t.Fatal(err)
+		}
+		status, body := postSnapshot(t, address)
+		if status != http.StatusOK {
+			t.Fatalf("Got status %d with body %q; want %d", status, body, http.StatusOK)
+		}
+		snapshot := strings.TrimSuffix(body, "\n")
+		if !strings.HasPrefix(snapshot, trace+".") {
+			t.Errorf("Got snapshot %s; want it next to %s", snapshot, trace)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	if snapshots[0] == snapshots[1] {
+		t.Errorf("Got the same snapshot %s twice; want different files", snapshots[0])
+	}
+	if first, second := len(readTrace(t, snapshots[0])), len(readTrace(t, snapshots[1])); first == 0 || second <= first {
+		t.Errorf("Got %d and %d events in snapshots; want a growing non-empty trace", first, second)
+	}
+
+	// Snapshots must not prevent the trace from being written on exit.
+	if err := state.TearDown(t); err != nil {
+		t.Fatalf("Failed to unmount file system: %v", err)
+	}
+	if len(readTrace(t, trace)) < len(readTrace(t, snapshots[1])) {
+		t.Errorf("Got final trace with fewer events than the last snapshot")
+	}
+}
+
+func TestProfiling_SnapshotWithoutTraceProfile(t *testing.T) {
+	address := freeAddress(t)
+	state := utils.MountSetup(t, "--listen_address="+address, "--enable_http_snapshot", "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(t)
+
+	status, body := postSnapshot(t, address)
+	if status != http.StatusConflict || !strings.Contains(body, "--trace_profile") {
+		t.Errorf("Got status %d with body %q; want %d mentioning --trace_profile", status, body, http.StatusConflict)
+	}
+}
+
+func TestProfiling_SnapshotNotEnabled(t *testing.T) {
+	address := freeAddress(t)
+	state := utils.MountSetup(t, "--listen_address="+address, "--trace_profile=%ROOT%/../trace.json", "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(t)
+
+	status, body := postSnapshot(t, address)
+	if status != http.StatusForbidden || !strings.Contains(body, "--enable_http_snapshot") {
+		t.Errorf("Got status %d with body %q; want %d mentioning --enable_http_snapshot", status, body, http.StatusForbidden)
+	}
+	matches, err := filepath.Glob(state.RootPath("../trace.json.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 0 {
+		t.Errorf("Got snapshots %v; want none written", matches)
+	}
+}
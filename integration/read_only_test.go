@@ -15,14 +15,18 @@
 package integration
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"syscall"
 	"testing"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 
@@ -174,6 +178,141 @@ func TestReadOnly_ReadLargeDir(t *testing.T) {
 	}
 }
 
+func TestReadOnly_ReadLargeDirInSmallChunks(t *testing.T) {
+	state := utils.MountSetup(t, "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(t)
+
+	utils.MustMkdirAll(t, state.RootPath("dir"), 0755)
+	wantNames := make(map[string]bool)
+	for i := 0; i < 2000; i++ {
+		name := fmt.Sprintf("file-%08d", i)
+		utils.MustWriteFile(t, state.RootPath("dir", name), 0644, "")
+		wantNames[name] = true
+	}
+
+	fd, err := unix.Open(state.MountPath("dir"), unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatalf("Failed to open directory: %v", err)
+	}
+	defer unix.Close(fd)
+
+	// Use a buffer much smaller than the replies sent by sandboxfs so that the kernel has to
+	// discard the entries that don't fit and ask for them again on the next read.  Do this twice
+	// to also verify that rewinding the directory restarts the listing.
+	for i := 0; i < 2; i++ {
+		if _, err := unix.Seek(fd, 0, 0); err != nil {
+			t.Fatalf("Failed to rewind directory: %v", err)
+		}
+
+		names := make(map[string]bool)
+		buf := make([]byte, 256)
+		for {
+			n, err := unix.ReadDirent(fd, buf)
+			if err != nil {
+				t.Fatalf("ReadDirent failed: %v", err)
+			}
+			if n == 0 {
+				break
+			}
+			_, _, entries := unix.ParseDirent(buf[:n], -1, nil)
+			for _, name := range entries {
+				if names[name] {
+					t.Errorf("Iteration %d returned duplicate entry for %s", i, name)
+				}
+				names[name] = true
+			}
+		}
+		if !reflect.DeepEqual(wantNames, names) {
+			t.Errorf("Iteration %d got %d entries; want %d", i, len(names), len(wantNames))
+		}
+	}
+}
+
+// BenchmarkReadOnly_ReadHugeDir measures the cost of listing a directory with many entries, all
+// of which are already known to sandboxfs after the first listing.
+func BenchmarkReadOnly_ReadHugeDir(b *testing.B) {
+	const numEntries = 100000
+
+	rootSetup := func(root string) error {
+		dir := filepath.Join(root, "dir")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		for i := 0; i < numEntries; i++ {
+			if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file-%08d", i)), nil, 0644); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	state := utils.MountSetupWithRootSetup(b, rootSetup, "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(b)
+
+	fd, err := unix.Open(state.MountPath("dir"), unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		b.Fatalf("Failed to open directory: %v", err)
+	}
+	defer unix.Close(fd)
+
+	buf := make([]byte, 64*1024)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := unix.Seek(fd, 0, 0); err != nil {
+			b.Fatalf("Failed to rewind directory: %v", err)
+		}
+		count := 0
+		for {
+			n, err := unix.ReadDirent(fd, buf)
+			if err != nil {
+				b.Fatalf("ReadDirent failed: %v", err)
+			}
+			if n == 0 {
+				break
+			}
+			_, _, names := unix.ParseDirent(buf[:n], -1, nil)
+			count += len(names)
+		}
+		if count != numEntries {
+			b.Fatalf("Got %d entries; want %d", count, numEntries)
+		}
+	}
+}
+
+// BenchmarkReadOnly_ReadBigFile measures the throughput of sequential reads of a big file.  The
+// file is sparse so that the benchmark measures the cost of going through the file system instead
+// of the speed of the underlying disk.
+func BenchmarkReadOnly_ReadBigFile(b *testing.B) {
+	const size = 2 << 30
+
+	rootSetup := func(root string) error {
+		file, err := os.Create(filepath.Join(root, "big"))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return file.Truncate(size)
+	}
+	state := utils.MountSetupWithRootSetup(b, rootSetup, "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(b)
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		file, err := os.Open(state.MountPath("big"))
+		if err != nil {
+			b.Fatalf("Failed to open file: %v", err)
+		}
+		n, err := io.Copy(ioutil.Discard, file)
+		file.Close()
+		if err != nil {
+			b.Fatalf("Failed to read file: %v", err)
+		}
+		if n != size {
+			b.Fatalf("Read %d bytes; want %d", n, size)
+		}
+	}
+}
+
 func TestReadOnly_RepeatedReadDirsWhileDirIsOpen(t *testing.T) {
 	state := utils.MountSetup(t, "--mapping=ro:/:%ROOT%", "--mapping=ro:/dir:%ROOT%/dir", "--mapping=ro:/scaffold/abc:%ROOT%/dir")
 	defer state.TearDown(t)
@@ -217,15 +356,85 @@ func TestReadOnly_RepeatedReadDirsWhileDirIsOpen(t *testing.T) {
 	}
 }
 
+// readDirentTypes lists the directory at path and returns the type reported by the file system for
+// each entry, excluding the "." and ".." entries.
+func readDirentTypes(t *testing.T, path string) map[string]uint8 {
+	t.Helper()
+
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatalf("Failed to open directory %s: %v", path, err)
+	}
+	defer unix.Close(fd)
+
+	types := make(map[string]uint8)
+	buf := make([]byte, 4096)
+	for {
+		n, err := unix.ReadDirent(fd, buf)
+		if err != nil {
+			t.Fatalf("ReadDirent failed: %v", err)
+		}
+		if n == 0 {
+			break
+		}
+		for offset := 0; offset < n; {
+			dirent := (*unix.Dirent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := (*[len(dirent.Name)]byte)(unsafe.Pointer(&dirent.Name[0]))
+			name := string(nameBytes[:bytes.IndexByte(nameBytes[:], 0)])
+			if name != "." && name != ".." {
+				types[name] = dirent.Type
+			}
+			offset += int(dirent.Reclen)
+		}
+	}
+	return types
+}
+
+func TestReadOnly_DirentTypes(t *testing.T) {
+	// Targets given via --mapping are created as directories before the root setup hook runs,
+	// so map the file from a mapping file instead.
+	rootSetup := func(root string) error {
+		if err := os.MkdirAll(filepath.Join(root, "dir/subdir"), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, "dir/file"), nil, 0644); err != nil {
+			return err
+		}
+		if err := os.Symlink("file", filepath.Join(root, "dir/symlink")); err != nil {
+			return err
+		}
+		contents := "ro:/:" + root + "\n" +
+			"ro:/scaffold/mapped-dir:" + filepath.Join(root, "dir/subdir") + "\n" +
+			"ro:/scaffold/mapped-file:" + filepath.Join(root, "dir/file") + "\n"
+		return ioutil.WriteFile(filepath.Join(root, "..", "mappings"), []byte(contents), 0644)
+	}
+	state := utils.MountSetupWithRootSetup(t, rootSetup, "--mapping_file=%ROOT%/../mappings")
+	defer state.TearDown(t)
+
+	wantTypes := map[string]uint8{"file": unix.DT_REG, "subdir": unix.DT_DIR, "symlink": unix.DT_LNK}
+	if types := readDirentTypes(t, state.MountPath("dir")); !reflect.DeepEqual(wantTypes, types) {
+		t.Errorf("Got types %v for mapped directory; want %v", types, wantTypes)
+	}
+
+	wantTypes = map[string]uint8{"mapped-dir": unix.DT_DIR, "mapped-file": unix.DT_REG}
+	if types := readDirentTypes(t, state.MountPath("scaffold")); !reflect.DeepEqual(wantTypes, types) {
+		t.Errorf("Got types %v for scaffold directory; want %v", types, wantTypes)
+	}
+}
+
 func TestReadOnly_Attributes(t *testing.T) {
 	state := utils.MountSetup(t, "--mapping=ro:/:%ROOT%")
 	defer state.TearDown(t)
 
 	utils.MustMkdirAll(t, state.RootPath("dir"), 0755)
 	utils.MustWriteFile(t, state.RootPath("file"), 0644, "new content")
+	utils.MustWriteFile(t, state.RootPath("sparse"), 0644, "")
+	if err := os.Truncate(state.RootPath("sparse"), 10*1024*1024); err != nil {
+		t.Fatalf("Failed to extend sparse file: %v", err)
+	}
 	utils.MustSymlink(t, "missing", state.RootPath("symlink"))
 
-	for _, name := range []string{"dir", "file", "symlink"} {
+	for _, name := range []string{"dir", "file", "sparse", "symlink"} {
 		outerPath := state.RootPath(name)
 		outerFileInfo, err := os.Lstat(outerPath)
 		if err != nil {
@@ -254,8 +463,6 @@ func TestReadOnly_Attributes(t *testing.T) {
 			t.Errorf("Got ctime %v for %s, want %v", utils.Ctime(innerStat), innerPath, utils.Ctime(outerStat))
 		}
 
-		// Even though we ignore underlying link counts, we expect these internal files to
-		// match the external ones because we did not create additional hard links for them.
 		if innerStat.Nlink != outerStat.Nlink {
 			t.Errorf("Got nlink %v for %s, want %v", innerStat.Nlink, innerPath, outerStat.Nlink)
 		}
@@ -264,6 +471,13 @@ func TestReadOnly_Attributes(t *testing.T) {
 			t.Errorf("Got rdev %v for %s, want %v", innerStat.Rdev, innerPath, outerStat.Rdev)
 		}
 
+		if innerStat.Blocks != outerStat.Blocks {
+			t.Errorf("Got blocks %v for %s, want %v", innerStat.Blocks, innerPath, outerStat.Blocks)
+		}
+		if !outerFileInfo.IsDir() && innerFileInfo.Size() != outerFileInfo.Size() {
+			t.Errorf("Got size %v for %s, want %v", innerFileInfo.Size(), innerPath, outerFileInfo.Size())
+		}
+
 		wantBlksize := outerStat.Blksize // Assign only to automatically determine integer size.
 		// The FUSE bindings for Rust only implement version 7.8 of the kernel
 		// protocol, which does not allow returning a block size from the getattr
@@ -393,7 +607,7 @@ func TestReadOnly_Access(t *testing.T) {
 	}
 }
 
-func TestReadOnly_HardLinkCountsAreFixed(t *testing.T) {
+func TestReadOnly_HardLinkCounts(t *testing.T) {
 	state := utils.MountSetup(t, "--mapping=ro:/:%ROOT%", "--mapping=ro:/scaffold/dir:%ROOT%/dir")
 	defer state.TearDown(t)
 
@@ -412,7 +626,7 @@ func TestReadOnly_HardLinkCountsAreFixed(t *testing.T) {
 	}{
 		{"MappedDir", "dir", 2},
 		{"FileWithOnlyOneName", "no-links", 1},
-		{"FileWithManyNames", "name1", 1},
+		{"FileWithManyNames", "name1", 2},
 		{"ScaffoldDir", "scaffold", 2},
 	}
 	for _, d := range testData {
@@ -470,6 +684,41 @@ func TestReadOnly_ReaddirFromFileFails(t *testing.T) {
 	}
 }
 
+func TestReadOnly_SeekHoleReportsWholeFileAsData(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skipf("SEEK_DATA and SEEK_HOLE values are only known for Linux")
+	}
+	const seekData = 3
+	const seekHole = 4
+
+	state := utils.MountSetup(t, "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(t)
+
+	utils.MustWriteFile(t, state.RootPath("sparse"), 0644, "some data")
+	size := int64(10 * 1024 * 1024)
+	if err := os.Truncate(state.RootPath("sparse"), size); err != nil {
+		t.Fatalf("Failed to extend sparse file: %v", err)
+	}
+
+	file, err := os.Open(state.MountPath("sparse"))
+	if err != nil {
+		t.Fatalf("Failed to open file %s: %v", state.MountPath("sparse"), err)
+	}
+	defer file.Close()
+
+	// The FUSE library we use does not support the lseek operation, so the kernel falls back
+	// to treating the whole file as data regardless of the holes in the underlying file.
+	if offset, err := file.Seek(0, seekData); err != nil || offset != 0 {
+		t.Errorf("Want SEEK_DATA from 0 to return 0; got %v, %v", offset, err)
+	}
+	if offset, err := file.Seek(0, seekHole); err != nil || offset != size {
+		t.Errorf("Want SEEK_HOLE from 0 to return %v; got %v, %v", size, offset, err)
+	}
+	if _, err := file.Seek(size, seekData); err == nil || err.(*os.PathError).Err != unix.ENXIO {
+		t.Errorf("Want SEEK_DATA past the end of the file to fail with ENXIO; got %v", err)
+	}
+}
+
 func TestReadOnly_Listxattrs(t *testing.T) {
 	state := utils.MountSetup(t, "--xattrs", "--mapping=ro:/:%ROOT%")
 	defer state.TearDown(t)
@@ -641,6 +890,129 @@ func TestReadOnly_GetxattrDisabled(t *testing.T) {
 	}
 }
 
+func TestReadOnly_XattrWritesFail(t *testing.T) {
+	state := utils.MountSetup(t, "--xattrs", "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(t)
+
+	utils.MustMkdirAll(t, state.RootPath("dir"), 0755)
+	utils.MustWriteFile(t, state.RootPath("file"), 0644, "")
+	utils.MustSymlink(t, "missing", state.RootPath("symlink"))
+
+	tests := []string{"dir", "file"}
+	if runtime.GOOS != "linux" { // Linux doesn't support xattrs on symlinks.
+		tests = append(tests, "symlink")
+	}
+	for _, name := range tests {
+		wantValue := []byte("original")
+		if err := unix.Lsetxattr(state.RootPath(name), "user.foo", wantValue, 0); err != nil {
+			t.Fatalf("Lsetxattr(%s) failed: %v", name, err)
+		}
+
+		// The permissions of the underlying files allow the writes, so the kernel lets the
+		// requests through and it's sandboxfs that must reject them.
+		path := state.MountPath(name)
+		if err := unix.Lsetxattr(path, "user.foo", []byte("modified"), 0); err != unix.EROFS {
+			t.Errorf("Invalid error from Lsetxattr for %s: got %v, want %v", path, err, unix.EROFS)
+		}
+		if err := unix.Lremovexattr(path, "user.foo"); err != unix.EROFS {
+			t.Errorf("Invalid error from Lremovexattr for %s: got %v, want %v", path, err, unix.EROFS)
+		}
+
+		buf := make([]byte, 32)
+		sz, err := unix.Lgetxattr(state.RootPath(name), "user.foo", buf)
+		if err != nil {
+			t.Fatalf("Lgetxattr(%s) failed: %v", name, err)
+		}
+		value := buf[0:sz]
+		if !reflect.DeepEqual(value, wantValue) {
+			t.Errorf("Invalid attribute for path %s: got %s, want %s", name, value, wantValue)
+		}
+	}
+}
+
+func TestReadOnly_WritesFail(t *testing.T) {
+	state := utils.MountSetup(t, "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(t)
+
+	utils.MustMkdirAll(t, state.RootPath("dir/subdir"), 0755)
+	utils.MustWriteFile(t, state.RootPath("dir/file"), 0644, "contents")
+
+	// The permissions of the underlying files allow all of these operations, so the kernel lets the
+	// requests through and it's sandboxfs that must reject them as a read-only file system would.
+	dir := state.MountPath("dir")
+	file := state.MountPath("dir/file")
+	tests := map[string]func() error{
+		"create": func() error {
+			fd, err := unix.Open(state.MountPath("dir/new"), unix.O_CREAT|unix.O_WRONLY, 0644)
+			if err == nil {
+				unix.Close(fd)
+			}
+			return err
+		},
+		"mkdir":    func() error { return unix.Mkdir(state.MountPath("dir/new"), 0755) },
+		"mknod":    func() error { return unix.Mkfifo(state.MountPath("dir/new"), 0644) },
+		"unlink":   func() error { return unix.Unlink(file) },
+		"rmdir":    func() error { return unix.Rmdir(state.MountPath("dir/subdir")) },
+		"rename":   func() error { return unix.Rename(file, state.MountPath("dir/new")) },
+		"symlink":  func() error { return unix.Symlink("file", state.MountPath("dir/new")) },
+		"link":     func() error { return unix.Link(file, state.MountPath("dir/new")) },
+		"chmod":    func() error { return unix.Chmod(dir, 0700) },
+		"truncate": func() error { return unix.Truncate(file, 0) },
+		"open-for-write": func() error {
+			fd, err := unix.Open(file, unix.O_WRONLY, 0)
+			if err == nil {
+				unix.Close(fd)
+			}
+			return err
+		},
+	}
+	for name, op := range tests {
+		if err := op(); err != unix.EROFS {
+			t.Errorf("Invalid error from %s: got %v, want %v", name, err, unix.EROFS)
+		}
+	}
+
+	if names := readDirNames(t, state.RootPath("dir")); !reflect.DeepEqual([]string{"file", "subdir"}, names) {
+		t.Errorf("Got entries %v in underlying directory; want file and subdir", names)
+	}
+	if err := utils.FileEquals(state.RootPath("dir/file"), "contents"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReadOnly_Statfs(t *testing.T) {
+	state := utils.MountSetup(t, "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(t)
+
+	var wantStat unix.Statfs_t
+	if err := unix.Statfs(state.RootPath(), &wantStat); err != nil {
+		t.Fatalf("Statfs(%s) failed: %v", state.RootPath(), err)
+	}
+	var stat unix.Statfs_t
+	if err := unix.Statfs(state.MountPath(), &stat); err != nil {
+		t.Fatalf("Statfs(%s) failed: %v", state.MountPath(), err)
+	}
+	if stat.Blocks == 0 {
+		t.Errorf("Got 0 blocks for %s; want non-zero", state.MountPath())
+	}
+	if stat.Blocks != wantStat.Blocks {
+		t.Errorf("Got %d blocks for %s; want %d from the underlying file system", stat.Blocks, state.MountPath(), wantStat.Blocks)
+	}
+}
+
+func TestReadOnly_StatfsOnScaffoldRoot(t *testing.T) {
+	state := utils.MountSetup(t, "--mapping=ro:/dir:%ROOT%")
+	defer state.TearDown(t)
+
+	var stat unix.Statfs_t
+	if err := unix.Statfs(state.MountPath(), &stat); err != nil {
+		t.Fatalf("Statfs(%s) failed: %v", state.MountPath(), err)
+	}
+	if stat.Blocks == 0 || stat.Bavail == 0 {
+		t.Errorf("Got %d blocks and %d available for %s; want non-zero values", stat.Blocks, stat.Bavail, state.MountPath())
+	}
+}
+
 // TODO(jmmv): Must have tests to ensure that read-only mappings are, well, read only.
 
 // TODO(jmmv): Should have tests to check what happens when the underlying files are modified
@@ -288,6 +288,188 @@ func TestReadWrite_RewriteFileWithShorterContent(t *testing.T) {
 	}
 }
 
+func TestReadWrite_ConcurrentWritesToSameHandle(t *testing.T) {
+	state := utils.MountSetup(t, "--mapping=rw:/:%ROOT%")
+	defer state.TearDown(t)
+
+	const numWriters = 16
+	const blockSize = 256 * 1024
+
+	file, err := os.OpenFile(state.MountPath("file"), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	defer file.Close()
+
+	errors := make(chan error, numWriters)
+	for i := 0; i < numWriters; i++ {
+		go func(i int) {
+			block := []byte(strings.Repeat(string(rune('a'+i)), blockSize))
+			n, err := file.WriteAt(block, int64(i*blockSize))
+			if err == nil && n != blockSize {
+				err = fmt.Errorf("wrote %d bytes of block %d; want %d", n, i, blockSize)
+			}
+			errors <- err
+		}(i)
+	}
+	for i := 0; i < numWriters; i++ {
+		if err := <-errors; err != nil {
+			t.Error(err)
+		}
+	}
+
+	var want strings.Builder
+	for i := 0; i < numWriters; i++ {
+		want.WriteString(strings.Repeat(string(rune('a'+i)), blockSize))
+	}
+	if err := utils.FileEquals(state.RootPath("file"), want.String()); err != nil {
+		t.Error(err)
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	if fileInfo.Size() != numWriters*blockSize {
+		t.Errorf("Got size %d for file; want %d", fileInfo.Size(), numWriters*blockSize)
+	}
+}
+
+func TestReadWrite_ConcurrentAppends(t *testing.T) {
+	state := utils.MountSetup(t, "--mapping=rw:/:%ROOT%")
+	defer state.TearDown(t)
+
+	const numRecords = 1000
+	writers := []string{"first", "second"}
+
+	utils.MustWriteFile(t, state.MountPath("log"), 0644, "")
+	errors := make(chan error, len(writers))
+	for _, writer := range writers {
+		go func(writer string) {
+			file, err := os.OpenFile(state.MountPath("log"), os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				errors <- err
+				return
+			}
+			defer file.Close()
+			for i := 0; i < numRecords; i++ {
+				if _, err := fmt.Fprintf(file, "%s %08d\n", writer, i); err != nil {
+					errors <- err
+					return
+				}
+			}
+			errors <- nil
+		}(writer)
+	}
+	for range writers {
+		if err := <-errors; err != nil {
+			t.Fatalf("Failed to append to file: %v", err)
+		}
+	}
+
+	contents, err := ioutil.ReadFile(state.RootPath("log"))
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	next := make(map[string]int)
+	for _, line := range strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n") {
+		var writer string
+		var i int
+		if _, err := fmt.Sscanf(line, "%s %d", &writer, &i); err != nil {
+			t.Fatalf("Found torn record %q: %v", line, err)
+		}
+		if i != next[writer] {
+			t.Fatalf("Got record %d from %s; want %d", i, writer, next[writer])
+		}
+		next[writer]++
+	}
+	for _, writer := range writers {
+		if next[writer] != numRecords {
+			t.Errorf("Got %d records from %s; want %d", next[writer], writer, numRecords)
+		}
+	}
+
+	fileInfo, err := os.Stat(state.MountPath("log"))
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+	if fileInfo.Size() != int64(len(contents)) {
+		t.Errorf("Got size %d for file; want %d", fileInfo.Size(), len(contents))
+	}
+}
+
+func TestReadWrite_Fsync(t *testing.T) {
+	state := utils.MountSetup(t, "--mapping=rw:/:%ROOT%", "--mapping=cow:/cow:%ROOT%/lower:%ROOT%/upper")
+	defer state.TearDown(t)
+
+	for _, dir := range []string{"dir", "cow"} {
+		utils.MustMkdirAll(t, state.MountPath(dir), 0755)
+
+		file, err := os.OpenFile(state.MountPath(dir, "file"), os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatalf("Failed to create file in %s: %v", dir, err)
+		}
+		defer file.Close()
+		if _, err := file.WriteString("durable"); err != nil {
+			t.Fatalf("Failed to write to file in %s: %v", dir, err)
+		}
+		if err := file.Sync(); err != nil {
+			t.Errorf("fsync of file in %s failed: %v", dir, err)
+		}
+		if err := unix.Fdatasync(int(file.Fd())); err != nil {
+			t.Errorf("fdatasync of file in %s failed: %v", dir, err)
+		}
+
+		handle, err := os.Open(state.MountPath(dir))
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", dir, err)
+		}
+		defer handle.Close()
+		if err := handle.Sync(); err != nil {
+			t.Errorf("fsync of %s failed: %v", dir, err)
+		}
+	}
+
+	for _, path := range []string{"dir/file", "upper/file"} {
+		if err := utils.FileEquals(state.RootPath(path), "durable"); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestReadWrite_CloseDuppedFds(t *testing.T) {
+	state := utils.MountSetup(t, "--mapping=rw:/:%ROOT%")
+	defer state.TearDown(t)
+
+	fd, err := unix.Open(state.MountPath("file"), unix.O_CREAT|unix.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	dupFd, err := unix.Dup(fd)
+	if err != nil {
+		unix.Close(fd)
+		t.Fatalf("Failed to dup file descriptor: %v", err)
+	}
+
+	// Every close sends a flush for the same handle, and the handle must remain usable through
+	// the descriptors that are still open.
+	if _, err := unix.Write(fd, []byte("first ")); err != nil {
+		t.Errorf("Failed to write through original descriptor: %v", err)
+	}
+	if err := unix.Close(fd); err != nil {
+		t.Errorf("Failed to close original descriptor: %v", err)
+	}
+	if _, err := unix.Write(dupFd, []byte("second")); err != nil {
+		t.Errorf("Failed to write through duplicate descriptor after closing the original: %v", err)
+	}
+	if err := unix.Close(dupFd); err != nil {
+		t.Errorf("Failed to close duplicate descriptor: %v", err)
+	}
+
+	if err := utils.FileEquals(state.RootPath("file"), "first second"); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestReadWrite_WriteOnDeletedAndDuppedFd(t *testing.T) {
 	state := utils.MountSetup(t, "--mapping=rw:/:%ROOT%")
 	defer state.TearDown(t)
@@ -500,6 +682,39 @@ func TestReadWrite_Truncate(t *testing.T) {
 	}
 }
 
+func TestReadWrite_FtruncateOnReplacedFile(t *testing.T) {
+	state := utils.MountSetup(t, "--mapping=rw:/:%ROOT%")
+	defer state.TearDown(t)
+
+	utils.MustWriteFile(t, state.MountPath("file"), 0644, "very long contents")
+	utils.MustWriteFile(t, state.MountPath("replacement"), 0644, "replacement contents")
+
+	file, err := os.OpenFile(state.MountPath("file"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Failed to open file: %v", err)
+	}
+	defer file.Close()
+	if err := os.Rename(state.MountPath("replacement"), state.MountPath("file")); err != nil {
+		t.Fatalf("Failed to rename file: %v", err)
+	}
+
+	// The truncation must apply to the file we opened, not to the one that now has its name.
+	wantContent := "very"
+	if err := file.Truncate(int64(len(wantContent))); err != nil {
+		t.Fatalf("Ftruncate failed: %v", err)
+	}
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatalf("Failed to read from open file: %v", err)
+	}
+	if string(content) != wantContent {
+		t.Errorf("Got content %q for open file; want %q", content, wantContent)
+	}
+	if err := utils.FileEquals(state.MountPath("file"), "replacement contents"); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestReadWrite_FtruncateOnDeletedFile(t *testing.T) {
 	state := utils.MountSetup(t, "--mapping=rw:/:%ROOT%")
 	defer state.TearDown(t)
@@ -689,6 +904,34 @@ func TestReadWrite_MoveFile(t *testing.T) {
 	doRenameTest(t, oldOuterPath, newOuterPath, oldInnerPath, newInnerPath)
 }
 
+func TestReadWrite_MoveAcrossMappings(t *testing.T) {
+	state := utils.MountSetup(t, "--mapping=rw:/:%ROOT%", "--mapping=rw:/rw1:%ROOT%/rw1", "--mapping=rw:/rw2:%ROOT%/rw2", "--mapping=ro:/ro:%ROOT%/ro")
+	defer state.TearDown(t)
+
+	utils.MustMkdirAll(t, state.RootPath("rw1/dir"), 0755)
+	utils.MustWriteFile(t, state.RootPath("rw1/file"), 0644, "rw1")
+	utils.MustWriteFile(t, state.RootPath("ro/file"), 0644, "ro")
+
+	if err := os.Rename(state.MountPath("rw1/file"), state.MountPath("rw1/dir/file")); err != nil {
+		t.Fatalf("Move within a mapping failed: %v", err)
+	}
+	if err := utils.FileEquals(state.RootPath("rw1/dir/file"), "rw1"); err != nil {
+		t.Error(err)
+	}
+
+	// All mappings share the same underlying file system, so a rename would succeed if sandboxfs
+	// did not prevent it.
+	for _, paths := range [][2]string{{"rw1/dir/file", "rw2/file"}, {"ro/file", "rw1/other"}, {"rw1/dir", "dir"}} {
+		err := os.Rename(state.MountPath(paths[0]), state.MountPath(paths[1]))
+		if linkErr, ok := err.(*os.LinkError); !ok || linkErr.Err != unix.EXDEV {
+			t.Errorf("Want move of %s to %s to fail with EXDEV; got %v", paths[0], paths[1], err)
+		}
+		if _, err := os.Lstat(state.RootPath(paths[0])); err != nil {
+			t.Errorf("Failed move of %s lost the source: %v", paths[0], err)
+		}
+	}
+}
+
 func TestReadWrite_MoveRace(t *testing.T) {
 	state := utils.MountSetup(t, "--mapping=rw:/:%ROOT%")
 	defer state.TearDown(t)
@@ -781,7 +1024,7 @@ func TestReadWrite_DeleteAfterMovedDirectory(t *testing.T) {
 func TestReadWrite_Mknod(t *testing.T) {
 	utils.RequireRoot(t, "Requires root privileges to create arbitrary nodes")
 
-	state := utils.MountSetup(t, "--mapping=rw:/:%ROOT%")
+	state := utils.MountSetup(t, "--allow_devices", "--mapping=rw:/:%ROOT%")
 	defer state.TearDown(t)
 
 	// checkNode ensures that a given file is of the specified type and, if the type indicates
@@ -846,6 +1089,7 @@ func TestReadWrite_Mknod(t *testing.T) {
 		{"BlockDevice", "blkdev", 0400, syscall.S_IFBLK, 1234, os.ModeDevice, allOSes},
 		{"CharDevice", "chrdev", 0400, syscall.S_IFCHR, 5678, os.ModeDevice | os.ModeCharDevice, allOSes},
 		{"NamedPipe", "fifo", 0640, syscall.S_IFIFO, 0, os.ModeNamedPipe, allOSes},
+		{"Socket", "socket", 0640, syscall.S_IFSOCK, 0, os.ModeSocket, []string{"linux"}},
 	}
 	for _, d := range testData {
 		t.Run(d.name, func(t *testing.T) {
@@ -881,10 +1125,92 @@ func TestReadWrite_Mknod(t *testing.T) {
 		})
 	}
 }
+
+func TestReadWrite_MknodDevicesNeedFlag(t *testing.T) {
+	utils.RequireRoot(t, "Requires root privileges to create devices")
+
+	state := utils.MountSetup(t, "--mapping=rw:/:%ROOT%")
+	defer state.TearDown(t)
+
+	for _, mknodType := range []uint32{syscall.S_IFBLK, syscall.S_IFCHR} {
+		path := state.MountPath(fmt.Sprintf("dev%d", mknodType))
+		if err := syscall.Mknod(path, 0400|mknodType, 1234); err != syscall.EPERM {
+			t.Errorf("Want mknod of type %o without --allow_devices to fail with EPERM; got %v", mknodType, err)
+		}
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("Want %s to not exist after a rejected mknod; got %v", path, err)
+		}
+	}
+
+	if err := unix.Mkfifo(state.MountPath("fifo"), 0644); err != nil {
+		t.Errorf("Want mkfifo to succeed without --allow_devices; got %v", err)
+	}
+}
+
 func TestReadWrite_MknodAsDifferentUser(t *testing.T) {
 	createAsDifferentUserTest(t, utils.MkfifoAsUser)
 }
 
+func TestReadWrite_Fifo(t *testing.T) {
+	state := utils.MountSetup(t, "--mapping=rw:/:%ROOT%")
+	defer state.TearDown(t)
+
+	utils.MustMkdirAll(t, state.RootPath("dir"), 0755)
+	path := state.MountPath("dir/fifo")
+	if err := unix.Mkfifo(path, 0644); err != nil {
+		t.Fatalf("Mkfifo failed: %v", err)
+	}
+
+	for _, path := range []string{state.RootPath("dir/fifo"), path} {
+		fileInfo, err := os.Lstat(path)
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", path, err)
+		}
+		if fileInfo.Mode()&os.ModeType != os.ModeNamedPipe {
+			t.Errorf("Got mode %v for %s; want a named pipe", fileInfo.Mode(), path)
+		}
+	}
+	entries, err := ioutil.ReadDir(state.MountPath("dir"))
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Mode()&os.ModeType != os.ModeNamedPipe {
+		t.Errorf("Got entries %v; want only a named pipe", entries)
+	}
+
+	// Opening either side of a named pipe blocks until the other side is opened too, so one of
+	// them must live in a separate goroutine.
+	writeErr := make(chan error)
+	go func() {
+		writer, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			writeErr <- err
+			return
+		}
+		_, err = writer.WriteString("message through the pipe")
+		if err2 := writer.Close(); err == nil {
+			err = err2
+		}
+		writeErr <- err
+	}()
+
+	reader, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open %s for reading: %v", path, err)
+	}
+	defer reader.Close()
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to read from %s: %v", path, err)
+	}
+	if err := <-writeErr; err != nil {
+		t.Fatalf("Failed to write to %s: %v", path, err)
+	}
+	if string(content) != "message through the pipe" {
+		t.Errorf("Got %q from the pipe; want %q", content, "message through the pipe")
+	}
+}
+
 func TestReadWrite_Chmod(t *testing.T) {
 	state := utils.MountSetup(t, "--mapping=rw:/:%ROOT%")
 	defer state.TearDown(t)
@@ -1263,6 +1589,55 @@ func TestReadWrite_ChtimesResetsBirthtimeWithMtime(t *testing.T) {
 	}
 }
 
+func TestReadWrite_ChtimesNanosecondPrecision(t *testing.T) {
+	state := utils.MountSetup(t, "--mapping=rw:/:%ROOT%")
+	defer state.TearDown(t)
+
+	utils.MustWriteFile(t, state.RootPath("probe"), 0644, "")
+	probeTime := time.Date(2001, 2, 3, 4, 5, 6, 123456789, time.UTC)
+	if err := os.Chtimes(state.RootPath("probe"), probeTime, probeTime); err != nil {
+		t.Fatalf("Failed to chtimes on %s: %v", state.RootPath("probe"), err)
+	}
+	if fileInfo, err := os.Stat(state.RootPath("probe")); err != nil || !fileInfo.ModTime().Equal(probeTime) {
+		t.Skipf("Underlying file system does not store nanosecond timestamps")
+	}
+
+	// checkTimes ensures that the file has the given times both on the underlying file system and
+	// within the mount point, down to the nanosecond.
+	checkTimes := func(wantAtime time.Time, wantMtime time.Time) {
+		t.Helper()
+		for _, path := range []string{state.RootPath("file"), state.MountPath("file")} {
+			var stat syscall.Stat_t
+			if err := syscall.Stat(path, &stat); err != nil {
+				t.Fatalf("Stat failed on %s: %v", path, err)
+			}
+			if !utils.Atime(&stat).Equal(wantAtime) || !utils.Mtime(&stat).Equal(wantMtime) {
+				t.Errorf("Got atime %v, mtime %v for %s; want atime %v, mtime %v", utils.Atime(&stat), utils.Mtime(&stat), path, wantAtime, wantMtime)
+			}
+		}
+	}
+
+	utils.MustWriteFile(t, state.MountPath("file"), 0644, "")
+	someAtime := time.Date(2009, 5, 25, 9, 0, 0, 987654321, time.UTC)
+	someMtime := time.Date(1984, 8, 10, 19, 15, 0, 123456789, time.UTC)
+	if err := os.Chtimes(state.MountPath("file"), someAtime, someMtime); err != nil {
+		t.Fatalf("Failed to chtimes on %s: %v", state.MountPath("file"), err)
+	}
+	checkTimes(someAtime, someMtime)
+
+	// Changing only one of the times must leave the other one untouched.
+	otherMtime := time.Date(1995, 1, 2, 3, 4, 5, 6, time.UTC)
+	mtimeTimespec, err := unix.TimeToTimespec(otherMtime)
+	if err != nil {
+		t.Fatalf("Failed to convert %v to a timespec: %v", otherMtime, err)
+	}
+	omit := unix.Timespec{Nsec: unix.UTIME_OMIT}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, state.MountPath("file"), []unix.Timespec{omit, mtimeTimespec}, 0); err != nil {
+		t.Fatalf("Failed to set mtime on %s: %v", state.MountPath("file"), err)
+	}
+	checkTimes(someAtime, otherMtime)
+}
+
 func TestReadWrite_FutimesOnDeletedNode(t *testing.T) {
 	state := utils.MountSetup(t, "--mapping=rw:/:%ROOT%")
 	defer state.TearDown(t)
@@ -1352,6 +1727,57 @@ func TestReadWrite_HardLinksNotSupported(t *testing.T) {
 	}
 }
 
+func TestReadWrite_HardLinksShareNode(t *testing.T) {
+	state := utils.MountSetup(t, "--mapping=rw:/:%ROOT%")
+	defer state.TearDown(t)
+
+	utils.MustMkdirAll(t, state.RootPath("dir"), 0755)
+	utils.MustWriteFile(t, state.RootPath("name1"), 0644, "original")
+	if err := os.Link(state.RootPath("name1"), state.RootPath("dir/name2")); err != nil {
+		t.Fatalf("Failed to create hard link in underlying file system: %v", err)
+	}
+
+	stat1, err := os.Lstat(state.MountPath("name1"))
+	if err != nil {
+		t.Fatalf("Failed to stat name1: %v", err)
+	}
+	stat2, err := os.Lstat(state.MountPath("dir/name2"))
+	if err != nil {
+		t.Fatalf("Failed to stat dir/name2: %v", err)
+	}
+	if !sameInode(stat1, stat2) {
+		t.Errorf("Hard links to the same file got different inodes")
+	}
+	if nlink := stat1.Sys().(*syscall.Stat_t).Nlink; nlink != 2 {
+		t.Errorf("Want hard link count to be 2; got %d", nlink)
+	}
+
+	utils.MustWriteFile(t, state.MountPath("name1"), 0644, "modified")
+	if err := utils.FileEquals(state.MountPath("dir/name2"), "modified"); err != nil {
+		t.Error(err)
+	}
+
+	if err := os.Remove(state.MountPath("name1")); err != nil {
+		t.Fatalf("Failed to remove name1: %v", err)
+	}
+	if err := os.Rename(state.MountPath("dir/name2"), state.MountPath("dir/name3")); err != nil {
+		t.Fatalf("Failed to rename dir/name2: %v", err)
+	}
+	stat3, err := os.Lstat(state.MountPath("dir/name3"))
+	if err != nil {
+		t.Fatalf("Failed to stat dir/name3: %v", err)
+	}
+	if nlink := stat3.Sys().(*syscall.Stat_t).Nlink; nlink != 1 {
+		t.Errorf("Want hard link count to be 1 after removing a name; got %d", nlink)
+	}
+	if err := utils.FileEquals(state.MountPath("dir/name3"), "modified"); err != nil {
+		t.Error(err)
+	}
+	if err := utils.FileEquals(state.RootPath("dir/name3"), "modified"); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestReadWrite_SymlinkAndReadlink(t *testing.T) {
 	state := utils.MountSetup(t, "--mapping=rw:/:%ROOT%")
 	defer state.TearDown(t)
@@ -1546,7 +1972,7 @@ func TestReadWrite_Removexattr(t *testing.T) {
 	if runtime.GOOS != "linux" { // Linux doesn't support xattrs on symlinks.
 		tests = append(tests, "symlink")
 	}
-	for _, name := range []string{"dir", "file"} {
+	for _, name := range tests {
 		if err := unix.Lsetxattr(state.RootPath(name), "user.foo", []byte("some-value"), 0); err != nil {
 			t.Fatalf("Lsetxattr(%s) failed: %v", name, err)
 		}
@@ -20,124 +20,51 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
 	"testing"
 
+	"github.com/bazelbuild/sandboxfs/client"
 	"github.com/bazelbuild/sandboxfs/integration/utils"
 )
 
-// mapping represents a mapping entry in the reconfiguration protocol.
-type mapping struct {
-	Path                 string `json:"path"`
-	PathPrefix           int    `json:"path_prefix"`
-	UnderlyingPath       string `json:"underlying_path"`
-	UnderlyingPathPrefix int    `json:"underlying_path_prefix"`
-	Writable             bool   `json:"writable"`
-}
-
-// mapStep represents a map operation in the reconfiguration protocol.
-type createSandboxRequest struct {
-	ID       string            `json:"id"`
-	Mappings []mapping         `json:"mappings"`
-	Prefixes map[string]string `json:"prefixes"`
-}
-
-// request represents a single reconfiguration request.
-type request struct {
-	CreateSanbox   *createSandboxRequest `json:"CreateSandbox,omitempty"`
-	DestroySandbox *string               `json:"DestroySandbox,omitempty"`
-}
-
-// getID returns the sandbox identifier in a request message.
-func (req request) getID() string {
-	if req.CreateSanbox != nil && req.DestroySandbox != nil {
-		panic("Bad request: contains both create and destroy requests")
-	} else if req.CreateSanbox != nil {
-		return req.CreateSanbox.ID
-	} else {
-		return *req.DestroySandbox
-	}
-}
-
-// response represents the result of a reconfiguration request.
-type response struct {
-	ID    *string `json:"id,omitempty"`
-	Error *string `json:"error,omitempty"`
-}
-
-// makeCreateSandboxRequest is a convenience function to instantiate a single map step.
-func makeCreateSandboxRequest(id string, mapping1 mapping, mappingN ...mapping) request {
-	return request{
-		CreateSanbox: &createSandboxRequest{
-			ID:       id,
-			Mappings: append([]mapping{mapping1}, mappingN...),
-			Prefixes: make(map[string]string),
-		},
-	}
-}
-
-// makeDestroySandboxRequest is a convenience function to instantiate a single unmap step.
-func makeDestroySandboxRequest(id string) request {
-	return request{
-		DestroySandbox: &id,
-	}
+// rawResponse represents the result of a reconfiguration request sent without client.Client,
+// which tests only do to issue requests that the client cannot produce (such as malformed or
+// prefix-compressed ones) or to use transports that the client does not support.
+type rawResponse struct {
+	ID       *string                `json:"id"`
+	Error    *string                `json:"error"`
+	Mappings []client.ActiveMapping `json:"mappings"`
 }
 
 // tryRawReconfigure pushes a new configuration to the sandboxfs process and waits for
 // acknowledgement. The reconfiguration request is provided as a string, which may be invalid (to
 // verify error cases). Returns the error message from the server, which might be nil.
-func tryRawReconfigure(input io.Writer, output io.Reader, root string, config string) (response, error) {
+func tryRawReconfigure(input io.Writer, output io.Reader, root string, config string) (rawResponse, error) {
 	config = strings.Replace(string(config), "%ROOT%", root, -1) + "\n"
 	n, err := io.WriteString(input, config)
 	if err != nil {
-		return response{}, fmt.Errorf("failed to send new configuration to sandboxfs: %v", err)
+		return rawResponse{}, fmt.Errorf("failed to send new configuration to sandboxfs: %v", err)
 	}
 	if n != len(config) {
-		return response{}, fmt.Errorf("failed to send full configuration to sandboxfs: got %d bytes, want %d bytes", n, len(config))
+		return rawResponse{}, fmt.Errorf("failed to send full configuration to sandboxfs: got %d bytes, want %d bytes", n, len(config))
 	}
 
 	decoder := json.NewDecoder(output)
-	resp := response{}
+	resp := rawResponse{}
 	if err := decoder.Decode(&resp); err != nil {
-		return response{}, fmt.Errorf("failed to read from sandboxfs's output: %v", err)
+		return rawResponse{}, fmt.Errorf("failed to read from sandboxfs's output: %v", err)
 	}
 	return resp, nil
 }
 
-// tryReconfigure pushes a new configuration to the sandboxfs process and waits for
-// acknowledgement. The reconfiguration request is provided as a sequence of objects, which is
-// assumed to be valid (except for semantical errors). Returns the error message from the server,
-// which might be nil.
-func tryReconfigure(input io.Writer, output io.Reader, root string, config request) (response, error) {
-	configBytes, err := json.Marshal(config)
-	if err != nil {
-		panic(fmt.Sprintf("Bad configuration request in test: %v", err))
-	}
-	return tryRawReconfigure(input, output, root, string(configBytes))
-}
-
-// reconfigure pushes a new configuration to the sandboxfs process and waits for acknowledgement.
-func reconfigure(input io.Writer, output io.Reader, root string, requests ...request) error {
-	for _, req := range requests {
-		resp, err := tryReconfigure(input, output, root, req)
-		if err != nil {
-			return err
-		}
-		if resp.ID == nil || *resp.ID != req.getID() {
-			return fmt.Errorf("sandboxfs replied with a bad id: got %v, want %s", resp.ID, req.getID())
-		}
-		if resp.Error != nil {
-			return fmt.Errorf("sandboxfs did not ack configuration: %s", *resp.Error)
-		}
-	}
-	return nil
-}
-
 // existsViaReaddir checks if a directory entry exists within a directory by scanning the contents
 // of the directory itself (i.e. via readdir), not by attempting a direct lookup on the entry.
 func existsViaReaddir(dir string, name string) (bool, error) {
@@ -175,8 +102,8 @@ func errorIfNotUnmapped(t *testing.T, dir string, name string) {
 func TestReconfiguration_Streams(t *testing.T) {
 	reconfigureAndCheck := func(t *testing.T, state *utils.MountState, input io.Writer, output io.Reader) {
 		utils.MustMkdirAll(t, state.RootPath("a/b"), 0755)
-		config := makeCreateSandboxRequest("sb", mapping{Path: "/ro", UnderlyingPath: "%ROOT%/a", Writable: false})
-		if err := reconfigure(input, output, state.RootPath(), config); err != nil {
+		c := client.New(input, output)
+		if err := c.Map("sb", []client.Mapping{{Path: "/ro", UnderlyingPath: state.RootPath("a")}}); err != nil {
 			t.Fatal(err)
 		}
 
@@ -241,13 +168,13 @@ func TestReconfiguration_Steps(t *testing.T) {
 
 	utils.MustMkdirAll(t, state.RootPath("some/read-only-dir"), 0755)
 	utils.MustMkdirAll(t, state.RootPath("some/read-write-dir"), 0755)
-	config := makeCreateSandboxRequest(
-		"sb",
-		mapping{Path: "/ro", UnderlyingPath: "%ROOT%/some/read-only-dir", Writable: false},
-		mapping{Path: "/ro/rw", UnderlyingPath: "%ROOT%/some/read-write-dir", Writable: true},
-		mapping{Path: "/nested/dup", UnderlyingPath: "%ROOT%/some/read-only-dir", Writable: false},
-	)
-	if err := reconfigure(state.Stdin, stdoutReader, state.RootPath(), config); err != nil {
+	c := client.New(state.Stdin, stdoutReader)
+	mappings := []client.Mapping{
+		{Path: "/ro", UnderlyingPath: state.RootPath("some/read-only-dir"), Writable: false},
+		{Path: "/ro/rw", UnderlyingPath: state.RootPath("some/read-write-dir"), Writable: true},
+		{Path: "/nested/dup", UnderlyingPath: state.RootPath("some/read-only-dir"), Writable: false},
+	}
+	if err := c.Map("sb", mappings); err != nil {
 		t.Fatal(err)
 	}
 
@@ -270,8 +197,8 @@ func TestReconfiguration_Steps(t *testing.T) {
 		t.Errorf("Mkdir succeeded in read-only root mapping")
 	}
 
-	config = makeCreateSandboxRequest("sb2", mapping{Path: "/rw/dir", UnderlyingPath: "%ROOT%/some/read-write-dir", Writable: true})
-	if err := reconfigure(state.Stdin, stdoutReader, state.RootPath(), config); err != nil {
+	mappings = []client.Mapping{{Path: "/rw/dir", UnderlyingPath: state.RootPath("some/read-write-dir"), Writable: true}}
+	if err := c.Map("sb2", mappings); err != nil {
 		t.Fatal(err)
 	}
 
@@ -285,8 +212,7 @@ func TestReconfiguration_Steps(t *testing.T) {
 		t.Errorf("Mkdir failed in read-write mapping: %v", err)
 	}
 
-	config = makeDestroySandboxRequest("sb")
-	if err := reconfigure(state.Stdin, stdoutReader, state.RootPath(), config); err != nil {
+	if err := c.Destroy("sb"); err != nil {
 		t.Fatal(err)
 	}
 
@@ -304,22 +230,15 @@ func TestReconfiguration_EmptySubroot(t *testing.T) {
 	defer state.TearDown(t)
 	defer stdoutWriter.Close() // Just in case the test fails half-way through.
 
-	config := request{
-		CreateSanbox: &createSandboxRequest{
-			ID:       "empty",
-			Mappings: []mapping{},
-			Prefixes: make(map[string]string),
-		},
-	}
-	if err := reconfigure(state.Stdin, stdoutReader, state.RootPath(), config); err != nil {
+	c := client.New(state.Stdin, stdoutReader)
+	if err := c.Map("empty", []client.Mapping{}); err != nil {
 		t.Fatal(err)
 	}
 	if _, err := os.Lstat(state.MountPath("empty")); err != nil {
 		t.Errorf("Failed to stat empty root: %v", err)
 	}
 
-	config = makeDestroySandboxRequest("empty")
-	if err := reconfigure(state.Stdin, stdoutReader, state.RootPath(), config); err != nil {
+	if err := c.Destroy("empty"); err != nil {
 		t.Fatal(err)
 	}
 	errorIfNotUnmapped(t, state.MountPath(), "empty")
@@ -335,18 +254,16 @@ func TestReconfiguration_Subroots(t *testing.T) {
 	utils.MustMkdirAll(t, state.RootPath("sandbox1"), 0755)
 	utils.MustMkdirAll(t, state.RootPath("sandbox1subdir"), 0755)
 	utils.MustMkdirAll(t, state.RootPath("sandbox2"), 0755)
-	config := []request{
-		makeCreateSandboxRequest(
-			"sandbox1",
-			mapping{Path: "/", UnderlyingPath: "%ROOT%/sandbox1", Writable: true},
-			mapping{Path: "/subdir", UnderlyingPath: "%ROOT%/sandbox1subdir", Writable: true},
-		),
-		makeCreateSandboxRequest(
-			"sandbox2",
-			mapping{Path: "/", UnderlyingPath: "%ROOT%/sandbox2", Writable: true},
-		),
+	c := client.New(state.Stdin, stdoutReader)
+	mappings := []client.Mapping{
+		{Path: "/", UnderlyingPath: state.RootPath("sandbox1"), Writable: true},
+		{Path: "/subdir", UnderlyingPath: state.RootPath("sandbox1subdir"), Writable: true},
+	}
+	if err := c.Map("sandbox1", mappings); err != nil {
+		t.Fatal(err)
 	}
-	if err := reconfigure(state.Stdin, stdoutReader, state.RootPath(), config...); err != nil {
+	mappings = []client.Mapping{{Path: "/", UnderlyingPath: state.RootPath("sandbox2"), Writable: true}}
+	if err := c.Map("sandbox2", mappings); err != nil {
 		t.Fatal(err)
 	}
 	for _, path := range []string{"sandbox1/a", "sandbox1/subdir/b", "sandbox2/c"} {
@@ -361,14 +278,572 @@ func TestReconfiguration_Subroots(t *testing.T) {
 	}
 
 	for _, subroot := range []string{"sandbox1", "sandbox2"} {
-		config := makeDestroySandboxRequest(subroot)
-		if err := reconfigure(state.Stdin, stdoutReader, state.RootPath(), config); err != nil {
+		if err := c.Destroy(subroot); err != nil {
 			t.Fatal(err)
 		}
 		errorIfNotUnmapped(t, state.MountPath(), subroot)
 	}
 }
 
+func TestReconfiguration_IncrementalMap(t *testing.T) {
+	stdoutReader, stdoutWriter := io.Pipe()
+	state := utils.MountSetupWithOutputs(t, stdoutWriter, os.Stderr)
+	defer stdoutReader.Close() // Just in case the test fails half-way through.
+	defer state.TearDown(t)
+	defer stdoutWriter.Close() // Just in case the test fails half-way through.
+
+	utils.MustMkdirAll(t, state.RootPath("dir"), 0755)
+	utils.MustWriteFile(t, state.RootPath("dir/file"), 0644, "contents")
+	c := client.New(state.Stdin, stdoutReader)
+	if err := c.Map("sb", []client.Mapping{{Path: "/a/first", UnderlyingPath: state.RootPath("dir")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep a handle open on a file within the existing mapping to verify that adding new
+	// mappings does not rebuild the tree under it.
+	file, err := os.Open(state.MountPath("sb/a/first/file"))
+	if err != nil {
+		t.Fatalf("Failed to open file in existing mapping: %v", err)
+	}
+	defer file.Close()
+	var before syscall.Stat_t
+	if err := syscall.Fstat(int(file.Fd()), &before); err != nil {
+		t.Fatalf("Failed to stat open file: %v", err)
+	}
+
+	mappings := []client.Mapping{
+		{Path: "/a/second", UnderlyingPath: state.RootPath("dir")},
+		{Path: "/b/c/third", UnderlyingPath: state.RootPath("dir/file")},
+	}
+	if err := c.Map("sb", mappings); err != nil {
+		t.Fatal(err)
+	}
+	if err := utils.DirEntryNamesEqual(state.MountPath("sb/a"), []string{"first", "second"}); err != nil {
+		t.Error(err)
+	}
+	if err := utils.FileEquals(state.MountPath("sb/b/c/third"), "contents"); err != nil {
+		t.Error(err)
+	}
+
+	var after syscall.Stat_t
+	if err := syscall.Lstat(state.MountPath("sb/a/first/file"), &after); err != nil {
+		t.Fatalf("Failed to stat file in existing mapping: %v", err)
+	}
+	if before.Ino != after.Ino {
+		t.Errorf("Existing node was replaced; got inode %d, want %d", after.Ino, before.Ino)
+	}
+
+	// Conflicts with existing mappings must be reported without affecting the sandbox.
+	err = c.Map("sb", []client.Mapping{{Path: "/a/first", UnderlyingPath: state.RootPath("dir")}})
+	if err == nil || !utils.MatchesRegexp("Cannot map.*/a/first.*Already mapped", err.Error()) {
+		t.Errorf("Want conflicting map to fail with Already mapped; got %v", err)
+	}
+	if err := utils.DirEntryNamesEqual(state.MountPath("sb/a/first"), []string{"file"}); err != nil {
+		t.Error(err)
+	}
+}
+
+// benchmarkIncrementalMap measures the cost of adding one mapping to a sandbox that already holds
+// many, either by recreating the whole sandbox or by grafting the new mapping onto it.
+func benchmarkIncrementalMap(b *testing.B, incremental bool) {
+	const existingMappings = 10000
+
+	stdoutReader, stdoutWriter := io.Pipe()
+	state := utils.MountSetupWithOutputs(b, stdoutWriter, os.Stderr)
+	defer stdoutReader.Close()
+	defer state.TearDown(b)
+	defer stdoutWriter.Close()
+
+	utils.MustMkdirAll(b, state.RootPath("dir"), 0755)
+	c := client.New(state.Stdin, stdoutReader)
+	mappings := make([]client.Mapping, 0, existingMappings+b.N)
+	for i := 0; i < existingMappings; i++ {
+		mappings = append(mappings, client.Mapping{Path: fmt.Sprintf("/d%d/m%d", i%100, i), UnderlyingPath: state.RootPath("dir")})
+	}
+	if err := c.Map("sb", mappings); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		extra := client.Mapping{Path: fmt.Sprintf("/extra/e%d", i), UnderlyingPath: state.RootPath("dir")}
+		if incremental {
+			if err := c.Map("sb", []client.Mapping{extra}); err != nil {
+				b.Fatal(err)
+			}
+		} else {
+			mappings = append(mappings, extra)
+			if err := c.Destroy("sb"); err != nil {
+				b.Fatal(err)
+			}
+			if err := c.Map("sb", mappings); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkReconfiguration_AddMappingFullSwap(b *testing.B) {
+	benchmarkIncrementalMap(b, false)
+}
+
+func BenchmarkReconfiguration_AddMappingIncremental(b *testing.B) {
+	benchmarkIncrementalMap(b, true)
+}
+
+// BenchmarkReconfiguration_LookupsDuringReconfigurations measures the cost of getting the
+// attributes of a file from many concurrent readers while reconfigurations keep modifying the
+// file system.  Run with a high -cpu value to exercise the contention on the node table.
+func BenchmarkReconfiguration_LookupsDuringReconfigurations(b *testing.B) {
+	stdoutReader, stdoutWriter := io.Pipe()
+	state := utils.MountSetupWithOutputs(b, stdoutWriter, os.Stderr, "--ttl=0s")
+	defer stdoutReader.Close()
+	defer state.TearDown(b)
+	defer stdoutWriter.Close()
+
+	utils.MustMkdirAll(b, state.RootPath("dir"), 0755)
+	utils.MustWriteFile(b, state.RootPath("dir/file"), 0644, "")
+	c := client.New(state.Stdin, stdoutReader)
+	mappings := []client.Mapping{{Path: "/dir", UnderlyingPath: state.RootPath("dir")}}
+	if err := c.Map("sb", mappings); err != nil {
+		b.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := c.Map("churn", mappings); err != nil {
+				b.Error(err)
+				return
+			}
+			if err := c.Destroy("churn"); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := os.Lstat(state.MountPath("sb/dir/file")); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+
+	close(done)
+	wg.Wait()
+}
+
+func TestReconfiguration_StableInodes(t *testing.T) {
+	stdoutReader, stdoutWriter := io.Pipe()
+	state := utils.MountSetupWithOutputs(t, stdoutWriter, os.Stderr)
+	defer stdoutReader.Close() // Just in case the test fails half-way through.
+	defer state.TearDown(t)
+	defer stdoutWriter.Close() // Just in case the test fails half-way through.
+
+	utils.MustMkdirAll(t, state.RootPath("dir"), 0755)
+	utils.MustWriteFile(t, state.RootPath("dir/file"), 0644, "contents")
+	utils.MustWriteFile(t, state.RootPath("other"), 0644, "")
+	c := client.New(state.Stdin, stdoutReader)
+	mappings := []client.Mapping{
+		{Path: "/a/b/dir", UnderlyingPath: state.RootPath("dir"), Writable: false},
+		{Path: "/other", UnderlyingPath: state.RootPath("other"), Writable: true},
+	}
+
+	paths := []string{"sb", "sb/a", "sb/a/b", "sb/a/b/dir", "sb/a/b/dir/file", "sb/other"}
+	statAll := func() map[string]uint64 {
+		inodes := make(map[string]uint64)
+		for _, path := range paths {
+			var stat syscall.Stat_t
+			if err := syscall.Lstat(state.MountPath(path), &stat); err != nil {
+				t.Fatalf("Failed to stat %s: %v", path, err)
+			}
+			inodes[path] = stat.Ino
+		}
+		return inodes
+	}
+
+	if err := c.Map("sb", mappings); err != nil {
+		t.Fatal(err)
+	}
+	before := statAll()
+
+	if err := c.Destroy("sb"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Map("sb", mappings); err != nil {
+		t.Fatal(err)
+	}
+	after := statAll()
+
+	for _, path := range paths {
+		if before[path] != after[path] {
+			t.Errorf("Inode of %s changed across reconfigurations; got %d, want %d", path, after[path], before[path])
+		}
+	}
+}
+
+func TestReconfiguration_OpenRootHandleSurvives(t *testing.T) {
+	stdoutReader, stdoutWriter := io.Pipe()
+	state := utils.MountSetupWithOutputs(t, stdoutWriter, os.Stderr)
+	defer stdoutReader.Close() // Just in case the test fails half-way through.
+	defer state.TearDown(t)
+	defer stdoutWriter.Close() // Just in case the test fails half-way through.
+
+	utils.MustMkdirAll(t, state.RootPath("dir"), 0755)
+
+	// The root directory is a single node whose contents change across reconfigurations, so
+	// handles opened on it before a reconfiguration must keep working after it.
+	root, err := os.Open(state.MountPath())
+	if err != nil {
+		t.Fatalf("Failed to open root directory: %v", err)
+	}
+	defer root.Close()
+	readRoot := func() []string {
+		t.Helper()
+		if _, err := root.Seek(0, io.SeekStart); err != nil {
+			t.Fatalf("Failed to rewind root directory: %v", err)
+		}
+		names, err := root.Readdirnames(-1)
+		if err != nil {
+			t.Fatalf("Failed to read root directory: %v", err)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	c := client.New(state.Stdin, stdoutReader)
+	if err := c.Map("sb", []client.Mapping{{Path: "/dir", UnderlyingPath: state.RootPath("dir")}}); err != nil {
+		t.Fatal(err)
+	}
+	if names := readRoot(); !reflect.DeepEqual([]string{"sb"}, names) {
+		t.Errorf("Got root entries %v after mapping sb; want [sb]", names)
+	}
+
+	if err := c.Destroy("sb"); err != nil {
+		t.Fatal(err)
+	}
+	if names := readRoot(); len(names) != 0 {
+		t.Errorf("Got root entries %v after unmapping sb; want none", names)
+	}
+}
+
+func TestReconfiguration_WorkingDirectorySurvivesRemapping(t *testing.T) {
+	stdoutReader, stdoutWriter := io.Pipe()
+	state := utils.MountSetupWithOutputs(t, stdoutWriter, os.Stderr)
+	defer stdoutReader.Close() // Just in case the test fails half-way through.
+	defer state.TearDown(t)
+	defer stdoutWriter.Close() // Just in case the test fails half-way through.
+
+	utils.MustMkdirAll(t, state.RootPath("dir"), 0755)
+	utils.MustWriteFile(t, state.RootPath("dir/file"), 0644, "")
+	c := client.New(state.Stdin, stdoutReader)
+	mappings := []client.Mapping{{Path: "/dir", UnderlyingPath: state.RootPath("dir")}}
+	if err := c.Map("sb", mappings); err != nil {
+		t.Fatal(err)
+	}
+
+	// Start a process within the mapped directory and let it list its working directory only
+	// once the sandbox has been recreated with the same mapping.
+	cmd := exec.Command("/bin/sh", "-c", "read unused && ls")
+	cmd.Dir = state.MountPath("sb/dir")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatalf("Failed to create stdin pipe: %v", err)
+	}
+	var output strings.Builder
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start process within the sandbox: %v", err)
+	}
+
+	if err := c.Destroy("sb"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Map("sb", mappings); err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Fprintln(stdin)
+	stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("Process failed to list its working directory after the reconfiguration: %v; output: %s", err, output.String())
+	}
+	if output.String() != "file\n" {
+		t.Errorf("Got listing %q of working directory; want %q", output.String(), "file\n")
+	}
+}
+
+func TestReconfiguration_UnmapPaths(t *testing.T) {
+	stdoutReader, stdoutWriter := io.Pipe()
+	state := utils.MountSetupWithOutputs(t, stdoutWriter, os.Stderr)
+	defer stdoutReader.Close() // Just in case the test fails half-way through.
+	defer state.TearDown(t)
+	defer stdoutWriter.Close() // Just in case the test fails half-way through.
+
+	utils.MustMkdirAll(t, state.RootPath("dir"), 0755)
+	utils.MustWriteFile(t, state.RootPath("file"), 0644, "")
+	c := client.New(state.Stdin, stdoutReader)
+	mappings := []client.Mapping{
+		{Path: "/a/b/c", UnderlyingPath: state.RootPath("dir")},
+		{Path: "/a/d", UnderlyingPath: state.RootPath("file")},
+		{Path: "/x/y/z", UnderlyingPath: state.RootPath("file")},
+		{Path: "/top", UnderlyingPath: state.RootPath("dir")},
+	}
+	if err := c.Map("sb", mappings); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Unmap("sb", []string{"/a/b/c", "/x/y/z"}); err != nil {
+		t.Fatal(err)
+	}
+	// The scaffold directories for /a/b and /x/y/z became empty so they must be gone, but /a
+	// still holds another mapping.
+	errorIfNotUnmapped(t, state.MountPath("sb/a"), "b")
+	errorIfNotUnmapped(t, state.MountPath("sb"), "x")
+	if err := utils.DirEntryNamesEqual(state.MountPath("sb"), []string{"a", "top"}); err != nil {
+		t.Error(err)
+	}
+	if err := utils.DirEntryNamesEqual(state.MountPath("sb/a"), []string{"d"}); err != nil {
+		t.Error(err)
+	}
+
+	// Unmapping the last mapping of a sandbox must not remove the sandbox itself.
+	if err := c.Unmap("sb", []string{"/a/d", "/top"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := utils.DirEntryNamesEqual(state.MountPath("sb"), nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReconfiguration_UnmapPathsErrors(t *testing.T) {
+	stdoutReader, stdoutWriter := io.Pipe()
+	state := utils.MountSetupWithOutputs(t, stdoutWriter, os.Stderr)
+	defer stdoutReader.Close() // Just in case the test fails half-way through.
+	defer state.TearDown(t)
+	defer stdoutWriter.Close() // Just in case the test fails half-way through.
+
+	utils.MustMkdirAll(t, state.RootPath("dir/subdir"), 0755)
+	c := client.New(state.Stdin, stdoutReader)
+	if err := c.Map("sb", []client.Mapping{{Path: "/mapped", UnderlyingPath: state.RootPath("dir")}}); err != nil {
+		t.Fatal(err)
+	}
+	// Look up the directory so that sandboxfs knows about it as a non-mapped entry.
+	if _, err := os.Lstat(state.MountPath("sb/mapped/subdir")); err != nil {
+		t.Fatalf("Failed to stat mount path sb/mapped/subdir: %v", err)
+	}
+
+	testData := []struct {
+		name string
+
+		path      string
+		wantError string
+	}{
+		{"NeverMapped", "/missing", "Cannot unmap '/missing': Unknown entry"},
+		{"NotAMapping", "/mapped/subdir", "Cannot unmap '/mapped/subdir': .*subdir.* is not a mapping"},
+		{"SandboxRoot", "/", "Cannot unmap the root of sandbox sb"},
+		{"RelativePath", "mapped", "not absolute"},
+	}
+	for _, d := range testData {
+		t.Run(d.name, func(t *testing.T) {
+			err := c.Unmap("sb", []string{d.path})
+			if err == nil {
+				t.Errorf("want reconfiguration to respond with %s; got OK", d.wantError)
+			} else if !utils.MatchesRegexp(d.wantError, err.Error()) {
+				t.Errorf("want reconfiguration to respond with %s; got %v", d.wantError, err)
+			}
+		})
+	}
+
+	// The stream must still be usable after all the failures above.
+	if err := utils.DirEntryNamesEqual(state.MountPath("sb/mapped"), []string{"subdir"}); err != nil {
+		t.Errorf("Want mapping to survive failed unmaps; got %v", err)
+	}
+	if err := c.Unmap("sb", []string{"/mapped"}); err != nil {
+		t.Fatal(err)
+	}
+	errorIfNotUnmapped(t, state.MountPath("sb"), "mapped")
+}
+
+func TestReconfiguration_ListMappings(t *testing.T) {
+	stdoutReader, stdoutWriter := io.Pipe()
+	state := utils.MountSetupWithOutputs(t, stdoutWriter, os.Stderr)
+	defer stdoutReader.Close() // Just in case the test fails half-way through.
+	defer state.TearDown(t)
+	defer stdoutWriter.Close() // Just in case the test fails half-way through.
+
+	utils.MustMkdirAll(t, state.RootPath("dir"), 0755)
+	utils.MustWriteFile(t, state.RootPath("file"), 0644, "")
+	c := client.New(state.Stdin, stdoutReader)
+	mappings := []client.Mapping{
+		{Path: "/x/y", UnderlyingPath: state.RootPath("file")},
+		{Path: "/a", UnderlyingPath: state.RootPath("dir"), Writable: true, Noexec: true, Perm: 0750},
+	}
+	if err := c.Map("sb", mappings); err != nil {
+		t.Fatal(err)
+	}
+
+	gotMappings, err := c.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantMappings := []client.ActiveMapping{
+		{Path: "/", Scaffold: true},
+		{Path: "/sb", Scaffold: true},
+		{Path: "/sb/a", UnderlyingPath: state.RootPath("dir"), Writable: true, Noexec: true, Perm: 0750},
+		{Path: "/sb/x", Scaffold: true},
+		{Path: "/sb/x/y", UnderlyingPath: state.RootPath("file")},
+	}
+	if !reflect.DeepEqual(wantMappings, gotMappings) {
+		t.Errorf("Got mappings %+v; want %+v", gotMappings, wantMappings)
+	}
+
+	// Unmapping the sandbox must make all of its entries disappear from the list.
+	if err := c.Destroy("sb"); err != nil {
+		t.Fatal(err)
+	}
+	gotMappings, err = c.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantMappings = []client.ActiveMapping{{Path: "/", Scaffold: true}}
+	if !reflect.DeepEqual(wantMappings, gotMappings) {
+		t.Errorf("Got mappings %+v; want %+v", gotMappings, wantMappings)
+	}
+}
+
+func TestReconfiguration_Reads(t *testing.T) {
+	stdoutReader, stdoutWriter := io.Pipe()
+	state := utils.MountSetupWithOutputs(t, stdoutWriter, os.Stderr, "--track_reads")
+	defer stdoutReader.Close() // Just in case the test fails half-way through.
+	defer state.TearDown(t)
+	defer stdoutWriter.Close() // Just in case the test fails half-way through.
+
+	utils.MustMkdirAll(t, state.RootPath("dir"), 0755)
+	utils.MustWriteFile(t, state.RootPath("dir/read"), 0644, "contents")
+	utils.MustWriteFile(t, state.RootPath("dir/unread"), 0644, "contents")
+	c := client.New(state.Stdin, stdoutReader)
+	if err := c.Map("sb", []client.Mapping{{Path: "/in", UnderlyingPath: state.RootPath("dir")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	takeReads := func() *client.ReadSet {
+		t.Helper()
+		reads, err := c.Reads()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reads
+	}
+
+	// Looking up a file is not reading it.
+	if _, err := os.Lstat(state.MountPath("sb/in/unread")); err != nil {
+		t.Fatal(err)
+	}
+	if err := utils.FileEquals(state.MountPath("sb/in/read"), "contents"); err != nil {
+		t.Fatal(err)
+	}
+	want := &client.ReadSet{Paths: []string{"/sb/in/read"}}
+	if got := takeReads(); !reflect.DeepEqual(want, got) {
+		t.Errorf("Got reads %+v; want %+v", got, want)
+	}
+
+	// Taking the reads resets them, but files read again must be reported again.
+	want = &client.ReadSet{Paths: []string{}}
+	if got := takeReads(); !reflect.DeepEqual(want, got) {
+		t.Errorf("Got reads %+v; want %+v", got, want)
+	}
+	if err := utils.FileEquals(state.MountPath("sb/in/read"), "contents"); err != nil {
+		t.Fatal(err)
+	}
+	want = &client.ReadSet{Paths: []string{"/sb/in/read"}}
+	if got := takeReads(); !reflect.DeepEqual(want, got) {
+		t.Errorf("Got reads %+v; want %+v", got, want)
+	}
+}
+
+func TestReconfiguration_ReadsNotEnabled(t *testing.T) {
+	stdoutReader, stdoutWriter := io.Pipe()
+	state := utils.MountSetupWithOutputs(t, stdoutWriter, os.Stderr)
+	defer stdoutReader.Close() // Just in case the test fails half-way through.
+	defer state.TearDown(t)
+	defer stdoutWriter.Close() // Just in case the test fails half-way through.
+
+	reads, err := client.New(state.Stdin, stdoutReader).Reads()
+	wantError := "Read tracking is not enabled; see --track_reads"
+	if err == nil || !strings.HasSuffix(err.Error(), ": "+wantError) {
+		t.Errorf("Got error %v; want %s", err, wantError)
+	}
+	if reads != nil {
+		t.Errorf("Got reads %+v; want none", reads)
+	}
+}
+
+func TestReconfiguration_OptionalMappings(t *testing.T) {
+	stdoutReader, stdoutWriter := io.Pipe()
+	state := utils.MountSetupWithOutputs(t, stdoutWriter, os.Stderr)
+	defer stdoutReader.Close() // Just in case the test fails half-way through.
+	defer state.TearDown(t)
+	defer stdoutWriter.Close() // Just in case the test fails half-way through.
+
+	c := client.New(state.Stdin, stdoutReader)
+	mappings := []client.Mapping{
+		{Path: "/out", UnderlyingPath: state.RootPath("out"), Writable: true, Optional: true, Type: "dir"},
+	}
+	if err := c.Map("sb", mappings); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Lstat(state.MountPath("sb/out")); !os.IsNotExist(err) {
+		t.Errorf("Want lookup of missing optional mapping to fail with ENOENT; got %v", err)
+	}
+	if err := utils.DirEntryNamesEqual(state.MountPath("sb"), nil); err != nil {
+		t.Error(err)
+	}
+
+	gotMappings, err := c.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantMappings := []client.ActiveMapping{
+		{Path: "/", Scaffold: true},
+		{Path: "/sb", Scaffold: true},
+		{Path: "/sb/out", UnderlyingPath: state.RootPath("out"), Writable: true, Unresolved: true},
+	}
+	if !reflect.DeepEqual(wantMappings, gotMappings) {
+		t.Errorf("Got mappings %+v; want %+v", gotMappings, wantMappings)
+	}
+
+	utils.MustMkdirAll(t, state.RootPath("out"), 0755)
+	utils.MustWriteFile(t, state.RootPath("out/file"), 0644, "contents")
+	if err := utils.FileEquals(state.MountPath("sb/out/file"), "contents"); err != nil {
+		t.Error(err)
+	}
+
+	gotMappings, err = c.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantMappings[2].Unresolved = false
+	if !reflect.DeepEqual(wantMappings, gotMappings) {
+		t.Errorf("Got mappings %+v; want %+v", gotMappings, wantMappings)
+	}
+}
+
 func TestReconfiguration_Prefixes(t *testing.T) {
 	stdoutReader, stdoutWriter := io.Pipe()
 	state := utils.MountSetupWithOutputs(t, stdoutWriter, os.Stderr)
@@ -378,33 +853,24 @@ func TestReconfiguration_Prefixes(t *testing.T) {
 
 	utils.MustMkdirAll(t, state.RootPath("x"), 0755)
 	utils.MustMkdirAll(t, state.RootPath("y"), 0755)
-	config1 := request{
-		CreateSanbox: &createSandboxRequest{
-			ID: "sb1",
-			Mappings: []mapping{
-				{Path: "a", PathPrefix: 1, UnderlyingPath: "x", UnderlyingPathPrefix: 2, Writable: true},
-			},
-			Prefixes: map[string]string{
-				"1": "/foo/bar",
-				"2": "%ROOT%",
-			},
-		},
+
+	// Prefixes are not supported by client.Client, so these requests are written by hand.
+	tryOne := func(config string) *string {
+		t.Helper()
+		resp, err := tryRawReconfigure(state.Stdin, stdoutReader, state.RootPath(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Error
+	}
+
+	if failure := tryOne(`{"CreateSandbox": {"id": "sb1", "mappings": [{"path": "a", "path_prefix": 1, "underlying_path": "x", "underlying_path_prefix": 2, "writable": true}], "prefixes": {"1": "/foo/bar", "2": "%ROOT%"}}}`); failure != nil {
+		t.Fatal(*failure)
 	}
 	// This second request is intended to define new prefixes and also use previously-defined
 	// prefixes.
-	config2 := request{
-		CreateSanbox: &createSandboxRequest{
-			ID: "sb2",
-			Mappings: []mapping{
-				{Path: "", PathPrefix: 3, UnderlyingPath: "y", UnderlyingPathPrefix: 2, Writable: true},
-			},
-			Prefixes: map[string]string{
-				"3": "/",
-			},
-		},
-	}
-	if err := reconfigure(state.Stdin, stdoutReader, state.RootPath(), config1, config2); err != nil {
-		t.Fatal(err)
+	if failure := tryOne(`{"CreateSandbox": {"id": "sb2", "mappings": [{"path": "", "path_prefix": 3, "underlying_path": "y", "underlying_path_prefix": 2, "writable": true}], "prefixes": {"3": "/"}}}`); failure != nil {
+		t.Fatal(*failure)
 	}
 	for _, path := range []string{"sb1/foo/bar/a/test", "sb2/test"} {
 		if err := os.Mkdir(state.MountPath(path), 0755); err != nil {
@@ -416,6 +882,17 @@ func TestReconfiguration_Prefixes(t *testing.T) {
 			t.Errorf("Failed to stat underlying path %s: %v", path, err)
 		}
 	}
+
+	// Referencing an undefined prefix must fail without affecting the existing sandboxes.
+	wantError := "Prefix 5 does not exist"
+	if failure := tryOne(`{"CreateSandbox": {"id": "sb3", "mappings": [{"path": "foo", "path_prefix": 5, "underlying_path": "%ROOT%/x"}]}}`); failure == nil {
+		t.Errorf("Want reconfiguration to respond with %s; got OK", wantError)
+	} else if !utils.MatchesRegexp(wantError, *failure) {
+		t.Errorf("Want reconfiguration to respond with %s; got %s", wantError, *failure)
+	}
+	if _, err := os.Lstat(state.MountPath("sb2/test")); err != nil {
+		t.Errorf("Want sb2 to still exist after failed reconfiguration; got %v", err)
+	}
 }
 
 func TestReconfiguration_Minimized(t *testing.T) {
@@ -463,88 +940,58 @@ func TestReconfiguration_Minimized(t *testing.T) {
 }
 
 func TestReconfiguration_RecoverableErrors(t *testing.T) {
-	// checkBadConfig applies the set of reconfiguration requests in configs and checks that the
-	// last one fails with the error provided in wantError.  All requests but the last one are
-	// expected to succeed, as they are intended to prepare the sandboxfs state before issuing
-	// the failing request.
-	checkBadConfig := func(t *testing.T, state *utils.MountState, stdoutReader io.Reader, configs []request, wantError string) {
-		t.Helper()
-
-		if len(configs) > 1 {
-			for _, req := range configs[:len(configs)-1] {
-				if err := reconfigure(state.Stdin, stdoutReader, state.RootPath(), req); err != nil {
-					t.Fatalf("prerequisite reconfiguration failed: %v", err)
-				}
-			}
-		}
-
-		req := configs[len(configs)-1]
-		resp, err := tryReconfigure(state.Stdin, stdoutReader, state.RootPath(), req)
-		if err != nil {
-			t.Fatalf("want reconfiguration of / to fail; got success")
-		}
-		if resp.ID == nil || *resp.ID != req.getID() {
-			t.Errorf("sandboxfs replied with a bad id: got %v, want %s", resp.ID, req.getID())
-		}
-		if resp.Error == nil {
-			t.Errorf("want reconfiguration to respond with %s; got OK", wantError)
-		} else if !utils.MatchesRegexp(wantError, *resp.Error) {
-			t.Errorf("want reconfiguration to respond with %s; got %s", wantError, *resp.Error)
-		}
-		if _, err := os.Lstat(state.MountPath("file")); err != nil {
-			t.Errorf("want file to still exist after failed reconfiguration; got %v", err)
-		}
-	}
-
 	testData := []struct {
 		name string
 
-		config    []request
-		wantError string
+		// reconfigure issues the request expected to fail, preceded by any requests needed
+		// to prepare the sandboxfs state, which are expected to succeed.
+		reconfigure func(c *client.Client, state *utils.MountState) error
+		wantError   string
 	}{
 		{
 			"InvalidMapping",
-			[]request{
-				makeCreateSandboxRequest("sb", mapping{Path: "foo/../.", UnderlyingPath: "%ROOT%/subdir", Writable: false}),
+			func(c *client.Client, state *utils.MountState) error {
+				return c.Map("sb", []client.Mapping{{Path: "foo/../.", UnderlyingPath: state.RootPath("subdir")}})
 			},
 			"path.*not absolute",
 		},
 		{
 			"MapRootLate",
-			[]request{
-				makeCreateSandboxRequest("sb", mapping{Path: "/too-late", UnderlyingPath: "%ROOT%/subdir", Writable: false}, mapping{Path: "/", UnderlyingPath: "%ROOT%/subdir", Writable: false}),
+			func(c *client.Client, state *utils.MountState) error {
+				return c.Map("sb", []client.Mapping{
+					{Path: "/too-late", UnderlyingPath: state.RootPath("subdir")},
+					{Path: "/", UnderlyingPath: state.RootPath("subdir")},
+				})
 			},
 			"Root can be mapped at most once",
 		},
 		{
 			"MapTwice",
-			[]request{
-				makeCreateSandboxRequest("sb", mapping{Path: "/foo", UnderlyingPath: "%ROOT%/subdir", Writable: false}),
-				makeCreateSandboxRequest("sb", mapping{Path: "/foo", UnderlyingPath: "%ROOT%/file", Writable: false}),
+			func(c *client.Client, state *utils.MountState) error {
+				if err := c.Map("sb", []client.Mapping{{Path: "/foo", UnderlyingPath: state.RootPath("subdir")}}); err != nil {
+					return fmt.Errorf("prerequisite reconfiguration failed: %v", err)
+				}
+				return c.Map("sb", []client.Mapping{{Path: "/foo", UnderlyingPath: state.RootPath("file")}})
 			},
 			"Already mapped",
 		},
 		{
 			"MapSubrootLate",
-			[]request{
-				makeCreateSandboxRequest("sb", mapping{Path: "/too-late", UnderlyingPath: "%ROOT%/file", Writable: false}, mapping{Path: "/", UnderlyingPath: "%ROOT%/subdir", Writable: false}),
+			func(c *client.Client, state *utils.MountState) error {
+				return c.Map("sb", []client.Mapping{
+					{Path: "/too-late", UnderlyingPath: state.RootPath("file")},
+					{Path: "/", UnderlyingPath: state.RootPath("subdir")},
+				})
 			},
 			"Root can be mapped at most once",
 		},
 		{
 			"UnmapInvalidID",
-			[]request{
-				makeDestroySandboxRequest(""),
+			func(c *client.Client, state *utils.MountState) error {
+				return c.Destroy("")
 			},
 			"Identifier cannot be empty",
 		},
-		{
-			"BadPrefixes",
-			[]request{
-				makeCreateSandboxRequest("sb", mapping{Path: "foo", PathPrefix: 5, UnderlyingPath: "%ROOT%/file", Writable: false}, mapping{Path: "/", UnderlyingPath: "%ROOT%/subdir", Writable: false}),
-			},
-			"Prefix 5 does not exist",
-		},
 	}
 	for _, d := range testData {
 		t.Run(d.name, func(t *testing.T) {
@@ -557,11 +1004,49 @@ func TestReconfiguration_RecoverableErrors(t *testing.T) {
 			utils.MustMkdirAll(t, state.RootPath("subdir"), 0755)
 			utils.MustWriteFile(t, state.RootPath("file"), 0644, "")
 
-			checkBadConfig(t, state, stdoutReader, d.config, d.wantError)
+			err := d.reconfigure(client.New(state.Stdin, stdoutReader), state)
+			if err == nil {
+				t.Errorf("want reconfiguration to respond with %s; got OK", d.wantError)
+			} else if !utils.MatchesRegexp(d.wantError, err.Error()) {
+				t.Errorf("want reconfiguration to respond with %s; got %v", d.wantError, err)
+			}
+			if _, err := os.Lstat(state.MountPath("file")); err != nil {
+				t.Errorf("want file to still exist after failed reconfiguration; got %v", err)
+			}
 		})
 	}
 }
 
+func TestReconfiguration_MalformedRequestIsSkipped(t *testing.T) {
+	stdoutReader, stdoutWriter := io.Pipe()
+	state := utils.MountSetupWithOutputs(t, stdoutWriter, os.Stderr, "--mapping=rw:/:%ROOT%")
+	defer stdoutReader.Close() // Just in case the test fails half-way through.
+	defer state.TearDown(t)
+	defer stdoutWriter.Close() // Just in case the test fails half-way through.
+
+	utils.MustMkdirAll(t, state.RootPath("subdir"), 0755)
+
+	resp, err := tryRawReconfigure(state.Stdin, stdoutReader, state.RootPath(), `{"CreateSandbox": {"id": "bad", "mappings": [}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != nil {
+		t.Errorf("Got id %s for malformed request; want none", *resp.ID)
+	}
+	if resp.Error == nil || !utils.MatchesRegexp("expected value", *resp.Error) {
+		t.Errorf("Got error %v for malformed request; want syntax error", resp.Error)
+	}
+
+	// The requests that follow the malformed one must still be processed.
+	c := client.New(state.Stdin, stdoutReader)
+	if err := c.Map("sb", []client.Mapping{{Path: "/dir", UnderlyingPath: state.RootPath("subdir"), Writable: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(state.MountPath("sb/dir/still-alive"), 0755); err != nil {
+		t.Errorf("Mkdir failed: %v", err)
+	}
+}
+
 func TestReconfiguration_RaceSystemComponents(t *testing.T) {
 	// This test verifies that a dynamic sandboxfs instance can be unmounted immediately after
 	// reconfiguration.
@@ -587,8 +1072,8 @@ func TestReconfiguration_RaceSystemComponents(t *testing.T) {
 
 		utils.MustWriteFile(t, state.RootPath("first"), 0644, "First")
 
-		firstConfig := makeCreateSandboxRequest("first", mapping{Path: "/", UnderlyingPath: "%ROOT%/first", Writable: false})
-		if err := reconfigure(state.Stdin, stdoutReader, state.RootPath(), firstConfig); err != nil {
+		c := client.New(state.Stdin, stdoutReader)
+		if err := c.Map("first", []client.Mapping{{Path: "/", UnderlyingPath: state.RootPath("first")}}); err != nil {
 			stdoutWriter.Close()
 			state.TearDown(t)
 			return err
@@ -637,10 +1122,11 @@ func TestReconfiguration_DirectoryListings(t *testing.T) {
 			utils.MustMkdirAll(t, state.RootPath("dir2"), 0755)
 			utils.MustWriteFile(t, state.RootPath("dir2/second"), 0644, "Second")
 
-			firstConfig := []request{
-				makeCreateSandboxRequest("sb", mapping{Path: filepath.Join(d.dir, "first"), UnderlyingPath: state.RootPath(d.firstConfigTarget), Writable: false}),
+			c := client.New(state.Stdin, stdoutReader)
+			firstMappings := []client.Mapping{
+				{Path: filepath.Join(d.dir, "first"), UnderlyingPath: state.RootPath(d.firstConfigTarget)},
 			}
-			if err := reconfigure(state.Stdin, stdoutReader, state.RootPath(), firstConfig...); err != nil {
+			if err := c.Map("sb", firstMappings); err != nil {
 				t.Fatalf("First configuration failed: %v", err)
 			}
 			if err := utils.DirEntryNamesEqual(state.MountPath("sb", d.dir), []string{"first"}); err != nil {
@@ -658,11 +1144,13 @@ func TestReconfiguration_DirectoryListings(t *testing.T) {
 				defer handle.Close()
 			}
 
-			secondConfig := []request{
-				makeDestroySandboxRequest("sb"),
-				makeCreateSandboxRequest("sb2", mapping{Path: filepath.Join(d.dir, "second"), UnderlyingPath: state.RootPath(d.secondConfigTarget), Writable: false}),
+			if err := c.Destroy("sb"); err != nil {
+				t.Fatalf("Second configuration failed: %v", err)
 			}
-			if err := reconfigure(state.Stdin, stdoutReader, state.RootPath(), secondConfig...); err != nil {
+			secondMappings := []client.Mapping{
+				{Path: filepath.Join(d.dir, "second"), UnderlyingPath: state.RootPath(d.secondConfigTarget)},
+			}
+			if err := c.Map("sb2", secondMappings); err != nil {
 				t.Fatalf("Second configuration failed: %v", err)
 			}
 			if err := utils.DirEntryNamesEqual(state.MountPath("sb2", d.dir), []string{"second"}); err != nil {
@@ -716,8 +1204,8 @@ func TestReconfiguration_FileSystemStillWorksAfterInputEOF(t *testing.T) {
 	go grepStderr(stderrReader, `Reached end of reconfiguration input`, gotEOF)
 
 	utils.MustMkdirAll(t, state.RootPath("dir"), 0755)
-	config := makeCreateSandboxRequest("sb", mapping{Path: "/dir", UnderlyingPath: "%ROOT%/dir", Writable: true})
-	if err := reconfigure(state.Stdin, stdoutReader, state.RootPath(), config); err != nil {
+	c := client.New(state.Stdin, stdoutReader)
+	if err := c.Map("sb", []client.Mapping{{Path: "/dir", UnderlyingPath: state.RootPath("dir"), Writable: true}}); err != nil {
 		t.Fatal(err)
 	}
 
@@ -737,6 +1225,222 @@ func TestReconfiguration_FileSystemStillWorksAfterInputEOF(t *testing.T) {
 	}
 }
 
+func TestReconfiguration_StopOnInputEOF(t *testing.T) {
+	stdoutReader, stdoutWriter := io.Pipe()
+	state := utils.MountSetupWithOutputs(t, stdoutWriter, os.Stderr, "--stop_on_input_eof")
+	defer stdoutReader.Close()
+	defer state.TearDown(t)
+	defer stdoutWriter.Close()
+
+	utils.MustMkdirAll(t, state.RootPath("dir"), 0755)
+	c := client.New(state.Stdin, stdoutReader)
+	if err := c.Map("sb", []client.Mapping{{Path: "/dir", UnderlyingPath: state.RootPath("dir"), Writable: true}}); err != nil {
+		t.Fatal(err)
+	}
+	utils.MustMkdirAll(t, state.MountPath("sb/dir/alive"), 0755)
+
+	if err := state.Stdin.Close(); err != nil {
+		t.Fatalf("Failed to close stdin: %v", err)
+	}
+	state.Stdin = nil // Tell state.TearDown that we cleaned up ourselves.
+
+	// Closing the input must cause sandboxfs to unmount the file system and exit cleanly.
+	if err := state.Cmd.Wait(); err != nil {
+		t.Errorf("sandboxfs did not exit successfully after input EOF: %v", err)
+	}
+	state.Cmd = nil // Tell state.TearDown that we cleaned the mount point ourselves.
+	if err := utils.Unmount(state.MountPath()); err == nil {
+		t.Errorf("Mount point should have been released on input EOF but wasn't")
+	}
+	if _, err := os.Stat(state.RootPath("dir/alive")); err != nil {
+		t.Errorf("Changes made before input EOF were lost: %v", err)
+	}
+}
+
+func TestReconfiguration_Socket(t *testing.T) {
+	state := utils.MountSetup(t, "--reconfig_socket=%ROOT%/../socket")
+	defer state.TearDown(t)
+	utils.MustMkdirAll(t, state.RootPath("dir"), 0755)
+	utils.MustWriteFile(t, state.RootPath("dir/file"), 0644, "contents")
+
+	socket := state.TempPath("socket")
+	fileInfo, err := os.Lstat(socket)
+	if err != nil {
+		t.Fatalf("Reconfiguration socket not created: %v", err)
+	}
+	if fileInfo.Mode()&os.ModeSocket == 0 || fileInfo.Mode().Perm() != 0600 {
+		t.Errorf("Got mode %v for the reconfiguration socket; want a socket with 0600 permissions", fileInfo.Mode())
+	}
+
+	// Connect more than once to ensure sandboxfs keeps accepting connections after a client
+	// goes away.
+	for _, id := range []string{"first", "second"} {
+		c, err := client.Dial(socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Map(id, []client.Mapping{{Path: "/dir", UnderlyingPath: state.RootPath("dir")}})
+		c.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := utils.FileEquals(state.MountPath(id, "dir/file"), "contents"); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestReconfiguration_SocketClient(t *testing.T) {
+	state := utils.MountSetup(t, "--reconfig_socket=%ROOT%/../socket")
+	defer state.TearDown(t)
+	utils.MustMkdirAll(t, state.RootPath("dir"), 0755)
+	utils.MustWriteFile(t, state.RootPath("dir/file"), 0644, "contents")
+
+	requests := fmt.Sprintf(`{"CreateSandbox": {"id": "sb", "mappings": [{"path": "/", "underlying_path": "%s"}]}}`, state.RootPath("dir"))
+	cmd := exec.Command(utils.GetConfig().SandboxfsBinary, "reconfigure", "--socket="+state.TempPath("socket"))
+	cmd.Stdin = strings.NewReader(requests)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("sandboxfs reconfigure failed: %v", err)
+	}
+	if want := `{"id":"sb","error":null}` + "\n"; string(stdout) != want {
+		t.Errorf("Got response %q; want %q", stdout, want)
+	}
+	if err := utils.FileEquals(state.MountPath("sb/file"), "contents"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReconfiguration_SocketClientFlags(t *testing.T) {
+	state := utils.MountSetup(t, "--reconfig_socket=%ROOT%/../socket")
+	defer state.TearDown(t)
+	utils.MustMkdirAll(t, state.RootPath("dir"), 0755)
+	utils.MustWriteFile(t, state.RootPath("dir/file"), 0644, "contents")
+
+	runReconfigure := func(args ...string) (string, string, error) {
+		args = append([]string{"reconfigure", "--socket=" + state.TempPath("socket")}, args...)
+		cmd := exec.Command(utils.GetConfig().SandboxfsBinary, args...)
+		var stderr strings.Builder
+		cmd.Stderr = &stderr
+		stdout, err := cmd.Output()
+		return string(stdout), stderr.String(), err
+	}
+
+	stdout, _, err := runReconfigure("--sandbox=sb", "--mapping=ro:/mapped:"+state.RootPath("dir"))
+	if err != nil {
+		t.Fatalf("sandboxfs reconfigure failed: %v", err)
+	}
+	if want := `{"id":"sb","error":null}` + "\n"; stdout != want {
+		t.Errorf("Got response %q; want %q", stdout, want)
+	}
+	if err := utils.FileEquals(state.MountPath("sb/mapped/file"), "contents"); err != nil {
+		t.Error(err)
+	}
+
+	// Rejected requests must make the subcommand fail after printing the response.
+	stdout, stderr, err := runReconfigure("--sandbox=sb", "--unmap=/missing")
+	if err == nil {
+		t.Errorf("sandboxfs reconfigure succeeded; want failure for unknown path")
+	}
+	if !strings.Contains(stdout, `"id":"sb"`) || !utils.MatchesRegexp("Reconfiguration failed: Cannot unmap '/missing'", stderr) {
+		t.Errorf("Got stdout %q and stderr %q; want response and error for unknown path", stdout, stderr)
+	}
+
+	if _, _, err := runReconfigure("--sandbox=sb", "--unmap=/mapped"); err != nil {
+		t.Fatalf("sandboxfs reconfigure failed: %v", err)
+	}
+	errorIfNotUnmapped(t, state.MountPath("sb"), "mapped")
+	if _, _, err := runReconfigure("--sandbox=sb", "--destroy"); err != nil {
+		t.Fatalf("sandboxfs reconfigure failed: %v", err)
+	}
+	errorIfNotUnmapped(t, state.MountPath(), "sb")
+}
+
+// postReconfiguration sends the given document, which may be invalid, to the HTTP
+// reconfiguration endpoint at address and returns the status code and the parsed responses.
+func postReconfiguration(t *testing.T, address string, document string) (int, []rawResponse) {
+	t.Helper()
+	resp, err := http.Post(fmt.Sprintf("http://%s/reconfigure", address), "application/json", strings.NewReader(document))
+	if err != nil {
+		t.Fatalf("Failed to post reconfiguration: %v", err)
+	}
+	defer resp.Body.Close()
+	var responses []rawResponse
+	if err := json.NewDecoder(resp.Body).Decode(&responses); err != nil {
+		t.Fatalf("Failed to parse reconfiguration responses: %v", err)
+	}
+	return resp.StatusCode, responses
+}
+
+func TestReconfiguration_HTTP(t *testing.T) {
+	address := freeAddress(t)
+	stdoutReader, stdoutWriter := io.Pipe()
+	state := utils.MountSetupWithOutputs(t, stdoutWriter, os.Stderr, "--listen_address="+address, "--enable_http_reconfig")
+	defer stdoutReader.Close() // Just in case the test fails half-way through.
+	defer state.TearDown(t)
+	defer stdoutWriter.Close() // Just in case the test fails half-way through.
+	utils.MustMkdirAll(t, state.RootPath("dir"), 0755)
+	utils.MustWriteFile(t, state.RootPath("dir/file"), 0644, "contents")
+
+	document := fmt.Sprintf(`{"CreateSandbox": {"id": "sb", "mappings": [{"path": "/dir", "underlying_path": "%s"}]}}
+{"ListMappings": "tag"}`, state.RootPath("dir"))
+	status, responses := postReconfiguration(t, address, document)
+	if status != http.StatusOK {
+		t.Errorf("Got status %d; want %d", status, http.StatusOK)
+	}
+	if len(responses) != 2 || responses[0].Error != nil || responses[1].ID == nil || *responses[1].ID != "tag" {
+		t.Fatalf("Got responses %+v; want successful responses for sb and tag", responses)
+	}
+	wantMappings := []client.ActiveMapping{
+		{Path: "/", Scaffold: true},
+		{Path: "/sb", Scaffold: true},
+		{Path: "/sb/dir", UnderlyingPath: state.RootPath("dir")},
+	}
+	if !reflect.DeepEqual(wantMappings, responses[1].Mappings) {
+		t.Errorf("Got mappings %+v; want %+v", responses[1].Mappings, wantMappings)
+	}
+	if err := utils.FileEquals(state.MountPath("sb/dir/file"), "contents"); err != nil {
+		t.Error(err)
+	}
+
+	// Reconfigurations through the regular input must keep working.
+	if err := client.New(state.Stdin, stdoutReader).Destroy("sb"); err != nil {
+		t.Fatal(err)
+	}
+
+	status, responses = postReconfiguration(t, address, `{"DestroySandbox": "sb"} {"ListMappings": "tag"}`)
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("Got status %d; want %d", status, http.StatusUnprocessableEntity)
+	}
+	if len(responses) != 2 || responses[0].Error == nil || responses[1].Error != nil {
+		t.Errorf("Got responses %+v; want the first one to fail and the second one to succeed", responses)
+	}
+
+	status, responses = postReconfiguration(t, address, `{"DestroySandbox": "sb"} {"Foo`)
+	if status != http.StatusBadRequest {
+		t.Errorf("Got status %d; want %d", status, http.StatusBadRequest)
+	}
+	if len(responses) != 1 || responses[0].ID != nil || responses[0].Error == nil {
+		t.Errorf("Got responses %+v; want a single error without identifier", responses)
+	}
+}
+
+func TestReconfiguration_HTTPNotEnabled(t *testing.T) {
+	address := freeAddress(t)
+	state := utils.MountSetup(t, "--listen_address="+address)
+	defer state.TearDown(t)
+
+	resp, err := http.Post(fmt.Sprintf("http://%s/reconfigure", address), "application/json", strings.NewReader(`{"ListMappings": "tag"}`))
+	if err != nil {
+		t.Fatalf("Failed to post reconfiguration: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Got status %d; want %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
+
 func TestReconfiguration_StreamFileDoesNotExist(t *testing.T) {
 	tempDir, err := ioutil.TempDir("", "test")
 	if err != nil {
@@ -803,18 +1507,16 @@ func requestsMatchResponsesWithNThreads(t *testing.T, threads int) bool {
 	wg := sync.WaitGroup{}
 	for i := 0; i < 500; i++ {
 		id := fmt.Sprintf("sandbox-%d", i)
-		req := makeCreateSandboxRequest(id, mapping{Path: "/", UnderlyingPath: state.RootPath("dir"), Writable: false})
+		// Requests are written by hand because client.Client waits for the response to each
+		// request before sending the next one, which would defeat the purpose of this test.
+		req := fmt.Sprintf(`{"CreateSandbox": {"id": "%s", "mappings": [{"path": "/", "underlying_path": "%s"}]}}`, id, state.RootPath("dir"))
 		wg.Add(1)
 		go func() {
-			bytes, err := json.Marshal(req)
-			if err != nil {
-				panic(fmt.Sprintf("Bad configuration request in test: %v", err))
-			}
 			requestsMu.Lock()
-			n, err := io.WriteString(state.Stdin, string(bytes))
-			if n != len(bytes) || err != nil {
+			n, err := io.WriteString(state.Stdin, req)
+			if n != len(req) || err != nil {
 				requestsMu.Unlock()
-				panic(fmt.Sprintf("Reconfiguration failed unexpectedly: %d bytes written of %d, error %v", n, len(bytes), err))
+				panic(fmt.Sprintf("Reconfiguration failed unexpectedly: %d bytes written of %d, error %v", n, len(req), err))
 			}
 			requests = append(requests, id)
 			requestsMu.Unlock()
@@ -825,7 +1527,7 @@ func requestsMatchResponsesWithNThreads(t *testing.T, threads int) bool {
 	decoder := json.NewDecoder(stdoutReader)
 	responses := []string{}
 	for i := 0; i < 500; i++ {
-		resp := response{}
+		resp := rawResponse{}
 		if err := decoder.Decode(&resp); err != nil {
 			t.Errorf("Failed to decode %v", err)
 		}
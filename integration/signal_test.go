@@ -19,7 +19,10 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -27,14 +30,27 @@ import (
 	"github.com/bazelbuild/sandboxfs/integration/utils"
 )
 
-// checkSignalHandled verifies that the given sandboxfs process exited with an error on receipt of
-// a signal and that the mount point was truly unmounted.
-func checkSignalHandled(state *utils.MountState) error {
+// signalExitStatus returns the exit status that sandboxfs uses when terminated by signal.
+func signalExitStatus(signal os.Signal) int {
+	return 128 + int(signal.(syscall.Signal))
+}
+
+// checkSignalHandled verifies that the given sandboxfs process exited with wantExitStatus on
+// receipt of a signal and that the mount point was truly unmounted.
+//
+// A process killed by the signal itself, which happens if the signal arrives before sandboxfs
+// has had a chance to install its handlers, is also accepted if it matches wantExitStatus.
+func checkSignalHandled(state *utils.MountState, wantExitStatus int) error {
 	if err := state.Cmd.Wait(); err == nil {
 		return fmt.Errorf("wait of sandboxfs returned nil, want an error")
 	}
-	if state.Cmd.ProcessState.Success() {
-		return fmt.Errorf("exit status of sandboxfs returned success, want an error")
+	status := state.Cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if status.Signaled() {
+		if signalExitStatus(status.Signal()) != wantExitStatus {
+			return fmt.Errorf("sandboxfs was killed by signal %v; want exit status %d", status.Signal(), wantExitStatus)
+		}
+	} else if status.ExitStatus() != wantExitStatus {
+		return fmt.Errorf("got exit status %d from sandboxfs; want %d", status.ExitStatus(), wantExitStatus)
 	}
 
 	if err := utils.Unmount(state.MountPath()); err == nil {
@@ -61,7 +77,7 @@ func TestSignal_RaceBetweenSignalSetupAndMount(t *testing.T) {
 			if err := state.Cmd.Process.Signal(os.Interrupt); err != nil {
 				t.Fatalf("Failed to deliver signal to sandboxfs process: %v", err)
 			}
-			if err := checkSignalHandled(state); err != nil {
+			if err := checkSignalHandled(state, signalExitStatus(os.Interrupt)); err != nil {
 				t.Fatal(err)
 			}
 		})
@@ -84,7 +100,7 @@ func TestSignal_UnmountWhenCaught(t *testing.T) {
 			if err := state.Cmd.Process.Signal(signal); err != nil {
 				t.Fatalf("Failed to deliver signal to sandboxfs process: %v", err)
 			}
-			if err := checkSignalHandled(state); err != nil {
+			if err := checkSignalHandled(state, signalExitStatus(signal)); err != nil {
 				t.Fatal(err)
 			}
 			if !utils.MatchesRegexp(fmt.Sprintf("Caught signal %d", signal), stderr.String()) {
@@ -161,7 +177,397 @@ func TestSignal_QueuedWhileInUse(t *testing.T) {
 	// Release the open file.  This should cause sandboxfs to terminate within a limited amount
 	// of time, so ensure it exited as expected.
 	file.Close()
-	if err := checkSignalHandled(state); err != nil {
+	if err := checkSignalHandled(state, signalExitStatus(os.Interrupt)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignal_DrainRejectsNewOperations(t *testing.T) {
+	state := utils.MountSetup(t, "--shutdown_timeout=60s", "--mapping=rw:/:%ROOT%")
+	defer state.TearDown(t)
+
+	utils.MustWriteFile(t, state.RootPath("file"), 0644, "file contents")
+	file, err := os.Open(state.MountPath("file"))
+	if err != nil {
+		t.Fatalf("Failed to open test file: %v", err)
+	}
+	defer file.Close()
+
+	if err := state.Cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatalf("Failed to deliver signal to sandboxfs process: %v", err)
+	}
+
+	// Signal delivery is asynchronous so poll until sandboxfs starts rejecting new operations.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		err := os.Mkdir(state.MountPath("dir"), 0755)
+		if err != nil && err.(*os.PathError).Err == syscall.EIO {
+			break
+		}
+		if err == nil {
+			if err := os.Remove(state.MountPath("dir")); err != nil {
+				t.Fatalf("Failed to clean up test directory: %v", err)
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sandboxfs did not start rejecting operations after signal delivery; last error: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Releasing the last open file must let sandboxfs unmount and exit well before the timeout.
+	file.Close()
+	if err := checkSignalHandled(state, signalExitStatus(os.Interrupt)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignal_DrainTimeoutForcesUnmount(t *testing.T) {
+	stderrReader, stderrWriter := io.Pipe()
+	defer stderrReader.Close()
+	defer stderrWriter.Close()
+	stderr := bufio.NewScanner(stderrReader)
+
+	state := utils.MountSetupWithOutputs(t, nil, stderrWriter, "--shutdown_timeout=1s", "--mapping=rw:/:%ROOT%")
+	defer state.TearDown(t)
+
+	utils.MustWriteFile(t, state.RootPath("file"), 0644, "file contents")
+	file, err := os.Open(state.MountPath("file"))
+	if err != nil {
+		t.Fatalf("Failed to open test file: %v", err)
+	}
+	defer file.Close()
+
+	if err := state.Cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatalf("Failed to deliver signal to sandboxfs process: %v", err)
+	}
+
+	// Wait until sandboxfs gives up on draining, but continue consuming stderr output in the
+	// background to prevent stalling sandboxfs due to a full pipe.
+	timedOut := make(chan bool)
+	go func() {
+		notified := false
+		for stderr.Scan() {
+			os.Stderr.WriteString(stderr.Text() + "\n")
+			if !notified && utils.MatchesRegexp("handles still open.*forcing unmount", stderr.Text()) {
+				timedOut <- true
+				notified = true
+			}
+		}
+	}()
+	_ = <-timedOut
+
+	// The forced unmount keeps retrying while the file system is busy, as it did before draining
+	// existed, so releasing the file must let sandboxfs exit.
+	file.Close()
+	if err := checkSignalHandled(state, signalExitStatus(os.Interrupt)); err != nil {
 		t.Fatal(err)
 	}
 }
+
+func TestSignal_UnmountTimeoutDetaches(t *testing.T) {
+	stderrReader, stderrWriter := io.Pipe()
+	defer stderrReader.Close()
+	defer stderrWriter.Close()
+	stderr := bufio.NewScanner(stderrReader)
+
+	state := utils.MountSetupWithOutputs(t, nil, stderrWriter, "--unmount_timeout=1s", "--mapping=rw:/:%ROOT%")
+	defer state.TearDown(t)
+
+	utils.MustWriteFile(t, state.RootPath("file"), 0644, "file contents")
+	file, err := os.Open(state.MountPath("file"))
+	if err != nil {
+		t.Fatalf("Failed to open test file: %v", err)
+	}
+	defer file.Close()
+
+	if err := state.Cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatalf("Failed to deliver signal to sandboxfs process: %v", err)
+	}
+
+	// Collect all of stderr until sandboxfs exits, which it must do on its own even though we
+	// keep the file system busy.
+	output := make(chan string)
+	go func() {
+		var lines []string
+		for stderr.Scan() {
+			os.Stderr.WriteString(stderr.Text() + "\n")
+			lines = append(lines, stderr.Text())
+		}
+		output <- strings.Join(lines, "\n")
+	}()
+	// Detaching the file system is a failure, not a clean termination.
+	if err := checkSignalHandled(state, 1); err != nil {
+		t.Fatal(err)
+	}
+	stderrWriter.Close()
+	got := <-output
+
+	for _, want := range []string{
+		fmt.Sprintf("Processes using .*: \\[.*\\b%d\\b.*\\]", os.Getpid()),
+		"Could not unmount .* within 1s; detaching it",
+		"was still busy after 1s; detached it and exiting",
+	} {
+		if !utils.MatchesRegexp(want, got) {
+			t.Errorf("Got %s; want stderr to match %s", got, want)
+		}
+	}
+}
+
+func TestSignal_DumpStateOnSIGUSR1(t *testing.T) {
+	stderrReader, stderrWriter := io.Pipe()
+	defer stderrReader.Close()
+	defer stderrWriter.Close()
+	stderr := bufio.NewScanner(stderrReader)
+
+	state := utils.MountSetupWithOutputs(t, nil, stderrWriter, "--mapping=ro:/:%ROOT%", "--mapping=rw:/scaffold/dir:%ROOT%")
+	defer state.TearDown(t)
+
+	utils.MustWriteFile(t, state.RootPath("file"), 0644, "file contents")
+	file, err := os.Open(state.MountPath("file"))
+	if err != nil {
+		t.Fatalf("Failed to open test file: %v", err)
+	}
+	defer file.Close()
+
+	if err := state.Cmd.Process.Signal(syscall.SIGUSR1); err != nil {
+		t.Fatalf("Failed to deliver signal to sandboxfs process: %v", err)
+	}
+
+	// Collect the dump, but continue consuming stderr output in the background afterwards to
+	// prevent stalling sandboxfs due to a full pipe.
+	dump := make(chan string)
+	go func() {
+		var lines []string
+		inDump := false
+		for stderr.Scan() {
+			line := stderr.Text()
+			os.Stderr.WriteString(line + "\n")
+			if line == "sandboxfs state dump" {
+				inDump = true
+			}
+			if inDump {
+				lines = append(lines, line)
+				if strings.HasPrefix(line, "Reconfigurations: ") {
+					dump <- strings.Join(lines, "\n")
+					inDump = false
+				}
+			}
+		}
+	}()
+	got := <-dump
+
+	for _, want := range []string{
+		fmt.Sprintf("  / -> %s (read-only)\n", state.RootPath()),
+		"  /scaffold (scaffold)\n",
+		fmt.Sprintf("  /scaffold/dir -> %s (read/write)\n", state.RootPath()),
+		"\nOpen handles: 1\n",
+		"\nIn-flight requests: 0\n",
+		"\n  open: 1\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("State dump does not contain %q; got:\n%s", want, got)
+		}
+	}
+
+	// The dump must not interfere with the file system.
+	if _, err := os.Lstat(state.MountPath("file")); err != nil {
+		t.Errorf("Lstat failed after state dump: %v", err)
+	}
+}
+
+func TestSignal_ToggleDebugLogging(t *testing.T) {
+	stderrReader, stderrWriter := io.Pipe()
+	defer stderrReader.Close()
+	defer stderrWriter.Close()
+	stderr := bufio.NewScanner(stderrReader)
+
+	state := utils.MountSetupWithOutputs(t, nil, stderrWriter, "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(t)
+
+	// Forward all stderr lines to the test so that we can wait for specific messages, and keep
+	// consuming them in the background to prevent stalling sandboxfs due to a full pipe.
+	lines := make(chan string, 1024)
+	go func() {
+		for stderr.Scan() {
+			os.Stderr.WriteString(stderr.Text() + "\n")
+			select {
+			case lines <- stderr.Text():
+			default:
+			}
+		}
+	}()
+	waitFor := func(re string) {
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case line := <-lines:
+				if utils.MatchesRegexp(re, line) {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("Timed out waiting for stderr to match %s", re)
+			}
+		}
+	}
+
+	if err := state.Cmd.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatalf("Failed to deliver signal to sandboxfs process: %v", err)
+	}
+	waitFor("debug logging enabled")
+
+	utils.MustWriteFile(t, state.RootPath("file"), 0644, "")
+	if _, err := os.Lstat(state.MountPath("file")); err != nil {
+		t.Fatalf("Lstat failed: %v", err)
+	}
+	waitFor("DEBUG")
+
+	if err := state.Cmd.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatalf("Failed to deliver signal to sandboxfs process: %v", err)
+	}
+	waitFor("debug logging disabled")
+}
+
+func TestSignal_ReloadMappingFileOnSIGHUP(t *testing.T) {
+	// The mapping file has to exist before sandboxfs starts, but its contents depend on the
+	// location of the root directory, so stage it from the root setup hook.
+	var mappingFile string
+	writeMappings := func(root string, extra ...string) error {
+		contents := "ro:/:" + root + "\n"
+		for _, mapping := range extra {
+			contents += mapping + "\n"
+		}
+		return ioutil.WriteFile(mappingFile, []byte(contents), 0644)
+	}
+	rootSetup := func(root string) error {
+		for _, name := range []string{"one", "two"} {
+			if err := os.MkdirAll(filepath.Join(root, name), 0755); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(filepath.Join(root, name, "file"), []byte(name), 0644); err != nil {
+				return err
+			}
+		}
+		mappingFile = filepath.Join(root, "..", "mappings")
+		return writeMappings(root, "ro:/first:"+filepath.Join(root, "one"))
+	}
+
+	stderrReader, stderrWriter := io.Pipe()
+	defer stderrReader.Close()
+	defer stderrWriter.Close()
+	stderr := bufio.NewScanner(stderrReader)
+
+	state := utils.MountSetupWithRootSetupAndOutputs(t, rootSetup, nil, stderrWriter, "--ttl=0s", "--mapping_file=%ROOT%/../mappings")
+	defer state.TearDown(t)
+
+	lines := make(chan string, 1024)
+	go func() {
+		for stderr.Scan() {
+			os.Stderr.WriteString(stderr.Text() + "\n")
+			select {
+			case lines <- stderr.Text():
+			default:
+			}
+		}
+	}()
+	reload := func(wantStderr string, extra ...string) {
+		t.Helper()
+		if err := writeMappings(state.RootPath(), extra...); err != nil {
+			t.Fatalf("Failed to rewrite mapping file: %v", err)
+		}
+		if err := state.Cmd.Process.Signal(syscall.SIGHUP); err != nil {
+			t.Fatalf("Failed to deliver signal to sandboxfs process: %v", err)
+		}
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case line := <-lines:
+				if utils.MatchesRegexp(wantStderr, line) {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("Timed out waiting for stderr to match %s", wantStderr)
+			}
+		}
+	}
+
+	reload("Reloaded mappings: 1 added, 1 removed", "ro:/second:"+state.RootPath("two"))
+	if err := utils.FileEquals(state.MountPath("second/file"), "two"); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Lstat(state.MountPath("first")); !os.IsNotExist(err) {
+		t.Errorf("Want removed mapping to not exist; got %v", err)
+	}
+
+	reload("Failed to reload mappings; keeping the previous ones: Cannot map '/third",
+		"ro:/second:"+state.RootPath("two"), "ro:/third:"+state.RootPath("missing"))
+	if err := utils.FileEquals(state.MountPath("second/file"), "two"); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Lstat(state.MountPath("third")); !os.IsNotExist(err) {
+		t.Errorf("Want mapping from invalid file to not exist; got %v", err)
+	}
+}
+
+// BenchmarkSignal_ReloadMostlyUnchangedMappings measures the cost of reloading a large mapping
+// file on SIGHUP when only a few of its mappings change between reloads.
+func BenchmarkSignal_ReloadMostlyUnchangedMappings(b *testing.B) {
+	const numMappings = 20000
+	const numChanged = numMappings / 20
+
+	var mappingFile string
+	writeMappings := func(root string, variant int) error {
+		var contents strings.Builder
+		fmt.Fprintf(&contents, "ro:/:%s\n", root)
+		for i := 0; i < numMappings; i++ {
+			name := fmt.Sprintf("m%d", i)
+			if i < numChanged {
+				name = fmt.Sprintf("m%d-v%d", i, variant)
+			}
+			fmt.Fprintf(&contents, "ro:/d%d/%s:%s\n", i%100, name, filepath.Join(root, "dir"))
+		}
+		return ioutil.WriteFile(mappingFile, []byte(contents.String()), 0644)
+	}
+	rootSetup := func(root string) error {
+		if err := os.MkdirAll(filepath.Join(root, "dir"), 0755); err != nil {
+			return err
+		}
+		mappingFile = filepath.Join(root, "..", "mappings")
+		return writeMappings(root, 0)
+	}
+
+	stderrReader, stderrWriter := io.Pipe()
+	defer stderrReader.Close()
+	defer stderrWriter.Close()
+	stderr := bufio.NewScanner(stderrReader)
+
+	state := utils.MountSetupWithRootSetupAndOutputs(b, rootSetup, nil, stderrWriter, "--mapping_file=%ROOT%/../mappings")
+	defer state.TearDown(b)
+
+	reloaded := make(chan string, 1)
+	go func() {
+		for stderr.Scan() {
+			line := stderr.Text()
+			if strings.Contains(line, "Reloaded mappings") || strings.Contains(line, "Failed to reload mappings") {
+				reloaded <- line
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		if err := writeMappings(state.RootPath(), (i+1)%2); err != nil {
+			b.Fatalf("Failed to rewrite mapping file: %v", err)
+		}
+		b.StartTimer()
+
+		if err := state.Cmd.Process.Signal(syscall.SIGHUP); err != nil {
+			b.Fatalf("Failed to deliver signal to sandboxfs process: %v", err)
+		}
+		want := fmt.Sprintf("Reloaded mappings: %d added, %d removed", numChanged, numChanged)
+		if line := <-reloaded; !strings.Contains(line, want) {
+			b.Fatalf("Got %q after reload; want it to contain %q", line, want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License.  You may obtain a copy
+// of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.  See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package integration
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/bazelbuild/sandboxfs/integration/utils"
+)
+
+// setupSpecialFiles populates the directory "dir" within the root of the given state with a
+// regular file, a named pipe and a socket.  The returned listener owns the socket and must be
+// closed by the caller.
+func setupSpecialFiles(t *testing.T, state *utils.MountState) net.Listener {
+	t.Helper()
+
+	utils.MustMkdirAll(t, state.RootPath("dir"), 0755)
+	utils.MustWriteFile(t, state.RootPath("dir/file"), 0644, "")
+	if err := unix.Mkfifo(state.RootPath("dir/fifo"), 0644); err != nil {
+		t.Fatalf("Mkfifo failed: %v", err)
+	}
+	listener, err := net.Listen("unix", state.RootPath("dir/socket"))
+	if err != nil {
+		t.Fatalf("Failed to create socket: %v", err)
+	}
+	return listener
+}
+
+// checkVisibleNames verifies that the directory at path contains exactly the entries in
+// wantNames and that lookups of the names in hiddenNames fail.
+func checkVisibleNames(t *testing.T, path string, wantNames []string, hiddenNames []string) {
+	t.Helper()
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		t.Fatalf("ReadDir of %s failed: %v", path, err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(wantNames, names) {
+		t.Errorf("Got entries %v in %s; want %v", names, path, wantNames)
+	}
+
+	for _, name := range hiddenNames {
+		if _, err := os.Lstat(filepath.Join(path, name)); !os.IsNotExist(err) {
+			t.Errorf("Want lookup of hidden entry %s to fail with ENOENT; got %v", name, err)
+		}
+	}
+}
+
+func TestSpecialFiles_HideSpecialFiles(t *testing.T) {
+	state := utils.MountSetup(t, "--hide_special_files", "--mapping=rw:/:%ROOT%")
+	defer state.TearDown(t)
+	listener := setupSpecialFiles(t, state)
+	defer listener.Close()
+
+	checkVisibleNames(t, state.MountPath("dir"), []string{"fifo", "file"}, []string{"socket"})
+
+	if err := syscall.Mknod(state.MountPath("dir/new-socket"), 0644|syscall.S_IFSOCK, 0); err != syscall.EPERM {
+		t.Errorf("Want creation of a hidden socket to fail with EPERM; got %v", err)
+	}
+	if err := unix.Mkfifo(state.MountPath("dir/new-fifo"), 0644); err != nil {
+		t.Errorf("Want creation of a named pipe to succeed; got %v", err)
+	}
+}
+
+func TestSpecialFiles_HideFifos(t *testing.T) {
+	state := utils.MountSetup(t, "--hide_fifos", "--mapping=rw:/:%ROOT%")
+	defer state.TearDown(t)
+	listener := setupSpecialFiles(t, state)
+	defer listener.Close()
+
+	checkVisibleNames(t, state.MountPath("dir"), []string{"file", "socket"}, []string{"fifo"})
+
+	if err := unix.Mkfifo(state.MountPath("dir/new-fifo"), 0644); err != syscall.EPERM {
+		t.Errorf("Want creation of a hidden named pipe to fail with EPERM; got %v", err)
+	}
+}
+
+func TestSpecialFiles_HideDevices(t *testing.T) {
+	utils.RequireRoot(t, "Requires root privileges to create devices")
+
+	state := utils.MountSetup(t, "--hide_special_files", "--mapping=ro:/:%ROOT%")
+	defer state.TearDown(t)
+
+	utils.MustMkdirAll(t, state.RootPath("dir"), 0755)
+	if err := syscall.Mknod(state.RootPath("dir/blkdev"), 0400|syscall.S_IFBLK, 1234); err != nil {
+		t.Fatalf("Failed to create block device: %v", err)
+	}
+	if err := syscall.Mknod(state.RootPath("dir/chrdev"), 0400|syscall.S_IFCHR, 5678); err != nil {
+		t.Fatalf("Failed to create character device: %v", err)
+	}
+	utils.MustWriteFile(t, state.RootPath("dir/file"), 0644, "")
+
+	checkVisibleNames(t, state.MountPath("dir"), []string{"file"}, []string{"blkdev", "chrdev"})
+}
+
+func TestSpecialFiles_ExplicitMappingsAreVisible(t *testing.T) {
+	// Targets given via --mapping are created as directories before the root setup hook runs,
+	// so map the named pipe from a mapping file instead.
+	rootSetup := func(root string) error {
+		if err := os.MkdirAll(filepath.Join(root, "dir"), 0755); err != nil {
+			return err
+		}
+		if err := unix.Mkfifo(filepath.Join(root, "dir/fifo"), 0644); err != nil {
+			return err
+		}
+		contents := "ro:/:" + root + "\n" +
+			"ro:/mapped-fifo:" + filepath.Join(root, "dir/fifo") + "\n"
+		return ioutil.WriteFile(filepath.Join(root, "..", "mappings"), []byte(contents), 0644)
+	}
+	state := utils.MountSetupWithRootSetup(t, rootSetup, "--hide_special_files", "--hide_fifos", "--mapping_file=%ROOT%/../mappings")
+	defer state.TearDown(t)
+
+	checkVisibleNames(t, state.MountPath("dir"), []string{}, []string{"fifo"})
+
+	fileInfo, err := os.Lstat(state.MountPath("mapped-fifo"))
+	if err != nil {
+		t.Fatalf("Want explicitly-mapped named pipe to be visible; got %v", err)
+	}
+	if fileInfo.Mode()&os.ModeType != os.ModeNamedPipe {
+		t.Errorf("Got mode %v for explicitly-mapped named pipe; want a named pipe", fileInfo.Mode())
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License.  You may obtain a copy
+// of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.  See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package integration
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/bazelbuild/sandboxfs/integration/utils"
+)
+
+// Arbitrary user and group identifiers to squash files to.  These needn't exist in the system.
+const (
+	squashUID = 12345
+	squashGID = 23456
+)
+
+// checkOwner verifies that the file at path is owned by the given uid and gid.
+func checkOwner(t *testing.T, path string, uid int, gid int) {
+	t.Helper()
+	fileInfo, err := os.Lstat(path)
+	if err != nil {
+		t.Fatalf("Cannot stat %s: %v", path, err)
+	}
+	stat := fileInfo.Sys().(*syscall.Stat_t)
+	if int(stat.Uid) != uid || int(stat.Gid) != gid {
+		t.Errorf("%s has wrong ownership; got %v:%v, want %v:%v", path, stat.Uid, stat.Gid, uid, gid)
+	}
+}
+
+func TestSquash_CreatedFilesOwnedBySquashedIdentity(t *testing.T) {
+	root := utils.RequireRoot(t, "Requires root privileges to change the ownership of files")
+
+	rootSetup := func(root string) error {
+		return os.MkdirAll(filepath.Join(root, "out"), 0755)
+	}
+	state := utils.MountSetupWithRootSetup(t, rootSetup, "--mapping=ro:/:%ROOT%", "--mapping=rw:/out:%ROOT%/out:uid=12345,gid=23456")
+	defer state.TearDown(t)
+
+	utils.MustMkdirAll(t, state.MountPath("out/dir"), 0755)
+	utils.MustWriteFile(t, state.MountPath("out/dir/file"), 0644, "")
+	utils.MustSymlink(t, "file", state.MountPath("out/dir/symlink"))
+	if err := unix.Mkfifo(state.MountPath("out/dir/fifo"), 0644); err != nil {
+		t.Fatalf("Mkfifo failed: %v", err)
+	}
+
+	for _, name := range []string{"out/dir", "out/dir/file", "out/dir/symlink", "out/dir/fifo"} {
+		checkOwner(t, state.RootPath(name), squashUID, squashGID)
+		checkOwner(t, state.MountPath(name), root.UID, root.GID)
+	}
+}
+
+func TestSquash_OnlyUser(t *testing.T) {
+	root := utils.RequireRoot(t, "Requires root privileges to change the ownership of files")
+
+	state := utils.MountSetup(t, "--mapping=rw:/:%ROOT%:uid=12345")
+	defer state.TearDown(t)
+
+	utils.MustWriteFile(t, state.MountPath("file"), 0644, "")
+	checkOwner(t, state.RootPath("file"), squashUID, root.GID)
+	checkOwner(t, state.MountPath("file"), root.UID, root.GID)
+}
+
+func TestSquash_ChownIgnored(t *testing.T) {
+	root := utils.RequireRoot(t, "Requires root privileges to change the ownership of files")
+
+	state := utils.MountSetup(t, "--mapping=rw:/:%ROOT%:uid=12345,gid=23456")
+	defer state.TearDown(t)
+
+	utils.MustWriteFile(t, state.MountPath("file"), 0644, "")
+	for _, ids := range [][2]int{{root.UID, root.GID}, {squashUID, squashGID}, {1, 1}} {
+		if err := os.Lchown(state.MountPath("file"), ids[0], ids[1]); err != nil {
+			t.Errorf("Lchown to %v:%v failed: %v", ids[0], ids[1], err)
+		}
+		checkOwner(t, state.RootPath("file"), squashUID, squashGID)
+	}
+}
+
+func TestSquash_StrictChownFails(t *testing.T) {
+	root := utils.RequireRoot(t, "Requires root privileges to change the ownership of files")
+
+	state := utils.MountSetup(t, "--mapping=rw:/:%ROOT%:uid=12345,gid=23456,strict")
+	defer state.TearDown(t)
+
+	utils.MustWriteFile(t, state.MountPath("file"), 0644, "")
+	for _, ids := range [][2]int{{root.UID, root.GID}, {squashUID, squashGID}} {
+		if err := os.Lchown(state.MountPath("file"), ids[0], ids[1]); err != nil {
+			t.Errorf("Lchown to %v:%v failed: %v", ids[0], ids[1], err)
+		}
+	}
+	for _, ids := range [][2]int{{1, root.GID}, {root.UID, 1}} {
+		if err := unix.Lchown(state.MountPath("file"), ids[0], ids[1]); err != unix.EPERM {
+			t.Errorf("Want Lchown to %v:%v to fail with EPERM; got %v", ids[0], ids[1], err)
+		}
+	}
+	checkOwner(t, state.RootPath("file"), squashUID, squashGID)
+}
+
+func TestSquash_FileMappingsNotSupported(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	file := filepath.Join(tempDir, "file")
+	utils.MustWriteFile(t, file, 0644, "")
+
+	wantStderr := "Cannot squash ownership of .*file.*: not a directory"
+	_, stderr, err := utils.RunAndWait(1, "--mapping=rw:/file:"+file+":uid=1", "irrelevant-mount-point")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !utils.MatchesRegexp(wantStderr, stderr) {
+		t.Errorf("Got %s; want stderr to match %s", stderr, wantStderr)
+	}
+}
@@ -30,7 +30,7 @@ import (
 
 // MustMkdirAll wraps os.MkdirAll and immediately fails the test case on failure.
 // This is purely syntactic sugar to keep test setup short and concise.
-func MustMkdirAll(t *testing.T, path string, perm os.FileMode) {
+func MustMkdirAll(t testing.TB, path string, perm os.FileMode) {
 	t.Helper()
 
 	if err := os.MkdirAll(path, perm); err != nil {
@@ -44,7 +44,7 @@ func MustMkdirAll(t *testing.T, path string, perm os.FileMode) {
 // Note that, compared to the other *OrFatal operations, this one does not take file permissions
 // into account because Linux does not have an lchmod(2) system call, nor Go offers a mechanism to
 // call it on the systems that support it.
-func MustSymlink(t *testing.T, target string, path string) {
+func MustSymlink(t testing.TB, target string, path string) {
 	t.Helper()
 
 	if err := os.Symlink(target, path); err != nil {
@@ -54,7 +54,7 @@ func MustSymlink(t *testing.T, target string, path string) {
 
 // MustWriteFile wraps ioutil.WriteFile and immediately fails the test case on failure.
 // This is purely syntactic sugar to keep test setup short and concise.
-func MustWriteFile(t *testing.T, path string, perm os.FileMode, contents string) {
+func MustWriteFile(t testing.TB, path string, perm os.FileMode, contents string) {
 	t.Helper()
 
 	if err := ioutil.WriteFile(path, []byte(contents), perm); err != nil {
@@ -64,7 +64,7 @@ func MustWriteFile(t *testing.T, path string, perm os.FileMode, contents string)
 
 // RequireRoot checks if the test is running as root and skips the test with the given reason
 // otherwise.
-func RequireRoot(t *testing.T, skipReason string) *UnixUser {
+func RequireRoot(t testing.TB, skipReason string) *UnixUser {
 	t.Helper()
 
 	if os.Getuid() != 0 {
@@ -234,30 +234,57 @@ func createDirsRequiredByMappings(root string, args ...string) error {
 		if !strings.HasPrefix(arg, "--mapping=") {
 			continue // Not a mapping.
 		}
-		fields := strings.Split(arg, ":")
-		if len(fields) != 3 {
-			// If we encounter more than two fields on a mapping flag, we have hit a bug
-			// in our tests and this bug must be fixed: propagating an error makes no
-			// sense.  In other words: this function applies heuristics to determine
-			// which flags represent mappings and extracts values from those... and if
-			// we fail to do this properly, the calling tests won't work at all.
-			panic(fmt.Sprintf("recognized a mapping but found more fields than expected: %v", fields))
+		fields := strings.Split(strings.TrimPrefix(arg, "--mapping="), ":")
+		var dirs []string
+		switch {
+		case fields[0] == "tmp" && len(fields) <= 3:
+			// In-memory mappings have no target.
+		case fields[0] == "cow" && len(fields) == 4:
+			dirs = fields[2:4]
+		case fields[0] != "cow" && (len(fields) == 3 || len(fields) == 4):
+			// The optional fourth field holds exclude patterns, not a directory.
+			dirs = fields[2:3]
+		default:
+			// If we encounter an unexpected number of fields on a mapping flag, we have
+			// hit a bug in our tests and this bug must be fixed: propagating an error
+			// makes no sense.  In other words: this function applies heuristics to
+			// determine which flags represent mappings and extracts values from those...
+			// and if we fail to do this properly, the calling tests won't work at all.
+			panic(fmt.Sprintf("recognized a mapping but found an unexpected number of fields: %v", fields))
 		}
-		dir := fields[2]
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			return fmt.Errorf("failed to mkdir %s: %v", dir, err)
+		for _, dir := range dirs {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return fmt.Errorf("failed to mkdir %s: %v", dir, err)
+			}
 		}
 	}
 	return nil
 }
 
+// isRootMapping returns true if the given mapping specification is for the root directory.
+func isRootMapping(spec string) bool {
+	return strings.HasPrefix(spec, "ro:/:") || strings.HasPrefix(spec, "rw:/:")
+}
+
 // hasRootMapping inspects the flags that configure sandboxfs and returns true if they define a
-// mapping for the sandbox's root directory.
+// mapping for the sandbox's root directory.  Mappings given via --mapping_file are inspected too,
+// but any problems reading the file are ignored: sandboxfs will report them on its own.
 func hasRootMapping(args ...string) bool {
 	for _, arg := range args {
-		if strings.HasPrefix(arg, "--mapping=ro:/:") || strings.HasPrefix(arg, "--mapping=rw:/:") {
+		if strings.HasPrefix(arg, "--mapping=") && isRootMapping(strings.TrimPrefix(arg, "--mapping=")) {
 			return true
 		}
+		if strings.HasPrefix(arg, "--mapping_file=") {
+			contents, err := ioutil.ReadFile(strings.TrimPrefix(arg, "--mapping_file="))
+			if err != nil {
+				continue
+			}
+			for _, line := range strings.Split(string(contents), "\n") {
+				if isRootMapping(strings.TrimSpace(line)) {
+					return true
+				}
+			}
+		}
 	}
 	return false
 }
@@ -267,7 +294,7 @@ func hasRootMapping(args ...string) bool {
 // This is essentially the same as mountSetupFull with stdout and stderr set to the caller's outputs
 // and with rootSetup and the user set to nil.  See the documentation for this other function for
 // further details.
-func MountSetup(t *testing.T, args ...string) *MountState {
+func MountSetup(t testing.TB, args ...string) *MountState {
 	t.Helper()
 
 	return mountSetupFull(t, os.Stdout, os.Stderr, nil, nil, args...)
@@ -279,7 +306,7 @@ func MountSetup(t *testing.T, args ...string) *MountState {
 // This is essentially the same as mountSetupFull with stdout and stderr set to the caller's
 // outputs and with the user set to nil.  See the documentation for this other function for
 // further details.
-func MountSetupWithRootSetup(t *testing.T, rootSetup func(string) error, args ...string) *MountState {
+func MountSetupWithRootSetup(t testing.TB, rootSetup func(string) error, args ...string) *MountState {
 	t.Helper()
 
 	return mountSetupFull(t, os.Stdout, os.Stderr, nil, rootSetup, args...)
@@ -291,19 +318,31 @@ func MountSetupWithRootSetup(t *testing.T, rootSetup func(string) error, args ..
 // This is essentially the same as mountSetupFull with stdout and stderr set to the caller's
 // provided values and with rootSetup and the user set to nil.  See the documentation for this other
 // function for further details.
-func MountSetupWithOutputs(t *testing.T, stdout io.Writer, stderr io.Writer, args ...string) *MountState {
+func MountSetupWithOutputs(t testing.TB, stdout io.Writer, stderr io.Writer, args ...string) *MountState {
 	t.Helper()
 
 	return mountSetupFull(t, stdout, stderr, nil, nil, args...)
 }
 
+// MountSetupWithRootSetupAndOutputs initializes a test that runs sandboxfs in the background with
+// output redirections and provides a mechanism to configure the root directory before sandboxfs is
+// started.
+//
+// This is essentially the same as mountSetupFull with the user set to nil.  See the documentation
+// for this other function for further details.
+func MountSetupWithRootSetupAndOutputs(t testing.TB, rootSetup func(string) error, stdout io.Writer, stderr io.Writer, args ...string) *MountState {
+	t.Helper()
+
+	return mountSetupFull(t, stdout, stderr, nil, rootSetup, args...)
+}
+
 // MountSetupWithUser initializes a test that runs sandboxfs in the background with different
 // credentials.
 //
 // This is essentially the same as mountSetupFull with stdout and stderr set to the caller's
 // outputs, with rootSetup set to nil, and with the user set to the given value.  See the
 // documentation for this other function for further details.
-func MountSetupWithUser(t *testing.T, user *UnixUser, args ...string) *MountState {
+func MountSetupWithUser(t testing.TB, user *UnixUser, args ...string) *MountState {
 	t.Helper()
 
 	return mountSetupFull(t, os.Stdout, os.Stderr, user, nil, args...)
@@ -333,7 +372,7 @@ func MountSetupWithUser(t *testing.T, user *UnixUser, args ...string) *MountStat
 //
 // Callers must defer execution of MountState.TearDown() immediately on return to ensure the
 // background process and the mount point are cleaned up on test completion.
-func mountSetupFull(t *testing.T, stdout io.Writer, stderr io.Writer, user *UnixUser, rootSetup func(string) error, args ...string) *MountState {
+func mountSetupFull(t testing.TB, stdout io.Writer, stderr io.Writer, user *UnixUser, rootSetup func(string) error, args ...string) *MountState {
 	t.Helper()
 
 	success := false
@@ -462,7 +501,7 @@ func mountSetupFull(t *testing.T, stdout io.Writer, stderr io.Writer, user *Unix
 // If tests wish to check if TearDown returned an error, they can do so by avoiding the recommended
 // use of "defer".  Note, though, that such tests will only receive the first error encountered by
 // this function, and that the function will run to completion even if there were failures.
-func (s *MountState) TearDown(t *testing.T) error {
+func (s *MountState) TearDown(t testing.TB) error {
 	t.Helper()
 
 	var firstErr error
@@ -0,0 +1,368 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License.  You may obtain a copy
+// of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.  See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+use logging;
+use metrics::{self, Metrics, Op};
+use serde_derive::Serialize;
+use std::collections::HashMap;
+use std::fs;
+use std::io::{self, Write};
+use std::path::Path;
+use std::sync::{Arc, Mutex};
+use std::sync::mpsc::{self, SyncSender, TrySendError};
+use std::thread;
+
+/// Maximum number of events waiting to be written before new ones are dropped.
+///
+/// Events are queued so that FUSE operations never wait for the log file, which means that a
+/// writer that cannot keep up must lose events instead of slowing down the file system.
+const QUEUE_SIZE: usize = 4096;
+
+/// Attributes modified by a `setattr` operation.  Unset fields were left untouched.
+#[derive(Debug, Default, Serialize)]
+pub struct Attributes {
+    /// New permissions, in octal.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub mode: Option<String>,
+
+    /// New owner.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub uid: Option<u32>,
+
+    /// New group.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub gid: Option<u32>,
+
+    /// New size, as done by truncations.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub size: Option<u64>,
+
+    /// New access time, in seconds since the epoch.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub atime: Option<i64>,
+
+    /// New modification time, in seconds since the epoch.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub mtime: Option<i64>,
+}
+
+/// Record of a single operation that modified, or tried to modify, the file system.
+#[derive(Debug, Serialize)]
+pub struct Event {
+    /// Time at which the operation happened, in RFC 3339 format and in UTC.  For writes, which are
+    /// aggregated per handle, this is the time of the first write.
+    pub timestamp: String,
+
+    /// Name of the operation.
+    pub op: &'static str,
+
+    /// User that issued the operation.
+    pub uid: u32,
+
+    /// Group that issued the operation.
+    pub gid: u32,
+
+    /// Process that issued the operation.
+    pub pid: u32,
+
+    /// Path within the file system affected by the operation, if known.
+    pub path: Option<String>,
+
+    /// Path in the underlying file system affected by the operation, if any.
+    pub underlying_path: Option<String>,
+
+    /// New path within the file system of a renamed entry.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub new_path: Option<String>,
+
+    /// New path in the underlying file system of a renamed entry.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub new_underlying_path: Option<String>,
+
+    /// Target of a created symlink.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub target: Option<String>,
+
+    /// Attributes changed by a `setattr` operation.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub attributes: Option<Attributes>,
+
+    /// Total number of bytes written through a handle.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub bytes: Option<u64>,
+
+    /// Lowest offset and highest end offset of the writes done through a handle.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub range: Option<(i64, i64)>,
+
+    /// "ok" if the operation succeeded, or the symbolic name of the error it returned.  For
+    /// writes, this is the error of the first write that failed, if any.
+    pub outcome: String,
+}
+
+impl Event {
+    /// Creates a new event for the operation `op` issued by `uid`, `gid` and `pid` on `path` and
+    /// `underlying_path`, which returned `errno` (or 0 if it succeeded).
+    pub fn new(op: Op, uid: u32, gid: u32, pid: u32, path: Option<&Path>,
+        underlying_path: Option<&Path>, errno: i32) -> Event {
+        Event {
+            timestamp: logging::now_rfc3339(),
+            op: op.name(),
+            uid,
+            gid,
+            pid,
+            path: path.map(|path| path.to_string_lossy().into_owned()),
+            underlying_path: underlying_path.map(|path| path.to_string_lossy().into_owned()),
+            new_path: None,
+            new_underlying_path: None,
+            target: None,
+            attributes: None,
+            bytes: None,
+            range: None,
+            outcome: outcome(errno),
+        }
+    }
+}
+
+/// Converts `errno` to the outcome of an operation as recorded in the audit log.
+fn outcome(errno: i32) -> String {
+    if errno == 0 { "ok".to_owned() } else { metrics::errno_name(errno as usize) }
+}
+
+/// Writer of audit events to a file.
+///
+/// Events are handed to a dedicated thread that appends them to the file, one JSON object per
+/// line, so recording an event never blocks.
+pub struct AuditLog {
+    /// Queue of events to write.  None once the log has been closed.
+    queue: Mutex<Option<SyncSender<Event>>>,
+
+    /// Thread that writes the queued events.  None once the log has been closed.
+    writer: Mutex<Option<thread::JoinHandle<()>>>,
+
+    /// Writes in progress, keyed by the handle they go through, which are aggregated into a
+    /// single event when the handle is released.
+    writes: Mutex<HashMap<u64, Event>>,
+
+    /// Metrics on which to account for dropped events.
+    metrics: Arc<Metrics>,
+}
+
+impl AuditLog {
+    /// Opens or creates the audit log at `path` for appending and starts the thread that writes to
+    /// it.  Dropped events are accounted for in `metrics`.
+    pub fn open(path: &Path, metrics: Arc<Metrics>) -> io::Result<AuditLog> {
+        let file = fs::OpenOptions::new().create(true).append(true).open(path)?;
+        let (queue, events) = mpsc::sync_channel::<Event>(QUEUE_SIZE);
+        let writer = thread::spawn(move || {
+            let mut file = io::BufWriter::new(file);
+            // Flush after every batch of queued events so that the file is always up to date when
+            // the file system is idle, without paying for a flush per event when it is busy.
+            while let Ok(event) = events.recv() {
+                let mut event = Some(event);
+                while let Some(event_to_write) = event {
+                    let mut line = serde_json::to_string(&event_to_write)
+                        .expect("Serializing plain values cannot fail");
+                    line.push('\n');
+                    if let Err(e) = file.write_all(line.as_bytes()) {
+                        warn!("Failed to write to audit log: {}", e);
+                    }
+                    event = events.try_recv().ok();
+                }
+                if let Err(e) = file.flush() {
+                    warn!("Failed to write to audit log: {}", e);
+                }
+            }
+        });
+        Ok(AuditLog {
+            queue: Mutex::from(Some(queue)),
+            writer: Mutex::from(Some(writer)),
+            writes: Mutex::from(HashMap::new()),
+            metrics,
+        })
+    }
+
+    /// Queues `event` for writing, or drops it if the writer is falling behind.
+    pub fn record(&self, event: Event) {
+        if let Some(ref queue) = *self.queue.lock().unwrap() {
+            match queue.try_send(event) {
+                Ok(()) => (),
+                Err(TrySendError::Full(_)) => self.metrics.record_audit_drop(),
+                Err(TrySendError::Disconnected(_)) => {
+                    panic!("Audit log writer cannot exit while the queue is open")
+                },
+            }
+        }
+    }
+
+    /// Accounts for a write of `size` bytes at `offset` through the handle `fh`, which returned
+    /// `errno` (or 0 if it succeeded).  `new_event` creates the event to describe the writes
+    /// through the handle and is only called for its first write.
+    pub fn record_write<F>(&self, fh: u64, offset: i64, size: u64, errno: i32, new_event: F)
+        where F: FnOnce() -> Event {
+        let mut writes = self.writes.lock().unwrap();
+        let event = writes.entry(fh).or_insert_with(|| {
+            let mut event = new_event();
+            event.bytes = Some(0);
+            event
+        });
+        if errno != 0 {
+            if event.outcome == "ok" {
+                event.outcome = outcome(errno);
+            }
+            return;
+        }
+        event.bytes = Some(event.bytes.unwrap_or(0) + size);
+        let end = offset + size as i64;
+        event.range = Some(match event.range {
+            Some((start, old_end)) => (start.min(offset), old_end.max(end)),
+            None => (offset, end),
+        });
+    }
+
+    /// Records the writes done through the handle `fh`, if any, which is being released.
+    pub fn finish_writes(&self, fh: u64) {
+        let event = self.writes.lock().unwrap().remove(&fh);
+        if let Some(event) = event {
+            self.record(event);
+        }
+    }
+
+    /// Records the writes done through handles that are still open, waits for all queued events
+    /// to be written, and stops accepting new events.
+    pub fn close(&self) {
+        let writes = self.writes.lock().unwrap().drain().map(|(_, event)| event)
+            .collect::<Vec<Event>>();
+        for event in writes {
+            self.record(event);
+        }
+
+        // Closing the queue makes the writer exit once it has written all pending events.
+        self.queue.lock().unwrap().take();
+        if let Some(writer) = self.writer.lock().unwrap().take() {
+            if writer.join().is_err() {
+                warn!("Audit log writer panicked");
+            }
+        }
+    }
+}
+
+/// Scope guard that closes an audit log when dropped.  See `AuditLog::close`.
+pub struct CloseOnDrop(pub Arc<AuditLog>);
+
+impl Drop for CloseOnDrop {
+    fn drop(&mut self) {
+        self.0.close();
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::path::PathBuf;
+    use tempfile::tempdir;
+
+    /// Reads the audit log at `path` and parses each of its lines.
+    fn read_events(path: &Path) -> Vec<serde_json::Value> {
+        fs::read_to_string(path).unwrap().lines()
+            .map(|line| serde_json::from_str(line).unwrap())
+            .collect()
+    }
+
+    #[test]
+    fn test_event_serialization() {
+        let mut event = Event::new(Op::Rename, 1, 2, 3, Some(Path::new("/a")),
+            Some(Path::new("/underlying/a")), 0);
+        event.new_path = Some("/b".to_owned());
+        let value = serde_json::to_value(&event).unwrap();
+        assert_eq!("rename", value["op"]);
+        assert_eq!(1, value["uid"]);
+        assert_eq!(2, value["gid"]);
+        assert_eq!(3, value["pid"]);
+        assert_eq!("/a", value["path"]);
+        assert_eq!("/underlying/a", value["underlying_path"]);
+        assert_eq!("/b", value["new_path"]);
+        assert_eq!("ok", value["outcome"]);
+        assert!(value.get("new_underlying_path").is_none());
+        assert!(value.get("attributes").is_none());
+
+        let event = Event::new(Op::Unlink, 1, 2, 3, None, None, 13);
+        let value = serde_json::to_value(&event).unwrap();
+        assert_eq!(serde_json::Value::Null, value["path"]);
+        assert_eq!("EACCES", value["outcome"]);
+    }
+
+    #[test]
+    fn test_audit_log_appends() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("audit.log");
+        fs::write(&path, "{\"existing\": true}\n").unwrap();
+
+        let log = AuditLog::open(&path, Arc::from(Metrics::default())).unwrap();
+        log.record(Event::new(Op::Mkdir, 0, 0, 0, Some(Path::new("/dir")), None, 0));
+        log.record(Event::new(Op::Rmdir, 0, 0, 0, Some(Path::new("/dir")), None, 0));
+        log.close();
+        log.record(Event::new(Op::Create, 0, 0, 0, None, None, 0));  // Ignored after close.
+
+        let events = read_events(&path);
+        assert_eq!(3, events.len());
+        assert_eq!(true, events[0]["existing"]);
+        assert_eq!("mkdir", events[1]["op"]);
+        assert_eq!("rmdir", events[2]["op"]);
+    }
+
+    #[test]
+    fn test_audit_log_empty() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("audit.log");
+
+        let log = AuditLog::open(&path, Arc::from(Metrics::default())).unwrap();
+        log.close();
+
+        assert_eq!("", fs::read_to_string(&path).unwrap());
+    }
+
+    #[test]
+    fn test_audit_log_aggregates_writes() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("audit.log");
+        let new_event = |name: &str| {
+            let path = PathBuf::from(name);
+            move || Event::new(Op::Write, 0, 0, 0, Some(&path), None, 0)
+        };
+
+        let log = AuditLog::open(&path, Arc::from(Metrics::default())).unwrap();
+        log.record_write(1, 100, 10, 0, new_event("/first"));
+        log.record_write(2, 0, 5, 0, new_event("/second"));
+        log.record_write(1, 50, 20, 0, new_event("/ignored"));
+        log.record_write(2, 5, 0, 28, new_event("/ignored"));
+        log.record_write(2, 5, 0, 5, new_event("/ignored"));
+        log.finish_writes(1);
+        log.finish_writes(3);  // Handle without writes.
+        log.close();  // Records writes through handles that are still open.
+
+        let events = read_events(&path);
+        assert_eq!(2, events.len());
+        assert_eq!("/first", events[0]["path"]);
+        assert_eq!(30, events[0]["bytes"]);
+        assert_eq!(50, events[0]["range"][0]);
+        assert_eq!(110, events[0]["range"][1]);
+        assert_eq!("ok", events[0]["outcome"]);
+        assert_eq!("/second", events[1]["path"]);
+        assert_eq!(5, events[1]["bytes"]);
+        assert_eq!(0, events[1]["range"][0]);
+        assert_eq!(5, events[1]["range"][1]);
+        assert_eq!("ENOSPC", events[1]["outcome"]);
+    }
+}
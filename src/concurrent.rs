@@ -16,6 +16,7 @@ use failure::Fallible;
 use nix::errno::Errno;
 use nix::unistd;
 use nix::sys::{self, signal};
+use privileges;
 use signal_hook;
 use std::cmp;
 use std::fs;
@@ -182,7 +183,7 @@ impl Read for ShareableFileReader {
 }
 
 /// List of termination signals that cause the mount point to be correctly unmounted.
-static CAPTURED_SIGNALS: [signal::Signal; 4] = [
+pub static TERMINATION_SIGNALS: [signal::Signal; 4] = [
     signal::Signal::SIGHUP,
     signal::Signal::SIGTERM,
     signal::Signal::SIGINT,
@@ -206,35 +207,49 @@ static CAPTURED_SIGNALS: [signal::Signal; 4] = [
 /// mount function" helps ensure restoration of the original signal mask in all cases because this
 /// type does so at drop time.
 pub struct SignalsInstaller {
+    /// Signals that cause the mount point to be unmounted.
+    signals: Vec<signal::Signal>,
+
     /// Signal mask to restore at drop time.
     old_sigset: signal::SigSet,
 }
 
 impl SignalsInstaller {
-    /// Blocks signals in preparation to mount the file system.
-    pub fn prepare() -> SignalsInstaller {
+    /// Blocks `signals` in preparation to mount the file system.
+    ///
+    /// `signals` are the signals that cause the file system to be unmounted, which are typically
+    /// all of `TERMINATION_SIGNALS`.
+    pub fn prepare(signals: &[signal::Signal]) -> SignalsInstaller {
         let mut old_sigset = signal::SigSet::empty();
         let mut sigset = signal::SigSet::empty();
-        for signal in CAPTURED_SIGNALS.iter() {
+        for signal in signals {
             sigset.add(*signal);
         }
         signal::pthread_sigmask(
             signal::SigmaskHow::SIG_BLOCK, Some(&sigset), Some(&mut old_sigset))
             .expect("pthread_sigmask is not expected to fail");
-        SignalsInstaller { old_sigset }
+        SignalsInstaller { signals: signals.to_vec(), old_sigset }
     }
 
     /// Installs all signal handlers to unmount the given `mount_point`.
-    pub fn install(self, mount_point: PathBuf) -> Fallible<SignalsHandler> {
+    ///
+    /// `drain` is invoked upon receipt of a signal, before attempting to unmount the file system,
+    /// to let the file system wind down any outstanding activity.
+    ///
+    /// `unmount_timeout` is as described in `unmount_for_exit`.
+    pub fn install<F: FnOnce() + Send + 'static>(self, mount_point: PathBuf, drain: F,
+        unmount_timeout: Option<time::Duration>) -> Fallible<SignalsHandler> {
         let (signal_sender, signal_receiver) = mpsc::channel();
 
         let mut signums = vec!();
-        for signal in CAPTURED_SIGNALS.iter() {
+        for signal in &self.signals {
             signums.push(*signal as i32);
         }
         let signals = signal_hook::iterator::Signals::new(&signums)?;
 
-        std::thread::spawn(move || SignalsHandler::handler(&signals, mount_point, &signal_sender));
+        std::thread::spawn(
+            move || SignalsHandler::handler(
+                &signals, mount_point, drain, unmount_timeout, &signal_sender));
 
         Ok(SignalsHandler { signal_receiver })
 
@@ -250,22 +265,75 @@ impl Drop for SignalsInstaller {
     }
 }
 
-/// Unmounts a file system by shelling out to the correct unmount tool.
+/// Installs a handler that invokes `action` every time `signal` is received.
 ///
-/// Doing this in-process is very difficult because of differences across systems and the fact that
-/// neither `nix` nor `libc` currently expose any of the unmounting functionality.
-fn unmount(path: &Path) -> Fallible<()> {
-    #[cfg(not(any(target_os = "linux")))]
-    fn run_unmount(path: &Path) -> io::Result<process::Output> {
-        process::Command::new("umount").arg(path).output()
+/// The handler runs in a separate thread for the lifetime of the process and is independent from
+/// the handling of the termination signals, so `action` must not block on locks that FUSE
+/// operations may hold for long periods of time.
+pub fn install_signal_action<F: Fn() + Send + 'static>(signal: signal::Signal, action: F)
+    -> Fallible<()> {
+    let signals = signal_hook::iterator::Signals::new(&[signal as i32])?;
+    std::thread::spawn(move || {
+        for _ in signals.forever() {
+            action();
+        }
+    });
+    Ok(())
+}
+
+/// How often to check whether the parent process is gone on systems that cannot notify us.
+#[cfg(not(target_os = "linux"))]
+const PARENT_POLL_INTERVAL: time::Duration = time::Duration::from_millis(500);
+
+/// Sends `SIGTERM` to ourselves to make the termination signal handlers unmount the file system.
+fn terminate_on_parent_death(parent: unistd::Pid) {
+    info!("Parent process {} is gone; terminating", parent);
+    signal::kill(unistd::getpid(), signal::Signal::SIGTERM)
+        .expect("Sending a signal to ourselves is not expected to fail");
+}
+
+/// Arranges for the process to receive `SIGTERM` once `parent` exits.
+///
+/// `parent` must be the identifier of our parent process as obtained as early as possible during
+/// program startup: if the parent has already exited by the time we are called, we have been
+/// reparented and the signal is delivered right away.  This must be called after the termination
+/// signal handlers have been installed so that the signal leads to a clean unmount.
+pub fn watch_parent(parent: unistd::Pid) -> Fallible<()> {
+    #[cfg(target_os = "linux")]
+    fn watch_parent_impl(parent: unistd::Pid) -> Fallible<()> {
+        // Note that the kernel delivers the signal when the thread that spawned us exits, not
+        // when the whole parent process does.
+        let result = unsafe {
+            libc::prctl(libc::PR_SET_PDEATHSIG, libc::SIGTERM as libc::c_ulong, 0, 0, 0)
+        };
+        Errno::result(result).map_err(|e| format_err!("prctl(PR_SET_PDEATHSIG) failed: {}", e))?;
+
+        // The parent may have exited before prctl took effect, in which case the kernel will
+        // never deliver the signal.
+        if unistd::getppid() != parent {
+            terminate_on_parent_death(parent);
+        }
+        Ok(())
     }
 
-    #[cfg(any(target_os = "linux"))]
-    fn run_unmount(path: &Path) -> io::Result<process::Output> {
-        process::Command::new("fusermount").arg("-u").arg(path).output()
+    #[cfg(not(target_os = "linux"))]
+    fn watch_parent_impl(parent: unistd::Pid) -> Fallible<()> {
+        thread::spawn(move || {
+            while unistd::getppid() == parent {
+                thread::sleep(PARENT_POLL_INTERVAL);
+            }
+            terminate_on_parent_death(parent);
+        });
+        Ok(())
     }
 
-    let output = run_unmount(path)?;
+    watch_parent_impl(parent)
+}
+
+/// Waits for the unmount tool spawned via `command` and converts its result into an error if it
+/// failed.
+fn run_unmount_tool(command: &mut process::Command) -> Fallible<()> {
+    let output = command.output()?;
     if output.status.success() {
         Ok(())
     } else {
@@ -275,22 +343,143 @@ fn unmount(path: &Path) -> Fallible<()> {
     }
 }
 
-/// Tries to unmount the given file system indefinitely.
+/// Unmounts a file system by shelling out to the correct unmount tool.
+///
+/// Doing this in-process is very difficult because of differences across systems and the fact that
+/// neither `nix` nor `libc` currently expose any of the unmounting functionality.
+fn unmount(path: &Path) -> Fallible<()> {
+    #[cfg(not(any(target_os = "linux")))]
+    fn run_unmount(path: &Path) -> Fallible<()> {
+        run_unmount_tool(process::Command::new("umount").arg(path))
+    }
+
+    #[cfg(any(target_os = "linux"))]
+    fn run_unmount(path: &Path) -> Fallible<()> {
+        run_unmount_tool(process::Command::new("fusermount").arg("-u").arg(path))
+    }
+
+    run_unmount(path)
+}
+
+/// Detaches a file system from the mount table even if it is busy or cannot be accessed.
+///
+/// This is a lazy unmount on Linux and a forced unmount elsewhere.
+fn detach(path: &Path) -> Fallible<()> {
+    #[cfg(not(any(target_os = "linux")))]
+    fn run_detach(path: &Path) -> Fallible<()> {
+        run_unmount_tool(process::Command::new("umount").arg("-f").arg(path))
+    }
+
+    #[cfg(any(target_os = "linux"))]
+    fn run_detach(path: &Path) -> Fallible<()> {
+        run_unmount_tool(process::Command::new("fusermount").arg("-uz").arg(path))
+    }
+
+    run_detach(path)
+}
+
+/// Unmounts a stale file system whose server is gone, which may not be possible to do cleanly.
+///
+/// This first tries a regular unmount and then falls back to detaching the file system.
+pub fn force_unmount(path: &Path) -> Fallible<()> {
+    match unmount(path) {
+        Ok(()) => Ok(()),
+        Err(e) => {
+            info!("Regular unmount of {} failed with '{}'; forcing it", path.display(), e);
+            detach(path)
+        },
+    }
+}
+
+/// Returns the identifiers of the processes that have `path`, or any file within it, open.
+///
+/// This is best-effort: only the processes whose `/proc` entries we can read are inspected, and
+/// `path` is compared textually so it must be absolute and normalized.
+#[cfg(target_os = "linux")]
+fn find_users(path: &Path) -> io::Result<Vec<u32>> {
+    let uses_path = |proc_dir: &Path| {
+        let mut links = vec!(proc_dir.join("cwd"), proc_dir.join("root"));
+        if let Ok(fds) = fs::read_dir(proc_dir.join("fd")) {
+            links.extend(fds.filter_map(Result::ok).map(|entry| entry.path()));
+        }
+        links.iter().any(|link| fs::read_link(link).map_or(false, |t| t.starts_with(path)))
+    };
+
+    let mut pids = vec!();
+    for entry in fs::read_dir("/proc")? {
+        let entry = entry?;
+        if let Some(pid) = entry.file_name().to_str().and_then(|name| name.parse::<u32>().ok()) {
+            if uses_path(&entry.path()) {
+                pids.push(pid);
+            }
+        }
+    }
+    pids.sort();
+    Ok(pids)
+}
+
+/// Logs the processes that keep `mount_point` busy to help the user fix the problem.
+fn log_users(mount_point: &Path) {
+    #[cfg(target_os = "linux")]
+    fn log_users_impl(mount_point: &Path) {
+        let mount_point = match mount_point.canonicalize() {
+            Ok(path) => path,
+            Err(_) => mount_point.to_owned(),
+        };
+        match find_users(&mount_point) {
+            Ok(ref pids) if pids.is_empty() => {
+                info!("Found no processes using {}", mount_point.display())
+            },
+            Ok(pids) => warn!("Processes using {}: {:?}", mount_point.display(), pids),
+            Err(e) => info!("Cannot find processes using {}: {}", mount_point.display(), e),
+        }
+    }
+
+    #[cfg(not(target_os = "linux"))]
+    fn log_users_impl(mount_point: &Path) {
+        info!("Finding the processes using {} is not supported on this system",
+            mount_point.display());
+    }
+
+    log_users_impl(mount_point)
+}
+
+/// Tries to unmount the given file system until it succeeds or until `timeout` expires.
 ///
 /// If unmounting fails, it is probably because the file system is busy.  We don't know but it
 /// doesn't matter: we have entered a terminal status: we do this at exit time so we'll keep trying
 /// to unclog things while telling the user what's going on.  They are the ones that have to fix
 /// this situation.
-fn retry_unmount<P: AsRef<Path>>(mount_point: P) {
+///
+/// If `timeout` is set and expires, the file system is detached instead and this returns true.
+/// Detaching leaves the processes that were using the file system with dangling references to it,
+/// so this is only done on request.
+pub fn retry_unmount<P: AsRef<Path>>(mount_point: P, timeout: Option<time::Duration>) -> bool {
+    let mount_point = mount_point.as_ref();
+    let deadline = timeout.map(|timeout| time::Instant::now() + timeout);
+    let mut logged_users = false;
     let mut backoff = time::Duration::from_millis(10);
     let goal = time::Duration::from_secs(1);
     'retry: loop {
-        match unmount(mount_point.as_ref()) {
+        match unmount(mount_point) {
             Ok(()) => break 'retry,
             Err(e) => {
-                if backoff >= goal {
+                let expired = deadline.map_or(false, |deadline| time::Instant::now() >= deadline);
+                if backoff >= goal || expired {
                     warn!("Unmounting file system failed with '{}'; will retry in {:?}",
                         e, backoff);
+                    if !logged_users {
+                        log_users(mount_point);
+                        logged_users = true;
+                    }
+                }
+                if expired {
+                    warn!("Could not unmount {} within {:?}; detaching it",
+                        mount_point.display(), timeout.unwrap());
+                    match detach(mount_point) {
+                        Ok(()) => return true,
+                        Err(e) => warn!("Detaching file system failed with '{}'", e),
+                    }
                 }
                 thread::sleep(backoff);
                 if backoff < goal {
@@ -299,6 +488,33 @@ fn retry_unmount<P: AsRef<Path>>(mount_point: P) {
             },
         }
     }
+    false
+}
+
+/// Unmounts `mount_point` in preparation to exit via `retry_unmount`.
+///
+/// If the file system had to be detached, the FUSE loop will not terminate until all processes
+/// release the file system, so this aborts the connection by exiting right away instead of
+/// returning.
+///
+/// Once privileges have been dropped, the file system may belong to a user we cannot act as
+/// anymore, so this also exits right away if the first unmount attempt fails.  The mount point is
+/// left disconnected in that case and has to be cleaned up by its owner.
+pub fn unmount_for_exit<P: AsRef<Path>>(mount_point: P, timeout: Option<time::Duration>) {
+    if privileges::dropped() {
+        if let Err(e) = unmount(mount_point.as_ref()) {
+            error!("Cannot unmount {} after dropping privileges ({}); exiting",
+                mount_point.as_ref().display(), e);
+            process::exit(1);
+        }
+        return;
+    }
+
+    if retry_unmount(&mount_point, timeout) {
+        error!("{} was still busy after {:?}; detached it and exiting",
+            mount_point.as_ref().display(), timeout.unwrap());
+        process::exit(1);
+    }
 }
 
 /// Maintains state and allows interaction with the installed signal handler.
@@ -328,16 +544,18 @@ impl SignalsHandler {
     /// This blocks until the receipt of the first signal and then ignores the rest.
     ///
     /// Upon receipt of a signal from `signals`, the handler first updates `signal_sender` with the
-    /// number of the received signal and then attempts to unmount `mount_point` indefinitely to
-    /// unblock the main FUSE loop.
-    fn handler(signals: &signal_hook::iterator::Signals, mount_point: PathBuf,
-        signal_sender: &mpsc::Sender<i32>) {
+    /// number of the received signal, then calls `drain` to give in-flight operations a chance to
+    /// complete, and then attempts to unmount `mount_point` to unblock the main FUSE loop.  See
+    /// `unmount_for_exit` for details on `unmount_timeout`.
+    fn handler(signals: &signal_hook::iterator::Signals, mount_point: PathBuf, drain: impl FnOnce(),
+        unmount_timeout: Option<time::Duration>, signal_sender: &mpsc::Sender<i32>) {
         let signo = signals.forever().next().unwrap();
         if let Err(e) = signal_sender.send(signo) {
             warn!("Failed to propagate signal to main thread; will get stuck exiting: {}", e);
         }
-        info!("Caught signal {}; unmounting {}", signo, mount_point.display());
-        retry_unmount(mount_point);
+        info!("Caught signal {}; draining and unmounting {}", signo, mount_point.display());
+        drain();
+        unmount_for_exit(mount_point, unmount_timeout);
 
         // It'd be nice if we could just "drop(signals)" here and then send the same received signal
         // to ourselves so that the program terminated with the correct exit status.  Unfortunately,
@@ -430,4 +648,17 @@ mod tests {
             try_shareable_file_close_unblocks_reads_without_error()
         }
     }
+
+    #[test]
+    #[cfg(target_os = "linux")]
+    fn test_find_users() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().canonicalize().unwrap();
+        let pid = process::id();
+        assert!(!find_users(&path).unwrap().contains(&pid));
+
+        let _file = fs::File::create(path.join("file")).unwrap();
+        assert!(find_users(&path).unwrap().contains(&pid));
+        assert!(!find_users(&path.join("other")).unwrap().contains(&pid));
+    }
 }
@@ -14,30 +14,61 @@
 
 use failure::Error;
 use nix::errno::Errno;
+use std::error;
+use std::fmt;
 use std::io;
-use std::path::PathBuf;
+use std::path::{Path, PathBuf};
 
 /// Type that represents an error understood by the kernel.
 #[derive(Debug, Fail)]
 #[fail(display = "errno={}", errno)]
 pub struct KernelError {
     errno: Errno,
+
+    /// Path to the underlying file whose operation was abandoned for taking too long, if that is
+    /// what caused this error.
+    timed_out_path: Option<PathBuf>,
 }
 
 impl KernelError {
     /// Constructs a new error given a raw errno code.
     pub fn from_errno(errno: Errno) -> KernelError {
-        KernelError { errno }
+        KernelError { errno, timed_out_path: None }
     }
 
     /// Obtains the errno code contained in this error as an integer.
     pub fn errno_as_i32(&self) -> i32 {
         self.errno as i32
     }
+
+    /// Returns the path to the underlying file whose operation timed out, if this error is due to
+    /// such a timeout.
+    pub fn timed_out_path(&self) -> Option<&Path> {
+        self.timed_out_path.as_ref().map(PathBuf::as_path)
+    }
+}
+
+/// Error carried within an `io::Error` when an operation on an underlying file is abandoned
+/// because it did not complete within `--io_timeout`.
+#[derive(Debug)]
+pub struct IoTimeout {
+    /// Path to the underlying file that stalled.
+    pub path: PathBuf,
 }
 
+impl fmt::Display for IoTimeout {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        write!(f, "operation on {} timed out", self.path.display())
+    }
+}
+
+impl error::Error for IoTimeout {}
+
 impl From<io::Error> for KernelError {
     fn from(e: io::Error) -> Self {
+        if let Some(timeout) = e.get_ref().and_then(|e| e.downcast_ref::<IoTimeout>()) {
+            return KernelError { errno: Errno::EIO, timed_out_path: Some(timeout.path.clone()) };
+        }
         match e.raw_os_error() {
             Some(errno) => KernelError::from_errno(Errno::from_i32(errno)),
             None => {
@@ -71,12 +102,39 @@ pub enum MappingError {
         path: PathBuf,
     },
 
-    /// A path contains non-normalized components (like "..").
-    #[fail(display = "path {:?} is not normalized", path)]
+    /// A path contains non-normalized components (like "." or "..").
+    #[fail(display = "path {:?} is not normalized: cannot contain . or .. components", path)]
     PathNotNormalized {
         /// The invalid path.
         path: PathBuf,
     },
+
+    /// An exclude pattern is empty or does not refer to a single path component.
+    #[fail(display = "exclude pattern {:?} must be a non-empty file name", pattern)]
+    InvalidExclude {
+        /// The invalid pattern.
+        pattern: String,
+    },
+
+    /// Ownership squashing was requested without specifying a user nor a group.
+    #[fail(display = "squashing requires a uid or a gid")]
+    EmptySquash,
+
+    /// A permissions mask has bits outside of the permissions or would make directories
+    /// untraversable.
+    #[fail(display = "permissions mask {:04o} must be at most 7777 and keep an execute bit", mask)]
+    InvalidPermMask {
+        /// The invalid mask.
+        mask: u32,
+    },
+}
+
+/// An error indicating that the file system was unmounted due to the receipt of a signal.
+#[derive(Debug, Eq, Fail, PartialEq)]
+#[fail(display = "Caught signal {}", signo)]
+pub struct SignalError {
+    /// Number of the signal that was caught.
+    pub signo: i32,
 }
 
 /// Flattens all causes of an error into a single string.
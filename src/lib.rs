@@ -29,10 +29,13 @@
 #![allow(clippy::useless_conversion)]
 
 #[cfg(feature = "profiling")] extern crate cpuprofiler;
+extern crate env_logger;
 #[macro_use] extern crate failure;
 extern crate fuse;
+extern crate libc;
 #[macro_use] extern crate log;
 extern crate nix;
+extern crate num_cpus;
 extern crate serde_derive;
 extern crate signal_hook;
 #[cfg(test)] extern crate tempfile;
@@ -44,69 +47,189 @@ extern crate xattr;
 use failure::{Fallible, ResultExt};
 use nix::errno::Errno;
 use nix::{sys, unistd};
-use std::collections::HashMap;
-use std::ffi::OsStr;
+use nix::sys::signal;
+use std::cmp;
+use std::collections::{HashMap, HashSet, VecDeque};
+use std::env;
+use std::ffi::{OsStr, OsString};
 use std::fmt;
 use std::fs;
+use std::io::{self, Write};
+use std::net::{SocketAddr, TcpListener};
 use std::os::unix::ffi::OsStrExt;
+use std::os::unix::fs::MetadataExt;
+use std::os::unix::io::{FromRawFd, RawFd};
 use std::path::{Component, Path, PathBuf};
 use std::result::Result;
-use std::sync::{Arc, Mutex};
-use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::{Arc, Mutex, RwLock};
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
 use std::thread;
+use std::time::{Duration, Instant};
 use time::Timespec;
 
+mod audit;
 mod concurrent;
 mod errors;
+mod logging;
+mod metrics;
 mod nodes;
+mod privileges;
 mod profiling;
+mod reads;
 mod reconfig;
+mod stats;
 #[cfg(test)] mod testutils;
+mod trace;
 
-pub use errors::{flatten_causes, KernelError, MappingError};
-pub use nodes::{ArcCache, NoCache, PathCache};
+pub use errors::{flatten_causes, KernelError, MappingError, SignalError};
+pub use logging::{init_logging, json_enabled, log_file_enabled, LogFormat, RequestFilter};
+pub use metrics::Op;
+pub use nodes::{ArcCache, NoCache, PathCache, Squash, TargetType};
+pub use privileges::User;
 pub use profiling::ScopedProfiler;
 pub use reconfig::{open_input, open_output};
 
+/// Function that loads the full set of mappings to apply to the file system.
+pub type MappingsLoader = Box<dyn Fn() -> Fallible<Vec<Mapping>> + Send>;
+
+/// Optional settings of a plain mapping, as given to `Mapping::from_parts_with`.
+#[derive(Clone, Debug, Default, Eq, PartialEq)]
+pub struct MappingOptions {
+    /// Patterns for the names of the entries to hide anywhere within the mapping, which must not
+    /// be empty nor contain path separators.
+    pub excludes: Vec<String>,
+
+    /// Ownership to give to all files created within the mapping, if any, which must specify a
+    /// user or a group.  Only directories can be squashed, but this is not checked until the
+    /// mapping is applied.
+    pub squash: Option<Squash>,
+
+    /// Whether the files within the mapping are reported without execute permissions and cannot
+    /// be opened for execution, though directories remain searchable.  Only directories support
+    /// this, but this is not checked until the mapping is applied.
+    pub noexec: bool,
+
+    /// Mask that is ANDed with the permissions that every file and directory within the mapping
+    /// reports, if any, though the permissions stored in the underlying file system are kept.  The
+    /// mask must keep at least one execute bit so that directories remain traversable.  Only
+    /// directories support this, but this is not checked until the mapping is applied.
+    pub perm_mask: Option<u32>,
+
+    /// Whether to defer inspecting the underlying path until the mapping is first accessed, which
+    /// only has an effect if the mapping has no other options.  A missing target is then not
+    /// reported when applying the mapping but makes the mapping behave as a missing entry.
+    pub lazy: bool,
+
+    /// Whether a missing underlying path is not an error, in which case the mapping behaves as a
+    /// missing entry until the path appears.  Does not apply to mappings of the root directory.
+    pub optional: bool,
+
+    /// Type that the underlying path must have, if any, which is checked when the mapping is
+    /// applied or, if the path does not exist yet, once it appears.  Does not apply to mappings of
+    /// the root directory.
+    pub target_type: Option<TargetType>,
+}
+
 /// Mapping describes how an individual path within the sandbox is connected to an external path
 /// in the underlying file system.
-#[derive(Debug, Eq, PartialEq)]
+#[derive(Clone, Debug, Eq, PartialEq)]
 pub struct Mapping {
     path: PathBuf,
-    underlying_path: PathBuf,
-    writable: bool,
+    target: nodes::MappingTarget,
 }
 impl Mapping {
     /// Creates a new mapping from the individual components.
     ///
     /// `path` is the inside the sandbox's mount point where the `underlying_path` is exposed.
-    /// Both must be absolute paths.  `path` must also not contain dot-dot components, though it
-    /// may contain dot components and repeated path separators.
+    /// Both must be absolute paths.  `path` must also not contain dot nor dot-dot components,
+    /// though it may contain repeated and trailing path separators, which are dropped.
     pub fn from_parts(path: PathBuf, underlying_path: PathBuf, writable: bool)
         -> Result<Self, MappingError> {
-        if !path.is_absolute() {
-            return Err(MappingError::PathNotAbsolute { path });
+        Mapping::from_parts_with(path, underlying_path, writable, MappingOptions::default())
+    }
+
+    /// Creates a new mapping from the individual components and the optional settings in
+    /// `options`.
+    ///
+    /// `path`, `underlying_path` and `writable` are as described in `from_parts`.
+    pub fn from_parts_with(path: PathBuf, underlying_path: PathBuf, writable: bool,
+        options: MappingOptions) -> Result<Self, MappingError> {
+        let MappingOptions {
+            excludes, squash, noexec, perm_mask, lazy, optional, target_type } = options;
+        let path = Mapping::check_path(path)?;
+        if !underlying_path.is_absolute() {
+            return Err(MappingError::PathNotAbsolute { path: underlying_path });
         }
-        let is_normalized = {
-            let mut components = path.components();
-            assert_eq!(components.next(), Some(Component::RootDir), "Path expected to be absolute");
-            let is_not_normal: fn(&Component) -> bool = |c| match c {
-                Component::CurDir => panic!("Dot components ought to have been skipped"),
-                Component::Normal(_) => false,
-                Component::ParentDir | Component::Prefix(_) => true,
-                Component::RootDir => panic!("Root directory should have already been handled"),
-            };
-            components.find(is_not_normal).is_none()
-        };
-        if !is_normalized {
-            return Err(MappingError::PathNotNormalized{ path });
+        if let Some(pattern) = excludes.iter().find(|p| p.is_empty() || p.contains('/')) {
+            return Err(MappingError::InvalidExclude { pattern: pattern.to_owned() });
+        }
+
+        if let Some(squash) = squash {
+            if squash.uid.is_none() && squash.gid.is_none() {
+                return Err(MappingError::EmptySquash);
+            }
+        }
+
+        if let Some(mask) = perm_mask {
+            if mask > 0o7777 || mask & 0o111 == 0 {
+                return Err(MappingError::InvalidPermMask { mask });
+            }
         }
 
+        let excludes = nodes::Excludes::new(excludes);
+        let target = nodes::MappingTarget::Path {
+            underlying_path, writable, excludes, squash, noexec, perm_mask, lazy, optional,
+            target_type };
+        Ok(Mapping { path, target })
+    }
+
+    /// Creates a new copy-on-write mapping from the individual components.
+    ///
+    /// `path` and `underlying_path` are as described in `from_parts`.  `scratch_path` is the
+    /// directory where files are copied to when they are first modified and where new files are
+    /// created.  It must be an absolute path.
+    pub fn from_parts_cow(path: PathBuf, underlying_path: PathBuf, scratch_path: PathBuf)
+        -> Result<Self, MappingError> {
+        let path = Mapping::check_path(path)?;
         if !underlying_path.is_absolute() {
             return Err(MappingError::PathNotAbsolute { path: underlying_path });
         }
+        if !scratch_path.is_absolute() {
+            return Err(MappingError::PathNotAbsolute { path: scratch_path });
+        }
+
+        let target = nodes::MappingTarget::CopyOnWrite { underlying_path, scratch_path };
+        Ok(Mapping { path, target })
+    }
+
+    /// Creates a new mapping for an in-memory directory.
+    ///
+    /// `path` is as described in `from_parts`.  `size_limit` is the maximum number of bytes that
+    /// the files in the directory can hold, if any.
+    pub fn from_parts_memory(path: PathBuf, size_limit: Option<u64>)
+        -> Result<Self, MappingError> {
+        let path = Mapping::check_path(path)?;
+        Ok(Mapping { path, target: nodes::MappingTarget::Memory { size_limit } })
+    }
+
+    /// Ensures that the `path` of a mapping is absolute and does not contain dot nor dot-dot
+    /// components.
+    ///
+    /// Returns the input path with repeated and trailing separators removed so that different
+    /// spellings of the same location are treated as the same mapping.
+    fn check_path(path: PathBuf) -> Result<PathBuf, MappingError> {
+        if !path.is_absolute() {
+            return Err(MappingError::PathNotAbsolute { path });
+        }
+        // Path::components() silently drops intermediate dot components, so we have to look for
+        // them in the raw path.
+        let has_dots = path.as_os_str().as_bytes().split(|c| *c == b'/')
+            .any(|name| name == b"." || name == b"..");
+        if has_dots {
+            return Err(MappingError::PathNotNormalized { path });
+        }
 
-        Ok(Mapping { path, underlying_path, writable })
+        Ok(path.components().collect())
     }
 
     /// Returns true if this is a mapping for the root directory.
@@ -117,27 +240,139 @@ impl Mapping {
 
 impl fmt::Display for Mapping {
     fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
-        let writability = if self.writable { "read/write" } else { "read-only" };
-        write!(f, "{} -> {} ({})", self.path.display(), self.underlying_path.display(), writability)
+        match &self.target {
+            nodes::MappingTarget::Path {
+                underlying_path, writable, excludes, squash, noexec, perm_mask, lazy, optional,
+                target_type } => {
+                let writability = if *writable { "read/write" } else { "read-only" };
+                let mut details = vec!(writability.to_owned());
+                if !excludes.is_empty() {
+                    details.push(format!("excluding {}", excludes.patterns().join(", ")));
+                }
+                if let Some(squash) = squash {
+                    details.push(squash.to_string());
+                }
+                if *noexec {
+                    details.push("noexec".to_owned());
+                }
+                if let Some(perm_mask) = perm_mask {
+                    details.push(format!("perm={:04o}", perm_mask));
+                }
+                if *lazy {
+                    details.push("lazy".to_owned());
+                }
+                if *optional {
+                    details.push("optional".to_owned());
+                }
+                if let Some(target_type) = target_type {
+                    details.push(format!("type={}", target_type));
+                }
+                write!(f, "{} -> {} ({})",
+                    self.path.display(), underlying_path.display(), details.join(", "))
+            },
+            nodes::MappingTarget::CopyOnWrite { underlying_path, scratch_path } => {
+                write!(f, "{} -> {} (copy-on-write to {})",
+                    self.path.display(), underlying_path.display(), scratch_path.display())
+            },
+            nodes::MappingTarget::Memory { size_limit: Some(size_limit) } => {
+                write!(f, "{} (in-memory, up to {} bytes)", self.path.display(), size_limit)
+            },
+            nodes::MappingTarget::Memory { size_limit: None } => {
+                write!(f, "{} (in-memory)", self.path.display())
+            },
+            nodes::MappingTarget::Overlay { layers, writable } => {
+                let layers = layers.iter()
+                    .map(|layer| layer.display().to_string())
+                    .collect::<Vec<String>>();
+                let writability = if *writable { "read/write" } else { "read-only" };
+                write!(f, "{} -> {} (overlay, {})",
+                    self.path.display(), layers.join(", "), writability)
+            },
+        }
     }
 }
 
+/// Identity of a node whose inode number should survive reconfigurations.
+#[derive(Clone, Debug, Eq, Hash, PartialEq)]
+enum InodeKey {
+    /// A node backed by an underlying file, identified by its device and inode numbers.
+    Underlying(u64, u64),
+
+    /// A scaffold directory, identified by the inode number of its parent and by its name.  As the
+    /// parent's number is itself stable, this identifies the directory's path within the mount.
+    Scaffold(u64, OsString),
+}
+
+/// Maximum number of released inode numbers that `IdGenerator` remembers so that nodes recreated
+/// for the same identities can claim them again.
+///
+/// This must be large enough to cover the nodes unmapped by a reconfiguration that are mapped
+/// again by the next one, but it bounds the memory used by a long-lived instance that looks up
+/// many distinct files over time.
+const MAX_RELEASED_INODES: usize = 1 << 16;
+
+/// Record of the inode numbers handed out to nodes with a stable identity.
+#[derive(Default)]
+struct InodeTable {
+    /// Inode number most recently assigned to each identity, whether still in use or not.
+    by_key: HashMap<InodeKey, u64>,
+
+    /// Identity of each inode number in `by_key`, plus those of numbers that were superseded by
+    /// another one for the same identity while still in use.
+    by_inode: HashMap<u64, InodeKey>,
+
+    /// Inode numbers currently held by nodes that are still part of the file system.
+    live: HashSet<u64>,
+
+    /// Released inode numbers, oldest first, whose entries are dropped once there are too many.
+    ///
+    /// A number may appear more than once if it was claimed again and released again.
+    released: VecDeque<u64>,
+}
+
 /// Monotonically-increasing generator of identifiers.
+///
+/// The generator also keeps track of the inode numbers assigned to nodes that represent underlying
+/// files or scaffold directories so that, when these nodes are unmapped and later recreated by a
+/// reconfiguration, they report the same inode numbers as before.  Tools that cache device and
+/// inode pairs, or that rely on them to detect hard links, otherwise see every file change.
+///
+/// Alternatively, the generator can pass through the inode numbers of the underlying files, in
+/// which case the numbers it synthesizes for all other nodes should start at
+/// `SYNTHESIZED_INODES_BASE` to keep them apart from the real ones.
 pub struct IdGenerator {
     last_id: AtomicUsize,
+    inodes: Mutex<InodeTable>,
+
+    /// Whether nodes backed by underlying files report the inode numbers of those files.
+    expose_underlying: bool,
+
+    /// Maximum number of released inode numbers to remember.  See `MAX_RELEASED_INODES`.
+    max_released: usize,
 }
 
 impl IdGenerator {
     /// Generation number to return to the kernel for any inode number.
     ///
-    /// We don't reuse inode numbers throughout the lifetime of a sandboxfs instance and we do not
-    /// support FUSE daemon restarts without going through an unmount/mount sequence, so it is OK
-    /// to have a constant number here.
+    /// Inode numbers are only reused for nodes that represent the same file or directory as the
+    /// node that previously held them, and we do not support FUSE daemon restarts without going
+    /// through an unmount/mount sequence, so it is OK to have a constant number here.
     const GENERATION: u64 = 0;
 
     /// Constructs a new generator that starts at the given value.
     fn new(start_value: u64) -> Self {
-        IdGenerator { last_id: AtomicUsize::new(start_value as usize) }
+        IdGenerator {
+            last_id: AtomicUsize::new(start_value as usize),
+            inodes: Mutex::from(InodeTable::default()),
+            expose_underlying: false,
+            max_released: MAX_RELEASED_INODES,
+        }
+    }
+
+    /// Constructs a new generator that starts at the given value and that passes through the
+    /// inode numbers of underlying files.
+    fn new_exposing_underlying(start_value: u64) -> Self {
+        IdGenerator { expose_underlying: true, ..IdGenerator::new(start_value) }
     }
 
     /// Obtains a new identifier.
@@ -149,6 +384,162 @@ impl IdGenerator {
         }
         id as u64
     }
+
+    /// Obtains the inode number for a node that represents the underlying file described by
+    /// `attr`, reusing the number of a previously-unmapped node for the same file if any.
+    ///
+    /// If the generator exposes underlying inode numbers, this is the inode number of the file.
+    pub fn for_underlying(&self, attr: &fs::Metadata) -> u64 {
+        if self.expose_underlying {
+            return attr.ino();
+        }
+        self.stable(InodeKey::Underlying(attr.dev(), attr.ino()))
+    }
+
+    /// Obtains the inode number for a scaffold directory called `name` within the directory
+    /// `parent`, reusing the number of a previously-unmapped directory at the same location if any.
+    pub fn for_scaffold(&self, parent: u64, name: &OsStr) -> u64 {
+        self.stable(InodeKey::Scaffold(parent, name.to_os_string()))
+    }
+
+    /// Obtains the inode number for the node identified by `key`.
+    ///
+    /// If another live node already holds the number previously assigned to `key`, a new number
+    /// is handed out instead so that the kernel can tell both nodes apart.
+    fn stable(&self, key: InodeKey) -> u64 {
+        let mut inodes = self.inodes.lock().unwrap();
+        if let Some(inode) = inodes.by_key.get(&key).cloned() {
+            if inodes.live.insert(inode) {
+                return inode;
+            }
+        }
+        let inode = self.next();
+        inodes.live.insert(inode);
+        inodes.by_inode.insert(inode, key.clone());
+        inodes.by_key.insert(key, inode);
+        inode
+    }
+
+    /// Marks the given `inode` as no longer in use so that a node with the same identity can
+    /// claim it again.
+    ///
+    /// Only the `max_released` most recently released numbers are remembered: older ones are
+    /// forgotten so that the table does not grow with every distinct file ever looked up.
+    fn release_inode(&self, inode: u64) {
+        let mut inodes = self.inodes.lock().unwrap();
+        if !inodes.live.remove(&inode) || !inodes.by_inode.contains_key(&inode) {
+            return;
+        }
+        inodes.released.push_back(inode);
+        while inodes.released.len() > self.max_released {
+            let oldest = inodes.released.pop_front().unwrap();
+            if inodes.live.contains(&oldest) {
+                continue;  // Claimed again; will be queued again once released.
+            }
+            if let Some(key) = inodes.by_inode.remove(&oldest) {
+                if inodes.by_key.get(&key) == Some(&oldest) {
+                    inodes.by_key.remove(&key);
+                }
+            }
+        }
+    }
+}
+
+/// First inode number to synthesize when exposing the inode numbers of underlying files.
+///
+/// Underlying file systems hand out inode numbers from the bottom of the range, so starting at
+/// the midpoint makes collisions with synthesized numbers very unlikely.
+const SYNTHESIZED_INODES_BASE: u64 = 1 << 63;
+
+/// Block size to report in file system statistics when the root is a scaffold directory.
+const SCAFFOLD_STATFS_BLOCK_SIZE: u32 = 4096;
+
+/// Number of blocks to report in file system statistics when the root is a scaffold directory.
+const SCAFFOLD_STATFS_BLOCKS: u64 = 1 << 20;
+
+/// Number of files to report in file system statistics when the root is a scaffold directory.
+const SCAFFOLD_STATFS_FILES: u64 = 1 << 20;
+
+/// Minimum number of mapping targets for which `prefetch_targets` bothers to stat them.
+const PREFETCH_MIN_TARGETS: usize = 64;
+
+/// Maximum number of threads that `prefetch_targets` uses to stat the targets of mappings.
+const PREFETCH_MAX_THREADS: usize = 32;
+
+/// Flag that Linux sets in the open requests issued to load a program, known as `__FMODE_EXEC`.
+///
+/// This is not part of the userspace headers, and other systems do not tell these opens apart, in
+/// which case hiding the execute bits of the files is what prevents their execution.
+const OPEN_FOR_EXEC: u32 = 0o40;
+
+/// Records a call to the FUSE operation `$op` on `$inode`, or on the entry `$name` within it,
+/// which is tracked as in flight until the end of the calling function (see `SandboxFS::start_op`)
+/// and traced if debug logging is enabled (see `SandboxFS::trace_request`), and then rejects the
+/// request and returns from the calling function if the file system `$fs` cannot serve the
+/// request `$req` (see `SandboxFS::check_request`).
+macro_rules! check_request {
+    ( $fs:expr, $op:expr, $req:expr, $reply:expr, $inode:expr ) => {
+        check_request!($fs, $op, $req, $reply, $inode, None)
+    };
+    ( $fs:expr, $op:expr, $req:expr, $reply:expr, $inode:expr, $name:expr ) => {
+        let _in_flight = $fs.start_op($op, $inode, $name);
+        $fs.trace_request($op, $inode, $name);
+        if let Err(e) = $fs.check_request($req) {
+            $reply.error($fs.metrics.record_error(&e));
+            return;
+        }
+    }
+}
+
+/// Tracks the references that the kernel holds on an inode number.
+///
+/// These are kept by inode number and not by node because the kernel does not know about nodes:
+/// if a reconfiguration replaces a node with another one that gets the same inode number, the
+/// kernel keeps accounting for both under the same number.
+#[derive(Default)]
+struct Lookups {
+    /// Number of lookups of the inode that the kernel has not forgotten about yet.
+    count: u64,
+
+    /// Directory entries through which the kernel reached the inode, as pairs of the inode
+    /// number of the directory and the name of the entry within it.
+    names: Vec<(u64, OsString)>,
+
+    /// Settings of the mapping through which the kernel last reached the inode.
+    settings: MappingSettings,
+}
+
+/// Settings of a mapping that affect how its nodes are presented to the kernel.
+#[derive(Clone, Copy, Default)]
+struct MappingSettings {
+    /// Ownership squashing of the mapping, if any.
+    squash: Option<nodes::Squash>,
+
+    /// Whether the mapping forbids execution.
+    noexec: bool,
+
+    /// Mask to apply to the permissions of the nodes of the mapping, if any.
+    perm_mask: Option<u32>,
+}
+
+impl MappingSettings {
+    /// Gets the settings of the mapping that the directory `dir_node` belongs to.
+    fn of_dir(dir_node: &nodes::ArcNode) -> Self {
+        MappingSettings {
+            squash: dir_node.squash(),
+            noexec: dir_node.noexec(),
+            perm_mask: dir_node.perm_mask(),
+        }
+    }
+
+    /// Gets the settings that apply to the entry `name` of the directory `dir_node`.
+    fn of_entry(dir_node: &nodes::ArcNode, name: &OsStr) -> Self {
+        MappingSettings {
+            squash: dir_node.squash_for(name),
+            noexec: dir_node.noexec_for(name),
+            perm_mask: dir_node.perm_mask_for(name),
+        }
+    }
 }
 
 /// FUSE file system implementation of sandboxfs.
@@ -156,8 +547,14 @@ struct SandboxFS {
     /// Monotonically-increasing generator of identifiers for this file system instance.
     ids: Arc<IdGenerator>,
 
-    /// Mapping of inode numbers to in-memory nodes that tracks all files known by sandboxfs.
-    nodes: Arc<Mutex<HashMap<u64, nodes::ArcNode>>>,
+    /// Mapping of inode numbers to in-memory nodes that tracks all files known by the kernel.
+    ///
+    /// Every operation looks its nodes up in this table but only lookups, forgets and
+    /// reconfigurations modify it, so readers share the lock to not serialize behind each other.
+    nodes: Arc<RwLock<HashMap<u64, nodes::ArcNode>>>,
+
+    /// Mapping of inode numbers to the references that the kernel holds on them.
+    lookups: HashMap<u64, Lookups>,
 
     /// Mapping of handle numbers to file open handles.
     handles: Arc<Mutex<HashMap<u64, nodes::ArcHandle>>>,
@@ -168,8 +565,54 @@ struct SandboxFS {
     /// How long to tell the kernel to cache file metadata for.
     ttl: Timespec,
 
+    /// How long to tell the kernel to cache failed lookups for.  Zero if they must not be cached.
+    negative_ttl: Timespec,
+
     /// Whether support for xattrs is enabled or not.
     xattrs: bool,
+
+    /// Underlying path of the root mapping, used to answer file system statistics queries.  None if
+    /// the root directory is a scaffold directory.
+    statfs_path: Option<PathBuf>,
+
+    /// User that owns the mount point when access must be restricted to it and to root.  None if
+    /// access control is delegated to the kernel.
+    owner: Option<unistd::Uid>,
+
+    /// User and group to report as the owners of all files instead of their real ones, if any.
+    forced_owner: (Option<u32>, Option<u32>),
+
+    /// Whether the file system is shutting down and thus must not accept new requests.
+    draining: Arc<AtomicBool>,
+
+    /// Number of open underlying file descriptors at which idle ones start being closed, if any.
+    max_open_files: Option<usize>,
+
+    /// Directories that the targets of all mappings must be within, if restricted.
+    allowed_targets: Option<Arc<Vec<PathBuf>>>,
+
+    /// Counters that track the activity of the file system.
+    metrics: Arc<metrics::Metrics>,
+
+    /// Filters for our own trace of requests, which replaces the one of the FUSE library.  None if
+    /// requests are not filtered, in which case we leave tracing to the FUSE library.
+    request_filter: Option<Arc<RequestFilter>>,
+
+    /// Duration above which operations are logged as slow.  None if they are never logged.
+    slow_op_threshold: Option<Duration>,
+
+    /// Log to which to record the operations that modify the file system, if any.
+    audit_log: Option<Arc<audit::AuditLog>>,
+
+    /// Tracker of the files that are read, if enabled.
+    reads: Option<Arc<reads::ReadsTracker>>,
+
+    /// Recorder of the execution trace of the operations, if enabled.
+    tracer: Option<Arc<trace::Tracer>>,
+
+    /// Lock that serializes reconfigurations received over HTTP and reloads of the mappings with
+    /// all other reconfigurations.  Shared by all the reconfigurable views of this file system.
+    reconfig_lock: Arc<RwLock<()>>,
 }
 
 /// A view of a `SandboxFS` instance to allow for concurrent reconfigurations.
@@ -186,10 +629,37 @@ struct ReconfigurableSandboxFS {
     ids: Arc<IdGenerator>,
 
     /// Mapping of inode numbers to in-memory nodes that tracks all files known by sandboxfs.
-    nodes: Arc<Mutex<HashMap<u64, nodes::ArcNode>>>,
+    nodes: Arc<RwLock<HashMap<u64, nodes::ArcNode>>>,
 
     /// Cache of sandboxfs nodes indexed by their underlying path.
     cache: ArcCache,
+
+    /// Directories that the targets of all mappings must be within, if restricted.
+    allowed_targets: Option<Arc<Vec<PathBuf>>>,
+
+    /// Counters that track the activity of the file system.
+    metrics: Arc<metrics::Metrics>,
+
+    /// Tracker of the files that are read, if enabled.
+    reads: Option<Arc<reads::ReadsTracker>>,
+
+    /// Lock that serializes reconfigurations received over HTTP and reloads of the mappings with
+    /// all other reconfigurations.  Shared by all views of the same file system.
+    reconfig_lock: Arc<RwLock<()>>,
+}
+
+/// Converts a relative `path` into an absolute one by prepending the current working directory.
+///
+/// This is purely lexical: symbolic links are not resolved and dot-dot components are preserved
+/// so that they are interpreted by the underlying file system.  Absolute paths are returned
+/// unmodified, and so are empty paths so that the callers can reject them as not absolute.
+pub fn make_absolute(path: PathBuf) -> io::Result<PathBuf> {
+    if path.is_absolute() || path.as_os_str().is_empty() {
+        return Ok(path);
+    }
+    let mut abs_path = env::current_dir()?;
+    abs_path.extend(path.components().filter(|c| *c != Component::CurDir));
+    Ok(abs_path)
 }
 
 /// Splits an absolute path into components, stripping the first root component.
@@ -212,68 +682,439 @@ fn split_abs_path(path: &Path) -> Vec<Component> {
 ///
 /// This code is shared by the application of `--mapping` flags and by the application of new
 /// mappings as part of a reconfiguration operation.  We want both processes to behave identically.
+///
+/// If `allowed_targets` is set, the mapping is rejected unless its targets are within them, and
+/// targets that are resolved later on are checked against them at that point.
 fn apply_mapping(mapping: &Mapping, root: &dyn nodes::Node, ids: &IdGenerator,
-    cache: &dyn nodes::Cache) -> Fallible<nodes::ArcNode> {
+    cache: &dyn nodes::Cache, allowed_targets: Option<&[PathBuf]>) -> Fallible<nodes::ArcNode> {
     let components = split_abs_path(&mapping.path);
 
     // The input `root` node is an existing node that corresponds to the root.  If we don't find
     // any path components in the given mapping, it means we are trying to remap that same node.
     ensure!(!components.is_empty(), "Root can be mapped at most once");
+    if nodes::confine_symlinks() {
+        check_confined_target(mapping)?;
+    }
+    if let Some(allowed_targets) = allowed_targets {
+        // Lazy targets are checked once they are resolved so that they are not inspected early.
+        if !mapping.target.is_lazy() {
+            check_allowed_target(mapping, allowed_targets)?;
+        }
+    }
+
+    root.map(&components, &mapping.target, allowed_targets, &ids, cache)
+}
+
+/// Ensures that the underlying paths that `mapping` targets do not traverse symlinks.
+///
+/// Symlink confinement refuses to open files through paths that traverse symlinks, so mappings
+/// whose targets do so would be unusable.  The targets themselves may still be symlinks, in which
+/// case they are exposed as such.
+fn check_confined_target(mapping: &Mapping) -> Fallible<()> {
+    for path in target_paths(&mapping.target) {
+        let (parent, name) = match (path.parent(), path.file_name()) {
+            (Some(parent), Some(name)) => (parent, name),
+            _ => continue,
+        };
+        let real_path = fs::canonicalize(parent)
+            .with_context(|_| format!("Failed to resolve {:?}", parent))?
+            .join(name);
+        ensure!(&real_path == path, "{:?} traverses a symlink, which --confine_symlinks does not \
+            allow; use {:?} instead", path, real_path);
+    }
+    Ok(())
+}
+
+/// Ensures that all the underlying paths that `mapping` targets are within one of the
+/// `allowed_targets` directories, which must be canonical.
+fn check_allowed_target(mapping: &Mapping, allowed_targets: &[PathBuf]) -> Fallible<()> {
+    for path in target_paths(&mapping.target) {
+        check_allowed_path(path, allowed_targets)?;
+    }
+    Ok(())
+}
+
+/// Ensures that `path` is within one of the `allowed_targets` directories, which must be
+/// canonical.
+///
+/// The path is resolved before being checked so that symlinks cannot be used to reach files
+/// outside of the allowed directories.  If `path` does not exist, its nearest existing ancestor is
+/// resolved instead, so targets that appear later on must be checked again once they exist.
+fn check_allowed_path(path: &Path, allowed_targets: &[PathBuf]) -> Fallible<()> {
+    let real_path = canonicalize_existing(path)
+        .with_context(|_| format!("Failed to resolve {:?}", path))?;
+    if allowed_targets.iter().any(|allowed| real_path.starts_with(allowed)) {
+        return Ok(());
+    }
+    if real_path == path {
+        return Err(format_err!("{:?} is not within any of the --allowed_targets", path));
+    }
+    Err(format_err!(
+        "{:?} resolves to {:?}, which is not within any of the --allowed_targets",
+        path, real_path))
+}
+
+/// Same as `fs::canonicalize` but tolerates `path` not existing, in which case the missing
+/// trailing components are appended as they are to the resolved path of the nearest existing
+/// ancestor.
+fn canonicalize_existing(path: &Path) -> io::Result<PathBuf> {
+    let mut missing = vec!();
+    let mut ancestor = path;
+    let mut real_path = loop {
+        let error = match fs::canonicalize(ancestor) {
+            Ok(real_path) => break real_path,
+            Err(e) => e,
+        };
+        match (error.kind(), ancestor.parent(), ancestor.file_name()) {
+            (io::ErrorKind::NotFound, Some(parent), Some(name)) => {
+                missing.push(name);
+                ancestor = parent;
+            },
+            _ => return Err(error),
+        }
+    };
+    for name in missing.iter().rev() {
+        real_path.push(name);
+    }
+    Ok(real_path)
+}
+
+/// Returns all the underlying paths that `target` refers to.
+fn target_paths(target: &nodes::MappingTarget) -> Vec<&PathBuf> {
+    match target {
+        nodes::MappingTarget::Path { underlying_path, .. } => vec!(underlying_path),
+        nodes::MappingTarget::CopyOnWrite { underlying_path, scratch_path } => {
+            vec!(underlying_path, scratch_path)
+        },
+        nodes::MappingTarget::Memory { .. } => vec!(),
+        nodes::MappingTarget::Overlay { layers, .. } => layers.iter().collect(),
+    }
+}
+
+/// Merges all `mappings` that share the same path into a single overlay mapping.
+///
+/// The layers of each overlay appear in the same order as their mappings, so later mappings take
+/// precedence over earlier ones, and the overlay is placed where the first of its mappings was.
+/// The overlay is writable if its last mapping is.
+fn merge_overlays(mappings: &[Mapping]) -> Fallible<Vec<Mapping>> {
+    let mut merged: Vec<Mapping> = vec!();
+    for mapping in mappings {
+        let other = match merged.iter().position(|other| other.path == mapping.path) {
+            Some(i) => &mut merged[i],
+            None => {
+                merged.push(Mapping { path: mapping.path.clone(), target: mapping.target.clone() });
+                continue;
+            },
+        };
+
+        let mut layers = match &other.target {
+            nodes::MappingTarget::Path {
+                underlying_path, excludes, squash, noexec, perm_mask, .. }
+                if excludes.is_empty() && squash.is_none() && !noexec && perm_mask.is_none() => {
+                vec!(underlying_path.clone())
+            },
+            nodes::MappingTarget::Overlay { layers, .. } => layers.clone(),
+            _ => return Err(format_err!(
+                "Cannot overlay '{}': only plain ro and rw mappings can be overlaid",
+                other)),
+        };
+        match &mapping.target {
+            nodes::MappingTarget::Path {
+                underlying_path, writable, excludes, squash, noexec, perm_mask, .. }
+                if excludes.is_empty() && squash.is_none() && !noexec && perm_mask.is_none() => {
+                layers.push(underlying_path.clone());
+                other.target = nodes::MappingTarget::Overlay { layers, writable: *writable };
+            },
+            _ => return Err(format_err!(
+                "Cannot overlay '{}': only plain ro and rw mappings can be overlaid",
+                mapping)),
+        }
+    }
+    Ok(merged)
+}
 
-    root.map(&components, &mapping.underlying_path, mapping.writable, &ids, cache)
+/// Warns if the targets of `mappings` live on more than one device, as their inode numbers may
+/// then collide when they are exposed verbatim.
+fn warn_if_devices_differ(mappings: &[Mapping]) {
+    let mut devices = HashSet::new();
+    for mapping in mappings.iter().filter(|mapping| !mapping.target.is_lazy()) {
+        let paths = match &mapping.target {
+            nodes::MappingTarget::Path { underlying_path, .. } => vec!(underlying_path),
+            nodes::MappingTarget::CopyOnWrite { underlying_path, .. } => vec!(underlying_path),
+            nodes::MappingTarget::Memory { .. } => vec!(),
+            nodes::MappingTarget::Overlay { layers, .. } => layers.iter().collect(),
+        };
+        for path in paths {
+            // Errors are reported later on when the mapping is applied.
+            if let Ok(attr) = fs::symlink_metadata(path) {
+                devices.insert(attr.dev());
+            }
+        }
+    }
+    if devices.len() > 1 {
+        warn!("Mappings target {} different devices; exposed inode numbers may collide",
+            devices.len());
+    }
+}
+
+/// Indexes `mappings`, which must have unique paths as `check_mappings` ensures, by their paths.
+///
+/// Reloading a mapping file compares the old and new mappings against each other, and scanning
+/// the whole set for every mapping becomes too slow once there are thousands of them.
+fn index_by_path<'a, I: IntoIterator<Item = &'a Mapping>>(mappings: I)
+    -> HashMap<&'a Path, &'a Mapping> {
+    mappings.into_iter().map(|mapping| (mapping.path.as_path(), mapping)).collect()
+}
+
+/// Returns whether `index`, as built by `index_by_path`, contains `mapping`.
+fn index_contains(index: &HashMap<&Path, &Mapping>, mapping: &Mapping) -> bool {
+    index.get(mapping.path.as_path()).map_or(false, |other| *other == mapping)
+}
+
+/// Stats the targets of all `mappings` concurrently so that the construction of the node hierarchy
+/// that follows, which happens one mapping at a time, finds their metadata in the kernel's caches.
+///
+/// Building the hierarchy for many mappings is dominated by the latency of looking up their
+/// targets, which are usually spread all over the underlying file systems.  The results of the
+/// prefetch are discarded: any problems are reported, in order, when the mappings are applied.
+fn prefetch_targets<'a, I: IntoIterator<Item = &'a Mapping>>(mappings: I) {
+    let paths = mappings.into_iter()
+        .filter(|mapping| !mapping.target.is_lazy())
+        .flat_map(|mapping| target_paths(&mapping.target))
+        .cloned()
+        .collect::<Vec<PathBuf>>();
+    if paths.len() < PREFETCH_MIN_TARGETS {
+        return;
+    }
+
+    // Stats are bound by I/O latency, not CPU, so use more threads than CPUs to overlap them.
+    let threads = cmp::min(num_cpus::get() * 4, PREFETCH_MAX_THREADS);
+    let paths: Arc<[PathBuf]> = Arc::from(paths);
+    let next = Arc::from(AtomicUsize::new(0));
+    let pool = threadpool::ThreadPool::new(threads);
+    for _ in 0..threads {
+        let paths = paths.clone();
+        let next = next.clone();
+        pool.execute(move || {
+            while let Some(path) = paths.get(next.fetch_add(1, Ordering::Relaxed)) {
+                let _ = fs::symlink_metadata(path);
+            }
+        });
+    }
+    pool.join();
 }
 
 /// Creates the initial node hierarchy based on a collection of `mappings`.
-fn create_root(mappings: &[Mapping], ids: &IdGenerator, cache: &dyn nodes::Cache)
-    -> Fallible<nodes::ArcNode> {
-    let now = time::get_time();
+///
+/// The root node always gets the `fuse::FUSE_ROOT_ID` inode number, whatever `ids` hands out.
+/// `allowed_targets` is as described in `apply_mapping`.
+fn create_root(mappings: &[Mapping], ids: &IdGenerator, cache: &dyn nodes::Cache,
+    allowed_targets: Option<&[PathBuf]>) -> Fallible<nodes::ArcNode> {
+    let mut errors = vec!();
+    let root = create_root_collecting(mappings, ids, cache, allowed_targets, &mut errors);
+    match errors.into_iter().next() {
+        Some(e) => Err(e),
+        None => Ok(root),
+    }
+}
 
-    let (root, rest) = if mappings.is_empty() {
-        (nodes::Dir::new_empty(ids.next(), None, now), mappings)
-    } else {
-        let first = &mappings[0];
-        if first.is_root() {
-            let fs_attr = fs::symlink_metadata(&first.underlying_path)
+/// Creates the root node for the `first` mapping of a collection, which is only used if it
+/// targets the root directory.
+///
+/// `allowed_targets` is as described in `apply_mapping`.
+fn create_root_node(first: Option<&Mapping>, now: Timespec, allowed_targets: Option<&[PathBuf]>)
+    -> Fallible<nodes::ArcNode> {
+    let first = match first {
+        Some(first) if first.is_root() => first,
+        _ => return Ok(nodes::Dir::new_empty(fuse::FUSE_ROOT_ID, None, now)),
+    };
+    if nodes::confine_symlinks() {
+        check_confined_target(first).context("Failed to map root")?;
+    }
+    if let Some(allowed_targets) = allowed_targets {
+        check_allowed_target(first, allowed_targets).context("Failed to map root")?;
+    }
+    let root = match &first.target {
+        nodes::MappingTarget::Path {
+            underlying_path, writable, excludes, squash, noexec, perm_mask, .. } => {
+            let fs_attr = fs::symlink_metadata(underlying_path)
                 .with_context(|_| format!("Failed to map root: stat failed for {:?}",
-                    &first.underlying_path))?;
+                    underlying_path))?;
             ensure!(fs_attr.is_dir(), "Failed to map root: {:?} is not a directory",
-                    &first.underlying_path);
-            (nodes::Dir::new_mapped(ids.next(), &first.underlying_path, &fs_attr, first.writable),
-                &mappings[1..])
-        } else {
-            (nodes::Dir::new_empty(ids.next(), None, now), mappings)
-        }
+                    underlying_path);
+            nodes::Dir::new_mapping(fuse::FUSE_ROOT_ID, underlying_path, &fs_attr,
+                *writable, excludes, *squash, *noexec, *perm_mask)
+        },
+        nodes::MappingTarget::CopyOnWrite { underlying_path, scratch_path } => {
+            nodes::Dir::new_cow_mapping(fuse::FUSE_ROOT_ID, underlying_path, scratch_path)
+                .context("Failed to map root")?
+        },
+        nodes::MappingTarget::Memory { size_limit } => {
+            let inode = fuse::FUSE_ROOT_ID;
+            nodes::MemDir::new_mapping(inode, inode, *size_limit, now)
+        },
+        nodes::MappingTarget::Overlay { layers, writable } => {
+            nodes::Dir::new_overlay_mapping(fuse::FUSE_ROOT_ID, layers, *writable)
+                .context("Failed to map root")?
+        },
+    };
+    Ok(root)
+}
+
+/// Same as `create_root` but keeps going when a mapping cannot be applied.
+///
+/// The errors of all failed mappings are appended to `errors` in order.  Failed mappings are
+/// skipped, so the returned hierarchy is incomplete if any errors were found and later mappings
+/// may report spurious errors if they depended on the failed ones.
+fn create_root_collecting(mappings: &[Mapping], ids: &IdGenerator, cache: &dyn nodes::Cache,
+    allowed_targets: Option<&[PathBuf]>, errors: &mut Vec<failure::Error>) -> nodes::ArcNode {
+    prefetch_targets(mappings);
+
+    let now = time::get_time();
+
+    let root = match create_root_node(mappings.get(0), now, allowed_targets) {
+        Ok(root) => root,
+        Err(e) => {
+            errors.push(e);
+            nodes::Dir::new_empty(fuse::FUSE_ROOT_ID, None, now)
+        },
+    };
+    let rest = match mappings.get(0) {
+        Some(first) if first.is_root() => &mappings[1..],
+        _ => mappings,
     };
 
     for mapping in rest {
-        apply_mapping(mapping, root.as_ref(), ids, cache)
-            .with_context(|_| format!("Cannot map '{}'", mapping))?;
+        if let Err(e) = apply_mapping(mapping, root.as_ref(), ids, cache, allowed_targets) {
+            errors.push(e.context(format!("Cannot map '{}'", mapping)).into());
+        }
     }
 
-    Ok(root)
+    root
+}
+
+/// Checks whether the given `mappings` can be applied without mounting the file system.
+///
+/// `overlay` and `allowed_targets` are as described in `SandboxFS::create`.  Returns the problems
+/// found in all mappings, which is empty if they are all valid.
+pub fn check_mappings(mappings: &[Mapping], overlay: bool, allowed_targets: Option<&[PathBuf]>)
+    -> Vec<failure::Error> {
+    let merged;
+    let mappings = if overlay {
+        match merge_overlays(mappings) {
+            Ok(mappings) => {
+                merged = mappings;
+                &merged[..]
+            },
+            Err(e) => return vec!(e),
+        }
+    } else {
+        mappings
+    };
+
+    let mut errors = vec!();
+    let ids = IdGenerator::new(fuse::FUSE_ROOT_ID + 1);
+    create_root_collecting(
+        mappings, &ids, &nodes::NoCache::default(), allowed_targets, &mut errors);
+    errors
 }
 
 impl SandboxFS {
-    /// Creates a new `SandboxFS` instance.
-    fn create(mappings: &[Mapping], ttl: Timespec, cache: ArcCache, xattrs: bool)
-        -> Fallible<SandboxFS> {
-        let ids = IdGenerator::new(fuse::FUSE_ROOT_ID);
+    /// Creates a new `SandboxFS` instance that exposes `mappings` as configured by `options`.
+    ///
+    /// Only the settings of `options` that affect the file system itself are applied here; the
+    /// caller is responsible for the ones that affect how it is mounted and served.
+    fn create(mappings: &[Mapping], options: &MountOptions) -> Fallible<SandboxFS> {
+        let ids = if options.expose_underlying_inodes {
+            warn_if_devices_differ(mappings);
+            IdGenerator::new_exposing_underlying(SYNTHESIZED_INODES_BASE)
+        } else {
+            IdGenerator::new(fuse::FUSE_ROOT_ID + 1)
+        };
+
+        let merged;
+        let mappings = if options.overlay {
+            merged = merge_overlays(mappings)?;
+            &merged[..]
+        } else {
+            mappings
+        };
 
         let mut nodes = HashMap::new();
-        let root = create_root(mappings, &ids, cache.as_ref())?;
+        let root = create_root(mappings, &ids, options.cache.as_ref(),
+            options.allowed_targets.as_ref().map(Vec::as_slice))?;
         assert_eq!(fuse::FUSE_ROOT_ID, root.inode());
         nodes.insert(root.inode(), root);
 
+        let statfs_path = match mappings.get(0) {
+            Some(mapping) if mapping.is_root() => match &mapping.target {
+                nodes::MappingTarget::Path { underlying_path, .. } => Some(underlying_path.clone()),
+                nodes::MappingTarget::CopyOnWrite { underlying_path, .. } => {
+                    Some(underlying_path.clone())
+                },
+                nodes::MappingTarget::Memory { .. } => None,
+                nodes::MappingTarget::Overlay { layers, .. } => layers.last().cloned(),
+            },
+            _ => None,
+        };
+
         Ok(SandboxFS {
             ids: Arc::from(ids),
-            nodes: Arc::from(Mutex::from(nodes)),
+            nodes: Arc::from(RwLock::from(nodes)),
+            lookups: HashMap::new(),
             handles: Arc::from(Mutex::from(HashMap::new())),
-            cache: cache,
-            ttl: ttl,
-            xattrs: xattrs,
+            cache: options.cache.clone(),
+            ttl: options.ttl,
+            negative_ttl: options.negative_ttl,
+            xattrs: options.xattrs,
+            statfs_path: statfs_path,
+            owner: if options.owner_and_root_only { Some(unistd::getuid()) } else { None },
+            forced_owner: options.forced_owner,
+            draining: Arc::from(AtomicBool::new(false)),
+            max_open_files: options.max_open_files,
+            allowed_targets: options.allowed_targets.clone().map(Arc::from),
+            metrics: Arc::from(metrics::Metrics::default()),
+            request_filter: None,
+            slow_op_threshold: None,
+            audit_log: None,
+            reads: None,
+            tracer: None,
+            reconfig_lock: Arc::from(RwLock::from(())),
         })
     }
 
+    /// Creates a new instance that shares all of its state with this one, for use in a new mount
+    /// attempt after a failed one consumed the previous instance.
+    ///
+    /// This must only be called before the file system is mounted: the references that the kernel
+    /// holds on the nodes are not shared.
+    fn clone_for_mount(&self) -> SandboxFS {
+        debug_assert!(self.lookups.is_empty(), "Cannot clone a file system once mounted");
+        SandboxFS {
+            ids: self.ids.clone(),
+            nodes: self.nodes.clone(),
+            lookups: HashMap::new(),
+            handles: self.handles.clone(),
+            cache: self.cache.clone(),
+            ttl: self.ttl,
+            negative_ttl: self.negative_ttl,
+            xattrs: self.xattrs,
+            statfs_path: self.statfs_path.clone(),
+            owner: self.owner,
+            forced_owner: self.forced_owner,
+            draining: self.draining.clone(),
+            max_open_files: self.max_open_files,
+            allowed_targets: self.allowed_targets.clone(),
+            metrics: self.metrics.clone(),
+            request_filter: self.request_filter.clone(),
+            slow_op_threshold: self.slow_op_threshold,
+            audit_log: self.audit_log.clone(),
+            reads: self.reads.clone(),
+            tracer: self.tracer.clone(),
+            reconfig_lock: self.reconfig_lock.clone(),
+        }
+    }
+
     /// Creates a reconfigurable view of this file system, to safely pass across threads.
     fn reconfigurable(&mut self) -> ReconfigurableSandboxFS {
         ReconfigurableSandboxFS {
@@ -281,30 +1122,355 @@ impl SandboxFS {
             ids: self.ids.clone(),
             nodes: self.nodes.clone(),
             cache: self.cache.clone(),
+            allowed_targets: self.allowed_targets.clone(),
+            metrics: self.metrics.clone(),
+            reads: self.reads.clone(),
+            reconfig_lock: self.reconfig_lock.clone(),
         }
     }
 
-    /// Gets a node given its `inode`.
-    fn find_node(&mut self, inode: u64) -> nodes::NodeResult<nodes::ArcNode> {
-        let nodes = self.nodes.lock().unwrap();
-        match nodes.get(&inode) {
-            Some(node) => Ok(node.clone()),
-            None => Err(KernelError::from_errno(Errno::ENOENT)),
+    /// Checks whether the file system can serve `req`.
+    ///
+    /// Requests are rejected with `EPERM` if the user that issued them is not allowed to access the
+    /// file system, and with `EIO` if the file system is shutting down.
+    fn check_request(&self, req: &fuse::Request) -> nodes::NodeResult<()> {
+        if let Some(owner) = self.owner {
+            let uid = nix_uid(req);
+            if !uid.is_root() && uid != owner {
+                return Err(KernelError::from_errno(Errno::EPERM));
+            }
+        }
+        if self.draining.load(Ordering::SeqCst) {
+            return Err(KernelError::from_errno(Errno::EIO));
         }
+        Ok(())
     }
 
-    /// Gets a node given its `inode` and ensures it is writable.
-    fn find_writable_node(&mut self, inode: u64) -> nodes::NodeResult<nodes::ArcNode> {
-        let node = self.find_node(inode)?;
-        if !node.writable() {
-            Err(KernelError::from_errno(Errno::EPERM))
-        } else {
-            Ok(node.clone())
+    /// Returns a function that samples the metrics that are derived from the file system state.
+    fn gauges(&self) -> impl Fn() -> metrics::Gauges + Send + 'static {
+        let nodes = self.nodes.clone();
+        let handles = self.handles.clone();
+        let root = nodes.read().unwrap().get(&fuse::FUSE_ROOT_ID).cloned()
+            .expect("Root node must always exist");
+        move || {
+            let mut mappings = vec!();
+            root.list_mappings(Path::new("/"), &mut mappings);
+            metrics::Gauges {
+                nodes: nodes.read().unwrap().len(),
+                handles: handles.lock().unwrap().len(),
+                open_fds: nodes::open_fds(),
+                peak_open_fds: nodes::peak_fds(),
+                mappings,
+            }
         }
     }
 
-    /// Gets a handle given its identifier.
-    ///
+    /// Returns a function that renders, as a JSON object, the configuration of the file system
+    /// mounted at `mount_point` with the FUSE `options` along with its current mappings.
+    fn config(&self, mount_point: &Path, options: &[&OsStr])
+        -> impl Fn() -> String + Send + 'static {
+        let root = self.nodes.read().unwrap().get(&fuse::FUSE_ROOT_ID).cloned()
+            .expect("Root node must always exist");
+        let mount_point = mount_point.to_owned();
+        let options = options.iter()
+            .filter(|option| **option != "-o")
+            .map(|option| option.to_string_lossy().into_owned())
+            .collect::<Vec<String>>();
+        let allow = if self.owner.is_some() || options.iter().any(|o| o == "allow_root") {
+            "root"
+        } else if options.iter().any(|o| o == "allow_other") {
+            "other"
+        } else {
+            "self"
+        };
+        let ttl_seconds = self.ttl.sec;
+        let negative_ttl_seconds = self.negative_ttl.sec;
+        move || {
+            let mut mappings = vec!();
+            root.list_mappings(Path::new("/"), &mut mappings);
+            let config = reconfig::JsonMountConfig {
+                mount_point: mount_point.clone(),
+                options: options.clone(),
+                allow,
+                ttl_seconds,
+                negative_ttl_seconds,
+                mappings: reconfig::active_mappings(mappings),
+            };
+            let mut out = serde_json::to_string(&config).expect("Serializing config cannot fail");
+            out.push('\n');
+            out
+        }
+    }
+
+    /// Returns a function that writes snapshots of the profiles that support them, which is only
+    /// the execution trace, and that returns the HTTP status and the paths of the new files.
+    fn snapshot(&self) -> impl Fn() -> (&'static str, String) + Send + 'static {
+        let tracer = self.tracer.clone();
+        move || {
+            let tracer = match tracer {
+                Some(ref tracer) => tracer,
+                None => {
+                    let message = "Only the execution trace supports snapshots; see \
+                        --trace_profile\n";
+                    return ("409 Conflict", message.to_owned());
+                },
+            };
+            match tracer.snapshot() {
+                Ok(Some(path)) => ("200 OK", format!("{}\n", path.display())),
+                Ok(None) => {
+                    let message = "The execution trace has already been written\n";
+                    ("409 Conflict", message.to_owned())
+                },
+                Err(e) => {
+                    warn!("Failed to write execution trace snapshot: {}", e);
+                    ("500 Internal Server Error", format!("Failed to write snapshot: {}\n", e))
+                },
+            }
+        }
+    }
+
+    /// Returns a function that checks whether the file system is able to serve requests by getting
+    /// the attributes of the root directory through the in-memory tree.
+    fn self_check(&self) -> impl Fn() -> Result<(), String> + Send + 'static {
+        let nodes = self.nodes.clone();
+        let draining = self.draining.clone();
+        move || {
+            if draining.load(Ordering::SeqCst) {
+                return Err("Draining before unmount".to_owned());
+            }
+            let root = nodes.read().unwrap().get(&fuse::FUSE_ROOT_ID).cloned()
+                .ok_or_else(|| "Root node does not exist".to_owned())?;
+            root.getattr()
+                .map(|_| ())
+                .map_err(|e| format!("Cannot get attributes of root: {}", e))
+        }
+    }
+
+    /// Returns a function that stops the file system from accepting new requests and then waits
+    /// for up to `timeout` for all open handles to be released.
+    ///
+    /// Writes are passed through to the underlying files as they come, so there is no buffered
+    /// data to flush from the handles that remain open once the timeout expires.
+    fn drainer(&self, timeout: Duration) -> impl FnOnce() + Send + 'static {
+        let draining = self.draining.clone();
+        let handles = self.handles.clone();
+        move || {
+            if timeout == Duration::from_secs(0) {
+                return;
+            }
+            draining.store(true, Ordering::SeqCst);
+
+            let deadline = Instant::now() + timeout;
+            loop {
+                let open = handles.lock().unwrap().len();
+                if open == 0 {
+                    info!("All open handles released; proceeding to unmount");
+                    break;
+                }
+                if Instant::now() >= deadline {
+                    warn!("{} handles still open after {:?}; forcing unmount", open, timeout);
+                    break;
+                }
+                thread::sleep(Duration::from_millis(10));
+            }
+        }
+    }
+
+    /// Computes the path of `inode` within the file system from the names through which the
+    /// kernel last reached it and its parents.
+    ///
+    /// Returns none if the path cannot be determined, which happens for inodes that the kernel
+    /// reached through a name that was later removed from the tree.
+    fn path_of(&self, inode: u64) -> Option<PathBuf> {
+        let mut names = vec!();
+        let mut inode = inode;
+        while inode != fuse::FUSE_ROOT_ID {
+            let (parent, name) = self.lookups.get(&inode)?.names.last()?;
+            if names.len() > self.lookups.len() {
+                return None;  // Cycle through stale names of renamed directories.
+            }
+            names.push(name);
+            inode = *parent;
+        }
+        let mut path = PathBuf::from("/");
+        path.extend(names.iter().rev());
+        Some(path)
+    }
+
+    /// Computes the path within the file system of the entry `name` within `inode`, or of `inode`
+    /// itself if there is no name.  See `path_of` for details.
+    fn path_within(&self, inode: u64, name: Option<&OsStr>) -> Option<PathBuf> {
+        self.path_of(inode).map(|path| match name {
+            Some(name) => path.join(name),
+            None => path,
+        })
+    }
+
+    /// Computes the underlying path of the entry `name` within `inode`, or of `inode` itself if
+    /// there is no name.
+    ///
+    /// Returns none if `inode` is unknown or if it is not backed by an underlying file.
+    fn underlying_path_within(&self, inode: u64, name: Option<&OsStr>) -> Option<PathBuf> {
+        let node = self.nodes.read().unwrap().get(&inode).cloned()?;
+        let path = node.underlying_path()?;
+        Some(match name {
+            Some(name) => path.join(name),
+            None => path,
+        })
+    }
+
+    /// Records a call to `op` on `inode`, or on the entry `name` within it, and returns the guard
+    /// that tracks the operation as in flight, that adds it to the execution trace and that logs it
+    /// if it turns out to be slow.
+    ///
+    /// The details needed to log a slow operation are only gathered if such logging is enabled.
+    fn start_op(&self, op: metrics::Op, inode: u64, name: Option<&OsStr>) -> metrics::InFlight {
+        let mut in_flight = metrics::start_op(&self.metrics, op);
+        if let Some(ref tracer) = self.tracer {
+            in_flight.trace_to(tracer.clone());
+        }
+        if let Some(threshold) = self.slow_op_threshold {
+            let path = self.path_within(inode, name);
+            let node = self.nodes.read().unwrap().get(&inode).cloned();
+            let name = name.map(OsStr::to_os_string);
+            let underlying_path = Box::new(move || {
+                let path = node.as_ref()?.underlying_path()?;
+                Some(match name {
+                    Some(ref name) => path.join(name),
+                    None => path,
+                })
+            });
+            in_flight.log_if_slower(threshold, metrics::SlowOpDetails { path, underlying_path });
+        }
+        in_flight
+    }
+
+    /// Traces the request for `op` on `inode`, or on the entry `name` within it, if there are
+    /// request filters and the request passes them.
+    fn trace_request(&self, op: metrics::Op, inode: u64, name: Option<&OsStr>) {
+        let filter = match self.request_filter {
+            Some(ref filter) => filter,
+            None => return,
+        };
+        if !log_enabled!(log::Level::Debug) || !filter.matches_op(op) {
+            return;
+        }
+        let path = self.path_within(inode, name);
+        if filter.matches_path(path.as_ref().map(PathBuf::as_path)) {
+            match path {
+                Some(path) => debug!("{} {} (inode {})", op.name(), path.display(), inode),
+                None => debug!("{} <unknown path> (inode {})", op.name(), inode),
+            }
+        }
+    }
+
+    /// Creates the audit log event for a call to `op` by `req` on `inode`, or on the entry `name`
+    /// within it, that returned `errno` (or 0 if it succeeded).
+    fn audit_event(&self, req: &fuse::Request, op: metrics::Op, inode: u64, name: Option<&OsStr>,
+        errno: i32) -> audit::Event {
+        let path = self.path_within(inode, name);
+        let underlying_path = self.underlying_path_within(inode, name);
+        audit::Event::new(op, req.uid(), req.gid(), req.pid(), path.as_ref().map(PathBuf::as_path),
+            underlying_path.as_ref().map(PathBuf::as_path), errno)
+    }
+
+    /// Records the call to the modifying operation `op` by `req` on `inode`, or on the entry
+    /// `name` within it, which returned `result`, if there is an audit log.  `details` can add
+    /// operation-specific fields to the event, and is only called if the event is recorded.
+    fn audit<T, F>(&self, req: &fuse::Request, op: metrics::Op, inode: u64, name: Option<&OsStr>,
+        result: &nodes::NodeResult<T>, details: F) where F: FnOnce(&mut audit::Event) {
+        if let Some(ref audit_log) = self.audit_log {
+            let errno = result.as_ref().err().map_or(0, KernelError::errno_as_i32);
+            let mut event = self.audit_event(req, op, inode, name, errno);
+            details(&mut event);
+            audit_log.record(event);
+        }
+    }
+
+    /// Records that `inode` was read, if read tracking is enabled.
+    ///
+    /// Only the first read of a node since the reads were last taken has to compute its path, so
+    /// this is cheap for the repeated reads of a file.
+    fn track_read(&self, inode: u64) {
+        let reads = match self.reads {
+            Some(ref reads) => reads,
+            None => return,
+        };
+        let node = match self.nodes.read().unwrap().get(&inode) {
+            Some(node) => node.clone(),
+            None => return,
+        };
+        if node.mark_read(reads.generation()) {
+            if let Some(path) = self.path_of(inode) {
+                reads.record(path);
+            }
+        }
+    }
+
+    /// Gets a node given its `inode`.
+    ///
+    /// If a reconfiguration dropped the node while the kernel still referenced it, as happens to
+    /// the working directory of a process when its mapping is replaced, the node is looked up again
+    /// so that the inode keeps working if the same file was mapped again.
+    fn find_node(&mut self, inode: u64) -> nodes::NodeResult<nodes::ArcNode> {
+        if let Some(node) = self.nodes.read().unwrap().get(&inode) {
+            return Ok(node.clone());
+        }
+        self.resolve_node(inode, &mut vec!()).ok_or_else(
+            || KernelError::from_errno(Errno::ENOENT))
+    }
+
+    /// Finds the node that now holds `inode` by looking up the names through which the kernel
+    /// reached it again, and registers it as the node for that number.
+    ///
+    /// Returns none if none of these names lead to a node with the same number, which is the case
+    /// when the file is not mapped any longer.  `visited` tracks the inodes being resolved to cut
+    /// cycles through stale names of renamed directories.
+    fn resolve_node(&mut self, inode: u64, visited: &mut Vec<u64>) -> Option<nodes::ArcNode> {
+        if let Some(node) = self.nodes.read().unwrap().get(&inode) {
+            return Some(node.clone());
+        }
+        if visited.contains(&inode) {
+            return None;
+        }
+        visited.push(inode);
+
+        let names = self.lookups.get(&inode)?.names.clone();
+        for (parent, name) in names {
+            let dir_node = match self.resolve_node(parent, visited) {
+                Some(dir_node) => dir_node,
+                None => continue,
+            };
+            if let Ok((node, _attr)) = dir_node.lookup(&name, &self.ids, self.cache.as_ref()) {
+                if node.inode() == inode {
+                    debug!("Resolved inode {} again as {:?} after a reconfiguration", inode, name);
+                    self.nodes.write().unwrap().insert(inode, node.clone());
+                    return Some(node);
+                }
+            }
+        }
+        None
+    }
+
+    /// Gets a node given its `inode` and ensures it is writable.
+    fn find_writable_node(&mut self, inode: u64) -> nodes::NodeResult<nodes::ArcNode> {
+        let node = self.find_node(inode)?;
+        if !node.writable() {
+            // Scaffold directories are not part of any mapping so there is no file system to be
+            // read-only: refuse to modify them as we do with any other operation that we cannot
+            // support.  Everything else belongs to a read-only mapping or to an overlay whose
+            // topmost layer is read-only, both of which behave as a read-only file system.
+            if node.is_scaffold() {
+                return Err(KernelError::from_errno(Errno::EPERM));
+            }
+            Err(KernelError::from_errno(Errno::EROFS))
+        } else {
+            Ok(node.clone())
+        }
+    }
+
+    /// Gets a handle given its identifier.
+    ///
     /// We assume that the identifier is valid and that we have a known handle for it; otherwise,
     /// we crash.  The rationale for this is that this function is always called on handles
     /// requested by the kernel, and we can trust that the kernel will only ever ask us for handles
@@ -317,54 +1483,162 @@ impl SandboxFS {
     /// Tracks a new file handle and assigns an identifier to it.
     fn insert_handle(&mut self, handle: nodes::ArcHandle) -> u64 {
         let fh = self.ids.next();
-        let mut handles = self.handles.lock().unwrap();
-        debug_assert!(!handles.contains_key(&fh));
-        handles.insert(fh, handle);
+        {
+            let mut handles = self.handles.lock().unwrap();
+            debug_assert!(!handles.contains_key(&fh));
+            handles.insert(fh, handle);
+        }
+        self.limit_open_files();
         fh
     }
 
-    /// Tracks a node, which may already be known.
-    fn insert_node(&mut self, node: nodes::ArcNode) {
-        let mut nodes = self.nodes.lock().unwrap();
+    /// Closes the descriptors of idle handles if there are too many underlying files open.
+    ///
+    /// This must be called after every operation that may open underlying files on behalf of a
+    /// handle, which includes reopening those that were closed while idle.
+    fn limit_open_files(&self) {
+        if let Some(max_open_files) = self.max_open_files {
+            let open = nodes::open_fds();
+            if open >= max_open_files {
+                close_idle_handles(&self.handles.lock().unwrap(), open, max_open_files);
+            }
+        }
+    }
+
+    /// Tracks a node, which may already be known, that the kernel reached via the entry `name` of
+    /// the directory `parent`, whose mapping settings are `settings`.
+    ///
+    /// Every call accounts for one lookup that the kernel will later release via `forget`.
+    fn insert_node(&mut self, parent: u64, name: &OsStr, node: nodes::ArcNode,
+        settings: MappingSettings) {
+        let lookups = self.lookups.entry(node.inode()).or_insert_with(Lookups::default);
+        lookups.count += 1;
+        if !lookups.names.iter().any(|(p, n)| *p == parent && n == name) {
+            lookups.names.push((parent, name.to_os_string()));
+        }
+        lookups.settings = settings;
+
+        let mut nodes = self.nodes.write().unwrap();
         nodes.entry(node.inode()).or_insert(node);
     }
 
+    /// Prepares the attributes `attr` of a node subject to the mapping `settings` for their
+    /// return to `req`.
+    fn present_attr(&self, req: &fuse::Request, settings: MappingSettings, attr: fuse::FileAttr)
+        -> fuse::FileAttr {
+        let mut attr = unsquash_attr(req, settings.squash, attr);
+        // Directories must remain searchable or nothing within them would be reachable.
+        if settings.noexec && attr.kind != fuse::FileType::Directory {
+            attr.perm &= !0o111;
+        }
+        if let Some(perm_mask) = settings.perm_mask {
+            attr.perm &= perm_mask as u16;
+        }
+        if let Some(uid) = self.forced_owner.0 {
+            attr.uid = uid;
+        }
+        if let Some(gid) = self.forced_owner.1 {
+            attr.gid = gid;
+        }
+        attr
+    }
+
+    /// Returns the mapping settings that apply to `node`.
+    ///
+    /// Directories know the mapping they belong to but files do not, so the settings of the latter
+    /// come from the directory through which the kernel reached them.
+    fn settings_of(&self, node: &nodes::ArcNode) -> MappingSettings {
+        let looked_up = self.lookups.get(&node.inode()).map(|l| l.settings).unwrap_or_default();
+        MappingSettings {
+            squash: node.squash().or(looked_up.squash),
+            noexec: node.noexec() || looked_up.noexec,
+            perm_mask: node.perm_mask().or(looked_up.perm_mask),
+        }
+    }
+
     /// Same as `create` but leaves the handling of the `fuse::Reply` to the caller.
     fn create2(&mut self, req: &fuse::Request, parent: u64, name: &OsStr, mode: u32, flags: u32)
         -> nodes::NodeResult<(fuse::FileAttr, u64)> {
         let dir_node = self.find_writable_node(parent)?;
+        let settings = MappingSettings::of_dir(&dir_node);
+        let (uid, gid) = squashed_owner(req, settings.squash);
         let (node, handle, attr) = dir_node.create(
-            name, nix_uid(req), nix_gid(req), mode, flags, &self.ids, self.cache.as_ref())?;
-        self.insert_node(node);
+            name, uid, gid, mode, flags, &self.ids, self.cache.as_ref())?;
+        self.insert_node(parent, name, node, settings);
         let fh = self.insert_handle(handle);
-        Ok((attr, fh))
+        Ok((self.present_attr(req, settings, attr), fh))
+    }
+
+    /// Same as `forget` but without the bookkeeping of metrics.
+    ///
+    /// Once the kernel has forgotten about all lookups of `inode`, the node stops being tracked
+    /// and is dropped from the directories it was reached through.  Nodes that cannot be dropped
+    /// from their directories, such as explicit mappings, remain alive but are no longer tracked
+    /// until the kernel looks them up again.
+    fn forget2(&mut self, inode: u64, nlookup: u64) {
+        if inode == fuse::FUSE_ROOT_ID {
+            return;
+        }
+
+        match self.lookups.get_mut(&inode) {
+            Some(lookups) => {
+                lookups.count = lookups.count.saturating_sub(nlookup);
+                if lookups.count > 0 {
+                    return;
+                }
+            },
+            None => {
+                warn!("Kernel forgot about unknown inode {}", inode);
+                return;
+            },
+        }
+        let names = self.lookups.remove(&inode).unwrap().names;
+
+        // The node may be missing if a reconfiguration unmapped it while the kernel still knew
+        // about it.  In that case, the inode number may have been reassigned to another node that
+        // the kernel has not reached yet, and that we may drop here as well without harm.
+        let node = match self.nodes.write().unwrap().remove(&inode) {
+            Some(node) => node,
+            None => return,
+        };
+
+        let mut dropped = false;
+        for (parent, name) in names {
+            if let Ok(dir_node) = self.find_node(parent) {
+                dropped |= dir_node.forget_child(&name, inode, self.cache.as_ref());
+            }
+        }
+        if dropped && Arc::strong_count(&node) == 1 {
+            self.ids.release_inode(inode);
+        }
     }
 
     /// Same as `getattr` but leaves the handling of the `fuse::Reply` to the caller.
-    fn getattr2(&mut self, inode: u64) -> nodes::NodeResult<fuse::FileAttr> {
+    fn getattr2(&mut self, req: &fuse::Request, inode: u64) -> nodes::NodeResult<fuse::FileAttr> {
         let node = self.find_node(inode)?;
-        node.getattr()
+        let attr = node.getattr()?;
+        Ok(self.present_attr(req, self.settings_of(&node), attr))
     }
 
     /// Same as `lookup` but leaves the handling of the `fuse::Reply` to the caller.
-    fn lookup2(&mut self, parent: u64, name: &OsStr) -> nodes::NodeResult<fuse::FileAttr> {
+    fn lookup2(&mut self, req: &fuse::Request, parent: u64, name: &OsStr)
+        -> nodes::NodeResult<fuse::FileAttr> {
         let dir_node = self.find_node(parent)?;
         let (node, attr) = dir_node.lookup(name, &self.ids, self.cache.as_ref())?;
-        let mut nodes = self.nodes.lock().unwrap();
-        if !nodes.contains_key(&node.inode()) {
-            nodes.insert(node.inode(), node);
-        }
-        Ok(attr)
+        let settings = MappingSettings::of_entry(&dir_node, name);
+        self.insert_node(parent, name, node, settings);
+        Ok(self.present_attr(req, settings, attr))
     }
 
     /// Same as `mkdir` but leaves the handling of the `fuse::Reply` to the caller.
     fn mkdir2(&mut self, req: &fuse::Request, parent: u64, name: &OsStr, mode: u32)
         -> nodes::NodeResult<fuse::FileAttr> {
         let dir_node = self.find_writable_node(parent)?;
-        let (node, attr) = dir_node.mkdir(
-            name, nix_uid(req), nix_gid(req), mode, &self.ids, self.cache.as_ref())?;
-        self.insert_node(node);
-        Ok(attr)
+        let settings = MappingSettings::of_dir(&dir_node);
+        let (uid, gid) = squashed_owner(req, settings.squash);
+        let (node, attr) = dir_node.mkdir(name, uid, gid, mode, &self.ids, self.cache.as_ref())?;
+        self.insert_node(parent, name, node, settings);
+        Ok(self.present_attr(req, settings, attr))
     }
 
     /// Same as `mknod` but leaves the handling of the `fuse::Reply` to the caller.
@@ -372,15 +1646,20 @@ impl SandboxFS {
         -> nodes::NodeResult<fuse::FileAttr> {
         let dir_node = self.find_writable_node(parent)?;
 
+        let settings = MappingSettings::of_dir(&dir_node);
+        let (uid, gid) = squashed_owner(req, settings.squash);
         let (node, attr) = dir_node.mknod(
-            name, nix_uid(req), nix_gid(req), mode, rdev, &self.ids, self.cache.as_ref())?;
-        self.insert_node(node);
-        Ok(attr)
+            name, uid, gid, mode, rdev, &self.ids, self.cache.as_ref())?;
+        self.insert_node(parent, name, node, settings);
+        Ok(self.present_attr(req, settings, attr))
     }
 
     /// Same as `open` and `opendir` but leaves the handling of the `fuse::Reply` to the caller.
     fn open2(&mut self, inode: u64, flags: u32) -> nodes::NodeResult<u64> {
         let node = self.find_node(inode)?;
+        if flags & OPEN_FOR_EXEC != 0 && self.settings_of(&node).noexec {
+            return Err(KernelError::from_errno(Errno::EACCES));
+        }
         let handle = node.open(flags)?;
         Ok(self.insert_handle(handle))
     }
@@ -401,10 +1680,16 @@ impl SandboxFS {
     /// Same as `rename` but leaves the handling of the `fuse::Reply` to the caller.
     fn rename2(&mut self, parent: u64, name: &OsStr, new_parent: u64, new_name: &OsStr)
         -> nodes::NodeResult<()> {
-        let dir_node = self.find_writable_node(parent)?;
         if parent == new_parent {
+            let dir_node = self.find_writable_node(parent)?;
             dir_node.rename(name, new_name, self.cache.as_ref())
         } else {
+            // Check for moves across mappings before checking for writability so that callers
+            // fall back to copying entries out of read-only mappings too.
+            if self.find_node(parent)?.mapping_id() != self.find_node(new_parent)?.mapping_id() {
+                return Err(KernelError::from_errno(Errno::EXDEV));
+            }
+            let dir_node = self.find_writable_node(parent)?;
             let new_dir_node = self.find_writable_node(new_parent)?;
             dir_node.rename_and_move_source(name, new_dir_node, new_name, self.cache.as_ref())
         }
@@ -418,29 +1703,51 @@ impl SandboxFS {
 
     /// Same as `setattr` but leaves the handling of the `fuse::Reply` to the caller.
     #[allow(clippy::too_many_arguments)]
-    fn setattr2(&mut self, inode: u64, mode: Option<u32>, uid: Option<u32>,
-        gid: Option<u32>, size: Option<u64>, atime: Option<Timespec>, mtime: Option<Timespec>)
-        -> nodes::NodeResult<fuse::FileAttr> {
+    fn setattr2(&mut self, req: &fuse::Request, inode: u64, mode: Option<u32>, uid: Option<u32>,
+        gid: Option<u32>, size: Option<u64>, atime: Option<Timespec>, mtime: Option<Timespec>,
+        fh: Option<u64>) -> nodes::NodeResult<fuse::FileAttr> {
         let node = self.find_writable_node(inode)?;
+        let uid = forced_chown(self.forced_owner.0, uid)?;
+        let gid = forced_chown(self.forced_owner.1, gid)?;
+        let settings = self.settings_of(&node);
+        let (uid, gid) = match settings.squash {
+            Some(squash) => (squash_chown(squash.uid, uid, req.uid(), squash.strict)?,
+                squash_chown(squash.gid, gid, req.gid(), squash.strict)?),
+            None => (uid, gid),
+        };
         let values = nodes::AttrDelta {
             mode: mode.map(|m| sys::stat::Mode::from_bits_truncate(m as sys::stat::mode_t)),
             uid: uid.map(unistd::Uid::from_raw),
             gid: gid.map(unistd::Gid::from_raw),
-            atime: atime.map(nodes::conv::timespec_to_timeval),
-            mtime: mtime.map(nodes::conv::timespec_to_timeval),
+            atime: atime,
+            mtime: mtime,
             size: size,
+            handle: fh.map(|fh| self.find_handle(fh)),
         };
-        node.setattr(&values)
+        let attr = node.setattr(&values)?;
+        Ok(self.present_attr(req, settings, attr))
+    }
+
+    /// Same as `statfs` but leaves the handling of the `fuse::Reply` to the caller.
+    ///
+    /// Returns None if the root directory is not backed by an underlying file system.
+    fn statfs2(&mut self) -> nodes::NodeResult<Option<sys::statvfs::Statvfs>> {
+        match &self.statfs_path {
+            Some(path) => Ok(Some(sys::statvfs::statvfs(path.as_path())?)),
+            None => Ok(None),
+        }
     }
 
     /// Same as `symlink` but leaves the handling of the `fuse::Reply` to the caller.
     fn symlink2(&mut self, req: &fuse::Request, parent: u64, name: &OsStr, link: &Path)
         -> nodes::NodeResult<fuse::FileAttr> {
         let dir_node = self.find_writable_node(parent)?;
+        let settings = MappingSettings::of_dir(&dir_node);
+        let (uid, gid) = squashed_owner(req, settings.squash);
         let (node, attr) = dir_node.symlink(
-            name, link, nix_uid(req), nix_gid(req), &self.ids, self.cache.as_ref())?;
-        self.insert_node(node);
-        Ok(attr)
+            name, link, uid, gid, &self.ids, self.cache.as_ref())?;
+        self.insert_node(parent, name, node, settings);
+        Ok(self.present_attr(req, settings, attr))
     }
 
     /// Same as `unlink` but leaves the handling of the `fuse::Reply` to the caller.
@@ -489,11 +1796,59 @@ impl SandboxFS {
     }
 }
 
+/// Closes the underlying descriptors of the least recently used idle `handles` given that there
+/// are `open` descriptors and that this reached `max_open_files`.
+///
+/// Only handles that can transparently reopen their files take part in this, so the number of
+/// open descriptors may remain over the limit if most of them belong to writable handles.
+fn close_idle_handles(handles: &HashMap<u64, nodes::ArcHandle>, open: usize,
+    max_open_files: usize) {
+    // Close more descriptors than strictly necessary so that we do not have to scan all handles
+    // again on every open that follows.
+    let target = max_open_files - max_open_files / 4;
+    let mut idle = handles.values()
+        .filter_map(|handle| handle.idle_since().map(|since| (since, handle)))
+        .collect::<Vec<_>>();
+    idle.sort_by_key(|(since, _)| *since);
+    let closed = idle.iter()
+        .take(open - target)
+        .filter(|(_, handle)| handle.close_idle())
+        .count();
+    debug!("Closed {} idle file descriptors out of {} open; limit is {}", closed, open,
+        max_open_files);
+}
+
+/// Returns the attributes to reply with when telling the kernel that an entry does not exist.
+///
+/// Only the inode number, which must be 0, matters to the kernel.
+fn negative_entry_attr() -> fuse::FileAttr {
+    let epoch = Timespec::new(0, 0);
+    fuse::FileAttr {
+        ino: 0,
+        kind: fuse::FileType::RegularFile,
+        nlink: 0,
+        size: 0,
+        blocks: 0,
+        atime: epoch,
+        mtime: epoch,
+        ctime: epoch,
+        crtime: epoch,
+        perm: 0,
+        uid: 0,
+        gid: 0,
+        rdev: 0,
+        flags: 0,
+    }
+}
+
 /// Creates a file `path` with the given `uid`/`gid` pair.
 ///
 /// The file is created via the `create` lambda, which can create any type of file it wishes.  The
 /// `delete` lambda should match this creation and allow the deletion of the file, and this is used
 /// as a cleanup function when the ownership cannot be successfully changed.
+///
+/// Once privileges have been dropped, the ownership is left untouched: the file belongs to the
+/// user we switched to, as changing it to anyone else would fail anyway.
 fn create_as<T, E: From<Errno> + fmt::Display, P: AsRef<Path>>(
     path: &P, uid: unistd::Uid, gid: unistd::Gid,
     create: impl Fn(&P) -> Result<T, E>,
@@ -502,8 +1857,11 @@ fn create_as<T, E: From<Errno> + fmt::Display, P: AsRef<Path>>(
 
     let result = create(path)?;
 
-    unistd::fchownat(
-        None, path.as_ref(), Some(uid), Some(gid), unistd::FchownatFlags::NoFollowSymlink)
+    if privileges::dropped() {
+        return Ok(result);
+    }
+
+    nodes::confine::lchown(path.as_ref(), Some(uid), Some(gid))
         .map_err(|e| {
             let chown_errno = match e {
                 nix::Error::Sys(chown_errno) => chown_errno,
@@ -525,6 +1883,68 @@ fn create_as<T, E: From<Errno> + fmt::Display, P: AsRef<Path>>(
     Ok(result)
 }
 
+/// Returns the owner to give to a file created by `req` within a mapping squashed by `squash`.
+fn squashed_owner(req: &fuse::Request, squash: Option<nodes::Squash>)
+    -> (unistd::Uid, unistd::Gid) {
+    match squash {
+        Some(squash) => (
+            squash.uid.map_or_else(|| nix_uid(req), unistd::Uid::from_raw),
+            squash.gid.map_or_else(|| nix_gid(req), unistd::Gid::from_raw)),
+        None => (nix_uid(req), nix_gid(req)),
+    }
+}
+
+/// Replaces the squashed identity in `attr` with the identity of the caller in `req`, so that
+/// callers see the files they create within squashed mappings as their own.
+fn unsquash_attr(req: &fuse::Request, squash: Option<nodes::Squash>, mut attr: fuse::FileAttr)
+    -> fuse::FileAttr {
+    if let Some(squash) = squash {
+        if squash.uid == Some(attr.uid) {
+            attr.uid = req.uid();
+        }
+        if squash.gid == Some(attr.gid) {
+            attr.gid = req.gid();
+        }
+    }
+    attr
+}
+
+/// Computes the ownership change to propagate to an underlying file given the user or group `id`
+/// requested by the caller and the `forced` identifier reported for all files, if any.
+///
+/// Changes to the forced identifier have no visible effect and are ignored, while changes to any
+/// other identifier fail with `EPERM` because they could never be observed.
+fn forced_chown(forced: Option<u32>, id: Option<u32>) -> nodes::NodeResult<Option<u32>> {
+    match (forced, id) {
+        (Some(forced), Some(id)) => {
+            if id != forced {
+                return Err(KernelError::from_errno(Errno::EPERM));
+            }
+            Ok(None)
+        },
+        (_, id) => Ok(id),
+    }
+}
+
+/// Computes the ownership change to propagate to an underlying file given the user or group `id`
+/// requested by the `caller` and the `squashed` identifier forced on the file, if any.
+///
+/// Changes are never propagated when the identifier is squashed: changes to the caller's own
+/// identifier or to the squashed one have no visible effect, and changes to any other identifier
+/// are ignored too unless `strict` is set, in which case they fail with `EPERM`.
+fn squash_chown(squashed: Option<u32>, id: Option<u32>, caller: u32, strict: bool)
+    -> nodes::NodeResult<Option<u32>> {
+    match (squashed, id) {
+        (Some(squashed), Some(id)) => {
+            if strict && id != squashed && id != caller {
+                return Err(KernelError::from_errno(Errno::EPERM));
+            }
+            Ok(None)
+        },
+        (_, id) => Ok(id),
+    }
+}
+
 /// Returns a `unistd::Uid` representation of the UID in a `fuse::Request`.
 fn nix_uid(req: &fuse::Request) -> unistd::Uid {
     unistd::Uid::from_raw(req.uid() as u32)
@@ -576,165 +1996,340 @@ fn reply_xattr(size: u32, value: &[u8], reply: fuse::ReplyXattr) {
 impl fuse::Filesystem for SandboxFS {
     fn create(&mut self, req: &fuse::Request, parent: u64, name: &OsStr, mode: u32, flags: u32,
         reply: fuse::ReplyCreate) {
-        match self.create2(req, parent, name, mode, flags) {
+        check_request!(self, metrics::Op::Create, req, reply, parent, Some(name));
+        let result = self.create2(req, parent, name, mode, flags);
+        self.audit(req, metrics::Op::Create, parent, Some(name), &result, |_| ());
+        match result {
             Ok((attr, fh)) => reply.created(&self.ttl, &attr, IdGenerator::GENERATION, fh, 0),
-            Err(e) => reply.error(e.errno_as_i32()),
+            Err(e) => reply.error(self.metrics.record_error(&e)),
+        }
+    }
+
+    fn flush(&mut self, _req: &fuse::Request, inode: u64, fh: u64, _lock_owner: u64,
+        reply: fuse::ReplyEmpty) {
+        // Like releases, flushes must go through while draining so that files can be closed.
+        let _in_flight = self.start_op(metrics::Op::Flush, inode, None);
+        self.trace_request(metrics::Op::Flush, inode, None);
+        let handle = self.find_handle(fh);
+        match handle.flush() {
+            Ok(()) => reply.ok(),
+            Err(e) => reply.error(self.metrics.record_error(&e)),
         }
     }
 
-    fn getattr(&mut self, _req: &fuse::Request, inode: u64, reply: fuse::ReplyAttr) {
-        match self.getattr2(inode) {
+    fn forget(&mut self, _req: &fuse::Request, inode: u64, nlookup: u64) {
+        // There is no reply to send, so these requests must be processed even if the file system
+        // is shutting down or if they come from an unauthorized user.
+        let _in_flight = self.start_op(metrics::Op::Forget, inode, None);
+        self.trace_request(metrics::Op::Forget, inode, None);
+        self.forget2(inode, nlookup);
+    }
+
+    fn fsync(&mut self, req: &fuse::Request, inode: u64, fh: u64, datasync: bool,
+        reply: fuse::ReplyEmpty) {
+        check_request!(self, metrics::Op::Fsync, req, reply, inode);
+        let handle = self.find_handle(fh);
+        match handle.fsync(datasync) {
+            Ok(()) => reply.ok(),
+            Err(e) => reply.error(self.metrics.record_error(&e)),
+        }
+    }
+
+    fn fsyncdir(&mut self, req: &fuse::Request, inode: u64, fh: u64, datasync: bool,
+        reply: fuse::ReplyEmpty) {
+        check_request!(self, metrics::Op::Fsyncdir, req, reply, inode);
+        let handle = self.find_handle(fh);
+        match handle.fsync(datasync) {
+            Ok(()) => reply.ok(),
+            Err(e) => reply.error(self.metrics.record_error(&e)),
+        }
+    }
+
+    fn getattr(&mut self, req: &fuse::Request, inode: u64, reply: fuse::ReplyAttr) {
+        check_request!(self, metrics::Op::Getattr, req, reply, inode);
+        match self.getattr2(req, inode) {
             Ok(attr) => reply.attr(&self.ttl, &attr),
-            Err(e) => reply.error(e.errno_as_i32()),
+            Err(e) => reply.error(self.metrics.record_error(&e)),
         }
     }
 
-    fn link(&mut self, _req: &fuse::Request, _inode: u64, _newparent: u64, _newname: &OsStr,
+    fn link(&mut self, req: &fuse::Request, inode: u64, newparent: u64, _newname: &OsStr,
         reply: fuse::ReplyEntry) {
+        check_request!(self, metrics::Op::Link, req, reply, inode);
+        // Report read-only targets as such so that link behaves like all other operations that
+        // modify a read-only mapping.
+        if let Err(e) = self.find_writable_node(newparent) {
+            reply.error(self.metrics.record_error(&e));
+            return;
+        }
         // We don't support hardlinks at this point.
         reply.error(Errno::EPERM as i32);
     }
 
-    fn lookup(&mut self, _req: &fuse::Request, parent: u64, name: &OsStr, reply: fuse::ReplyEntry) {
-        match self.lookup2(parent, name) {
+    fn lookup(&mut self, req: &fuse::Request, parent: u64, name: &OsStr, reply: fuse::ReplyEntry) {
+        check_request!(self, metrics::Op::Lookup, req, reply, parent, Some(name));
+        match self.lookup2(req, parent, name) {
             Ok(attr) => reply.entry(&self.ttl, &attr, IdGenerator::GENERATION),
-            Err(e) => reply.error(e.errno_as_i32()),
+            Err(e) => {
+                let errno = self.metrics.record_error(&e);
+                if errno == Errno::ENOENT as i32 && self.negative_ttl != Timespec::new(0, 0) {
+                    // The kernel caches replies for inode 0 as negative entries.  Entries created
+                    // later on through the mount point replace them, but those that appear in any
+                    // other way, including via reconfigurations, stay hidden until they expire.
+                    reply.entry(&self.negative_ttl, &negative_entry_attr(), 0);
+                } else {
+                    reply.error(errno);
+                }
+            },
         }
     }
 
     fn mkdir(&mut self, req: &fuse::Request, parent: u64, name: &OsStr, mode: u32,
         reply: fuse::ReplyEntry) {
-        match self.mkdir2(req, parent, name, mode) {
+        check_request!(self, metrics::Op::Mkdir, req, reply, parent, Some(name));
+        let result = self.mkdir2(req, parent, name, mode);
+        self.audit(req, metrics::Op::Mkdir, parent, Some(name), &result, |_| ());
+        match result {
             Ok(attr) => reply.entry(&self.ttl, &attr, IdGenerator::GENERATION),
-            Err(e) => reply.error(e.errno_as_i32()),
+            Err(e) => reply.error(self.metrics.record_error(&e)),
         }
     }
 
     fn mknod(&mut self, req: &fuse::Request, parent: u64, name: &OsStr, mode: u32, rdev: u32,
         reply: fuse::ReplyEntry) {
-        match self.mknod2(req, parent, name, mode, rdev) {
+        check_request!(self, metrics::Op::Mknod, req, reply, parent, Some(name));
+        let result = self.mknod2(req, parent, name, mode, rdev);
+        self.audit(req, metrics::Op::Mknod, parent, Some(name), &result, |_| ());
+        match result {
             Ok(attr) => reply.entry(&self.ttl, &attr, IdGenerator::GENERATION),
-            Err(e) => reply.error(e.errno_as_i32()),
+            Err(e) => reply.error(self.metrics.record_error(&e)),
         }
     }
 
-    fn open(&mut self, _req: &fuse::Request, inode: u64, flags: u32, reply: fuse::ReplyOpen) {
+    fn open(&mut self, req: &fuse::Request, inode: u64, flags: u32, reply: fuse::ReplyOpen) {
+        check_request!(self, metrics::Op::Open, req, reply, inode);
         match self.open2(inode, flags) {
-            Ok(fh) => reply.opened(fh, 0),
-            Err(e) => reply.error(e.errno_as_i32()),
+            Ok(fh) => {
+                let oflag = nix::fcntl::OFlag::from_bits_truncate(flags as i32);
+                if !oflag.contains(nix::fcntl::OFlag::O_WRONLY) {
+                    self.track_read(inode);
+                }
+                reply.opened(fh, 0)
+            },
+            Err(e) => reply.error(self.metrics.record_error(&e)),
         }
     }
 
-    fn opendir(&mut self, _req: &fuse::Request, inode: u64, flags: u32, reply: fuse::ReplyOpen) {
+    fn opendir(&mut self, req: &fuse::Request, inode: u64, flags: u32, reply: fuse::ReplyOpen) {
+        check_request!(self, metrics::Op::Opendir, req, reply, inode);
         match self.open2(inode, flags) {
             Ok(fh) => reply.opened(fh, 0),
-            Err(e) => reply.error(e.errno_as_i32()),
+            Err(e) => reply.error(self.metrics.record_error(&e)),
         }
     }
 
-    fn read(&mut self, _req: &fuse::Request, _inode: u64, fh: u64, offset: i64, size: u32,
+    // TODO(jmmv): Reads and writes on underlying files that block (e.g. on a hung NFS server)
+    // cannot be abandoned when the caller is interrupted.  The fuse crate we use answers the
+    // kernel's interrupt requests on its own without telling us and it only hands us one request
+    // at a time, so it would not even read the interrupt until the blocked operation completed.
+    // Honoring interrupts requires asynchronous replies first, and then running the underlying
+    // I/O in a way that can be abandoned without leaving the handle in an inconsistent state.
+    fn read(&mut self, req: &fuse::Request, inode: u64, fh: u64, offset: i64, size: u32,
         reply: fuse::ReplyData) {
+        check_request!(self, metrics::Op::Read, req, reply, inode);
         let handle = self.find_handle(fh);
 
-        match handle.read(offset, size) {
-            Ok(data) => reply.data(&data),
-            Err(e) => reply.error(e.errno_as_i32()),
+        let result = handle.read(offset, size);
+        self.limit_open_files();
+        match result {
+            Ok(data) => {
+                self.metrics.record_read(data.len());
+                self.track_read(inode);
+                reply.data(&data)
+            },
+            Err(e) => reply.error(self.metrics.record_error(&e)),
         }
     }
 
-    fn readdir(&mut self, _req: &fuse::Request, _inode: u64, handle: u64, offset: i64,
+    // TODO(jmmv): Listing a directory with attributes (as `ls -l` does) costs a lookup per entry
+    // after the readdir, even though we already stat every entry while reading the directory.
+    // Linux's readdirplus protocol would let us return those attributes along with the entries,
+    // but the fuse crate we use speaks a protocol version that predates it and does not expose
+    // the operation.  Once it does, replying with an entry must also count as a lookup of that
+    // entry (see `insert_node`) to keep the accounting of forget requests balanced.
+    fn readdir(&mut self, req: &fuse::Request, inode: u64, handle: u64, offset: i64,
                mut reply: fuse::ReplyDirectory) {
+        check_request!(self, metrics::Op::Readdir, req, reply, inode);
         let handle = self.find_handle(handle);
         match handle.readdir(&self.ids, self.cache.as_ref(), offset, &mut reply) {
             Ok(()) => reply.ok(),
-            Err(e) => reply.error(e.errno_as_i32()),
+            Err(e) => reply.error(self.metrics.record_error(&e)),
         }
     }
 
-    fn readlink(&mut self, _req: &fuse::Request, inode: u64, reply: fuse::ReplyData) {
+    fn readlink(&mut self, req: &fuse::Request, inode: u64, reply: fuse::ReplyData) {
+        check_request!(self, metrics::Op::Readlink, req, reply, inode);
         match self.readlink2(inode) {
             Ok(target) => reply.data(target.as_os_str().as_bytes()),
-            Err(e) => reply.error(e.errno_as_i32()),
+            Err(e) => reply.error(self.metrics.record_error(&e)),
         }
     }
 
-    fn release(&mut self, _req: &fuse::Request, _inode: u64, fh: u64, _flags: u32, _lock_owner: u64,
+    fn release(&mut self, _req: &fuse::Request, inode: u64, fh: u64, _flags: u32, _lock_owner: u64,
         _flush: bool, reply: fuse::ReplyEmpty) {
+        let _in_flight = self.start_op(metrics::Op::Release, inode, None);
+        self.trace_request(metrics::Op::Release, inode, None);
+        if let Some(ref audit_log) = self.audit_log {
+            audit_log.finish_writes(fh);
+        }
         self.release2(fh);
         reply.ok();
     }
 
-    fn releasedir(&mut self, _req: &fuse::Request, _inode: u64, fh: u64, _flags: u32,
+    fn releasedir(&mut self, _req: &fuse::Request, inode: u64, fh: u64, _flags: u32,
         reply: fuse::ReplyEmpty) {
+        let _in_flight = self.start_op(metrics::Op::Releasedir, inode, None);
+        self.trace_request(metrics::Op::Releasedir, inode, None);
         self.release2(fh);
         reply.ok();
     }
 
-    fn rename(&mut self, _req: &fuse::Request, parent: u64, name: &OsStr, new_parent: u64,
+    fn rename(&mut self, req: &fuse::Request, parent: u64, name: &OsStr, new_parent: u64,
         new_name: &OsStr, reply: fuse::ReplyEmpty) {
-        match self.rename2(parent, name, new_parent, new_name) {
+        check_request!(self, metrics::Op::Rename, req, reply, parent, Some(name));
+        let result = self.rename2(parent, name, new_parent, new_name);
+        self.audit(req, metrics::Op::Rename, parent, Some(name), &result, |event| {
+            event.new_path = self.path_within(new_parent, Some(new_name))
+                .map(|path| path.to_string_lossy().into_owned());
+            event.new_underlying_path = self.underlying_path_within(new_parent, Some(new_name))
+                .map(|path| path.to_string_lossy().into_owned());
+        });
+        match result {
             Ok(()) => reply.ok(),
-            Err(e) => reply.error(e.errno_as_i32()),
+            Err(e) => reply.error(self.metrics.record_error(&e)),
         }
     }
 
-    fn rmdir(&mut self, _req: &fuse::Request, parent: u64, name: &OsStr, reply: fuse::ReplyEmpty) {
-        match self.rmdir2(parent, name) {
+    fn rmdir(&mut self, req: &fuse::Request, parent: u64, name: &OsStr, reply: fuse::ReplyEmpty) {
+        check_request!(self, metrics::Op::Rmdir, req, reply, parent, Some(name));
+        let result = self.rmdir2(parent, name);
+        self.audit(req, metrics::Op::Rmdir, parent, Some(name), &result, |_| ());
+        match result {
             Ok(()) => reply.ok(),
-            Err(e) => reply.error(e.errno_as_i32()),
+            Err(e) => reply.error(self.metrics.record_error(&e)),
         }
     }
 
-    fn setattr(&mut self, _req: &fuse::Request, inode: u64, mode: Option<u32>, uid: Option<u32>,
+    fn setattr(&mut self, req: &fuse::Request, inode: u64, mode: Option<u32>, uid: Option<u32>,
         gid: Option<u32>, size: Option<u64>, atime: Option<Timespec>, mtime: Option<Timespec>,
-        _fh: Option<u64>, _crtime: Option<Timespec>, _chgtime: Option<Timespec>,
+        fh: Option<u64>, _crtime: Option<Timespec>, _chgtime: Option<Timespec>,
         _bkuptime: Option<Timespec>, _flags: Option<u32>, reply: fuse::ReplyAttr) {
-        match self.setattr2(inode, mode, uid, gid, size, atime, mtime) {
+        check_request!(self, metrics::Op::Setattr, req, reply, inode);
+        let result = self.setattr2(req, inode, mode, uid, gid, size, atime, mtime, fh);
+        self.audit(req, metrics::Op::Setattr, inode, None, &result, |event| {
+            event.attributes = Some(audit::Attributes {
+                mode: mode.map(|mode| format!("{:04o}", mode & 0o7777)),
+                uid,
+                gid,
+                size,
+                atime: atime.map(|atime| atime.sec),
+                mtime: mtime.map(|mtime| mtime.sec),
+            });
+        });
+        match result {
             Ok(attr) => reply.attr(&self.ttl, &attr),
-            Err(e) => reply.error(e.errno_as_i32()),
+            Err(e) => reply.error(self.metrics.record_error(&e)),
+        }
+    }
+
+    fn statfs(&mut self, req: &fuse::Request, inode: u64, reply: fuse::ReplyStatfs) {
+        check_request!(self, metrics::Op::Statfs, req, reply, inode);
+        match self.statfs2() {
+            Ok(Some(stat)) => reply.statfs(
+                stat.blocks() as u64, stat.blocks_free() as u64, stat.blocks_available() as u64,
+                stat.files() as u64, stat.files_free() as u64, stat.block_size() as u32,
+                stat.name_max() as u32, stat.fragment_size() as u32),
+            Ok(None) => {
+                // A scaffold root has no storage of its own, but many tools refuse to write to
+                // file systems that claim to be full, so report an arbitrary one with free space.
+                reply.statfs(SCAFFOLD_STATFS_BLOCKS, SCAFFOLD_STATFS_BLOCKS,
+                    SCAFFOLD_STATFS_BLOCKS, SCAFFOLD_STATFS_FILES, SCAFFOLD_STATFS_FILES,
+                    SCAFFOLD_STATFS_BLOCK_SIZE, 255, SCAFFOLD_STATFS_BLOCK_SIZE)
+            },
+            Err(e) => reply.error(self.metrics.record_error(&e)),
         }
     }
 
     fn symlink(&mut self, req: &fuse::Request, parent: u64, name: &OsStr, link: &Path,
         reply: fuse::ReplyEntry) {
-        match self.symlink2(req, parent, name, link) {
+        check_request!(self, metrics::Op::Symlink, req, reply, parent, Some(name));
+        let result = self.symlink2(req, parent, name, link);
+        self.audit(req, metrics::Op::Symlink, parent, Some(name), &result, |event| {
+            event.target = Some(link.to_string_lossy().into_owned());
+        });
+        match result {
             Ok(attr) => reply.entry(&self.ttl, &attr, IdGenerator::GENERATION),
-            Err(e) => reply.error(e.errno_as_i32()),
+            Err(e) => reply.error(self.metrics.record_error(&e)),
         }
     }
 
-    fn unlink(&mut self, _req: &fuse::Request, parent: u64, name: &OsStr, reply: fuse::ReplyEmpty) {
-        match self.unlink2(parent, name) {
+    fn unlink(&mut self, req: &fuse::Request, parent: u64, name: &OsStr, reply: fuse::ReplyEmpty) {
+        check_request!(self, metrics::Op::Unlink, req, reply, parent, Some(name));
+        let result = self.unlink2(parent, name);
+        self.audit(req, metrics::Op::Unlink, parent, Some(name), &result, |_| ());
+        match result {
             Ok(()) => reply.ok(),
-            Err(e) => reply.error(e.errno_as_i32()),
+            Err(e) => reply.error(self.metrics.record_error(&e)),
         }
     }
 
-    fn write(&mut self, _req: &fuse::Request, _inode: u64, fh: u64, offset: i64, data: &[u8],
+    // TODO(jmmv): The kernel sends us every write separately, page by page, which is slow for
+    // workloads that write large files.  Linux's writeback cache mode would let the kernel
+    // coalesce writes, but it has to be requested in the reply to the init request and the fuse
+    // crate we use neither speaks a protocol version that supports it nor lets us alter the flags
+    // of that reply.  Once it does, truncations via `setattr` and handle releases will need to
+    // account for the dirty pages owned by the kernel.
+    fn write(&mut self, req: &fuse::Request, inode: u64, fh: u64, offset: i64, data: &[u8],
         _flags: u32, reply: fuse::ReplyWrite) {
+        check_request!(self, metrics::Op::Write, req, reply, inode);
         let handle = self.find_handle(fh);
 
-        match handle.write(offset, data) {
-            Ok(size) => reply.written(size),
-            Err(e) => reply.error(e.errno_as_i32()),
+        let result = handle.write(offset, data);
+        if let Some(ref audit_log) = self.audit_log {
+            // Writes come in small chunks, so they are aggregated per handle until it is released.
+            let errno = result.as_ref().err().map_or(0, KernelError::errno_as_i32);
+            let size = *result.as_ref().unwrap_or(&0);
+            audit_log.record_write(fh, offset, u64::from(size), errno,
+                || self.audit_event(req, metrics::Op::Write, inode, None, errno));
+        }
+        match result {
+            Ok(size) => {
+                self.metrics.record_write(size as usize);
+                reply.written(size)
+            },
+            Err(e) => reply.error(self.metrics.record_error(&e)),
         }
     }
 
-    fn setxattr(&mut self, _req: &fuse::Request<'_>, inode: u64, name: &OsStr, value: &[u8],
+    fn setxattr(&mut self, req: &fuse::Request<'_>, inode: u64, name: &OsStr, value: &[u8],
         _flags: u32, _position: u32, reply: fuse::ReplyEmpty) {
+        check_request!(self, metrics::Op::Setxattr, req, reply, inode);
         if !self.xattrs {
             reply.error(Errno::ENOSYS as i32);
             return;
         }
 
-        match self.setxattr2(inode, name, value) {
+        let result = self.setxattr2(inode, name, value);
+        self.audit(req, metrics::Op::Setxattr, inode, None, &result, |_| ());
+        match result {
             Ok(()) => reply.ok(),
-            Err(e) => reply.error(e.errno_as_i32()),
+            Err(e) => reply.error(self.metrics.record_error(&e)),
         }
     }
 
-    fn getxattr(&mut self, _req: &fuse::Request<'_>, inode: u64, name: &OsStr, size: u32,
+    fn getxattr(&mut self, req: &fuse::Request<'_>, inode: u64, name: &OsStr, size: u32,
         reply: fuse::ReplyXattr) {
+        check_request!(self, metrics::Op::Getxattr, req, reply, inode);
         if !self.xattrs {
             reply.error(Errno::ENOSYS as i32);
             return;
@@ -742,12 +2337,13 @@ impl fuse::Filesystem for SandboxFS {
 
         match self.getxattr2(inode, name) {
             Ok(value) => reply_xattr(size, value.as_slice(), reply),
-            Err(e) => reply.error(e.errno_as_i32()),
+            Err(e) => reply.error(self.metrics.record_error(&e)),
         }
     }
 
-    fn listxattr(&mut self, _req: &fuse::Request<'_>, inode: u64, size: u32,
+    fn listxattr(&mut self, req: &fuse::Request<'_>, inode: u64, size: u32,
         reply: fuse::ReplyXattr) {
+        check_request!(self, metrics::Op::Listxattr, req, reply, inode);
         if !self.xattrs {
             reply.error(Errno::ENOSYS as i32);
             return;
@@ -762,26 +2358,108 @@ impl fuse::Filesystem for SandboxFS {
                     reply.data(&[]);
                 }
             },
-            Err(e) => reply.error(e.errno_as_i32()),
+            Err(e) => reply.error(self.metrics.record_error(&e)),
         }
     }
 
-    fn removexattr(&mut self, _req: &fuse::Request<'_>, inode: u64, name: &OsStr,
+    fn removexattr(&mut self, req: &fuse::Request<'_>, inode: u64, name: &OsStr,
         reply: fuse::ReplyEmpty) {
+        check_request!(self, metrics::Op::Removexattr, req, reply, inode);
         if !self.xattrs {
             reply.error(Errno::ENOSYS as i32);
             return;
         }
 
-        match self.removexattr2(inode, name) {
+        let result = self.removexattr2(inode, name);
+        self.audit(req, metrics::Op::Removexattr, inode, None, &result, |_| ());
+        match result {
             Ok(()) => reply.ok(),
-            Err(e) => reply.error(e.errno_as_i32()),
+            Err(e) => reply.error(self.metrics.record_error(&e)),
+        }
+    }
+}
+
+impl ReconfigurableSandboxFS {
+    /// Replaces the top-level `old` mappings, which must be the ones currently applied, with the
+    /// `new` ones.
+    ///
+    /// The new mappings are validated as a whole before touching the file system so that problems
+    /// like missing targets or duplicate mappings leave the current tree untouched.  Mappings that
+    /// are present in both sets are left alone, as are the sandboxes created via reconfiguration
+    /// requests.  Returns the number of mappings that were added and removed.
+    fn replace_mappings(&self, old: &[Mapping], new: &[Mapping]) -> Fallible<(usize, usize)> {
+        let errors = check_mappings(new, false, self.allowed_targets());
+        if let Some(e) = errors.into_iter().next() {
+            return Err(e);
+        }
+
+        let old_root = old.first().filter(|m| m.is_root());
+        ensure!(old_root == new.first().filter(|m| m.is_root()),
+            "Cannot change the mapping of the root directory");
+        let skip = if old_root.is_some() { 1 } else { 0 };
+
+        // Mappings nested within a removed mapping vanish along with it, so they have to be
+        // reapplied even if they did not change.
+        let old_index = index_by_path(old);
+        let new_index = index_by_path(new);
+        let mut removed: Vec<&Mapping> = vec!();
+        let mut removed_paths = HashSet::new();
+        for mapping in &old[skip..] {
+            if !index_contains(&new_index, mapping)
+                || mapping.path.ancestors().any(|path| removed_paths.contains(path)) {
+                removed.push(mapping);
+                removed_paths.insert(mapping.path.as_path());
+            }
+        }
+        let removed_index = index_by_path(removed.iter().cloned());
+        let added: Vec<&Mapping> = new[skip..].iter()
+            .filter(|m| !index_contains(&old_index, m) || index_contains(&removed_index, m))
+            .collect();
+
+        self.metrics.record_reconfiguration();
+        let mut inodes = vec!();
+        let result = self.apply_changes(&removed, &added, &mut inodes);
+
+        let mut nodes = self.nodes.write().unwrap();
+        for inode in inodes {
+            nodes.remove(&inode);
+            self.ids.release_inode(inode);
+        }
+
+        result.map(|()| (added.len(), removed.len()))
+    }
+
+    /// Unmaps all `removed` mappings and then applies all `added` mappings, in order.
+    ///
+    /// `inodes` is extended with the inode numbers that were unmapped.
+    fn apply_changes(&self, removed: &[&Mapping], added: &[&Mapping], inodes: &mut Vec<u64>)
+        -> Fallible<()> {
+        for (i, mapping) in removed.iter().enumerate() {
+            if removed[..i].iter().any(|r| mapping.path.starts_with(&r.path)) {
+                continue;  // Already gone with its parent.
+            }
+            self.root.unmap_path(&split_abs_path(&mapping.path), inodes)
+                .with_context(|_| format!("Cannot unmap '{}'", mapping))?;
+        }
+        prefetch_targets(added.iter().cloned());
+        for mapping in added {
+            apply_mapping(mapping, self.root.as_ref(), self.ids.as_ref(), self.cache.as_ref(),
+                self.allowed_targets())
+                .with_context(|_| format!("Cannot map '{}'", mapping))?;
         }
+        Ok(())
+    }
+
+    /// Returns the directories that the targets of new mappings must be within, if restricted.
+    fn allowed_targets(&self) -> Option<&[PathBuf]> {
+        self.allowed_targets.as_ref().map(|targets| targets.as_slice())
     }
 }
 
 impl reconfig::ReconfigurableFS for ReconfigurableSandboxFS {
     fn create_sandbox(&self, id: &str, mut mappings: &[Mapping]) -> Fallible<()> {
+        self.metrics.record_reconfiguration();
+
         // Special-case the first mapping if it is for the "root" directory.  We know that this
         // mapping, if present, must come first (as otherwise it will fail when applied later on
         // anyway).  But if it is first, we must treat it as if we were mapping the "root" itself.
@@ -790,9 +2468,12 @@ impl reconfig::ReconfigurableFS for ReconfigurableSandboxFS {
                 if mapping.path.as_path() == Path::new(&"/") {
                     let path = reconfig::make_path(id, mapping.path.clone())?;
                     mappings = &mappings[1..];
-                    let m = Mapping::from_parts(
-                        path, mapping.underlying_path.clone(), mapping.writable)?;
-                    apply_mapping(&m, self.root.as_ref(), self.ids.as_ref(), self.cache.as_ref())
+                    let m = Mapping {
+                        path: Mapping::check_path(path)?,
+                        target: mapping.target.clone(),
+                    };
+                    apply_mapping(&m, self.root.as_ref(), self.ids.as_ref(),
+                        self.cache.as_ref(), self.allowed_targets())
                         .with_context(|_| format!("Cannot map '{}'", mapping))?
                 } else {
                     self.root.find_subdir(OsStr::new(id), self.ids.as_ref())?
@@ -805,69 +2486,608 @@ impl reconfig::ReconfigurableFS for ReconfigurableSandboxFS {
         // inefficient because keep locking/unlocking the top directory for every mapping.  Should
         // pass the list of mappings down to the `map` operation... but that'd only fix this issue
         // for the top-level directory; what about all intermediate directories for all mappings?
+        prefetch_targets(mappings);
         for mapping in mappings {
             apply_mapping(
-                mapping, root_node.clone().as_ref(), self.ids.as_ref(), self.cache.as_ref())
+                mapping, root_node.clone().as_ref(), self.ids.as_ref(), self.cache.as_ref(),
+                self.allowed_targets())
                     .with_context(|_| format!("Cannot map '{}'", mapping))?;
         }
         Ok(())
     }
 
     fn destroy_sandbox(&self, id: &str) -> Fallible<()> {
+        self.metrics.record_reconfiguration();
+
         let mut inodes = vec!();
         let result = self.root.unmap_subdir(OsStr::new(id), &mut inodes);
 
-        let mut nodes = self.nodes.lock().unwrap();
+        let mut nodes = self.nodes.write().unwrap();
         for inode in inodes {
             nodes.remove(&inode);
+            self.ids.release_inode(inode);
         }
 
         result
     }
+
+    fn unmap_paths(&self, id: &str, paths: &[PathBuf]) -> Fallible<()> {
+        self.metrics.record_reconfiguration();
+
+        let mut inodes = vec!();
+        let result = paths.iter().try_for_each(|path| {
+            let full_path = reconfig::make_path(id, path)?;
+            let components = split_abs_path(&full_path);
+            ensure!(components.len() > 1,
+                "Cannot unmap the root of sandbox {}; destroy the sandbox instead", id);
+            self.root.unmap_path(&components, &mut inodes)
+                .with_context(|_| format!("Cannot unmap '{}'", path.display()))?;
+            Ok(())
+        });
+
+        let mut nodes = self.nodes.write().unwrap();
+        for inode in inodes {
+            nodes.remove(&inode);
+            self.ids.release_inode(inode);
+        }
+
+        result
+    }
+
+    fn list_mappings(&self) -> Vec<nodes::MappingInfo> {
+        let mut mappings = vec!();
+        self.root.list_mappings(Path::new("/"), &mut mappings);
+        mappings
+    }
+
+    fn take_reads(&self) -> Fallible<reads::ReadSet> {
+        match self.reads {
+            Some(ref reads) => Ok(reads.take()),
+            None => Err(format_err!("Read tracking is not enabled; see --track_reads")),
+        }
+    }
+
+    fn reconfig_lock(&self) -> &RwLock<()> {
+        &self.reconfig_lock
+    }
+}
+
+/// Returns true if `e`, which was returned by a failed mount attempt, may go away by retrying.
+///
+/// These are the errors we have seen on loaded machines when spawning the mount helper or when
+/// racing with other mount operations.  Other errors, like a missing mount point or insufficient
+/// permissions, are not going to fix themselves.
+fn is_transient_mount_error(e: &io::Error) -> bool {
+    match e.raw_os_error() {
+        Some(errno) => [Errno::EAGAIN, Errno::EBUSY, Errno::EINTR].iter()
+            .any(|transient| *transient as i32 == errno),
+        None => false,
+    }
+}
+
+/// Adds the likely cause to the error `e` returned by a failed attempt to mount `mount_point` with
+/// the given `options`, if we can tell what it is.
+///
+/// The mount helper only reports some problems on its stderr, leaving us with an error that says
+/// nothing about them.
+fn explain_mount_error(e: io::Error, mount_point: &Path, options: &[&OsStr]) -> failure::Error {
+    let nonempty = options.iter().any(|option| *option == OsStr::new("nonempty"));
+    let has_entries = fs::read_dir(mount_point).ok()
+        .map_or(false, |mut entries| entries.next().is_some());
+    if cfg!(target_os = "linux") && !nonempty && has_entries {
+        return format_err!("{}; the mount point is not empty, which FUSE refuses to mount over \
+            unless --nonempty is given", e);
+    }
+    if options.iter().any(|option| *option == OsStr::new("auto_unmount")) {
+        // Older libfuse versions reject the option outright and older fusermount binaries do not
+        // know how to watch the server, so there is nothing we can fall back to.
+        return format_err!("{}; auto_unmount was requested, which needs libfuse and fusermount \
+            2.9.0 or later", e);
+    }
+    e.into()
+}
+
+/// Mounts `fs` onto `mount_point` with the given `options`.
+///
+/// Failed attempts due to transient errors are retried up to `retries` times, waiting `delay`
+/// before the first retry and doubling the wait on every subsequent retry.
+fn mount_with_retries(fs: SandboxFS, mount_point: &Path, options: &[&OsStr], retries: u32,
+    delay: Duration) -> io::Result<fuse::Session<SandboxFS>> {
+    let mut attempt = 0;
+    let mut delay = delay;
+    loop {
+        match fuse::Session::new(fs.clone_for_mount(), mount_point, options) {
+            Err(ref e) if attempt < retries && is_transient_mount_error(e) => {
+                attempt += 1;
+                warn!("Mounting {} failed with '{}'; retry {} of {} in {:?}",
+                    mount_point.display(), e, attempt, retries, delay);
+                thread::sleep(delay);
+                delay *= 2;
+            },
+            result => return result,
+        }
+    }
+}
+
+/// Checks whether `mount_point` holds a stale FUSE mount left behind by a server that died.
+///
+/// Accessing such a mount point fails with `ENOTCONN` on Linux and with `EIO` on other systems.
+/// If `force` is true, the stale file system is unmounted so that we can mount on top of the
+/// directory again; otherwise, this returns an error that explains the situation.  Any other
+/// problems with `mount_point` are left for the mount operation to report.
+fn check_stale_mount(mount_point: &Path, force: bool) -> Fallible<()> {
+    let stale = match fs::symlink_metadata(mount_point) {
+        Err(e) => match e.raw_os_error() {
+            Some(errno) => errno == Errno::ENOTCONN as i32 || errno == Errno::EIO as i32,
+            None => false,
+        },
+        Ok(_) => false,
+    };
+    if !stale {
+        return Ok(());
+    }
+
+    ensure!(force, "{} holds a stale FUSE mount, probably from a sandboxfs instance that died; \
+        unmount it or use --force", mount_point.display());
+    warn!("Unmounting stale FUSE mount at {}", mount_point.display());
+    concurrent::force_unmount(mount_point)
+        .with_context(|_| format!("Failed to unmount stale FUSE mount at {}",
+            mount_point.display()))?;
+    Ok(())
+}
+
+/// Takes ownership of the open file descriptor `fd` to later report readiness on it.
+///
+/// The descriptor is marked close-on-exec so that the helper processes we spawn, such as the
+/// unmount tools, do not keep it open and delay the reader from seeing EOF.
+#[allow(unsafe_code)]
+pub fn open_ready_fd(fd: RawFd) -> Fallible<fs::File> {
+    let flags = nix::fcntl::FdFlag::FD_CLOEXEC;
+    nix::fcntl::fcntl(fd, nix::fcntl::FcntlArg::F_SETFD(flags))
+        .with_context(|_| format!("File descriptor {} is not open", fd))?;
+    Ok(unsafe { fs::File::from_raw_fd(fd) })
+}
+
+/// Settings of a sandboxfs instance, as given to `mount`.
+///
+/// The default settings match the defaults of the command line flags, except for `threads`, which
+/// is one instead of the number of CPUs.
+pub struct MountOptions<'a> {
+    /// Time during which the kernel is allowed to cache file metadata.
+    pub ttl: Timespec,
+
+    /// Time during which the kernel is allowed to cache lookups of missing entries, if not zero.
+    /// Entries that appear in the meantime other than by being created through the mount point,
+    /// such as those added via reconfiguration, remain invisible until the cache expires.
+    pub negative_ttl: Timespec,
+
+    /// Factory of the nodes that represent underlying files.
+    pub cache: ArcCache,
+
+    /// Whether extended attributes are supported.
+    pub xattrs: bool,
+
+    /// Whether mappings that share the same path are merged into a single overlay whose contents
+    /// are the union of all of their targets.
+    pub overlay: bool,
+
+    /// Whether mapped files and directories report the inode numbers of their targets instead of
+    /// synthesized ones.
+    pub expose_underlying_inodes: bool,
+
+    /// Whether to reject all requests that do not come from the user running this process or from
+    /// root.  This is how `allow_root` is implemented on platforms where the kernel cannot enforce
+    /// it, in which case the mount options must request `allow_other` instead.
+    pub owner_and_root_only: bool,
+
+    /// User and group to report as the owners of all files, if any, which only affects the
+    /// attributes returned to the kernel and never the underlying files.
+    pub forced_owner: (Option<u32>, Option<u32>),
+
+    /// Maximum time to wait for open files to be closed before unmounting the file system upon
+    /// receipt of a termination signal.
+    pub shutdown_timeout: Duration,
+
+    /// Maximum time to wait for a busy file system to be unmounted after `shutdown_timeout`, if
+    /// any, after which it is detached and the process exits right away.
+    pub unmount_timeout: Option<Duration>,
+
+    /// Maximum time that any single operation on an underlying file may take before it is
+    /// abandoned and the request fails with `EIO`, if any.
+    pub io_timeout: Option<Duration>,
+
+    /// Whether underlying files are accessed in a way that fails with `EXDEV` if their paths
+    /// traverse symlinks, which prevents the underlying file system from redirecting reads, writes
+    /// and other modifications to files outside of the mapped targets.  Mapping targets must not
+    /// traverse symlinks in this case.
+    pub confine_symlinks: bool,
+
+    /// Canonical directories within which the targets of all mappings, both on startup and on
+    /// reconfiguration, must resolve, if any.
+    pub allowed_targets: Option<Vec<PathBuf>>,
+
+    /// Whether `mknod` requests for block and character devices are forwarded to writable mappings
+    /// instead of failing with `EPERM`.  Those for named pipes and sockets are always forwarded.
+    pub allow_devices: bool,
+
+    /// Whether block devices, character devices and sockets found within the mappings are hidden
+    /// as if they did not exist, unless they are explicitly mapped.
+    pub hide_special_files: bool,
+
+    /// Same as `hide_special_files` but for named pipes.
+    pub hide_fifos: bool,
+
+    /// Whether the targets of all plain mappings other than the root are only inspected once they
+    /// are first accessed instead of when the mappings are applied.
+    pub lazy_mappings: bool,
+
+    /// Whether lookups of names that do not exist within the mappings fall back to the entries
+    /// whose names only differ in case, in which case new entries cannot be created if their names
+    /// only differ in case from existing ones.
+    pub case_insensitive: bool,
+
+    /// Filters for the trace of requests written when debug logging is enabled.
+    pub request_filter: RequestFilter,
+
+    /// Duration above which operations are logged along with the paths they target and their
+    /// outcome, if any.
+    pub slow_op_threshold: Option<Duration>,
+
+    /// File to which the operations that modify the file system are appended, one JSON object per
+    /// line, if any.
+    pub audit_log: Option<&'a Path>,
+
+    /// Whether the paths of the files that are read are recorded so that they can be queried via
+    /// reconfiguration requests.
+    pub track_reads: bool,
+
+    /// File to which the paths recorded due to `track_reads` are written on unmount, if any.
+    pub track_reads_output: Option<&'a Path>,
+
+    /// File to which a trace of the operations is written, if any.
+    pub trace_profile: Option<&'a Path>,
+
+    /// Maximum duration of the trace written to `trace_profile`, if any.
+    pub trace_profile_duration: Option<Duration>,
+
+    /// Maximum number of underlying files to keep open, which defaults to 90% of the limit on open
+    /// files.  Once reached, the descriptors of idle read-only handles start being closed and are
+    /// transparently reopened on their next access.
+    pub max_open_files: Option<usize>,
+
+    /// Address on which to serve metrics about the activity of the file system over HTTP at the
+    /// `/metrics` path, along with the `/healthz` and `/readyz` health checks, if any.
+    pub listen_address: Option<SocketAddr>,
+
+    /// Whether the HTTP server enabled by `listen_address` also accepts reconfiguration documents,
+    /// which are serialized with the requests received through the other channels.
+    pub http_reconfig: bool,
+
+    /// Whether the HTTP server enabled by `listen_address` also writes snapshots of the execution
+    /// trace on request, which creates new files next to `trace_profile`.
+    pub http_snapshot: bool,
+
+    /// Path at which to create a Unix domain socket that accepts reconfiguration requests instead
+    /// of reading them from the input, if any.  Responses are written back to the same connection
+    /// and the socket is deleted on exit.
+    pub reconfig_socket: Option<&'a Path>,
+
+    /// Number of reconfiguration requests to process in parallel.
+    pub threads: usize,
+
+    /// Whether the file system is drained and unmounted once the reconfiguration input reaches
+    /// EOF, just as if a termination signal had been received.  Otherwise, the file system keeps
+    /// serving with its mappings frozen until it is unmounted or signaled.
+    pub stop_on_input_eof: bool,
+
+    /// Loader of the mappings to apply on `SIGHUP`, if any, in which case `SIGHUP` stops being a
+    /// termination signal.  Failures to load or validate the new mappings are logged and leave the
+    /// current ones in place.
+    pub reload_mappings: Option<MappingsLoader>,
+
+    /// File to which the byte `1` is written, and which is then closed, once the file system is
+    /// mounted and about to start serving, if any.  If mounting fails, the file is closed without
+    /// writing to it so that the reader can tell both cases apart.
+    pub ready: Option<fs::File>,
+
+    /// Whether to unmount a stale FUSE mount found at the mount point first.
+    pub force: bool,
+
+    /// Number of times to retry mount attempts that fail due to transient errors.  Termination
+    /// signals received in the meantime are only handled once the file system is mounted.
+    pub mount_retries: u32,
+
+    /// Delay before the first retry of a failed mount attempt, which doubles on every retry.
+    pub mount_retry_delay: Duration,
+
+    /// Identifier of our parent process, if any, whose exit unmounts the file system as if
+    /// `SIGTERM` had been received.
+    pub parent: Option<u32>,
+
+    /// User to switch to once the file system is mounted and before it starts serving, if any, so
+    /// that all accesses to underlying files happen as that user.  Files and sockets opened
+    /// earlier, like the reconfiguration input and output, remain usable.  New files are owned by
+    /// that user regardless of who creates them, and the file system can only be unmounted on exit
+    /// if that user is allowed to.
+    pub drop_privileges_to: Option<User>,
+}
+
+impl<'a> Default for MountOptions<'a> {
+    fn default() -> Self {
+        MountOptions {
+            ttl: Timespec::new(60, 0),
+            negative_ttl: Timespec::new(0, 0),
+            cache: Arc::from(NoCache::default()),
+            xattrs: false,
+            overlay: false,
+            expose_underlying_inodes: false,
+            owner_and_root_only: false,
+            forced_owner: (None, None),
+            shutdown_timeout: Duration::from_secs(0),
+            unmount_timeout: None,
+            io_timeout: None,
+            confine_symlinks: false,
+            allowed_targets: None,
+            allow_devices: false,
+            hide_special_files: false,
+            hide_fifos: false,
+            lazy_mappings: false,
+            case_insensitive: false,
+            request_filter: RequestFilter::default(),
+            slow_op_threshold: None,
+            audit_log: None,
+            track_reads: false,
+            track_reads_output: None,
+            trace_profile: None,
+            trace_profile_duration: None,
+            max_open_files: None,
+            listen_address: None,
+            http_reconfig: false,
+            http_snapshot: false,
+            reconfig_socket: None,
+            threads: 1,
+            stop_on_input_eof: false,
+            reload_mappings: None,
+            ready: None,
+            force: false,
+            mount_retries: 0,
+            mount_retry_delay: Duration::from_secs(1),
+            parent: None,
+            drop_privileges_to: None,
+        }
+    }
 }
 
 /// Mounts a new sandboxfs instance on the given `mount_point` and maps all `mappings` within it.
-#[allow(clippy::too_many_arguments)]
-pub fn mount(mount_point: &Path, options: &[&str], mappings: &[Mapping], ttl: Timespec,
-    cache: ArcCache, xattrs: bool, input: fs::File, output: fs::File, threads: usize)
-    -> Fallible<()> {
-    let mut os_options = options.iter().map(AsRef::as_ref).collect::<Vec<&OsStr>>();
+///
+/// `fuse_options` are passed to the FUSE library as is.  Reconfiguration requests are read from
+/// `input` and their responses are written to `output` unless `options` set up a reconfiguration
+/// socket instead.
+///
+/// Upon receipt of a termination signal, new requests are rejected and sandboxfs waits for open
+/// files to be closed before unmounting the file system, as configured in `options`.  This then
+/// returns a `SignalError` once the file system has been unmounted.
+///
+/// The limit on open files is raised as much as possible on startup.
+pub fn mount(mount_point: &Path, fuse_options: &[&str], mappings: &[Mapping], input: fs::File,
+    output: fs::File, mut options: MountOptions) -> Fallible<()> {
+    check_stale_mount(mount_point, options.force)?;
+    nodes::set_io_timeout(options.io_timeout);
+    nodes::set_confine_symlinks(options.confine_symlinks);
+    nodes::set_allow_devices(options.allow_devices);
+    nodes::set_hidden_special_files(options.hide_special_files, options.hide_fifos);
+    nodes::set_lazy_mappings(options.lazy_mappings);
+    nodes::set_case_insensitive(options.case_insensitive);
+    match nodes::raise_nofile_limit() {
+        Ok(limit) => {
+            options.max_open_files = Some(options.max_open_files.unwrap_or(limit as usize / 10 * 9))
+        },
+        Err(e) => warn!("Failed to raise the limit on open files: {}", e),
+    }
+
+    // This must happen before any other threads are started; see `bind_socket`.
+    let (listener, _socket_path) = match options.reconfig_socket {
+        Some(path) => {
+            let (listener, socket_path) = reconfig::bind_socket(path)?;
+            info!("Listening for reconfigurations on {}", path.display());
+            (Some(listener), Some(socket_path))
+        },
+        None => (None, None),
+    };
+
+    let mut os_options = fuse_options.iter().map(AsRef::as_ref).collect::<Vec<&OsStr>>();
 
     // Delegate permissions checks to the kernel for efficiency and to avoid having to implement
     // them on our own.
     os_options.push(OsStr::new("-o"));
     os_options.push(OsStr::new("default_permissions"));
 
-    let mut fs = SandboxFS::create(mappings, ttl, cache, xattrs)?;
+    let mut fs = SandboxFS::create(mappings, &options)?;
+    if !options.request_filter.is_empty() {
+        logging::suppress_fuse_trace();
+        fs.request_filter = Some(Arc::from(options.request_filter));
+    }
+    fs.slow_op_threshold = options.slow_op_threshold;
+    // This must outlive the FUSE session so that the log is closed once all operations are done.
+    let _audit_log = match options.audit_log {
+        Some(path) => {
+            let audit_log = audit::AuditLog::open(path, fs.metrics.clone())
+                .with_context(|_| format!("Failed to open audit log {}", path.display()))?;
+            let audit_log = Arc::from(audit_log);
+            fs.audit_log = Some(audit_log.clone());
+            Some(audit::CloseOnDrop(audit_log))
+        },
+        None => None,
+    };
+    // Same as above: the reads must be written once no more operations can happen.
+    let _reads_output = if options.track_reads {
+        let tracker = Arc::from(reads::ReadsTracker::default());
+        fs.reads = Some(tracker.clone());
+        match options.track_reads_output {
+            Some(path) => Some(reads::WriteOnDrop::create(tracker, path)
+                .with_context(|_| format!("Failed to create reads output file {}",
+                    path.display()))?),
+            None => None,
+        }
+    } else {
+        None
+    };
+    // Same as above: the trace must be written once no more operations can happen.
+    let _trace_profile = match options.trace_profile {
+        Some(path) => {
+            let tracer = trace::Tracer::create(path, options.trace_profile_duration)
+                .with_context(|_| format!("Failed to create trace profile {}", path.display()))?;
+            fs.tracer = Some(tracer.clone());
+            Some(trace::FinishOnDrop(tracer))
+        },
+        None => None,
+    };
     let reconfigurable_fs = fs.reconfigurable();
+    let drainer = fs.drainer(options.shutdown_timeout);
+    let eof_drainer = fs.drainer(options.shutdown_timeout);
+    if let Some(address) = options.listen_address {
+        let listener = TcpListener::bind(address)
+            .with_context(|_| format!("Failed to listen on {}", address))?;
+        let reconfigure = if options.http_reconfig {
+            let reconfigurable_fs = reconfigurable_fs.clone();
+            Some(move |input: &[u8]| reconfig::handle_document(input, &reconfigurable_fs))
+        } else {
+            None
+        };
+        let snapshot = if options.http_snapshot { Some(fs.snapshot()) } else { None };
+        metrics::serve(listener, fs.metrics.clone(), fs.gauges(), fs.self_check(),
+            fs.config(mount_point, &os_options), reconfigure, snapshot);
+        info!("Serving metrics on http://{}/metrics", address);
+    }
+    {
+        let metrics = fs.metrics.clone();
+        let gauges = fs.gauges();
+        concurrent::install_signal_action(signal::Signal::SIGUSR1, move || {
+            // Write the whole dump at once to prevent interleaving with log messages.
+            let dump = metrics.dump(&gauges());
+            if let Err(e) = io::stderr().write_all(dump.as_bytes()) {
+                warn!("Failed to write state dump: {}", e);
+            }
+        })?;
+    }
+    let termination_signals = match options.reload_mappings {
+        Some(loader) => {
+            let overlay = options.overlay;
+            let mut current = mappings.to_vec();
+            if overlay {
+                current = merge_overlays(&current)?;
+            }
+            let current = Mutex::from(current);
+            let reconfigurable_fs = fs.reconfigurable();
+            concurrent::install_signal_action(signal::Signal::SIGHUP, move || {
+                let mut current = current.lock().unwrap();
+                let result = loader().and_then(|new| {
+                    let new = if overlay { merge_overlays(&new)? } else { new };
+                    let _lock = reconfigurable_fs.reconfig_lock.write().unwrap();
+                    let counts = reconfigurable_fs.replace_mappings(&current, &new)?;
+                    *current = new;
+                    Ok(counts)
+                });
+                match result {
+                    Ok((added, removed)) => {
+                        info!("Reloaded mappings: {} added, {} removed", added, removed)
+                    },
+                    Err(e) => warn!("Failed to reload mappings; keeping the previous ones: {}",
+                        flatten_causes(&e)),
+                }
+            })?;
+            concurrent::TERMINATION_SIGNALS.iter()
+                .filter(|sig| **sig != signal::Signal::SIGHUP)
+                .cloned()
+                .collect::<Vec<_>>()
+        },
+        None => concurrent::TERMINATION_SIGNALS.to_vec(),
+    };
+    concurrent::install_signal_action(signal::Signal::SIGUSR2, || {
+        let state = if logging::toggle_debug() { "enabled" } else { "disabled" };
+        if let Err(e) = writeln!(io::stderr(), "sandboxfs: debug logging {}", state) {
+            warn!("Failed to report debug logging state: {}", e);
+        }
+    })?;
     info!("Mounting file system onto {:?}", mount_point);
 
+    let metrics = fs.metrics.clone();
     let (signals, mut session) = {
-        let installer = concurrent::SignalsInstaller::prepare();
-        let session = fuse::Session::new(fs, &mount_point, &os_options)?;
-        let signals = installer.install(PathBuf::from(mount_point))?;
+        let installer = concurrent::SignalsInstaller::prepare(&termination_signals);
+        let session = mount_with_retries(
+            fs, mount_point, &os_options, options.mount_retries, options.mount_retry_delay)
+            .map_err(|e| explain_mount_error(e, mount_point, &os_options))?;
+        let signals = installer.install(
+            PathBuf::from(mount_point), drainer, options.unmount_timeout)?;
+        // This must happen before watching the parent because changing credentials clears the
+        // parent death signal on Linux.
+        if let Some(user) = options.drop_privileges_to {
+            privileges::drop_privileges(&user).context("Failed to drop privileges")?;
+            info!("Dropped privileges to {}", user);
+        }
+        if let Some(parent) = options.parent {
+            concurrent::watch_parent(unistd::Pid::from_raw(parent as i32))?;
+        }
         (signals, session)
     };
 
+    if let Some(mut ready) = options.ready {
+        if let Err(e) = ready.write_all(b"1") {
+            warn!("Failed to report readiness: {}", e);
+        }
+    }
+
+    let threads = options.threads;
+    if let Some(listener) = listener {
+        // The socket thread blocks accepting connections for as long as the process lives, so
+        // there is no way to wait for it to finish: just let it die when we exit.
+        thread::spawn(move || {
+            if let Err(e) = reconfig::serve_socket(listener, threads, &reconfigurable_fs) {
+                warn!("Reconfigurations stopped due to internal error: {}", e);
+            }
+        });
+        metrics.set_serving(true);
+        let result = session.run();
+        metrics.set_serving(false);
+        result?;
+        if let Some(signo) = signals.caught() {
+            info!("Caught signal {}", signo);
+            return Err(SignalError { signo }.into());
+        }
+        return Ok(());
+    }
+
+    let stop_on_input_eof = options.stop_on_input_eof;
+    let unmount_timeout = options.unmount_timeout;
     let config_handler = {
         let mut input = concurrent::ShareableFile::from(input);
         let reader = input.reader()?;
+        let mount_point = PathBuf::from(mount_point);
         let handler = thread::spawn(move || {
             match reconfig::run_loop(reader, output, threads, &reconfigurable_fs) {
+                Ok(()) if stop_on_input_eof => {
+                    info!("Reached end of reconfiguration input; draining and unmounting {}",
+                        mount_point.display());
+                    eof_drainer();
+                    concurrent::unmount_for_exit(mount_point, unmount_timeout);
+                },
                 Ok(()) => info!(
                     "Reached end of reconfiguration input; file system mappings are now frozen"),
                 Err(e) => warn!("Reconfigurations stopped due to internal error: {}", e),
             }
         });
 
-        session.run()?;
+        metrics.set_serving(true);
+        let result = session.run();
+        metrics.set_serving(false);
+        result?;
         handler
     };
     // The input must be closed to let the reconfiguration thread to exit, which then lets the join
     // operation below complete, hence the scope above.
     if let Some(signo) = signals.caught() {
         info!("Caught signal {}", signo);
-        return Err(format_err!("Caught signal {}", signo));
+        return Err(SignalError { signo }.into());
     }
 
     match config_handler.join() {
@@ -885,12 +3105,23 @@ mod tests {
     #[test]
     fn test_mapping_new_ok() {
         let mapping = Mapping::from_parts(
-            PathBuf::from("/foo/.///bar"),  // Must be absolute and normalized.
+            PathBuf::from("/foo///bar/"),  // Must be absolute and normalized.
             PathBuf::from("/bar/./baz/../abc"),  // Must be absolute but needn't be normalized.
             false).unwrap();
-        assert_eq!(PathBuf::from("/foo/bar"), mapping.path);
-        assert_eq!(PathBuf::from("/bar/baz/../abc"), mapping.underlying_path);
-        assert!(!mapping.writable);
+        assert_eq!("/foo/bar", mapping.path.to_str().unwrap());
+        assert_eq!(
+            nodes::MappingTarget::Path {
+                underlying_path: PathBuf::from("/bar/baz/../abc"),
+                writable: false,
+                excludes: nodes::Excludes::default(),
+                squash: None,
+                noexec: false,
+                perm_mask: None,
+                lazy: false,
+                optional: false,
+                target_type: None,
+            },
+            mapping.target);
     }
 
     #[test]
@@ -911,6 +3142,32 @@ mod tests {
         assert_eq!(
             MappingError::PathNotNormalized { path: intermediate_dotdot.clone() },
             Mapping::from_parts(intermediate_dotdot, PathBuf::from("/bar"), true).unwrap_err());
+
+        let intermediate_dot = PathBuf::from("/foo/./bar");
+        assert_eq!(
+            MappingError::PathNotNormalized { path: intermediate_dot.clone() },
+            Mapping::from_parts(intermediate_dot, PathBuf::from("/bar"), true).unwrap_err());
+    }
+
+    #[test]
+    fn test_mapping_check_path() {
+        for (path, exp_path) in &[
+            ("/", "/"),
+            ("//", "/"),
+            ("/a", "/a"),
+            ("/a/", "/a"),
+            ("//a//b//", "/a/b"),
+            ("/a.b/..c/.d", "/a.b/..c/.d"),
+        ] {
+            let normalized = Mapping::check_path(PathBuf::from(path)).unwrap();
+            assert_eq!(*exp_path, normalized.to_str().unwrap(), "Bad normalization of {}", path);
+        }
+
+        for path in &["/.", "/./", "/..", "/a/.", "/a/./b", "/a/../b", "/a/b/.."] {
+            assert_eq!(
+                MappingError::PathNotNormalized { path: PathBuf::from(path) },
+                Mapping::check_path(PathBuf::from(path)).unwrap_err());
+        }
     }
 
     #[test]
@@ -920,6 +3177,191 @@ mod tests {
         assert_eq!(MappingError::PathNotAbsolute { path: PathBuf::from("bar") }, err);
     }
 
+    #[test]
+    fn test_mapping_new_excluding_ok() {
+        let options = MappingOptions {
+            excludes: vec!(".git".to_owned(), "bazel-*".to_owned()),
+            ..Default::default()
+        };
+        let mapping = Mapping::from_parts_with(
+            PathBuf::from("/src"), PathBuf::from("/home/me/src"), false, options).unwrap();
+        assert_eq!(
+            nodes::MappingTarget::Path {
+                underlying_path: PathBuf::from("/home/me/src"),
+                writable: false,
+                excludes: nodes::Excludes::new(vec!(".git".to_owned(), "bazel-*".to_owned())),
+                squash: None,
+                noexec: false,
+                perm_mask: None,
+                lazy: false,
+                optional: false,
+                target_type: None,
+            },
+            mapping.target);
+        assert_eq!("/src -> /home/me/src (read-only, excluding .git, bazel-*)",
+            format!("{}", mapping));
+    }
+
+    #[test]
+    fn test_mapping_new_excluding_bad_pattern() {
+        for pattern in ["", "a/b", "/"].iter() {
+            let options = MappingOptions {
+                excludes: vec!("ok".to_owned(), pattern.to_string()),
+                ..Default::default()
+            };
+            let err = Mapping::from_parts_with(
+                PathBuf::from("/src"), PathBuf::from("/home/me/src"), false, options).unwrap_err();
+            assert_eq!(MappingError::InvalidExclude { pattern: pattern.to_string() }, err);
+        }
+    }
+
+    #[test]
+    fn test_mapping_new_squashing_ok() {
+        let squash = Squash { uid: Some(1000), gid: Some(100), strict: true };
+        let options = MappingOptions { squash: Some(squash), ..Default::default() };
+        let mapping = Mapping::from_parts_with(
+            PathBuf::from("/out"), PathBuf::from("/tmp/out"), true, options).unwrap();
+        assert_eq!(
+            nodes::MappingTarget::Path {
+                underlying_path: PathBuf::from("/tmp/out"),
+                writable: true,
+                excludes: nodes::Excludes::default(),
+                squash: Some(squash),
+                noexec: false,
+                perm_mask: None,
+                lazy: false,
+                optional: false,
+                target_type: None,
+            },
+            mapping.target);
+        assert_eq!("/out -> /tmp/out (read/write, strictly squashing to uid 1000 and gid 100)",
+            format!("{}", mapping));
+
+        let squash = Squash { uid: None, gid: Some(100), strict: false };
+        let options = MappingOptions {
+            excludes: vec!("*.o".to_owned()),
+            squash: Some(squash),
+            ..Default::default()
+        };
+        let mapping = Mapping::from_parts_with(
+            PathBuf::from("/out"), PathBuf::from("/tmp/out"), true, options).unwrap();
+        assert_eq!("/out -> /tmp/out (read/write, excluding *.o, squashing to gid 100)",
+            format!("{}", mapping));
+    }
+
+    #[test]
+    fn test_mapping_new_squashing_empty() {
+        let squash = Squash { uid: None, gid: None, strict: true };
+        let options = MappingOptions { squash: Some(squash), ..Default::default() };
+        let err = Mapping::from_parts_with(
+            PathBuf::from("/out"), PathBuf::from("/tmp/out"), true, options).unwrap_err();
+        assert_eq!(MappingError::EmptySquash, err);
+    }
+
+    #[test]
+    fn test_mapping_new_restricting_exec_ok() {
+        let options = MappingOptions { noexec: true, ..Default::default() };
+        let mapping = Mapping::from_parts_with(
+            PathBuf::from("/deps"), PathBuf::from("/home/me/deps"), false, options).unwrap();
+        assert_eq!(
+            nodes::MappingTarget::Path {
+                underlying_path: PathBuf::from("/home/me/deps"),
+                writable: false,
+                excludes: nodes::Excludes::default(),
+                squash: None,
+                noexec: true,
+                perm_mask: None,
+                lazy: false,
+                optional: false,
+                target_type: None,
+            },
+            mapping.target);
+        assert_eq!("/deps -> /home/me/deps (read-only, noexec)", format!("{}", mapping));
+    }
+
+    #[test]
+    fn test_mapping_new_masking_ok() {
+        let options = MappingOptions { perm_mask: Some(0o555), ..Default::default() };
+        let mapping = Mapping::from_parts_with(
+            PathBuf::from("/src"), PathBuf::from("/home/me/src"), true, options).unwrap();
+        assert_eq!(
+            nodes::MappingTarget::Path {
+                underlying_path: PathBuf::from("/home/me/src"),
+                writable: true,
+                excludes: nodes::Excludes::default(),
+                squash: None,
+                noexec: false,
+                perm_mask: Some(0o555),
+                lazy: false,
+                optional: false,
+                target_type: None,
+            },
+            mapping.target);
+        assert_eq!("/src -> /home/me/src (read/write, perm=0555)", format!("{}", mapping));
+    }
+
+    #[test]
+    fn test_mapping_new_deferring_ok() {
+        let options = MappingOptions { lazy: true, ..Default::default() };
+        let mapping = Mapping::from_parts_with(
+            PathBuf::from("/src"), PathBuf::from("/home/me/src"), false, options).unwrap();
+        assert!(mapping.target.is_lazy());
+        assert_eq!("/src -> /home/me/src (read-only, lazy)", format!("{}", mapping));
+
+        // Mappings with other options cannot be lazy.
+        let options = MappingOptions { noexec: true, lazy: true, ..Default::default() };
+        let mapping = Mapping::from_parts_with(
+            PathBuf::from("/src"), PathBuf::from("/home/me/src"), false, options).unwrap();
+        assert!(!mapping.target.is_lazy());
+    }
+
+    #[test]
+    fn test_mapping_new_masking_invalid() {
+        for mask in &[0o666, 0o10000] {
+            let options = MappingOptions { perm_mask: Some(*mask), ..Default::default() };
+            let err = Mapping::from_parts_with(
+                PathBuf::from("/src"), PathBuf::from("/home/me/src"), false, options).unwrap_err();
+            assert_eq!(MappingError::InvalidPermMask { mask: *mask }, err);
+        }
+    }
+
+    #[test]
+    fn test_mapping_new_cow_ok() {
+        let mapping = Mapping::from_parts_cow(
+            PathBuf::from("/foo"), PathBuf::from("/bar"), PathBuf::from("/scratch")).unwrap();
+        assert_eq!(
+            nodes::MappingTarget::CopyOnWrite {
+                underlying_path: PathBuf::from("/bar"),
+                scratch_path: PathBuf::from("/scratch"),
+            },
+            mapping.target);
+        assert_eq!("/foo -> /bar (copy-on-write to /scratch)", format!("{}", mapping));
+    }
+
+    #[test]
+    fn test_mapping_new_cow_scratch_path_is_not_absolute() {
+        let err = Mapping::from_parts_cow(
+            PathBuf::from("/foo"), PathBuf::from("/bar"), PathBuf::from("scratch")).unwrap_err();
+        assert_eq!(MappingError::PathNotAbsolute { path: PathBuf::from("scratch") }, err);
+    }
+
+    #[test]
+    fn test_mapping_new_memory_ok() {
+        let mapping = Mapping::from_parts_memory(PathBuf::from("/tmp"), None).unwrap();
+        assert_eq!(nodes::MappingTarget::Memory { size_limit: None }, mapping.target);
+        assert_eq!("/tmp (in-memory)", format!("{}", mapping));
+
+        let mapping = Mapping::from_parts_memory(PathBuf::from("/tmp"), Some(1024)).unwrap();
+        assert_eq!(nodes::MappingTarget::Memory { size_limit: Some(1024) }, mapping.target);
+        assert_eq!("/tmp (in-memory, up to 1024 bytes)", format!("{}", mapping));
+    }
+
+    #[test]
+    fn test_mapping_new_memory_path_is_not_absolute() {
+        let err = Mapping::from_parts_memory(PathBuf::from("tmp"), None).unwrap_err();
+        assert_eq!(MappingError::PathNotAbsolute { path: PathBuf::from("tmp") }, err);
+    }
+
     #[test]
     fn test_mapping_is_root() {
         let irrelevant = PathBuf::from("/some/place");
@@ -928,7 +3370,7 @@ mod tests {
         assert!(Mapping::from_parts(
             PathBuf::from("///"), irrelevant.clone(), false).unwrap().is_root());
         assert!(Mapping::from_parts(
-            PathBuf::from("/./"), irrelevant.clone(), false).unwrap().is_root());
+            PathBuf::from("//"), irrelevant.clone(), false).unwrap().is_root());
         assert!(!Mapping::from_parts(
             PathBuf::from("/a"), irrelevant.clone(), false).unwrap().is_root());
         assert!(!Mapping::from_parts(
@@ -943,6 +3385,80 @@ mod tests {
         assert_eq!(12, ids.next());
     }
 
+    #[test]
+    fn id_generator_reuses_released_inodes() {
+        let root = tempdir().unwrap();
+        let file1 = root.path().join("file1");
+        drop(fs::File::create(&file1).unwrap());
+        let attr1 = fs::symlink_metadata(&file1).unwrap();
+        let file2 = root.path().join("file2");
+        drop(fs::File::create(&file2).unwrap());
+        let attr2 = fs::symlink_metadata(&file2).unwrap();
+
+        let ids = IdGenerator::new(10);
+        let inode1 = ids.for_underlying(&attr1);
+        let inode2 = ids.for_underlying(&attr2);
+        assert_ne!(inode1, inode2);
+
+        ids.release_inode(inode1);
+        assert_eq!(inode1, ids.for_underlying(&attr1));
+        assert_eq!(12, ids.next());
+    }
+
+    #[test]
+    fn id_generator_bounds_released_inodes() {
+        let root = tempdir().unwrap();
+        let ids = IdGenerator { max_released: 10, ..IdGenerator::new(10) };
+        let mut attrs = vec!();
+        for i in 0..100 {
+            let file = root.path().join(format!("file{}", i));
+            drop(fs::File::create(&file).unwrap());
+            let attr = fs::symlink_metadata(&file).unwrap();
+            let inode = ids.for_underlying(&attr);
+            ids.release_inode(inode);
+            attrs.push((attr, inode));
+
+            let inodes = ids.inodes.lock().unwrap();
+            assert!(inodes.by_key.len() <= 10);
+            assert!(inodes.by_inode.len() <= 10);
+            assert!(inodes.released.len() <= 10);
+        }
+
+        // Only the most recently released numbers can be claimed again.
+        let (attr, inode) = &attrs[99];
+        assert_eq!(*inode, ids.for_underlying(attr));
+        let (attr, inode) = &attrs[0];
+        assert_ne!(*inode, ids.for_underlying(attr));
+    }
+
+    #[test]
+    fn id_generator_does_not_share_live_inodes() {
+        let ids = IdGenerator::new(10);
+        let inode1 = ids.for_scaffold(1, OsStr::new("sandbox"));
+        let inode2 = ids.for_scaffold(1, OsStr::new("sandbox"));
+        assert_ne!(inode1, inode2);
+        assert_ne!(inode1, ids.for_scaffold(2, OsStr::new("sandbox")));
+
+        // The most recently assigned number wins once both are released.
+        ids.release_inode(inode1);
+        ids.release_inode(inode2);
+        assert_eq!(inode2, ids.for_scaffold(1, OsStr::new("sandbox")));
+    }
+
+    #[test]
+    fn id_generator_exposing_underlying() {
+        let root = tempdir().unwrap();
+        let file = root.path().join("file");
+        drop(fs::File::create(&file).unwrap());
+        let attr = fs::symlink_metadata(&file).unwrap();
+
+        let ids = IdGenerator::new_exposing_underlying(SYNTHESIZED_INODES_BASE);
+        assert_eq!(attr.ino(), ids.for_underlying(&attr));
+        assert_eq!(attr.ino(), ids.for_underlying(&attr));
+        assert_eq!(SYNTHESIZED_INODES_BASE, ids.for_scaffold(1, OsStr::new("sandbox")));
+        assert_eq!(SYNTHESIZED_INODES_BASE + 1, ids.next());
+    }
+
     #[test]
     #[should_panic(expected = "Ran out of identifiers")]
     fn id_generator_exhaustion() {
@@ -951,6 +3467,353 @@ mod tests {
         ids.next();  // Should panic.
     }
 
+    #[test]
+    fn test_merge_overlays_ok() {
+        let mappings = [
+            Mapping::from_parts(PathBuf::from("/"), PathBuf::from("/root"), false).unwrap(),
+            Mapping::from_parts(PathBuf::from("/lib"), PathBuf::from("/base"), false).unwrap(),
+            Mapping::from_parts(PathBuf::from("/tmp"), PathBuf::from("/scratch"), true).unwrap(),
+            Mapping::from_parts(PathBuf::from("/lib"), PathBuf::from("/extra"), false).unwrap(),
+            Mapping::from_parts(PathBuf::from("/lib"), PathBuf::from("/build"), true).unwrap(),
+        ];
+        let merged = merge_overlays(&mappings).unwrap();
+        assert_eq!(3, merged.len());
+        assert_eq!(mappings[0], merged[0]);
+        assert_eq!(PathBuf::from("/lib"), merged[1].path);
+        assert_eq!(
+            nodes::MappingTarget::Overlay {
+                layers: vec!(
+                    PathBuf::from("/base"), PathBuf::from("/extra"), PathBuf::from("/build")),
+                writable: true,
+            },
+            merged[1].target);
+        assert_eq!("/lib -> /base, /extra, /build (overlay, read/write)",
+            format!("{}", merged[1]));
+        assert_eq!(mappings[2], merged[2]);
+    }
+
+    #[test]
+    fn test_merge_overlays_top_layer_determines_writability() {
+        let mappings = [
+            Mapping::from_parts(PathBuf::from("/lib"), PathBuf::from("/base"), true).unwrap(),
+            Mapping::from_parts(PathBuf::from("/lib"), PathBuf::from("/extra"), false).unwrap(),
+        ];
+        let merged = merge_overlays(&mappings).unwrap();
+        assert_eq!(
+            nodes::MappingTarget::Overlay {
+                layers: vec!(PathBuf::from("/base"), PathBuf::from("/extra")),
+                writable: false,
+            },
+            merged[0].target);
+    }
+
+    #[test]
+    fn test_merge_overlays_only_path_mappings() {
+        let mappings = [
+            Mapping::from_parts(PathBuf::from("/lib"), PathBuf::from("/base"), false).unwrap(),
+            Mapping::from_parts_memory(PathBuf::from("/lib"), None).unwrap(),
+        ];
+        let err = merge_overlays(&mappings).unwrap_err();
+        assert_eq!(
+            "Cannot overlay '/lib (in-memory)': only plain ro and rw mappings can be overlaid",
+            format!("{}", err));
+    }
+
+    #[test]
+    fn test_check_mappings_ok() {
+        let root = tempdir().unwrap();
+        fs::create_dir(root.path().join("dir")).unwrap();
+        let mappings = [
+            Mapping::from_parts(PathBuf::from("/"), root.path().to_owned(), false).unwrap(),
+            Mapping::from_parts(PathBuf::from("/a/b"), root.path().join("dir"), true).unwrap(),
+            Mapping::from_parts_memory(PathBuf::from("/tmp"), None).unwrap(),
+        ];
+        assert!(check_mappings(&mappings, false, None).is_empty());
+    }
+
+    #[test]
+    fn test_check_mappings_reports_all_errors() {
+        let root = tempdir().unwrap();
+        let missing = root.path().join("missing");
+        let mappings = [
+            Mapping::from_parts(PathBuf::from("/"), missing.clone(), false).unwrap(),
+            Mapping::from_parts(PathBuf::from("/a"), root.path().to_owned(), false).unwrap(),
+            Mapping::from_parts(PathBuf::from("/b"), missing.clone(), false).unwrap(),
+            Mapping::from_parts(PathBuf::from("/a"), root.path().to_owned(), false).unwrap(),
+        ];
+        let errors: Vec<String> =
+            check_mappings(&mappings, false, None).iter().map(flatten_causes).collect();
+        assert_eq!(3, errors.len(), "Unexpected errors: {:?}", errors);
+        assert!(errors[0].starts_with("Failed to map root: stat failed"), "{}", errors[0]);
+        assert!(errors[1].starts_with("Cannot map '/b -> "), "{}", errors[1]);
+        assert!(errors[2].starts_with("Cannot map '/a -> "), "{}", errors[2]);
+        assert!(errors[2].ends_with("Already mapped"), "{}", errors[2]);
+    }
+
+    #[test]
+    fn test_check_mappings_reports_errors_in_order_when_prefetching() {
+        let root = tempdir().unwrap();
+        let missing = root.path().join("missing");
+        let mut mappings = vec!();
+        for i in 0..PREFETCH_MIN_TARGETS * 2 {
+            let path = PathBuf::from(format!("/m{}", i));
+            let target = if i == 10 { missing.clone() } else { root.path().to_owned() };
+            mappings.push(Mapping::from_parts(path, target, false).unwrap());
+        }
+        mappings.push(
+            Mapping::from_parts(PathBuf::from("/m5"), root.path().to_owned(), false).unwrap());
+        mappings.push(Mapping::from_parts(PathBuf::from("/z"), missing.clone(), false).unwrap());
+        let errors: Vec<String> =
+            check_mappings(&mappings, false, None).iter().map(flatten_causes).collect();
+        assert_eq!(3, errors.len(), "Unexpected errors: {:?}", errors);
+        assert!(errors[0].starts_with("Cannot map '/m10 -> "), "{}", errors[0]);
+        assert!(errors[1].starts_with("Cannot map '/m5 -> "), "{}", errors[1]);
+        assert!(errors[1].ends_with("Already mapped"), "{}", errors[1]);
+        assert!(errors[2].starts_with("Cannot map '/z -> "), "{}", errors[2]);
+    }
+
+    #[test]
+    fn test_check_mappings_defers_lazy_targets() {
+        let root = tempdir().unwrap();
+        let missing = root.path().join("missing");
+        let lazy = |path: &str, target: &Path| {
+            let options = MappingOptions { lazy: true, ..Default::default() };
+            Mapping::from_parts_with(PathBuf::from(path), target.to_owned(), false, options)
+                .unwrap()
+        };
+        let mappings = [
+            lazy("/a", &missing),
+            lazy("/b", root.path()),
+            lazy("/b/c", root.path()),
+            lazy("/a/d", root.path()),
+            lazy("/b", root.path()),
+        ];
+        let errors: Vec<String> =
+            check_mappings(&mappings, false, None).iter().map(flatten_causes).collect();
+        assert_eq!(2, errors.len(), "Unexpected errors: {:?}", errors);
+        assert!(errors[0].starts_with("Cannot map '/a/d -> "), "{}", errors[0]);
+        assert!(errors[0].contains("Stat failed for the target of \"a\""), "{}", errors[0]);
+        assert!(errors[1].starts_with("Cannot map '/b -> "), "{}", errors[1]);
+        assert!(errors[1].ends_with("Already mapped"), "{}", errors[1]);
+    }
+
+    #[test]
+    fn test_check_mappings_overlay_errors() {
+        let mappings = [
+            Mapping::from_parts(PathBuf::from("/lib"), PathBuf::from("/base"), false).unwrap(),
+            Mapping::from_parts_memory(PathBuf::from("/lib"), None).unwrap(),
+        ];
+        assert_eq!(1, check_mappings(&mappings, true, None).len());
+    }
+
+    #[test]
+    fn test_check_mappings_allowed_targets() {
+        let dir = tempdir().unwrap();
+        // The temporary directory itself may be behind a symlink (e.g. /tmp on macOS).
+        let root = fs::canonicalize(dir.path()).unwrap();
+        fs::create_dir(root.join("allowed")).unwrap();
+        fs::create_dir(root.join("allowed/dir")).unwrap();
+        fs::create_dir(root.join("other")).unwrap();
+        std::os::unix::fs::symlink("../other", root.join("allowed/link")).unwrap();
+        let allowed = [root.join("allowed")];
+
+        let mappings = [
+            Mapping::from_parts(PathBuf::from("/a"), root.join("allowed"), false).unwrap(),
+            Mapping::from_parts(PathBuf::from("/b"), root.join("other/../allowed/dir"), true)
+                .unwrap(),
+        ];
+        assert!(check_mappings(&mappings, false, Some(&allowed)).is_empty());
+
+        let mappings = [
+            Mapping::from_parts(PathBuf::from("/"), root.join("other"), false).unwrap(),
+            Mapping::from_parts(PathBuf::from("/a"), root.join("allowed/../other"), false)
+                .unwrap(),
+            Mapping::from_parts(PathBuf::from("/b"), root.join("allowed/link"), false).unwrap(),
+        ];
+        assert!(check_mappings(&mappings, false, None).is_empty());
+        let errors: Vec<String> =
+            check_mappings(&mappings, false, Some(&allowed)).iter().map(flatten_causes).collect();
+        assert_eq!(3, errors.len(), "Unexpected errors: {:?}", errors);
+        assert!(errors[0].starts_with("Failed to map root: "), "{}", errors[0]);
+        assert!(errors[0].ends_with("is not within any of the --allowed_targets"), "{}", errors[0]);
+        let resolved = format!("resolves to {:?}", root.join("other"));
+        assert!(errors[1].contains(&resolved), "{}", errors[1]);
+        assert!(errors[2].contains(&resolved), "{}", errors[2]);
+    }
+
+    /// Returns the sorted paths of all mappings backed by an underlying file in `fs`.
+    fn mapped_paths(fs: &ReconfigurableSandboxFS) -> Vec<PathBuf> {
+        let mut mappings = vec!();
+        fs.root.list_mappings(Path::new("/"), &mut mappings);
+        let mut paths: Vec<PathBuf> = mappings.into_iter()
+            .filter(|m| m.underlying_path.is_some())
+            .map(|m| m.path)
+            .collect();
+        paths.sort();
+        paths
+    }
+
+    #[test]
+    fn test_reconfigurable_views_share_lock() {
+        let mut sandboxfs = SandboxFS::create(&[], &MountOptions::default()).unwrap();
+        let fs1 = sandboxfs.reconfigurable();
+        let fs2 = sandboxfs.clone_for_mount().reconfigurable();
+
+        let _lock = fs1.reconfig_lock.write().unwrap();
+        assert!(fs2.reconfig_lock.try_read().is_err());
+    }
+
+    #[test]
+    fn test_find_node_resolves_remapped_inodes() {
+        let root = tempdir().unwrap();
+        fs::create_dir(root.path().join("a")).unwrap();
+        let mappings = [
+            Mapping::from_parts(PathBuf::from("/a"), root.path().join("a"), false).unwrap(),
+        ];
+        let mut sandboxfs = SandboxFS::create(&mappings, &MountOptions::default()).unwrap();
+        let fs = sandboxfs.reconfigurable();
+
+        // Simulate the kernel looking up the mapping, as it does when a process enters it.
+        let root_node = sandboxfs.find_node(fuse::FUSE_ROOT_ID).unwrap();
+        let (node, _attr) = root_node.lookup(
+            OsStr::new("a"), &sandboxfs.ids, sandboxfs.cache.as_ref()).unwrap();
+        let inode = node.inode();
+        sandboxfs.insert_node(
+            fuse::FUSE_ROOT_ID, OsStr::new("a"), node, MappingSettings::default());
+
+        fs.replace_mappings(&mappings, &[]).unwrap();
+        assert!(sandboxfs.find_node(inode).is_err());
+
+        fs.replace_mappings(&[], &mappings).unwrap();
+        assert_eq!(inode, sandboxfs.find_node(inode).unwrap().inode());
+    }
+
+    #[test]
+    fn test_replace_mappings() {
+        let root = tempdir().unwrap();
+        for dir in &["a", "b", "c"] {
+            fs::create_dir(root.path().join(dir)).unwrap();
+        }
+        let mapping = |path: &str, dir: &str| {
+            Mapping::from_parts(PathBuf::from(path), root.path().join(dir), false).unwrap()
+        };
+        let old = [mapping("/a", "a"), mapping("/a/b", "b")];
+        let mut sandboxfs = SandboxFS::create(&old, &MountOptions::default()).unwrap();
+        let fs = sandboxfs.reconfigurable();
+
+        let new = [mapping("/a", "a"), mapping("/a/b", "b"), mapping("/c", "c")];
+        assert_eq!((1, 0), fs.replace_mappings(&old, &new).unwrap());
+        assert_eq!(vec!(PathBuf::from("/a"), PathBuf::from("/a/b"), PathBuf::from("/c")),
+            mapped_paths(&fs));
+
+        // Replacing a mapping also reapplies those nested within it.
+        let newer = [mapping("/a", "c"), mapping("/a/b", "b")];
+        assert_eq!((2, 3), fs.replace_mappings(&new, &newer).unwrap());
+        assert_eq!(vec!(PathBuf::from("/a"), PathBuf::from("/a/b")), mapped_paths(&fs));
+    }
+
+    #[test]
+    fn test_replace_mappings_errors_keep_old_mappings() {
+        let root = tempdir().unwrap();
+        let old = [
+            Mapping::from_parts(PathBuf::from("/a"), root.path().to_owned(), false).unwrap(),
+        ];
+        let mut sandboxfs = SandboxFS::create(&old, &MountOptions::default()).unwrap();
+        let fs = sandboxfs.reconfigurable();
+
+        let missing = [
+            Mapping::from_parts(PathBuf::from("/b"), root.path().join("missing"), false).unwrap(),
+        ];
+        let err = fs.replace_mappings(&old, &missing).unwrap_err();
+        assert!(format!("{}", err).starts_with("Cannot map '/b -> "), "{}", err);
+
+        let new_root = [
+            Mapping::from_parts(PathBuf::from("/"), root.path().to_owned(), false).unwrap(),
+        ];
+        let err = fs.replace_mappings(&old, &new_root).unwrap_err();
+        assert_eq!("Cannot change the mapping of the root directory", format!("{}", err));
+
+        assert_eq!(vec!(PathBuf::from("/a")), mapped_paths(&fs));
+    }
+
+    #[test]
+    fn test_is_transient_mount_error() {
+        for errno in &[Errno::EAGAIN, Errno::EBUSY, Errno::EINTR] {
+            assert!(is_transient_mount_error(&io::Error::from_raw_os_error(*errno as i32)));
+        }
+        for errno in &[Errno::ENOENT, Errno::EPERM, Errno::ENOTDIR] {
+            assert!(!is_transient_mount_error(&io::Error::from_raw_os_error(*errno as i32)));
+        }
+        assert!(!is_transient_mount_error(&io::Error::new(io::ErrorKind::Other, "no errno")));
+    }
+
+    #[test]
+    fn test_explain_mount_error() {
+        let root = tempdir().unwrap();
+        let error = || io::Error::from_raw_os_error(Errno::EIO as i32);
+
+        let message = format!("{}", explain_mount_error(error(), root.path(), &[]));
+        assert!(!message.contains("not empty"), "Got unexpected hint in '{}'", message);
+
+        fs::write(root.path().join("file"), "").unwrap();
+        let message = format!("{}", explain_mount_error(error(), root.path(), &[]));
+        if cfg!(target_os = "linux") {
+            assert!(message.contains("the mount point is not empty"), "Got '{}'", message);
+        }
+
+        let options = [OsStr::new("-o"), OsStr::new("nonempty")];
+        let message = format!("{}", explain_mount_error(error(), root.path(), &options));
+        assert!(!message.contains("not empty"), "Got unexpected hint in '{}'", message);
+
+        let options = [OsStr::new("-o"), OsStr::new("nonempty"), OsStr::new("-o"),
+            OsStr::new("auto_unmount")];
+        let message = format!("{}", explain_mount_error(error(), root.path(), &options));
+        assert!(message.contains("auto_unmount was requested"), "Got '{}'", message);
+    }
+
+    #[test]
+    fn test_forced_chown() {
+        assert_eq!(None, forced_chown(None, None).unwrap());
+        assert_eq!(Some(20), forced_chown(None, Some(20)).unwrap());
+        assert_eq!(None, forced_chown(Some(30), None).unwrap());
+        assert_eq!(None, forced_chown(Some(30), Some(30)).unwrap());
+        let err = forced_chown(Some(30), Some(20)).unwrap_err();
+        assert_eq!(Errno::EPERM as i32, err.errno_as_i32());
+    }
+
+    #[test]
+    fn test_squash_chown_not_squashed() {
+        assert_eq!(None, squash_chown(None, None, 10, true).unwrap());
+        assert_eq!(Some(20), squash_chown(None, Some(20), 10, true).unwrap());
+    }
+
+    #[test]
+    fn test_squash_chown_lenient() {
+        assert_eq!(None, squash_chown(Some(30), None, 10, false).unwrap());
+        assert_eq!(None, squash_chown(Some(30), Some(10), 10, false).unwrap());
+        assert_eq!(None, squash_chown(Some(30), Some(20), 10, false).unwrap());
+        assert_eq!(None, squash_chown(Some(30), Some(30), 10, false).unwrap());
+    }
+
+    #[test]
+    fn test_squash_chown_strict() {
+        assert_eq!(None, squash_chown(Some(30), None, 10, true).unwrap());
+        assert_eq!(None, squash_chown(Some(30), Some(10), 10, true).unwrap());
+        let err = squash_chown(Some(30), Some(20), 10, true).unwrap_err();
+        assert_eq!(Errno::EPERM as i32, err.errno_as_i32());
+        assert_eq!(None, squash_chown(Some(30), Some(30), 10, true).unwrap());
+    }
+
+    #[test]
+    fn test_make_absolute() {
+        let cwd = env::current_dir().unwrap();
+        assert_eq!(PathBuf::from("/a/./b"), make_absolute(PathBuf::from("/a/./b")).unwrap());
+        assert_eq!(PathBuf::from(""), make_absolute(PathBuf::from("")).unwrap());
+        assert_eq!(cwd, make_absolute(PathBuf::from(".")).unwrap());
+        assert_eq!(cwd.join("a/b"), make_absolute(PathBuf::from("./a/./b")).unwrap());
+        assert_eq!(cwd.join("../a"), make_absolute(PathBuf::from("../a")).unwrap());
+    }
+
     #[test]
     fn test_split_abs_path() {
         let empty: [Component; 0] = [];
@@ -0,0 +1,470 @@
+// Copyright 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License.  You may obtain a copy
+// of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.  See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+use env_logger;
+use log::{self, LevelFilter, Log, Metadata, Record};
+use metrics::Op;
+use serde_derive::Serialize;
+use std::cmp;
+use std::fs;
+use std::io::{self, Write};
+use std::os::unix::fs::MetadataExt;
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+use time;
+
+/// Formats in which log messages can be written to stderr.
+#[derive(Clone, Copy, Debug, Eq, PartialEq)]
+pub enum LogFormat {
+    /// Human-readable lines as written by `env_logger`.
+    Text,
+
+    /// One JSON object per message, for consumption by log aggregation pipelines.
+    Json,
+}
+
+/// Whether debug logging has been enabled at runtime via `toggle_debug`.
+static DEBUG_ENABLED: AtomicBool = AtomicBool::new(false);
+
+/// Maximum log level configured from the environment at initialization time, stored as the
+/// numeric value of a `LevelFilter`.
+static DEFAULT_MAX_LEVEL: AtomicUsize = AtomicUsize::new(LevelFilter::Error as usize);
+
+/// Converts the numeric value of a `LevelFilter` back to its enum form.
+fn level_filter_from_usize(value: usize) -> LevelFilter {
+    match value {
+        0 => LevelFilter::Off,
+        1 => LevelFilter::Error,
+        2 => LevelFilter::Warn,
+        3 => LevelFilter::Info,
+        4 => LevelFilter::Debug,
+        _ => LevelFilter::Trace,
+    }
+}
+
+/// Whether log messages are being written as JSON objects.
+static JSON_ENABLED: AtomicBool = AtomicBool::new(false);
+
+/// Representation of a log message in the JSON format.
+#[derive(Debug, Serialize)]
+struct JsonEvent<'a> {
+    /// Time at which the message was logged, in RFC 3339 format and in UTC.
+    timestamp: String,
+
+    /// Level of the message, in lowercase.
+    level: String,
+
+    /// Module that logged the message, which for messages coming from the FUSE library (such as
+    /// the trace of requests) is within the `fuse` crate.
+    component: &'a str,
+
+    /// The message itself, which may span multiple lines.
+    message: String,
+}
+
+/// Returns the current time in RFC 3339 format, in UTC and with nanosecond precision.
+pub fn now_rfc3339() -> String {
+    time::now_utc().strftime("%Y-%m-%dT%H:%M:%S.%fZ")
+        .expect("Hardcoded time format must be valid").to_string()
+}
+
+/// Formats `record` as a single-line JSON object, including the line terminator.
+fn json_line(record: &Record) -> String {
+    let event = JsonEvent {
+        timestamp: now_rfc3339(),
+        level: record.level().to_string().to_lowercase(),
+        component: record.target(),
+        message: format!("{}", record.args()),
+    };
+    let mut line = serde_json::to_string(&event).expect("Serializing plain strings cannot fail");
+    line.push('\n');
+    line
+}
+
+/// Formats `record` as a human-readable line, including the line terminator.
+///
+/// This resembles the default format of `env_logger`, which we cannot reuse when writing to a file.
+fn text_line(record: &Record) -> String {
+    format!("{:<5} {}: {}: {}\n", record.level(), now_rfc3339(), record.target(), record.args())
+}
+
+/// Writes `record` to `buf` as a single-line JSON object.
+fn format_json(buf: &mut env_logger::fmt::Formatter, record: &Record) -> io::Result<()> {
+    buf.write_all(json_line(record).as_bytes())
+}
+
+/// How often to check if the log file has been rotated.
+const ROTATION_CHECK_PERIOD_SECS: u64 = 1;
+
+/// Log file that follows rotations done by tools like logrotate.
+struct LogFile {
+    /// Path to the log file, used to reopen it.
+    path: PathBuf,
+
+    /// Open file to which messages are appended.
+    file: fs::File,
+
+    /// Device and inode numbers of `file`, used to detect when `path` stops referring to it.
+    id: (u64, u64),
+
+    /// Last time we checked whether the file was rotated.
+    last_check: Instant,
+}
+
+impl LogFile {
+    /// Opens or creates the log file at `path` for appending.
+    fn open(path: &Path) -> io::Result<LogFile> {
+        let file = fs::OpenOptions::new().create(true).append(true).open(path)?;
+        let metadata = file.metadata()?;
+        Ok(LogFile {
+            path: path.to_owned(),
+            file,
+            id: (metadata.dev(), metadata.ino()),
+            last_check: Instant::now(),
+        })
+    }
+
+    /// Reopens the log file if its path does not refer to the file we have open anymore, which
+    /// happens when the file is renamed or deleted as part of a rotation.
+    ///
+    /// This is rate-limited because it is called for every message.  If reopening fails, the
+    /// messages keep going to the old file, which is better than dropping them.
+    fn reopen_if_rotated(&mut self) {
+        let now = Instant::now();
+        if now.duration_since(self.last_check) < Duration::from_secs(ROTATION_CHECK_PERIOD_SECS) {
+            return;
+        }
+        self.last_check = now;
+
+        let rotated = match fs::metadata(&self.path) {
+            Ok(metadata) => (metadata.dev(), metadata.ino()) != self.id,
+            Err(_) => true,
+        };
+        if rotated {
+            match LogFile::open(&self.path) {
+                Ok(file) => *self = file,
+                Err(e) => {
+                    let message = format!("Cannot reopen rotated log file {}: {}\n",
+                        self.path.display(), e);
+                    let _ = self.file.write_all(message.as_bytes());
+                },
+            }
+        }
+    }
+
+    /// Appends `line` to the log file.
+    ///
+    /// Errors are ignored because there is nowhere else to report them.
+    fn write_line(&mut self, line: &str) {
+        self.reopen_if_rotated();
+        let _ = self.file.write_all(line.as_bytes());
+    }
+}
+
+/// Creates a new logger builder that writes messages in the given `format`.
+fn new_builder(format: LogFormat, level: Option<LevelFilter>) -> env_logger::Builder {
+    let mut builder = match level {
+        Some(level) => {
+            let mut builder = env_logger::Builder::new();
+            builder.filter(None, level);
+            builder
+        },
+        None => env_logger::Builder::from_env(env_logger::Env::default()),
+    };
+    if format == LogFormat::Json {
+        builder.format(format_json);
+    }
+    builder
+}
+
+/// Target of the messages with which the FUSE library traces every request it receives.
+const FUSE_TRACE_TARGET: &str = "fuse::request";
+
+/// Whether the trace of requests written by the FUSE library has been replaced by ours.
+static FUSE_TRACE_SUPPRESSED: AtomicBool = AtomicBool::new(false);
+
+/// Drops the trace of requests written by the FUSE library, which cannot be filtered because it
+/// only gives us strings, in favor of the one written by sandboxfs subject to a `RequestFilter`.
+pub fn suppress_fuse_trace() {
+    FUSE_TRACE_SUPPRESSED.store(true, Ordering::SeqCst);
+}
+
+/// Filters for the trace of requests written when debug logging is enabled.
+///
+/// A request is traced only if it passes all of the filters that are set.
+#[derive(Debug, Default)]
+pub struct RequestFilter {
+    /// Operations to trace, or all of them if empty.
+    pub ops: Vec<Op>,
+
+    /// Path within the file system under which to trace requests, or everywhere if none.
+    pub path_prefix: Option<PathBuf>,
+}
+
+impl RequestFilter {
+    /// Returns true if no filters are set.
+    pub fn is_empty(&self) -> bool {
+        self.ops.is_empty() && self.path_prefix.is_none()
+    }
+
+    /// Returns true if requests for `op` pass the operations filter.
+    pub fn matches_op(&self, op: Op) -> bool {
+        self.ops.is_empty() || self.ops.contains(&op)
+    }
+
+    /// Returns true if requests on `path` pass the path prefix filter.  `path` is none if the
+    /// path of the request's target is not known, in which case only the lack of a filter passes.
+    pub fn matches_path(&self, path: Option<&Path>) -> bool {
+        match self.path_prefix {
+            Some(ref prefix) => path.map_or(false, |path| path.starts_with(prefix)),
+            None => true,
+        }
+    }
+}
+
+/// Logger that forwards messages to one of two `env_logger` instances depending on whether debug
+/// logging has been toggled on at runtime.
+struct ToggleableLogger {
+    /// Logger configured from the environment, used while debug logging is off.
+    default: env_logger::Logger,
+
+    /// Logger that lets all debug messages through, used while debug logging is on.
+    debug: env_logger::Logger,
+
+    /// Format of the messages, needed to write them to `file` on our own.
+    format: LogFormat,
+
+    /// File to write messages to instead of stderr, if any.  The `env_logger` instances are then
+    /// only used to decide which messages to write.
+    file: Option<Mutex<LogFile>>,
+}
+
+impl ToggleableLogger {
+    /// Returns the logger to use given the current debug logging state.
+    fn current(&self) -> &env_logger::Logger {
+        if DEBUG_ENABLED.load(Ordering::Relaxed) { &self.debug } else { &self.default }
+    }
+}
+
+impl Log for ToggleableLogger {
+    fn enabled(&self, metadata: &Metadata) -> bool {
+        self.current().enabled(metadata)
+    }
+
+    fn log(&self, record: &Record) {
+        if record.target() == FUSE_TRACE_TARGET && FUSE_TRACE_SUPPRESSED.load(Ordering::Relaxed) {
+            return;
+        }
+        match self.file {
+            Some(ref file) => {
+                if !self.current().matches(record) {
+                    return;
+                }
+                let line = match self.format {
+                    LogFormat::Json => json_line(record),
+                    LogFormat::Text => text_line(record),
+                };
+                file.lock().unwrap().write_line(&line);
+            },
+            None => self.current().log(record),
+        }
+    }
+
+    fn flush(&self) {
+        match self.file {
+            Some(ref file) => { let _ = file.lock().unwrap().file.flush(); },
+            None => self.current().flush(),
+        }
+    }
+}
+
+/// Whether log messages are being written to a file instead of stderr.
+static FILE_ENABLED: AtomicBool = AtomicBool::new(false);
+
+/// Initializes logging to write messages in the given `format`.
+///
+/// The maximum level of the messages to write is `level` if given, or else comes from the
+/// configuration in the `RUST_LOG` environment variable.
+///
+/// Messages go to stderr unless `file` is given, in which case they are appended to that file,
+/// which is reopened when it is rotated.  The file is opened right away so that any problems
+/// with it are reported before mounting the file system.
+///
+/// Debug logging can later be enabled and disabled at runtime with `toggle_debug`.
+pub fn init_logging(format: LogFormat, level: Option<LevelFilter>, file: Option<&Path>)
+    -> io::Result<()> {
+    let file = match file {
+        Some(path) => Some(Mutex::new(LogFile::open(path)?)),
+        None => None,
+    };
+
+    let default = new_builder(format, level).build();
+    let debug = new_builder(format, Some(LevelFilter::Debug)).build();
+
+    let max_level = default.filter();
+    DEFAULT_MAX_LEVEL.store(max_level as usize, Ordering::SeqCst);
+    FILE_ENABLED.store(file.is_some(), Ordering::SeqCst);
+    log::set_boxed_logger(Box::new(ToggleableLogger { default, debug, format, file }))
+        .expect("Logging must only be initialized once");
+    log::set_max_level(max_level);
+    JSON_ENABLED.store(format == LogFormat::Json, Ordering::SeqCst);
+    Ok(())
+}
+
+/// Returns true if log messages are being written to a file instead of stderr.
+pub fn log_file_enabled() -> bool {
+    FILE_ENABLED.load(Ordering::SeqCst)
+}
+
+/// Returns true if log messages are being written as JSON objects, in which case all diagnostics
+/// should go through the logger instead of being printed to stderr directly.
+pub fn json_enabled() -> bool {
+    JSON_ENABLED.load(Ordering::SeqCst)
+}
+
+/// Flips debug logging on or off and returns the new state.
+///
+/// This is safe to call while other threads are logging: the switch between the default and the
+/// debug configurations is atomic.
+pub fn toggle_debug() -> bool {
+    let enabled = !DEBUG_ENABLED.fetch_xor(true, Ordering::SeqCst);
+    let default_max_level = level_filter_from_usize(DEFAULT_MAX_LEVEL.load(Ordering::SeqCst));
+    if enabled {
+        log::set_max_level(cmp::max(default_max_level, LevelFilter::Debug));
+    } else {
+        log::set_max_level(default_max_level);
+    }
+    enabled
+}
+
+/// Limits how often a recurring log message is written so that a condition that repeats for
+/// every request does not flood the logs.
+pub struct RateLimiter {
+    /// Minimum number of seconds between two written messages.
+    period_secs: usize,
+
+    /// Time at which the last message was written, in seconds since the epoch, or 0 if none.
+    last_secs: AtomicUsize,
+
+    /// Number of messages dropped since the last one was written.
+    suppressed: AtomicUsize,
+}
+
+impl RateLimiter {
+    /// Creates a limiter that lets through at most one message every `period_secs` seconds.
+    pub const fn new(period_secs: usize) -> RateLimiter {
+        RateLimiter {
+            period_secs,
+            last_secs: AtomicUsize::new(0),
+            suppressed: AtomicUsize::new(0),
+        }
+    }
+
+    /// Checks whether a message can be written at `now_secs`.
+    fn check_at(&self, now_secs: usize) -> Option<usize> {
+        let last = self.last_secs.load(Ordering::SeqCst);
+        let due = last == 0 || now_secs >= last + self.period_secs;
+        if !due || self.last_secs.compare_exchange(
+            last, now_secs, Ordering::SeqCst, Ordering::SeqCst).is_err() {
+            self.suppressed.fetch_add(1, Ordering::SeqCst);
+            return None;
+        }
+        Some(self.suppressed.swap(0, Ordering::SeqCst))
+    }
+
+    /// Checks whether a message can be written now.
+    ///
+    /// Returns the number of messages dropped since the last one was written if the caller should
+    /// write its message, which it should then mention, or `None` if the caller must drop it.
+    pub fn check(&self) -> Option<usize> {
+        let now = SystemTime::now().duration_since(UNIX_EPOCH)
+            .map(|d| d.as_secs() as usize)
+            .unwrap_or(1);
+        self.check_at(now)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::tempdir;
+
+    #[test]
+    fn test_level_filter_from_usize_round_trip() {
+        for level in &[LevelFilter::Off, LevelFilter::Error, LevelFilter::Warn, LevelFilter::Info,
+            LevelFilter::Debug, LevelFilter::Trace] {
+            assert_eq!(*level, level_filter_from_usize(*level as usize));
+        }
+    }
+
+    #[test]
+    fn test_request_filter_empty() {
+        let filter = RequestFilter::default();
+        assert!(filter.is_empty());
+        assert!(filter.matches_op(Op::Read));
+        assert!(filter.matches_path(None));
+        assert!(filter.matches_path(Some(Path::new("/a"))));
+    }
+
+    #[test]
+    fn test_request_filter_ops() {
+        let filter = RequestFilter { ops: vec!(Op::Lookup, Op::Getattr), path_prefix: None };
+        assert!(!filter.is_empty());
+        assert!(filter.matches_op(Op::Lookup));
+        assert!(filter.matches_op(Op::Getattr));
+        assert!(!filter.matches_op(Op::Read));
+    }
+
+    #[test]
+    fn test_request_filter_path_prefix() {
+        let filter = RequestFilter { ops: vec!(), path_prefix: Some(PathBuf::from("/out/foo")) };
+        assert!(!filter.is_empty());
+        assert!(filter.matches_path(Some(Path::new("/out/foo"))));
+        assert!(filter.matches_path(Some(Path::new("/out/foo/bar"))));
+        assert!(!filter.matches_path(Some(Path::new("/out/foobar"))));
+        assert!(!filter.matches_path(Some(Path::new("/out"))));
+        assert!(!filter.matches_path(None));
+    }
+
+    #[test]
+    fn test_log_file_reopens_after_rotation() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("log");
+        let rotated = dir.path().join("log.1");
+
+        let mut file = LogFile::open(&path).unwrap();
+        file.write_line("first\n");
+        fs::rename(&path, &rotated).unwrap();
+        file.write_line("second\n");
+        file.last_check -= Duration::from_secs(ROTATION_CHECK_PERIOD_SECS);
+        file.write_line("third\n");
+
+        assert_eq!("first\nsecond\n", fs::read_to_string(&rotated).unwrap());
+        assert_eq!("third\n", fs::read_to_string(&path).unwrap());
+    }
+
+    #[test]
+    fn test_rate_limiter_counts_suppressed() {
+        let limiter = RateLimiter::new(10);
+        assert_eq!(Some(0), limiter.check_at(100));
+        assert_eq!(None, limiter.check_at(100));
+        assert_eq!(None, limiter.check_at(109));
+        assert_eq!(Some(2), limiter.check_at(110));
+        assert_eq!(None, limiter.check_at(115));
+        assert_eq!(Some(1), limiter.check_at(500));
+        assert_eq!(Some(0), limiter.check_at(510));
+    }
+}
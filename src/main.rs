@@ -19,22 +19,34 @@
 #![warn(unused, unused_extern_crates, unused_import_braces, unused_qualifications)]
 #![warn(unsafe_code)]
 
-extern crate env_logger;
 #[macro_use] extern crate failure;
 extern crate getopts;
 #[macro_use] extern crate log;
 extern crate sandboxfs;
+extern crate serde_derive;
+#[cfg(test)] extern crate tempfile;
 extern crate time;
 
 use failure::{Fallible, ResultExt};
 use getopts::Options;
+use serde_derive::{Deserialize, Serialize};
 use std::env;
-use std::path::{Path, PathBuf};
+use std::fs;
+use std::io::{self, BufRead, Read, Write};
+use std::net::{Shutdown, SocketAddr};
+use std::os::unix::net::UnixStream;
+use std::os::unix::process as unix_process;
+use std::path::{Component, Path, PathBuf};
 use std::process;
 use std::result::Result;
 use std::sync::Arc;
+use std::thread;
+use std::time::Duration;
 use time::Timespec;
 
+/// Default value of the `--fs_name` and `--subtype` flags.
+static DEFAULT_FS_NAME: &str = "sandboxfs";
+
 /// Default value of the `--input` and `--output` flags.
 static DEFAULT_INOUT: &str = "-";
 
@@ -44,9 +56,24 @@ static DEFAULT_INOUT: &str = "-";
 /// parsed with the same semantics as user-provided values.
 static DEFAULT_TTL: &str = "60s";
 
+/// Default value of the `--negative_ttl` flag.
+///
+/// This is expressed as a string rather than a parsed value to ensure the default value can be
+/// parsed with the same semantics as user-provided values.
+static DEFAULT_NEGATIVE_TTL: &str = "0s";
+
+/// Default value of the `--shutdown_timeout` flag.
+///
+/// This is expressed as a string rather than a parsed value to ensure the default value can be
+/// parsed with the same semantics as user-provided values.
+static DEFAULT_SHUTDOWN_TIMEOUT: &str = "0s";
+
 /// Suffix for durations expressed in seconds.
 static SECONDS_SUFFIX: &str = "s";
 
+/// Default value of the `--mount_retry_delay` flag.
+static DEFAULT_MOUNT_RETRY_DELAY: &str = "1s";
+
 /// Execution failure due to a user-triggered error.
 #[derive(Debug, Fail)]
 #[fail(display = "{}", message)]
@@ -57,27 +84,23 @@ struct UsageError {
 /// Parses the value of a flag that controls who has access to the mount point.
 ///
 /// Returns the collection of options, if any, to be passed to the FUSE mount operation in order to
-/// grant the requested permissions.
-fn parse_allow(s: &str) -> Fallible<&'static [&'static str]> {
+/// grant the requested permissions, and whether sandboxfs must enforce on its own that only the
+/// user running it and root have access to the file system.
+fn parse_allow(s: &str) -> Fallible<(&'static [&'static str], bool)> {
     match s {
-        "other" => Ok(&["-o", "allow_other"]),
+        "other" => Ok((&["-o", "allow_other"], false)),
         "root" => {
             if cfg!(target_os = "linux") {
-                // "-o allow_root" is broken on Linux because this is not actually a
-                // fusermount option: it is a libfuse option and the Go bindings don't
-                // implement it as such.  We could implement this on our own by handling
-                // allow_root as if it were allow_other with an explicit user check... but
-                // it's probably not worth doing.  For now, just tell the user that we know
-                // about the breakage.
-                //
-                // See https://github.com/bazil/fuse/issues/144 for context (which is about Go
-                // but applies equally here).
-                Err(format_err!("--allow=root is known to be broken on Linux"))
+                // "-o allow_root" is not a fusermount option on Linux: it is a libfuse option
+                // that libfuse implements as "-o allow_other" plus a check of the caller's
+                // credentials on every request.  The fuse crate does not use libfuse's request
+                // loop, so we have to do the same on our own.
+                Ok((&["-o", "allow_other"], true))
             } else {
-                Ok(&["-o", "allow_root"])
+                Ok((&["-o", "allow_root"], false))
             }
         },
-        "self" => Ok(&[]),
+        "self" => Ok((&[], false)),
         _ => {
             let message = format!("{} must be one of other, root, or self", s);
             Err(UsageError { message }.into())
@@ -85,6 +108,186 @@ fn parse_allow(s: &str) -> Fallible<&'static [&'static str]> {
     }
 }
 
+/// Parses the value of a flag that names the file system in the mount table.
+///
+/// `flag` is the name of the flag being parsed and is only used for error reporting.  An empty
+/// `value` selects the default name.  Names containing commas or whitespace are rejected because
+/// they would otherwise corrupt the FUSE mount options, which results in obscure errors.
+fn parse_fs_name(flag: &str, value: &str) -> Result<String, UsageError> {
+    if value.is_empty() {
+        Ok(DEFAULT_FS_NAME.to_owned())
+    } else if value.contains(|c: char| c == ',' || c.is_whitespace()) {
+        let message = format!("invalid --{} {}: cannot contain commas or whitespace", flag, value);
+        Err(UsageError { message })
+    } else {
+        Ok(value.to_owned())
+    }
+}
+
+/// Parses the value of `--debug_ops` into the list of operations to trace.
+fn parse_debug_ops(value: &str) -> Result<Vec<sandboxfs::Op>, UsageError> {
+    let mut ops = vec!();
+    for name in value.split(',') {
+        match sandboxfs::Op::from_name(name) {
+            Some(op) => ops.push(op),
+            None => return Err(UsageError {
+                message: format!("invalid --debug_ops {}: unknown operation {}; must be one of {}",
+                    value, name, sandboxfs::Op::names().join(", "))
+            }),
+        }
+    }
+    Ok(ops)
+}
+
+/// Parses the value of `--debug_path_prefix`, which must be an absolute and normalized path.
+fn parse_debug_path_prefix(value: &str) -> Result<PathBuf, UsageError> {
+    let path = PathBuf::from(value);
+    if !path.is_absolute() {
+        return Err(UsageError {
+            message: format!("invalid --debug_path_prefix {}: must be absolute", value)
+        });
+    }
+    if path.components().any(|c| c == Component::CurDir || c == Component::ParentDir) {
+        return Err(UsageError {
+            message: format!("invalid --debug_path_prefix {}: must be normalized", value)
+        });
+    }
+    Ok(path)
+}
+
+/// Parses the value of `--log_format`.
+fn parse_log_format(value: &str) -> Result<sandboxfs::LogFormat, UsageError> {
+    match value {
+        "json" => Ok(sandboxfs::LogFormat::Json),
+        "text" => Ok(sandboxfs::LogFormat::Text),
+        _ => Err(UsageError {
+            message: format!("invalid --log_format {}: must be text or json", value)
+        }),
+    }
+}
+
+/// Parses the value of `--log_level`.
+fn parse_log_level(value: &str) -> Result<log::LevelFilter, UsageError> {
+    match value {
+        "debug" => Ok(log::LevelFilter::Debug),
+        "info" => Ok(log::LevelFilter::Info),
+        "warn" => Ok(log::LevelFilter::Warn),
+        "error" => Ok(log::LevelFilter::Error),
+        _ => Err(UsageError {
+            message: format!("invalid --log_level {}: must be debug, info, warn or error", value)
+        }),
+    }
+}
+
+/// Reports the error `message` on stderr.
+///
+/// The message goes through the logger when it writes JSON so that log parsers see the error as
+/// one more event instead of as an unparseable line, and also when it writes to a file so that
+/// the file has the full history.
+fn report_error(program: &str, message: &str) {
+    if !sandboxfs::json_enabled() {
+        eprintln!("{}: {}", program, message);
+    }
+    if sandboxfs::json_enabled() || sandboxfs::log_file_enabled() {
+        error!("{}", message);
+    }
+}
+
+/// Parses the value of the `--max_read_bytes` flag into the size to pass to the kernel.
+///
+/// The kernel silently raises sizes below a page and the mount option only holds 32 bits, so
+/// reject values outside of those limits instead of pretending to honor them.
+fn parse_max_read(value: &str) -> Result<u32, UsageError> {
+    let size = parse_size(value).map_err(|e| {
+        UsageError { message: format!("invalid --max_read_bytes {}: {}", value, e) }
+    })?;
+    if size < 4096 || size > u64::from(std::u32::MAX) {
+        let message = format!(
+            "invalid --max_read_bytes {}: must be at least 4K and less than 4G", value);
+        return Err(UsageError { message });
+    }
+    Ok(size as u32)
+}
+
+/// Returns the mount options that `--fuse_option` accepts on the current platform along with
+/// whether they take a value.
+///
+/// Options are only added here once we know that they do not interfere with how sandboxfs works.
+fn allowed_fuse_options() -> &'static [(&'static str, bool)] {
+    if cfg!(target_os = "linux") {
+        &[("auto_unmount", false), ("noatime", false), ("nonempty", false)]
+    } else if cfg!(target_os = "macos") {
+        &[("daemon_timeout", true), ("local", false), ("nobrowse", false), ("volname", true)]
+    } else {
+        &[]
+    }
+}
+
+/// Parses the value of a `--fuse_option` flag into the mount option to pass to FUSE.
+///
+/// The option has to be in the allowlist of the current platform, and the error lists the valid
+/// choices otherwise.  Values containing commas are rejected because they would otherwise corrupt
+/// the FUSE mount options.
+fn parse_fuse_option(value: &str) -> Result<String, UsageError> {
+    let fail = |reason: String| {
+        UsageError { message: format!("invalid --fuse_option {}: {}", value, reason) }
+    };
+
+    let (name, option_value) = match value.find('=') {
+        Some(pos) => (&value[..pos], Some(&value[pos + 1..])),
+        None => (value, None),
+    };
+    let takes_value = match allowed_fuse_options().iter().find(|(allowed, _)| *allowed == name) {
+        Some((_, takes_value)) => *takes_value,
+        None => {
+            let allowed = allowed_fuse_options().iter()
+                .map(|(name, takes_value)| {
+                    if *takes_value { format!("{}=VALUE", name) } else { (*name).to_owned() }
+                })
+                .collect::<Vec<String>>();
+            let reason = if allowed.is_empty() {
+                "no options are supported on this platform".to_owned()
+            } else {
+                format!("unsupported option; must be one of {}", allowed.join(", "))
+            };
+            return Err(fail(reason));
+        },
+    };
+    match option_value {
+        Some(_) if !takes_value => Err(fail(format!("{} does not take a value", name))),
+        None if takes_value => Err(fail(format!("{} requires a value", name))),
+        Some(option_value) if option_value.contains(',') => {
+            Err(fail("cannot contain commas".to_owned()))
+        },
+        _ => Ok(value.to_owned()),
+    }
+}
+
+/// Parses the value of the `--volume_icon` flag into the path to pass to OSXFUSE.
+///
+/// OSXFUSE silently ignores icons that it cannot read, so check for the file upfront.  Paths
+/// containing commas are rejected because they would otherwise corrupt the FUSE mount options.
+fn parse_volume_icon(value: &str) -> Result<String, UsageError> {
+    if value.contains(',') {
+        let message = format!("invalid --volume_icon {}: cannot contain commas", value);
+        return Err(UsageError { message });
+    }
+    fs::metadata(value).map_err(|e| {
+        UsageError { message: format!("invalid --volume_icon {}: {}", value, e) }
+    })?;
+    Ok(value.to_owned())
+}
+
+/// Fails if `flag`, which maps to a mount option that only OSXFUSE implements, was given on any
+/// other platform.
+fn require_macos(flag: &str) -> Result<(), UsageError> {
+    if cfg!(target_os = "macos") {
+        Ok(())
+    } else {
+        Err(UsageError { message: format!("--{} is only supported on macOS", flag) })
+    }
+}
+
 /// Parses the value of a flag that takes a duration, which must specify its unit.
 fn parse_duration(s: &str) -> Result<Timespec, UsageError> {
     let (value, unit) = match s.find(|c| !char::is_ascii_digit(&c) && c != '-') {
@@ -107,48 +310,357 @@ fn parse_duration(s: &str) -> Result<Timespec, UsageError> {
         .map_err(|e| UsageError { message: format!("invalid time specification {}: {}", s, e) })
 }
 
+/// Parses the optional numeric user or group identifier given to the flag `name`.
+fn parse_id(name: &str, value: Option<String>) -> Result<Option<u32>, UsageError> {
+    match value {
+        Some(value) => value.parse::<u32>().map(Some).map_err(|e| {
+            UsageError { message: format!("invalid --{} {}: {}", name, value, e) }
+        }),
+        None => Ok(None),
+    }
+}
+
+/// Parses a size in bytes with an optional binary unit suffix (`K`, `M` or `G`).
+fn parse_size(s: &str) -> Result<u64, UsageError> {
+    let (value, multiplier) = match s.chars().last() {
+        Some('K') => (&s[..s.len() - 1], 1 << 10),
+        Some('M') => (&s[..s.len() - 1], 1 << 20),
+        Some('G') => (&s[..s.len() - 1], 1 << 30),
+        _ => (s, 1),
+    };
+    value.parse::<u64>()
+        .map_err(|e| UsageError { message: format!("invalid size {}: {}", s, e) })
+        .and_then(|value| value.checked_mul(multiplier).ok_or_else(|| {
+            UsageError { message: format!("invalid size {}: too large", s) }
+        }))
+}
+
+/// Parses the comma-separated list of options of a mapping.
+///
+/// Options are exclude patterns, each prefixed by `!`, the `uid=N`, `gid=N` and `strict`
+/// settings to squash the ownership of the files in the mapping, `noexec` to forbid executing
+/// them, `perm=MASK` to mask their permissions with an octal value, `optional` to allow the
+/// target to not exist yet, and `type=dir` or `type=file` to declare the type of the target.
+fn parse_mapping_options(s: &str) -> Result<sandboxfs::MappingOptions, UsageError> {
+    let mut options = sandboxfs::MappingOptions::default();
+    let mut squash = sandboxfs::Squash { uid: None, gid: None, strict: false };
+    for option in s.split(',') {
+        if option.starts_with('!') {
+            options.excludes.push(option[1..].to_owned());
+        } else if option == "strict" {
+            squash.strict = true;
+        } else if option == "noexec" {
+            options.noexec = true;
+        } else if option == "optional" {
+            options.optional = true;
+        } else if option.starts_with("type=") {
+            options.target_type = Some(option[5..].parse::<sandboxfs::TargetType>().map_err(|e| {
+                UsageError { message: format!("invalid option {}: {}", option, e) }
+            })?);
+        } else if option.starts_with("perm=") {
+            let mask = u32::from_str_radix(&option[5..], 8).map_err(|e| {
+                UsageError { message: format!("invalid option {}: {}", option, e) }
+            })?;
+            options.perm_mask = Some(mask);
+        } else if let Some(pos) = option.find('=') {
+            let (name, value) = (&option[..pos], &option[pos + 1..]);
+            let id = match name {
+                "uid" | "gid" => value.parse::<u32>().map_err(|e| {
+                    UsageError { message: format!("invalid option {}: {}", option, e) }
+                })?,
+                _ => {
+                    let message = format!("invalid option {}: unknown name {}", option, name);
+                    return Err(UsageError { message });
+                },
+            };
+            if name == "uid" {
+                squash.uid = Some(id);
+            } else {
+                squash.gid = Some(id);
+            }
+        } else {
+            let message = format!("invalid exclude pattern {}: must start with !", option);
+            return Err(UsageError { message });
+        }
+    }
+    if squash.uid.is_some() || squash.gid.is_some() || squash.strict {
+        options.squash = Some(squash);
+    }
+    Ok(options)
+}
+
+/// Splits a mapping specification into its colon-separated fields.
+///
+/// Colons and backslashes that are part of a field must be escaped with a backslash.
+fn split_mapping_fields(s: &str) -> Result<Vec<String>, UsageError> {
+    let mut fields = vec!(String::new());
+    let mut chars = s.chars();
+    while let Some(c) = chars.next() {
+        match c {
+            ':' => fields.push(String::new()),
+            '\\' => match chars.next() {
+                Some(c) if c == ':' || c == '\\' => fields.last_mut().unwrap().push(c),
+                Some(c) => {
+                    let message = format!("invalid escape sequence \\{}", c);
+                    return Err(UsageError { message });
+                },
+                None => {
+                    let message = "unterminated escape sequence".to_owned();
+                    return Err(UsageError { message });
+                },
+            },
+            c => fields.last_mut().unwrap().push(c),
+        }
+    }
+    Ok(fields)
+}
+
+/// Parses a single mapping specification of the form `TYPE:PATH:UNDERLYING_PATH`.
+///
+/// Read-only and read/write mappings take an optional `OPTIONS` field, copy-on-write mappings
+/// take an extra `SCRATCH_PATH` field, and in-memory mappings take no `UNDERLYING_PATH` but an
+/// optional `SIZE` instead.  Colons and backslashes within the fields must be escaped as
+/// described in `split_mapping_fields`.  Relative underlying and scratch paths are resolved
+/// against the current working directory.
+fn parse_mapping(arg: &str) -> Result<sandboxfs::Mapping, UsageError> {
+    let fields = split_mapping_fields(arg).map_err(|e| {
+        UsageError { message: format!("bad mapping {}: {}", arg, e) }
+    })?;
+    let fields: Vec<&str> = fields.iter().map(String::as_str).collect();
+    let (min_fields, max_fields, count) = match fields[0] {
+        "ro" | "rw" => (3, 4, "three or four"),
+        "cow" => (4, 4, "four"),
+        "tmp" => (2, 3, "two or three"),
+        _ => (3, 3, "three"),
+    };
+    if fields.len() < min_fields || fields.len() > max_fields {
+        let message = format!("bad mapping {}: expected {} colon-separated fields", arg, count);
+        return Err(UsageError { message });
+    }
+
+    let path = PathBuf::from(fields[1]);
+    let target = |field: &str| sandboxfs::make_absolute(PathBuf::from(field)).map_err(|e| {
+        UsageError { message: format!("bad mapping {}: cannot resolve {}: {}", arg, field, e) }
+    });
+    let mapping = match fields[0] {
+        "ro" | "rw" => {
+            let options = match fields.get(3) {
+                Some(options) => parse_mapping_options(options).map_err(|e| {
+                    UsageError { message: format!("bad mapping {}: {}", arg, e) }
+                })?,
+                None => sandboxfs::MappingOptions::default(),
+            };
+            sandboxfs::Mapping::from_parts_with(
+                path, target(fields[2])?, fields[0] == "rw", options)
+        },
+        "cow" => sandboxfs::Mapping::from_parts_cow(path, target(fields[2])?, target(fields[3])?),
+        "tmp" => {
+            let size_limit = match fields.get(2) {
+                Some(size) => Some(parse_size(size).map_err(|e| {
+                    UsageError { message: format!("bad mapping {}: {}", arg, e) }
+                })?),
+                None => None,
+            };
+            sandboxfs::Mapping::from_parts_memory(path, size_limit)
+        },
+        _ => {
+            let message = format!("bad mapping {}: type was {} but should be ro, rw, cow or tmp",
+                arg, fields[0]);
+            return Err(UsageError { message });
+        },
+    };
+    mapping.map_err(|e| {
+        // TODO(jmmv): Figure how to best leverage failure's cause propagation.  May need
+        // to define a custom ErrorKind to represent UsageError, instead of having a special
+        // error type.
+        UsageError { message: format!("bad mapping {}: {}", arg, e) }
+    })
+}
+
 /// Takes the list of strings that represent mappings (supplied via multiple instances of the
 /// `--mapping` flag) and returns a parsed representation of those flags.
 fn parse_mappings<T: AsRef<str>, U: IntoIterator<Item=T>>(args: U)
     -> Result<Vec<sandboxfs::Mapping>, UsageError> {
     let mut mappings = Vec::new();
-
     for arg in args {
-        let arg = arg.as_ref();
+        mappings.push(parse_mapping(arg.as_ref())?);
+    }
+    Ok(mappings)
+}
 
-        let fields: Vec<&str> = arg.split(':').collect();
-        if fields.len() != 3 {
-            let message = format!("bad mapping {}: expected three colon-separated fields", arg);
-            return Err(UsageError { message });
+/// Parses the contents of a mapping file read from `reader`, which contains one mapping
+/// specification per line using the same syntax as the `--mapping` flag.
+///
+/// Blank lines and lines starting with `#` are ignored, and leading and trailing whitespace is
+/// stripped from every line.  `name` is the name of the file being read and is only used to
+/// prefix error messages along with the offending line number.
+fn parse_mapping_lines<R: BufRead>(name: &Path, reader: R) -> Fallible<Vec<sandboxfs::Mapping>> {
+    let mut mappings = Vec::new();
+    for (i, line) in reader.lines().enumerate() {
+        let line = line.with_context(|_| format!("Failed to read mapping file '{}'",
+            name.display()))?;
+        let line = line.trim();
+        if line.is_empty() || line.starts_with('#') {
+            continue;
         }
 
-        let writable = {
-            if fields[0] == "ro" {
-                false
-            } else if fields[0] == "rw" {
-                true
-            } else {
-                let message = format!("bad mapping {}: type was {} but should be ro or rw",
-                    arg, fields[0]);
-                return Err(UsageError { message });
-            }
-        };
-
-        let path = PathBuf::from(fields[1]);
-        let underlying_path = PathBuf::from(fields[2]);
-
-        match sandboxfs::Mapping::from_parts(path, underlying_path, writable) {
+        match parse_mapping(line) {
             Ok(mapping) => mappings.push(mapping),
             Err(e) => {
-                // TODO(jmmv): Figure how to best leverage failure's cause propagation.  May need
-                // to define a custom ErrorKind to represent UsageError, instead of having a special
-                // error type.
-                let message = format!("bad mapping {}: {}", arg, e);
-                return Err(UsageError { message });
+                let message = format!("{}:{}: {}", name.display(), i + 1, e);
+                return Err(UsageError { message }.into());
             }
         }
     }
+    Ok(mappings)
+}
+
+/// Reads the mappings contained in the file given by `path`.  See `parse_mapping_lines` for
+/// details on the format of the file.
+fn parse_mapping_file(path: &Path) -> Fallible<Vec<sandboxfs::Mapping>> {
+    let file = fs::File::open(path)
+        .with_context(|_| format!("Failed to open mapping file '{}'", path.display()))?;
+    parse_mapping_lines(path, io::BufReader::new(file))
+}
+
+/// Undoes the escaping of a field of a Bazel runfiles manifest entry, where `\s` stands for a space
+/// (only if `spaces` is true), `\n` for a newline and `\b` for a backslash.
+fn unescape_manifest_field(s: &str, spaces: bool) -> Result<String, String> {
+    let mut unescaped = String::with_capacity(s.len());
+    let mut chars = s.chars();
+    while let Some(c) = chars.next() {
+        if c != '\\' {
+            unescaped.push(c);
+            continue;
+        }
+        match chars.next() {
+            Some('s') if spaces => unescaped.push(' '),
+            Some('n') => unescaped.push('\n'),
+            Some('b') => unescaped.push('\\'),
+            Some(c) => return Err(format!("invalid escape sequence \\{}", c)),
+            None => return Err("unterminated escape sequence".to_owned()),
+        }
+    }
+    Ok(unescaped)
+}
+
+/// Parses a single entry of a Bazel runfiles manifest, of the form `PATH TARGET`, into the path of
+/// the entry within the runfiles tree and its target.
+///
+/// Entries that start with a space have their fields escaped as described in
+/// `unescape_manifest_field`, which allows `PATH` to contain spaces.  Entries without a target
+/// represent empty files and yield no target.
+fn parse_manifest_entry(line: &str) -> Result<(PathBuf, Option<PathBuf>), String> {
+    let (escaped, line) = if line.starts_with(' ') { (true, &line[1..]) } else { (false, line) };
+    let (path, target) = match line.find(' ') {
+        Some(i) => (&line[..i], &line[i + 1..]),
+        None => (line, ""),
+    };
+    let (path, target) = if escaped {
+        (unescape_manifest_field(path, true)?, unescape_manifest_field(target, false)?)
+    } else {
+        (path.to_owned(), target.to_owned())
+    };
+
+    let path = PathBuf::from(path);
+    if path.as_os_str().is_empty() {
+        return Err("missing path".to_owned());
+    }
+    if path.is_absolute() {
+        return Err(format!("path {} is not relative", path.display()));
+    }
+    if target.is_empty() {
+        return Ok((path, None));
+    }
+    let target = PathBuf::from(target);
+    if !target.is_absolute() {
+        return Err(format!("target {} is not absolute", target.display()));
+    }
+    Ok((path, Some(target)))
+}
+
+/// Parses the Bazel runfiles manifest read from `reader` into read-only mappings of each entry
+/// under `prefix`, all with the mapping `options` accepted by `parse_mapping_options`.
+///
+/// `name` is the name of the file being read and is only used to prefix error messages along with
+/// the offending line number.  Entries that represent empty files are skipped because there is no
+/// target to map them to.
+fn parse_manifest_lines<R: BufRead>(name: &Path, reader: R, prefix: &Path, options: &str)
+    -> Fallible<Vec<sandboxfs::Mapping>> {
+    let mapping_options = if options.is_empty() {
+        sandboxfs::MappingOptions::default()
+    } else {
+        parse_mapping_options(options).map_err(|e| UsageError {
+            message: format!("bad manifest options {}: {}", options, e)
+        })?
+    };
+
+    let mut mappings = Vec::new();
+    let mut empty_files = 0;
+    for (i, line) in reader.lines().enumerate() {
+        let line = line.with_context(|_| format!("Failed to read manifest '{}'",
+            name.display()))?;
+        if line.is_empty() {
+            continue;
+        }
+
+        let error = |e: String| {
+            UsageError { message: format!("{}:{}: {}", name.display(), i + 1, e) }
+        };
+        let (path, target) = parse_manifest_entry(&line).map_err(&error)?;
+        let target = match target {
+            Some(target) => target,
+            None => {
+                empty_files += 1;
+                continue;
+            },
+        };
+        let mapping = sandboxfs::Mapping::from_parts_with(
+            prefix.join(path), target, false, mapping_options.clone())
+            .map_err(|e| error(format!("bad entry: {}", e)))?;
+        mappings.push(mapping);
+    }
+    if empty_files > 0 {
+        warn!("Skipped {} entries for empty files in manifest '{}'", empty_files, name.display());
+    }
+    Ok(mappings)
+}
+
+/// Reads the mappings described by the value of a `--mapping_manifest` flag, which is of the form
+/// `PATH[:PREFIX[:OPTIONS]]`.  See `parse_manifest_lines` for details.
+fn parse_mapping_manifest(arg: &str) -> Fallible<Vec<sandboxfs::Mapping>> {
+    let fields = split_mapping_fields(arg).map_err(|e| {
+        UsageError { message: format!("bad --mapping_manifest {}: {}", arg, e) }
+    })?;
+    if fields.len() > 3 {
+        let message = format!("bad --mapping_manifest {}: expected one to three colon-separated \
+            fields", arg);
+        return Err(UsageError { message }.into());
+    }
+    let path = Path::new(&fields[0]);
+    let prefix = match fields.get(1) {
+        Some(prefix) if !prefix.is_empty() => Path::new(prefix),
+        _ => Path::new("/"),
+    };
+    if !prefix.is_absolute() {
+        let message = format!("bad --mapping_manifest {}: prefix {} is not absolute", arg,
+            prefix.display());
+        return Err(UsageError { message }.into());
+    }
+    let options = fields.get(2).map_or("", String::as_str);
 
+    let file = fs::File::open(path)
+        .with_context(|_| format!("Failed to open manifest '{}'", path.display()))?;
+    parse_manifest_lines(path, io::BufReader::new(file), prefix, options)
+}
+
+/// Reads the mappings described by all `--mapping_manifest` flags given in `args`, in order.
+fn parse_mapping_manifests<T: AsRef<str>, U: IntoIterator<Item=T>>(args: U)
+    -> Fallible<Vec<sandboxfs::Mapping>> {
+    let mut mappings = Vec::new();
+    for arg in args {
+        mappings.append(&mut parse_mapping_manifest(arg.as_ref())?);
+    }
     Ok(mappings)
 }
 
@@ -187,39 +699,192 @@ fn usage(program: &str, opts: &Options) {
     print!("{}", opts.usage(&brief));
 }
 
-/// Prints version information to stdout.
-fn version() {
-    println!("{} {}", env!("CARGO_PKG_NAME"), env!("CARGO_PKG_VERSION"));
+/// Build and version metadata as printed by `--version=json`.
+///
+/// The details that Cargo does not know about are provided by `build.rs`.
+#[derive(Debug, Serialize)]
+struct BuildInfo {
+    package_version: &'static str,
+    git_commit: &'static str,
+    rustc_version: &'static str,
+    fuse_version: &'static str,
+    build_timestamp: String,
+    target_os: &'static str,
+    target_arch: &'static str,
+}
+
+impl BuildInfo {
+    /// Gets the metadata of the running binary.
+    fn current() -> BuildInfo {
+        let timestamp = env!("SANDBOXFS_BUILD_TIMESTAMP").parse::<i64>()
+            .expect("build.rs must provide the build timestamp as seconds since the epoch");
+        BuildInfo {
+            package_version: env!("CARGO_PKG_VERSION"),
+            git_commit: env!("SANDBOXFS_BUILD_GIT_COMMIT"),
+            rustc_version: env!("SANDBOXFS_BUILD_RUSTC_VERSION"),
+            fuse_version: env!("SANDBOXFS_BUILD_FUSE_VERSION"),
+            build_timestamp: format!("{}", time::at_utc(Timespec::new(timestamp, 0)).rfc3339()),
+            target_os: env::consts::OS,
+            target_arch: env::consts::ARCH,
+        }
+    }
+}
+
+/// Prints version information to stdout in the given `format`, which is either the human-readable
+/// one if `None` or `json`.
+fn version(format: Option<&str>) -> Result<(), UsageError> {
+    match format {
+        None => println!("{} {}", env!("CARGO_PKG_NAME"), env!("CARGO_PKG_VERSION")),
+        Some("json") => {
+            let info = serde_json::to_string(&BuildInfo::current())
+                .expect("Serializing plain strings cannot fail");
+            println!("{}", info);
+        },
+        Some(format) => return Err(UsageError {
+            message: format!("invalid --version {}: must be json", format)
+        }),
+    }
+    Ok(())
 }
 
 /// Program's entry point.  This is a "safe" version of `main` in the sense that this doesn't
 /// directly handle errors: all errors are returned to the caller for consistent reporter to the
 /// user depending on their type.
 fn safe_main(program: &str, args: &[String]) -> Fallible<()> {
-    env_logger::init();
+    // Query this as early as possible to minimize the chances of our parent exiting before we
+    // know who it was; see --parent_death_unmount.
+    let parent = unix_process::parent_id();
 
     let cpus = num_cpus::get();
 
     let mut opts = Options::new();
     opts.optopt("", "allow", concat!("specifies who should have access to the file system",
         " (default: self)"), "other|root|self");
+    opts.optflag("", "allow_devices",
+        "allows creating block and character devices (dangerous; requires root)");
+    opts.optmulti("", "allowed_targets",
+        "only accepts mappings whose targets are within the given directories", "DIR[,DIR]");
+    opts.optopt("", "audit_log", "file to append a JSON record of each modification to",
+        "PATH");
+    opts.optflag("", "auto_unmount",
+        "unmounts the file system when sandboxfs is killed (Linux only)");
+    opts.optflag("", "case_insensitive",
+        "looks up names within the mappings ignoring case if they do not exist as given");
+    opts.optflag("", "confine_symlinks",
+        "refuses to access underlying files through paths that traverse symlinks");
     opts.optopt("", "cpu_profile", "enables CPU profiling and writes a profile to the given path",
         "PATH");
+    opts.optopt("", "debug_ops",
+        "only traces requests for the given operations when debug logging is on",
+        "OP[,OP]");
+    opts.optopt("", "debug_path_prefix",
+        "only traces requests on paths under the given one when debug logging is on", "PATH");
+    opts.optopt("", "drop_privileges_to",
+        "switches to the given user once the file system is mounted", "USER");
+    opts.optflag("", "dry_run", "validates the mappings and exits without mounting");
+    opts.optflag("", "enable_http_reconfig",
+        "accepts reconfigurations over HTTP (requires --listen_address)");
+    opts.optflag("", "enable_http_snapshot",
+        "writes trace snapshots on request over HTTP (requires --listen_address)");
+    opts.optflag("", "expose_underlying_inodes",
+        "reports the inode numbers of mapped files instead of synthesized ones");
+    opts.optflag("", "force", "unmounts a stale file system at the mount point before mounting");
+    opts.optopt("", "fs_name",
+        &format!("name of the file system in the mount table (default: {})", DEFAULT_FS_NAME),
+        "NAME");
+    opts.optmulti("", "fuse_option",
+        "adds a mount option from the allowed ones listed in the manual page", "NAME[=VALUE]");
+    opts.optopt("", "gid", "group to report as the owner of all files", "GID");
     opts.optflag("", "help", "prints usage information and exits");
+    opts.optflag("", "hide_fifos", "hides named pipes found within the mappings");
+    opts.optflag("", "hide_special_files",
+        "hides devices and sockets found within the mappings");
     opts.optopt("", "input",
         &format!("where to read reconfiguration data from ({} for stdin)", DEFAULT_INOUT),
         "PATH");
+    opts.optopt("", "io_timeout",
+        "how long an operation on an underlying file may take before failing with EIO",
+        &format!("TIME{}", SECONDS_SUFFIX));
+    opts.optflag("", "lazy_mapping_validation",
+        "defers inspecting the targets of plain mappings until they are first accessed");
+    opts.optopt("", "listen_address", "enables serving metrics over HTTP on the given address",
+        "HOST:PORT");
+    opts.optopt("", "log_file", "file to append log messages to instead of stderr", "PATH");
+    opts.optopt("", "log_format", "format of the log messages on stderr (default: text)",
+        "text|json");
+    opts.optopt("", "log_level", "maximum level of messages to log (default: RUST_LOG)",
+        "debug|info|warn|error");
+    opts.optopt("", "log_slow_ops", "logs operations that take longer than the given time",
+        &format!("TIME{}", SECONDS_SUFFIX));
     opts.optmulti("", "mapping", "type and locations of a mapping", "TYPE:PATH:UNDERLYING_PATH");
+    opts.optopt("", "mapping_file", "file with one mapping per line, applied before --mapping",
+        "PATH");
+    opts.optmulti("", "mapping_manifest",
+        "Bazel runfiles manifest whose entries to map read-only under PREFIX (default: /)",
+        "PATH[:PREFIX[:OPTIONS]]");
+    opts.optopt("", "max_open_files",
+        "number of open underlying files at which idle read-only ones start being closed \
+        (default: 90% of the open files limit)", "COUNT");
+    opts.optopt("", "max_read_bytes",
+        "largest read that the kernel may ask the file system for (Linux only)", "SIZE");
+    opts.optopt("", "mount_retries",
+        "number of times to retry mounting after a transient failure (default: 0)", "COUNT");
+    opts.optopt("", "mount_retry_delay",
+        &format!("how long to wait before the first mount retry (default: {})",
+            DEFAULT_MOUNT_RETRY_DELAY),
+        &format!("TIME{}", SECONDS_SUFFIX));
+    opts.optopt("", "negative_ttl",
+        &format!("how long the kernel is allowed to cache lookups of missing files (default: {})",
+            DEFAULT_NEGATIVE_TTL),
+        &format!("TIME{}", SECONDS_SUFFIX));
+    opts.optflag("", "noappledouble",
+        "hides and denies access to AppleDouble (._*) and .DS_Store files (macOS only)");
+    opts.optflag("", "noapplexattr",
+        "denies access to Apple-specific extended attributes (macOS only)");
     opts.optflag("", "node_cache", "enables the path-based node cache (known broken)");
+    opts.optflag("", "nonempty", "allows mounting over a non-empty directory (Linux only)");
+    opts.optflag("", "overlay", "merges mappings with the same path instead of rejecting them");
     opts.optopt("", "output",
         &format!("where to write the reconfiguration status to ({} for stdout)", DEFAULT_INOUT),
         "PATH");
+    opts.optflag("", "parent_death_unmount",
+        "unmounts the file system when the parent process exits");
+    opts.optopt("", "ready_fd",
+        "writes 1 to the given file descriptor once the file system is mounted", "FD");
+    opts.optopt("", "reconfig_socket",
+        "listens for reconfiguration requests on a Unix socket at the given path", "PATH");
     opts.optopt("", "reconfig_threads",
         &format!("number of reconfiguration threads (default: {})", cpus), "COUNT");
+    opts.optopt("", "shutdown_timeout",
+        &format!("how long to wait for open files to be closed on exit (default: {})",
+            DEFAULT_SHUTDOWN_TIMEOUT),
+        &format!("TIME{}", SECONDS_SUFFIX));
+    opts.optflag("", "stop_on_input_eof",
+        "unmounts the file system once the reconfiguration input is closed");
+    opts.optopt("", "subtype",
+        &format!("subtype of the file system in the mount table (default: {})", DEFAULT_FS_NAME),
+        "NAME");
+    opts.optopt("", "trace_profile",
+        "writes a trace of the operations to the given path for chrome://tracing or Perfetto",
+        "PATH");
+    opts.optopt("", "trace_profile_duration",
+        "stops tracing after the given time and writes the trace right away",
+        &format!("TIME{}", SECONDS_SUFFIX));
+    opts.optflag("", "track_reads", "tracks which files are read through the file system");
+    opts.optopt("", "track_reads_output",
+        "file to write the paths of the read files to on unmount (requires --track_reads)",
+        "PATH");
     opts.optopt("", "ttl",
         &format!("how long the kernel is allowed to keep file metadata (default: {})", DEFAULT_TTL),
         &format!("TIME{}", SECONDS_SUFFIX));
-    opts.optflag("", "version", "prints version information and exits");
+    opts.optopt("", "uid", "user to report as the owner of all files", "UID");
+    opts.optopt("", "unmount_timeout",
+        "how long to retry unmounting a busy file system on exit before detaching it",
+        &format!("TIME{}", SECONDS_SUFFIX));
+    opts.optflagopt("", "version",
+        "prints version information, as JSON if FORMAT is json, and exits", "FORMAT");
+    opts.optopt("", "volume_icon", "icon file to display for the file system (macOS only)",
+        "PATH");
     opts.optflag("", "xattrs", "enables support for extended attributes");
     let matches = opts.parse(args)?;
 
@@ -229,20 +894,137 @@ fn safe_main(program: &str, args: &[String]) -> Fallible<()> {
     }
 
     if matches.opt_present("version") {
-        version();
+        version(matches.opt_str("version").as_ref().map(String::as_str))?;
         return Ok(());
     }
 
-    let mut options = vec!("-o", "fsname=sandboxfs");
-    // TODO(jmmv): Support passing in arbitrary FUSE options from the command line, like "-o ro".
+    let log_format = match matches.opt_str("log_format") {
+        Some(value) => parse_log_format(&value)?,
+        None => sandboxfs::LogFormat::Text,
+    };
+    let log_level = match matches.opt_str("log_level") {
+        Some(value) => Some(parse_log_level(&value)?),
+        None => None,
+    };
+    let log_file = matches.opt_str("log_file");
+    let request_filter = sandboxfs::RequestFilter {
+        ops: match matches.opt_str("debug_ops") {
+            Some(value) => parse_debug_ops(&value)?,
+            None => vec!(),
+        },
+        path_prefix: match matches.opt_str("debug_path_prefix") {
+            Some(value) => Some(parse_debug_path_prefix(&value)?),
+            None => None,
+        },
+    };
+    sandboxfs::init_logging(log_format, log_level, log_file.as_ref().map(Path::new))
+        .with_context(|_| format!("Failed to open log file {}", log_file.unwrap_or_default()))?;
+
+    let fs_name_option = format!("fsname={}",
+        parse_fs_name("fs_name", &matches.opt_str("fs_name").unwrap_or_default())?);
+    let subtype_option = format!("subtype={}",
+        parse_fs_name("subtype", &matches.opt_str("subtype").unwrap_or_default())?);
+
+    let max_read_option = match matches.opt_str("max_read_bytes") {
+        Some(value) => {
+            let size = parse_max_read(&value)?;
+            if !cfg!(target_os = "linux") {
+                // OSXFUSE sizes its transfers via its own "iosize" option, which has different
+                // constraints.
+                return Err(UsageError {
+                    message: "--max_read_bytes is only supported on Linux".to_owned()
+                }.into());
+            }
+            Some(format!("max_read={}", size))
+        },
+        None => None,
+    };
+
+    let mut macos_options = vec!();
+    for flag in &["noappledouble", "noapplexattr"] {
+        if matches.opt_present(flag) {
+            require_macos(flag)?;
+            macos_options.push((*flag).to_owned());
+        }
+    }
+    if let Some(value) = matches.opt_str("volume_icon") {
+        let path = parse_volume_icon(&value)?;
+        require_macos("volume_icon")?;
+        macos_options.push(format!("volicon={}", path));
+    }
+
+    let fuse_options = matches.opt_strs("fuse_option").iter()
+        .map(|value| parse_fuse_option(value))
+        .collect::<Result<Vec<String>, UsageError>>()?;
+
+    if matches.opt_present("nonempty") && !cfg!(target_os = "linux") {
+        // OSXFUSE mounts over non-empty directories without asking.
+        return Err(UsageError {
+            message: "--nonempty is only supported on Linux".to_owned()
+        }.into());
+    }
+
+    if matches.opt_present("auto_unmount") && !cfg!(target_os = "linux") {
+        return Err(UsageError {
+            message: "--auto_unmount is only supported on Linux".to_owned()
+        }.into());
+    }
+
+    let mut options = vec!("-o", fs_name_option.as_str());
+    if cfg!(target_os = "linux") {
+        // OSXFUSE does not know about subtypes; passing one makes the mount fail.
+        options.push("-o");
+        options.push(subtype_option.as_str());
+    }
+    if let Some(max_read_option) = &max_read_option {
+        options.push("-o");
+        options.push(max_read_option.as_str());
+    }
+    if matches.opt_present("auto_unmount") {
+        options.push("-o");
+        options.push("auto_unmount");
+    }
+    if matches.opt_present("nonempty") {
+        options.push("-o");
+        options.push("nonempty");
+    }
+    for option in macos_options.iter().chain(fuse_options.iter()) {
+        options.push("-o");
+        options.push(option.as_str());
+    }
 
+    let mut owner_and_root_only = false;
     if let Some(value) = matches.opt_str("allow") {
-        for arg in parse_allow(&value)? {
+        let (args, enforce) = parse_allow(&value)?;
+        for arg in args {
             options.push(arg);
         }
+        owner_and_root_only = enforce;
     }
 
-    let mappings = parse_mappings(matches.opt_strs("mapping"))?;
+    let mappings = {
+        let mut mappings = match matches.opt_str("mapping_file") {
+            Some(path) => parse_mapping_file(Path::new(&path))?,
+            None => Vec::new(),
+        };
+        mappings.append(&mut parse_mapping_manifests(matches.opt_strs("mapping_manifest"))?);
+        mappings.append(&mut parse_mappings(matches.opt_strs("mapping"))?);
+        mappings
+    };
+
+    // The mapping file is reread on SIGHUP.  The --mapping flags cannot change so we could cache
+    // their parsed results, but reparsing them keeps the precedence rules in a single place.  The
+    // manifests are reread too because build tools rewrite them in place.
+    let reload_mappings = matches.opt_str("mapping_file").map(|path| {
+        let manifests = matches.opt_strs("mapping_manifest");
+        let flags = matches.opt_strs("mapping");
+        Box::new(move || {
+            let mut mappings = parse_mapping_file(Path::new(&path))?;
+            mappings.append(&mut parse_mapping_manifests(&manifests)?);
+            mappings.append(&mut parse_mappings(&flags)?);
+            Ok(mappings)
+        }) as sandboxfs::MappingsLoader
+    });
 
     let ttl = match matches.opt_str("ttl") {
         Some(value) => parse_duration(&value)?,
@@ -250,63 +1032,501 @@ fn safe_main(program: &str, args: &[String]) -> Fallible<()> {
             "default value for flag is not accepted by the parser; this is a bug in the value"),
     };
 
-    let input = {
-        let input_flag = matches.opt_str("input");
-        sandboxfs::open_input(file_flag(&input_flag))
-            .with_context(|_| format!("Failed to open reconfiguration input '{}'",
-                input_flag.unwrap_or_else(|| DEFAULT_INOUT.to_owned())))?
+    let negative_ttl = match matches.opt_str("negative_ttl") {
+        Some(value) => parse_duration(&value)?,
+        None => parse_duration(DEFAULT_NEGATIVE_TTL).expect(
+            "default value for flag is not accepted by the parser; this is a bug in the value"),
     };
 
-    let output = {
-        let output_flag = matches.opt_str("output");
-        sandboxfs::open_output(file_flag(&output_flag))
-            .with_context(|_| format!("Failed to open reconfiguration output '{}'",
-                output_flag.unwrap_or_else(|| DEFAULT_INOUT.to_owned())))?
+    let shutdown_timeout = {
+        let timespec = match matches.opt_str("shutdown_timeout") {
+            Some(value) => parse_duration(&value)?,
+            None => parse_duration(DEFAULT_SHUTDOWN_TIMEOUT).expect(
+                "default value for flag is not accepted by the parser; this is a bug in the value"),
+        };
+        Duration::new(timespec.sec as u64, timespec.nsec as u32)
     };
 
-    let reconfig_threads = match matches.opt_str("reconfig_threads") {
-        Some(value) => {
-            match value.parse::<usize>() {
-                Ok(n) => n,
-                Err(e) => return Err(UsageError {
-                    message: format!("invalid thread count {}: {}", value, e)
-                }.into()),
-            }
+    let mount_retries = match matches.opt_str("mount_retries") {
+        Some(value) => match value.parse::<u32>() {
+            Ok(n) => n,
+            Err(e) => return Err(UsageError {
+                message: format!("invalid --mount_retries {}: {}", value, e)
+            }.into()),
         },
-        None => cpus,
+        None => 0,
     };
 
-    let mount_point = if matches.free.len() == 1 {
-        Path::new(&matches.free[0])
-    } else {
-        return Err(UsageError { message: "invalid number of arguments".to_string() }.into());
+    let mount_retry_delay = {
+        let timespec = match matches.opt_str("mount_retry_delay") {
+            Some(value) => parse_duration(&value)?,
+            None => parse_duration(DEFAULT_MOUNT_RETRY_DELAY).expect(
+                "default value for flag is not accepted by the parser; this is a bug in the value"),
+        };
+        Duration::new(timespec.sec as u64, timespec.nsec as u32)
     };
 
-    let node_cache: sandboxfs::ArcCache = if matches.opt_present("node_cache") {
-        warn!("Using --node_cache is known to be broken under certain scenarios; see the manpage");
-        Arc::from(sandboxfs::PathCache::default())
-    } else {
-        Arc::from(sandboxfs::NoCache::default())
+    let unmount_timeout = match matches.opt_str("unmount_timeout") {
+        Some(value) => {
+            let timespec = parse_duration(&value)?;
+            Some(Duration::new(timespec.sec as u64, timespec.nsec as u32))
+        },
+        None => None,
     };
 
-    let _profiler;
-    if let Some(path) = matches.opt_str("cpu_profile") {
-        _profiler = sandboxfs::ScopedProfiler::start(&path).context("Failed to start CPU profile")?;
+    let io_timeout = match matches.opt_str("io_timeout") {
+        Some(value) => {
+            let timespec = parse_duration(&value)?;
+            if timespec.sec == 0 && timespec.nsec == 0 {
+                return Err(UsageError {
+                    message: format!("invalid --io_timeout {}: must be positive", value)
+                }.into());
+            }
+            Some(Duration::new(timespec.sec as u64, timespec.nsec as u32))
+        },
+        None => None,
     };
-    sandboxfs::mount(
-        mount_point, &options, &mappings, ttl, node_cache, matches.opt_present("xattrs"),
-        input, output, reconfig_threads)
-        .with_context(|_| format!("Failed to mount {}", mount_point.display()))?;
-    Ok(())
-}
 
-/// Program's entry point.  This delegates to `safe_main` for all program logic and is just in
-/// charge of consistently formatting and reporting all possible errors to the caller.
-fn main() {
-    let args: Vec<String> = env::args().collect();
-    let program = program_name(&args, "sandboxfs");
+    let slow_op_threshold = match matches.opt_str("log_slow_ops") {
+        Some(value) => {
+            let timespec = parse_duration(&value)?;
+            if timespec.sec == 0 && timespec.nsec == 0 {
+                return Err(UsageError {
+                    message: format!("invalid --log_slow_ops {}: must be positive", value)
+                }.into());
+            }
+            Some(Duration::new(timespec.sec as u64, timespec.nsec as u32))
+        },
+        None => None,
+    };
 
-    if let Err(err) = safe_main(&program, &args[1..]) {
+    let max_open_files = match matches.opt_str("max_open_files") {
+        Some(value) => match value.parse::<usize>() {
+            Ok(0) => return Err(UsageError {
+                message: format!("invalid --max_open_files {}: must be positive", value)
+            }.into()),
+            Ok(n) => Some(n),
+            Err(e) => return Err(UsageError {
+                message: format!("invalid --max_open_files {}: {}", value, e)
+            }.into()),
+        },
+        None => None,
+    };
+
+    let allowed_targets = if matches.opt_present("allowed_targets") {
+        let mut allowed_targets = vec!();
+        for value in matches.opt_strs("allowed_targets") {
+            for dir in value.split(',') {
+                let dir = Path::new(dir);
+                if !dir.is_absolute() {
+                    return Err(UsageError {
+                        message: format!("invalid --allowed_targets {}: {:?} is not absolute",
+                            value, dir)
+                    }.into());
+                }
+                match fs::canonicalize(dir) {
+                    Ok(dir) => allowed_targets.push(dir),
+                    Err(e) => return Err(UsageError {
+                        message: format!("invalid --allowed_targets {}: {:?}: {}", value, dir, e)
+                    }.into()),
+                }
+            }
+        }
+        Some(allowed_targets)
+    } else {
+        None
+    };
+
+    let allow_devices = matches.opt_present("allow_devices");
+    if allow_devices && !nix::unistd::geteuid().is_root() {
+        return Err(UsageError {
+            message: "--allow_devices requires running as root".to_owned()
+        }.into());
+    }
+
+    let drop_privileges_to = match matches.opt_str("drop_privileges_to") {
+        Some(value) => {
+            if !cfg!(target_os = "linux") {
+                // Privileges are dropped once the serving threads exist, which relies on the C
+                // library switching the credentials of all threads at once.  We only know this to
+                // hold on Linux.
+                return Err(UsageError {
+                    message: "--drop_privileges_to is only supported on Linux".to_owned()
+                }.into());
+            }
+            match sandboxfs::User::lookup(&value) {
+                Ok(user) => Some(user),
+                Err(e) => return Err(UsageError {
+                    message: format!("invalid --drop_privileges_to {}: {}", value, e)
+                }.into()),
+            }
+        },
+        None => None,
+    };
+
+    let reconfig_threads = match matches.opt_str("reconfig_threads") {
+        Some(value) => {
+            match value.parse::<usize>() {
+                Ok(n) => n,
+                Err(e) => return Err(UsageError {
+                    message: format!("invalid thread count {}: {}", value, e)
+                }.into()),
+            }
+        },
+        None => cpus,
+    };
+
+    let forced_owner = (parse_id("uid", matches.opt_str("uid"))?,
+        parse_id("gid", matches.opt_str("gid"))?);
+
+    let audit_log = matches.opt_str("audit_log").map(PathBuf::from);
+
+    let track_reads_output = matches.opt_str("track_reads_output").map(PathBuf::from);
+    if track_reads_output.is_some() && !matches.opt_present("track_reads") {
+        let message = "--track_reads_output requires --track_reads".to_owned();
+        return Err(UsageError { message }.into());
+    }
+
+    let trace_profile = matches.opt_str("trace_profile").map(PathBuf::from);
+    if trace_profile.is_some() && matches.opt_present("cpu_profile") {
+        let message = "--trace_profile cannot be combined with --cpu_profile".to_owned();
+        return Err(UsageError { message }.into());
+    }
+    let trace_profile_duration = match matches.opt_str("trace_profile_duration") {
+        Some(value) => {
+            if trace_profile.is_none() {
+                let message = "--trace_profile_duration requires --trace_profile".to_owned();
+                return Err(UsageError { message }.into());
+            }
+            let timespec = parse_duration(&value)?;
+            if timespec.sec == 0 && timespec.nsec == 0 {
+                return Err(UsageError {
+                    message: format!("invalid --trace_profile_duration {}: must be positive", value)
+                }.into());
+            }
+            Some(Duration::new(timespec.sec as u64, timespec.nsec as u32))
+        },
+        None => None,
+    };
+
+    let reconfig_socket = matches.opt_str("reconfig_socket").map(PathBuf::from);
+    if reconfig_socket.is_some() && (matches.opt_present("input")
+        || matches.opt_present("output") || matches.opt_present("stop_on_input_eof")) {
+        let message = concat!("--reconfig_socket cannot be combined with --input, --output nor ",
+            "--stop_on_input_eof").to_owned();
+        return Err(UsageError { message }.into());
+    }
+
+    let listen_address = match matches.opt_str("listen_address") {
+        Some(value) => match value.parse::<SocketAddr>() {
+            Ok(address) => Some(address),
+            Err(e) => return Err(UsageError {
+                message: format!("invalid --listen_address {}: {}", value, e)
+            }.into()),
+        },
+        None => None,
+    };
+    if matches.opt_present("enable_http_reconfig") && listen_address.is_none() {
+        let message = "--enable_http_reconfig requires --listen_address".to_owned();
+        return Err(UsageError { message }.into());
+    }
+    if matches.opt_present("enable_http_snapshot") && listen_address.is_none() {
+        let message = "--enable_http_snapshot requires --listen_address".to_owned();
+        return Err(UsageError { message }.into());
+    }
+
+    let ready_fd = match matches.opt_str("ready_fd") {
+        Some(value) => match value.parse::<i32>() {
+            Ok(fd) if fd >= 0 => Some(fd),
+            Ok(_) => return Err(UsageError {
+                message: format!("invalid --ready_fd {}: must not be negative", value)
+            }.into()),
+            Err(e) => return Err(UsageError {
+                message: format!("invalid --ready_fd {}: {}", value, e)
+            }.into()),
+        },
+        None => None,
+    };
+
+    let dry_run = matches.opt_present("dry_run");
+    let mount_point = match matches.free.len() {
+        0 if dry_run => None,
+        1 => Some(Path::new(&matches.free[0])),
+        _ => return Err(UsageError { message: "invalid number of arguments".to_string() }.into()),
+    };
+
+    if dry_run {
+        let errors = sandboxfs::check_mappings(&mappings, matches.opt_present("overlay"),
+            allowed_targets.as_ref().map(Vec::as_slice));
+        for err in &errors {
+            report_error(program, &sandboxfs::flatten_causes(err));
+        }
+        ensure!(errors.is_empty(), "Found {} invalid mapping(s)", errors.len());
+        return Ok(());
+    }
+    let mount_point = mount_point.expect("Mount point must be present when not in dry-run mode");
+
+    let ready = match ready_fd {
+        Some(fd) => Some(sandboxfs::open_ready_fd(fd)
+            .with_context(|_| format!("Cannot use --ready_fd {}", fd))?),
+        None => None,
+    };
+
+    let input = {
+        let input_flag = matches.opt_str("input");
+        sandboxfs::open_input(file_flag(&input_flag))
+            .with_context(|_| format!("Failed to open reconfiguration input '{}'",
+                input_flag.unwrap_or_else(|| DEFAULT_INOUT.to_owned())))?
+    };
+
+    let output = {
+        let output_flag = matches.opt_str("output");
+        sandboxfs::open_output(file_flag(&output_flag))
+            .with_context(|_| format!("Failed to open reconfiguration output '{}'",
+                output_flag.unwrap_or_else(|| DEFAULT_INOUT.to_owned())))?
+    };
+
+    let node_cache: sandboxfs::ArcCache = if matches.opt_present("node_cache") {
+        warn!("Using --node_cache is known to be broken under certain scenarios; see the manpage");
+        Arc::from(sandboxfs::PathCache::default())
+    } else {
+        Arc::from(sandboxfs::NoCache::default())
+    };
+
+    let _profiler;
+    if let Some(path) = matches.opt_str("cpu_profile") {
+        _profiler = sandboxfs::ScopedProfiler::start(&path).context("Failed to start CPU profile")?;
+    };
+    let mount_options = sandboxfs::MountOptions {
+        ttl: ttl,
+        negative_ttl: negative_ttl,
+        cache: node_cache,
+        xattrs: matches.opt_present("xattrs"),
+        overlay: matches.opt_present("overlay"),
+        expose_underlying_inodes: matches.opt_present("expose_underlying_inodes"),
+        owner_and_root_only: owner_and_root_only,
+        forced_owner: forced_owner,
+        shutdown_timeout: shutdown_timeout,
+        unmount_timeout: unmount_timeout,
+        io_timeout: io_timeout,
+        confine_symlinks: matches.opt_present("confine_symlinks"),
+        allowed_targets: allowed_targets,
+        allow_devices: allow_devices,
+        hide_special_files: matches.opt_present("hide_special_files"),
+        hide_fifos: matches.opt_present("hide_fifos"),
+        lazy_mappings: matches.opt_present("lazy_mapping_validation"),
+        case_insensitive: matches.opt_present("case_insensitive"),
+        request_filter: request_filter,
+        slow_op_threshold: slow_op_threshold,
+        audit_log: audit_log.as_ref().map(PathBuf::as_path),
+        track_reads: matches.opt_present("track_reads"),
+        track_reads_output: track_reads_output.as_ref().map(PathBuf::as_path),
+        trace_profile: trace_profile.as_ref().map(PathBuf::as_path),
+        trace_profile_duration: trace_profile_duration,
+        max_open_files: max_open_files,
+        listen_address: listen_address,
+        http_reconfig: matches.opt_present("enable_http_reconfig"),
+        http_snapshot: matches.opt_present("enable_http_snapshot"),
+        reconfig_socket: reconfig_socket.as_ref().map(PathBuf::as_path),
+        threads: reconfig_threads,
+        stop_on_input_eof: matches.opt_present("stop_on_input_eof"),
+        reload_mappings: reload_mappings,
+        ready: ready,
+        force: matches.opt_present("force"),
+        mount_retries: mount_retries,
+        mount_retry_delay: mount_retry_delay,
+        parent: if matches.opt_present("parent_death_unmount") { Some(parent) } else { None },
+        drop_privileges_to: drop_privileges_to,
+    };
+    sandboxfs::mount(mount_point, &options, &mappings, input, output, mount_options)
+        .with_context(|_| format!("Failed to mount {}", mount_point.display()))?;
+    Ok(())
+}
+
+/// Mapping within a reconfiguration request built by the `reconfigure` subcommand.
+#[derive(Debug, Eq, PartialEq, Serialize)]
+struct ReconfigureMapping {
+    path: PathBuf,
+    underlying_path: PathBuf,
+    writable: bool,
+}
+
+/// Reconfiguration request built by the `reconfigure` subcommand from its flags, serialized in the
+/// same format that sandboxfs accepts as input.
+#[derive(Debug, Eq, PartialEq, Serialize)]
+enum ReconfigureRequest {
+    CreateSandbox { id: String, mappings: Vec<ReconfigureMapping> },
+    DestroySandbox(String),
+    UnmapPaths { id: String, paths: Vec<PathBuf> },
+    ListMappings(String),
+}
+
+/// Response to a reconfiguration request, reduced to the fields the `reconfigure` subcommand needs.
+#[derive(Debug, Deserialize)]
+struct ReconfigureResponse {
+    error: Option<String>,
+}
+
+/// Parses a mapping given to the `reconfigure` subcommand, of the form `TYPE:PATH:UNDERLYING_PATH`
+/// where `TYPE` is either `ro` or `rw`.
+fn parse_reconfigure_mapping(arg: &str) -> Result<ReconfigureMapping, UsageError> {
+    let fields = split_mapping_fields(arg).map_err(|e| {
+        UsageError { message: format!("bad mapping {}: {}", arg, e) }
+    })?;
+    let writable = match fields[0].as_str() {
+        "ro" => false,
+        "rw" => true,
+        other => {
+            let message = format!("bad mapping {}: type was {} but should be ro or rw", arg, other);
+            return Err(UsageError { message });
+        },
+    };
+    if fields.len() != 3 {
+        let message = format!("bad mapping {}: expected three colon-separated fields", arg);
+        return Err(UsageError { message });
+    }
+    let underlying_path = sandboxfs::make_absolute(PathBuf::from(&fields[2])).map_err(|e| {
+        UsageError { message: format!("bad mapping {}: cannot resolve {}: {}", arg, fields[2], e) }
+    })?;
+    Ok(ReconfigureMapping { path: PathBuf::from(&fields[1]), underlying_path, writable })
+}
+
+/// Builds the reconfiguration request described by the flags of the `reconfigure` subcommand.
+///
+/// Returns None if no flags describe a request, in which case requests are read from stdin.
+fn parse_reconfigure_request(matches: &getopts::Matches)
+    -> Result<Option<ReconfigureRequest>, UsageError> {
+    let actions = ["mapping", "unmap", "destroy", "list"].iter()
+        .filter(|flag| matches.opt_present(flag))
+        .count();
+    if actions > 1 {
+        let message = "--mapping, --unmap, --destroy and --list are mutually exclusive".to_owned();
+        return Err(UsageError { message });
+    }
+
+    let sandbox = matches.opt_str("sandbox");
+    if matches.opt_present("list") {
+        return Ok(Some(ReconfigureRequest::ListMappings(sandbox.unwrap_or_default())));
+    }
+    if actions == 0 {
+        if sandbox.is_some() {
+            let message = "--sandbox requires --mapping, --unmap, --destroy or --list".to_owned();
+            return Err(UsageError { message });
+        }
+        return Ok(None);
+    }
+    let id = match sandbox {
+        Some(id) => id,
+        None => {
+            let message = "--sandbox is required with --mapping, --unmap and --destroy".to_owned();
+            return Err(UsageError { message });
+        },
+    };
+
+    if matches.opt_present("mapping") {
+        let mut mappings = vec!();
+        for arg in matches.opt_strs("mapping") {
+            mappings.push(parse_reconfigure_mapping(&arg)?);
+        }
+        Ok(Some(ReconfigureRequest::CreateSandbox { id, mappings }))
+    } else if matches.opt_present("unmap") {
+        let paths = matches.opt_strs("unmap").into_iter().map(PathBuf::from).collect();
+        Ok(Some(ReconfigureRequest::UnmapPaths { id, paths }))
+    } else {
+        Ok(Some(ReconfigureRequest::DestroySandbox(id)))
+    }
+}
+
+/// Returns the flags accepted by the `reconfigure` subcommand.
+fn reconfigure_options() -> Options {
+    let mut opts = Options::new();
+    opts.optflag("", "destroy", "destroys the sandbox");
+    opts.optflag("", "help", "prints usage information and exits");
+    opts.optflag("", "list", "lists all mappings");
+    opts.optmulti("", "mapping", "adds a mapping to the sandbox, creating it if necessary",
+        "TYPE:PATH:TARGET");
+    opts.optopt("", "sandbox", "identifier of the sandbox to reconfigure", "ID");
+    opts.optopt("", "socket", "path to the reconfiguration socket of the instance", "PATH");
+    opts.optmulti("", "unmap", "removes the mapping at the given path from the sandbox", "PATH");
+    opts
+}
+
+/// Implements the `reconfigure` subcommand, which sends reconfiguration requests to the socket of
+/// a running instance and copies the responses to stdout.
+///
+/// The requests are read from stdin unless the flags describe a single request, in which case the
+/// subcommand fails if sandboxfs rejects it.
+fn reconfigure_main(program: &str, args: &[String]) -> Fallible<()> {
+    let opts = reconfigure_options();
+    let matches = opts.parse(args)?;
+
+    if matches.opt_present("help") {
+        let brief = format!("Usage: {} reconfigure --socket=PATH [<REQUESTS]", program);
+        print!("{}", opts.usage(&brief));
+        return Ok(());
+    }
+
+    if !matches.free.is_empty() {
+        return Err(UsageError { message: "invalid number of arguments".to_string() }.into());
+    }
+    let path = match matches.opt_str("socket") {
+        Some(path) => PathBuf::from(path),
+        None => return Err(UsageError { message: "--socket is required".to_string() }.into()),
+    };
+    let request = match parse_reconfigure_request(&matches)? {
+        Some(request) => {
+            let mut request = serde_json::to_string(&request)
+                .expect("Serializing a request cannot fail");
+            request.push('\n');
+            Some(request)
+        },
+        None => None,
+    };
+
+    let mut stream = UnixStream::connect(&path)
+        .with_context(|_| format!("Failed to connect to {}", path.display()))?;
+    let mut writer = stream.try_clone()?;
+    let single = request.is_some();
+    let sender = thread::spawn(move || -> io::Result<()> {
+        match request {
+            Some(request) => writer.write_all(request.as_bytes())?,
+            None => { io::copy(&mut io::stdin(), &mut writer)?; },
+        }
+        // Closing our side of the connection tells sandboxfs that there are no more requests,
+        // which in turn makes it close the connection once it has responded to all of them.
+        writer.shutdown(Shutdown::Write)
+    });
+    if single {
+        let mut response = String::new();
+        stream.read_to_string(&mut response).context("Failed to read response")?;
+        print!("{}", response);
+        let response: ReconfigureResponse = serde_json::from_str(&response)
+            .with_context(|_| format!("Invalid response '{}'", response.trim_end()))?;
+        if let Some(error) = response.error {
+            return Err(format_err!("Reconfiguration failed: {}", error));
+        }
+    } else {
+        io::copy(&mut stream, &mut io::stdout()).context("Failed to read responses")?;
+    }
+    match sender.join() {
+        Ok(result) => Ok(result.context("Failed to send requests")?),
+        Err(_) => Err(format_err!("Requests sender thread panicked")),
+    }
+}
+
+/// Program's entry point.  This delegates to `safe_main` (or to `reconfigure_main` for the
+/// `reconfigure` subcommand) for all program logic and is just in charge of consistently
+/// formatting and reporting all possible errors to the caller.
+fn main() {
+    let args: Vec<String> = env::args().collect();
+    let program = program_name(&args, "sandboxfs");
+
+    let result = if args.get(1).map(String::as_str) == Some("reconfigure") {
+        reconfigure_main(&program, &args[2..])
+    } else {
+        safe_main(&program, &args[1..])
+    };
+    if let Err(err) = result {
         if let Some(err) = err.downcast_ref::<UsageError>() {
             eprintln!("Usage error: {}", err);
             eprintln!("Type {} --help for more information", program);
@@ -316,16 +1536,25 @@ fn main() {
             eprintln!("Type {} --help for more information", program);
             process::exit(2);
         } else {
-            eprintln!("{}: {}", program, sandboxfs::flatten_causes(&err));
-            process::exit(1);
+            report_error(&program, &sandboxfs::flatten_causes(&err));
+            // Follow the shell convention for processes terminated by a signal so that callers
+            // can tell a requested stop apart from a failure.
+            let signal = err.iter_chain()
+                .filter_map(|cause| cause.downcast_ref::<sandboxfs::SignalError>())
+                .next();
+            match signal {
+                Some(e) => process::exit(128 + e.signo),
+                None => process::exit(1),
+            }
         }
     }
 }
 
 #[cfg(test)]
 mod tests {
-    use sandboxfs::Mapping;
+    use sandboxfs::{Mapping, MappingOptions, Squash, TargetType};
     use super::*;
+    use tempfile::tempdir;
 
     /// Checks that an error, once formatted for printing, contains the given substring.
     fn err_contains(substr: &str, err: impl failure::Fail) {
@@ -334,6 +1563,156 @@ mod tests {
             "bad error message '{}'; does not contain '{}'", formatted, substr);
     }
 
+    #[test]
+    fn test_parse_allow_ok() {
+        assert_eq!((&["-o", "allow_other"][..], false), parse_allow("other").unwrap());
+        assert_eq!((&[][..], false), parse_allow("self").unwrap());
+        if cfg!(target_os = "linux") {
+            assert_eq!((&["-o", "allow_other"][..], true), parse_allow("root").unwrap());
+        } else {
+            assert_eq!((&["-o", "allow_root"][..], false), parse_allow("root").unwrap());
+        }
+    }
+
+    #[test]
+    fn test_parse_allow_bad_value() {
+        let err = parse_allow("foo").unwrap_err();
+        err_contains("foo must be one of other, root, or self",
+            err.downcast::<UsageError>().unwrap());
+    }
+
+    #[test]
+    fn test_build_info_current() {
+        let info = BuildInfo::current();
+        assert_eq!(env!("CARGO_PKG_VERSION"), info.package_version);
+        assert!(info.build_timestamp.ends_with('Z'), "Got '{}'", info.build_timestamp);
+        assert_eq!(env::consts::OS, info.target_os);
+    }
+
+    #[test]
+    fn test_version_bad_format() {
+        err_contains("invalid --version xml: must be json", version(Some("xml")).unwrap_err());
+    }
+
+    #[test]
+    fn test_parse_debug_ops() {
+        assert_eq!(vec!(sandboxfs::Op::Lookup), parse_debug_ops("lookup").unwrap());
+        assert_eq!(vec!(sandboxfs::Op::Lookup, sandboxfs::Op::Getattr, sandboxfs::Op::Readdir),
+            parse_debug_ops("lookup,getattr,readdir").unwrap());
+        err_contains("invalid --debug_ops lookup,foo: unknown operation foo; must be one of \
+            create, flush,", parse_debug_ops("lookup,foo").unwrap_err());
+        err_contains("unknown operation ; must be", parse_debug_ops("lookup,").unwrap_err());
+    }
+
+    #[test]
+    fn test_parse_debug_path_prefix() {
+        assert_eq!(PathBuf::from("/out/foo"), parse_debug_path_prefix("/out/foo").unwrap());
+        err_contains("invalid --debug_path_prefix out/foo: must be absolute",
+            parse_debug_path_prefix("out/foo").unwrap_err());
+        err_contains("invalid --debug_path_prefix /out/../foo: must be normalized",
+            parse_debug_path_prefix("/out/../foo").unwrap_err());
+    }
+
+    #[test]
+    fn test_parse_log_format() {
+        assert_eq!(sandboxfs::LogFormat::Text, parse_log_format("text").unwrap());
+        assert_eq!(sandboxfs::LogFormat::Json, parse_log_format("json").unwrap());
+        err_contains("invalid --log_format xml: must be text or json",
+            parse_log_format("xml").unwrap_err());
+    }
+
+    #[test]
+    fn test_parse_log_level() {
+        assert_eq!(log::LevelFilter::Debug, parse_log_level("debug").unwrap());
+        assert_eq!(log::LevelFilter::Error, parse_log_level("error").unwrap());
+        err_contains("invalid --log_level trace: must be debug, info, warn or error",
+            parse_log_level("trace").unwrap_err());
+    }
+
+    #[test]
+    fn test_parse_fs_name_ok() {
+        assert_eq!("sandboxfs", parse_fs_name("fs_name", "").unwrap());
+        assert_eq!("worker-1", parse_fs_name("fs_name", "worker-1").unwrap());
+        assert_eq!("a.b_c", parse_fs_name("subtype", "a.b_c").unwrap());
+    }
+
+    #[test]
+    fn test_parse_max_read_ok() {
+        assert_eq!(4096, parse_max_read("4096").unwrap());
+        assert_eq!(1 << 20, parse_max_read("1M").unwrap());
+        assert_eq!(std::u32::MAX, parse_max_read("4294967295").unwrap());
+    }
+
+    #[test]
+    fn test_parse_max_read_errors() {
+        err_contains("invalid --max_read_bytes 4095: must be at least 4K and less than 4G",
+            parse_max_read("4095").unwrap_err());
+        err_contains("invalid --max_read_bytes 4G: must be at least 4K and less than 4G",
+            parse_max_read("4G").unwrap_err());
+        err_contains("invalid --max_read_bytes 1X: invalid size 1X",
+            parse_max_read("1X").unwrap_err());
+    }
+
+    #[test]
+    fn test_parse_fuse_option_ok() {
+        for (name, takes_value) in allowed_fuse_options() {
+            let value = if *takes_value { format!("{}=foo", name) } else { (*name).to_owned() };
+            assert_eq!(value, parse_fuse_option(&value).unwrap());
+        }
+    }
+
+    #[test]
+    fn test_parse_fuse_option_errors() {
+        err_contains("invalid --fuse_option allow_other: ",
+            parse_fuse_option("allow_other").unwrap_err());
+        err_contains("invalid --fuse_option max_background=10: ",
+            parse_fuse_option("max_background=10").unwrap_err());
+        if cfg!(target_os = "linux") {
+            err_contains(
+                "invalid --fuse_option foo: unsupported option; must be one of auto_unmount, \
+                noatime, nonempty",
+                parse_fuse_option("foo").unwrap_err());
+            err_contains("invalid --fuse_option nonempty=1: nonempty does not take a value",
+                parse_fuse_option("nonempty=1").unwrap_err());
+        }
+        if cfg!(target_os = "macos") {
+            err_contains(
+                "invalid --fuse_option nonempty: unsupported option; must be one of \
+                daemon_timeout=VALUE, local, nobrowse, volname=VALUE",
+                parse_fuse_option("nonempty").unwrap_err());
+            err_contains("invalid --fuse_option volname: volname requires a value",
+                parse_fuse_option("volname").unwrap_err());
+            err_contains("invalid --fuse_option volname=a,b: cannot contain commas",
+                parse_fuse_option("volname=a,b").unwrap_err());
+        }
+    }
+
+    #[test]
+    fn test_parse_volume_icon_ok() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("icon.icns");
+        fs::write(&path, "").unwrap();
+        let value = path.to_str().unwrap();
+        assert_eq!(value, parse_volume_icon(value).unwrap());
+    }
+
+    #[test]
+    fn test_parse_volume_icon_errors() {
+        err_contains("invalid --volume_icon /a,b.icns: cannot contain commas",
+            parse_volume_icon("/a,b.icns").unwrap_err());
+        err_contains("invalid --volume_icon /non-existent.icns: No such file",
+            parse_volume_icon("/non-existent.icns").unwrap_err());
+    }
+
+    #[test]
+    fn test_parse_fs_name_bad_characters() {
+        err_contains("invalid --fs_name a,b: cannot contain commas or whitespace",
+            parse_fs_name("fs_name", "a,b").unwrap_err());
+        err_contains("invalid --subtype a b: cannot contain commas or whitespace",
+            parse_fs_name("subtype", "a b").unwrap_err());
+        err_contains("invalid --subtype a\tb", parse_fs_name("subtype", "a\tb").unwrap_err());
+    }
+
     #[test]
     fn test_parse_duration_ok() {
         assert_eq!(Timespec { sec: 1234, nsec: 0 }, parse_duration("1234s").unwrap());
@@ -379,7 +1758,261 @@ mod tests {
     fn test_parse_mappings_bad_type() {
         let args = ["rr:/foo:/bar"];
         let err = parse_mappings(&args).unwrap_err();
-        err_contains("bad mapping rr:/foo:/bar: type was rr but should be ro or rw", err);
+        err_contains("bad mapping rr:/foo:/bar: type was rr but should be ro, rw, cow or tmp", err);
+    }
+
+    #[test]
+    fn test_parse_mappings_excludes_ok() {
+        let args = ["ro:/src:/home/me/src:!.git,!bazel-*", "rw:/out:/tmp/out:!*.o"];
+        let exp_mappings = vec!(
+            Mapping::from_parts_with(
+                PathBuf::from("/src"), PathBuf::from("/home/me/src"), false, MappingOptions {
+                    excludes: vec!(".git".to_owned(), "bazel-*".to_owned()),
+                    ..Default::default()
+                }).unwrap(),
+            Mapping::from_parts_with(
+                PathBuf::from("/out"), PathBuf::from("/tmp/out"), true, MappingOptions {
+                    excludes: vec!("*.o".to_owned()),
+                    ..Default::default()
+                }).unwrap(),
+        );
+        match parse_mappings(&args) {
+            Ok(mappings) => assert_eq!(exp_mappings, mappings),
+            Err(e) => panic!(e),
+        }
+    }
+
+    #[test]
+    fn test_parse_mappings_excludes_bad_format() {
+        let err = parse_mappings(&["ro:/src:/home/me/src:!.git,bazel-out"]).unwrap_err();
+        err_contains(
+            "bad mapping ro:/src:/home/me/src:!.git,bazel-out: invalid exclude pattern bazel-out: \
+            must start with !", err);
+        let err = parse_mappings(&["ro:/src:/home/me/src:!"]).unwrap_err();
+        err_contains("bad mapping ro:/src:/home/me/src:!: exclude pattern \"\" must be", err);
+        let err = parse_mappings(&["ro:/src:/home/me/src:!a:b"]).unwrap_err();
+        err_contains(
+            "bad mapping ro:/src:/home/me/src:!a:b: expected three or four colon-separated fields",
+            err);
+    }
+
+    #[test]
+    fn test_parse_mappings_squash_ok() {
+        let args = ["rw:/out:/tmp/out:uid=1000,gid=100", "rw:/src:/home/me/src:!.git,gid=5,strict"];
+        let exp_mappings = vec!(
+            Mapping::from_parts_with(
+                PathBuf::from("/out"), PathBuf::from("/tmp/out"), true, MappingOptions {
+                    squash: Some(Squash { uid: Some(1000), gid: Some(100), strict: false }),
+                    ..Default::default()
+                }).unwrap(),
+            Mapping::from_parts_with(
+                PathBuf::from("/src"), PathBuf::from("/home/me/src"), true, MappingOptions {
+                    excludes: vec!(".git".to_owned()),
+                    squash: Some(Squash { uid: None, gid: Some(5), strict: true }),
+                    ..Default::default()
+                }).unwrap(),
+        );
+        match parse_mappings(&args) {
+            Ok(mappings) => assert_eq!(exp_mappings, mappings),
+            Err(e) => panic!(e),
+        }
+    }
+
+    #[test]
+    fn test_parse_mappings_squash_bad_format() {
+        let err = parse_mappings(&["rw:/out:/tmp/out:uid=me"]).unwrap_err();
+        err_contains("bad mapping rw:/out:/tmp/out:uid=me: invalid option uid=me: invalid digit",
+            err);
+        let err = parse_mappings(&["rw:/out:/tmp/out:user=1000"]).unwrap_err();
+        err_contains(
+            "bad mapping rw:/out:/tmp/out:user=1000: invalid option user=1000: unknown name user",
+            err);
+        let err = parse_mappings(&["rw:/out:/tmp/out:strict"]).unwrap_err();
+        err_contains("bad mapping rw:/out:/tmp/out:strict: squashing requires a uid or a gid", err);
+    }
+
+    #[test]
+    fn test_parse_mappings_noexec_ok() {
+        let args = ["ro:/deps:/home/me/deps:noexec", "rw:/out:/tmp/out:!*.o,noexec,uid=1000"];
+        let exp_mappings = vec!(
+            Mapping::from_parts_with(
+                PathBuf::from("/deps"), PathBuf::from("/home/me/deps"), false, MappingOptions {
+                    noexec: true,
+                    ..Default::default()
+                }).unwrap(),
+            Mapping::from_parts_with(
+                PathBuf::from("/out"), PathBuf::from("/tmp/out"), true, MappingOptions {
+                    excludes: vec!("*.o".to_owned()),
+                    squash: Some(Squash { uid: Some(1000), gid: None, strict: false }),
+                    noexec: true,
+                    ..Default::default()
+                }).unwrap(),
+        );
+        match parse_mappings(&args) {
+            Ok(mappings) => assert_eq!(exp_mappings, mappings),
+            Err(e) => panic!(e),
+        }
+    }
+
+    #[test]
+    fn test_parse_mappings_perm_ok() {
+        let args = ["ro:/src:/home/me/src:perm=0555", "rw:/out:/tmp/out:noexec,perm=750"];
+        let exp_mappings = vec!(
+            Mapping::from_parts_with(
+                PathBuf::from("/src"), PathBuf::from("/home/me/src"), false, MappingOptions {
+                    perm_mask: Some(0o555),
+                    ..Default::default()
+                }).unwrap(),
+            Mapping::from_parts_with(
+                PathBuf::from("/out"), PathBuf::from("/tmp/out"), true, MappingOptions {
+                    noexec: true,
+                    perm_mask: Some(0o750),
+                    ..Default::default()
+                }).unwrap(),
+        );
+        match parse_mappings(&args) {
+            Ok(mappings) => assert_eq!(exp_mappings, mappings),
+            Err(e) => panic!(e),
+        }
+    }
+
+    #[test]
+    fn test_parse_mappings_perm_bad_format() {
+        let err = parse_mappings(&["ro:/src:/home/me/src:perm=0589"]).unwrap_err();
+        err_contains(
+            "bad mapping ro:/src:/home/me/src:perm=0589: invalid option perm=0589: invalid digit",
+            err);
+        let err = parse_mappings(&["ro:/src:/home/me/src:perm=0644"]).unwrap_err();
+        err_contains("bad mapping ro:/src:/home/me/src:perm=0644: permissions mask 0644 must", err);
+    }
+
+    #[test]
+    fn test_parse_mappings_optional_ok() {
+        let args = ["rw:/out:/tmp/out:optional,type=dir", "ro:/lib:/home/me/lib:type=file"];
+        let exp_mappings = vec!(
+            Mapping::from_parts_with(
+                PathBuf::from("/out"), PathBuf::from("/tmp/out"), true, MappingOptions {
+                    optional: true,
+                    target_type: Some(TargetType::Dir),
+                    ..Default::default()
+                }).unwrap(),
+            Mapping::from_parts_with(
+                PathBuf::from("/lib"), PathBuf::from("/home/me/lib"), false, MappingOptions {
+                    target_type: Some(TargetType::File),
+                    ..Default::default()
+                }).unwrap(),
+        );
+        match parse_mappings(&args) {
+            Ok(mappings) => assert_eq!(exp_mappings, mappings),
+            Err(e) => panic!(e),
+        }
+    }
+
+    #[test]
+    fn test_parse_mappings_optional_bad_type() {
+        let err = parse_mappings(&["rw:/out:/tmp/out:type=fifo"]).unwrap_err();
+        err_contains(
+            "bad mapping rw:/out:/tmp/out:type=fifo: invalid option type=fifo: invalid target type",
+            err);
+    }
+
+    #[test]
+    fn test_parse_id() {
+        assert_eq!(None, parse_id("uid", None).unwrap());
+        assert_eq!(Some(0), parse_id("uid", Some("0".to_owned())).unwrap());
+        assert_eq!(Some(1234), parse_id("gid", Some("1234".to_owned())).unwrap());
+        err_contains("invalid --uid -1: invalid digit", parse_id("uid", Some("-1".to_owned()))
+            .unwrap_err());
+        err_contains("invalid --gid root: invalid digit", parse_id("gid", Some("root".to_owned()))
+            .unwrap_err());
+    }
+
+    #[test]
+    fn test_parse_mappings_escapes_ok() {
+        let args = [
+            r"ro:/a\:b:/x\:y\:z",
+            r"rw:/with spaces:/back\\slash",
+            "ro:/ñandú:/tmp/日本語",
+            r"ro:/src:/home/me/src\:1:!.git",
+        ];
+        let exp_mappings = vec!(
+            Mapping::from_parts(PathBuf::from("/a:b"), PathBuf::from("/x:y:z"), false).unwrap(),
+            Mapping::from_parts(PathBuf::from("/with spaces"), PathBuf::from(r"/back\slash"), true)
+                .unwrap(),
+            Mapping::from_parts(PathBuf::from("/ñandú"), PathBuf::from("/tmp/日本語"), false)
+                .unwrap(),
+            Mapping::from_parts_with(
+                PathBuf::from("/src"), PathBuf::from("/home/me/src:1"), false, MappingOptions {
+                    excludes: vec!(".git".to_owned()),
+                    ..Default::default()
+                }).unwrap(),
+        );
+        match parse_mappings(&args) {
+            Ok(mappings) => assert_eq!(exp_mappings, mappings),
+            Err(e) => panic!(e),
+        }
+    }
+
+    #[test]
+    fn test_parse_mappings_escapes_bad_format() {
+        let err = parse_mappings(&[r"ro:/a:/b\c"]).unwrap_err();
+        err_contains(r"bad mapping ro:/a:/b\c: invalid escape sequence \c", err);
+        let err = parse_mappings(&[r"ro:/a:/b\"]).unwrap_err();
+        err_contains(r"bad mapping ro:/a:/b\: unterminated escape sequence", err);
+    }
+
+    #[test]
+    fn test_parse_mappings_cow_ok() {
+        let args = ["cow:/foo:/bar:/scratch"];
+        let exp_mappings = vec!(Mapping::from_parts_cow(
+            PathBuf::from("/foo"), PathBuf::from("/bar"), PathBuf::from("/scratch")).unwrap());
+        match parse_mappings(&args) {
+            Ok(mappings) => assert_eq!(exp_mappings, mappings),
+            Err(e) => panic!(e),
+        }
+    }
+
+    #[test]
+    fn test_parse_mappings_tmp_ok() {
+        let args = ["tmp:/tmp", "tmp:/small:64K", "tmp:/big:2G", "tmp:/exact:100"];
+        let exp_mappings = vec!(
+            Mapping::from_parts_memory(PathBuf::from("/tmp"), None).unwrap(),
+            Mapping::from_parts_memory(PathBuf::from("/small"), Some(64 * 1024)).unwrap(),
+            Mapping::from_parts_memory(PathBuf::from("/big"), Some(2 * 1024 * 1024 * 1024))
+                .unwrap(),
+            Mapping::from_parts_memory(PathBuf::from("/exact"), Some(100)).unwrap(),
+        );
+        match parse_mappings(&args) {
+            Ok(mappings) => assert_eq!(exp_mappings, mappings),
+            Err(e) => panic!(e),
+        }
+    }
+
+    #[test]
+    fn test_parse_mappings_tmp_bad_format() {
+        for arg in ["tmp", "tmp:/foo:1M:extra"].iter() {
+            let err = parse_mappings(&[arg]).unwrap_err();
+            err_contains(
+                &format!("bad mapping {}: expected two or three colon-separated fields", arg),
+                err);
+        }
+    }
+
+    #[test]
+    fn test_parse_mappings_tmp_bad_size() {
+        let err = parse_mappings(&["tmp:/foo:12X"]).unwrap_err();
+        err_contains("bad mapping tmp:/foo:12X: invalid size 12X: invalid digit", err);
+        let err = parse_mappings(&["tmp:/foo:99999999999999G"]).unwrap_err();
+        err_contains("invalid size 99999999999999G: too large", err);
+    }
+
+    #[test]
+    fn test_parse_mappings_cow_bad_format() {
+        for arg in ["cow:/foo:/bar", "cow:/foo:/bar:/scratch:extra"].iter() {
+            let err = parse_mappings(&[arg]).unwrap_err();
+            err_contains(
+                &format!("bad mapping {}: expected four colon-separated fields", arg), err);
+        }
     }
 
     #[test]
@@ -390,10 +2023,146 @@ mod tests {
     }
 
     #[test]
-    fn test_parse_mappings_bad_underlying_path() {
-        let args = ["ro:/foo:bar"];
-        let err = parse_mappings(&args).unwrap_err();
-        err_contains("bad mapping ro:/foo:bar: path \"bar\" is not absolute", err);
+    fn test_parse_mappings_relative_underlying_path() {
+        let cwd = env::current_dir().unwrap();
+        let args = ["ro:/foo:bar", "rw:/baz:./a/../b", "cow:/cow:c:/scratch"];
+        let exp_mappings = vec!(
+            Mapping::from_parts(PathBuf::from("/foo"), cwd.join("bar"), false).unwrap(),
+            Mapping::from_parts(PathBuf::from("/baz"), cwd.join("a/../b"), true).unwrap(),
+            Mapping::from_parts_cow(
+                PathBuf::from("/cow"), cwd.join("c"), PathBuf::from("/scratch")).unwrap(),
+        );
+        match parse_mappings(&args) {
+            Ok(mappings) => assert_eq!(exp_mappings, mappings),
+            Err(e) => panic!(e),
+        }
+    }
+
+    #[test]
+    fn test_parse_mapping_lines_ok() {
+        let contents = "# A comment\n\nro:/:/fake/root\n  rw:/foo:/bar  \n\t# Indented comment\n";
+        let exp_mappings = vec!(
+            Mapping::from_parts(PathBuf::from("/"), PathBuf::from("/fake/root"), false).unwrap(),
+            Mapping::from_parts(PathBuf::from("/foo"), PathBuf::from("/bar"), true).unwrap(),
+        );
+        let mappings = parse_mapping_lines(Path::new("file"), io::Cursor::new(contents)).unwrap();
+        assert_eq!(exp_mappings, mappings);
+    }
+
+    #[test]
+    fn test_parse_mapping_lines_empty() {
+        let mappings = parse_mapping_lines(Path::new("file"), io::Cursor::new("")).unwrap();
+        assert!(mappings.is_empty());
+    }
+
+    #[test]
+    fn test_parse_mapping_lines_bad_mapping() {
+        let contents = "ro:/:/fake/root\n\n# Comment\nrr:/foo:/bar\n";
+        let err = parse_mapping_lines(Path::new("some/file"), io::Cursor::new(contents))
+            .unwrap_err();
+        let err = err.downcast::<UsageError>().unwrap();
+        err_contains(
+            "some/file:4: bad mapping rr:/foo:/bar: type was rr but should be ro, rw, cow or tmp",
+            err);
+    }
+
+    #[test]
+    fn test_parse_manifest_entry_ok() {
+        assert_eq!(Ok((PathBuf::from("ws/a"), Some(PathBuf::from("/t/x y")))),
+            parse_manifest_entry("ws/a /t/x y"));
+        assert_eq!(Ok((PathBuf::from("ws/a b"), Some(PathBuf::from("/t/x\\y\nz")))),
+            parse_manifest_entry(" ws/a\\sb /t/x\\by\\nz"));
+        assert_eq!(Ok((PathBuf::from("ws/__init__.py"), None)),
+            parse_manifest_entry("ws/__init__.py"));
+        assert_eq!(Ok((PathBuf::from("ws/__init__.py"), None)),
+            parse_manifest_entry("ws/__init__.py "));
+    }
+
+    #[test]
+    fn test_parse_manifest_entry_errors() {
+        assert_eq!(Err("missing path".to_owned()), parse_manifest_entry(" /t"));
+        assert_eq!(Err("path /a is not relative".to_owned()), parse_manifest_entry("/a /t"));
+        assert_eq!(Err("target t is not absolute".to_owned()), parse_manifest_entry("a t"));
+        assert_eq!(Err("invalid escape sequence \\x".to_owned()), parse_manifest_entry(" a\\x /t"));
+        assert_eq!(Err("invalid escape sequence \\s".to_owned()), parse_manifest_entry(" a /t\\s"));
+        assert_eq!(Err("unterminated escape sequence".to_owned()), parse_manifest_entry(" a\\ /t"));
+    }
+
+    #[test]
+    fn test_parse_manifest_lines_ok() {
+        let contents = "ws/a /fake/a\nws/empty\n\n ws/b\\sc /fake/b c\n";
+        let exp_mappings = vec!(
+            Mapping::from_parts(PathBuf::from("/run/ws/a"), PathBuf::from("/fake/a"), false)
+                .unwrap(),
+            Mapping::from_parts(PathBuf::from("/run/ws/b c"), PathBuf::from("/fake/b c"), false)
+                .unwrap(),
+        );
+        let mappings = parse_manifest_lines(
+            Path::new("manifest"), io::Cursor::new(contents), Path::new("/run"), "").unwrap();
+        assert_eq!(exp_mappings, mappings);
+    }
+
+    #[test]
+    fn test_parse_manifest_lines_options() {
+        let contents = "ws/a /fake/a\n";
+        let exp_mappings = vec!(
+            Mapping::from_parts_with(
+                PathBuf::from("/ws/a"), PathBuf::from("/fake/a"), false, MappingOptions {
+                    noexec: true,
+                    optional: true,
+                    ..Default::default()
+                }).unwrap(),
+        );
+        let mappings = parse_manifest_lines(
+            Path::new("manifest"), io::Cursor::new(contents), Path::new("/"), "noexec,optional")
+            .unwrap();
+        assert_eq!(exp_mappings, mappings);
+
+        let err = parse_manifest_lines(
+            Path::new("manifest"), io::Cursor::new(contents), Path::new("/"), "type=foo")
+            .unwrap_err();
+        let err = err.downcast::<UsageError>().unwrap();
+        err_contains("bad manifest options type=foo", err);
+    }
+
+    #[test]
+    fn test_parse_manifest_lines_bad_entry() {
+        let contents = "ws/a /fake/a\n\nws/b relative\n";
+        let err = parse_manifest_lines(
+            Path::new("some/manifest"), io::Cursor::new(contents), Path::new("/"), "")
+            .unwrap_err();
+        let err = err.downcast::<UsageError>().unwrap();
+        err_contains("some/manifest:3: target relative is not absolute", err);
+    }
+
+    #[test]
+    fn test_parse_mapping_manifest() {
+        let dir = tempdir().unwrap();
+        let manifest = dir.path().join("MANIFEST");
+        fs::write(&manifest, "ws/a /fake/a\n").unwrap();
+
+        let exp_mappings = vec!(
+            Mapping::from_parts(PathBuf::from("/ws/a"), PathBuf::from("/fake/a"), false).unwrap(),
+        );
+        assert_eq!(exp_mappings, parse_mapping_manifest(manifest.to_str().unwrap()).unwrap());
+        assert_eq!(exp_mappings,
+            parse_mapping_manifest(&format!("{}:", manifest.display())).unwrap());
+
+        let exp_mappings = vec!(
+            Mapping::from_parts(PathBuf::from("/x/ws/a"), PathBuf::from("/fake/a"), false)
+                .unwrap(),
+        );
+        assert_eq!(exp_mappings,
+            parse_mapping_manifest(&format!("{}:/x", manifest.display())).unwrap());
+
+        let err = parse_mapping_manifest(&format!("{}:x", manifest.display())).unwrap_err();
+        err_contains("prefix x is not absolute", err.downcast::<UsageError>().unwrap());
+        let err = parse_mapping_manifest(&format!("{}:/x:noexec:extra", manifest.display()))
+            .unwrap_err();
+        err_contains("expected one to three colon-separated fields",
+            err.downcast::<UsageError>().unwrap());
+        let err = parse_mapping_manifest("/non-existent").unwrap_err();
+        assert!(format!("{}", err).contains("Failed to open manifest '/non-existent'"));
     }
 
     #[test]
@@ -406,4 +2175,86 @@ mod tests {
         assert_eq!("b", program_name(&["a/b".to_string()], "unused"));
         assert_eq!("foo", program_name(&["./x/y/foo".to_string()], "unused"));
     }
+
+    /// Builds the request described by `args` as given to the `reconfigure` subcommand.
+    fn reconfigure_request(args: &[&str]) -> Result<Option<ReconfigureRequest>, UsageError> {
+        let matches = reconfigure_options().parse(args).unwrap();
+        parse_reconfigure_request(&matches)
+    }
+
+    #[test]
+    fn test_parse_reconfigure_request_ok() {
+        assert_eq!(None, reconfigure_request(&[]).unwrap());
+        assert_eq!(
+            Some(ReconfigureRequest::CreateSandbox {
+                id: "sb".to_owned(),
+                mappings: vec!(
+                    ReconfigureMapping {
+                        path: PathBuf::from("/a"),
+                        underlying_path: PathBuf::from("/b"),
+                        writable: false,
+                    },
+                    ReconfigureMapping {
+                        path: PathBuf::from("/c:d"),
+                        underlying_path: PathBuf::from("/e"),
+                        writable: true,
+                    },
+                ),
+            }),
+            reconfigure_request(
+                &["--sandbox=sb", "--mapping=ro:/a:/b", "--mapping=rw:/c\\:d:/e"]).unwrap());
+        assert_eq!(
+            Some(ReconfigureRequest::UnmapPaths {
+                id: "sb".to_owned(),
+                paths: vec!(PathBuf::from("/a"), PathBuf::from("/b")),
+            }),
+            reconfigure_request(&["--sandbox=sb", "--unmap=/a", "--unmap=/b"]).unwrap());
+        assert_eq!(Some(ReconfigureRequest::DestroySandbox("sb".to_owned())),
+            reconfigure_request(&["--destroy", "--sandbox=sb"]).unwrap());
+        assert_eq!(Some(ReconfigureRequest::ListMappings("".to_owned())),
+            reconfigure_request(&["--list"]).unwrap());
+    }
+
+    #[test]
+    fn test_parse_reconfigure_request_relative_target() {
+        let request = reconfigure_request(&["--sandbox=sb", "--mapping=ro:/a:b"]).unwrap();
+        match request {
+            Some(ReconfigureRequest::CreateSandbox { mappings, .. }) => {
+                assert_eq!(env::current_dir().unwrap().join("b"), mappings[0].underlying_path);
+            },
+            other => panic!("Got {:?}; want a CreateSandbox request", other),
+        }
+    }
+
+    #[test]
+    fn test_parse_reconfigure_request_errors() {
+        err_contains("mutually exclusive",
+            reconfigure_request(&["--sandbox=sb", "--destroy", "--list"]).unwrap_err());
+        err_contains("--sandbox is required",
+            reconfigure_request(&["--mapping=ro:/a:/b"]).unwrap_err());
+        err_contains("--sandbox requires",
+            reconfigure_request(&["--sandbox=sb"]).unwrap_err());
+        err_contains("bad mapping cow:/a:/b: type was cow but should be ro or rw",
+            reconfigure_request(&["--sandbox=sb", "--mapping=cow:/a:/b"]).unwrap_err());
+        err_contains("bad mapping ro:/a: expected three colon-separated fields",
+            reconfigure_request(&["--sandbox=sb", "--mapping=ro:/a"]).unwrap_err());
+    }
+
+    #[test]
+    fn test_reconfigure_request_serialization() {
+        let request = ReconfigureRequest::CreateSandbox {
+            id: "sb".to_owned(),
+            mappings: vec!(ReconfigureMapping {
+                path: PathBuf::from("/a"),
+                underlying_path: PathBuf::from("/b"),
+                writable: true,
+            }),
+        };
+        assert_eq!(
+            concat!(r#"{"CreateSandbox":{"id":"sb","mappings":"#,
+                r#"[{"path":"/a","underlying_path":"/b","writable":true}]}}"#),
+            serde_json::to_string(&request).unwrap());
+        assert_eq!(r#"{"DestroySandbox":"sb"}"#,
+            serde_json::to_string(&ReconfigureRequest::DestroySandbox("sb".to_owned())).unwrap());
+    }
 }
@@ -0,0 +1,994 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License.  You may obtain a copy
+// of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.  See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+use errors::KernelError;
+use logging::RateLimiter;
+use nix::errno::Errno;
+use nodes::MappingInfo;
+use std::cell::Cell;
+use std::collections::{BTreeMap, HashMap};
+use std::fmt::Write as FmtWrite;
+use std::io::{self, BufRead, Read, Write};
+use std::net::{TcpListener, TcpStream};
+use stats::LatencyStats;
+use std::path::PathBuf;
+use std::sync::{Arc, Mutex};
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+use std::thread;
+use std::time::{Duration, Instant};
+use trace::Tracer;
+
+/// FUSE operations tracked by `Metrics`.
+#[derive(Clone, Copy, Debug, Eq, PartialEq)]
+pub enum Op {
+    Create, Flush, Forget, Fsync, Fsyncdir, Getattr, Getxattr, Link, Listxattr, Lookup, Mkdir,
+    Mknod, Open, Opendir, Read, Readdir, Readlink, Release, Releasedir, Removexattr, Rename, Rmdir,
+    Setattr, Setxattr, Statfs, Symlink, Unlink, Write,
+}
+
+/// Names of the operations in `Op` as exposed in the metrics, in the same order as the variants.
+static OP_NAMES: [&str; 28] = [
+    "create", "flush", "forget", "fsync", "fsyncdir", "getattr", "getxattr", "link", "listxattr",
+    "lookup", "mkdir", "mknod", "open", "opendir", "read", "readdir", "readlink", "release",
+    "releasedir", "removexattr", "rename", "rmdir", "setattr", "setxattr", "statfs", "symlink",
+    "unlink", "write",
+];
+
+/// All variants of `Op`, in the same order as their names in `OP_NAMES`.
+static ALL_OPS: [Op; 28] = [
+    Op::Create, Op::Flush, Op::Forget, Op::Fsync, Op::Fsyncdir, Op::Getattr, Op::Getxattr, Op::Link,
+    Op::Listxattr, Op::Lookup, Op::Mkdir, Op::Mknod, Op::Open, Op::Opendir, Op::Read, Op::Readdir,
+    Op::Readlink, Op::Release, Op::Releasedir, Op::Removexattr, Op::Rename, Op::Rmdir,
+    Op::Setattr, Op::Setxattr, Op::Statfs, Op::Symlink, Op::Unlink, Op::Write,
+];
+
+impl Op {
+    /// Returns the name of the operation, as used in the metrics and in the `--debug_ops` flag.
+    pub fn name(self) -> &'static str {
+        OP_NAMES[self as usize]
+    }
+
+    /// Returns the operation with the given `name`, if any.
+    pub fn from_name(name: &str) -> Option<Op> {
+        OP_NAMES.iter().position(|candidate| *candidate == name).map(|i| ALL_OPS[i])
+    }
+
+    /// Returns the names of all operations.
+    pub fn names() -> &'static [&'static str] {
+        &OP_NAMES
+    }
+}
+
+/// Upper bounds, in bytes, of the buckets of the read and write size histograms.
+static SIZE_BUCKETS: [usize; 6] = [512, 4096, 16384, 65536, 131_072, 1_048_576];
+
+/// Number of distinct error codes tracked individually.  Larger codes are tracked as unknown.
+const MAX_ERRNO: usize = 256;
+
+/// Number of distinct underlying paths whose `--io_timeout` expirations are tracked individually.
+/// Expirations on further paths cannot be attributed to a mapping.
+const MAX_IO_TIMEOUT_PATHS: usize = 1024;
+
+/// Maximum time to wait for a client to send its request before giving up on it.
+const CLIENT_TIMEOUT: Duration = Duration::from_secs(5);
+
+/// Maximum size of the body of a request that we are willing to read.
+const MAX_BODY_SIZE: u64 = 64 * 1024 * 1024;
+
+/// Function that applies a reconfiguration document and returns the HTTP status and the body of
+/// the response.
+type ReconfigureFn = dyn Fn(&[u8]) -> (&'static str, String);
+
+/// Function that writes snapshots of the enabled profiles and returns the HTTP status and the body
+/// of the response.
+type SnapshotFn = dyn Fn() -> (&'static str, String);
+
+/// Lock-free histogram of data sizes.
+struct SizeHistogram {
+    /// Number of samples in each bucket of `SIZE_BUCKETS` plus one extra bucket for larger values.
+    buckets: Vec<AtomicUsize>,
+
+    /// Sum of all samples.
+    sum: AtomicUsize,
+}
+
+impl SizeHistogram {
+    /// Creates a new empty histogram.
+    fn new() -> Self {
+        SizeHistogram {
+            buckets: (0..=SIZE_BUCKETS.len()).map(|_| AtomicUsize::new(0)).collect(),
+            sum: AtomicUsize::new(0),
+        }
+    }
+
+    /// Records a new sample of `size` bytes.
+    fn observe(&self, size: usize) {
+        let i = SIZE_BUCKETS.iter().position(|bound| size <= *bound).unwrap_or(SIZE_BUCKETS.len());
+        self.buckets[i].fetch_add(1, Ordering::Relaxed);
+        self.sum.fetch_add(size, Ordering::Relaxed);
+    }
+
+    /// Appends the histogram in the Prometheus text format to `out` under the metric `name`.
+    fn render(&self, name: &str, help: &str, out: &mut String) {
+        writeln!(out, "# HELP {} {}", name, help).unwrap();
+        writeln!(out, "# TYPE {} histogram", name).unwrap();
+        let mut count = 0;
+        for (i, bucket) in self.buckets.iter().enumerate() {
+            count += bucket.load(Ordering::Relaxed);
+            match SIZE_BUCKETS.get(i) {
+                Some(bound) => writeln!(out, "{}_bucket{{le=\"{}\"}} {}", name, bound, count),
+                None => writeln!(out, "{}_bucket{{le=\"+Inf\"}} {}", name, count),
+            }.unwrap();
+        }
+        writeln!(out, "{}_sum {}", name, self.sum.load(Ordering::Relaxed)).unwrap();
+        writeln!(out, "{}_count {}", name, count).unwrap();
+    }
+}
+
+/// Values that are sampled from the file system at the time the metrics are rendered.
+#[derive(Default)]
+pub struct Gauges {
+    /// Number of nodes currently known by the kernel.
+    pub nodes: usize,
+
+    /// Number of currently-open file and directory handles.
+    pub handles: usize,
+
+    /// Number of underlying file descriptors currently held open by file handles.
+    pub open_fds: usize,
+
+    /// Highest number of underlying file descriptors ever held open at once by file handles.
+    pub peak_open_fds: usize,
+
+    /// Active mappings, used to attribute per-path counters to the mappings they belong to.
+    pub mappings: Vec<MappingInfo>,
+}
+
+/// Collection of counters that track the activity of the file system.
+///
+/// All updates are lock-free so that they can be done on every FUSE operation with negligible
+/// overhead.
+pub struct Metrics {
+    /// Number of calls to each operation, indexed by `Op`.
+    ops: Vec<AtomicUsize>,
+
+    /// Number of errors returned to the kernel, indexed by errno.  Index 0 tracks unknown errors.
+    errors: Vec<AtomicUsize>,
+
+    /// Sizes of the data returned by reads.
+    read_sizes: SizeHistogram,
+
+    /// Sizes of the data accepted by writes.
+    write_sizes: SizeHistogram,
+
+    /// Number of reconfiguration requests that modified the file system.
+    reconfigurations: AtomicUsize,
+
+    /// Number of FUSE operations currently being processed.
+    in_flight: AtomicUsize,
+
+    /// Whether the file system is mounted and serving requests from the kernel.
+    serving: AtomicBool,
+
+    /// Number of operations abandoned due to `--io_timeout`, keyed by the underlying path that
+    /// stalled.  This is only updated when things go wrong, so a lock is fine.  Holds at most
+    /// `MAX_IO_TIMEOUT_PATHS` entries so that a stalled tree with many files cannot make it grow
+    /// without bound.
+    io_timeouts: Mutex<HashMap<PathBuf, usize>>,
+
+    /// Number of operations abandoned due to `--io_timeout` on paths that did not fit in
+    /// `io_timeouts`.
+    untracked_io_timeouts: AtomicUsize,
+
+    /// Number of audit log events dropped because the writer could not keep up.
+    audit_drops: AtomicUsize,
+
+    /// Latencies and outcomes of the completed operations.
+    latencies: LatencyStats,
+}
+
+impl Default for Metrics {
+    fn default() -> Self {
+        Metrics {
+            ops: OP_NAMES.iter().map(|_| AtomicUsize::new(0)).collect(),
+            errors: (0..MAX_ERRNO).map(|_| AtomicUsize::new(0)).collect(),
+            read_sizes: SizeHistogram::new(),
+            write_sizes: SizeHistogram::new(),
+            reconfigurations: AtomicUsize::new(0),
+            in_flight: AtomicUsize::new(0),
+            serving: AtomicBool::new(false),
+            io_timeouts: Mutex::from(HashMap::new()),
+            untracked_io_timeouts: AtomicUsize::new(0),
+            audit_drops: AtomicUsize::new(0),
+            latencies: LatencyStats::default(),
+        }
+    }
+}
+
+impl Metrics {
+    /// Records a call to the operation `op`.
+    pub fn record_op(&self, op: Op) {
+        self.ops[op as usize].fetch_add(1, Ordering::Relaxed);
+    }
+
+    /// Records that the error `e` is being returned to the kernel and returns its errno for
+    /// convenience.
+    pub fn record_error(&self, e: &KernelError) -> i32 {
+        let errno = e.errno_as_i32();
+        OP_ERRNO.with(|op_errno| op_errno.set(errno));
+        let i = if errno > 0 && (errno as usize) < MAX_ERRNO { errno as usize } else { 0 };
+        self.errors[i].fetch_add(1, Ordering::Relaxed);
+        if let Some(path) = e.timed_out_path() {
+            let mut io_timeouts = self.io_timeouts.lock().unwrap();
+            if let Some(count) = io_timeouts.get_mut(path) {
+                *count += 1;
+            } else if io_timeouts.len() < MAX_IO_TIMEOUT_PATHS {
+                io_timeouts.insert(path.to_owned(), 1);
+            } else {
+                self.untracked_io_timeouts.fetch_add(1, Ordering::Relaxed);
+            }
+        }
+        errno
+    }
+
+    /// Aggregates the operations abandoned due to `--io_timeout` by the path of the mapping, among
+    /// `mappings`, that contains the underlying path that stalled.
+    ///
+    /// Paths that do not belong to any of the mappings, which happens if their mapping has been
+    /// removed since, are attributed to "unknown", and so are those that were not tracked.
+    fn io_timeouts_by_mapping(&self, mappings: &[MappingInfo]) -> BTreeMap<String, usize> {
+        let mut by_mapping = BTreeMap::new();
+        for (path, count) in self.io_timeouts.lock().unwrap().iter() {
+            let mapping = mappings.iter()
+                .filter_map(|mapping| match &mapping.underlying_path {
+                    Some(underlying_path) if path.starts_with(underlying_path) => {
+                        Some((underlying_path.components().count(), mapping))
+                    },
+                    _ => None,
+                })
+                .max_by_key(|(depth, _)| *depth)
+                .map(|(_, mapping)| mapping.path.display().to_string())
+                .unwrap_or_else(|| "unknown".to_owned());
+            *by_mapping.entry(mapping).or_insert(0) += count;
+        }
+        let untracked = self.untracked_io_timeouts.load(Ordering::Relaxed);
+        if untracked > 0 {
+            *by_mapping.entry("unknown".to_owned()).or_insert(0) += untracked;
+        }
+        by_mapping
+    }
+
+    /// Records a successful read that returned `size` bytes.
+    pub fn record_read(&self, size: usize) {
+        self.read_sizes.observe(size);
+    }
+
+    /// Records a successful write that stored `size` bytes.
+    pub fn record_write(&self, size: usize) {
+        self.write_sizes.observe(size);
+    }
+
+    /// Records a reconfiguration request that modified the file system.
+    pub fn record_reconfiguration(&self) {
+        self.reconfigurations.fetch_add(1, Ordering::Relaxed);
+    }
+
+    /// Records an audit log event dropped because the writer could not keep up.
+    pub fn record_audit_drop(&self) {
+        self.audit_drops.fetch_add(1, Ordering::Relaxed);
+    }
+
+    /// Records whether the file system is mounted and serving requests from the kernel.
+    pub fn set_serving(&self, serving: bool) {
+        self.serving.store(serving, Ordering::SeqCst);
+    }
+
+    /// Renders all metrics, including the given sampled `gauges`, in the Prometheus text format.
+    pub fn render(&self, gauges: &Gauges) -> String {
+        let mut out = String::new();
+
+        writeln!(out, "# HELP sandboxfs_operations_total Number of FUSE operations received.")
+            .unwrap();
+        writeln!(out, "# TYPE sandboxfs_operations_total counter").unwrap();
+        for (name, count) in OP_NAMES.iter().zip(self.ops.iter()) {
+            writeln!(out, "sandboxfs_operations_total{{op=\"{}\"}} {}",
+                name, count.load(Ordering::Relaxed)).unwrap();
+        }
+
+        writeln!(out, "# HELP sandboxfs_errors_total Number of errors returned to the kernel.")
+            .unwrap();
+        writeln!(out, "# TYPE sandboxfs_errors_total counter").unwrap();
+        for (errno, count) in self.errors.iter().enumerate() {
+            let count = count.load(Ordering::Relaxed);
+            if count == 0 {
+                continue;
+            }
+            writeln!(out, "sandboxfs_errors_total{{errno=\"{}\"}} {}", errno_name(errno), count)
+                .unwrap();
+        }
+
+        self.read_sizes.render(
+            "sandboxfs_read_size_bytes", "Size of the data returned by reads.", &mut out);
+        self.write_sizes.render(
+            "sandboxfs_write_size_bytes", "Size of the data accepted by writes.", &mut out);
+
+        writeln!(out, "# HELP sandboxfs_nodes Number of nodes known by the kernel.").unwrap();
+        writeln!(out, "# TYPE sandboxfs_nodes gauge").unwrap();
+        writeln!(out, "sandboxfs_nodes {}", gauges.nodes).unwrap();
+
+        writeln!(out, "# HELP sandboxfs_open_handles Number of open file and directory handles.")
+            .unwrap();
+        writeln!(out, "# TYPE sandboxfs_open_handles gauge").unwrap();
+        writeln!(out, "sandboxfs_open_handles {}", gauges.handles).unwrap();
+
+        writeln!(out, "# HELP sandboxfs_open_fds Number of underlying files held open by file \
+            handles.").unwrap();
+        writeln!(out, "# TYPE sandboxfs_open_fds gauge").unwrap();
+        writeln!(out, "sandboxfs_open_fds {}", gauges.open_fds).unwrap();
+
+        writeln!(out, "# HELP sandboxfs_open_fds_peak Highest number of underlying files ever held \
+            open by file handles.").unwrap();
+        writeln!(out, "# TYPE sandboxfs_open_fds_peak gauge").unwrap();
+        writeln!(out, "sandboxfs_open_fds_peak {}", gauges.peak_open_fds).unwrap();
+
+        writeln!(out, "# HELP sandboxfs_in_flight_requests Number of FUSE operations being \
+            processed.").unwrap();
+        writeln!(out, "# TYPE sandboxfs_in_flight_requests gauge").unwrap();
+        writeln!(out, "sandboxfs_in_flight_requests {}", self.in_flight.load(Ordering::Relaxed))
+            .unwrap();
+
+        writeln!(out, "# HELP sandboxfs_reconfigurations_total Number of reconfiguration requests \
+            that modified the file system.").unwrap();
+        writeln!(out, "# TYPE sandboxfs_reconfigurations_total counter").unwrap();
+        writeln!(out, "sandboxfs_reconfigurations_total {}",
+            self.reconfigurations.load(Ordering::Relaxed)).unwrap();
+
+        writeln!(out, "# HELP sandboxfs_io_timeouts_total Number of operations on underlying files \
+            abandoned due to --io_timeout.").unwrap();
+        writeln!(out, "# TYPE sandboxfs_io_timeouts_total counter").unwrap();
+        for (mapping, count) in self.io_timeouts_by_mapping(&gauges.mappings) {
+            writeln!(out, "sandboxfs_io_timeouts_total{{mapping=\"{}\"}} {}",
+                escape_label(&mapping), count).unwrap();
+        }
+
+        writeln!(out, "# HELP sandboxfs_audit_log_dropped_events_total Number of audit log events \
+            dropped because the writer could not keep up.").unwrap();
+        writeln!(out, "# TYPE sandboxfs_audit_log_dropped_events_total counter").unwrap();
+        writeln!(out, "sandboxfs_audit_log_dropped_events_total {}",
+            self.audit_drops.load(Ordering::Relaxed)).unwrap();
+
+        out
+    }
+
+    /// Renders a human-readable summary of the state of the file system, consisting of the
+    /// sampled `gauges`, including the active mappings, and all non-zero counters.
+    pub fn dump(&self, gauges: &Gauges) -> String {
+        let mut out = String::new();
+
+        writeln!(out, "sandboxfs state dump").unwrap();
+        writeln!(out, "Mappings:").unwrap();
+        for mapping in &gauges.mappings {
+            match &mapping.underlying_path {
+                Some(underlying_path) => writeln!(out, "  {} -> {} ({}{}{}{})",
+                    mapping.path.display(), underlying_path.display(),
+                    if mapping.writable { "read/write" } else { "read-only" },
+                    if mapping.noexec { ", noexec" } else { "" },
+                    mapping.perm_mask.map(|m| format!(", perm={:04o}", m)).unwrap_or_default(),
+                    if mapping.unresolved { ", unresolved" } else { "" })
+                    .unwrap(),
+                None if mapping.writable => {
+                    writeln!(out, "  {} (in-memory)", mapping.path.display()).unwrap()
+                },
+                None => writeln!(out, "  {} (scaffold)", mapping.path.display()).unwrap(),
+            }
+        }
+        writeln!(out, "Nodes: {}", gauges.nodes).unwrap();
+        writeln!(out, "Open handles: {}", gauges.handles).unwrap();
+        writeln!(out, "Open files: {} (peak: {})", gauges.open_fds, gauges.peak_open_fds).unwrap();
+        writeln!(out, "In-flight requests: {}", self.in_flight.load(Ordering::Relaxed)).unwrap();
+
+        writeln!(out, "Operations:").unwrap();
+        for (name, count) in OP_NAMES.iter().zip(self.ops.iter()) {
+            let count = count.load(Ordering::Relaxed);
+            if count > 0 {
+                writeln!(out, "  {}: {}", name, count).unwrap();
+            }
+        }
+
+        writeln!(out, "Errors:").unwrap();
+        for (errno, count) in self.errors.iter().enumerate() {
+            let count = count.load(Ordering::Relaxed);
+            if count > 0 {
+                writeln!(out, "  {}: {}", errno_name(errno), count).unwrap();
+            }
+        }
+
+        writeln!(out, "Reconfigurations: {}", self.reconfigurations.load(Ordering::Relaxed))
+            .unwrap();
+
+        writeln!(out, "I/O timeouts:").unwrap();
+        for (mapping, count) in self.io_timeouts_by_mapping(&gauges.mappings) {
+            writeln!(out, "  {}: {}", mapping, count).unwrap();
+        }
+
+        out
+    }
+}
+
+/// Escapes `value` for use as a label value in the Prometheus text format.
+fn escape_label(value: &str) -> String {
+    value.replace('\\', "\\\\").replace('"', "\\\"").replace('\n', "\\n")
+}
+
+/// Returns the symbolic name of the errno at index `errno` of `Metrics::errors`.
+pub fn errno_name(errno: usize) -> String {
+    if errno == 0 {
+        "unknown".to_owned()
+    } else {
+        format!("{:?}", Errno::from_i32(errno as i32))
+    }
+}
+
+thread_local! {
+    /// Error code returned by the operation being processed by this thread, or 0 if none.
+    ///
+    /// Set by `Metrics::record_error` so that `InFlight` can report the outcome of slow operations
+    /// without having to intercept every reply.
+    static OP_ERRNO: Cell<i32> = Cell::new(0);
+}
+
+/// Limits the logging of slow operations so that a systemic slowdown does not flood the logs.
+static SLOW_OPS_LOG: RateLimiter = RateLimiter::new(1);
+
+/// Description of an operation to log if it takes too long.  See `InFlight::log_if_slower`.
+pub struct SlowOpDetails {
+    /// Path within the file system targeted by the operation, if known.
+    pub path: Option<PathBuf>,
+
+    /// Computes the underlying path targeted by the operation, if any.  This is only called once
+    /// the operation is known to be slow because it requires locking the node.
+    pub underlying_path: Box<dyn Fn() -> Option<PathBuf>>,
+}
+
+/// Scope guard that tracks an operation as in flight until dropped.  See `start_op`.
+pub struct InFlight {
+    /// Metrics that account for the operation.
+    metrics: Arc<Metrics>,
+
+    /// The operation being tracked.
+    op: Op,
+
+    /// Time at which the operation started.
+    start: Instant,
+
+    /// Threshold above which the operation is logged and its details, if requested.
+    slow: Option<(Duration, SlowOpDetails)>,
+
+    /// Execution trace to add the operation to, if requested.
+    tracer: Option<Arc<Tracer>>,
+}
+
+impl InFlight {
+    /// Requests that the operation be logged, along with its `details`, if it takes longer than
+    /// `threshold` to complete.
+    pub fn log_if_slower(&mut self, threshold: Duration, details: SlowOpDetails) {
+        self.slow = Some((threshold, details));
+    }
+
+    /// Requests that the operation be added to the execution trace recorded by `tracer` once it
+    /// completes.
+    pub fn trace_to(&mut self, tracer: Arc<Tracer>) {
+        self.tracer = Some(tracer);
+    }
+}
+
+impl Drop for InFlight {
+    fn drop(&mut self) {
+        self.metrics.in_flight.fetch_sub(1, Ordering::Relaxed);
+        let errno = OP_ERRNO.with(|op_errno| op_errno.replace(0));
+        let now = Instant::now();
+        let elapsed = now.duration_since(self.start);
+        self.metrics.latencies.record(self.op, now, elapsed, errno != 0);
+        if let Some(ref tracer) = self.tracer {
+            tracer.record(self.op, self.start, elapsed, errno);
+        }
+
+        if let Some((threshold, details)) = self.slow.take() {
+            if elapsed < threshold {
+                return;
+            }
+            if let Some(suppressed) = SLOW_OPS_LOG.check() {
+                let describe = |path: Option<PathBuf>| match path {
+                    Some(path) => format!("{}", path.display()),
+                    None => "<unknown>".to_owned(),
+                };
+                warn!("Slow {} on {} (underlying {}) took {:?} and returned errno {} \
+                    ({} similar messages suppressed)", self.op.name(), describe(details.path),
+                    describe((details.underlying_path)()), elapsed, errno, suppressed);
+            }
+        }
+    }
+}
+
+/// Records a call to the operation `op` in `metrics` and tracks it as in flight until the returned
+/// guard goes out of scope.
+pub fn start_op(metrics: &Arc<Metrics>, op: Op) -> InFlight {
+    metrics.record_op(op);
+    metrics.in_flight.fetch_add(1, Ordering::Relaxed);
+    OP_ERRNO.with(|op_errno| op_errno.set(0));
+    InFlight { metrics: metrics.clone(), op, start: Instant::now(), slow: None, tracer: None }
+}
+
+/// Computes the response to a health check of `metrics`.
+///
+/// If `self_check` is given, the file system must also pass it to be considered healthy.
+fn health(metrics: &Metrics, self_check: Option<&dyn Fn() -> Result<(), String>>)
+    -> (&'static str, String) {
+    if !metrics.serving.load(Ordering::SeqCst) {
+        return ("503 Service Unavailable", "Not serving\n".to_owned());
+    }
+    match self_check.map_or(Ok(()), |check| check()) {
+        Ok(()) => ("200 OK", "OK\n".to_owned()),
+        Err(e) => ("503 Service Unavailable", format!("{}\n", e)),
+    }
+}
+
+/// Computes the response to a request for the latency statistics of `metrics` and its content type.
+///
+/// The statistics are rendered as HTML unless the `query` string asks for `format=json`.
+fn latency_stats(metrics: &Metrics, query: &str) -> ((&'static str, String), &'static str) {
+    let format = query.split('&')
+        .filter_map(|param| {
+            let mut parts = param.splitn(2, '=');
+            match (parts.next(), parts.next()) {
+                (Some("format"), Some(value)) => Some(value),
+                _ => None,
+            }
+        })
+        .last()
+        .unwrap_or("html");
+    let snapshot = metrics.latencies.snapshot(Instant::now());
+    match format {
+        "html" => (("200 OK", snapshot.to_html()), "text/html; charset=utf-8"),
+        "json" => (("200 OK", snapshot.to_json()), "application/json"),
+        _ => (("400 Bad Request", format!("Unknown format {}\n", format)), "text/plain"),
+    }
+}
+
+/// Handles a single HTTP connection to the metrics server.
+fn handle_connection(mut stream: TcpStream, metrics: &Metrics, gauges: &impl Fn() -> Gauges,
+    self_check: &dyn Fn() -> Result<(), String>, config: &dyn Fn() -> String,
+    reconfigure: Option<&ReconfigureFn>, snapshot: Option<&SnapshotFn>) -> io::Result<()> {
+    stream.set_read_timeout(Some(CLIENT_TIMEOUT))?;
+
+    let mut reader = io::BufReader::new(stream.try_clone()?);
+    let mut request_line = String::new();
+    reader.read_line(&mut request_line)?;
+    let mut content_length = None;
+    loop {
+        // Skip all headers except for the length of the body, which we need to read it.
+        let mut line = String::new();
+        if reader.read_line(&mut line)? == 0 || line.trim().is_empty() {
+            break;
+        }
+        let mut parts = line.splitn(2, ':');
+        if let (Some(name), Some(value)) = (parts.next(), parts.next()) {
+            if name.trim().eq_ignore_ascii_case("content-length") {
+                content_length = value.trim().parse::<u64>().ok();
+            }
+        }
+    }
+
+    let mut fields = request_line.split_whitespace();
+    let method = fields.next();
+    let (path, query) = match fields.next() {
+        Some(target) => match target.find('?') {
+            Some(i) => (Some(&target[..i]), &target[i + 1..]),
+            None => (Some(target), ""),
+        },
+        None => (None, ""),
+    };
+    let ((status, body), content_type) = match (method, path) {
+        (Some("GET"), Some("/metrics")) => {
+            (("200 OK", metrics.render(&gauges())), "text/plain; version=0.0.4")
+        },
+        (Some("GET"), Some("/healthz")) => (health(metrics, None), "text/plain"),
+        (Some("GET"), Some("/readyz")) => (health(metrics, Some(self_check)), "text/plain"),
+        (Some("GET"), Some("/stats")) => latency_stats(metrics, query),
+        (Some("GET"), Some("/config")) => (("200 OK", config()), "application/json"),
+        (Some("POST"), Some("/reconfigure")) => match reconfigure {
+            Some(reconfigure) => match content_length {
+                Some(length) if length <= MAX_BODY_SIZE => {
+                    // Let the buffer grow as the body arrives instead of trusting the length that
+                    // the client claims, which could make us allocate memory for nothing.
+                    let mut body = vec!();
+                    reader.by_ref().take(length).read_to_end(&mut body)?;
+                    (reconfigure(&body), "application/json")
+                },
+                Some(_) => {
+                    (("413 Payload Too Large", "Body too large\n".to_owned()), "text/plain")
+                },
+                None => (("411 Length Required", "Missing length\n".to_owned()), "text/plain"),
+            },
+            None => {
+                let message = "Reconfiguration over HTTP is not enabled; see \
+                    --enable_http_reconfig\n".to_owned();
+                (("403 Forbidden", message), "text/plain")
+            },
+        },
+        (Some("POST"), Some("/debug/snapshot")) => match snapshot {
+            Some(snapshot) => (snapshot(), "text/plain"),
+            None => {
+                let message = "Snapshots over HTTP are not enabled; see \
+                    --enable_http_snapshot\n".to_owned();
+                (("403 Forbidden", message), "text/plain")
+            },
+        },
+        (Some("GET"), _) => (("404 Not Found", "Not found\n".to_owned()), "text/plain"),
+        _ => (("405 Method Not Allowed", "Method not allowed\n".to_owned()), "text/plain"),
+    };
+    write!(stream, "HTTP/1.0 {}\r\nContent-Type: {}\r\nContent-Length: {}\r\n\
+        Connection: close\r\n\r\n{}", status, content_type, body.len(), body)?;
+    stream.flush()
+}
+
+/// Serves `metrics` over HTTP at the `/metrics` path of `listener` in a background thread, along
+/// with the latency statistics at the `/stats` path.
+///
+/// `gauges` is invoked on every request to sample the values that are not tracked by `metrics`.
+///
+/// The `/healthz` path returns 200 while the file system is serving, as recorded via
+/// `Metrics::set_serving`, and 503 otherwise.  The `/readyz` path additionally requires
+/// `self_check` to succeed, and returns its error message in the body if it does not.
+///
+/// The `/config` path returns the JSON document rendered by `config`, which describes the
+/// configuration of the file system and its current mappings.
+///
+/// If `reconfigure` is set, POST requests to the `/reconfigure` path are passed to it along with
+/// their body.  Otherwise they are rejected.
+///
+/// If `snapshot` is set, POST requests to the `/debug/snapshot` path invoke it to write the enabled
+/// profiles to new files, and it returns the HTTP status and the body of the response.  Otherwise
+/// they are rejected.
+pub fn serve(listener: TcpListener, metrics: Arc<Metrics>,
+    gauges: impl Fn() -> Gauges + Send + 'static,
+    self_check: impl Fn() -> Result<(), String> + Send + 'static,
+    config: impl Fn() -> String + Send + 'static,
+    reconfigure: Option<impl Fn(&[u8]) -> (&'static str, String) + Send + 'static>,
+    snapshot: Option<impl Fn() -> (&'static str, String) + Send + 'static>) {
+    thread::spawn(move || {
+        for stream in listener.incoming() {
+            let reconfigure = reconfigure.as_ref().map(|f| f as &ReconfigureFn);
+            let snapshot = snapshot.as_ref().map(|f| f as &SnapshotFn);
+            let result = stream.and_then(|stream| {
+                handle_connection(stream, &metrics, &gauges, &self_check, &config, reconfigure,
+                    snapshot)
+            });
+            if let Err(e) = result {
+                warn!("Failed to serve metrics request: {}", e);
+            }
+        }
+    });
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use errors::IoTimeout;
+    use std::net::SocketAddr;
+
+    #[test]
+    fn test_op_names_match_variants() {
+        assert_eq!("create", OP_NAMES[Op::Create as usize]);
+        assert_eq!("fsyncdir", OP_NAMES[Op::Fsyncdir as usize]);
+        assert_eq!("lookup", OP_NAMES[Op::Lookup as usize]);
+        assert_eq!("write", OP_NAMES[Op::Write as usize]);
+        assert_eq!(OP_NAMES.len(), Op::Write as usize + 1);
+        for (i, op) in ALL_OPS.iter().enumerate() {
+            assert_eq!(i, *op as usize);
+        }
+    }
+
+    #[test]
+    fn test_op_from_name() {
+        assert_eq!(Some(Op::Getattr), Op::from_name("getattr"));
+        assert_eq!(Some(Op::Write), Op::from_name("write"));
+        assert_eq!(None, Op::from_name("GETATTR"));
+        assert_eq!(None, Op::from_name("unknown"));
+        assert_eq!("readdir", Op::Readdir.name());
+    }
+
+    #[test]
+    fn test_render_counters() {
+        let metrics = Metrics::default();
+        metrics.record_op(Op::Lookup);
+        metrics.record_op(Op::Lookup);
+        metrics.record_op(Op::Read);
+        let errno = metrics.record_error(&KernelError::from_errno(Errno::ENOENT));
+        assert_eq!(Errno::ENOENT as i32, errno);
+        metrics.record_reconfiguration();
+        metrics.record_audit_drop();
+
+        let out = metrics.render(
+            &Gauges { nodes: 5, handles: 2, open_fds: 3, peak_open_fds: 7, ..Default::default() });
+        assert!(out.contains("sandboxfs_operations_total{op=\"lookup\"} 2\n"));
+        assert!(out.contains("sandboxfs_operations_total{op=\"read\"} 1\n"));
+        assert!(out.contains("sandboxfs_operations_total{op=\"write\"} 0\n"));
+        assert!(out.contains("sandboxfs_errors_total{errno=\"ENOENT\"} 1\n"));
+        assert!(!out.contains("EPERM"));
+        assert!(out.contains("sandboxfs_nodes 5\n"));
+        assert!(out.contains("sandboxfs_open_handles 2\n"));
+        assert!(out.contains("sandboxfs_open_fds 3\n"));
+        assert!(out.contains("sandboxfs_open_fds_peak 7\n"));
+        assert!(out.contains("sandboxfs_reconfigurations_total 1\n"));
+        assert!(out.contains("sandboxfs_audit_log_dropped_events_total 1\n"));
+    }
+
+    #[test]
+    fn test_start_op_tracks_in_flight() {
+        let metrics = Arc::from(Metrics::default());
+        let guard1 = start_op(&metrics, Op::Read);
+        let guard2 = start_op(&metrics, Op::Write);
+        assert!(metrics.render(&Gauges { nodes: 0, handles: 0, ..Default::default() })
+            .contains("sandboxfs_in_flight_requests 2\n"));
+        drop(guard1);
+        drop(guard2);
+        let out = metrics.render(&Gauges { nodes: 0, handles: 0, ..Default::default() });
+        assert!(out.contains("sandboxfs_in_flight_requests 0\n"));
+        assert!(out.contains("sandboxfs_operations_total{op=\"read\"} 1\n"));
+        assert!(out.contains("sandboxfs_operations_total{op=\"write\"} 1\n"));
+    }
+
+    #[test]
+    fn test_start_op_records_latencies() {
+        let metrics = Arc::from(Metrics::default());
+        drop(start_op(&metrics, Op::Lookup));
+        {
+            let _guard = start_op(&metrics, Op::Lookup);
+            metrics.record_error(&KernelError::from_errno(Errno::ENOENT));
+        }
+        drop(start_op(&metrics, Op::Read));
+
+        let snapshot = metrics.latencies.snapshot(Instant::now());
+        let lookup = &snapshot.ops[Op::Lookup as usize];
+        assert_eq!((2, 1), (lookup.lifetime.count, lookup.lifetime.errors));
+        assert_eq!((2, 1), (lookup.last_minute.count, lookup.last_minute.errors));
+        let read = &snapshot.ops[Op::Read as usize];
+        assert_eq!((1, 0), (read.lifetime.count, read.lifetime.errors));
+    }
+
+    #[test]
+    fn test_dump() {
+        let metrics = Arc::from(Metrics::default());
+        metrics.record_op(Op::Lookup);
+        metrics.record_error(&KernelError::from_errno(Errno::ENOENT));
+        let _guard = start_op(&metrics, Op::Getattr);
+
+        let mappings = vec!(
+            MappingInfo {
+                path: PathBuf::from("/"), underlying_path: None, writable: false, noexec: false,
+                perm_mask: None, unresolved: false },
+            MappingInfo {
+                path: PathBuf::from("/ro"), underlying_path: Some(PathBuf::from("/a")),
+                writable: false, noexec: true, perm_mask: None, unresolved: false },
+            MappingInfo {
+                path: PathBuf::from("/rw"), underlying_path: Some(PathBuf::from("/b")),
+                writable: true, noexec: false, perm_mask: Some(0o750), unresolved: false },
+        );
+        let out = metrics.dump(
+            &Gauges { nodes: 4, handles: 1, open_fds: 1, peak_open_fds: 2, mappings });
+        assert_eq!("sandboxfs state dump\n\
+            Mappings:\n  / (scaffold)\n  /ro -> /a (read-only, noexec)\n\
+            \x20 /rw -> /b (read/write, perm=0750)\n\
+            Nodes: 4\nOpen handles: 1\nOpen files: 1 (peak: 2)\nIn-flight requests: 1\n\
+            Operations:\n  getattr: 1\n  lookup: 1\n\
+            Errors:\n  ENOENT: 1\n\
+            Reconfigurations: 0\n\
+            I/O timeouts:\n", out);
+    }
+
+    #[test]
+    fn test_io_timeouts_by_mapping() {
+        let metrics = Metrics::default();
+        let timeout = |path: &str| {
+            let timeout = IoTimeout { path: PathBuf::from(path) };
+            let e = io::Error::new(io::ErrorKind::TimedOut, timeout);
+            metrics.record_error(&KernelError::from(e));
+        };
+        timeout("/a/file");
+        timeout("/a/nested/file");
+        timeout("/a/nested/other");
+        timeout("/a/nestedfile");
+        timeout("/gone");
+
+        let mappings = vec!(
+            MappingInfo {
+                path: PathBuf::from("/"), underlying_path: None, writable: false, noexec: false,
+                perm_mask: None, unresolved: false },
+            MappingInfo {
+                path: PathBuf::from("/ro"), underlying_path: Some(PathBuf::from("/a")),
+                writable: false, noexec: false, perm_mask: None, unresolved: false },
+            MappingInfo {
+                path: PathBuf::from("/ro/sub \"dir\""),
+                underlying_path: Some(PathBuf::from("/a/nested")), writable: false,
+                noexec: false, perm_mask: None, unresolved: false },
+        );
+        let out = metrics.render(&Gauges { nodes: 0, handles: 0, mappings, ..Default::default() });
+        assert!(out.contains("sandboxfs_errors_total{errno=\"EIO\"} 5\n"));
+        assert!(out.contains("sandboxfs_io_timeouts_total{mapping=\"/ro\"} 2\n"));
+        assert!(out.contains(
+            "sandboxfs_io_timeouts_total{mapping=\"/ro/sub \\\"dir\\\"\"} 2\n"));
+        assert!(out.contains("sandboxfs_io_timeouts_total{mapping=\"unknown\"} 1\n"));
+    }
+
+    #[test]
+    fn test_io_timeouts_are_capped() {
+        let metrics = Metrics::default();
+        let timeout = |path: PathBuf| {
+            let e = io::Error::new(io::ErrorKind::TimedOut, IoTimeout { path: path });
+            metrics.record_error(&KernelError::from(e));
+        };
+        for i in 0..MAX_IO_TIMEOUT_PATHS + 10 {
+            timeout(PathBuf::from(format!("/a/file{}", i)));
+        }
+        timeout(PathBuf::from("/a/file0"));
+        assert_eq!(MAX_IO_TIMEOUT_PATHS, metrics.io_timeouts.lock().unwrap().len());
+
+        let mappings = vec!(
+            MappingInfo {
+                path: PathBuf::from("/ro"), underlying_path: Some(PathBuf::from("/a")),
+                writable: false, noexec: false, perm_mask: None, unresolved: false },
+        );
+        let mut exp = BTreeMap::new();
+        exp.insert("/ro".to_owned(), MAX_IO_TIMEOUT_PATHS + 1);
+        exp.insert("unknown".to_owned(), 10);
+        assert_eq!(exp, metrics.io_timeouts_by_mapping(&mappings));
+    }
+
+    #[test]
+    fn test_render_histograms() {
+        let metrics = Metrics::default();
+        metrics.record_read(100);
+        metrics.record_read(4096);
+        metrics.record_read(2_000_000);
+
+        let out = metrics.render(&Gauges { nodes: 0, handles: 0, ..Default::default() });
+        assert!(out.contains("sandboxfs_read_size_bytes_bucket{le=\"512\"} 1\n"));
+        assert!(out.contains("sandboxfs_read_size_bytes_bucket{le=\"4096\"} 2\n"));
+        assert!(out.contains("sandboxfs_read_size_bytes_bucket{le=\"1048576\"} 2\n"));
+        assert!(out.contains("sandboxfs_read_size_bytes_bucket{le=\"+Inf\"} 3\n"));
+        assert!(out.contains("sandboxfs_read_size_bytes_sum 2004196\n"));
+        assert!(out.contains("sandboxfs_read_size_bytes_count 3\n"));
+        assert!(out.contains("sandboxfs_write_size_bytes_count 0\n"));
+    }
+
+    /// Sends the raw HTTP `request` to the server at `address` and returns its raw response.
+    fn send(address: SocketAddr, request: &str) -> String {
+        let mut stream = TcpStream::connect(address).unwrap();
+        stream.write_all(request.as_bytes()).unwrap();
+        let mut response = String::new();
+        stream.read_to_string(&mut response).unwrap();
+        response
+    }
+
+    #[test]
+    fn test_serve() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let address = listener.local_addr().unwrap();
+        let metrics = Arc::from(Metrics::default());
+        metrics.record_op(Op::Statfs);
+        let reconfigure = |body: &[u8]| ("200 OK", format!("got {}", body.len()));
+        serve(listener, metrics, || Gauges { nodes: 1, handles: 0, ..Default::default() },
+            || Ok(()), || "{\"config\":true}\n".to_owned(), Some(reconfigure),
+            Some(|| ("200 OK", "/tmp/snapshot\n".to_owned())));
+
+        let fetch = |path: &str| {
+            send(address, &format!("GET {} HTTP/1.1\r\nHost: localhost\r\n\r\n", path))
+        };
+
+        let response = fetch("/metrics");
+        assert!(response.starts_with("HTTP/1.0 200 OK\r\n"));
+        assert!(response.contains("sandboxfs_operations_total{op=\"statfs\"} 1\n"));
+        assert!(response.contains("sandboxfs_nodes 1\n"));
+
+        let response = fetch("/stats");
+        assert!(response.starts_with("HTTP/1.0 200 OK\r\n"));
+        assert!(response.contains("Content-Type: text/html; charset=utf-8\r\n"));
+        assert!(response.contains("<tr><td>statfs</td>"));
+
+        let response = fetch("/stats?format=json");
+        assert!(response.starts_with("HTTP/1.0 200 OK\r\n"));
+        assert!(response.contains("Content-Type: application/json\r\n"));
+        assert!(response.contains("{\"op\":\"statfs\","));
+
+        let response = fetch("/stats?format=xml");
+        assert!(response.starts_with("HTTP/1.0 400 Bad Request\r\n"));
+
+        let response = fetch("/config");
+        assert!(response.starts_with("HTTP/1.0 200 OK\r\n"));
+        assert!(response.contains("Content-Type: application/json\r\n"));
+        assert!(response.ends_with("\r\n\r\n{\"config\":true}\n"));
+
+        let response = fetch("/other");
+        assert!(response.starts_with("HTTP/1.0 404 Not Found\r\n"));
+
+        let response = fetch("/reconfigure");
+        assert!(response.starts_with("HTTP/1.0 405 Method Not Allowed\r\n"));
+
+        let response = send(address, "POST /reconfigure HTTP/1.1\r\nContent-length: 5\r\n\r\n\
+            12345");
+        assert!(response.starts_with("HTTP/1.0 200 OK\r\n"));
+        assert!(response.ends_with("\r\n\r\ngot 5"));
+
+        let response = send(address, "POST /reconfigure HTTP/1.1\r\n\r\n");
+        assert!(response.starts_with("HTTP/1.0 411 Length Required\r\n"));
+
+        let response = send(address, &format!(
+            "POST /reconfigure HTTP/1.1\r\nContent-Length: {}\r\n\r\n", MAX_BODY_SIZE + 1));
+        assert!(response.starts_with("HTTP/1.0 413 Payload Too Large\r\n"));
+
+        let response = send(address, "POST /debug/snapshot HTTP/1.1\r\n\r\n");
+        assert!(response.starts_with("HTTP/1.0 200 OK\r\n"));
+        assert!(response.ends_with("\r\n\r\n/tmp/snapshot\n"));
+
+        let response = fetch("/debug/snapshot");
+        assert!(response.starts_with("HTTP/1.0 404 Not Found\r\n"));
+    }
+
+    #[test]
+    fn test_serve_reconfigure_disabled() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let address = listener.local_addr().unwrap();
+        let reconfigure: Option<fn(&[u8]) -> (&'static str, String)> = None;
+        serve(listener, Arc::from(Metrics::default()), Gauges::default, || Ok(()), String::new,
+            reconfigure, Some(|| ("200 OK", String::new())));
+
+        let response = send(address, "POST /reconfigure HTTP/1.1\r\nContent-Length: 2\r\n\r\n\
+            {}");
+        assert!(response.starts_with("HTTP/1.0 403 Forbidden\r\n"));
+        assert!(response.contains("--enable_http_reconfig"));
+    }
+
+    #[test]
+    fn test_serve_snapshot_disabled() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let address = listener.local_addr().unwrap();
+        let snapshot: Option<fn() -> (&'static str, String)> = None;
+        serve(listener, Arc::from(Metrics::default()), Gauges::default, || Ok(()), String::new,
+            Some(|_: &[u8]| ("200 OK", String::new())), snapshot);
+
+        let response = send(address, "POST /debug/snapshot HTTP/1.1\r\n\r\n");
+        assert!(response.starts_with("HTTP/1.0 403 Forbidden\r\n"));
+        assert!(response.contains("--enable_http_snapshot"));
+    }
+
+    #[test]
+    fn test_health() {
+        let metrics = Metrics::default();
+        let ok = || -> Result<(), String> { Ok(()) };
+        let broken = || -> Result<(), String> { Err("Broken root".to_owned()) };
+
+        assert_eq!("503 Service Unavailable", health(&metrics, None).0);
+        assert_eq!("503 Service Unavailable", health(&metrics, Some(&ok)).0);
+
+        metrics.set_serving(true);
+        assert_eq!(("200 OK", "OK\n".to_owned()), health(&metrics, None));
+        assert_eq!(("200 OK", "OK\n".to_owned()), health(&metrics, Some(&ok)));
+        assert_eq!(("503 Service Unavailable", "Broken root\n".to_owned()),
+            health(&metrics, Some(&broken)));
+
+        metrics.set_serving(false);
+        assert_eq!("503 Service Unavailable", health(&metrics, None).0);
+    }
+}
@@ -13,12 +13,17 @@
 // under the License.
 
 use {fuse, IdGenerator};
+use logging::RateLimiter;
 use nodes::{ArcNode, Cache, Dir, File, Symlink};
 use std::collections::HashMap;
 use std::fs;
 use std::path::{Path, PathBuf};
 use std::sync::Mutex;
 
+/// Limits the logging of missed caching opportunities, which can happen for every lookup of the
+/// files shared by mappings that differ in writability.
+static MISSED_CACHING_LOG: RateLimiter = RateLimiter::new(60);
+
 /// Node factory without any caching.
 #[derive(Default)]
 pub struct NoCache {
@@ -28,11 +33,11 @@ impl Cache for NoCache {
     fn get_or_create(&self, ids: &IdGenerator, underlying_path: &Path, attr: &fs::Metadata,
         writable: bool) -> ArcNode {
         if attr.is_dir() {
-            Dir::new_mapped(ids.next(), underlying_path, attr, writable)
+            Dir::new_mapped(ids.for_underlying(attr), underlying_path, attr, writable)
         } else if attr.file_type().is_symlink() {
-            Symlink::new_mapped(ids.next(), underlying_path, attr, writable)
+            Symlink::new_mapped(ids.for_underlying(attr), underlying_path, attr, writable)
         } else {
-            File::new_mapped(ids.next(), underlying_path, attr, writable)
+            File::new_mapped(ids.for_underlying(attr), underlying_path, attr, writable)
         }
     }
 
@@ -43,6 +48,10 @@ impl Cache for NoCache {
     fn rename(&self, _old_path: &Path, _new_path: PathBuf, _file_type: fuse::FileType) {
         // Nothing to do.
     }
+
+    fn forget(&self, _path: &Path, _inode: u64) {
+        // Nothing to do.
+    }
 }
 
 /// Cache of sandboxfs nodes indexed by their underlying path.
@@ -59,11 +68,10 @@ impl Cache for NoCache {
 /// deleted by the user (because there is a chance they'll be recreated, and at that point we truly
 /// want to reload the data from disk).
 ///
-/// TODO(jmmv): There currently is no cache expiration, which means that memory usage can grow
-/// unboundedly.  A preliminary attempt at expiring cache entries on a node's forget handler sounded
-/// promising (because then cache expiration would be delegated to the kernel)... but, on Linux, the
-/// kernel seems to be calling this very eagerly, rendering our cache useless.  I did not track down
-/// what exactly triggered the forget notifications though.
+/// Entries are also dropped when the kernel forgets about their nodes so that memory usage does not
+/// grow unboundedly.  The kernel tends to do this eagerly on Linux, but this does not defeat the
+/// purpose of the cache because a reloaded node gets the same inode number as the one it replaces
+/// as long as the underlying file is the same.
 ///
 /// TODO(jmmv): This cache has proven to be problematic in some cases and should probably be
 /// removed.  See https://jmmv.dev/2020/01/osxfuse-hardlinks-dladdr.html for details.
@@ -81,7 +89,7 @@ impl Cache for PathCache {
             //
             // TODO(jmmv): Actually, they *could* be cached, but it's hard.  Investigate doing so
             // after quantifying how much it may benefit performance.
-            return Dir::new_mapped(ids.next(), underlying_path, attr, writable);
+            return Dir::new_mapped(ids.for_underlying(attr), underlying_path, attr, writable);
         }
 
         let mut entries = self.entries.lock().unwrap();
@@ -104,16 +112,18 @@ impl Cache for PathCache {
             // reason is that the writability property is a setting of the mappings, not a property
             // of the underlying files, and thus it's a setting that we fully control and must keep
             // correct across reconfigurations or across different mappings of the same files.
-            info!("Missed node caching opportunity because writability has changed for {:?}",
-                underlying_path)
+            if let Some(suppressed) = MISSED_CACHING_LOG.check() {
+                info!("Missed node caching opportunity because writability has changed for {:?} \
+                    ({} similar messages suppressed)", underlying_path, suppressed);
+            }
         }
 
         let node: ArcNode = if attr.is_dir() {
             panic!("Directory entries cannot be cached and are handled above");
         } else if attr.file_type().is_symlink() {
-            Symlink::new_mapped(ids.next(), underlying_path, attr, writable)
+            Symlink::new_mapped(ids.for_underlying(attr), underlying_path, attr, writable)
         } else {
-            File::new_mapped(ids.next(), underlying_path, attr, writable)
+            File::new_mapped(ids.for_underlying(attr), underlying_path, attr, writable)
         };
         entries.insert(underlying_path.to_path_buf(), node.clone());
         node
@@ -137,6 +147,13 @@ impl Cache for PathCache {
             entries.insert(new_path, node);
         }
     }
+
+    fn forget(&self, path: &Path, inode: u64) {
+        let mut entries = self.entries.lock().unwrap();
+        if entries.get(path).map_or(false, |node| node.inode() == inode) {
+            entries.remove(path);
+        }
+    }
 }
 
 #[cfg(test)]
@@ -186,6 +203,27 @@ mod tests {
         assert_eq!(9, cache.get_or_create(&ids, &file2, &file2attr, true).inode());
     }
 
+    #[test]
+    fn path_cache_forget() {
+        let root = tempdir().unwrap();
+
+        let file1 = root.path().join("file1");
+        drop(fs::File::create(&file1).unwrap());
+        let file1attr = fs::symlink_metadata(&file1).unwrap();
+
+        let ids = IdGenerator::new(1);
+        let cache = PathCache::default();
+        assert_eq!(1, cache.get_or_create(&ids, &file1, &file1attr, false).inode());
+
+        // Forgetting a node other than the cached one for the same path has no effect.
+        cache.forget(&file1, 5);
+        assert_eq!(1, cache.get_or_create(&ids, &file1, &file1attr, false).inode());
+
+        // Forgetting the cached node drops it, so a new node is created next time.
+        cache.forget(&file1, 1);
+        assert_eq!(2, cache.get_or_create(&ids, &file1, &file1attr, false).inode());
+    }
+
     #[test]
     fn path_cache_nodes_support_all_file_types() {
         let ids = IdGenerator::new(1);
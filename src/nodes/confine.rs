@@ -0,0 +1,477 @@
+// Copyright 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License.  You may obtain a copy
+// of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.  See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+use libc;
+use nix;
+use nix::NixPath;
+use nix::errno::Errno;
+use nix::fcntl::{self, OFlag};
+use nix::sys::stat::{self, Mode, SFlag};
+use nix::unistd;
+use std::ffi::OsStr;
+use std::fs;
+use std::io;
+use std::os::unix::io::{FromRawFd, RawFd};
+use std::path::{Component, Path, PathBuf};
+use std::sync::atomic::{AtomicBool, Ordering};
+use xattr;
+
+/// Whether accessing underlying files must refuse to traverse symlinks.
+///
+/// Nodes only ever reach underlying files by joining the names of the directory entries they
+/// discovered with `lstat`, so the paths they use never traverse symlinks unless the underlying
+/// file system changes behind our back, as a malicious process can do to make us access files
+/// outside of the mapped targets.  Symlinks within the sandbox are resolved by the kernel and keep
+/// working because they are exposed as symlink nodes.
+static CONFINE_SYMLINKS: AtomicBool = AtomicBool::new(false);
+
+/// Enables or disables the confinement of accesses to underlying files.
+pub fn set_confine_symlinks(enabled: bool) {
+    CONFINE_SYMLINKS.store(enabled, Ordering::SeqCst);
+}
+
+/// Returns whether accesses to underlying files are confined.
+pub fn confine_symlinks() -> bool {
+    CONFINE_SYMLINKS.load(Ordering::Relaxed)
+}
+
+/// Opens the underlying file `path` with `options`.
+///
+/// If confinement is enabled, the file is instead opened with the open(2) `oflag` and `mode`,
+/// which must be equivalent to `options`, and the open fails with `EXDEV` if `path` traverses or
+/// names a symlink.
+#[allow(unsafe_code)]
+pub fn open(path: &Path, options: &fs::OpenOptions, oflag: OFlag, mode: Mode)
+    -> io::Result<fs::File> {
+    if !confine_symlinks() {
+        return options.open(path);
+    }
+
+    let mode = if oflag.contains(OFlag::O_CREAT) { mode } else { Mode::empty() };
+    match open_nofollow(path, oflag | OFlag::O_CLOEXEC, mode) {
+        Ok(fd) => Ok(unsafe { fs::File::from_raw_fd(fd) }),
+        Err(e) if e.raw_os_error() == Some(Errno::ELOOP as i32) => {
+            warn!("Refusing to open {} because it traverses a symlink", path.display());
+            Err(io::Error::from_raw_os_error(Errno::EXDEV as i32))
+        },
+        Err(e) => Err(e),
+    }
+}
+
+/// Runs `op` on the underlying file `path`, which `op` receives as a name relative to a directory.
+///
+/// If confinement is disabled, `op` gets `AT_FDCWD` and `path` itself.  Otherwise, `op` gets the
+/// parent directory of `path`, opened without traversing any symlinks, and the last component of
+/// `path`, which `op` must not follow if it is a symlink.  In that case, the operation fails with
+/// `EXDEV` if `path` traverses a symlink.
+pub fn at<T, F>(path: &Path, op: F) -> nix::Result<T>
+    where F: FnOnce(RawFd, &Path) -> nix::Result<T> {
+    if !confine_symlinks() {
+        return op(libc::AT_FDCWD, path);
+    }
+    at_confined(path, op)
+}
+
+/// Same as `at` but always confined.
+fn at_confined<T, F>(path: &Path, op: F) -> nix::Result<T>
+    where F: FnOnce(RawFd, &Path) -> nix::Result<T> {
+    let (parent, name) = match (path.parent(), path.file_name()) {
+        (Some(parent), Some(name)) => (parent, Path::new(name)),
+        _ => return op(libc::AT_FDCWD, path),
+    };
+
+    let result = open_nofollow(parent, dir_oflag(), Mode::empty()).map_err(io_to_nix)
+        .and_then(|dirfd| {
+            let result = op(dirfd, name);
+            let _ = unistd::close(dirfd);
+            result
+        });
+    match result {
+        Err(nix::Error::Sys(Errno::ELOOP)) => {
+            warn!("Refusing to access {} because it traverses a symlink", path.display());
+            Err(nix::Error::from_errno(Errno::EXDEV))
+        },
+        result => result,
+    }
+}
+
+/// Returns the flags to open the directories that `at` hands to its operations.
+#[cfg(target_os = "linux")]
+fn dir_oflag() -> OFlag {
+    // O_PATH lets us operate within directories that we can search but not read.
+    OFlag::O_PATH | OFlag::O_DIRECTORY | OFlag::O_CLOEXEC
+}
+
+/// Returns the flags to open the directories that `at` hands to its operations.
+#[cfg(not(target_os = "linux"))]
+fn dir_oflag() -> OFlag {
+    OFlag::O_RDONLY | OFlag::O_DIRECTORY | OFlag::O_CLOEXEC
+}
+
+/// Runs `op` on a path that reaches the underlying file `path` without traversing any symlinks.
+///
+/// This is for operations that have no `*at` variant but that do not follow a symlink in the last
+/// component.  On Linux, the path goes through the `/proc/self/fd` entry of the parent directory
+/// that `at` opens.  Elsewhere, there is no such mechanism and `op` gets `path` itself.
+fn via_parent<T, F>(path: &Path, op: F) -> io::Result<T> where F: FnOnce(&Path) -> io::Result<T> {
+    if !cfg!(target_os = "linux") || !confine_symlinks() || path.parent().is_none() {
+        return op(path);
+    }
+    at(path, |dirfd, name| {
+        let proc_path = Path::new(&format!("/proc/self/fd/{}", dirfd)).join(name);
+        op(&proc_path).map_err(io_to_nix)
+    }).map_err(nix_to_io)
+}
+
+/// Same as `fs::symlink_metadata` but confined if enabled.
+///
+/// Only confined on Linux.
+pub fn symlink_metadata(path: &Path) -> io::Result<fs::Metadata> {
+    via_parent(path, |p| fs::symlink_metadata(p))
+}
+
+/// Same as `fs::read_link` but confined if enabled.
+///
+/// Only confined on Linux.
+pub fn read_link(path: &Path) -> io::Result<PathBuf> {
+    via_parent(path, |p| fs::read_link(p))
+}
+
+/// Same as `fs::DirBuilder::create` for a directory with permissions `mode` but confined if
+/// enabled.
+#[allow(unsafe_code)]
+pub fn mkdir(path: &Path, mode: u32) -> io::Result<()> {
+    at(path, |dirfd, name| {
+        let ret = name.with_nix_path(|cstr| unsafe {
+            libc::mkdirat(dirfd, cstr.as_ptr(), mode as libc::mode_t)
+        })?;
+        Errno::result(ret).map(drop)
+    }).map_err(nix_to_io)
+}
+
+/// Same as `nix::sys::stat::mknod` but confined if enabled.
+///
+/// Only confined on Linux.
+#[cfg(target_os = "linux")]
+#[allow(unsafe_code)]
+pub fn mknod(path: &Path, kind: SFlag, perm: Mode, dev: stat::dev_t) -> io::Result<()> {
+    at(path, |dirfd, name| {
+        let ret = name.with_nix_path(|cstr| unsafe {
+            libc::mknodat(dirfd, cstr.as_ptr(), kind.bits() | perm.bits(), dev)
+        })?;
+        Errno::result(ret).map(drop)
+    }).map_err(nix_to_io)
+}
+
+/// Same as `nix::sys::stat::mknod` but confined if enabled.
+///
+/// Only confined on Linux.
+#[cfg(not(target_os = "linux"))]
+pub fn mknod(path: &Path, kind: SFlag, perm: Mode, dev: stat::dev_t) -> io::Result<()> {
+    stat::mknod(path, kind, perm, dev).map_err(nix_to_io)
+}
+
+/// Same as `fs::remove_file` but confined if enabled.
+pub fn remove_file(path: &Path) -> io::Result<()> {
+    unlink(path, 0)
+}
+
+/// Same as `fs::remove_dir` but confined if enabled.
+pub fn remove_dir(path: &Path) -> io::Result<()> {
+    unlink(path, libc::AT_REMOVEDIR)
+}
+
+/// Removes `path` via unlinkat(2) with the given `flags`.
+#[allow(unsafe_code)]
+fn unlink(path: &Path, flags: libc::c_int) -> io::Result<()> {
+    at(path, |dirfd, name| {
+        let ret = name.with_nix_path(|cstr| unsafe {
+            libc::unlinkat(dirfd, cstr.as_ptr(), flags)
+        })?;
+        Errno::result(ret).map(drop)
+    }).map_err(nix_to_io)
+}
+
+/// Same as `fs::rename` but confined if enabled.
+#[allow(unsafe_code)]
+pub fn rename(old_path: &Path, new_path: &Path) -> io::Result<()> {
+    at(old_path, |old_dirfd, old_name| at(new_path, |new_dirfd, new_name| {
+        let ret = old_name.with_nix_path(|old_cstr| new_name.with_nix_path(|new_cstr| unsafe {
+            libc::renameat(old_dirfd, old_cstr.as_ptr(), new_dirfd, new_cstr.as_ptr())
+        }))??;
+        Errno::result(ret).map(drop)
+    })).map_err(nix_to_io)
+}
+
+/// Same as `std::os::unix::fs::symlink` but confined if enabled.
+#[allow(unsafe_code)]
+pub fn symlink(target: &Path, path: &Path) -> io::Result<()> {
+    at(path, |dirfd, name| {
+        let ret = target.with_nix_path(|target_cstr| name.with_nix_path(|cstr| unsafe {
+            libc::symlinkat(target_cstr.as_ptr(), dirfd, cstr.as_ptr())
+        }))??;
+        Errno::result(ret).map(drop)
+    }).map_err(nix_to_io)
+}
+
+/// Same as `fchmodat` with `FollowSymlink` but confined if enabled.
+///
+/// `path` must not be a symlink.
+#[cfg(target_os = "linux")]
+pub fn chmod(path: &Path, mode: Mode) -> nix::Result<()> {
+    if !confine_symlinks() {
+        return stat::fchmodat(None, path, mode, stat::FchmodatFlags::FollowSymlink);
+    }
+    at(path, |dirfd, name| {
+        // fchmodat(2) cannot leave symlinks alone on Linux, and fchmod(2) does not work on O_PATH
+        // descriptors, so go through the descriptor's magic link once we know it is no symlink.
+        let fd = fcntl::openat(
+            dirfd, name, OFlag::O_PATH | OFlag::O_NOFOLLOW | OFlag::O_CLOEXEC, Mode::empty())?;
+        let result = stat::fstat(fd).and_then(|attr| {
+            if attr.st_mode & libc::S_IFMT == libc::S_IFLNK {
+                return Err(nix::Error::from_errno(Errno::ELOOP));
+            }
+            let fd_path = format!("/proc/self/fd/{}", fd);
+            stat::fchmodat(None, Path::new(&fd_path), mode, stat::FchmodatFlags::FollowSymlink)
+        });
+        let _ = unistd::close(fd);
+        result
+    })
+}
+
+/// Same as `fchmodat` with `FollowSymlink` but confined if enabled.
+///
+/// `path` must not be a symlink.
+#[cfg(not(target_os = "linux"))]
+pub fn chmod(path: &Path, mode: Mode) -> nix::Result<()> {
+    if !confine_symlinks() {
+        return stat::fchmodat(None, path, mode, stat::FchmodatFlags::FollowSymlink);
+    }
+    at(path, |dirfd, name| {
+        stat::fchmodat(Some(dirfd), name, mode, stat::FchmodatFlags::NoFollowSymlink)
+    })
+}
+
+/// Same as `fchownat` with `NoFollowSymlink` but confined if enabled.
+pub fn lchown(path: &Path, uid: Option<unistd::Uid>, gid: Option<unistd::Gid>)
+    -> nix::Result<()> {
+    at(path, |dirfd, name| {
+        unistd::fchownat(Some(dirfd), name, uid, gid, unistd::FchownatFlags::NoFollowSymlink)
+    })
+}
+
+/// Same as `nix::unistd::truncate` but confined if enabled.
+///
+/// When confined, `path` must not be a symlink.
+pub fn truncate(path: &Path, size: i64) -> nix::Result<()> {
+    if !confine_symlinks() {
+        return unistd::truncate(path, size);
+    }
+    at(path, |dirfd, name| {
+        let oflag = OFlag::O_WRONLY | OFlag::O_NOFOLLOW | OFlag::O_NONBLOCK | OFlag::O_CLOEXEC;
+        let fd = fcntl::openat(dirfd, name, oflag, Mode::empty())?;
+        let result = unistd::ftruncate(fd, size);
+        let _ = unistd::close(fd);
+        result
+    })
+}
+
+/// Same as `xattr::get` but confined if enabled.
+///
+/// Only confined on Linux.
+pub fn get_xattr(path: &Path, name: &OsStr) -> io::Result<Option<Vec<u8>>> {
+    via_parent(path, |p| xattr::get(p, name))
+}
+
+/// Same as `xattr::list` but confined if enabled.
+///
+/// Only confined on Linux.
+pub fn list_xattrs(path: &Path) -> io::Result<xattr::XAttrs> {
+    via_parent(path, |p| xattr::list(p))
+}
+
+/// Same as `xattr::remove` but confined if enabled.
+///
+/// Only confined on Linux.
+pub fn remove_xattr(path: &Path, name: &OsStr) -> io::Result<()> {
+    via_parent(path, |p| xattr::remove(p, name))
+}
+
+/// Same as `xattr::set` but confined if enabled.
+///
+/// Only confined on Linux.
+pub fn set_xattr(path: &Path, name: &OsStr, value: &[u8]) -> io::Result<()> {
+    via_parent(path, |p| xattr::set(p, name, value))
+}
+
+/// Opens `path` without following any symlinks, failing with `ELOOP` if it traverses one.
+#[cfg(target_os = "linux")]
+fn open_nofollow(path: &Path, oflag: OFlag, mode: Mode) -> io::Result<RawFd> {
+    match openat2_nofollow(path, oflag, mode) {
+        Err(ref e) if e.raw_os_error() == Some(Errno::ENOSYS as i32) => {
+            // openat2(2) only exists since Linux 5.6.
+            open_walking(path, oflag, mode)
+        },
+        result => result,
+    }
+}
+
+/// Opens `path` without following any symlinks, failing with `ELOOP` if it traverses one.
+#[cfg(not(target_os = "linux"))]
+fn open_nofollow(path: &Path, oflag: OFlag, mode: Mode) -> io::Result<RawFd> {
+    open_walking(path, oflag, mode)
+}
+
+/// Opens `path` via openat2(2) asking the kernel to not resolve any symlinks.
+#[cfg(target_os = "linux")]
+#[allow(unsafe_code)]
+fn openat2_nofollow(path: &Path, oflag: OFlag, mode: Mode) -> io::Result<RawFd> {
+    use libc;
+    use std::ffi::CString;
+    use std::mem;
+    use std::os::unix::ffi::OsStrExt;
+
+    /// Number of the openat2(2) system call, which is the same on all architectures.
+    const SYS_OPENAT2: libc::c_long = 437;
+
+    /// Makes openat2(2) fail with `ELOOP` when encountering magic links, like /proc/self/fd/*.
+    const RESOLVE_NO_MAGICLINKS: u64 = 0x02;
+
+    /// Makes openat2(2) fail with `ELOOP` when encountering any symlink.
+    const RESOLVE_NO_SYMLINKS: u64 = 0x04;
+
+    /// Mirror of the kernel's `struct open_how`.
+    #[repr(C)]
+    struct OpenHow {
+        flags: u64,
+        mode: u64,
+        resolve: u64,
+    }
+
+    let path = CString::new(path.as_os_str().as_bytes())
+        .map_err(|_| io::Error::from_raw_os_error(Errno::EINVAL as i32))?;
+    let how = OpenHow {
+        flags: oflag.bits() as u64,
+        mode: mode.bits() as u64,
+        resolve: RESOLVE_NO_MAGICLINKS | RESOLVE_NO_SYMLINKS,
+    };
+    let fd = unsafe {
+        libc::syscall(SYS_OPENAT2, libc::AT_FDCWD, path.as_ptr(), &how as *const OpenHow,
+            mem::size_of::<OpenHow>())
+    };
+    if fd == -1 {
+        return Err(io::Error::last_os_error());
+    }
+    Ok(fd as RawFd)
+}
+
+/// Opens `path` by walking its components one at a time relative to the previous one and
+/// refusing to follow symlinks at every step.
+fn open_walking(path: &Path, oflag: OFlag, mode: Mode) -> io::Result<RawFd> {
+    let mut names = vec!();
+    for component in path.components() {
+        match component {
+            Component::RootDir => (),
+            Component::Normal(name) => names.push(name),
+            _ => panic!("Paths to underlying files are always absolute and normalized"),
+        }
+    }
+    let last = match names.pop() {
+        Some(last) => last,
+        None => return open_last(None, Path::new("/"), oflag, mode),
+    };
+
+    let dir_oflag = OFlag::O_RDONLY | OFlag::O_DIRECTORY | OFlag::O_NOFOLLOW | OFlag::O_CLOEXEC;
+    let mut dirfd = fcntl::open("/", dir_oflag, Mode::empty()).map_err(nix_to_io)?;
+    for name in names {
+        let result = fcntl::openat(dirfd, name, dir_oflag, Mode::empty());
+        let _ = unistd::close(dirfd);
+        dirfd = result.map_err(nix_to_io)?;
+    }
+    let result = open_last(Some(dirfd), Path::new(last), oflag, mode);
+    let _ = unistd::close(dirfd);
+    result
+}
+
+/// Opens `name` relative to `dirfd`, or `name` itself if there is no directory, without following
+/// a symlink in its last component.
+fn open_last(dirfd: Option<RawFd>, name: &Path, oflag: OFlag, mode: Mode) -> io::Result<RawFd> {
+    let oflag = oflag | OFlag::O_NOFOLLOW;
+    let result = match dirfd {
+        Some(dirfd) => fcntl::openat(dirfd, name, oflag, mode),
+        None => fcntl::open(name, oflag, mode),
+    };
+    result.map_err(nix_to_io)
+}
+
+/// Converts a `nix::Error` into an `io::Error`, preserving the errno value if there is one.
+fn nix_to_io(e: nix::Error) -> io::Error {
+    match e {
+        nix::Error::Sys(errno) => io::Error::from_raw_os_error(errno as i32),
+        e => io::Error::new(io::ErrorKind::Other, e),
+    }
+}
+
+/// Converts an `io::Error` into a `nix::Error`, propagating errors without an errno as `EIO`.
+fn io_to_nix(e: io::Error) -> nix::Error {
+    nix::Error::from_errno(Errno::from_i32(e.raw_os_error().unwrap_or(Errno::EIO as i32)))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use nix::fcntl::AtFlags;
+    use std::os::unix;
+    use tempfile::tempdir;
+
+    #[test]
+    fn test_at_confined() {
+        let dir = tempdir().unwrap();
+        // The temporary directory itself may be behind a symlink (e.g. /tmp on macOS).
+        let root = fs::canonicalize(dir.path()).unwrap();
+        fs::create_dir(root.join("dir")).unwrap();
+        fs::write(root.join("dir/file"), "contents").unwrap();
+        unix::fs::symlink("dir", root.join("dir-link")).unwrap();
+
+        let lstat = |dirfd, name: &Path| stat::fstatat(dirfd, name, AtFlags::AT_SYMLINK_NOFOLLOW);
+        let attr = at_confined(&root.join("dir/file"), lstat).unwrap();
+        assert_eq!(libc::S_IFREG, attr.st_mode & libc::S_IFMT);
+
+        // A symlink in the last component is handed to the operation, which must not follow it.
+        let attr = at_confined(&root.join("dir-link"), lstat).unwrap();
+        assert_eq!(libc::S_IFLNK, attr.st_mode & libc::S_IFMT);
+
+        let err = at_confined(&root.join("dir-link/file"), lstat).unwrap_err();
+        assert_eq!(nix::Error::from_errno(Errno::EXDEV), err);
+    }
+
+    #[test]
+    fn test_open_walking() {
+        let dir = tempdir().unwrap();
+        // The temporary directory itself may be behind a symlink (e.g. /tmp on macOS).
+        let root = fs::canonicalize(dir.path()).unwrap();
+        fs::create_dir(root.join("dir")).unwrap();
+        fs::write(root.join("dir/file"), "contents").unwrap();
+        unix::fs::symlink("dir", root.join("dir-link")).unwrap();
+        unix::fs::symlink("file", root.join("dir/file-link")).unwrap();
+
+        let fd = open_walking(&root.join("dir/file"), OFlag::O_RDONLY, Mode::empty()).unwrap();
+        unistd::close(fd).unwrap();
+
+        for path in &["dir-link/file", "dir/file-link"] {
+            let err = open_walking(&root.join(path), OFlag::O_RDONLY, Mode::empty()).unwrap_err();
+            assert_eq!(Some(Errno::ELOOP as i32), err.raw_os_error(), "{}", path);
+        }
+    }
+}
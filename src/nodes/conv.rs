@@ -60,29 +60,6 @@ pub fn timespec_to_timeval(spec: Timespec) -> sys::time::TimeVal {
     TimeVal::seconds(spec.sec) + TimeVal::nanoseconds(spec.nsec.into())
 }
 
-/// Converts a `sys::time::TimeVal` object into a `time::Timespec`.
-// TODO(jmmv): Consider upstreaming this function as a TimeVal method.
-pub fn timeval_to_timespec(val: sys::time::TimeVal) -> Timespec {
-    let usec = if val.tv_usec() > sys::time::suseconds_t::from(std::i32::MAX) {
-        warn!("Cannot represent too-long usec quantity {} in timespec; using 0", val.tv_usec());
-        0
-    } else {
-        val.tv_usec() as i32
-    };
-    Timespec::new(val.tv_sec() as sys::time::time_t, usec)
-}
-
-/// Converts a `sys::time::TimeVal` object into a `sys::time::TimeSpec`.
-pub fn timeval_to_nix_timespec(val: sys::time::TimeVal) -> sys::time::TimeSpec {
-    let usec = if val.tv_usec() > sys::time::suseconds_t::from(std::i32::MAX) {
-        warn!("Cannot represent too-long usec quantity {} in timespec; using 0", val.tv_usec());
-        0
-    } else {
-        val.tv_usec() as i64
-    };
-    sys::time::TimeSpec::nanoseconds((val.tv_sec() as i64) * 1_000_000_000 + usec)
-}
-
 /// Converts a file type as returned by the file system to a FUSE file type.
 ///
 /// `path` is the file from which the file type was originally extracted and is only for debugging
@@ -161,7 +138,10 @@ pub fn attr_fs_to_fuse(path: &Path, inode: u64, nlink: u32, attr: &fs::Metadata)
         kind: filetype_fs_to_fuse(path, attr.file_type()),
         nlink: nlink,
         size: len,
-        blocks: 0, // TODO(jmmv): Reevaluate what blocks should be.
+        // st_blocks is always expressed in 512-byte units, regardless of st_blksize, and that is
+        // also what FUSE expects.  The block size itself cannot be returned with the version of the
+        // protocol we implement, so the kernel reports a fixed value instead.
+        blocks: attr.blocks(),
         atime: system_time_to_timespec(path, "atime", &attr.accessed()),
         mtime: system_time_to_timespec(path, "mtime", &attr.modified()),
         ctime: ctime,
@@ -177,7 +157,7 @@ pub fn attr_fs_to_fuse(path: &Path, inode: u64, nlink: u32, attr: &fs::Metadata)
 /// Converts a set of `flags` bitmask to an `fs::OpenOptions`.
 ///
 /// `allow_writes` indicates whether the file to be opened supports writes or not.  If the flags
-/// don't match this condition, then this returns an error.
+/// don't match this condition, then this returns `EROFS`.
 pub fn flags_to_openoptions(flags: u32, allow_writes: bool) -> NodeResult<fs::OpenOptions> {
     let flags = flags as i32;
     let oflag = fcntl::OFlag::from_bits_truncate(flags);
@@ -186,7 +166,7 @@ pub fn flags_to_openoptions(flags: u32, allow_writes: bool) -> NodeResult<fs::Op
     options.read(true);
     if oflag.contains(fcntl::OFlag::O_WRONLY) | oflag.contains(fcntl::OFlag::O_RDWR) {
         if !allow_writes {
-            return Err(KernelError::from_errno(errno::Errno::EPERM));
+            return Err(KernelError::from_errno(errno::Errno::EROFS));
         }
         if oflag.contains(fcntl::OFlag::O_WRONLY) {
             options.read(false);
@@ -222,7 +202,6 @@ mod tests {
     use super::*;
 
     use nix::{errno, unistd};
-    use nix::sys::time::TimeValLike;
     use std::fs::File;
     use std::io::{Read, Write};
     use std::os::unix;
@@ -245,22 +224,6 @@ mod tests {
         assert_eq!(45, val.tv_usec());
     }
 
-    #[test]
-    fn test_timeval_to_timespec() {
-        let val = sys::time::TimeVal::seconds(654) + sys::time::TimeVal::nanoseconds(123_456);
-        let spec = timeval_to_timespec(val);
-        assert_eq!(654, spec.sec);
-        assert_eq!(123, spec.nsec);
-    }
-
-    #[test]
-    fn test_timeval_to_nix_timespec() {
-        let val = sys::time::TimeVal::seconds(654) + sys::time::TimeVal::nanoseconds(123_456);
-        let spec = timeval_to_nix_timespec(val);
-        assert_eq!(654, spec.tv_sec());
-        assert_eq!(123, spec.tv_nsec());
-    }
-
     #[test]
     fn test_system_time_to_timespec_ok() {
         let sys_time = SystemTime::UNIX_EPOCH + Duration::new(12345, 6789);
@@ -311,7 +274,7 @@ mod tests {
             kind: fuse::FileType::Directory,
             nlink: 56, // TODO(jmmv): Should this account for subdirs?
             size: 2,
-            blocks: 0,
+            blocks: fs::symlink_metadata(&path).unwrap().blocks(),
             atime: Timespec { sec: 12345, nsec: 0 },
             mtime: Timespec { sec: 678, nsec: 0 },
             ctime: BAD_TIME,
@@ -348,7 +311,7 @@ mod tests {
             kind: fuse::FileType::RegularFile,
             nlink: 50,
             size: content.len() as u64,
-            blocks: 0,
+            blocks: fs::symlink_metadata(&path).unwrap().blocks(),
             atime: Timespec { sec: 54321, nsec: 0 },
             mtime: Timespec { sec: 876, nsec: 0 },
             ctime: BAD_TIME,
@@ -368,6 +331,21 @@ mod tests {
         assert!(fileattrs_eq(&exp_attr, &attr));
     }
 
+    #[test]
+    fn test_attr_fs_to_fuse_sparse() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("file");
+        let file = fs::File::create(&path).unwrap();
+        file.set_len(1024 * 1024).unwrap();
+        drop(file);
+
+        let fs_attr = fs::symlink_metadata(&path).unwrap();
+        let attr = attr_fs_to_fuse(&path, 42, 1, &fs_attr);
+        assert_eq!(1024 * 1024, attr.size);
+        assert_eq!(fs_attr.blocks(), attr.blocks);
+        assert!(attr.blocks < attr.size / 512, "Blocks must not be derived from the file size");
+    }
+
     #[test]
     fn test_flags_to_openoptions_rdonly() {
         let dir = tempdir().unwrap();
@@ -0,0 +1,91 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License.  You may obtain a copy
+// of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.  See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+use nix::errno::Errno;
+use std::fs;
+use std::io;
+use std::os::unix::fs::{self as unix_fs, DirBuilderExt, OpenOptionsExt, PermissionsExt};
+use std::path::Path;
+
+/// Permissions that are always granted to the user on directories created in the scratch area,
+/// as otherwise we would not be able to copy any entries into them.
+const UPPER_DIR_MIN_MODE: u32 = 0o700;
+
+/// Ensures that the directory `upper` exists in the scratch area of a copy-on-write mapping.
+///
+/// The scratch area mirrors the layout of the read-only side of the mapping, so `lower` is the
+/// location of the same directory on the read-only side, which may not exist.
+///
+/// Missing directories, including any missing parents, are created with the permissions of their
+/// `lower` counterparts, if any, but always writable by us.
+pub fn copy_up_dir(upper: &Path, lower: Option<&Path>) -> io::Result<()> {
+    match fs::symlink_metadata(upper) {
+        Ok(fs_attr) => {
+            if fs_attr.is_dir() {
+                return Ok(());
+            }
+            return Err(io::Error::from_raw_os_error(Errno::ENOTDIR as i32));
+        },
+        Err(e) => {
+            if e.kind() != io::ErrorKind::NotFound {
+                return Err(e);
+            }
+        },
+    }
+
+    if let Some(parent) = upper.parent() {
+        copy_up_dir(parent, lower.and_then(Path::parent))?;
+    }
+
+    let mode = match lower.map(fs::symlink_metadata) {
+        Some(Ok(fs_attr)) => fs_attr.permissions().mode() & 0o7777,
+        Some(Err(ref e)) if e.kind() == io::ErrorKind::NotFound => 0o755,
+        Some(Err(e)) => return Err(e),
+        None => 0o755,
+    };
+    match fs::DirBuilder::new().mode(mode | UPPER_DIR_MIN_MODE).create(upper) {
+        Ok(()) => Ok(()),
+        Err(ref e) if e.kind() == io::ErrorKind::AlreadyExists => Ok(()),
+        Err(e) => Err(e),
+    }
+}
+
+/// Copies the file `lower` to `upper` in the scratch area, creating any missing parent directories.
+///
+/// If `truncate` is true, only the permissions of the file are copied, not its contents.  This is
+/// an optimization for callers that are about to discard the contents anyway.
+pub fn copy_up_file(lower: &Path, upper: &Path, truncate: bool) -> io::Result<()> {
+    if let Some(parent) = upper.parent() {
+        copy_up_dir(parent, lower.parent())?;
+    }
+
+    if truncate {
+        let mode = fs::symlink_metadata(lower)?.permissions().mode() & 0o7777;
+        fs::OpenOptions::new().write(true).create(true).truncate(true).mode(mode).open(upper)?;
+    } else {
+        fs::copy(lower, upper)?;
+    }
+    Ok(())
+}
+
+/// Copies the symlink `lower` to `upper` in the scratch area, creating any missing parent
+/// directories.
+pub fn copy_up_symlink(lower: &Path, upper: &Path) -> io::Result<()> {
+    if let Some(parent) = upper.parent() {
+        copy_up_dir(parent, lower.parent())?;
+    }
+
+    let target = fs::read_link(lower)?;
+    unix_fs::symlink(target, upper)
+}
@@ -18,17 +18,68 @@ extern crate time;
 use {create_as, IdGenerator};
 use failure::{Fallible, ResultExt};
 use nix::{errno, fcntl, sys, unistd};
-use nix::dir as rawdir;
 use nodes::{
-    ArcHandle, ArcNode, AttrDelta, Cache, Handle, KernelError, Node, NodeResult, conv, setattr};
-use std::collections::HashMap;
+    ArcHandle, ArcNode, AttrDelta, Backing, Cache, Excludes, File, Handle, KernelError, Lazy,
+    MappingInfo, MappingTarget, MemDir, NoCache, Node, NodeResult, Squash, Symlink, confine, conv,
+    cow, setattr, timeout};
+use std::collections::{HashMap, HashSet};
 use std::ffi::{OsStr, OsString};
-use std::os::unix::ffi::OsStrExt;
-use std::os::unix::fs::{self as unix_fs, DirBuilderExt, OpenOptionsExt};
+use std::os::unix::fs::{MetadataExt, OpenOptionsExt};
 use std::fs;
 use std::io;
 use std::path::{Component, Path, PathBuf};
-use std::sync::{Arc, Mutex};
+use std::sync::{Arc, Mutex, Weak};
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+
+/// Whether `mknod` may create block and character devices in the underlying file system.
+///
+/// Devices grant access to whatever hardware or kernel facility they refer to, so letting any
+/// process with access to a writable mapping create them is dangerous.
+static ALLOW_DEVICES: AtomicBool = AtomicBool::new(false);
+
+/// Enables or disables the creation of block and character devices via `mknod`.
+pub fn set_allow_devices(enabled: bool) {
+    ALLOW_DEVICES.store(enabled, Ordering::SeqCst);
+}
+
+/// Whether block devices, character devices and sockets found in the underlying file system are
+/// hidden from directories as if they did not exist.
+static HIDE_SPECIAL_FILES: AtomicBool = AtomicBool::new(false);
+
+/// Whether named pipes found in the underlying file system are hidden from directories.
+static HIDE_FIFOS: AtomicBool = AtomicBool::new(false);
+
+/// Configures which types of special files found in the underlying file system are hidden.
+///
+/// `special_files` covers block devices, character devices and sockets, while `fifos` covers named
+/// pipes, which some tools rely on and thus are configured separately.
+pub fn set_hidden_special_files(special_files: bool, fifos: bool) {
+    HIDE_SPECIAL_FILES.store(special_files, Ordering::SeqCst);
+    HIDE_FIFOS.store(fifos, Ordering::SeqCst);
+}
+
+/// Whether lookups of names that do not exist in the underlying directories fall back to the
+/// entries whose names are equal to them when ignoring case.
+static CASE_INSENSITIVE: AtomicBool = AtomicBool::new(false);
+
+/// Enables or disables the case-insensitive lookups of underlying entries.
+pub fn set_case_insensitive(enabled: bool) {
+    CASE_INSENSITIVE.store(enabled, Ordering::SeqCst);
+}
+
+/// Returns true if underlying files of type `fs_type` must be hidden from directories.
+///
+/// Hidden entries are skipped when reading directories, fail lookups with `ENOENT` and cannot be
+/// created.  Explicit mappings are never hidden.
+fn is_hidden_type(fs_type: fuse::FileType) -> bool {
+    match fs_type {
+        fuse::FileType::BlockDevice | fuse::FileType::CharDevice | fuse::FileType::Socket => {
+            HIDE_SPECIAL_FILES.load(Ordering::Relaxed)
+        },
+        fuse::FileType::NamedPipe => HIDE_FIFOS.load(Ordering::Relaxed),
+        _ => false,
+    }
+}
 
 /// Takes the components of a path and returns the first normal component and the rest.
 ///
@@ -50,45 +101,84 @@ struct ReplyEntry {
     name: OsString,
 }
 
-/// Handle for an open directory.
-struct OpenDir {
-    // These are copies of the fields that also exist in the Dir corresponding to this OpenDir.
-    // Ideally we could just hold an immutable reference to the Dir instance... but this is hard
-    // to do because, when opendir() gets called on an abstract Node, we do not get access to the
-    // ArcNode that corresponds to it (to clone it).  Given that these values are immutable on
-    // the node, holding a copy here is fine.
-    inode: u64,
-    writable: bool,
-    state: Arc<Mutex<MutableDir>>,
+/// Position of a stream of partial `readdir` calls on an open directory.
+///
+/// Entries are numbered sequentially from the start of the stream and each entry is returned to
+/// the kernel along with the number of the entry that follows it, which is the offset the kernel
+/// gives us back to continue the stream.  An offset of zero thus always starts a new stream.
+///
+/// The entries of the underlying directory are read as the kernel asks for them instead of all at
+/// once, so mutations to the directory may or may not be visible while a stream is in progress.
+struct ReaddirStream {
+    /// Entries to return before those of the underlying directory, in reverse order.  These are
+    /// the `.` and `..` entries and the explicit mappings, captured when the stream starts, plus
+    /// all entries of copy-on-write directories because those merge the contents of various
+    /// directories.
+    head: Vec<ReplyEntry>,
 
-    /// Handle for the open directory file descriptor.  This is `None` if the directory does not
-    /// have an underlying path.
-    handle: Mutex<Option<rawdir::Dir>>,
+    /// Reader of the contents of the underlying directory.  This is `None` if the directory does
+    /// not have an underlying path or if it is a copy-on-write directory.
+    entries: Option<fs::ReadDir>,
 
-    /// Contents of this directory.  This is populated on the first `readdir` request that has an
-    /// offset of zero and reused for all further calls until the contents are consumed.
+    /// Whether `entries` has already returned any entries and must be reopened to restart.
+    consumed: bool,
+
+    /// Whether reading `entries` timed out, which loses the reader until the stream restarts.
+    stalled: bool,
+
+    /// Number of the next entry to return to the kernel.
+    next: usize,
+
+    /// Entries already produced that must be returned again, in reverse order.  The last entry
+    /// is entry number `next`.
+    replay: Vec<ReplyEntry>,
+
+    /// Entries returned in the previous reply, the first of which is entry number `returned_start`.
     ///
-    /// Doing this means that mutations to the directory won't be visible to `readdir` while a
-    /// "stream" of partial `readdir` calls is in progress.  This is probably a good thing.
-    reply_contents: Mutex<Vec<ReplyEntry>>,
+    /// The kernel may discard the tail of a reply when the buffer of the process reading the
+    /// directory is full, and then asks for those entries again.  Keeping them around allows us
+    /// to go back without rereading the underlying directory from its beginning.
+    returned: Vec<ReplyEntry>,
+
+    /// Number of the first entry in `returned`.
+    returned_start: usize,
 }
 
-impl OpenDir {
-    /// Reads all directory entries in one go.
+impl ReaddirStream {
+    /// Creates a new stream that reads the underlying directory via `entries`, if any.
+    fn new(entries: Option<fs::ReadDir>) -> Self {
+        ReaddirStream {
+            head: vec!(),
+            entries,
+            consumed: false,
+            stalled: false,
+            next: 0,
+            replay: vec!(),
+            returned: vec!(),
+            returned_start: 0,
+        }
+    }
+
+    /// Rewinds the stream to its beginning and captures the entries that do not come from the
+    /// underlying directory, with the directory `inode` already locked as `state`.
     ///
     /// `_ids` and `_cache` are the file system-wide bookkeeping objects needed to instantiate new
-    /// nodes, used when readdir discovers an underlying node that was not yet known.
-    fn readdirall(&self, ids: &IdGenerator, cache: &dyn Cache) -> NodeResult<Vec<ReplyEntry>> {
-        let mut reply = vec!();
-
-        let mut state = self.state.lock().unwrap();
+    /// nodes, used when reading the entries of a copy-on-write directory discovers a node that was
+    /// not yet known and when resolving lazy mappings.
+    fn restart(&mut self, inode: u64, writable: bool, state: &mut MutableDir, ids: &IdGenerator,
+        cache: &dyn Cache) -> NodeResult<()> {
+        self.head.clear();
+        self.next = 0;
+        self.replay.clear();
+        self.returned.clear();
+        self.returned_start = 0;
 
-        reply.push(ReplyEntry {
-            inode: self.inode,
+        self.head.push(ReplyEntry {
+            inode: inode,
             fs_type: fuse::FileType::Directory,
             name: OsString::from(".")
         });
-        reply.push(ReplyEntry {
+        self.head.push(ReplyEntry {
             inode: state.parent,
             fs_type: fuse::FileType::Directory,
             name: OsString::from("..")
@@ -97,51 +187,111 @@ impl OpenDir {
         // First, return the entries that correspond to explicit mappings performed by the user at
         // either mount time or during a reconfiguration.  Those should clobber any on-disk
         // contents that we discover later when we issue the readdir on the underlying directory,
-        // if any.
-        for (name, dirent) in &state.children {
-            if dirent.explicit_mapping {
-                reply.push(ReplyEntry {
-                    inode: dirent.node.inode(),
-                    fs_type: dirent.node.file_type_cached(),
-                    name: name.clone()
-                });
+        // if any.  Lazy mappings whose targets are missing are skipped, just as their lookups fail.
+        let names = state.children.iter()
+            .filter(|(_, dirent)| dirent.explicit_mapping)
+            .map(|(name, _)| name.clone())
+            .collect::<Vec<OsString>>();
+        for name in names {
+            if Dir::resolve_child_locked(state, &name, ids, cache).is_err() {
+                continue;
+            }
+            let dirent = &state.children[&name];
+            self.head.push(ReplyEntry {
+                inode: dirent.node.inode(),
+                fs_type: dirent.node.file_type_cached(),
+                name: name,
+            });
+        }
+
+        if state.cow.is_some() {
+            Dir::readdirall_cow_locked(writable, state, ids, &mut self.head)?;
+            self.entries = None;
+        } else if let Some(path) = &state.underlying_path {
+            if self.entries.is_none() || self.consumed {
+                self.entries = Some(timeout::read_dir(path)?);
+                self.consumed = false;
+                self.stalled = false;
             }
+        } else {
+            self.entries = None;
         }
 
-        let mut handle = self.handle.lock().unwrap();
+        self.head.reverse();
+        Ok(())
+    }
 
-        if handle.is_none() {
-            debug_assert!(state.underlying_path.is_none());
-            return Ok(reply);
+    /// Moves the stream back to entry number `offset`, which must be within the previous reply.
+    fn rewind(&mut self, offset: usize) {
+        debug_assert!(offset >= self.returned_start && offset < self.next);
+        for entry in self.returned.drain(offset - self.returned_start..).rev() {
+            self.replay.push(entry);
         }
-        debug_assert!(state.underlying_path.is_some());
-        let handle = handle.as_mut().unwrap();
-        for entry in handle.iter() {
-            let entry = entry?;
-            let name = entry.file_name();
+        self.next = offset;
+    }
 
-            let name = OsStr::from_bytes(name.to_bytes()).to_os_string();
+    /// Produces entry number `next` of the stream, or `None` if there are no more entries, with
+    /// the directory already locked as `state`.
+    ///
+    /// This does not advance the stream: the caller must increment `next` once the entry has been
+    /// handed to the kernel or push it to `replay` otherwise.
+    ///
+    /// `_ids` and `_cache` are the file system-wide bookkeeping objects needed to instantiate new
+    /// nodes, used when readdir discovers an underlying node that was not yet known.
+    fn next_entry(&mut self, writable: bool, state: &mut MutableDir, ids: &IdGenerator,
+        cache: &dyn Cache) -> NodeResult<Option<ReplyEntry>> {
+        if let Some(entry) = self.replay.pop() {
+            return Ok(Some(entry));
+        }
+        if let Some(entry) = self.head.pop() {
+            return Ok(Some(entry));
+        }
 
-            if name == "." || name == ".." {
-                continue;
-            }
+        if self.stalled {
+            return Err(KernelError::from_errno(errno::Errno::EIO));
+        }
+        if self.entries.is_none() {
+            return Ok(None);
+        }
+        // The path of the directory is only needed to report timeouts, so borrow it for each read
+        // instead of copying it: this runs once per entry and large directories have many.
+        while let Some(entry) = timeout::next_dir_entry(
+            state.underlying_path.as_ref().map_or(Path::new(""), PathBuf::as_path),
+            &mut self.entries) {
+            self.consumed = true;
+            let (name, entry) = match entry {
+                Ok(entry) => (entry.file_name(), entry),
+                Err(e) => {
+                    self.stalled = self.entries.is_none();
+                    return Err(e.into());
+                },
+            };
 
             if let Some(dirent) = state.children.get(&name) {
                 // Found a previously-known on-disk entry.  Must return it "as is" (even if its
                 // type might have changed) because, if we called into `cache.get_or_create` below,
                 // we might recreate the node unintentionally.  Note that mappings were handled
-                // earlier, so only handle the non-mapping case here.
-                if !dirent.explicit_mapping {
-                    reply.push(ReplyEntry {
-                        inode: dirent.node.inode(),
-                        fs_type: dirent.node.file_type_cached(),
-                        name: name.clone(),
-                    });
+                // when the stream started, so only handle the non-mapping case here.
+                if dirent.explicit_mapping {
+                    continue;
                 }
+                return Ok(Some(ReplyEntry {
+                    inode: dirent.node.inode(),
+                    fs_type: dirent.node.file_type_cached(),
+                    name: name,
+                }));
+            }
+
+            if Dir::is_excluded_locked(state, &name) {
                 continue;
             }
 
-            let path = state.underlying_path.as_ref().unwrap().join(&name);
+            // The directory may have been deleted or renamed while the stream was in progress, in
+            // which case the remaining entries are no longer reachable.
+            let path = match &state.underlying_path {
+                Some(underlying_path) => underlying_path.join(&name),
+                None => return Ok(None),
+            };
 
             // TODO(jmmv): In theory we shouldn't need to issue a stat for every entry during a
             // readdir.  However, it's much easier to handle things this way because we currently
@@ -149,54 +299,110 @@ impl OpenDir {
             // of this code does the same and an attempt to "fix" this resulted in more complex
             // code and no visible performance gains.  That said, it'd be worth to investigate this
             // again.
-            let fs_attr = fs::symlink_metadata(&path)?;
-
+            //
+            // The stat happens relative to the directory stream so that the kernel does not have
+            // to walk the whole path again for every entry, which is costly in deep trees.
+            let fs_attr = match timeout::dir_entry_metadata(&path, entry) {
+                Ok(fs_attr) => fs_attr,
+                // Entries removed since we read their names are skipped silently.
+                Err(ref e) if e.kind() == io::ErrorKind::NotFound => continue,
+                Err(e) => return Err(e.into()),
+            };
             let fs_type = conv::filetype_fs_to_fuse(&path, fs_attr.file_type());
-            let child = cache.get_or_create(ids, &path, &fs_attr, self.writable);
+            if is_hidden_type(fs_type) {
+                continue;
+            }
 
-            reply.push(ReplyEntry { inode: child.inode(), fs_type: fs_type, name: name.clone() });
+            let child = Dir::new_child_locked(state, &path, &fs_attr, writable, ids, cache);
+            let entry = ReplyEntry { inode: child.inode(), fs_type: fs_type, name: name.clone() };
 
-            // Do the insertion into state.children after calling reply.add() to be able to move
-            // the name into the key without having to copy it again.
-            let dirent = Dirent {
-                node: child.clone(),
-                explicit_mapping: false,
-            };
             // TODO(jmmv): We should remove stale entries at some point (possibly here), but the Go
             // variant does not do this so any implications of this are not tested.  The reason this
             // hasn't caused trouble yet is because: on readdir, we don't use any contents from
             // state.children that correspond to unmapped entries, and any stale entries visited
             // during lookup will result in an ENOENT.
-            state.children.insert(name, dirent);
+            state.children.insert(name, Dirent { node: child, explicit_mapping: false });
+            return Ok(Some(entry));
         }
-        // No need to worry about rewinding handle.iter() for future reads on the same OpenDir:
-        // the rawdir::Dir implementation does this for us.
-        Ok(reply)
+        Ok(None)
     }
 }
 
+/// Handle for an open directory.
+struct OpenDir {
+    // These are copies of the fields that also exist in the Dir corresponding to this OpenDir.
+    // Ideally we could just hold an immutable reference to the Dir instance... but this is hard
+    // to do because, when opendir() gets called on an abstract Node, we do not get access to the
+    // ArcNode that corresponds to it (to clone it).  Given that these values are immutable on
+    // the node, holding a copy here is fine.
+    inode: u64,
+    writable: bool,
+    state: Arc<Mutex<MutableDir>>,
+
+    /// Position of the stream of `readdir` calls on this handle.
+    stream: Mutex<ReaddirStream>,
+}
+
 impl Handle for OpenDir {
+    fn fsync(&self, _datasync: bool) -> NodeResult<()> {
+        if !self.writable {
+            return Ok(());  // Nothing can have been modified through read-only mappings.
+        }
+
+        // Modifications to copy-on-write directories only ever land in their scratch area.
+        let (path, cow) = {
+            let state = self.state.lock().unwrap();
+            match state.cow {
+                Some(ref cow) => (cow.upper_path.clone(), true),
+                None => match state.underlying_path {
+                    Some(ref path) => (path.clone(), false),
+                    None => return Ok(()),
+                },
+            }
+        };
+        match fs::File::open(&path) {
+            Ok(dir) => dir.sync_all()?,
+            // The scratch directory is only created once the directory is first modified.
+            Err(ref e) if cow && e.kind() == io::ErrorKind::NotFound => (),
+            Err(e) => return Err(e.into()),
+        }
+        Ok(())
+    }
+
     fn readdir(&self, ids: &IdGenerator, cache: &dyn Cache, offset: i64,
         reply: &mut fuse::ReplyDirectory) -> NodeResult<()> {
-        let mut offset: usize = offset as usize;
+        let offset = offset as usize;
 
-        let mut contents = self.reply_contents.lock().unwrap();
-        if offset == 0 {
-            *contents = self.readdirall(ids, cache)?;
-        } else {
-            // When the kernel asks us to return extra entries from a partially-read directory, it
-            // does so by giving us the offset of the last entry we returned -- not the first one
-            // that we ought to return.  Therefore, advance the offset by one to avoid duplicate
-            // return values and to avoid entering an infinite loop.
-            offset += 1;
+        let mut stream = self.stream.lock().unwrap();
+        let mut state = self.state.lock().unwrap();
+
+        // The kernel normally continues from where the previous reply stopped but it may also seek
+        // anywhere within the directory.  We cannot seek the underlying directory, so going back
+        // beyond the previous reply means rereading it from its beginning and skipping entries,
+        // and going forward means skipping entries.  Entries created or removed in the meantime
+        // may thus be missed or be returned twice, but their offsets never repeat.
+        if offset == 0 || offset < stream.returned_start {
+            stream.restart(self.inode, self.writable, &mut state, ids, cache)?;
+        } else if offset < stream.next {
+            stream.rewind(offset);
+        }
+        while stream.next < offset {
+            if stream.next_entry(self.writable, &mut state, ids, cache)?.is_none() {
+                return Ok(());
+            }
+            stream.next += 1;
         }
 
-        while offset < contents.len() {
-            let entry = &contents[offset];
-            if reply.add(entry.inode, offset as i64, entry.fs_type, &entry.name) {
-                break;  // Reply buffer is full.
+        stream.returned.clear();
+        stream.returned_start = stream.next;
+        while let Some(entry) = stream.next_entry(self.writable, &mut state, ids, cache)? {
+            let next = stream.next + 1;
+            if reply.add(entry.inode, next as i64, entry.fs_type, &entry.name) {
+                stream.replay.push(entry);  // Reply buffer is full.
+                break;
             }
-            offset += 1;
+            stream.returned.push(entry);
+            stream.next = next;
         }
         Ok(())
     }
@@ -205,14 +411,15 @@ impl Handle for OpenDir {
 /// Representation of a directory entry.
 #[derive(Clone)]
 pub struct Dirent {
-    node: ArcNode,
-    explicit_mapping: bool,
+    pub(super) node: ArcNode,
+    pub(super) explicit_mapping: bool,
 }
 
 /// Representation of a directory node.
 pub struct Dir {
     inode: u64,
     writable: bool,
+    cow: bool,
     state: Arc<Mutex<MutableDir>>,
 }
 
@@ -222,6 +429,158 @@ pub struct MutableDir {
     underlying_path: Option<PathBuf>,
     attr: fuse::FileAttr,
     children: HashMap<OsString, Dirent>,
+
+    /// Copy-on-write state of the directory.  None if the directory is not in such a mapping.
+    cow: Option<CowDir>,
+
+    /// State shared with all other directories of the same mapping.  None if the directory is not
+    /// backed by an underlying directory.
+    mapping: Option<Arc<MappingContext>>,
+
+    /// Names of the entries of the underlying directory keyed by their case-folded spelling, along
+    /// with the modification time of the directory when they were read.  Only used for
+    /// case-insensitive lookups, and none until the first lookup misses or after the directory is
+    /// modified through us.
+    folded_names: Option<((i64, i64), HashMap<String, OsString>)>,
+}
+
+/// Source of the identifiers of the mappings, which are unique within the process.
+static NEXT_MAPPING_ID: AtomicUsize = AtomicUsize::new(0);
+
+/// State shared by all directories within a single mapping of an underlying directory.
+///
+/// Copy-on-write and overlay mappings only use this to identify the mapping.
+struct MappingContext {
+    /// Identifier of the mapping, used to tell apart the directories of different mappings.
+    id: usize,
+
+    /// Patterns of the entries to hide anywhere within the mapping.
+    excludes: Excludes,
+
+    /// Ownership to force on the files within the mapping, if any.
+    squash: Option<Squash>,
+
+    /// Whether the files within the mapping cannot be executed.
+    noexec: bool,
+
+    /// Mask to apply to the permissions of the files within the mapping, if any.
+    perm_mask: Option<u32>,
+
+    /// Nodes of the files with more than one hard link found within the mapping, keyed by their
+    /// device and inode numbers, so that all names of the same file share a single node.
+    links: Mutex<HashMap<(u64, u64), Weak<dyn Node + Send + Sync>>>,
+}
+
+impl Default for MappingContext {
+    fn default() -> Self {
+        MappingContext::new(Excludes::default(), None, false, None)
+    }
+}
+
+impl MappingContext {
+    /// Creates the context for a new mapping that hides the entries matching `excludes`, that
+    /// forces the ownership in `squash` on its files, that, if `noexec` is set, forbids
+    /// executing them and that reports their permissions ANDed with `perm_mask`, if any.
+    fn new(excludes: Excludes, squash: Option<Squash>, noexec: bool, perm_mask: Option<u32>)
+        -> Self {
+        let id = NEXT_MAPPING_ID.fetch_add(1, Ordering::Relaxed);
+        MappingContext { id, excludes, squash, noexec, perm_mask, links: Mutex::default() }
+    }
+
+    /// Gets the node for the file `path`, whose stat data is `fs_attr`, reusing the node of any
+    /// other name of the same file seen within the mapping and calling `create` otherwise.
+    fn get_or_create_link<C>(&self, path: &Path, fs_attr: &fs::Metadata, create: C) -> ArcNode
+        where C: FnOnce() -> ArcNode {
+        let key = (fs_attr.dev(), fs_attr.ino());
+        let mut links = self.links.lock().unwrap();
+        if let Some(node) = links.get(&key).and_then(Weak::upgrade) {
+            if node.add_link(path) {
+                return node;
+            }
+        }
+        let node = create();
+        links.insert(key, Arc::downgrade(&node));
+        node
+    }
+}
+
+/// Copy-on-write state of a directory that lives within a copy-on-write or an overlay mapping.
+///
+/// Such a directory merges the contents of one or more read-only "lower" directories with the
+/// contents of an "upper" directory in the scratch area of the mapping, whose layout mirrors the
+/// lower side.  Entries in the upper directory shadow those with the same name in the lower
+/// directories, and entries in earlier lower directories shadow those in later ones.
+///
+/// The `underlying_path` of a copy-on-write directory, from which its attributes are read, is the
+/// first lower directory until the attributes are modified, at which point it becomes the upper
+/// one.
+struct CowDir {
+    /// Paths to the read-only directories that provide the original contents, in order of
+    /// precedence.  Empty if the directory only exists in the scratch area.
+    lower_paths: Vec<PathBuf>,
+
+    /// Path to this directory in the scratch area, which may not exist until any of its entries
+    /// is modified.  For overlay mappings, this is the topmost layer.
+    upper_path: PathBuf,
+
+    /// Names of the entries in the lower directory that have been deleted or replaced and that
+    /// must not be visible any longer.
+    whiteouts: HashSet<OsString>,
+}
+
+impl CowDir {
+    /// Returns the paths and stat data of the entries `name` in the lower directories, in order of
+    /// precedence, unless the entry has been whited out.
+    fn lower_children(&self, name: &OsStr) -> io::Result<Vec<(PathBuf, fs::Metadata)>> {
+        let mut children = vec!();
+        if self.whiteouts.contains(name) {
+            return Ok(children);
+        }
+        for lower_path in &self.lower_paths {
+            let path = lower_path.join(name);
+            match fs::symlink_metadata(&path) {
+                Ok(fs_attr) => children.push((path, fs_attr)),
+                Err(ref e) if e.kind() == io::ErrorKind::NotFound => (),
+                Err(e) => return Err(e),
+            }
+        }
+        Ok(children)
+    }
+
+    /// Ensures that the directory exists in the scratch area.
+    fn copy_up(&self) -> io::Result<()> {
+        cow::copy_up_dir(&self.upper_path, self.lower_paths.first().map(PathBuf::as_path))
+    }
+
+    /// Returns the names of all visible entries in the directory.
+    fn names(&self) -> io::Result<Vec<OsString>> {
+        /// Appends the names of the entries in the directory `path` to `names`, if it exists.
+        fn read_names(path: &Path, names: &mut Vec<OsString>) -> io::Result<()> {
+            let entries = match fs::read_dir(path) {
+                Ok(entries) => entries,
+                Err(ref e) if e.kind() == io::ErrorKind::NotFound => return Ok(()),
+                Err(e) => return Err(e),
+            };
+            for entry in entries {
+                names.push(entry?.file_name());
+            }
+            Ok(())
+        }
+
+        let mut names = vec!();
+        read_names(&self.upper_path, &mut names)?;
+        let mut seen = names.iter().cloned().collect::<HashSet<OsString>>();
+        for lower_path in &self.lower_paths {
+            let mut lower_names = vec!();
+            read_names(lower_path, &mut lower_names)?;
+            for name in lower_names {
+                if !self.whiteouts.contains(&name) && seen.insert(name.clone()) {
+                    names.push(name);
+                }
+            }
+        }
+        Ok(names)
+    }
 }
 
 impl Dir {
@@ -234,7 +593,7 @@ impl Dir {
             kind: fuse::FileType::Directory,
             nlink: 2,  // "." entry plus whichever initial named node points at this.
             size: 2,  // TODO(jmmv): Reevaluate what directory sizes should be.
-            blocks: 1,  // TODO(jmmv): Reevaluate what directory blocks should be.
+            blocks: 0,  // Scaffold directories have no storage, just like in-memory ones.
             atime: now,
             mtime: now,
             ctime: now,
@@ -251,11 +610,15 @@ impl Dir {
             underlying_path: None,
             attr: attr,
             children: HashMap::new(),
+            cow: None,
+            mapping: None,
+            folded_names: None,
         };
 
         Arc::new(Dir {
             inode: inode,
             writable: false,
+            cow: false,
             state: Arc::from(Mutex::from(state)),
         })
     }
@@ -271,6 +634,65 @@ impl Dir {
     /// issued a stat on the underlying file system and we cannot re-do it for efficiency reasons.
     pub fn new_mapped(inode: u64, underlying_path: &Path, fs_attr: &fs::Metadata, writable: bool)
         -> ArcNode {
+        let mapping = Arc::from(MappingContext::default());
+        Dir::new_mapped_in(inode, underlying_path, fs_attr, writable, mapping)
+    }
+
+    /// Creates a new directory for the root of a mapping backed by another directory.
+    ///
+    /// The directory hides the entries matching `excludes` from itself and from all of its
+    /// subdirectories, forces the ownership in `squash` on all files created within them,
+    /// forbids executing any of their files if `noexec` is set, and masks the permissions that
+    /// all of them report with `perm_mask` if given.
+    /// All other arguments are as described in `new_mapped`.
+    #[allow(clippy::too_many_arguments)]
+    pub fn new_mapping(inode: u64, underlying_path: &Path, fs_attr: &fs::Metadata,
+        writable: bool, excludes: &Excludes, squash: Option<Squash>, noexec: bool,
+        perm_mask: Option<u32>) -> ArcNode {
+        let mapping = Arc::from(MappingContext::new(excludes.clone(), squash, noexec, perm_mask));
+        Dir::new_mapped_in(inode, underlying_path, fs_attr, writable, mapping)
+    }
+
+    /// Creates the node for the root of a mapping of `target`, which must be a
+    /// `MappingTarget::Path`, given the `fs_attr` of its underlying path.
+    ///
+    /// Fails if the underlying path does not have the type that the mapping declares or if the
+    /// options of the mapping do not apply to it.  `ids` and `cache` are the file system-wide
+    /// bookkeeping objects needed to instantiate new nodes.
+    pub fn new_path_mapping(target: &MappingTarget, fs_attr: &fs::Metadata, ids: &IdGenerator,
+        cache: &dyn Cache) -> Fallible<ArcNode> {
+        let (underlying_path, writable, excludes, squash, noexec, perm_mask, target_type) =
+            match target {
+                MappingTarget::Path {
+                    underlying_path, writable, excludes, squash, noexec, perm_mask, target_type,
+                    .. } => {
+                    (underlying_path, *writable, excludes, *squash, *noexec, *perm_mask,
+                        *target_type)
+                },
+                _ => panic!("Can only construct based on underlying paths"),
+            };
+        if let Some(target_type) = target_type {
+            ensure!(target_type.matches(fs_attr.file_type()),
+                "{:?} is not of type {}", underlying_path, target_type);
+        }
+        ensure!(fs_attr.is_dir() || squash.is_none(),
+            "Cannot squash ownership of {:?}: not a directory", underlying_path);
+        ensure!(fs_attr.is_dir() || !noexec,
+            "Cannot forbid execution within {:?}: not a directory", underlying_path);
+        ensure!(fs_attr.is_dir() || perm_mask.is_none(),
+            "Cannot mask permissions within {:?}: not a directory", underlying_path);
+        let custom = !excludes.is_empty() || squash.is_some() || noexec || perm_mask.is_some();
+        if fs_attr.is_dir() && custom {
+            Ok(Dir::new_mapping(ids.for_underlying(&fs_attr), underlying_path, &fs_attr,
+                writable, excludes, squash, noexec, perm_mask))
+        } else {
+            Ok(cache.get_or_create(ids, underlying_path, &fs_attr, writable))
+        }
+    }
+
+    /// Same as `new_mapped` but for a directory within the existing `mapping`.
+    fn new_mapped_in(inode: u64, underlying_path: &Path, fs_attr: &fs::Metadata,
+        writable: bool, mapping: Arc<MappingContext>) -> ArcNode {
         if !fs_attr.is_dir() {
             panic!("Can only construct based on dirs");
         }
@@ -292,9 +714,285 @@ impl Dir {
             underlying_path: Some(PathBuf::from(underlying_path)),
             attr: attr,
             children: HashMap::new(),
+            cow: None,
+            mapping: Some(mapping),
+            folded_names: None,
+        };
+
+        Arc::new(Dir { inode, writable, cow: false, state: Arc::from(Mutex::from(state)) })
+    }
+
+    /// Creates a new directory for the root of a copy-on-write mapping.
+    ///
+    /// `underlying_path` is the directory to expose, which is never modified, and `scratch_path` is
+    /// the directory that receives the modified copies of its entries.  Both must exist.
+    pub fn new_cow_mapping(inode: u64, underlying_path: &Path, scratch_path: &Path)
+        -> Fallible<ArcNode> {
+        let fs_attr = fs::symlink_metadata(underlying_path)
+            .with_context(|_| format!("Stat failed for {:?}", underlying_path))?;
+        ensure!(fs_attr.is_dir(), "Copy-on-write target {:?} is not a directory", underlying_path);
+        let scratch_attr = fs::symlink_metadata(scratch_path)
+            .with_context(|_| format!("Stat failed for {:?}", scratch_path))?;
+        ensure!(scratch_attr.is_dir(), "Scratch path {:?} is not a directory", scratch_path);
+        let mapping = Arc::from(MappingContext::default());
+        Ok(Dir::new_cow(
+            inode, vec!(underlying_path.to_owned()), scratch_path, &fs_attr, true, mapping))
+    }
+
+    /// Creates a new directory for the root of an overlay mapping.
+    ///
+    /// `layers` are the directories to merge, from the bottom to the top, and must all exist.  The
+    /// topmost layer receives all modifications if `writable` is true; the others are never
+    /// modified.
+    pub fn new_overlay_mapping(inode: u64, layers: &[PathBuf], writable: bool)
+        -> Fallible<ArcNode> {
+        let mut attrs = vec!();
+        for layer in layers {
+            let fs_attr = fs::symlink_metadata(layer)
+                .with_context(|_| format!("Stat failed for {:?}", layer))?;
+            ensure!(fs_attr.is_dir(), "Overlay layer {:?} is not a directory", layer);
+            attrs.push(fs_attr);
+        }
+        let (upper_path, lower_paths) = layers.split_last()
+            .expect("Overlay mappings must have at least one layer");
+        let lower_paths = lower_paths.iter().rev().cloned().collect::<Vec<PathBuf>>();
+        let fs_attr = if lower_paths.is_empty() { &attrs[0] } else { &attrs[attrs.len() - 2] };
+        let mapping = Arc::from(MappingContext::default());
+        Ok(Dir::new_cow(inode, lower_paths, upper_path, fs_attr, writable, mapping))
+    }
+
+    /// Creates a new directory within a copy-on-write mapping.
+    ///
+    /// `lower_paths` and `upper_path` are the locations of the directory on the read-only side of
+    /// the mapping, in order of precedence, and in its scratch area, respectively.  `fs_attr`
+    /// contains the stat data of the first of `lower_paths` if any, or of `upper_path` otherwise.
+    /// `writable` is false only for overlay mappings whose topmost layer is read-only.  `mapping`
+    /// is the mapping the directory belongs to.
+    fn new_cow(inode: u64, lower_paths: Vec<PathBuf>, upper_path: &Path, fs_attr: &fs::Metadata,
+        writable: bool, mapping: Arc<MappingContext>) -> ArcNode {
+        if !fs_attr.is_dir() {
+            panic!("Can only construct based on dirs");
+        }
+
+        // See the comment in new_mapped for details on the link count.
+        let nlink = 2;
+
+        let underlying_path = lower_paths.first().map_or(upper_path, PathBuf::as_path).to_owned();
+        let attr = conv::attr_fs_to_fuse(&underlying_path, inode, nlink, &fs_attr);
+
+        let state = MutableDir {
+            parent: inode,
+            underlying_path: Some(underlying_path),
+            attr: attr,
+            children: HashMap::new(),
+            cow: Some(CowDir {
+                lower_paths: lower_paths,
+                upper_path: PathBuf::from(upper_path),
+                whiteouts: HashSet::new(),
+            }),
+            mapping: Some(mapping),
+            folded_names: None,
         };
 
-        Arc::new(Dir { inode, writable, state: Arc::from(Mutex::from(state)) })
+        Arc::new(Dir { inode, writable, cow: true, state: Arc::from(Mutex::from(state)) })
+    }
+
+    /// Returns true if the entry `name` must be hidden from the directory due to its excludes, with
+    /// the node already locked.
+    ///
+    /// Explicit mappings take precedence over excludes, so callers must check for them first.
+    fn is_excluded_locked(state: &MutableDir, name: &OsStr) -> bool {
+        state.mapping.as_ref().map_or(false, |mapping| mapping.excludes.matches(name))
+    }
+
+    /// Instantiates a node for the underlying file `path` found within the directory, with the
+    /// node already locked.
+    ///
+    /// Subdirectories belong to the same mapping as the directory, which is why they cannot come
+    /// from the `cache`.  Files with more than one hard link share the node of any other name of
+    /// the same file within the mapping.
+    fn new_child_locked(state: &MutableDir, path: &Path, fs_attr: &fs::Metadata, writable: bool,
+        ids: &IdGenerator, cache: &dyn Cache) -> ArcNode {
+        match &state.mapping {
+            Some(mapping) if fs_attr.is_dir() => Dir::new_mapped_in(
+                ids.for_underlying(fs_attr), path, fs_attr, writable, mapping.clone()),
+            Some(mapping) if fs_attr.file_type().is_file() && fs_attr.nlink() > 1 => {
+                mapping.get_or_create_link(
+                    path, fs_attr, || cache.get_or_create(ids, path, fs_attr, writable))
+            },
+            _ => cache.get_or_create(ids, path, fs_attr, writable),
+        }
+    }
+
+    /// Instantiates a node for the entry `name` of the copy-on-write directory `cow`, which belongs
+    /// to `mapping` or to a new mapping if not given.
+    ///
+    /// Returns the new node along with the path and the stat data of the file backing it.
+    fn new_cow_child(cow: &CowDir, mapping: Option<&Arc<MappingContext>>, name: &OsStr,
+        writable: bool, ids: &IdGenerator) -> NodeResult<(ArcNode, PathBuf, fs::Metadata)> {
+        let upper_path = cow.upper_path.join(name);
+        let mut lower_children = cow.lower_children(name)?;
+
+        let (path, fs_attr) = match fs::symlink_metadata(&upper_path) {
+            Ok(fs_attr) => (upper_path.clone(), fs_attr),
+            Err(e) => {
+                if e.kind() != io::ErrorKind::NotFound {
+                    return Err(e.into());
+                }
+                match lower_children.first() {
+                    Some((lower_path, lower_attr)) => (lower_path.clone(), lower_attr.clone()),
+                    None => return Err(KernelError::from_errno(errno::Errno::ENOENT)),
+                }
+            },
+        };
+        if is_hidden_type(conv::filetype_fs_to_fuse(&path, fs_attr.file_type())) {
+            return Err(KernelError::from_errno(errno::Errno::ENOENT));
+        }
+
+        let node = if fs_attr.is_dir() {
+            // The directory only merges the contents of the lower directories that are not shadowed
+            // by a non-directory entry in a layer of higher precedence.
+            let lower_paths = lower_children.iter()
+                .take_while(|(_, lower_attr)| lower_attr.is_dir())
+                .map(|(path, _)| path.clone())
+                .collect::<Vec<PathBuf>>();
+            let mapping = mapping.cloned().unwrap_or_default();
+            if lower_paths.is_empty() {
+                Dir::new_cow(ids.next(), lower_paths, &upper_path, &fs_attr, writable, mapping)
+            } else {
+                let (lower_path, lower_attr) = lower_children.swap_remove(0);
+                let node = Dir::new_cow(
+                    ids.next(), lower_paths, &upper_path, &lower_attr, writable, mapping);
+                return Ok((node, lower_path, lower_attr));
+            }
+        } else if fs_attr.file_type().is_symlink() {
+            Symlink::new_cow(ids.next(), &path, &fs_attr, &upper_path, writable)
+        } else {
+            File::new_cow(ids.next(), &path, &fs_attr, &upper_path, writable)
+        };
+        Ok((node, path, fs_attr))
+    }
+
+    /// Reads all entries of a copy-on-write directory, with the node already locked.
+    ///
+    /// Entries that correspond to explicit mappings must have already been added to `reply`.
+    fn readdirall_cow_locked(writable: bool, state: &mut MutableDir, ids: &IdGenerator,
+        reply: &mut Vec<ReplyEntry>) -> NodeResult<()> {
+        let cow = state.cow.as_ref().expect("Must only be called on copy-on-write directories");
+        for name in cow.names()? {
+            if let Some(dirent) = state.children.get(&name) {
+                // Explicit mappings were handled by the caller.
+                if !dirent.explicit_mapping {
+                    reply.push(ReplyEntry {
+                        inode: dirent.node.inode(),
+                        fs_type: dirent.node.file_type_cached(),
+                        name: name.clone(),
+                    });
+                }
+                continue;
+            }
+
+            // Hidden entries and those removed since we read their names are skipped silently.
+            let (child, path, fs_attr) =
+                match Dir::new_cow_child(cow, state.mapping.as_ref(), &name, writable, ids) {
+                    Ok(result) => result,
+                    Err(ref e) if e.errno_as_i32() == errno::Errno::ENOENT as i32 => continue,
+                    Err(e) => return Err(e),
+                };
+            let fs_type = conv::filetype_fs_to_fuse(&path, fs_attr.file_type());
+            reply.push(ReplyEntry { inode: child.inode(), fs_type: fs_type, name: name.clone() });
+            state.children.insert(name, Dirent { node: child, explicit_mapping: false });
+        }
+        Ok(())
+    }
+
+    /// Copies the directory to the scratch area of its copy-on-write mapping, if it is not there
+    /// yet, and starts using the copy as the source of the directory's attributes, with the node
+    /// already locked.
+    fn copy_up_locked(state: &mut MutableDir) -> NodeResult<()> {
+        if state.underlying_path.is_none() {
+            return Ok(());  // Deleted directories have nothing to copy.
+        }
+        let upper_path = match &state.cow {
+            Some(cow) => {
+                cow.copy_up()?;
+                cow.upper_path.clone()
+            },
+            None => return Ok(()),
+        };
+        state.underlying_path = Some(upper_path);
+        Ok(())
+    }
+
+    /// Hides the entry `name` on the read-only side of a copy-on-write directory, if it exists,
+    /// with the node already locked.
+    fn whiteout_locked(state: &mut MutableDir, name: &OsStr) {
+        if let Some(cow) = &mut state.cow {
+            if cow.lower_paths.iter().any(|path| fs::symlink_metadata(path.join(name)).is_ok()) {
+                cow.whiteouts.insert(name.to_os_string());
+            }
+        }
+    }
+
+    /// Ensures that the entry `name` in a copy-on-write directory can be replaced by a rename, with
+    /// the node already locked.
+    fn check_cow_rename_target_locked(state: &MutableDir, name: &OsStr) -> NodeResult<()> {
+        if let Some(dirent) = state.children.get(name) {
+            if dirent.node.file_type_cached() == fuse::FileType::Directory
+                && !dirent.node.is_empty_dir()? {
+                return Err(KernelError::from_errno(errno::Errno::ENOTEMPTY));
+            }
+        }
+        Ok(())
+    }
+
+    /// Same as `rename` but for copy-on-write directories and with the node already locked.
+    fn rename_cow_locked(state: &mut MutableDir, old_name: &OsStr, new_name: &OsStr)
+        -> NodeResult<()> {
+        let old_path = Dir::get_writable_path(state, old_name)?;
+        let new_path = Dir::get_writable_path(state, new_name)?;
+
+        state.children.get(old_name)
+            .expect("get_writable_path call above ensured the child exists")
+            .node.copy_up()?;
+        Dir::check_cow_rename_target_locked(state, new_name)?;
+
+        confine::rename(&old_path, &new_path)?;
+        Dir::whiteout_locked(state, old_name);
+        Dir::whiteout_locked(state, new_name);
+
+        let dirent = state.children.remove(old_name)
+            .expect("get_writable_path call above ensured the child exists");
+        dirent.node.set_underlying_path(&new_path, &NoCache::default());
+        state.children.insert(new_name.to_owned(), dirent);
+        Ok(())
+    }
+
+    /// Same as `remove_any` but for copy-on-write directories and with the node already locked.
+    fn remove_cow_locked<R>(state: &mut MutableDir, name: &OsStr, remove: R) -> NodeResult<()>
+        where R: Fn(&PathBuf) -> io::Result<()> {
+        let path = Dir::get_writable_path(state, name)?;
+
+        let node = match state.children.get(name) {
+            Some(dirent) => dirent.node.clone(),
+            None => return Err(KernelError::from_errno(errno::Errno::ENOENT)),
+        };
+        if node.file_type_cached() == fuse::FileType::Directory && !node.is_empty_dir()? {
+            return Err(KernelError::from_errno(errno::Errno::ENOTEMPTY));
+        }
+
+        // The entry may live in the scratch area, on the read-only side, or both.  Remove the
+        // former and hide the latter.
+        match remove(&path) {
+            Ok(()) => (),
+            Err(ref e) if e.kind() == io::ErrorKind::NotFound => (),
+            Err(e) => return Err(e.into()),
+        }
+        Dir::whiteout_locked(state, name);
+
+        state.children.remove(name);
+        node.delete(&NoCache::default());
+        Ok(())
     }
 
     /// Creates a new scaffold directory as a child of the current one.
@@ -305,14 +1003,20 @@ impl Dir {
     ///
     /// This is purely a helper function for `map`.  As a result, the caller is responsible for
     /// inserting the new directory into the children of the current directory.
-    fn new_scaffold_child(&self, underlying_path: Option<&PathBuf>, name: &OsStr, ids: &IdGenerator,
+    ///
+    /// The new directory belongs to `mapping`, or to a new mapping if not given, when it is backed
+    /// by `underlying_path`.  Note that the directory is visible even if `name` is excluded because
+    /// it holds a mapping.
+    fn new_scaffold_child(&self, underlying_path: Option<&PathBuf>,
+        mapping: Option<&Arc<MappingContext>>, name: &OsStr, ids: &IdGenerator,
         now: time::Timespec) -> ArcNode {
         if let Some(path) = underlying_path {
             let child_path = path.join(name);
             match fs::symlink_metadata(&child_path) {
                 Ok(fs_attr) => {
                     if fs_attr.is_dir() {
-                        return Dir::new_mapped(ids.next(), &child_path, &fs_attr, self.writable);
+                        return Dir::new_mapped_in(ids.for_underlying(&fs_attr), &child_path,
+                            &fs_attr, self.writable, mapping.cloned().unwrap_or_default());
                     }
 
                     info!("Mapping clobbers non-directory {} with an immutable directory",
@@ -325,13 +1029,30 @@ impl Dir {
                 },
             }
         }
-        Dir::new_empty(ids.next(), Some(self), now)
+        Dir::new_empty(ids.for_scaffold(self.inode, name), Some(self), now)
+    }
+
+    /// Same as `unmap_subdir` but with the node already locked.
+    fn unmap_child_locked(state: &mut MutableDir, name: &OsStr, inodes: &mut Vec<u64>)
+        -> Fallible<()> {
+        match state.children.remove_entry(name) {
+            Some((name, dirent)) => {
+                if dirent.explicit_mapping {
+                    dirent.node.unmap(inodes)
+                } else {
+                    let err = format_err!("{:?} is not a mapping", &name);
+                    state.children.insert(name, dirent);
+                    Err(err)
+                }
+            },
+            None => Err(format_err!("Unknown entry")),
+        }
     }
 
     /// Same as `getattr` but with the node already locked.
     fn getattr_locked(inode: u64, state: &mut MutableDir) -> NodeResult<fuse::FileAttr> {
         if let Some(path) = &state.underlying_path {
-            let fs_attr = fs::symlink_metadata(path)?;
+            let fs_attr = timeout::symlink_metadata(path)?;
             if !fs_attr.is_dir() {
                 warn!("Path {} backing a directory node is no longer a directory; got {:?}",
                     path.display(), fs_attr.file_type());
@@ -347,11 +1068,20 @@ impl Dir {
     ///
     /// This also ensures that the entry is writable, which is determined by the directory itself
     /// being mapped to an underlying path and the entry not being an explicit mapping.
+    ///
+    /// For copy-on-write directories, the returned path lives in the scratch area and this also
+    /// ensures that the directory containing it exists.
     fn get_writable_path(state: &mut MutableDir, name: &OsStr) -> NodeResult<PathBuf> {
         if state.underlying_path.is_none() {
             return Err(KernelError::from_errno(errno::Errno::EPERM));
         }
-        let path = state.underlying_path.as_ref().unwrap().join(name);
+        let path = match &state.cow {
+            Some(cow) => {
+                cow.copy_up()?;
+                cow.upper_path.join(name)
+            },
+            None => state.underlying_path.as_ref().unwrap().join(name),
+        };
 
         if let Some(node) = state.children.get(name) {
             if node.explicit_mapping {
@@ -359,24 +1089,133 @@ impl Dir {
             }
         };
 
+        // Prevent excluded entries from coming back into view.
+        if Dir::is_excluded_locked(state, name) {
+            return Err(KernelError::from_errno(errno::Errno::EPERM));
+        }
+
         Ok(path)
     }
 
+    /// Returns the spelling of the entry of the underlying directory that `name` refers to when
+    /// lookups are case-insensitive, with the node already locked.
+    ///
+    /// Returns none if `name` has to be used as is: because lookups are case-sensitive, because the
+    /// entry exists under that exact name, or because no entry is equal to it when ignoring case.
+    /// Copy-on-write directories and names that are not valid UTF-8 are never case-folded.
+    fn find_folded_locked(state: &mut MutableDir, name: &OsStr) -> NodeResult<Option<OsString>> {
+        if !CASE_INSENSITIVE.load(Ordering::Relaxed) || state.cow.is_some()
+            || state.children.contains_key(name) {
+            return Ok(None);
+        }
+        let (path, folded) = match (&state.underlying_path, name.to_str()) {
+            (Some(path), Some(name)) => (path.clone(), name.to_lowercase()),
+            _ => return Ok(None),
+        };
+        match timeout::symlink_metadata(&path.join(name)) {
+            Ok(_) => return Ok(None),
+            Err(ref e) if e.kind() == io::ErrorKind::NotFound => (),
+            Err(e) => return Err(e.into()),
+        }
+
+        // Rescan the underlying directory if it changed behind our back since we last did.
+        let fs_attr = timeout::symlink_metadata(&path)?;
+        let mtime = (fs_attr.mtime(), fs_attr.mtime_nsec());
+        let stale = match &state.folded_names {
+            Some((scanned, _)) => *scanned != mtime,
+            None => true,
+        };
+        if stale {
+            let mut names = HashMap::new();
+            for entry in timeout::read_dir(&path)? {
+                let entry_name = entry?.file_name();
+                if let Some(key) = entry_name.to_str().map(str::to_lowercase) {
+                    names.entry(key).or_insert(entry_name);
+                }
+            }
+            state.folded_names = Some((mtime, names));
+        }
+
+        let names = &state.folded_names.as_ref().expect("Populated above").1;
+        Ok(names.get(&folded).cloned())
+    }
+
+    /// Fails with `EEXIST` if lookups are case-insensitive and an entry of the underlying directory
+    /// other than `name` is equal to it when ignoring case, with the node already locked.
+    fn check_folded_collision_locked(state: &mut MutableDir, name: &OsStr) -> NodeResult<()> {
+        match Dir::find_folded_locked(state, name)? {
+            Some(_) => Err(KernelError::from_errno(errno::Errno::EEXIST)),
+            None => Ok(()),
+        }
+    }
+
+    /// Prepares the entry `name` to be replaced by a rename of the node `inode`, with the node
+    /// already locked.
+    ///
+    /// Returns the node that the rename will replace, if any, which the caller must delete once the
+    /// rename succeeds.  Renames between two names of the same node replace nothing.
+    fn prepare_replace_locked(state: &MutableDir, name: &OsStr, inode: u64) -> Option<ArcNode> {
+        let node = state.children.get(name)
+            .filter(|dirent| dirent.node.inode() != inode)
+            .map(|dirent| dirent.node.clone())?;
+        node.keep_handles_open();
+        Some(node)
+    }
+
+    /// Replaces the entry `name`, if it is a lazy mapping, with the node for its target, with the
+    /// node already locked.
+    ///
+    /// Fails if the target of the lazy mapping cannot be inspected, in which case the entry stays
+    /// lazy so that the next access retries.
+    fn resolve_child_locked(state: &mut MutableDir, name: &OsStr, ids: &IdGenerator,
+        cache: &dyn Cache) -> NodeResult<()> {
+        let resolved = state.children.get(name)
+            .and_then(|dirent| dirent.node.resolve(ids, cache));
+        let node = match resolved {
+            Some(result) => result?,
+            None => return Ok(()),
+        };
+        state.children.insert(name.to_os_string(), Dirent { node, explicit_mapping: true });
+        Ok(())
+    }
+
     // Same as `lookup` but with the node already locked.
     fn lookup_locked(writable: bool, state: &mut MutableDir, name: &OsStr, ids: &IdGenerator,
         cache: &dyn Cache) -> NodeResult<(ArcNode, fuse::FileAttr)> {
+        match Dir::find_folded_locked(state, name)? {
+            Some(name) => Dir::lookup_exact_locked(writable, state, &name, ids, cache),
+            None => Dir::lookup_exact_locked(writable, state, name, ids, cache),
+        }
+    }
+
+    // Same as `lookup_locked` but without case-folding `name`.
+    fn lookup_exact_locked(writable: bool, state: &mut MutableDir, name: &OsStr,
+        ids: &IdGenerator, cache: &dyn Cache) -> NodeResult<(ArcNode, fuse::FileAttr)> {
+        Dir::resolve_child_locked(state, name, ids, cache)?;
         if let Some(dirent) = state.children.get(name) {
             let refreshed_attr = dirent.node.getattr()?;
             return Ok((dirent.node.clone(), refreshed_attr))
         }
 
-        let (child, attr) = {
+        let (child, attr) = if let Some(cow) = &state.cow {
+            let (node, path, fs_attr) =
+                Dir::new_cow_child(cow, state.mapping.as_ref(), name, writable, ids)?;
+            let attr = conv::attr_fs_to_fuse(
+                path.as_path(), node.inode(), node.getattr()?.nlink, &fs_attr);
+            (node, attr)
+        } else {
             let path = match &state.underlying_path {
                 Some(underlying_path) => underlying_path.join(name),
                 None => return Err(KernelError::from_errno(errno::Errno::ENOENT)),
             };
-            let fs_attr = fs::symlink_metadata(&path)?;
-            let node = cache.get_or_create(ids, &path, &fs_attr, writable);
+            if Dir::is_excluded_locked(state, name) {
+                return Err(KernelError::from_errno(errno::Errno::ENOENT));
+            }
+            let fs_attr = timeout::symlink_metadata(&path)?;
+            if is_hidden_type(conv::filetype_fs_to_fuse(&path, fs_attr.file_type())) {
+                return Err(KernelError::from_errno(errno::Errno::ENOENT));
+            }
+            let node = Dir::new_child_locked(state, &path, &fs_attr, writable, ids, cache);
             let attr = conv::attr_fs_to_fuse(
                 path.as_path(), node.inode(), node.getattr()?.nlink, &fs_attr);
             (node, attr)
@@ -405,13 +1244,14 @@ impl Dir {
         exp_type: fuse::FileType, ids: &IdGenerator, cache: &dyn Cache)
         -> NodeResult<(ArcNode, fuse::FileAttr)> {
         debug_assert_eq!(path.file_name().unwrap(), name);
+        state.folded_names = None;
 
         // TODO(https://github.com/bazelbuild/sandboxfs/issues/43): We abuse lookup here to handle
         // the node creation and the child insertion into the directory, but we shouldn't do this
         // because lookup performs an extra stat that we should not be issuing.  But to resolve this
         // we need to be able to synthesize the returned attr, which means we need to track ctimes
         // internally.
-        match Dir::lookup_locked(writable, state, name, ids, cache) {
+        match Dir::lookup_exact_locked(writable, state, name, ids, cache) {
             Ok((node, attr)) => {
                 if node.file_type_cached() != exp_type {
                     warn!("Newly-created file {} was replaced or deleted before create finished",
@@ -421,7 +1261,7 @@ impl Dir {
                 Ok((node, attr))
             },
             Err(e) => {
-                if let Err(e) = fs::remove_file(&path) {
+                if let Err(e) = confine::remove_file(&path) {
                     warn!("Failed to clean up newly-created {}: {}", path.display(), e);
                 }
                 Err(e)
@@ -436,9 +1276,18 @@ impl Dir {
     fn remove_any<R>(&self, name: &OsStr, remove: R, cache: &dyn Cache) -> NodeResult<()>
         where R: Fn(&PathBuf) -> io::Result<()> {
         let mut state = self.state.lock().unwrap();
+        if state.cow.is_some() {
+            return Dir::remove_cow_locked(&mut state, name, remove);
+        }
+        let folded = Dir::find_folded_locked(&mut state, name)?;
+        let name = folded.as_ref().map_or(name, OsString::as_os_str);
         let path = Dir::get_writable_path(&mut state, name)?;
 
+        state.children.get(name)
+            .expect("Presence guaranteed by get_writable_path call above")
+            .node.keep_handles_open();
         remove(&path)?;
+        state.folded_names = None;
 
         // Removing the underlying path from the cache is not racy within the same directory: we
         // hold the directory node locked while we perform the operations below to remove the child,
@@ -483,6 +1332,10 @@ impl Node for Dir {
         state.attr.nlink -= 2;
     }
 
+    fn underlying_path(&self) -> Option<PathBuf> {
+        self.state.lock().unwrap().underlying_path.clone()
+    }
+
     fn set_underlying_path(&self, path: &Path, cache: &dyn Cache) {
         let mut state = self.state.lock().unwrap();
         debug_assert!(state.underlying_path.is_some(),
@@ -490,6 +1343,11 @@ impl Node for Dir {
         cache.rename(
             state.underlying_path.as_ref().unwrap(), path.to_owned(), state.attr.kind);
         state.underlying_path = Some(PathBuf::from(path));
+        if let Some(cow) = &mut state.cow {
+            debug_assert!(cow.lower_paths.is_empty(),
+                "Renames should not have been allowed on directories with read-only contents");
+            cow.upper_path = PathBuf::from(path);
+        }
 
         // This is racy: if other file operations are going on inside this subtree, they will fail
         // with ENOENT until we have updated their underlying paths after the move.  However, as we
@@ -500,6 +1358,73 @@ impl Node for Dir {
         }
     }
 
+    fn mapping_id(&self) -> Option<usize> {
+        let state = self.state.lock().unwrap();
+        state.mapping.as_ref().map(|mapping| mapping.id)
+    }
+
+    fn squash(&self) -> Option<Squash> {
+        let state = self.state.lock().unwrap();
+        state.mapping.as_ref().and_then(|mapping| mapping.squash)
+    }
+
+    fn squash_for(&self, name: &OsStr) -> Option<Squash> {
+        let state = self.state.lock().unwrap();
+        match state.children.get(name) {
+            Some(dirent) if dirent.explicit_mapping => dirent.node.squash(),
+            _ => state.mapping.as_ref().and_then(|mapping| mapping.squash),
+        }
+    }
+
+    fn noexec(&self) -> bool {
+        let state = self.state.lock().unwrap();
+        state.mapping.as_ref().map_or(false, |mapping| mapping.noexec)
+    }
+
+    fn noexec_for(&self, name: &OsStr) -> bool {
+        let state = self.state.lock().unwrap();
+        match state.children.get(name) {
+            Some(dirent) if dirent.explicit_mapping => dirent.node.noexec(),
+            _ => state.mapping.as_ref().map_or(false, |mapping| mapping.noexec),
+        }
+    }
+
+    fn perm_mask(&self) -> Option<u32> {
+        let state = self.state.lock().unwrap();
+        state.mapping.as_ref().and_then(|mapping| mapping.perm_mask)
+    }
+
+    fn perm_mask_for(&self, name: &OsStr) -> Option<u32> {
+        let state = self.state.lock().unwrap();
+        match state.children.get(name) {
+            Some(dirent) if dirent.explicit_mapping => dirent.node.perm_mask(),
+            _ => state.mapping.as_ref().and_then(|mapping| mapping.perm_mask),
+        }
+    }
+
+    fn forget_child(&self, name: &OsStr, inode: u64, cache: &dyn Cache) -> bool {
+        let mut state = self.state.lock().unwrap();
+
+        // Only entries that we discovered by reading the underlying directory can be dropped.
+        // Entries in copy-on-write directories may carry state that only lives in memory, and
+        // explicit mappings (which include all directories leading to a mapping) cannot be
+        // reconstructed from disk.
+        let path = match (&state.underlying_path, &state.cow) {
+            (Some(path), None) => path.join(name),
+            _ => return false,
+        };
+        match state.children.get(name) {
+            Some(dirent) if !dirent.explicit_mapping && dirent.node.inode() == inode => (),
+            _ => return false,
+        }
+
+        let dirent = state.children.remove(name).unwrap();
+        if dirent.node.file_type_cached() != fuse::FileType::Directory {
+            cache.forget(&path, inode);
+        }
+        true
+    }
+
     fn find_subdir(&self, name: &OsStr, ids: &IdGenerator) -> Fallible<ArcNode> {
         let mut state = self.state.lock().unwrap();
 
@@ -509,7 +1434,7 @@ impl Node for Dir {
                 Ok(dirent.node.clone())
             },
             None => {
-                let child = self.new_scaffold_child(None, name, ids, time::get_time());
+                let child = self.new_scaffold_child(None, None, name, ids, time::get_time());
                 let dirent = Dirent { node: child.clone(), explicit_mapping: true };
                 state.children.insert(name.to_os_string(), dirent);
                 Ok(child)
@@ -517,8 +1442,9 @@ impl Node for Dir {
         }
     }
 
-    fn map(&self, components: &[Component], underlying_path: &Path, writable: bool,
-        ids: &IdGenerator, cache: &dyn Cache) -> Fallible<ArcNode> {
+    fn map(&self, components: &[Component], target: &MappingTarget,
+        allowed_targets: Option<&[PathBuf]>, ids: &IdGenerator, cache: &dyn Cache)
+        -> Fallible<ArcNode> {
         debug_assert!(
             !components.is_empty(),
             "Must not be reached because we don't have the containing ArcNode to return it");
@@ -526,20 +1452,54 @@ impl Node for Dir {
 
         let mut state = self.state.lock().unwrap();
 
+        if !remainder.is_empty() {
+            // Mapping within a lazy mapping requires knowing whether its target is a directory.
+            Dir::resolve_child_locked(&mut state, name, ids, cache)
+                .with_context(|_| format!("Stat failed for the target of {:?}", name))?;
+        }
         if let Some(dirent) = state.children.get(name) {
             // TODO(jmmv): We should probably mark this dirent as an explicit mapping if it already
             // wasn't, but the Go variant of this code doesn't do this -- so investigate later.
             ensure!(dirent.node.file_type_cached() == fuse::FileType::Directory
                 && !remainder.is_empty(), "Already mapped");
-            return dirent.node.map(remainder, underlying_path, writable, ids, cache);
+            return dirent.node.map(remainder, target, allowed_targets, ids, cache);
         }
 
         let child = if remainder.is_empty() {
-            let fs_attr = fs::symlink_metadata(underlying_path)
-                .with_context(|_| format!("Stat failed for {:?}", underlying_path))?;
-            cache.get_or_create(ids, underlying_path, &fs_attr, writable)
+            match target {
+                MappingTarget::Path { .. } if target.is_lazy() => {
+                    Lazy::new_mapping(ids.next(), target, allowed_targets)
+                },
+                MappingTarget::Path { underlying_path, optional, .. } => {
+                    let fs_attr = match fs::symlink_metadata(underlying_path) {
+                        Err(ref e) if *optional && e.kind() == io::ErrorKind::NotFound => None,
+                        result => Some(result
+                            .with_context(|_| format!("Stat failed for {:?}", underlying_path))?),
+                    };
+                    match fs_attr {
+                        Some(fs_attr) => Dir::new_path_mapping(target, &fs_attr, ids, cache)?,
+                        None => Lazy::new_mapping(ids.next(), target, allowed_targets),
+                    }
+                },
+                MappingTarget::CopyOnWrite { underlying_path, scratch_path } => {
+                    Dir::new_cow_mapping(ids.next(), underlying_path, scratch_path)?
+                },
+                MappingTarget::Overlay { layers, writable } => {
+                    Dir::new_overlay_mapping(ids.next(), layers, *writable)?
+                },
+                MappingTarget::Memory { size_limit } => {
+                    MemDir::new_mapping(ids.next(), self.inode, *size_limit, time::get_time())
+                },
+            }
         } else {
-            self.new_scaffold_child(state.underlying_path.as_ref(), name, ids, time::get_time())
+            // Intermediate directories within a copy-on-write mapping are not backed by the
+            // read-only side of the mapping because they would otherwise be writable.
+            let underlying_path = match state.cow {
+                Some(_) => None,
+                None => state.underlying_path.as_ref(),
+            };
+            self.new_scaffold_child(
+                underlying_path, state.mapping.as_ref(), name, ids, time::get_time())
         };
 
         let dirent = Dirent { node: child.clone(), explicit_mapping: true };
@@ -549,7 +1509,7 @@ impl Node for Dir {
             Ok(child)
         } else {
             ensure!(child.file_type_cached() == fuse::FileType::Directory, "Already mapped");
-            child.map(remainder, underlying_path, writable, ids, cache)
+            child.map(remainder, target, allowed_targets, ids, cache)
         }
     }
 
@@ -566,17 +1526,90 @@ impl Node for Dir {
 
     fn unmap_subdir(&self, name: &OsStr, inodes: &mut Vec<u64>) -> Fallible<()> {
         let mut state = self.state.lock().unwrap();
-        match state.children.remove_entry(name) {
-            Some((name, dirent)) => {
-                if dirent.explicit_mapping {
-                    dirent.node.unmap(inodes)
-                } else {
-                    let err = format_err!("{:?} is not a mapping", &name);
-                    state.children.insert(name, dirent);
-                    Err(err)
-                }
+        Dir::unmap_child_locked(&mut state, name, inodes)
+    }
+
+    fn unmap_path(&self, components: &[Component], inodes: &mut Vec<u64>) -> Fallible<()> {
+        let (name, remainder) = split_components(components);
+
+        let mut state = self.state.lock().unwrap();
+
+        if remainder.is_empty() {
+            return Dir::unmap_child_locked(&mut state, name, inodes);
+        }
+
+        let child = match state.children.get(name) {
+            Some(dirent) => {
+                ensure!(dirent.explicit_mapping, "{:?} is not a mapping", name);
+                ensure!(dirent.node.file_type_cached() == fuse::FileType::Directory,
+                    "{:?} is not a directory", name);
+                dirent.node.clone()
             },
-            None => Err(format_err!("Unknown entry")),
+            None => return Err(format_err!("Unknown entry")),
+        };
+        child.unmap_path(remainder, inodes)?;
+
+        if self.inode != fuse::FUSE_ROOT_ID && child.is_empty_scaffold() {
+            state.children.remove(name);
+            inodes.push(child.inode());
+        }
+        Ok(())
+    }
+
+    fn list_mappings(&self, path: &Path, mappings: &mut Vec<MappingInfo>) {
+        let state = self.state.lock().unwrap();
+        let underlying_path = match &state.cow {
+            Some(cow) => cow.lower_paths.first().cloned(),
+            None => state.underlying_path.clone(),
+        };
+        mappings.push(MappingInfo {
+            path: path.to_owned(),
+            underlying_path: underlying_path,
+            writable: self.writable,
+            noexec: state.mapping.as_ref().map_or(false, |mapping| mapping.noexec),
+            perm_mask: state.mapping.as_ref().and_then(|mapping| mapping.perm_mask),
+            unresolved: false,
+        });
+        for (name, dirent) in &state.children {
+            if dirent.explicit_mapping {
+                dirent.node.list_mappings(&path.join(name), mappings);
+            }
+        }
+    }
+
+    fn is_empty_scaffold(&self) -> bool {
+        let state = self.state.lock().unwrap();
+        state.underlying_path.is_none() && state.children.is_empty()
+    }
+
+    fn is_scaffold(&self) -> bool {
+        let state = self.state.lock().unwrap();
+        state.underlying_path.is_none() && state.cow.is_none()
+    }
+
+    fn backing(&self) -> Backing {
+        if self.cow { Backing::CopyOnWrite } else { Backing::Underlying }
+    }
+
+    fn copy_up(&self) -> NodeResult<()> {
+        let state = self.state.lock().unwrap();
+        match &state.cow {
+            Some(cow) if !cow.lower_paths.is_empty() => {
+                Err(KernelError::from_errno(errno::Errno::EXDEV))
+            },
+            _ => Ok(()),
+        }
+    }
+
+    fn is_empty_dir(&self) -> NodeResult<bool> {
+        let state = self.state.lock().unwrap();
+        if state.children.values().any(|dirent| dirent.explicit_mapping) {
+            return Ok(false);
+        }
+        match (&state.cow, &state.underlying_path) {
+            (Some(cow), _) => Ok(cow.names()?.is_empty()),
+            (None, Some(path)) => Ok(fs::read_dir(path)?.next().is_none()),
+            (None, None) => Ok(true),
         }
     }
 
@@ -585,12 +1618,18 @@ impl Node for Dir {
         ids: &IdGenerator, cache: &dyn Cache) -> NodeResult<(ArcNode, ArcHandle, fuse::FileAttr)> {
         let mut state = self.state.lock().unwrap();
         let path = Dir::get_writable_path(&mut state, name)?;
+        Dir::check_folded_collision_locked(&mut state, name)?;
 
         let mut options = conv::flags_to_openoptions(flags, self.writable)?;
         options.create(true);
         options.mode(mode);
+        let oflag = fcntl::OFlag::from_bits_truncate(flags as i32) | fcntl::OFlag::O_CREAT;
+        let mode = sys::stat::Mode::from_bits_truncate(mode as sys::stat::mode_t);
 
-        let file = create_as(&path, uid, gid, |p| options.open(&p), |p| fs::remove_file(&p))?;
+        let file = create_as(
+            &path, uid, gid,
+            |p| confine::open(p, &options, oflag, mode),
+            |p| confine::remove_file(p))?;
         let (node, attr) = Dir::post_create_lookup(self.writable, &mut state, &path, name,
             fuse::FileType::RegularFile, ids, cache)?;
         Ok((node.clone(), node.handle_from(file), attr))
@@ -604,7 +1643,7 @@ impl Node for Dir {
     fn getxattr(&self, name: &OsStr) -> NodeResult<Option<Vec<u8>>> {
         let state = self.state.lock().unwrap();
         match &state.underlying_path {
-            Some(path) => Ok(xattr::get(path, name)?),
+            Some(path) => Ok(confine::get_xattr(path, name)?),
             None => Ok(None),
         }
     }
@@ -612,7 +1651,7 @@ impl Node for Dir {
     fn listxattr(&self) -> NodeResult<Option<xattr::XAttrs>> {
         let state = self.state.lock().unwrap();
         match &state.underlying_path {
-            Some(path) => Ok(Some(xattr::list(path)?)),
+            Some(path) => Ok(Some(confine::list_xattrs(path)?)),
             None => Ok(None),
         }
     }
@@ -627,11 +1666,12 @@ impl Node for Dir {
         cache: &dyn Cache) -> NodeResult<(ArcNode, fuse::FileAttr)> {
         let mut state = self.state.lock().unwrap();
         let path = Dir::get_writable_path(&mut state, name)?;
+        Dir::check_folded_collision_locked(&mut state, name)?;
 
         create_as(
             &path, uid, gid,
-            |p| fs::DirBuilder::new().mode(mode).create(&p),
-            |p| fs::remove_dir(&p))?;
+            |p| confine::mkdir(p, mode),
+            |p| confine::remove_dir(p))?;
         Dir::post_create_lookup(self.writable, &mut state, &path, name,
             fuse::FileType::Directory, ids, cache)
     }
@@ -640,6 +1680,7 @@ impl Node for Dir {
         ids: &IdGenerator, cache: &dyn Cache) -> NodeResult<(ArcNode, fuse::FileAttr)> {
         let mut state = self.state.lock().unwrap();
         let path = Dir::get_writable_path(&mut state, name)?;
+        Dir::check_folded_collision_locked(&mut state, name)?;
 
         if mode > u32::from(std::u16::MAX) {
             warn!("mknod got too-big mode {} (exceeds {})", mode, std::u16::MAX);
@@ -662,35 +1703,43 @@ impl Node for Dir {
         };
 
         let exp_filetype = match sflag {
+            sys::stat::SFlag::S_IFBLK | sys::stat::SFlag::S_IFCHR
+                if !ALLOW_DEVICES.load(Ordering::Relaxed) => {
+                return Err(KernelError::from_errno(errno::Errno::EPERM));
+            },
             sys::stat::SFlag::S_IFBLK => fuse::FileType::BlockDevice,
             sys::stat::SFlag::S_IFCHR => fuse::FileType::CharDevice,
             sys::stat::SFlag::S_IFIFO => fuse::FileType::NamedPipe,
             sys::stat::SFlag::S_IFREG => fuse::FileType::RegularFile,
+            sys::stat::SFlag::S_IFSOCK => fuse::FileType::Socket,
             _ => {
                 warn!("mknod received request to create {} with type {:?}, which is not supported",
                     path.display(), sflag);
                 return Err(KernelError::from_errno(errno::Errno::EIO));
             },
         };
+        // Prevent hidden entries from coming into existence, as we do with excluded ones.
+        if is_hidden_type(exp_filetype) {
+            return Err(KernelError::from_errno(errno::Errno::EPERM));
+        }
 
         #[allow(clippy::cast_lossless)]
         create_as(
             &path, uid, gid,
-            |p| sys::stat::mknod(p, sflag, perm, rdev as sys::stat::dev_t),
-            |p| unistd::unlink(p))?;
+            |p| confine::mknod(p, sflag, perm, rdev as sys::stat::dev_t),
+            |p| confine::remove_file(p))?;
         Dir::post_create_lookup(self.writable, &mut state, &path, name, exp_filetype, ids, cache)
     }
 
-    fn open(&self, flags: u32) -> NodeResult<ArcHandle> {
-        let flags = flags as i32;
-        let oflag = fcntl::OFlag::from_bits_truncate(flags);
-
-        let handle = {
+    fn open(&self, _flags: u32) -> NodeResult<ArcHandle> {
+        let entries = {
             let state = self.state.lock().unwrap();
 
-            match state.underlying_path.as_ref() {
-                Some(path) => Some(rawdir::Dir::open(path, oflag, sys::stat::Mode::S_IRUSR)?),
-                None => None,
+            // Copy-on-write directories read their contents from two separate directories, so
+            // they do not keep an open handle.
+            match (&state.cow, state.underlying_path.as_ref()) {
+                (None, Some(path)) => Some(timeout::read_dir(path)?),
+                _ => None,
             }
         };
 
@@ -698,26 +1747,39 @@ impl Node for Dir {
             inode: self.inode,
             writable: self.writable,
             state: self.state.clone(),
-            handle: Mutex::from(handle),
-            reply_contents: Mutex::from(vec!()),
+            stream: Mutex::from(ReaddirStream::new(entries)),
         }))
     }
 
     fn removexattr(&self, name: &OsStr) -> NodeResult<()> {
-        let state = self.state.lock().unwrap();
+        let mut state = self.state.lock().unwrap();
+        Dir::copy_up_locked(&mut state)?;
         match &state.underlying_path {
-            Some(path) => Ok(xattr::remove(path, name)?),
+            Some(path) => Ok(confine::remove_xattr(path, name)?),
             None => Err(KernelError::from_errno(errno::Errno::EACCES)),
         }
     }
 
     fn rename(&self, old_name: &OsStr, new_name: &OsStr, cache: &dyn Cache) -> NodeResult<()> {
         let mut state = self.state.lock().unwrap();
+        if state.cow.is_some() {
+            return Dir::rename_cow_locked(&mut state, old_name, new_name);
+        }
 
+        let folded = Dir::find_folded_locked(&mut state, old_name)?;
+        let old_name = folded.as_ref().map_or(old_name, OsString::as_os_str);
         let old_path = Dir::get_writable_path(&mut state, old_name)?;
         let new_path = Dir::get_writable_path(&mut state, new_name)?;
 
-        fs::rename(&old_path, &new_path)?;
+        let inode = state.children.get(old_name)
+            .expect("get_writable_path call above ensured the child exists")
+            .node.inode();
+        let replaced = Dir::prepare_replace_locked(&state, new_name, inode);
+        confine::rename(&old_path, &new_path)?;
+        state.folded_names = None;
+        if let Some(node) = replaced {
+            node.delete(cache);
+        }
 
         let dirent = state.children.remove(old_name)
             .expect("get_writable_path call above ensured the child exists");
@@ -733,15 +1795,28 @@ impl Node for Dir {
 
         let mut state = self.state.lock().unwrap();
 
+        let folded = Dir::find_folded_locked(&mut state, old_name)?;
+        let old_name = folded.as_ref().map_or(old_name, OsString::as_os_str);
         let old_path = Dir::get_writable_path(&mut state, old_name)?;
+        if state.cow.is_some() {
+            state.children.get(old_name)
+                .expect("get_writable_path call above ensured the child exists")
+                .node.copy_up()?;
+        }
 
         let (old_name, dirent) = state.children.remove_entry(old_name)
             .expect("get_writable_path call above ensured the child exists");
         let result = new_dir.rename_and_move_target(&dirent, &old_path, new_name, cache);
-        if result.is_err() {
-            // "Roll back" any changes we did to the current directory because the rename could not
-            // be completed on the target.
-            state.children.insert(old_name, dirent);
+        match result {
+            Ok(()) => {
+                state.folded_names = None;
+                Dir::whiteout_locked(&mut state, &old_name);
+            },
+            Err(_) => {
+                // "Roll back" any changes we did to the current directory because the rename could
+                // not be completed on the target.
+                state.children.insert(old_name, dirent);
+            },
         }
         result
     }
@@ -762,11 +1837,28 @@ impl Node for Dir {
         // have an integration test to catch this race, which will ensure this doesn't go unnoticed.
         let mut state = self.state.lock().unwrap();
 
-        let new_path = Dir::get_writable_path(&mut state, new_name)?;
+        // Moving entries across different kinds of storage would require copying them, so let the
+        // caller do that instead.
+        if self.backing() != dirent.node.backing() {
+            return Err(KernelError::from_errno(errno::Errno::EXDEV));
+        }
 
-        fs::rename(&old_path, &new_path)?;
+        let new_path = Dir::get_writable_path(&mut state, new_name)?;
 
-        dirent.node.set_underlying_path(&new_path, cache);
+        if state.cow.is_some() {
+            Dir::check_cow_rename_target_locked(&state, new_name)?;
+            confine::rename(&old_path, &new_path)?;
+            Dir::whiteout_locked(&mut state, new_name);
+            dirent.node.set_underlying_path(&new_path, &NoCache::default());
+        } else {
+            let replaced = Dir::prepare_replace_locked(&state, new_name, dirent.node.inode());
+            confine::rename(&old_path, &new_path)?;
+            state.folded_names = None;
+            if let Some(node) = replaced {
+                node.delete(cache);
+            }
+            dirent.node.set_underlying_path(&new_path, cache);
+        }
         state.children.insert(new_name.to_owned(), dirent.clone());
         Ok(())
     }
@@ -774,19 +1866,21 @@ impl Node for Dir {
     fn rmdir(&self, name: &OsStr, cache: &dyn Cache) -> NodeResult<()> {
         // TODO(jmmv): Figure out how to remove the redundant closure.
         #[allow(clippy::redundant_closure)]
-        self.remove_any(name, |p| fs::remove_dir(p), cache)
+        self.remove_any(name, |p| confine::remove_dir(p), cache)
     }
 
     fn setattr(&self, delta: &AttrDelta) -> NodeResult<fuse::FileAttr> {
         let mut state = self.state.lock().unwrap();
+        Dir::copy_up_locked(&mut state)?;
         state.attr = setattr(state.underlying_path.as_ref(), &state.attr, delta)?;
         Ok(state.attr)
     }
 
     fn setxattr(&self, name: &OsStr, value: &[u8]) -> NodeResult<()> {
-        let state = self.state.lock().unwrap();
+        let mut state = self.state.lock().unwrap();
+        Dir::copy_up_locked(&mut state)?;
         match &state.underlying_path {
-            Some(path) => Ok(xattr::set(path, name, value)?),
+            Some(path) => Ok(confine::set_xattr(path, name, value)?),
             None => Err(KernelError::from_errno(errno::Errno::EACCES)),
         }
     }
@@ -795,8 +1889,9 @@ impl Node for Dir {
         ids: &IdGenerator, cache: &dyn Cache) -> NodeResult<(ArcNode, fuse::FileAttr)> {
         let mut state = self.state.lock().unwrap();
         let path = Dir::get_writable_path(&mut state, name)?;
+        Dir::check_folded_collision_locked(&mut state, name)?;
 
-        create_as(&path, uid, gid, |p| unix_fs::symlink(link, &p), |p| fs::remove_file(&p))?;
+        create_as(&path, uid, gid, |p| confine::symlink(link, p), |p| confine::remove_file(p))?;
         Dir::post_create_lookup(self.writable, &mut state, &path, name,
             fuse::FileType::Symlink, ids, cache)
     }
@@ -804,6 +1899,6 @@ impl Node for Dir {
     fn unlink(&self, name: &OsStr, cache: &dyn Cache) -> NodeResult<()> {
         // TODO(jmmv): Figure out how to remove the redundant closure.
         #[allow(clippy::redundant_closure)]
-        self.remove_any(name, |p| fs::remove_file(p), cache)
+        self.remove_any(name, |p| confine::remove_file(p), cache)
     }
 }
@@ -0,0 +1,111 @@
+// Copyright 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License.  You may obtain a copy
+// of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.  See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+use std::ffi::OsStr;
+use std::os::unix::ffi::OsStrExt;
+
+/// Collection of patterns that hide entries anywhere within a mapping.
+///
+/// Patterns are matched against the names of individual directory entries, not against their
+/// paths.  A pattern may contain the `*` wildcard, which matches any sequence of characters, and
+/// the `?` wildcard, which matches any single character.  All other characters match literally.
+#[derive(Clone, Debug, Default, Eq, PartialEq)]
+pub struct Excludes {
+    patterns: Vec<String>,
+}
+
+impl Excludes {
+    /// Creates a new collection from the given `patterns`, which are assumed to be valid.
+    pub fn new(patterns: Vec<String>) -> Self {
+        Excludes { patterns }
+    }
+
+    /// Returns true if there are no patterns in this collection.
+    pub fn is_empty(&self) -> bool {
+        self.patterns.is_empty()
+    }
+
+    /// Returns the patterns in this collection.
+    pub fn patterns(&self) -> &[String] {
+        &self.patterns
+    }
+
+    /// Returns true if the directory entry `name` matches any of the patterns.
+    pub fn matches(&self, name: &OsStr) -> bool {
+        self.patterns.iter().any(|pattern| glob_matches(pattern.as_bytes(), name.as_bytes()))
+    }
+}
+
+/// Returns true if `name` matches the glob `pattern` in its entirety.
+fn glob_matches(pattern: &[u8], name: &[u8]) -> bool {
+    let (mut p, mut n) = (0, 0);
+
+    // Position in the pattern just after the last `*` seen and position in the name that this `*`
+    // is currently matching up to.  Used to backtrack when a literal match fails.
+    let mut backtrack: Option<(usize, usize)> = None;
+
+    while n < name.len() {
+        if p < pattern.len() && pattern[p] == b'*' {
+            p += 1;
+            backtrack = Some((p, n));
+        } else if p < pattern.len() && (pattern[p] == b'?' || pattern[p] == name[n]) {
+            p += 1;
+            n += 1;
+        } else if let Some((star_p, star_n)) = backtrack {
+            p = star_p;
+            n = star_n + 1;
+            backtrack = Some((star_p, n));
+        } else {
+            return false;
+        }
+    }
+    pattern[p..].iter().all(|c| *c == b'*')
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_glob_matches_literal() {
+        assert!(glob_matches(b".git", b".git"));
+        assert!(!glob_matches(b".git", b".gitignore"));
+        assert!(!glob_matches(b".git", b"git"));
+        assert!(!glob_matches(b"", b"a"));
+    }
+
+    #[test]
+    fn test_glob_matches_wildcards() {
+        assert!(glob_matches(b"*", b"anything"));
+        assert!(glob_matches(b"bazel-*", b"bazel-out"));
+        assert!(glob_matches(b"bazel-*", b"bazel-"));
+        assert!(!glob_matches(b"bazel-*", b"bazel"));
+        assert!(glob_matches(b"*.o", b"main.o"));
+        assert!(!glob_matches(b"*.o", b"main.oo"));
+        assert!(glob_matches(b"*.o*", b"main.oo"));
+        assert!(glob_matches(b"a*b*c", b"aXXbYYbZZc"));
+        assert!(!glob_matches(b"a*b*c", b"aXXbYYbZZ"));
+        assert!(glob_matches(b"?.txt", b"a.txt"));
+        assert!(!glob_matches(b"?.txt", b"ab.txt"));
+    }
+
+    #[test]
+    fn test_excludes_matches() {
+        let excludes = Excludes::new(vec!(".git".to_owned(), "*.swp".to_owned()));
+        assert!(excludes.matches(OsStr::new(".git")));
+        assert!(excludes.matches(OsStr::new(".main.rs.swp")));
+        assert!(!excludes.matches(OsStr::new("main.rs")));
+        assert!(!Excludes::default().matches(OsStr::new(".git")));
+    }
+}
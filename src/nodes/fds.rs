@@ -0,0 +1,126 @@
+// Copyright 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License.  You may obtain a copy
+// of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.  See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+use libc;
+use nix::errno::Errno;
+use std::cmp;
+use std::fs;
+use std::io;
+use std::ops::Deref;
+use std::sync::atomic::{AtomicUsize, Ordering};
+
+/// Number of underlying file descriptors currently held open by file handles.
+static OPEN_FDS: AtomicUsize = AtomicUsize::new(0);
+
+/// Highest value that `OPEN_FDS` has ever reached.
+static PEAK_FDS: AtomicUsize = AtomicUsize::new(0);
+
+/// Returns the number of underlying file descriptors currently held open by file handles.
+pub fn open_fds() -> usize {
+    OPEN_FDS.load(Ordering::Relaxed)
+}
+
+/// Returns the highest number of underlying file descriptors ever held open at once.
+pub fn peak_fds() -> usize {
+    PEAK_FDS.load(Ordering::Relaxed)
+}
+
+/// An open underlying file whose descriptor counts towards `open_fds` until it is dropped.
+pub struct TrackedFile {
+    file: fs::File,
+}
+
+impl TrackedFile {
+    /// Starts tracking the already-open `file`.
+    pub fn new(file: fs::File) -> TrackedFile {
+        let open = OPEN_FDS.fetch_add(1, Ordering::SeqCst) + 1;
+        let mut peak = PEAK_FDS.load(Ordering::SeqCst);
+        while open > peak {
+            match PEAK_FDS.compare_exchange_weak(peak, open, Ordering::SeqCst, Ordering::SeqCst) {
+                Ok(_) => break,
+                Err(current) => peak = current,
+            }
+        }
+        TrackedFile { file }
+    }
+}
+
+impl Deref for TrackedFile {
+    type Target = fs::File;
+
+    fn deref(&self) -> &fs::File {
+        &self.file
+    }
+}
+
+impl Drop for TrackedFile {
+    fn drop(&mut self) {
+        let previous = OPEN_FDS.fetch_sub(1, Ordering::SeqCst);
+        debug_assert!(previous > 0, "Open descriptors count underflow");
+    }
+}
+
+/// Raises the soft limit on the number of open files to the hard limit and returns the new soft
+/// limit.
+#[allow(unsafe_code)]
+pub fn raise_nofile_limit() -> io::Result<u64> {
+    let mut limit = libc::rlimit { rlim_cur: 0, rlim_max: 0 };
+    if unsafe { libc::getrlimit(libc::RLIMIT_NOFILE, &mut limit) } == -1 {
+        return Err(io::Error::last_os_error());
+    }
+
+    let mut wanted = limit.rlim_max;
+    if cfg!(target_os = "macos") {
+        // macOS reports an infinite hard limit but rejects soft limits above OPEN_MAX.
+        wanted = cmp::min(wanted, 10240);
+    }
+    if wanted > limit.rlim_cur {
+        let new_limit = libc::rlimit { rlim_cur: wanted, rlim_max: limit.rlim_max };
+        if unsafe { libc::setrlimit(libc::RLIMIT_NOFILE, &new_limit) } == -1 {
+            let e = io::Error::last_os_error();
+            if e.raw_os_error() != Some(Errno::EINVAL as i32) {
+                return Err(e);
+            }
+            // Some systems cap the limit further (e.g. kern.maxfilesperproc on macOS); keep the
+            // current limit in that case.
+            return Ok(limit.rlim_cur as u64);
+        }
+        limit.rlim_cur = wanted;
+    }
+    Ok(limit.rlim_cur as u64)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::tempfile;
+
+    #[test]
+    fn test_tracked_file_counts() {
+        // Other tests open files concurrently, so only check for lower bounds.
+        let file = TrackedFile::new(tempfile().unwrap());
+        assert!(open_fds() >= 1);
+        assert!(peak_fds() >= 1);
+        file.metadata().unwrap();  // Deref gives access to the underlying file.
+        drop(file);
+        assert!(peak_fds() >= 1);
+    }
+
+    #[test]
+    fn test_raise_nofile_limit() {
+        let limit = raise_nofile_limit().unwrap();
+        assert!(limit > 0);
+        assert_eq!(limit, raise_nofile_limit().unwrap());
+    }
+}
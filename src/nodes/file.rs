@@ -15,37 +15,204 @@
 extern crate fuse;
 
 use failure::Fallible;
-use nix::errno;
+use nix::{self, errno, fcntl, sys, unistd};
 use nodes::{
-    ArcHandle, ArcNode, AttrDelta, Cache, Handle, KernelError, Node, NodeResult, conv, setattr};
+    ArcHandle, ArcNode, AttrDelta, Backing, Cache, Handle, KernelError, MappingInfo, Node,
+    NodeResult, confine, conv, cow, setattr, timeout};
+use nodes::fds::TrackedFile;
 use std::ffi::OsStr;
 use std::fs;
-use std::os::unix::fs::FileExt;
+use std::io::{self, Write};
+use std::os::unix::fs::{FileExt, MetadataExt};
+use std::os::unix::io::AsRawFd;
 use std::path::{Path, PathBuf};
-use std::sync::{Arc, Mutex};
+use std::sync::{Arc, Mutex, Weak};
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::time::Instant;
+
+/// State of the underlying file descriptor of an open file handle.
+enum Descriptor {
+    /// The descriptor is open.  Shared with reads that may outlive the request that issued them if
+    /// they time out.
+    Open(Arc<TrackedFile>),
+
+    /// The descriptor was closed while idle to make room for others and has to be reopened on next
+    /// access.  Holds the device and inode numbers of the file it referenced so that reopening can
+    /// verify that the underlying path still points to the same file.
+    Closed { dev: u64, ino: u64 },
+}
 
 /// Handle for an open file.
 struct OpenFile {
     /// Reference to the node's state for this file.  Needed to update attributes on writes.
     state: Arc<Mutex<MutableFile>>,
 
-    /// Handle for the open file descriptor.
-    file: fs::File,
+    /// The underlying file descriptor.
+    file: Mutex<Descriptor>,
+
+    /// Path to the underlying file when it was opened, for diagnostic purposes only.
+    path: PathBuf,
+
+    /// Whether the underlying file was opened with `O_APPEND`, in which case writes must ignore
+    /// the offsets that the kernel computes from its possibly-stale idea of the file size.
+    append: bool,
+
+    /// Options and open(2) flags to reopen the underlying file with if its descriptor is closed
+    /// while idle.  None if the descriptor must never be closed, as is the case for handles that
+    /// can be written to.
+    reopen: Option<(fs::OpenOptions, fcntl::OFlag)>,
+
+    /// Last time the handle was accessed.
+    last_used: Mutex<Instant>,
 }
 
 impl OpenFile {
-    /// Creates a new handle that references the given node's `state` and the already-open `file`.
-    fn from(state: Arc<Mutex<MutableFile>>, file: fs::File) -> OpenFile {
-        Self { state, file }
+    /// Creates a new handle that references the given node's `state` and the already-open `file`,
+    /// which was opened from `path`.
+    ///
+    /// If `reopen` is set, the descriptor may be closed while idle and is later reopened with those
+    /// options and flags.
+    fn from(state: Arc<Mutex<MutableFile>>, file: fs::File, path: &Path,
+        reopen: Option<(fs::OpenOptions, fcntl::OFlag)>) -> OpenFile {
+        let append = match fcntl::fcntl(file.as_raw_fd(), fcntl::FcntlArg::F_GETFL) {
+            Ok(flags) => fcntl::OFlag::from_bits_truncate(flags).contains(fcntl::OFlag::O_APPEND),
+            Err(e) => {
+                warn!("Cannot get the flags of {}: {}", path.display(), e);
+                false
+            },
+        };
+        Self {
+            state,
+            file: Mutex::from(Descriptor::Open(Arc::from(TrackedFile::new(file)))),
+            path: path.to_owned(),
+            append,
+            reopen,
+            last_used: Mutex::from(Instant::now()),
+        }
+    }
+
+    /// Returns the open descriptor of the handle, reopening the underlying file if its descriptor
+    /// was closed while idle.
+    fn file(&self) -> NodeResult<Arc<TrackedFile>> {
+        *self.last_used.lock().unwrap() = Instant::now();
+        let (dev, ino) = match *self.file.lock().unwrap() {
+            Descriptor::Open(ref file) => return Ok(file.clone()),
+            Descriptor::Closed { dev, ino } => (dev, ino),
+        };
+
+        let (options, oflag) = self.reopen.as_ref()
+            .expect("Only reopenable descriptors can be closed");
+        let path = match self.state.lock().unwrap().underlying_path.clone() {
+            Some(path) => path,
+            None => {
+                warn!("Cannot reopen {}: file was deleted while idle", self.path.display());
+                return Err(KernelError::from_errno(errno::Errno::EIO));
+            },
+        };
+        let file = timeout::open(&path, options, *oflag, sys::stat::Mode::empty())?;
+        let fs_attr = file.metadata()?;
+        if fs_attr.dev() != dev || fs_attr.ino() != ino {
+            warn!("Cannot reopen {}: file was replaced while idle", path.display());
+            return Err(KernelError::from_errno(errno::Errno::EIO));
+        }
+
+        let file = Arc::from(TrackedFile::new(file));
+        *self.file.lock().unwrap() = Descriptor::Open(file.clone());
+        Ok(file)
+    }
+
+    /// Returns the open descriptor of the handle, if any, without reopening it.
+    fn open_file(&self) -> Option<Arc<TrackedFile>> {
+        match *self.file.lock().unwrap() {
+            Descriptor::Open(ref file) => Some(file.clone()),
+            Descriptor::Closed { .. } => None,
+        }
+    }
+
+    /// Returns true if the descriptor of the handle may be closed while idle.
+    ///
+    /// Descriptors of deleted files must stay open because there is no path to reopen them from.
+    fn can_close_idle(&self) -> bool {
+        self.reopen.is_some() && self.state.lock().unwrap().underlying_path.is_some()
     }
 }
 
 impl Handle for OpenFile {
+    fn close_idle(&self) -> bool {
+        if !self.can_close_idle() {
+            return false;
+        }
+
+        let mut file = self.file.lock().unwrap();
+        let (dev, ino) = match *file {
+            Descriptor::Open(ref file) => match file.metadata() {
+                Ok(fs_attr) => (fs_attr.dev(), fs_attr.ino()),
+                Err(e) => {
+                    debug!("Cannot close idle {}: {}", self.path.display(), e);
+                    return false;
+                },
+            },
+            Descriptor::Closed { .. } => return false,
+        };
+        *file = Descriptor::Closed { dev, ino };
+        true
+    }
+
+    fn flush(&self) -> NodeResult<()> {
+        // A descriptor that was closed while idle has nothing left to report.
+        let file = match self.open_file() {
+            Some(file) => file,
+            None => return Ok(()),
+        };
+
+        // Closing a duplicate of the descriptor forces file systems that only report write errors
+        // at close time, like NFS, to report them now while leaving our descriptor usable by the
+        // remaining users of the handle.
+        //
+        // Note that we do not request F_FULLFSYNC on macOS: close(2) does not imply durability on
+        // any system, and applications that need it call fsync(2), which we forward.
+        let fd = unistd::dup(file.as_raw_fd())?;
+        unistd::close(fd)?;
+        Ok(())
+    }
+
+    fn fsync(&self, datasync: bool) -> NodeResult<()> {
+        // Only read-only descriptors are ever closed while idle, so there is nothing to sync.
+        let file = match self.open_file() {
+            Some(file) => file,
+            None => return Ok(()),
+        };
+
+        if datasync {
+            file.sync_data()?;
+        } else {
+            file.sync_all()?;
+        }
+        Ok(())
+    }
+
+    fn idle_since(&self) -> Option<Instant> {
+        if !self.can_close_idle() {
+            return None;
+        }
+        match *self.file.lock().unwrap() {
+            Descriptor::Open(_) => Some(*self.last_used.lock().unwrap()),
+            Descriptor::Closed { .. } => None,
+        }
+    }
+
     fn read(&self, offset: i64, size: u32) -> NodeResult<Vec<u8>> {
-        let mut buffer = vec![0; size as usize];
-        let n = self.file.read_at(&mut buffer[..size as usize], offset as u64)?;
-        buffer.truncate(n);
-        Ok(buffer)
+        Ok(timeout::read_at(&self.file()?, &self.path, offset as u64, size as usize)?)
+    }
+
+    fn truncate(&self, size: u64) -> nix::Result<bool> {
+        // Only read-only descriptors are ever closed while idle, and the kernel does not let those
+        // truncate the file.  Reopening them here would also deadlock on the node's state, which
+        // the caller holds.
+        match self.open_file() {
+            Some(file) => unistd::ftruncate(file.as_raw_fd(), size as i64).map(|()| true),
+            None => Ok(false),
+        }
     }
 
     fn write(&self, offset: i64, mut data: &[u8]) -> NodeResult<u32> {
@@ -59,14 +226,44 @@ impl Handle for OpenFile {
             data = &data[..MAX_WRITE];
         }
 
+        let file = self.file()?;
         let mut state = self.state.lock().unwrap();
 
-        let n = self.file.write_at(data, offset as u64)?;
+        // Write straight from the request's buffer.  Short writes are retried because the kernel
+        // takes any count smaller than the request as the end of the data it can write, but an
+        // error after some data was written is reported as a short write so that the kernel's
+        // idea of the file offset matches what actually reached the underlying file.
+        //
+        // Appends go through write(2) so that the underlying file places them at its real end,
+        // which other processes may have moved since the kernel last learned the file size.
+        let mut n = 0;
+        while n < data.len() {
+            let result = if self.append {
+                (&**file).write(&data[n..])
+            } else {
+                file.write_at(&data[n..], (offset as u64) + (n as u64))
+            };
+            match result {
+                Ok(0) => break,
+                Ok(written) => n += written,
+                Err(ref e) if e.kind() == io::ErrorKind::Interrupted => (),
+                Err(e) => {
+                    if n == 0 {
+                        return Err(e.into());
+                    }
+                    break;
+                },
+            }
+        }
         debug_assert!(n <= MAX_WRITE, "Size bounds checked above");
 
-        let new_size = (offset as u64) + (n as u64);
-        if state.attr.size < new_size {
-            state.attr.size = new_size;
+        if self.append {
+            state.attr.size = file.metadata()?.len();
+        } else {
+            let new_size = (offset as u64) + (n as u64);
+            if state.attr.size < new_size {
+                state.attr.size = new_size;
+            }
         }
 
         Ok(n as u32)
@@ -80,6 +277,11 @@ impl Handle for OpenFile {
 pub struct File {
     inode: u64,
     writable: bool,
+    cow: bool,
+
+    /// Read tracking generation in which the file was last read, or 0 if never.
+    read_generation: AtomicUsize,
+
     state: Arc<Mutex<MutableFile>>,
 }
 
@@ -87,6 +289,19 @@ pub struct File {
 struct MutableFile {
     underlying_path: Option<PathBuf>,
     attr: fuse::FileAttr,
+
+    /// Other names of the underlying file within its mapping, all of which share this node because
+    /// they are hard links to the same file.
+    links: Vec<PathBuf>,
+
+    /// Path in the scratch directory of a copy-on-write mapping where this file has to be copied
+    /// to before it is first modified.  None if the file is not in such a mapping or if it has
+    /// already been copied.
+    pending_copy: Option<PathBuf>,
+
+    /// Handles opened on this file whose descriptors may be closed while idle.  These have to be
+    /// reopened before the file loses its name because they cannot be reopened from it later on.
+    handles: Vec<Weak<OpenFile>>,
 }
 
 impl File {
@@ -109,26 +324,92 @@ impl File {
         if !File::supports_type(fs_attr.file_type()) {
             panic!("Can only construct based on non-directories / non-symlinks");
         }
-        let attr = conv::attr_fs_to_fuse(underlying_path, inode, 1, &fs_attr);
+        let attr = conv::attr_fs_to_fuse(underlying_path, inode, fs_attr.nlink() as u32, &fs_attr);
+
+        let state = MutableFile {
+            underlying_path: Some(PathBuf::from(underlying_path)),
+            attr: attr,
+            links: vec!(),
+            pending_copy: None,
+            handles: vec!(),
+        };
+
+        Arc::new(File {
+            inode,
+            writable,
+            cow: false,
+            read_generation: AtomicUsize::new(0),
+            state: Arc::from(Mutex::from(state)),
+        })
+    }
+
+    /// Creates a new file within a copy-on-write mapping.
+    ///
+    /// `underlying_path` and `fs_attr` are as described in `new_mapped`.  `upper_path` is the
+    /// location of this file in the scratch directory of the mapping, which matches
+    /// `underlying_path` if the file was already copied there.  `writable` is false only for
+    /// overlay mappings whose topmost layer is read-only.
+    pub fn new_cow(inode: u64, underlying_path: &Path, fs_attr: &fs::Metadata, upper_path: &Path,
+        writable: bool) -> ArcNode {
+        if !File::supports_type(fs_attr.file_type()) {
+            panic!("Can only construct based on non-directories / non-symlinks");
+        }
+        let attr = conv::attr_fs_to_fuse(underlying_path, inode, fs_attr.nlink() as u32, &fs_attr);
 
+        let pending_copy = if underlying_path == upper_path {
+            None
+        } else {
+            Some(PathBuf::from(upper_path))
+        };
         let state = MutableFile {
             underlying_path: Some(PathBuf::from(underlying_path)),
             attr: attr,
+            links: vec!(),
+            pending_copy: pending_copy,
+            handles: vec!(),
         };
 
-        Arc::new(File { inode, writable, state: Arc::from(Mutex::from(state)) })
+        Arc::new(File {
+            inode,
+            writable,
+            cow: true,
+            read_generation: AtomicUsize::new(0),
+            state: Arc::from(Mutex::from(state)),
+        })
+    }
+
+    /// Copies the file to the scratch directory of its copy-on-write mapping if it has not been
+    /// copied yet, with the node already locked.
+    ///
+    /// If `truncate` is true, the contents of the file are not copied.
+    fn copy_up_locked(state: &mut MutableFile, truncate: bool) -> NodeResult<()> {
+        if let Some(upper_path) = &state.pending_copy {
+            let path = state.underlying_path.as_ref().expect(
+                "Deleted files must not have pending copies");
+            cow::copy_up_file(path, upper_path, truncate)?;
+        }
+        if let Some(upper_path) = state.pending_copy.take() {
+            state.underlying_path = Some(upper_path);
+        }
+        Ok(())
+    }
+
+    /// Records `handle` as a reopenable handle of this file, with the node already locked.
+    fn add_handle_locked(state: &mut MutableFile, handle: &Arc<OpenFile>) {
+        state.handles.retain(|handle| handle.upgrade().is_some());
+        state.handles.push(Arc::downgrade(handle));
     }
 
     /// Same as `getattr` but with the node already locked.
     fn getattr_locked(inode: u64, state: &mut MutableFile) -> NodeResult<fuse::FileAttr> {
         if let Some(path) = &state.underlying_path {
-            let fs_attr = fs::symlink_metadata(path)?;
+            let fs_attr = timeout::symlink_metadata(path)?;
             if !File::supports_type(fs_attr.file_type()) {
                 warn!("Path {} backing a file node is no longer a file; got {:?}",
                     path.display(), fs_attr.file_type());
                 return Err(KernelError::from_errno(errno::Errno::EIO));
             }
-            state.attr = conv::attr_fs_to_fuse(path, inode, state.attr.nlink, &fs_attr);
+            state.attr = conv::attr_fs_to_fuse(path, inode, fs_attr.nlink() as u32, &fs_attr);
         }
 
         Ok(state.attr)
@@ -154,26 +435,108 @@ impl Node for File {
         assert!(
             state.underlying_path.is_some(),
             "Delete already called or trying to delete an explicit mapping");
-        cache.delete(state.underlying_path.as_ref().unwrap(), state.attr.kind);
-        state.underlying_path = None;
         debug_assert!(state.attr.nlink >= 1);
         state.attr.nlink -= 1;
+
+        // The caller has just removed one of the names of the file, so if there are others, the
+        // node must stay backed by those that remain.
+        if !state.links.is_empty() {
+            state.links.retain(|link| fs::symlink_metadata(link).is_ok());
+            if fs::symlink_metadata(state.underlying_path.as_ref().unwrap()).is_ok() {
+                return;
+            }
+            if let Some(link) = state.links.pop() {
+                let old_path = state.underlying_path.replace(link.clone()).unwrap();
+                cache.rename(&old_path, link, state.attr.kind);
+                return;
+            }
+        }
+
+        cache.delete(state.underlying_path.as_ref().unwrap(), state.attr.kind);
+        state.underlying_path = None;
+    }
+
+    fn underlying_path(&self) -> Option<PathBuf> {
+        self.state.lock().unwrap().underlying_path.clone()
+    }
+
+    fn mark_read(&self, generation: usize) -> bool {
+        self.read_generation.swap(generation, Ordering::Relaxed) != generation
     }
 
     fn set_underlying_path(&self, path: &Path, cache: &dyn Cache) {
         let mut state = self.state.lock().unwrap();
         debug_assert!(state.underlying_path.is_some(),
             "Renames should not have been allowed in scaffold or deleted nodes");
+
+        // If the file has other names, the one that was renamed is the one that does not exist
+        // any longer, which need not be the primary one.
+        if !state.links.is_empty()
+            && fs::symlink_metadata(state.underlying_path.as_ref().unwrap()).is_ok() {
+            if let Some(link) = state.links.iter_mut()
+                .find(|link| fs::symlink_metadata(link).is_err()) {
+                *link = PathBuf::from(path);
+                return;
+            }
+        }
+
         cache.rename(
             state.underlying_path.as_ref().unwrap(), path.to_owned(), state.attr.kind);
         state.underlying_path = Some(PathBuf::from(path));
     }
 
+    fn keep_handles_open(&self) {
+        // Collect the handles first because reopening their descriptors locks the node.
+        let handles = self.state.lock().unwrap().handles.iter()
+            .filter_map(Weak::upgrade)
+            .collect::<Vec<_>>();
+        for handle in handles {
+            if let Err(e) = handle.file() {
+                warn!("Failed to reopen {} before it loses its name: {}", handle.path.display(), e);
+            }
+        }
+    }
+
+    fn add_link(&self, path: &Path) -> bool {
+        let mut state = self.state.lock().unwrap();
+        let state = &mut *state;
+        match &state.underlying_path {
+            Some(underlying_path) => {
+                if underlying_path != path && !state.links.iter().any(|link| link == path) {
+                    state.links.push(PathBuf::from(path));
+                }
+                true
+            },
+            None => false,
+        }
+    }
+
     fn unmap(&self, inodes: &mut Vec<u64>) -> Fallible<()> {
         inodes.push(self.inode);
         Ok(())
     }
 
+    fn list_mappings(&self, path: &Path, mappings: &mut Vec<MappingInfo>) {
+        let state = self.state.lock().unwrap();
+        mappings.push(MappingInfo {
+            path: path.to_owned(),
+            underlying_path: state.underlying_path.clone(),
+            writable: self.writable,
+            noexec: false,
+            perm_mask: None,
+            unresolved: false,
+        });
+    }
+
+    fn backing(&self) -> Backing {
+        if self.cow { Backing::CopyOnWrite } else { Backing::Underlying }
+    }
+
+    fn copy_up(&self) -> NodeResult<()> {
+        let mut state = self.state.lock().unwrap();
+        File::copy_up_locked(&mut state, false)
+    }
+
     fn getattr(&self) -> NodeResult<fuse::FileAttr> {
         let mut state = self.state.lock().unwrap();
         File::getattr_locked(self.inode, &mut state)
@@ -182,51 +545,77 @@ impl Node for File {
     fn getxattr(&self, name: &OsStr) -> NodeResult<Option<Vec<u8>>> {
         let state = self.state.lock().unwrap();
         match &state.underlying_path {
-            Some(path) => Ok(xattr::get(path, name)?),
+            Some(path) => Ok(confine::get_xattr(path, name)?),
             None => Ok(None),
         }
     }
 
     fn handle_from(&self, file: fs::File) -> ArcHandle {
-        Arc::from(OpenFile::from(self.state.clone(), file))
+        let path = self.state.lock().unwrap().underlying_path.clone().unwrap_or_default();
+        Arc::from(OpenFile::from(self.state.clone(), file, &path, None))
     }
 
     fn listxattr(&self) -> NodeResult<Option<xattr::XAttrs>> {
         let state = self.state.lock().unwrap();
         match &state.underlying_path {
-            Some(path) => Ok(Some(xattr::list(path)?)),
+            Some(path) => Ok(Some(confine::list_xattrs(path)?)),
             None => Ok(None),
         }
     }
 
     fn open(&self, flags: u32) -> NodeResult<ArcHandle> {
-        let state = self.state.lock().unwrap();
+        let mut state = self.state.lock().unwrap();
 
         let options = conv::flags_to_openoptions(flags, self.writable)?;
+
+        let oflag = fcntl::OFlag::from_bits_truncate(flags as i32);
+        if oflag.intersects(fcntl::OFlag::O_WRONLY | fcntl::OFlag::O_RDWR | fcntl::OFlag::O_TRUNC) {
+            File::copy_up_locked(&mut state, oflag.contains(fcntl::OFlag::O_TRUNC))?;
+        }
+
+        // Only descriptors of regular files opened for reading can be closed while idle: reopening
+        // writable or truncating descriptors could lose data, and reopening special files, such as
+        // FIFOs, is not transparent to their users.
+        let reopen = if oflag.intersects(
+            fcntl::OFlag::O_WRONLY | fcntl::OFlag::O_RDWR | fcntl::OFlag::O_TRUNC)
+            || state.attr.kind != fuse::FileType::RegularFile {
+            None
+        } else {
+            Some((options.clone(), oflag))
+        };
+
         let path = state.underlying_path.as_ref().expect(
             "Don't know how to handle a request to reopen a deleted file");
-        let file = options.open(&path)?;
-        Ok(Arc::from(OpenFile::from(self.state.clone(), file)))
+        let file = timeout::open(&path, &options, oflag, sys::stat::Mode::empty())?;
+        let reopenable = reopen.is_some();
+        let handle = Arc::from(OpenFile::from(self.state.clone(), file, &path, reopen));
+        if reopenable {
+            File::add_handle_locked(&mut state, &handle);
+        }
+        Ok(handle)
     }
 
     fn removexattr(&self, name: &OsStr) -> NodeResult<()> {
-        let state = self.state.lock().unwrap();
+        let mut state = self.state.lock().unwrap();
+        File::copy_up_locked(&mut state, false)?;
         match &state.underlying_path {
-            Some(path) => Ok(xattr::remove(path, name)?),
+            Some(path) => Ok(confine::remove_xattr(path, name)?),
             None => Err(KernelError::from_errno(errno::Errno::EACCES)),
         }
     }
 
     fn setattr(&self, delta: &AttrDelta) -> NodeResult<fuse::FileAttr> {
         let mut state = self.state.lock().unwrap();
+        File::copy_up_locked(&mut state, delta.size == Some(0))?;
         state.attr = setattr(state.underlying_path.as_ref(), &state.attr, delta)?;
         Ok(state.attr)
     }
 
     fn setxattr(&self, name: &OsStr, value: &[u8]) -> NodeResult<()> {
-        let state = self.state.lock().unwrap();
+        let mut state = self.state.lock().unwrap();
+        File::copy_up_locked(&mut state, false)?;
         match &state.underlying_path {
-            Some(path) => Ok(xattr::set(path, name, value)?),
+            Some(path) => Ok(confine::set_xattr(path, name, value)?),
             None => Err(KernelError::from_errno(errno::Errno::EACCES)),
         }
     }
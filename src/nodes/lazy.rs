@@ -0,0 +1,234 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License.  You may obtain a copy
+// of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.  See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+extern crate fuse;
+
+use {IdGenerator, check_allowed_path};
+use failure::Fallible;
+use nix::errno;
+use nodes::{
+    ArcNode, Cache, Dir, KernelError, MappingInfo, MappingTarget, Node, NodeResult, conv, timeout};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::sync::atomic::{AtomicBool, Ordering};
+
+/// Whether all mappings that support it defer the inspection of their targets until they are
+/// first accessed, as if they had all asked for it.
+static LAZY_MAPPINGS: AtomicBool = AtomicBool::new(false);
+
+/// Enables or disables the deferred inspection of the targets of all mappings.
+pub fn set_lazy_mappings(enabled: bool) {
+    LAZY_MAPPINGS.store(enabled, Ordering::SeqCst);
+}
+
+/// Returns whether the targets of all mappings are inspected once they are first accessed.
+pub fn lazy_mappings() -> bool {
+    LAZY_MAPPINGS.load(Ordering::Relaxed)
+}
+
+/// Representation of an explicit mapping whose target has not been found yet, either because it
+/// has not been inspected yet or because it is optional and did not exist.
+///
+/// Directories replace these nodes with the nodes for their targets the first time they are
+/// looked up or listed and the targets exist, so these nodes are never handed to the kernel.
+/// Targets that cannot be found are retried on every access, and meanwhile the mapping behaves as
+/// a missing entry.
+pub struct Lazy {
+    inode: u64,
+    target: MappingTarget,
+
+    /// Canonical directories that the target must be within once it is resolved, if restricted.
+    allowed_targets: Option<Vec<PathBuf>>,
+}
+
+impl Lazy {
+    /// Creates a new lazy mapping for `target`, which must be a `MappingTarget::Path`.
+    ///
+    /// `inode` is the node number to assign to the placeholder, which is not the number of the
+    /// node that later represents the target.  `allowed_targets` is as described in `Node::map`.
+    pub fn new_mapping(inode: u64, target: &MappingTarget, allowed_targets: Option<&[PathBuf]>)
+        -> ArcNode {
+        match target {
+            MappingTarget::Path { .. } => (),
+            _ => panic!("Can only construct based on underlying paths"),
+        }
+        let allowed_targets = allowed_targets.map(<[PathBuf]>::to_vec);
+        Arc::new(Lazy { inode, target: target.clone(), allowed_targets })
+    }
+
+    /// Returns the underlying path of the target.
+    fn underlying_path(&self) -> &Path {
+        match &self.target {
+            MappingTarget::Path { underlying_path, .. } => underlying_path,
+            _ => unreachable!("Checked on construction"),
+        }
+    }
+
+    /// Same as `resolve` but without wrapping the result.
+    fn resolve_target(&self, ids: &IdGenerator, cache: &dyn Cache) -> NodeResult<ArcNode> {
+        let path = self.underlying_path();
+        let fs_attr = timeout::symlink_metadata(path)?;
+        if let Some(allowed_targets) = &self.allowed_targets {
+            // The target may not have existed when the mapping was applied, or it may have been
+            // replaced since, so check it again now that we are about to expose it.
+            check_allowed_path(path, allowed_targets).map_err(|e| {
+                warn!("Refusing to map {} once it appeared: {}", path.display(), e);
+                KernelError::from_errno(errno::Errno::EACCES)
+            })?;
+        }
+        Dir::new_path_mapping(&self.target, &fs_attr, ids, cache).map_err(|e| {
+            warn!("Cannot map {} once it appeared: {}", path.display(), e);
+            KernelError::from_errno(errno::Errno::EIO)
+        })
+    }
+}
+
+impl Node for Lazy {
+    fn inode(&self) -> u64 {
+        self.inode
+    }
+
+    fn writable(&self) -> bool {
+        match &self.target {
+            MappingTarget::Path { writable, .. } => *writable,
+            _ => unreachable!("Checked on construction"),
+        }
+    }
+
+    fn file_type_cached(&self) -> fuse::FileType {
+        // Never reported: directories resolve lazy mappings before listing them.
+        fuse::FileType::RegularFile
+    }
+
+    fn delete(&self, _cache: &dyn Cache) {
+        panic!("Explicit mappings cannot be deleted");
+    }
+
+    fn set_underlying_path(&self, _path: &Path, _cache: &dyn Cache) {
+        panic!("Explicit mappings cannot be renamed");
+    }
+
+    fn resolve(&self, ids: &IdGenerator, cache: &dyn Cache) -> Option<NodeResult<ArcNode>> {
+        Some(self.resolve_target(ids, cache))
+    }
+
+    fn unmap(&self, inodes: &mut Vec<u64>) -> Fallible<()> {
+        inodes.push(self.inode);
+        Ok(())
+    }
+
+    fn list_mappings(&self, path: &Path, mappings: &mut Vec<MappingInfo>) {
+        let (noexec, perm_mask) = match &self.target {
+            MappingTarget::Path { noexec, perm_mask, .. } => (*noexec, *perm_mask),
+            _ => unreachable!("Checked on construction"),
+        };
+        mappings.push(MappingInfo {
+            path: path.to_owned(),
+            underlying_path: Some(self.underlying_path().to_owned()),
+            writable: self.writable(),
+            noexec: noexec,
+            perm_mask: perm_mask,
+            unresolved: true,
+        });
+    }
+
+    fn getattr(&self) -> NodeResult<fuse::FileAttr> {
+        let path = self.underlying_path();
+        let fs_attr = timeout::symlink_metadata(path)?;
+        Ok(conv::attr_fs_to_fuse(path, self.inode, 1, &fs_attr))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use {Mapping, MappingOptions};
+    use nodes::{NoCache, TargetType};
+    use std::fs;
+    use std::path::PathBuf;
+    use tempfile::tempdir;
+
+    #[test]
+    fn test_resolve_inspects_target() {
+        let root = tempdir().unwrap();
+        let path = root.path().join("file");
+        let ids = IdGenerator::new(1);
+        let cache = NoCache::default();
+
+        let mapping = Mapping::from_parts(PathBuf::from("/file"), path.clone(), false).unwrap();
+        let node = Lazy::new_mapping(ids.next(), &mapping.target, None);
+        match node.resolve(&ids, &cache) {
+            Some(Err(e)) => assert_eq!(errno::Errno::ENOENT as i32, e.errno_as_i32()),
+            _ => panic!("Want resolving a missing target to fail"),
+        }
+
+        fs::write(&path, "").unwrap();
+        let resolved = node.resolve(&ids, &cache).unwrap().unwrap();
+        assert_eq!(fuse::FileType::RegularFile, resolved.file_type_cached());
+        assert_ne!(node.inode(), resolved.inode());
+    }
+
+    #[test]
+    fn test_resolve_checks_target_type() {
+        let root = tempdir().unwrap();
+        let path = root.path().join("out");
+        let ids = IdGenerator::new(1);
+        let cache = NoCache::default();
+
+        let options = MappingOptions {
+            optional: true,
+            target_type: Some(TargetType::Dir),
+            ..Default::default()
+        };
+        let mapping = Mapping::from_parts_with(PathBuf::from("/out"), path.clone(), true, options)
+            .unwrap();
+        let node = Lazy::new_mapping(ids.next(), &mapping.target, None);
+        fs::write(&path, "").unwrap();
+        match node.resolve(&ids, &cache) {
+            Some(Err(e)) => assert_eq!(errno::Errno::EIO as i32, e.errno_as_i32()),
+            _ => panic!("Want resolving a target of the wrong type to fail"),
+        }
+
+        fs::remove_file(&path).unwrap();
+        fs::create_dir(&path).unwrap();
+        let resolved = node.resolve(&ids, &cache).unwrap().unwrap();
+        assert_eq!(fuse::FileType::Directory, resolved.file_type_cached());
+    }
+
+    #[test]
+    fn test_resolve_checks_allowed_targets() {
+        let dir = tempdir().unwrap();
+        // The temporary directory itself may be behind a symlink (e.g. /tmp on macOS).
+        let root = fs::canonicalize(dir.path()).unwrap();
+        fs::create_dir(root.join("allowed")).unwrap();
+        fs::create_dir(root.join("other")).unwrap();
+        let allowed = [root.join("allowed")];
+        let path = root.join("allowed/out");
+        let ids = IdGenerator::new(1);
+        let cache = NoCache::default();
+
+        let mapping = Mapping::from_parts(PathBuf::from("/out"), path.clone(), true).unwrap();
+        let node = Lazy::new_mapping(ids.next(), &mapping.target, Some(&allowed));
+        std::os::unix::fs::symlink("../other", &path).unwrap();
+        match node.resolve(&ids, &cache) {
+            Some(Err(e)) => assert_eq!(errno::Errno::EACCES as i32, e.errno_as_i32()),
+            _ => panic!("Want resolving a target outside of the allowed ones to fail"),
+        }
+
+        fs::remove_file(&path).unwrap();
+        fs::create_dir(&path).unwrap();
+        let resolved = node.resolve(&ids, &cache).unwrap().unwrap();
+        assert_eq!(fuse::FileType::Directory, resolved.file_type_cached());
+    }
+}
@@ -0,0 +1,806 @@
+// Copyright 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License.  You may obtain a copy
+// of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.  See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+extern crate fuse;
+extern crate time;
+
+use IdGenerator;
+use failure::Fallible;
+use nix::{errno, fcntl, unistd};
+use nodes::{
+    ArcHandle, ArcNode, AttrDelta, Backing, Cache, Handle, KernelError, MappingInfo,
+    MappingTarget, NoCache, Node, NodeResult, setattr};
+use nodes::dir::Dirent;
+use std::collections::HashMap;
+use std::ffi::{OsStr, OsString};
+use std::path::{Component, Path, PathBuf};
+use std::sync::{Arc, Mutex};
+
+/// Permissions of the root directory of an in-memory mapping, which match those of a typical
+/// temporary directory.
+const ROOT_PERM: u16 = 0o1777;
+
+/// Tracks the space consumed by the files of an in-memory mapping.
+struct Quota {
+    /// Maximum number of bytes that the files can hold, if any.
+    limit: Option<u64>,
+
+    /// Number of bytes currently held by the files.
+    used: Mutex<u64>,
+}
+
+impl Quota {
+    /// Accounts for a file whose contents change from `old_size` to `new_size` bytes.
+    ///
+    /// Fails with `ENOSPC` if the new size does not fit within the limit, in which case the usage
+    /// is left unmodified.
+    fn resize(&self, old_size: u64, new_size: u64) -> NodeResult<()> {
+        let mut used = self.used.lock().unwrap();
+        if new_size > old_size {
+            let new_used = *used + (new_size - old_size);
+            if let Some(limit) = self.limit {
+                if new_used > limit {
+                    return Err(KernelError::from_errno(errno::Errno::ENOSPC));
+                }
+            }
+            *used = new_used;
+        } else {
+            debug_assert!(*used >= old_size - new_size);
+            *used -= old_size - new_size;
+        }
+        Ok(())
+    }
+}
+
+/// Properties shared by all the nodes of an in-memory mapping.
+struct Context {
+    /// Inode number of the root directory of the mapping, which identifies its storage.
+    root: u64,
+
+    /// Space accounting for the whole mapping.
+    quota: Quota,
+}
+
+/// Creates the attributes for a new in-memory node.
+fn new_attr(inode: u64, kind: fuse::FileType, perm: u16, uid: unistd::Uid, gid: unistd::Gid)
+    -> fuse::FileAttr {
+    let now = time::get_time();
+    let (nlink, size) = match kind {
+        fuse::FileType::Directory => (2, 2),  // Same as scaffold directories.
+        _ => (1, 0),
+    };
+    fuse::FileAttr {
+        ino: inode,
+        kind: kind,
+        nlink: nlink,
+        size: size,
+        blocks: 0,
+        atime: now,
+        mtime: now,
+        ctime: now,
+        crtime: now,
+        perm: perm,
+        uid: uid.as_raw(),
+        gid: gid.as_raw(),
+        rdev: 0,
+        flags: 0,
+    }
+}
+
+/// Computes the number of 512-byte blocks needed to hold `size` bytes.
+fn blocks_for(size: u64) -> u64 {
+    (size + 511) / 512
+}
+
+/// Handle for an open in-memory file.
+struct OpenMemFile {
+    /// Reference to the node's state for this file.
+    state: Arc<Mutex<MutableMemFile>>,
+
+    /// Properties of the mapping the file belongs to.
+    context: Arc<Context>,
+}
+
+impl Handle for OpenMemFile {
+    fn read(&self, offset: i64, size: u32) -> NodeResult<Vec<u8>> {
+        let state = self.state.lock().unwrap();
+        let len = state.data.len();
+        let start = ::std::cmp::min(offset as usize, len);
+        let end = ::std::cmp::min(start + size as usize, len);
+        Ok(state.data[start..end].to_vec())
+    }
+
+    fn write(&self, offset: i64, data: &[u8]) -> NodeResult<u32> {
+        if data.len() > ::std::u32::MAX as usize {
+            // FUSE never sends writes this large, so there is no need to support partial writes.
+            return Err(KernelError::from_errno(errno::Errno::EINVAL));
+        }
+
+        let mut state = self.state.lock().unwrap();
+
+        let start = offset as usize;
+        let end = start + data.len();
+        if end > state.data.len() {
+            self.context.quota.resize(state.data.len() as u64, end as u64)?;
+            state.data.resize(end, 0);
+        }
+        state.data[start..end].copy_from_slice(data);
+
+        let now = time::get_time();
+        state.attr.size = state.data.len() as u64;
+        state.attr.blocks = blocks_for(state.attr.size);
+        state.attr.mtime = now;
+        state.attr.ctime = now;
+        Ok(data.len() as u32)
+    }
+}
+
+impl Drop for OpenMemFile {
+    fn drop(&mut self) {
+        let mut state = self.state.lock().unwrap();
+        debug_assert!(state.open_handles > 0);
+        state.open_handles -= 1;
+        MemFile::release_if_unused_locked(&self.context, &mut state);
+    }
+}
+
+/// Representation of an in-memory file.
+struct MemFile {
+    inode: u64,
+    context: Arc<Context>,
+    state: Arc<Mutex<MutableMemFile>>,
+}
+
+/// Holds the mutable data of an in-memory file node.
+struct MutableMemFile {
+    attr: fuse::FileAttr,
+    data: Vec<u8>,
+
+    /// Number of handles that reference this file, which keep its contents alive after deletion.
+    open_handles: usize,
+
+    /// Whether the file has been deleted from its directory.
+    deleted: bool,
+}
+
+impl MemFile {
+    /// Creates a new empty file owned by `uid` and `gid` with the permissions in `perm`.
+    fn new(inode: u64, context: Arc<Context>, perm: u16, uid: unistd::Uid, gid: unistd::Gid)
+        -> Arc<MemFile> {
+        let state = MutableMemFile {
+            attr: new_attr(inode, fuse::FileType::RegularFile, perm, uid, gid),
+            data: vec!(),
+            open_handles: 0,
+            deleted: false,
+        };
+        Arc::new(MemFile { inode, context, state: Arc::from(Mutex::from(state)) })
+    }
+
+    /// Frees the contents of a deleted file once no handles reference it any longer, with the node
+    /// already locked.
+    fn release_if_unused_locked(context: &Context, state: &mut MutableMemFile) {
+        if state.deleted && state.open_handles == 0 {
+            context.quota.resize(state.data.len() as u64, 0)
+                .expect("Shrinking a file must always succeed");
+            state.data = vec!();
+        }
+    }
+
+    /// Creates a new handle for this file and, if `truncate` is true, discards its contents.
+    fn open_locked(&self, state: &mut MutableMemFile, truncate: bool) -> NodeResult<ArcHandle> {
+        if truncate && !state.data.is_empty() {
+            self.context.quota.resize(state.data.len() as u64, 0)?;
+            state.data = vec!();
+            state.attr.size = 0;
+            state.attr.blocks = 0;
+            let now = time::get_time();
+            state.attr.mtime = now;
+            state.attr.ctime = now;
+        }
+        state.open_handles += 1;
+        Ok(Arc::from(OpenMemFile { state: self.state.clone(), context: self.context.clone() }))
+    }
+}
+
+impl Node for MemFile {
+    fn inode(&self) -> u64 {
+        self.inode
+    }
+
+    fn writable(&self) -> bool {
+        true
+    }
+
+    fn file_type_cached(&self) -> fuse::FileType {
+        fuse::FileType::RegularFile
+    }
+
+    fn delete(&self, _cache: &dyn Cache) {
+        let mut state = self.state.lock().unwrap();
+        assert!(!state.deleted, "Delete already called");
+        state.deleted = true;
+        debug_assert!(state.attr.nlink >= 1);
+        state.attr.nlink -= 1;
+        MemFile::release_if_unused_locked(&self.context, &mut state);
+    }
+
+    fn set_underlying_path(&self, _path: &Path, _cache: &dyn Cache) {
+        // Nothing to do: in-memory nodes are not backed by any path.
+    }
+
+    fn unmap(&self, inodes: &mut Vec<u64>) -> Fallible<()> {
+        inodes.push(self.inode);
+        Ok(())
+    }
+
+    fn list_mappings(&self, _path: &Path, _mappings: &mut Vec<MappingInfo>) {
+        panic!("Files within in-memory mappings cannot be explicit mappings");
+    }
+
+    fn backing(&self) -> Backing {
+        Backing::Memory(self.context.root)
+    }
+
+    fn getattr(&self) -> NodeResult<fuse::FileAttr> {
+        let state = self.state.lock().unwrap();
+        Ok(state.attr)
+    }
+
+    fn getxattr(&self, _name: &OsStr) -> NodeResult<Option<Vec<u8>>> {
+        Ok(None)
+    }
+
+    fn listxattr(&self) -> NodeResult<Option<xattr::XAttrs>> {
+        Ok(None)
+    }
+
+    fn open(&self, flags: u32) -> NodeResult<ArcHandle> {
+        let mut state = self.state.lock().unwrap();
+        let oflag = fcntl::OFlag::from_bits_truncate(flags as i32);
+        self.open_locked(&mut state, oflag.contains(fcntl::OFlag::O_TRUNC))
+    }
+
+    fn removexattr(&self, _name: &OsStr) -> NodeResult<()> {
+        Err(KernelError::from_errno(errno::Errno::EOPNOTSUPP))
+    }
+
+    fn setattr(&self, delta: &AttrDelta) -> NodeResult<fuse::FileAttr> {
+        let mut state = self.state.lock().unwrap();
+        if let Some(size) = delta.size {
+            if size > ::std::isize::MAX as u64 {
+                return Err(KernelError::from_errno(errno::Errno::EFBIG));
+            }
+            self.context.quota.resize(state.data.len() as u64, size)?;
+            state.data.resize(size as usize, 0);
+            state.attr.blocks = blocks_for(size);
+        }
+        state.attr = setattr(None, &state.attr, delta)?;
+        Ok(state.attr)
+    }
+
+    fn setxattr(&self, _name: &OsStr, _value: &[u8]) -> NodeResult<()> {
+        Err(KernelError::from_errno(errno::Errno::EOPNOTSUPP))
+    }
+}
+
+/// Representation of an in-memory symlink.
+struct MemSymlink {
+    inode: u64,
+    context: Arc<Context>,
+    target: PathBuf,
+    state: Mutex<fuse::FileAttr>,
+}
+
+impl Node for MemSymlink {
+    fn inode(&self) -> u64 {
+        self.inode
+    }
+
+    fn writable(&self) -> bool {
+        true
+    }
+
+    fn file_type_cached(&self) -> fuse::FileType {
+        fuse::FileType::Symlink
+    }
+
+    fn delete(&self, _cache: &dyn Cache) {
+        let mut attr = self.state.lock().unwrap();
+        debug_assert!(attr.nlink >= 1);
+        attr.nlink -= 1;
+    }
+
+    fn set_underlying_path(&self, _path: &Path, _cache: &dyn Cache) {
+        // Nothing to do: in-memory nodes are not backed by any path.
+    }
+
+    fn unmap(&self, inodes: &mut Vec<u64>) -> Fallible<()> {
+        inodes.push(self.inode);
+        Ok(())
+    }
+
+    fn list_mappings(&self, _path: &Path, _mappings: &mut Vec<MappingInfo>) {
+        panic!("Symlinks within in-memory mappings cannot be explicit mappings");
+    }
+
+    fn backing(&self) -> Backing {
+        Backing::Memory(self.context.root)
+    }
+
+    fn getattr(&self) -> NodeResult<fuse::FileAttr> {
+        let attr = self.state.lock().unwrap();
+        Ok(*attr)
+    }
+
+    fn getxattr(&self, _name: &OsStr) -> NodeResult<Option<Vec<u8>>> {
+        Ok(None)
+    }
+
+    fn listxattr(&self) -> NodeResult<Option<xattr::XAttrs>> {
+        Ok(None)
+    }
+
+    fn readlink(&self) -> NodeResult<PathBuf> {
+        Ok(self.target.clone())
+    }
+
+    fn removexattr(&self, _name: &OsStr) -> NodeResult<()> {
+        Err(KernelError::from_errno(errno::Errno::EOPNOTSUPP))
+    }
+
+    fn setattr(&self, delta: &AttrDelta) -> NodeResult<fuse::FileAttr> {
+        let mut attr = self.state.lock().unwrap();
+        *attr = setattr(None, &attr, delta)?;
+        Ok(*attr)
+    }
+
+    fn setxattr(&self, _name: &OsStr, _value: &[u8]) -> NodeResult<()> {
+        Err(KernelError::from_errno(errno::Errno::EOPNOTSUPP))
+    }
+}
+
+/// Handle for an open in-memory directory.
+struct OpenMemDir {
+    inode: u64,
+    state: Arc<Mutex<MutableMemDir>>,
+
+    /// Contents of this directory, captured on the first `readdir` request that has an offset of
+    /// zero.  See the equivalent field in `OpenDir` for details.
+    reply_contents: Mutex<Vec<(u64, fuse::FileType, OsString)>>,
+}
+
+impl Handle for OpenMemDir {
+    fn readdir(&self, _ids: &IdGenerator, _cache: &dyn Cache, offset: i64,
+        reply: &mut fuse::ReplyDirectory) -> NodeResult<()> {
+        let mut offset: usize = offset as usize;
+
+        let mut contents = self.reply_contents.lock().unwrap();
+        if offset == 0 {
+            let state = self.state.lock().unwrap();
+            contents.clear();
+            contents.push((self.inode, fuse::FileType::Directory, OsString::from(".")));
+            contents.push((state.parent, fuse::FileType::Directory, OsString::from("..")));
+            for (name, dirent) in &state.children {
+                contents.push((dirent.node.inode(), dirent.node.file_type_cached(), name.clone()));
+            }
+        } else {
+            // The kernel gives us the offset of the last entry we returned, so skip it.
+            offset += 1;
+        }
+
+        while offset < contents.len() {
+            let (inode, fs_type, name) = &contents[offset];
+            if reply.add(*inode, offset as i64, *fs_type, name) {
+                break;  // Reply buffer is full.
+            }
+            offset += 1;
+        }
+        Ok(())
+    }
+}
+
+/// Representation of an in-memory directory, which is either the root of an in-memory mapping or
+/// one of its subdirectories.
+pub struct MemDir {
+    inode: u64,
+    context: Arc<Context>,
+    state: Arc<Mutex<MutableMemDir>>,
+}
+
+/// Holds the mutable data of an in-memory directory node.
+struct MutableMemDir {
+    parent: u64,
+    attr: fuse::FileAttr,
+    children: HashMap<OsString, Dirent>,
+}
+
+impl MemDir {
+    /// Creates the root directory of a new in-memory mapping.
+    ///
+    /// `parent` is the inode number of the directory that contains the mapping and `size_limit`
+    /// is the maximum number of bytes that all files in the mapping can hold, if any.  The
+    /// directory's timestamps are set to `now` and the ownership is set to the current user.
+    pub fn new_mapping(inode: u64, parent: u64, size_limit: Option<u64>, now: time::Timespec)
+        -> ArcNode {
+        let context = Arc::from(Context {
+            root: inode,
+            quota: Quota { limit: size_limit, used: Mutex::from(0) },
+        });
+
+        let mut attr = new_attr(
+            inode, fuse::FileType::Directory, ROOT_PERM, unistd::getuid(), unistd::getgid());
+        attr.atime = now;
+        attr.mtime = now;
+        attr.ctime = now;
+        attr.crtime = now;
+
+        MemDir::new(inode, context, parent, attr)
+    }
+
+    /// Creates a new directory within the mapping described by `context`.
+    fn new(inode: u64, context: Arc<Context>, parent: u64, attr: fuse::FileAttr) -> Arc<MemDir> {
+        let state = MutableMemDir {
+            parent: parent,
+            attr: attr,
+            children: HashMap::new(),
+        };
+        Arc::new(MemDir { inode, context, state: Arc::from(Mutex::from(state)) })
+    }
+
+    /// Adds the new `node` as the entry `name` of this directory, with the node already locked.
+    ///
+    /// Fails with `EEXIST` if the name is already taken.
+    fn insert_locked(state: &mut MutableMemDir, name: &OsStr, node: ArcNode)
+        -> NodeResult<(ArcNode, fuse::FileAttr)> {
+        if state.children.contains_key(name) {
+            return Err(KernelError::from_errno(errno::Errno::EEXIST));
+        }
+        let attr = node.getattr()?;
+        if attr.kind == fuse::FileType::Directory {
+            state.attr.nlink += 1;
+        }
+        MemDir::touch_locked(state);
+        state.children.insert(
+            name.to_os_string(), Dirent { node: node.clone(), explicit_mapping: false });
+        Ok((node, attr))
+    }
+
+    /// Updates the modification times of the directory after a change to its entries, with the
+    /// node already locked.
+    fn touch_locked(state: &mut MutableMemDir) {
+        let now = time::get_time();
+        state.attr.mtime = now;
+        state.attr.ctime = now;
+    }
+
+    /// Ensures that the entry `name` can be replaced with `node` by a rename, with the node
+    /// already locked.
+    fn check_rename_target_locked(state: &MutableMemDir, name: &OsStr, node: &ArcNode)
+        -> NodeResult<()> {
+        if let Some(dirent) = state.children.get(name) {
+            let is_dir = node.file_type_cached() == fuse::FileType::Directory;
+            let target_is_dir = dirent.node.file_type_cached() == fuse::FileType::Directory;
+            if is_dir && !target_is_dir {
+                return Err(KernelError::from_errno(errno::Errno::ENOTDIR));
+            } else if !is_dir && target_is_dir {
+                return Err(KernelError::from_errno(errno::Errno::EISDIR));
+            } else if target_is_dir && !dirent.node.is_empty_dir()? {
+                return Err(KernelError::from_errno(errno::Errno::ENOTEMPTY));
+            }
+        }
+        Ok(())
+    }
+
+    /// Removes the entry `name` from this directory, if present, with the node already locked.
+    fn remove_locked(state: &mut MutableMemDir, name: &OsStr) {
+        if let Some(dirent) = state.children.remove(name) {
+            if dirent.node.file_type_cached() == fuse::FileType::Directory {
+                state.attr.nlink -= 1;
+            }
+            dirent.node.delete(&NoCache::default());
+        }
+    }
+
+    /// Common implementation for the `rmdir` and `unlink` operations.
+    ///
+    /// `want_dir` indicates whether the entry to remove has to be a directory or not.
+    fn remove_any(&self, name: &OsStr, want_dir: bool) -> NodeResult<()> {
+        let mut state = self.state.lock().unwrap();
+        let node = match state.children.get(name) {
+            Some(dirent) => dirent.node.clone(),
+            None => return Err(KernelError::from_errno(errno::Errno::ENOENT)),
+        };
+        let is_dir = node.file_type_cached() == fuse::FileType::Directory;
+        if want_dir && !is_dir {
+            return Err(KernelError::from_errno(errno::Errno::ENOTDIR));
+        } else if !want_dir && is_dir {
+            return Err(KernelError::from_errno(errno::Errno::EISDIR));
+        } else if is_dir && !node.is_empty_dir()? {
+            return Err(KernelError::from_errno(errno::Errno::ENOTEMPTY));
+        }
+        MemDir::remove_locked(&mut state, name);
+        MemDir::touch_locked(&mut state);
+        Ok(())
+    }
+}
+
+impl Node for MemDir {
+    fn inode(&self) -> u64 {
+        self.inode
+    }
+
+    fn writable(&self) -> bool {
+        true
+    }
+
+    fn file_type_cached(&self) -> fuse::FileType {
+        fuse::FileType::Directory
+    }
+
+    fn delete(&self, _cache: &dyn Cache) {
+        let mut state = self.state.lock().unwrap();
+        debug_assert!(state.children.is_empty(), "Only empty directories can be deleted");
+        // See the comment in `Dir::delete` for details on the link count.
+        debug_assert!(state.attr.nlink >= 2);
+        state.attr.nlink -= 2;
+    }
+
+    fn set_underlying_path(&self, _path: &Path, _cache: &dyn Cache) {
+        // Nothing to do: in-memory nodes are not backed by any path.
+    }
+
+    fn find_subdir(&self, _name: &OsStr, _ids: &IdGenerator) -> Fallible<ArcNode> {
+        Err(format_err!("Cannot create sandboxes within an in-memory mapping"))
+    }
+
+    fn map(&self, _components: &[Component], _target: &MappingTarget,
+        _allowed_targets: Option<&[PathBuf]>, _ids: &IdGenerator, _cache: &dyn Cache)
+        -> Fallible<ArcNode> {
+        Err(format_err!("Cannot map within an in-memory mapping"))
+    }
+
+    fn unmap(&self, inodes: &mut Vec<u64>) -> Fallible<()> {
+        let mut state = self.state.lock().unwrap();
+        for dirent in state.children.values() {
+            dirent.node.unmap(inodes)?;
+        }
+        state.children.clear();
+
+        inodes.push(self.inode);
+        Ok(())
+    }
+
+    fn unmap_subdir(&self, name: &OsStr, _inodes: &mut Vec<u64>) -> Fallible<()> {
+        Err(format_err!("{:?} is not a mapping", name))
+    }
+
+    fn unmap_path(&self, _components: &[Component], _inodes: &mut Vec<u64>) -> Fallible<()> {
+        Err(format_err!("Cannot unmap entries within an in-memory mapping"))
+    }
+
+    fn list_mappings(&self, path: &Path, mappings: &mut Vec<MappingInfo>) {
+        mappings.push(MappingInfo {
+            path: path.to_owned(),
+            underlying_path: None,
+            writable: true,
+            noexec: false,
+            perm_mask: None,
+            unresolved: false,
+        });
+    }
+
+    fn backing(&self) -> Backing {
+        Backing::Memory(self.context.root)
+    }
+
+    fn is_empty_dir(&self) -> NodeResult<bool> {
+        let state = self.state.lock().unwrap();
+        Ok(state.children.is_empty())
+    }
+
+    fn create(&self, name: &OsStr, uid: unistd::Uid, gid: unistd::Gid, mode: u32, flags: u32,
+        ids: &IdGenerator, _cache: &dyn Cache)
+        -> NodeResult<(ArcNode, ArcHandle, fuse::FileAttr)> {
+        let mut state = self.state.lock().unwrap();
+        let file = MemFile::new(ids.next(), self.context.clone(), (mode & 0o7777) as u16, uid, gid);
+        let handle = {
+            let mut file_state = file.state.lock().unwrap();
+            let oflag = fcntl::OFlag::from_bits_truncate(flags as i32);
+            file.open_locked(&mut file_state, oflag.contains(fcntl::OFlag::O_TRUNC))?
+        };
+        let (node, attr) = MemDir::insert_locked(&mut state, name, file)?;
+        Ok((node, handle, attr))
+    }
+
+    fn getattr(&self) -> NodeResult<fuse::FileAttr> {
+        let state = self.state.lock().unwrap();
+        Ok(state.attr)
+    }
+
+    fn getxattr(&self, _name: &OsStr) -> NodeResult<Option<Vec<u8>>> {
+        Ok(None)
+    }
+
+    fn listxattr(&self) -> NodeResult<Option<xattr::XAttrs>> {
+        Ok(None)
+    }
+
+    fn lookup(&self, name: &OsStr, _ids: &IdGenerator, _cache: &dyn Cache)
+        -> NodeResult<(ArcNode, fuse::FileAttr)> {
+        let state = self.state.lock().unwrap();
+        match state.children.get(name) {
+            Some(dirent) => Ok((dirent.node.clone(), dirent.node.getattr()?)),
+            None => Err(KernelError::from_errno(errno::Errno::ENOENT)),
+        }
+    }
+
+    fn mkdir(&self, name: &OsStr, uid: unistd::Uid, gid: unistd::Gid, mode: u32, ids: &IdGenerator,
+        _cache: &dyn Cache) -> NodeResult<(ArcNode, fuse::FileAttr)> {
+        let mut state = self.state.lock().unwrap();
+        let inode = ids.next();
+        let attr = new_attr(inode, fuse::FileType::Directory, (mode & 0o7777) as u16, uid, gid);
+        let dir = MemDir::new(inode, self.context.clone(), self.inode, attr);
+        MemDir::insert_locked(&mut state, name, dir)
+    }
+
+    fn mknod(&self, _name: &OsStr, _uid: unistd::Uid, _gid: unistd::Gid, _mode: u32, _rdev: u32,
+        _ids: &IdGenerator, _cache: &dyn Cache) -> NodeResult<(ArcNode, fuse::FileAttr)> {
+        Err(KernelError::from_errno(errno::Errno::EPERM))
+    }
+
+    fn open(&self, _flags: u32) -> NodeResult<ArcHandle> {
+        Ok(Arc::from(OpenMemDir {
+            inode: self.inode,
+            state: self.state.clone(),
+            reply_contents: Mutex::from(vec!()),
+        }))
+    }
+
+    fn removexattr(&self, _name: &OsStr) -> NodeResult<()> {
+        Err(KernelError::from_errno(errno::Errno::EOPNOTSUPP))
+    }
+
+    fn rename(&self, old_name: &OsStr, new_name: &OsStr, _cache: &dyn Cache) -> NodeResult<()> {
+        let mut state = self.state.lock().unwrap();
+        let node = match state.children.get(old_name) {
+            Some(dirent) => dirent.node.clone(),
+            None => return Err(KernelError::from_errno(errno::Errno::ENOENT)),
+        };
+        if old_name == new_name {
+            return Ok(());
+        }
+        MemDir::check_rename_target_locked(&state, new_name, &node)?;
+
+        MemDir::remove_locked(&mut state, new_name);
+        let dirent = state.children.remove(old_name).expect("Presence checked above");
+        state.children.insert(new_name.to_os_string(), dirent);
+        MemDir::touch_locked(&mut state);
+        Ok(())
+    }
+
+    fn rename_and_move_source(&self, old_name: &OsStr, new_dir: ArcNode, new_name: &OsStr,
+        cache: &dyn Cache) -> NodeResult<()> {
+        debug_assert!(self.inode != new_dir.inode(),
+            "Same-directory renames have to be done via `rename`");
+
+        let mut state = self.state.lock().unwrap();
+
+        let (old_name, dirent) = match state.children.remove_entry(old_name) {
+            Some(entry) => entry,
+            None => return Err(KernelError::from_errno(errno::Errno::ENOENT)),
+        };
+        let result = new_dir.rename_and_move_target(&dirent, Path::new(""), new_name, cache);
+        match result {
+            Ok(()) => {
+                if dirent.node.file_type_cached() == fuse::FileType::Directory {
+                    state.attr.nlink -= 1;
+                }
+                MemDir::touch_locked(&mut state);
+            },
+            Err(_) => {
+                // "Roll back" any changes we did to the current directory because the rename could
+                // not be completed on the target.
+                state.children.insert(old_name, dirent);
+            },
+        }
+        result
+    }
+
+    fn rename_and_move_target(&self, dirent: &Dirent, _old_path: &Path, new_name: &OsStr,
+        _cache: &dyn Cache) -> NodeResult<()> {
+        // Moving entries across different kinds of storage would require copying them, so let the
+        // caller do that instead.
+        if self.backing() != dirent.node.backing() {
+            return Err(KernelError::from_errno(errno::Errno::EXDEV));
+        }
+
+        let mut state = self.state.lock().unwrap();
+        MemDir::check_rename_target_locked(&state, new_name, &dirent.node)?;
+
+        MemDir::remove_locked(&mut state, new_name);
+        if dirent.node.file_type_cached() == fuse::FileType::Directory {
+            state.attr.nlink += 1;
+        }
+        state.children.insert(new_name.to_os_string(), dirent.clone());
+        MemDir::touch_locked(&mut state);
+        Ok(())
+    }
+
+    fn rmdir(&self, name: &OsStr, _cache: &dyn Cache) -> NodeResult<()> {
+        self.remove_any(name, true)
+    }
+
+    fn setattr(&self, delta: &AttrDelta) -> NodeResult<fuse::FileAttr> {
+        let mut state = self.state.lock().unwrap();
+        state.attr = setattr(None, &state.attr, delta)?;
+        Ok(state.attr)
+    }
+
+    fn setxattr(&self, _name: &OsStr, _value: &[u8]) -> NodeResult<()> {
+        Err(KernelError::from_errno(errno::Errno::EOPNOTSUPP))
+    }
+
+    fn symlink(&self, name: &OsStr, link: &Path, uid: unistd::Uid, gid: unistd::Gid,
+        ids: &IdGenerator, _cache: &dyn Cache) -> NodeResult<(ArcNode, fuse::FileAttr)> {
+        let mut state = self.state.lock().unwrap();
+        let inode = ids.next();
+        let mut attr = new_attr(inode, fuse::FileType::Symlink, 0o777, uid, gid);
+        attr.size = link.as_os_str().len() as u64;
+        let symlink = Arc::new(MemSymlink {
+            inode: inode,
+            context: self.context.clone(),
+            target: link.to_owned(),
+            state: Mutex::from(attr),
+        });
+        MemDir::insert_locked(&mut state, name, symlink)
+    }
+
+    fn unlink(&self, name: &OsStr, _cache: &dyn Cache) -> NodeResult<()> {
+        self.remove_any(name, false)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_quota_unlimited() {
+        let quota = Quota { limit: None, used: Mutex::from(0) };
+        quota.resize(0, ::std::u32::MAX as u64).unwrap();
+        quota.resize(::std::u32::MAX as u64, 10).unwrap();
+        assert_eq!(10, *quota.used.lock().unwrap());
+    }
+
+    #[test]
+    fn test_quota_limit() {
+        let quota = Quota { limit: Some(100), used: Mutex::from(0) };
+        quota.resize(0, 60).unwrap();
+        quota.resize(0, 40).unwrap();
+        assert_eq!(
+            errno::Errno::ENOSPC as i32, quota.resize(0, 1).unwrap_err().errno_as_i32());
+        assert_eq!(100, *quota.used.lock().unwrap());
+        quota.resize(60, 0).unwrap();
+        quota.resize(0, 60).unwrap();
+        assert_eq!(100, *quota.used.lock().unwrap());
+    }
+
+    #[test]
+    fn test_blocks_for() {
+        assert_eq!(0, blocks_for(0));
+        assert_eq!(1, blocks_for(1));
+        assert_eq!(1, blocks_for(512));
+        assert_eq!(2, blocks_for(513));
+    }
+}
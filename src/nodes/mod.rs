@@ -14,26 +14,47 @@
 
 use IdGenerator;
 use errors::KernelError;
-use failure::Fallible;
+use failure::{Error, Fallible};
 use fuse;
+use libc;
 use nix;
+use nix::NixPath;
 use nix::errno::Errno;
 use nix::{sys, unistd};
 use std::ffi::OsStr;
+use std::fmt;
 use std::fs;
+use std::os::unix::io::RawFd;
+use std::os::unix::fs::MetadataExt;
 use std::path::{Component, Path, PathBuf};
 use std::result::Result;
+use std::str::FromStr;
 use std::sync::Arc;
+use std::time::Instant;
+use time::Timespec;
 
 mod caches;
 pub use self::caches::{NoCache, PathCache};
+pub mod confine;
+pub use self::confine::{confine_symlinks, set_confine_symlinks};
 pub mod conv;
+mod cow;
 mod dir;
-pub use self::dir::Dir;
+pub use self::dir::{Dir, set_allow_devices, set_case_insensitive, set_hidden_special_files};
+mod excludes;
+pub use self::excludes::Excludes;
+mod fds;
+pub use self::fds::{open_fds, peak_fds, raise_nofile_limit};
 mod file;
 pub use self::file::File;
+mod lazy;
+pub use self::lazy::{Lazy, lazy_mappings, set_lazy_mappings};
+mod memory;
+pub use self::memory::MemDir;
 mod symlink;
 pub use self::symlink::Symlink;
+mod timeout;
+pub use self::timeout::set_io_timeout;
 
 /// Node factory with possible reuse of previously-created nodes.
 pub trait Cache {
@@ -53,6 +74,12 @@ pub trait Cache {
     ///
     /// The `file_type` corresponds to the type of the mapping that points to the given `old_path`.
     fn rename(&self, _old_path: &Path, _new_path: PathBuf, _file_type: fuse::FileType);
+
+    /// Drops the entry `path` from the cache if it holds the node with the given `inode`.
+    ///
+    /// This is called once the kernel has forgotten about the node so that the cache does not
+    /// keep it alive.
+    fn forget(&self, _path: &Path, _inode: u64);
 }
 
 /// A reference-counted `Cache` that's safe to send across threads.
@@ -63,9 +90,198 @@ pub struct AttrDelta {
     pub mode: Option<sys::stat::Mode>,
     pub uid: Option<unistd::Uid>,
     pub gid: Option<unistd::Gid>,
-    pub atime: Option<sys::time::TimeVal>,
-    pub mtime: Option<sys::time::TimeVal>,
+    pub atime: Option<Timespec>,
+    pub mtime: Option<Timespec>,
     pub size: Option<u64>,
+
+    /// Open handle through which the changes were requested, if any.  Size changes go through it
+    /// so that they apply to the open file even if it has lost its name.
+    pub handle: Option<ArcHandle>,
+}
+
+/// Ownership to force on the files of a mapping, regardless of the identity of the caller.
+///
+/// Files created within the mapping are owned by the given user and group in the underlying file
+/// system, and these files report the identity of the caller instead.  Requests to change the
+/// ownership of files are not propagated to the underlying file system.
+#[derive(Clone, Copy, Debug, Eq, PartialEq)]
+pub struct Squash {
+    /// User that owns all created files, or none to leave the user of the caller.
+    pub uid: Option<u32>,
+
+    /// Group that owns all created files, or none to leave the group of the caller.
+    pub gid: Option<u32>,
+
+    /// Whether requests to change the ownership of files to identities other than the caller's
+    /// fail with `EPERM` instead of being ignored.
+    pub strict: bool,
+}
+
+impl fmt::Display for Squash {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        let mut ids = vec!();
+        if let Some(uid) = self.uid {
+            ids.push(format!("uid {}", uid));
+        }
+        if let Some(gid) = self.gid {
+            ids.push(format!("gid {}", gid));
+        }
+        let strict = if self.strict { "strictly " } else { "" };
+        write!(f, "{}squashing to {}", strict, ids.join(" and "))
+    }
+}
+
+/// Type that the target of a mapping is declared to have.
+#[derive(Clone, Copy, Debug, Eq, PartialEq)]
+pub enum TargetType {
+    /// The target must be a directory.
+    Dir,
+
+    /// The target must be a regular file.
+    File,
+}
+
+impl TargetType {
+    /// Returns true if `file_type` is of this type.
+    pub fn matches(self, file_type: fs::FileType) -> bool {
+        match self {
+            TargetType::Dir => file_type.is_dir(),
+            TargetType::File => file_type.is_file(),
+        }
+    }
+}
+
+impl fmt::Display for TargetType {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        match self {
+            TargetType::Dir => write!(f, "dir"),
+            TargetType::File => write!(f, "file"),
+        }
+    }
+}
+
+impl FromStr for TargetType {
+    type Err = Error;
+
+    fn from_str(s: &str) -> Fallible<Self> {
+        match s {
+            "dir" => Ok(TargetType::Dir),
+            "file" => Ok(TargetType::File),
+            _ => Err(format_err!("invalid target type {}: must be dir or file", s)),
+        }
+    }
+}
+
+/// Description of the contents that a mapping exposes at its location.
+#[derive(Clone, Debug, Eq, PartialEq)]
+pub enum MappingTarget {
+    /// A file or directory of the underlying file system, exposed verbatim.
+    Path {
+        underlying_path: PathBuf,
+        writable: bool,
+
+        /// Entries to hide anywhere within the mapping unless they are explicitly mapped.
+        excludes: Excludes,
+
+        /// Ownership to force on the files within the mapping, if any.  Only directories support
+        /// this.
+        squash: Option<Squash>,
+
+        /// Whether files within the mapping are hidden from execution by stripping the execute
+        /// bits from their modes.  Only directories support this.
+        noexec: bool,
+
+        /// Mask to AND with the permissions that files and directories within the mapping
+        /// report, if any.  The permissions stored in the underlying file system are not affected.
+        perm_mask: Option<u32>,
+
+        /// Whether the underlying path is only inspected once the mapping is first accessed, so
+        /// that problems with it surface as errors on that access instead of when mapping it.
+        /// Only mappings without any of the options above support this.
+        lazy: bool,
+
+        /// Whether the underlying path may not exist yet when applying the mapping, in which case
+        /// the mapping behaves as a missing entry until the underlying path appears.
+        optional: bool,
+
+        /// Type that the underlying path must have, if any.  A mismatch is reported when applying
+        /// the mapping or, for targets that do not exist yet, once they appear.
+        target_type: Option<TargetType>,
+    },
+
+    /// A directory of the underlying file system that is never modified: entries are copied to
+    /// `scratch_path` before they are first modified and new entries are created there.
+    CopyOnWrite {
+        underlying_path: PathBuf,
+        scratch_path: PathBuf,
+    },
+
+    /// An initially-empty directory held in memory, whose files cannot hold more than
+    /// `size_limit` bytes in total if set.
+    Memory {
+        size_limit: Option<u64>,
+    },
+
+    /// The union of several directories of the underlying file system, listed from the bottom
+    /// to the top layer.  Entries in upper layers shadow those with the same name in lower
+    /// layers.  Only the topmost layer is ever modified, and only if `writable` is true.
+    Overlay {
+        layers: Vec<PathBuf>,
+        writable: bool,
+    },
+}
+
+impl MappingTarget {
+    /// Returns true if this target is only inspected once it is first accessed, either because it
+    /// asked for this or because all mappings that support it have to be lazy.
+    pub fn is_lazy(&self) -> bool {
+        match self {
+            MappingTarget::Path { excludes, squash, noexec, perm_mask, lazy, .. } => {
+                (*lazy || lazy_mappings()) && excludes.is_empty() && squash.is_none() && !noexec
+                    && perm_mask.is_none()
+            },
+            _ => false,
+        }
+    }
+}
+
+/// Storage that holds the contents of a node.
+///
+/// Nodes can only be moved between directories that use the same storage.
+#[derive(Clone, Copy, Debug, Eq, PartialEq)]
+pub enum Backing {
+    /// The node is backed by the underlying file system, which is modified in place.
+    Underlying,
+
+    /// The node lives within a copy-on-write or an overlay mapping.
+    CopyOnWrite,
+
+    /// The node lives in memory within the in-memory mapping whose root has the given inode.
+    Memory(u64),
+}
+
+/// Description of an explicit mapping in the node tree, used for reporting purposes only.
+#[derive(Clone, Debug, Eq, PartialEq)]
+pub struct MappingInfo {
+    /// Path to the mapping within the file system.
+    pub path: PathBuf,
+
+    /// Path to the underlying file backing the mapping, or none if it is a scaffold directory or
+    /// an in-memory mapping.
+    pub underlying_path: Option<PathBuf>,
+
+    /// Whether the mapping is writable or not.
+    pub writable: bool,
+
+    /// Whether the files within the mapping cannot be executed.
+    pub noexec: bool,
+
+    /// Mask applied to the permissions of the files within the mapping, if any.
+    pub perm_mask: Option<u32>,
+
+    /// Whether the target of the mapping has not been found yet, either because it is optional
+    /// and did not exist or because it is lazy and has not been accessed.
+    pub unresolved: bool,
 }
 
 /// Generic result type for of all node operations.
@@ -100,8 +316,7 @@ fn setattr_mode(attr: &mut fuse::FileAttr, path: Option<&PathBuf>, mode: Option<
         return Err(nix::Error::from_errno(Errno::EOPNOTSUPP));
     }
 
-    let result = try_path(path, |p|
-        sys::stat::fchmodat(None, p, mode, sys::stat::FchmodatFlags::FollowSymlink));
+    let result = try_path(path, |p| confine::chmod(p, mode));
     if result.is_ok() {
         attr.perm = perm;
     }
@@ -115,8 +330,7 @@ fn setattr_owners(attr: &mut fuse::FileAttr, path: Option<&PathBuf>, uid: Option
         return Ok(())
     }
 
-    let result = try_path(path, |p|
-        unistd::fchownat(None, p, uid, gid, unistd::FchownatFlags::NoFollowSymlink));
+    let result = try_path(path, |p| confine::lchown(p, uid, gid));
     if result.is_ok() {
         attr.uid = uid.map_or(attr.uid, u32::from);
         attr.gid = gid.map_or(attr.gid, u32::from);
@@ -124,34 +338,54 @@ fn setattr_owners(attr: &mut fuse::FileAttr, path: Option<&PathBuf>, uid: Option
     result
 }
 
+/// Sets the access and modification times of `name` within `dirfd` without following symlinks,
+/// leaving the times that are none untouched.
+#[allow(unsafe_code)]
+fn utimensat_nofollow(dirfd: RawFd, name: &Path, atime: Option<Timespec>,
+    mtime: Option<Timespec>) -> nix::Result<()> {
+    let to_libc = |time: Option<Timespec>| match time {
+        Some(time) => libc::timespec { tv_sec: time.sec as _, tv_nsec: time.nsec as _ },
+        None => libc::timespec { tv_sec: 0, tv_nsec: libc::UTIME_OMIT },
+    };
+    let times = [to_libc(atime), to_libc(mtime)];
+    let ret = name.with_nix_path(|cstr| unsafe {
+        libc::utimensat(dirfd, cstr.as_ptr(), times.as_ptr(), libc::AT_SYMLINK_NOFOLLOW)
+    })?;
+    Errno::result(ret).map(drop)
+}
+
 /// Helper function for `setattr` to apply only the atime and mtime changes.
-fn setattr_times(attr: &mut fuse::FileAttr, path: Option<&PathBuf>,
-    atime: Option<sys::time::TimeVal>, mtime: Option<sys::time::TimeVal>)
-    -> Result<(), nix::Error> {
+///
+/// Both times are applied at once and with nanosecond precision, leaving the one that was not
+/// requested untouched in the underlying file.
+//
+// TODO(jmmv): The kernel can ask us to set the times to "now" via FATTR_ATIME_NOW and
+// FATTR_MTIME_NOW, which we should map to UTIME_NOW, but the fuse crate does not expose these
+// bits and instead hands us the kernel's idea of the current time.
+fn setattr_times(attr: &mut fuse::FileAttr, path: Option<&PathBuf>, atime: Option<Timespec>,
+    mtime: Option<Timespec>) -> Result<(), nix::Error> {
     if atime.is_none() && mtime.is_none() {
         return Ok(());
     }
 
-    let atime = atime.unwrap_or_else(|| conv::timespec_to_timeval(attr.atime));
-    let mtime = mtime.unwrap_or_else(|| conv::timespec_to_timeval(attr.mtime));
     #[allow(clippy::collapsible_if)]
     let result = if cfg!(have_utimensat = "1") {
-        try_path(path, |p| sys::stat::utimensat(
-            None, p,
-            &conv::timeval_to_nix_timespec(atime), &conv::timeval_to_nix_timespec(mtime),
-            sys::stat::UtimensatFlags::NoFollowSymlink))
+        try_path(path, |p| confine::at(p, |dirfd, name|
+            utimensat_nofollow(dirfd, name, atime, mtime)))
     } else {
         if attr.kind == fuse::FileType::Symlink {
-            eprintln!(
-                "utimensat not present; ignoring request to change symlink times for {:?}", path);
+            warn!("utimensat not present; ignoring request to change symlink times for {:?}", path);
             Err(nix::Error::from_errno(Errno::EOPNOTSUPP))
         } else {
+            // utimes(2) cannot leave any of the times untouched, so reapply the ones we know.
+            let atime = conv::timespec_to_timeval(atime.unwrap_or(attr.atime));
+            let mtime = conv::timespec_to_timeval(mtime.unwrap_or(attr.mtime));
             try_path(path, |p| sys::stat::utimes(p, &atime, &mtime))
         }
     };
     if result.is_ok() {
-        attr.atime = conv::timeval_to_timespec(atime);
-        attr.mtime = conv::timeval_to_timespec(mtime);
+        attr.atime = atime.unwrap_or(attr.atime);
+        attr.mtime = mtime.unwrap_or(attr.mtime);
         if attr.mtime < attr.crtime {
             // BSD semantics say, per the sources of libarchive, that the crtime should be rolled
             // back to an earlier mtime.
@@ -162,8 +396,11 @@ fn setattr_times(attr: &mut fuse::FileAttr, path: Option<&PathBuf>,
 }
 
 /// Helper function for `setattr` to apply only the size changes.
-fn setattr_size(attr: &mut fuse::FileAttr, path: Option<&PathBuf>, size: Option<u64>)
-    -> Result<(), nix::Error> {
+///
+/// The size change goes through `handle` if given and if it holds an underlying descriptor, and
+/// through `path` otherwise.
+fn setattr_size(attr: &mut fuse::FileAttr, path: Option<&PathBuf>, handle: Option<&ArcHandle>,
+    size: Option<u64>) -> Result<(), nix::Error> {
     if size.is_none() {
         return Ok(());
     }
@@ -173,7 +410,11 @@ fn setattr_size(attr: &mut fuse::FileAttr, path: Option<&PathBuf>, size: Option<
         warn!("truncate request got size {}, which is too large (exceeds i64's MAX)", size);
         Err(nix::Error::invalid_argument())
     } else {
-        try_path(path, |p| unistd::truncate(p, size as i64))
+        match handle.map(|h| h.truncate(size)) {
+            Some(Ok(true)) => Ok(()),
+            Some(Err(e)) => Err(e),
+            Some(Ok(false)) | None => try_path(path, |p| confine::truncate(p, size as i64)),
+        }
     };
     if result.is_ok() {
         attr.size = size;
@@ -195,10 +436,9 @@ pub fn setattr(path: Option<&PathBuf>, attr: &fuse::FileAttr, delta: &AttrDelta)
     // underlying file system.  Some, like HFS+, only have 1-second resolution... so pick that in
     // the worst case.
     //
-    // This is not perfectly accurate because we don't actually know what ctime the underlying file
-    // has gotten and thus a future getattr on it will cause the ctime to change.  But as long as we
-    // avoid going back on time, we can afford to do this -- which is a requirement for supporting
-    // setting attributes on deleted files.
+    // This value is only used when the underlying file cannot be queried afterwards, such as when
+    // setting attributes on deleted files, so it is not perfectly accurate.  But as long as we
+    // avoid going back on time, we can afford to do this.
     //
     // TODO(https://github.com/bazelbuild/sandboxfs/issues/43): Revisit this when we track
     // ctimes purely on our own.
@@ -222,15 +462,61 @@ pub fn setattr(path: Option<&PathBuf>, attr: &fuse::FileAttr, delta: &AttrDelta)
         // Updating the size only makes sense on files, but handling it here is much simpler than
         // doing so on a node type basis.  Plus, who knows, if the kernel asked us to change the
         // size of anything other than a file, maybe we have to obey and try to do it.
-        .and(setattr_size(&mut new_attr, path, delta.size));
+        .and(setattr_size(&mut new_attr, path, delta.handle.as_ref(), delta.size));
     if !conv::fileattrs_eq(attr, &new_attr) {
         new_attr.ctime = updated_ctime;
     }
+    // Prefer the real ctime and block count when the underlying file is still reachable, as size
+    // changes affect the latter in ways we cannot predict (e.g. on sparse files).  The same goes
+    // for the times we just set, which the underlying file system may have rounded.
+    if let Some(Ok(fs_attr)) = path.map(|p| timeout::symlink_metadata(p)) {
+        new_attr.ctime = Timespec { sec: fs_attr.ctime(), nsec: fs_attr.ctime_nsec() as i32 };
+        new_attr.blocks = fs_attr.blocks();
+        if delta.atime.is_some() {
+            new_attr.atime = Timespec { sec: fs_attr.atime(), nsec: fs_attr.atime_nsec() as i32 };
+        }
+        if delta.mtime.is_some() {
+            new_attr.mtime = Timespec { sec: fs_attr.mtime(), nsec: fs_attr.mtime_nsec() as i32 };
+        }
+    }
     result.and(Ok(new_attr))
 }
 
 /// Abstract representation of an open file handle.
 pub trait Handle {
+    /// Closes the underlying file descriptor of an idle handle to make room for others.
+    ///
+    /// The descriptor is transparently reopened the next time the handle is used.  Returns false
+    /// if the handle could not give up its descriptor, in which case it remains untouched.
+    fn close_idle(&self) -> bool {
+        false
+    }
+
+    /// Reports any errors that the underlying file system deferred until the file is closed.
+    ///
+    /// This is called every time a file descriptor that references the handle is closed, so it
+    /// may be called more than once for the same handle and must not invalidate it.
+    fn flush(&self) -> NodeResult<()> {
+        Ok(())
+    }
+
+    /// Flushes any modifications made through the handle to the underlying storage.
+    ///
+    /// `_datasync` indicates that only the contents, and not the metadata, have to be flushed.
+    /// Handles that are not backed by an underlying file have nothing to flush.
+    fn fsync(&self, _datasync: bool) -> NodeResult<()> {
+        Ok(())
+    }
+
+    /// Returns when the handle was last used if it holds an underlying file descriptor that
+    /// `close_idle` may be able to close, or none otherwise.
+    ///
+    /// Handles that can be written to never offer their descriptors for closing because reopening
+    /// them could lose data or change what the writes apply to.
+    fn idle_since(&self) -> Option<Instant> {
+        None
+    }
+
     /// Reads `_size` bytes from the open file starting at `_offset`.
     fn read(&self, _offset: i64, _size: u32) -> NodeResult<Vec<u8>> {
         panic!("Not implemented")
@@ -254,6 +540,14 @@ pub trait Handle {
         panic!("Not implemented");
     }
 
+    /// Truncates the open file to `_size` bytes through the handle's underlying descriptor.
+    ///
+    /// Returns false if the handle does not hold a descriptor to truncate, in which case the
+    /// caller has to truncate the file by its path.
+    fn truncate(&self, _size: u64) -> nix::Result<bool> {
+        Ok(false)
+    }
+
     /// Writes the bytes held in `_data` to the open file starting at `_offset`.
     fn write(&self, _offset: i64, _data: &[u8]) -> NodeResult<u32> {
         panic!("Not implemented");
@@ -307,11 +601,101 @@ pub trait Node {
     /// `_cache` is updated to remove the path if the underlying file is deleted.
     fn delete(&self, _cache: &dyn Cache);
 
+    /// Returns the node's underlying path, if it is backed by an underlying file that still
+    /// exists.  Only used for reporting purposes.
+    fn underlying_path(&self) -> Option<PathBuf> {
+        None
+    }
+
+    /// Marks the node as read during the read tracking `generation` and returns true if it had not
+    /// been marked during that generation yet.  See `ReadsTracker`.
+    ///
+    /// This is called on every read so it must not lock the node.  Only nodes backed by underlying
+    /// files are tracked, so the default is to never report a first read.
+    fn mark_read(&self, _generation: usize) -> bool {
+        false
+    }
+
     /// Updates the node's underlying path to the given one.  Needed for renames.
     ///
     /// `_cache` is updated to reflect the rename of the underlying path.
     fn set_underlying_path(&self, _path: &Path, _cache: &dyn Cache);
 
+    /// Ensures that the handles open on this node keep working once the underlying file loses its
+    /// current name, which must be called right before it is removed or replaced by a rename.
+    fn keep_handles_open(&self) {}
+
+    /// Returns the node for the target of this lazy mapping, inspecting the target to create it,
+    /// or none if this node is not a lazy mapping.
+    ///
+    /// The caller must replace this node with the returned one so that the target is only
+    /// inspected once.  `_ids` and `_cache` are the file system-wide bookkeeping objects needed to
+    /// instantiate new nodes.
+    fn resolve(&self, _ids: &IdGenerator, _cache: &dyn Cache) -> Option<NodeResult<ArcNode>> {
+        None
+    }
+
+    /// Records `_path` as another name of the underlying file backing this node, which happens
+    /// when all hard links to the same file within a mapping share a single node.
+    ///
+    /// Returns false if the node cannot take the new name because it has already been deleted.
+    fn add_link(&self, _path: &Path) -> bool {
+        panic!("Not implemented")
+    }
+
+    /// Returns the identifier of the mapping of an underlying directory that this directory
+    /// belongs to, or `None` if the directory is not backed by one.
+    ///
+    /// Entries cannot be moved between directories of different mappings, even if their targets
+    /// live on the same underlying file system.
+    fn mapping_id(&self) -> Option<usize> {
+        None
+    }
+
+    /// Returns the ownership squashing settings of the mapping this directory belongs to, if any.
+    fn squash(&self) -> Option<Squash> {
+        None
+    }
+
+    /// Returns the ownership squashing settings that apply to the entry `_name` of this directory,
+    /// which may differ from the directory's own if the entry is an explicit mapping.
+    fn squash_for(&self, _name: &OsStr) -> Option<Squash> {
+        None
+    }
+
+    /// Returns whether the mapping this directory belongs to forbids executing its files.
+    fn noexec(&self) -> bool {
+        false
+    }
+
+    /// Returns whether executing the entry `_name` of this directory is forbidden, which may
+    /// differ from the directory's own setting if the entry is an explicit mapping.
+    fn noexec_for(&self, _name: &OsStr) -> bool {
+        false
+    }
+
+    /// Returns the mask to apply to the permissions of the files in the mapping this directory
+    /// belongs to, if any.
+    fn perm_mask(&self) -> Option<u32> {
+        None
+    }
+
+    /// Returns the mask to apply to the permissions of the entry `_name` of this directory, which
+    /// may differ from the directory's own if the entry is an explicit mapping.
+    fn perm_mask_for(&self, _name: &OsStr) -> Option<u32> {
+        None
+    }
+
+    /// Drops the entry `_name` from this directory if it still refers to the node `_inode` and if
+    /// the entry can be reloaded from the underlying file system on a later lookup.
+    ///
+    /// This is called once the kernel has forgotten about `_inode` to release the memory used by
+    /// the node and by any nodes below it.  `_cache` is updated to also drop the entry.  Returns
+    /// true if the entry was dropped.
+    fn forget_child(&self, _name: &OsStr, _inode: u64, _cache: &dyn Cache) -> bool {
+        false
+    }
+
     /// Returns the subdirectory `_name` and creates it as a scaffold directory if missing.
     ///
     /// `_ids` and `_cache` are the file system-wide bookkeeping objects needed to instantiate new
@@ -325,13 +709,17 @@ pub trait Node {
     /// Returns the newly-created node.
     ///
     /// `_components` is the path to map, broken down into components, and relative to the current
-    /// node.  `_underlying_path` is the target to use for the created node.  `_writable` indicates
-    /// the final node's writability, but intermediate nodes are creates as not writable.
+    /// node.  `_target` describes the contents of the created node, but intermediate nodes are
+    /// created as not writable.
+    ///
+    /// `_allowed_targets`, if set, holds the canonical directories that a target which is only
+    /// inspected later on, such as a lazy or missing optional one, must resolve to once it is.
     ///
     /// `_ids` and `_cache` are the file system-wide bookkeeping objects needed to instantiate new
     /// nodes, used when this algorithm instantiates any new node.
-    fn map(&self, _components: &[Component], _underlying_path: &Path, _writable: bool,
-        _ids: &IdGenerator, _cache: &dyn Cache) -> Fallible<ArcNode> {
+    fn map(&self, _components: &[Component], _target: &MappingTarget,
+        _allowed_targets: Option<&[PathBuf]>, _ids: &IdGenerator, _cache: &dyn Cache)
+        -> Fallible<ArcNode> {
         panic!("Not implemented")
     }
 
@@ -352,6 +740,61 @@ pub trait Node {
         panic!("Not implemented")
     }
 
+    /// Unmaps the explicit mapping at `_components`, which is relative to this node (and assumes
+    /// that this is called on a directory).
+    ///
+    /// Scaffold directories along the path that become empty as a result of the unmap are removed
+    /// as well, except for those that live directly under the root directory: these represent
+    /// sandboxes and can only be removed by destroying them.
+    ///
+    /// `_inodes` is extended on a successful unmap to contain the inode numbers that were unmapped.
+    /// The caller must then clear these inodes from whichever data structures it has.
+    fn unmap_path(&self, _components: &[Component], _inodes: &mut Vec<u64>) -> Fallible<()> {
+        panic!("Not implemented")
+    }
+
+    /// Appends a description of this node, located at `_path` within the file system, to
+    /// `_mappings` along with the descriptions of all explicit mappings under it.
+    ///
+    /// Directories hold their lock while they walk their children so that the result reflects a
+    /// consistent view of the subtree.
+    fn list_mappings(&self, _path: &Path, _mappings: &mut Vec<MappingInfo>);
+
+    /// Returns true if this node is an in-memory directory that has no entries.
+    fn is_empty_scaffold(&self) -> bool {
+        false
+    }
+
+    /// Returns true if this node is an in-memory directory created to hold mappings.
+    fn is_scaffold(&self) -> bool {
+        false
+    }
+
+    /// Returns the storage that holds the contents of this node.
+    ///
+    /// The backing of a node is immutable and, as such, this information can be queried without
+    /// having to lock the node.
+    fn backing(&self) -> Backing {
+        Backing::Underlying
+    }
+
+    /// Moves this node within a copy-on-write mapping to the scratch directory if it is not there
+    /// yet, which is necessary before the node can be renamed.
+    ///
+    /// Directories that have contents on the read-only side of the mapping cannot be moved and
+    /// fail with `EXDEV` so that the caller falls back to copying the directory tree.
+    fn copy_up(&self) -> NodeResult<()> {
+        Ok(())
+    }
+
+    /// Returns true if this node is a directory without any visible entries.
+    ///
+    /// Only needed for directories within copy-on-write mappings, where the removal of the
+    /// directory by itself cannot tell if there are visible entries left on the read-only side.
+    fn is_empty_dir(&self) -> NodeResult<bool> {
+        panic!("Not implemented")
+    }
+
     /// Creates a new file with `_name` and `_mode` and opens it with `_flags`.
     ///
     /// The attributes are returned to avoid having to relock the node on the caller side in order
@@ -16,7 +16,9 @@ extern crate fuse;
 
 use failure::Fallible;
 use nix::errno;
-use nodes::{ArcNode, AttrDelta, Cache, KernelError, Node, NodeResult, conv, setattr};
+use nodes::{
+    ArcNode, AttrDelta, Backing, Cache, KernelError, MappingInfo, Node, NodeResult, confine, conv,
+    cow, setattr, timeout};
 use std::ffi::OsStr;
 use std::fs;
 use std::path::{Path, PathBuf};
@@ -26,6 +28,7 @@ use std::sync::{Arc, Mutex};
 pub struct Symlink {
     inode: u64,
     writable: bool,
+    cow: bool,
     state: Mutex<MutableSymlink>,
 }
 
@@ -33,6 +36,11 @@ pub struct Symlink {
 struct MutableSymlink {
     underlying_path: Option<PathBuf>,
     attr: fuse::FileAttr,
+
+    /// Path in the scratch directory of a copy-on-write mapping where this symlink has to be
+    /// copied to before it is first modified.  None if the symlink is not in such a mapping or if
+    /// it has already been copied.
+    pending_copy: Option<PathBuf>,
 }
 
 impl Symlink {
@@ -55,15 +63,57 @@ impl Symlink {
         let state = MutableSymlink {
             underlying_path: Some(PathBuf::from(underlying_path)),
             attr: attr,
+            pending_copy: None,
         };
 
-        Arc::new(Symlink { inode, writable, state: Mutex::from(state) })
+        Arc::new(Symlink { inode, writable, cow: false, state: Mutex::from(state) })
+    }
+
+    /// Creates a new symlink within a copy-on-write mapping.
+    ///
+    /// `underlying_path` and `fs_attr` are as described in `new_mapped`.  `upper_path` is the
+    /// location of this symlink in the scratch directory of the mapping, which matches
+    /// `underlying_path` if the symlink was already copied there.  `writable` is false only for
+    /// overlay mappings whose topmost layer is read-only.
+    pub fn new_cow(inode: u64, underlying_path: &Path, fs_attr: &fs::Metadata, upper_path: &Path,
+        writable: bool) -> ArcNode {
+        if !fs_attr.file_type().is_symlink() {
+            panic!("Can only construct based on symlinks");
+        }
+        let attr = conv::attr_fs_to_fuse(underlying_path, inode, 1, &fs_attr);
+
+        let pending_copy = if underlying_path == upper_path {
+            None
+        } else {
+            Some(PathBuf::from(upper_path))
+        };
+        let state = MutableSymlink {
+            underlying_path: Some(PathBuf::from(underlying_path)),
+            attr: attr,
+            pending_copy: pending_copy,
+        };
+
+        Arc::new(Symlink { inode, writable, cow: true, state: Mutex::from(state) })
+    }
+
+    /// Copies the symlink to the scratch directory of its copy-on-write mapping if it has not been
+    /// copied yet, with the node already locked.
+    fn copy_up_locked(state: &mut MutableSymlink) -> NodeResult<()> {
+        if let Some(upper_path) = &state.pending_copy {
+            let path = state.underlying_path.as_ref().expect(
+                "Deleted symlinks must not have pending copies");
+            cow::copy_up_symlink(path, upper_path)?;
+        }
+        if let Some(upper_path) = state.pending_copy.take() {
+            state.underlying_path = Some(upper_path);
+        }
+        Ok(())
     }
 
     /// Same as `getattr` but with the node already locked.
     fn getattr_locked(inode: u64, state: &mut MutableSymlink) -> NodeResult<fuse::FileAttr> {
         if let Some(path) = &state.underlying_path {
-            let fs_attr = fs::symlink_metadata(path)?;
+            let fs_attr = timeout::symlink_metadata(path)?;
             if !fs_attr.file_type().is_symlink() {
                 warn!("Path {} backing a symlink node is no longer a symlink; got {:?}",
                     path.display(), fs_attr.file_type());
@@ -98,6 +148,10 @@ impl Node for Symlink {
         state.underlying_path = None;
     }
 
+    fn underlying_path(&self) -> Option<PathBuf> {
+        self.state.lock().unwrap().underlying_path.clone()
+    }
+
     fn set_underlying_path(&self, path: &Path, cache: &dyn Cache) {
         let mut state = self.state.lock().unwrap();
         debug_assert!(state.underlying_path.is_some(),
@@ -114,6 +168,27 @@ impl Node for Symlink {
         Ok(())
     }
 
+    fn list_mappings(&self, path: &Path, mappings: &mut Vec<MappingInfo>) {
+        let state = self.state.lock().unwrap();
+        mappings.push(MappingInfo {
+            path: path.to_owned(),
+            underlying_path: state.underlying_path.clone(),
+            writable: self.writable,
+            noexec: false,
+            perm_mask: None,
+            unresolved: false,
+        });
+    }
+
+    fn backing(&self) -> Backing {
+        if self.cow { Backing::CopyOnWrite } else { Backing::Underlying }
+    }
+
+    fn copy_up(&self) -> NodeResult<()> {
+        let mut state = self.state.lock().unwrap();
+        Symlink::copy_up_locked(&mut state)
+    }
+
     fn getattr(&self) -> NodeResult<fuse::FileAttr> {
         let mut state = self.state.lock().unwrap();
         Symlink::getattr_locked(self.inode, &mut state)
@@ -124,7 +199,7 @@ impl Node for Symlink {
         assert!(
             state.underlying_path.is_some(),
             "There is no known API to access the extended attributes of a symlink via an fd");
-        let value = xattr::get(state.underlying_path.as_ref().unwrap(), name)?;
+        let value = confine::get_xattr(state.underlying_path.as_ref().unwrap(), name)?;
         Ok(value)
     }
 
@@ -133,7 +208,7 @@ impl Node for Symlink {
         assert!(
             state.underlying_path.is_some(),
             "There is no known API to access the extended attributes of a symlink via an fd");
-        let xattrs = xattr::list(state.underlying_path.as_ref().unwrap())?;
+        let xattrs = confine::list_xattrs(state.underlying_path.as_ref().unwrap())?;
         Ok(Some(xattrs))
     }
 
@@ -142,30 +217,33 @@ impl Node for Symlink {
 
         let path = state.underlying_path.as_ref().expect(
             "There is no known API to get the target of a deleted symlink");
-        Ok(fs::read_link(path)?)
+        Ok(confine::read_link(path)?)
     }
 
     fn removexattr(&self, name: &OsStr) -> NodeResult<()> {
-        let state = self.state.lock().unwrap();
+        let mut state = self.state.lock().unwrap();
+        Symlink::copy_up_locked(&mut state)?;
         assert!(
             state.underlying_path.is_some(),
             "There is no known API to access the extended attributes of a symlink via an fd");
-        xattr::remove(state.underlying_path.as_ref().unwrap(), name)?;
+        confine::remove_xattr(state.underlying_path.as_ref().unwrap(), name)?;
         Ok(())
     }
 
     fn setattr(&self, delta: &AttrDelta) -> NodeResult<fuse::FileAttr> {
         let mut state = self.state.lock().unwrap();
+        Symlink::copy_up_locked(&mut state)?;
         state.attr = setattr(state.underlying_path.as_ref(), &state.attr, delta)?;
         Ok(state.attr)
     }
 
     fn setxattr(&self, name: &OsStr, value: &[u8]) -> NodeResult<()> {
-        let state = self.state.lock().unwrap();
+        let mut state = self.state.lock().unwrap();
+        Symlink::copy_up_locked(&mut state)?;
         assert!(
             state.underlying_path.is_some(),
             "There is no known API to access the extended attributes of a symlink via an fd");
-        xattr::set(state.underlying_path.as_ref().unwrap(), name, value)?;
+        confine::set_xattr(state.underlying_path.as_ref().unwrap(), name, value)?;
         Ok(())
     }
 }
@@ -0,0 +1,218 @@
+// Copyright 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License.  You may obtain a copy
+// of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.  See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+use errors::IoTimeout;
+use nix::fcntl::OFlag;
+use nix::sys::stat::Mode;
+use nodes::confine;
+use nodes::fds::TrackedFile;
+use std::cmp;
+use std::fs;
+use std::io;
+use std::os::unix::fs::FileExt;
+use std::path::Path;
+use std::sync::Arc;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::mpsc;
+use std::thread;
+use std::time::Duration;
+
+/// Maximum time, in milliseconds, that a single operation on an underlying file may take.  Zero
+/// means that operations are never abandoned.
+///
+/// FUSE requests are served one at a time, so a single operation that blocks forever on an
+/// unresponsive underlying file system (e.g. a hung NFS server) would otherwise freeze the whole
+/// mount point.
+static IO_TIMEOUT_MS: AtomicUsize = AtomicUsize::new(0);
+
+/// Sets the maximum time that a single operation on an underlying file may take, or removes the
+/// limit if `timeout` is none.
+pub fn set_io_timeout(timeout: Option<Duration>) {
+    let ms = match timeout {
+        Some(timeout) => cmp::max(
+            1, timeout.as_secs() as usize * 1000 + timeout.subsec_millis() as usize),
+        None => 0,
+    };
+    IO_TIMEOUT_MS.store(ms, Ordering::SeqCst);
+}
+
+/// Returns the maximum time that a single operation on an underlying file may take, if any.
+fn io_timeout() -> Option<Duration> {
+    match IO_TIMEOUT_MS.load(Ordering::Relaxed) {
+        0 => None,
+        ms => Some(Duration::from_millis(ms as u64)),
+    }
+}
+
+/// Runs `op`, which operates on the underlying file `path`, and gives up on it if it does not
+/// complete within the configured timeout.
+fn run<T, F>(path: &Path, op: F) -> io::Result<T>
+    where T: Send + 'static, F: FnOnce() -> io::Result<T> + Send + 'static {
+    run_with_timeout(path, io_timeout(), op)
+}
+
+/// Runs `op`, which operates on the underlying file `path`, and gives up on it if it does not
+/// complete within `timeout`.
+///
+/// When we give up, `op` keeps running in a separate thread until the underlying file system
+/// returns, at which point its result is dropped.  `op` must thus own everything it touches and
+/// anything it acquires must be released when dropped, as is the case for file descriptors held
+/// by `fs::File`.
+fn run_with_timeout<T, F>(path: &Path, timeout: Option<Duration>, op: F) -> io::Result<T>
+    where T: Send + 'static, F: FnOnce() -> io::Result<T> + Send + 'static {
+    let timeout = match timeout {
+        Some(timeout) => timeout,
+        None => return op(),
+    };
+
+    let (sender, receiver) = mpsc::channel();
+    thread::spawn(move || {
+        // Sending fails if we already gave up waiting, which is fine: the result is dropped.
+        let _ = sender.send(op());
+    });
+    match receiver.recv_timeout(timeout) {
+        Ok(result) => result,
+        Err(mpsc::RecvTimeoutError::Timeout) => {
+            warn!("Operation on {} did not complete within {:?}; returning EIO",
+                path.display(), timeout);
+            Err(io::Error::new(io::ErrorKind::TimedOut, IoTimeout { path: path.to_owned() }))
+        },
+        Err(mpsc::RecvTimeoutError::Disconnected) => {
+            panic!("Operation on {} panicked", path.display())
+        },
+    }
+}
+
+/// Same as `confine::symlink_metadata` but bounded by the configured timeout.
+pub fn symlink_metadata(path: &Path) -> io::Result<fs::Metadata> {
+    let owned_path = path.to_owned();
+    run(path, move || confine::symlink_metadata(&owned_path))
+}
+
+/// Same as `fs::DirEntry::metadata` for the `entry` of the directory `path`, bounded by the
+/// configured timeout.
+///
+/// Where supported, this stats the entry relative to the open directory instead of walking its
+/// whole path again.
+pub fn dir_entry_metadata(path: &Path, entry: fs::DirEntry) -> io::Result<fs::Metadata> {
+    run(path, move || entry.metadata())
+}
+
+/// Same as `confine::open` but bounded by the configured timeout.
+pub fn open(path: &Path, options: &fs::OpenOptions, oflag: OFlag, mode: Mode)
+    -> io::Result<fs::File> {
+    let options = options.clone();
+    let owned_path = path.to_owned();
+    run(path, move || confine::open(&owned_path, &options, oflag, mode))
+}
+
+/// Same as `fs::read_dir` but bounded by the configured timeout.
+pub fn read_dir(path: &Path) -> io::Result<fs::ReadDir> {
+    let owned_path = path.to_owned();
+    run(path, move || fs::read_dir(owned_path))
+}
+
+/// Reads the next entry of the directory `path` from `entries` bounded by the configured timeout.
+///
+/// Returns none once all entries have been read.  If the read times out, `entries` is left
+/// unset because the stalled read still owns the directory stream.
+pub fn next_dir_entry(path: &Path, entries: &mut Option<fs::ReadDir>)
+    -> Option<io::Result<fs::DirEntry>> {
+    if io_timeout().is_none() {
+        return entries.as_mut().and_then(Iterator::next);
+    }
+
+    let mut owned_entries = entries.take()?;
+    let result = run(path, move || {
+        let entry = owned_entries.next();
+        Ok((owned_entries, entry))
+    });
+    match result {
+        Ok((owned_entries, entry)) => {
+            *entries = Some(owned_entries);
+            entry
+        },
+        Err(e) => Some(Err(e)),
+    }
+}
+
+/// Reads up to `size` bytes at `offset` from the open underlying `file`, which lives at `path`,
+/// bounded by the configured timeout.
+pub fn read_at(file: &Arc<TrackedFile>, path: &Path, offset: u64, size: usize)
+    -> io::Result<Vec<u8>> {
+    let file = file.clone();
+    run(path, move || {
+        let mut buffer = vec![0; size];
+        let n = file.read_at(&mut buffer, offset)?;
+        buffer.truncate(n);
+        Ok(buffer)
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::os::unix;
+    use tempfile::tempdir;
+
+    #[test]
+    fn test_run_with_timeout_unbounded() {
+        assert_eq!(5, run_with_timeout(Path::new("/foo"), None, || Ok(5)).unwrap());
+    }
+
+    #[test]
+    fn test_run_with_timeout_completes_in_time() {
+        let timeout = Some(Duration::from_secs(60));
+        assert_eq!(5, run_with_timeout(Path::new("/foo"), timeout, || Ok(5)).unwrap());
+        let err = run_with_timeout::<(), _>(
+            Path::new("/foo"), timeout, || Err(io::Error::from_raw_os_error(2))).unwrap_err();
+        assert_eq!(Some(2), err.raw_os_error());
+    }
+
+    #[test]
+    fn test_run_with_timeout_gives_up() {
+        let (sender, receiver) = mpsc::channel::<()>();
+        let timeout = Some(Duration::from_millis(10));
+        let err = run_with_timeout(Path::new("/stuck"), timeout, move || {
+            receiver.recv().unwrap();
+            Ok(())
+        }).unwrap_err();
+        sender.send(()).unwrap();  // Let the abandoned operation finish.
+
+        assert_eq!(io::ErrorKind::TimedOut, err.kind());
+        let timeout = err.get_ref().unwrap().downcast_ref::<IoTimeout>().unwrap();
+        assert_eq!(Path::new("/stuck"), timeout.path);
+    }
+
+    #[test]
+    fn test_dir_entry_metadata_does_not_follow_symlinks() {
+        let dir = tempdir().unwrap();
+        unix::fs::symlink("missing", dir.path().join("link")).unwrap();
+
+        let entry = fs::read_dir(dir.path()).unwrap().next().unwrap().unwrap();
+        let fs_attr = dir_entry_metadata(dir.path(), entry).unwrap();
+        assert!(fs_attr.file_type().is_symlink());
+    }
+
+    #[test]
+    fn test_set_io_timeout() {
+        // Other tests run concurrently and operate on underlying files, so restore the default
+        // right away and only use a timeout long enough not to affect them.
+        set_io_timeout(Some(Duration::from_millis(3_600_500)));
+        let timeout = io_timeout();
+        set_io_timeout(None);
+        assert_eq!(Some(Duration::from_millis(3_600_500)), timeout);
+        assert_eq!(None, io_timeout());
+    }
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License.  You may obtain a copy
+// of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.  See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+use failure::{Fail, Fallible, ResultExt};
+use libc;
+use nix::unistd::{self, Gid, Uid};
+use std::ffi::CString;
+use std::fmt;
+use std::io;
+use std::mem;
+use std::ptr;
+use std::sync::atomic::{AtomicBool, Ordering};
+
+/// Whether the process has switched to the credentials of an unprivileged user.
+static DROPPED: AtomicBool = AtomicBool::new(false);
+
+/// Returns whether the process has dropped its privileges via `drop_privileges`.
+pub fn dropped() -> bool {
+    DROPPED.load(Ordering::SeqCst)
+}
+
+/// A user to switch the credentials of the process to.
+#[derive(Debug)]
+pub struct User {
+    /// Login name of the user.
+    name: CString,
+
+    /// Numeric identifier of the user.
+    uid: Uid,
+
+    /// Numeric identifier of the primary group of the user.
+    gid: Gid,
+}
+
+impl User {
+    /// Looks up the user called `name` in the user database.
+    #[allow(unsafe_code)]
+    pub fn lookup(name: &str) -> Fallible<User> {
+        let c_name = CString::new(name)
+            .map_err(|_| format_err!("Invalid user name {:?}", name))?;
+
+        let mut buffer = vec![0 as libc::c_char; 16 * 1024];
+        loop {
+            let mut entry: libc::passwd = unsafe { mem::zeroed() };
+            let mut result = ptr::null_mut();
+            let errno = unsafe {
+                libc::getpwnam_r(c_name.as_ptr(), &mut entry, buffer.as_mut_ptr(), buffer.len(),
+                    &mut result)
+            };
+            if errno == libc::ERANGE {
+                let size = buffer.len() * 2;
+                buffer.resize(size, 0);
+                continue;
+            } else if errno != 0 {
+                let e = io::Error::from_raw_os_error(errno);
+                return Err(e.context(format!("Failed to look up user {}", name)).into());
+            } else if result.is_null() {
+                return Err(format_err!("Unknown user {}", name));
+            }
+            return Ok(User {
+                name: c_name,
+                uid: Uid::from_raw(entry.pw_uid),
+                gid: Gid::from_raw(entry.pw_gid),
+            });
+        }
+    }
+}
+
+impl fmt::Display for User {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        write!(f, "{} (uid {}, gid {})", self.name.to_string_lossy(), self.uid.as_raw(),
+            self.gid.as_raw())
+    }
+}
+
+/// Switches the credentials of the whole process to those of `user`, including its supplementary
+/// groups, and ensures that the previous ones cannot be regained.
+///
+/// The C library applies these changes to all threads of the process, not only to the calling
+/// one, so this can be called once other threads have been started.
+#[allow(unsafe_code)]
+pub fn drop_privileges(user: &User) -> Fallible<()> {
+    // The groups must be changed first because doing so requires the privileges that changing
+    // the user gives up.
+    if unsafe { libc::initgroups(user.name.as_ptr(), user.gid.as_raw() as _) } == -1 {
+        let e = io::Error::last_os_error();
+        return Err(e.context(format!("setgroups to the groups of {} failed",
+            user.name.to_string_lossy())).into());
+    }
+    unistd::setgid(user.gid).with_context(|_| format!("setgid to {} failed", user.gid.as_raw()))?;
+    unistd::setuid(user.uid).with_context(|_| format!("setuid to {} failed", user.uid.as_raw()))?;
+    DROPPED.store(true, Ordering::SeqCst);
+
+    ensure!(user.uid.is_root() || unistd::setuid(Uid::from_raw(0)).is_err(),
+        "Privileges could be regained after switching to user {}", user.uid.as_raw());
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_user_lookup_ok() {
+        let user = User::lookup("root").unwrap();
+        assert!(user.uid.is_root());
+        assert_eq!(Gid::from_raw(0), user.gid);
+    }
+
+    #[test]
+    fn test_user_lookup_unknown() {
+        let err = User::lookup("this-user-does-not-exist").unwrap_err();
+        assert_eq!("Unknown user this-user-does-not-exist", format!("{}", err));
+    }
+}
@@ -0,0 +1,201 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License.  You may obtain a copy
+// of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.  See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+use serde_derive::{Deserialize, Serialize};
+use std::collections::HashSet;
+use std::fs;
+use std::io::{self, Write};
+use std::mem;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex};
+use std::sync::atomic::{AtomicUsize, Ordering};
+
+/// Maximum number of distinct paths to remember before flagging the set of read files as
+/// incomplete, which bounds the memory used by tracking.
+const MAX_PATHS: usize = 1 << 20;
+
+/// External representation of the set of files that were read, as returned to the user.
+#[derive(Debug, Default, Deserialize, Eq, PartialEq, Serialize)]
+pub struct ReadSet {
+    /// Paths within the file system of the files that were read, sorted.
+    pub paths: Vec<PathBuf>,
+
+    /// Whether more files than we were willing to remember were read, in which case `paths` is
+    /// incomplete.
+    pub overflowed: bool,
+}
+
+/// Paths recorded since tracking started or since they were last taken.
+#[derive(Default)]
+struct Reads {
+    /// Paths within the file system of the files that were read.
+    paths: HashSet<PathBuf>,
+
+    /// Whether some paths were not recorded because there were too many.
+    overflowed: bool,
+}
+
+/// Tracker of the files that are read through the file system.
+///
+/// Recording a read is cheap once a file has been recorded: nodes remember the generation of the
+/// tracker in which they were last read (see `Node::mark_read`), so only their first read within
+/// a generation reaches this tracker.  Taking the recorded reads starts a new generation.
+pub struct ReadsTracker {
+    /// Current generation, which starts at 1 so that nodes that were never read are recorded.
+    generation: AtomicUsize,
+
+    /// Reads recorded within the current generation.
+    reads: Mutex<Reads>,
+
+    /// Maximum number of paths to record, normally `MAX_PATHS`.
+    max_paths: usize,
+}
+
+impl Default for ReadsTracker {
+    fn default() -> Self {
+        ReadsTracker::with_max_paths(MAX_PATHS)
+    }
+}
+
+impl ReadsTracker {
+    /// Creates a new tracker that remembers up to `max_paths` paths.
+    fn with_max_paths(max_paths: usize) -> Self {
+        ReadsTracker {
+            generation: AtomicUsize::new(1),
+            reads: Mutex::from(Reads::default()),
+            max_paths,
+        }
+    }
+
+    /// Returns the current generation, to be passed to `Node::mark_read`.
+    pub fn generation(&self) -> usize {
+        self.generation.load(Ordering::Relaxed)
+    }
+
+    /// Records a read of the file at `path` within the file system.
+    pub fn record(&self, path: PathBuf) {
+        let mut reads = self.reads.lock().unwrap();
+        if reads.paths.len() < self.max_paths {
+            reads.paths.insert(path);
+        } else if !reads.paths.contains(&path) {
+            reads.overflowed = true;
+        }
+    }
+
+    /// Returns the reads recorded so far and forgets about them, so that subsequent reads of the
+    /// same files are recorded again.
+    pub fn take(&self) -> ReadSet {
+        let reads = {
+            let mut reads = self.reads.lock().unwrap();
+            self.generation.fetch_add(1, Ordering::Relaxed);
+            mem::replace(&mut *reads, Reads::default())
+        };
+        let mut paths = reads.paths.into_iter().collect::<Vec<PathBuf>>();
+        paths.sort();
+        ReadSet { paths, overflowed: reads.overflowed }
+    }
+}
+
+/// Scope guard that writes the reads recorded by a tracker to a file when dropped.
+///
+/// The file is created upfront so that problems with it are reported before mounting, and it is
+/// written on drop so that the reads are saved however the file system is unmounted.
+pub struct WriteOnDrop {
+    /// Tracker from which to take the reads.
+    tracker: Arc<ReadsTracker>,
+
+    /// File to write the reads to.
+    file: fs::File,
+}
+
+impl WriteOnDrop {
+    /// Creates the file at `path`, to which the reads in `tracker` will be written on drop.
+    pub fn create(tracker: Arc<ReadsTracker>, path: &Path) -> io::Result<WriteOnDrop> {
+        let file = fs::File::create(path)?;
+        Ok(WriteOnDrop { tracker, file })
+    }
+}
+
+impl Drop for WriteOnDrop {
+    fn drop(&mut self) {
+        let mut contents = serde_json::to_string(&self.tracker.take())
+            .expect("Serializing paths cannot fail");
+        contents.push('\n');
+        if let Err(e) = self.file.write_all(contents.as_bytes()) {
+            warn!("Failed to write the set of read files: {}", e);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::tempdir;
+
+    #[test]
+    fn test_reads_tracker_deduplicates_and_sorts() {
+        let tracker = ReadsTracker::default();
+        tracker.record(PathBuf::from("/b"));
+        tracker.record(PathBuf::from("/a"));
+        tracker.record(PathBuf::from("/b"));
+        assert_eq!(
+            ReadSet { paths: vec!(PathBuf::from("/a"), PathBuf::from("/b")), overflowed: false },
+            tracker.take());
+    }
+
+    #[test]
+    fn test_reads_tracker_take_resets() {
+        let tracker = ReadsTracker::default();
+        let generation = tracker.generation();
+        tracker.record(PathBuf::from("/a"));
+        assert_eq!(1, tracker.take().paths.len());
+        assert_ne!(generation, tracker.generation());
+        assert_eq!(ReadSet::default(), tracker.take());
+    }
+
+    #[test]
+    fn test_reads_tracker_overflow() {
+        let tracker = ReadsTracker::with_max_paths(2);
+        tracker.record(PathBuf::from("/a"));
+        tracker.record(PathBuf::from("/b"));
+        tracker.record(PathBuf::from("/a"));
+        assert!(!tracker.reads.lock().unwrap().overflowed);
+        tracker.record(PathBuf::from("/c"));
+        assert_eq!(
+            ReadSet { paths: vec!(PathBuf::from("/a"), PathBuf::from("/b")), overflowed: true },
+            tracker.take());
+
+        tracker.record(PathBuf::from("/c"));
+        assert_eq!(
+            ReadSet { paths: vec!(PathBuf::from("/c")), overflowed: false },
+            tracker.take());
+    }
+
+    #[test]
+    fn test_write_on_drop() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("reads");
+        let tracker = Arc::from(ReadsTracker::default());
+        {
+            let _guard = WriteOnDrop::create(tracker.clone(), &path).unwrap();
+            assert_eq!("", fs::read_to_string(&path).unwrap());
+            tracker.record(PathBuf::from("/file"));
+        }
+        assert_eq!("{\"paths\":[\"/file\"],\"overflowed\":false}\n",
+            fs::read_to_string(&path).unwrap());
+
+        let error = WriteOnDrop::create(tracker, Path::new("/non-existent/reads"));
+        assert!(error.is_err());
+    }
+}
@@ -12,18 +12,22 @@
 // License for the specific language governing permissions and limitations
 // under the License.
 
-use {Mapping, MappingError};
+use {make_absolute, Mapping, MappingError, MappingOptions, Squash, TargetType};
 use errors::flatten_causes;
 use failure::{Fallible, ResultExt};
+use nix::sys::stat;
 use nix::unistd;
+use nodes::MappingInfo;
+use reads::ReadSet;
 use serde_derive::{Deserialize, Serialize};
 use std::collections::HashMap;
 use std::collections::hash_map::Entry;
 use std::fs;
-use std::io::{self, Read, Write};
+use std::io::{self, BufRead, Read, Write};
 use std::os::unix::io::{AsRawFd, FromRawFd};
+use std::os::unix::net::UnixListener;
 use std::path::{self, Path, PathBuf};
-use std::sync::{Arc, Mutex};
+use std::sync::{Arc, Mutex, RwLock};
 use threadpool::ThreadPool;
 
 /// A shareable view into a reconfigurable file system.
@@ -36,6 +40,28 @@ pub trait ReconfigurableFS {
 
     /// Destroys the top-level directory named `id`.
     fn destroy_sandbox(&self, id: &str) -> Fallible<()>;
+
+    /// Unmaps all given `paths` from the top-level directory named `id`, leaving all other
+    /// mappings within it untouched.
+    ///
+    /// The paths are specified as absolute, but they are all joined with the name in `id`.
+    /// Processing stops at the first path that cannot be unmapped.
+    fn unmap_paths(&self, id: &str, paths: &[PathBuf]) -> Fallible<()>;
+
+    /// Returns all explicit mappings currently in the file system, including the scaffold
+    /// directories that hold them.
+    fn list_mappings(&self) -> Vec<MappingInfo>;
+
+    /// Returns the files read since read tracking started or since the last call, and forgets
+    /// about them.  Fails if read tracking is not enabled.
+    fn take_reads(&self) -> Fallible<ReadSet>;
+
+    /// Returns the lock that serializes the reconfigurations received through different channels.
+    ///
+    /// Requests read from reconfiguration streams hold it shared, so they can still be processed
+    /// in parallel, and documents received over HTTP hold it exclusively while they are applied,
+    /// as do reloads of the mappings.
+    fn reconfig_lock(&self) -> &RwLock<()>;
 }
 
 /// External representation of a mapping in the JSON reconfiguration data.
@@ -55,6 +81,65 @@ struct JsonMapping {
 
     #[serde(alias = "w", default)]
     writable: bool,
+
+    #[serde(alias = "e", default)]
+    excludes: Vec<String>,
+
+    #[serde(alias = "s", default)]
+    squash: Option<JsonSquash>,
+
+    #[serde(alias = "n", default)]
+    noexec: bool,
+
+    #[serde(alias = "k", default)]
+    perm: Option<u32>,
+
+    #[serde(alias = "l", default)]
+    lazy: bool,
+
+    #[serde(alias = "o", default)]
+    optional: bool,
+
+    #[serde(rename = "type", alias = "t", default)]
+    target_type: Option<String>,
+}
+
+impl JsonMapping {
+    /// Converts the optional settings of this mapping to their internal representation.
+    fn into_options(self) -> Fallible<MappingOptions> {
+        let target_type = match self.target_type {
+            Some(target_type) => Some(target_type.parse::<TargetType>()?),
+            None => None,
+        };
+        Ok(MappingOptions {
+            excludes: self.excludes,
+            squash: self.squash.map(Squash::from),
+            noexec: self.noexec,
+            perm_mask: self.perm,
+            lazy: self.lazy,
+            optional: self.optional,
+            target_type: target_type,
+        })
+    }
+}
+
+/// External representation of the ownership squashing settings of a mapping.
+#[derive(Clone, Debug, Deserialize, Eq, PartialEq, Serialize)]
+struct JsonSquash {
+    #[serde(default)]
+    uid: Option<u32>,
+
+    #[serde(default)]
+    gid: Option<u32>,
+
+    #[serde(default)]
+    strict: bool,
+}
+
+impl From<JsonSquash> for Squash {
+    fn from(squash: JsonSquash) -> Self {
+        Squash { uid: squash.uid, gid: squash.gid, strict: squash.strict }
+    }
 }
 
 /// External representation of a reconfiguration map request.
@@ -71,6 +156,16 @@ struct CreateSandboxRequest {
     prefixes: HashMap<String, PathBuf>,
 }
 
+/// External representation of a reconfiguration unmap request.
+#[derive(Debug, Deserialize, Eq, PartialEq, Serialize)]
+struct UnmapPathsRequest {
+    #[serde(alias = "i")]
+    id: String,
+
+    #[serde(alias = "p", default)]
+    paths: Vec<PathBuf>,
+}
+
 /// External representation of a reconfiguration request.
 #[derive(Debug, Deserialize, Eq, PartialEq, Serialize)]
 enum Request {
@@ -79,17 +174,115 @@ enum Request {
 
     #[serde(alias = "D")]
     DestroySandbox(String),
+
+    #[serde(alias = "U")]
+    UnmapPaths(UnmapPathsRequest),
+
+    #[serde(alias = "L")]
+    ListMappings(String),
+
+    #[serde(alias = "R")]
+    Reads(String),
+}
+
+/// External representation of an active mapping in the response to a list request and in the
+/// configuration served over HTTP.
+#[derive(Debug, Deserialize, Eq, PartialEq, Serialize)]
+pub struct JsonActiveMapping {
+    path: PathBuf,
+
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    underlying_path: Option<PathBuf>,
+
+    writable: bool,
+
+    scaffold: bool,
+
+    #[serde(default)]
+    noexec: bool,
+
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    perm: Option<u32>,
+
+    #[serde(default)]
+    unresolved: bool,
+}
+
+impl From<MappingInfo> for JsonActiveMapping {
+    fn from(info: MappingInfo) -> Self {
+        Self {
+            path: info.path,
+            // In-memory mappings have no underlying path either, but only they are writable.
+            scaffold: info.underlying_path.is_none() && !info.writable,
+            underlying_path: info.underlying_path,
+            writable: info.writable,
+            noexec: info.noexec,
+            perm: info.perm_mask,
+            unresolved: info.unresolved,
+        }
+    }
+}
+
+/// Converts the `mappings` of a file system to their external representation, sorted by path.
+///
+/// This is shared by list requests and by the configuration served over HTTP so that both always
+/// agree.
+pub fn active_mappings(mut mappings: Vec<MappingInfo>) -> Vec<JsonActiveMapping> {
+    mappings.sort_by(|a, b| a.path.cmp(&b.path));
+    mappings.into_iter().map(JsonActiveMapping::from).collect()
+}
+
+/// External representation of the configuration of a mounted file system, as served over HTTP.
+#[derive(Debug, Serialize)]
+pub struct JsonMountConfig {
+    /// Path where the file system is mounted.
+    pub mount_point: PathBuf,
+
+    /// Options given to FUSE to mount the file system.
+    pub options: Vec<String>,
+
+    /// Who has access to the file system, as given to `--allow`.
+    pub allow: &'static str,
+
+    /// How long the kernel is allowed to cache file metadata for, in seconds.
+    pub ttl_seconds: i64,
+
+    /// How long the kernel is allowed to cache failed lookups for, in seconds.
+    pub negative_ttl_seconds: i64,
+
+    /// All mappings in the file system, as returned by list requests.
+    pub mappings: Vec<JsonActiveMapping>,
 }
 
 /// External representation of a response to a reconfiguration request.
 #[derive(Debug, Deserialize, Eq, PartialEq, Serialize)]
 struct Response {
     /// Identifier of the sandbox this response corresponds to.  Not present if the response
-    /// corresponds to an unrecoverable error (e.g. a syntax error in the requests stream).
+    /// corresponds to a malformed request (e.g. a syntax error in the requests stream).
     id: Option<String>,
 
     /// Contains the error, if any, for a failed reconfiguration request.
     error: Option<String>,
+
+    /// Contains the active mappings for a successful list request.  Not present for any other
+    /// request type.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    mappings: Option<Vec<JsonActiveMapping>>,
+
+    /// Contains the files that were read for a successful reads request.  Not present for any
+    /// other request type.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    reads: Option<ReadSet>,
+}
+
+/// Data returned by a successful reconfiguration request, if any, to include in its response.
+#[derive(Debug, Default)]
+struct ResponseData {
+    /// Active mappings, for list requests.
+    mappings: Option<Vec<JsonActiveMapping>>,
+
+    /// Files that were read, for reads requests.
+    reads: Option<ReadSet>,
 }
 
 /// Tracks prefixes seen in the requests to handle the prefix-encoded paths.
@@ -202,8 +395,11 @@ pub fn make_path<P: AsRef<Path>>(id: &str, abs_path: P) -> Fallible<PathBuf> {
 }
 
 /// Applies a reconfiguration request to the given file system.
+///
+/// Returns the list of active mappings for list requests, the files that were read for reads
+/// requests, and nothing for all others.
 fn handle_request<F: ReconfigurableFS>(request: Request, fs: &F, prefixes: Fallible<Prefixes>)
-    -> Fallible<()> {
+    -> Fallible<ResponseData> {
     let prefixes = &prefixes?;  // Unwrap any possible error as part of this request.
     match request {
         Request::CreateSandbox(request) => {
@@ -213,32 +409,86 @@ fn handle_request<F: ReconfigurableFS>(request: Request, fs: &F, prefixes: Falli
                 let path = prefixes.build_path(mapping.path_prefix, &mapping.path)?;
                 let underlying_path = prefixes.build_path(mapping.underlying_path_prefix,
                     &mapping.underlying_path)?;
-                mappings.push(Mapping::from_parts(path, underlying_path, mapping.writable)?);
+                let underlying_path = make_absolute(underlying_path.clone())
+                    .with_context(|_| format!("Cannot resolve {}", underlying_path.display()))?;
+                let writable = mapping.writable;
+                mappings.push(Mapping::from_parts_with(
+                    path, underlying_path, writable, mapping.into_options()?)?);
             }
 
-            Ok(fs.create_sandbox(&request.id, &mappings)?)
+            fs.create_sandbox(&request.id, &mappings)?;
+            Ok(ResponseData::default())
         },
         Request::DestroySandbox(id) => {
             validate_id(&id)?;
-            Ok(fs.destroy_sandbox(&id)?)
+            fs.destroy_sandbox(&id)?;
+            Ok(ResponseData::default())
+        },
+        Request::UnmapPaths(request) => {
+            validate_id(&request.id)?;
+            fs.unmap_paths(&request.id, &request.paths)?;
+            Ok(ResponseData::default())
+        },
+        Request::ListMappings(id) => {
+            validate_id(&id)?;
+            let mappings = active_mappings(fs.list_mappings());
+            Ok(ResponseData { mappings: Some(mappings), ..Default::default() })
+        },
+        Request::Reads(id) => {
+            validate_id(&id)?;
+            Ok(ResponseData { reads: Some(fs.take_reads()?), ..Default::default() })
         },
     }
 }
 
+/// Returns the identifier of `request`, which is echoed back in its response.
+fn request_id(request: &Request) -> String {
+    match request {
+        Request::CreateSandbox(request) => request.id.clone(),
+        Request::DestroySandbox(id) => id.clone(),
+        Request::UnmapPaths(request) => request.id.clone(),
+        Request::ListMappings(id) => id.clone(),
+        Request::Reads(id) => id.clone(),
+    }
+}
+
+/// Builds the response to a reconfiguration request with the details contained in a result object.
+fn make_response(id: Option<String>, result: Fallible<ResponseData>) -> Response {
+    match result {
+        Ok(data) => Response { id: id, error: None, mappings: data.mappings, reads: data.reads },
+        Err(e) => Response {
+            id: id, error: Some(flatten_causes(&e)), mappings: None, reads: None },
+    }
+}
+
 /// Responds to a reconfiguration request with the details contained in a result object.
-fn respond(writer: Arc<Mutex<io::BufWriter<impl Write>>>, id: Option<String>, result: Fallible<()>)
-    -> Fallible<()> {
+fn respond(writer: Arc<Mutex<io::BufWriter<impl Write>>>, id: Option<String>,
+    result: Fallible<ResponseData>) -> Fallible<()> {
     let mut writer = writer.lock().unwrap();
-    let response = Response {
-        id: id,
-        error: result.as_ref().err().map(|e| flatten_causes(&e)),
-    };
+    let response = make_response(id, result);
     serde_json::to_writer(writer.by_ref(), &response)?;
     writer.write_all(b"\n")?;
     writer.flush()?;
     Ok(())
 }
 
+/// Reader adapter that counts the newlines that go through it.
+///
+/// This lets `run_loop_aux` tell whether the JSON parser already consumed the end of the line on
+/// which it found a malformed request.
+struct NewlineCounter<'a, R: 'a> {
+    reader: &'a mut R,
+    newlines: u64,
+}
+
+impl<'a, R: Read> Read for NewlineCounter<'a, R> {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        let n = self.reader.read(buf)?;
+        self.newlines += buf[..n].iter().filter(|b| **b == b'\n').count() as u64;
+        Ok(n)
+    }
+}
+
 /// Same as `run_loop` but takes a thread pool instead of a number of threads.
 ///
 /// This is a separate function to ensure we control the lifecycle of the thread pool on the caller
@@ -252,40 +502,74 @@ fn run_loop_aux(
 
     let mut reader = io::BufReader::new(reader);
     let writer = Arc::from(Mutex::from(io::BufWriter::new(writer)));
-    let mut stream = serde_json::Deserializer::from_reader(&mut reader).into_iter::<Request>();
 
     let mut prefixes = Prefixes::new();
 
     loop {
-        let writer = writer.clone();
-        match stream.next() {
-            Some(Ok(request)) => {
-                let fs = fs.clone();
-                let used_prefixes = prefixes.register(&request);
-                pool.execute(move || {
-                    let id = match &request {
-                        Request::CreateSandbox(request) => request.id.clone(),
-                        Request::DestroySandbox(id) => id.clone(),
-                    };
-                    let result = handle_request(request, &fs, used_prefixes);
-                    if let Err(e) = respond(writer, Some(id), result) {
-                        warn!("Failed to write response: {}", e);
+        // Each pass parses requests until one is malformed.  The parser cannot continue after an
+        // error (see https://github.com/serde-rs/json/issues/70), so we start a new one after
+        // skipping the rest of the offending line.
+        let (e, consumed_line_end) = {
+            let mut input = NewlineCounter { reader: &mut reader, newlines: 0 };
+            let e = {
+                let stream = serde_json::Deserializer::from_reader(&mut input)
+                    .into_iter::<Request>();
+                let mut error = None;
+                for request in stream {
+                    match request {
+                        Ok(request) => {
+                            let writer = writer.clone();
+                            let fs = fs.clone();
+                            let used_prefixes = prefixes.register(&request);
+                            pool.execute(move || {
+                                let id = request_id(&request);
+                                let result = {
+                                    let _lock = fs.reconfig_lock().read().unwrap();
+                                    handle_request(request, &fs, used_prefixes)
+                                };
+                                if let Err(e) = respond(writer, Some(id), result) {
+                                    warn!("Failed to write response: {}", e);
+                                }
+                            });
+                        },
+                        Err(e) => {
+                            error = Some(e);
+                            break;
+                        },
                     }
-                });
-            },
-            Some(Err(e)) => {
-                assert!(!e.is_eof());  // Handled below.
-                let result = Err(format_err!("{}", e));
-                respond(writer, None, Err(e.into()))?;
-                // Parsing failed due to invalid JSON data.  Would be nice to recover from this by
-                // advancing the stream to the next valid request, but this is currently not
-                // possible; see https://github.com/serde-rs/json/issues/70.
-                return result;
-            },
-            None => {
+                }
+                match error {
+                    Some(e) => e,
+                    None => return Ok(()),
+                }
+            };
+            // The error points right past the end of the line if the newline was what made the
+            // request malformed, and the parser may have peeked at the newline without accounting
+            // for it in the error's position.
+            let consumed_line_end = e.column() == 0 || input.newlines >= e.line() as u64;
+            (e, consumed_line_end)
+        };
+
+        if e.is_eof() {
+            // The input was closed in the middle of a request, which is normal if the client went
+            // away.  The partial request was never applied so there is nothing to undo.
+            warn!("Reconfiguration input closed in the middle of a request; ignoring it");
+            return Ok(());
+        }
+        if e.is_io() {
+            let result = Err(format_err!("{}", e));
+            respond(writer, None, Err(e.into()))?;
+            return result;
+        }
+
+        warn!("Skipping malformed reconfiguration request: {}", e);
+        respond(writer.clone(), None, Err(e.into()))?;
+        if !consumed_line_end {
+            let mut rest = Vec::new();
+            if reader.read_until(b'\n', &mut rest)? == 0 {
                 return Ok(());
             }
-        };
+        }
     }
 }
 
@@ -294,10 +578,11 @@ fn run_loop_aux(
 /// The reconfiguration loop terminates under these conditions:
 /// * there is no more input in `reader`, which denotes that the user froze the configuration,
 /// * once the the input is closed by a different thread (returning success), or
-/// * once parsing stops abruptly due to an error in the input stream (returning such details).
+/// * once reading from the input stream fails (returning such details).
 ///
 /// Writes reconfiguration responses to `output`, which either acknowledge the request or contain
-/// details about any semantical errors that occur during the process.
+/// details about any semantical errors that occur during the process.  Malformed requests get a
+/// response without identifier and are skipped along with the rest of the line they are on.
 ///
 /// The reconfiguration loop is configured to accept `threads` parallel requests.
 pub fn run_loop(
@@ -314,6 +599,96 @@ pub fn run_loop(
     result
 }
 
+/// Applies the reconfiguration requests in `input`, a document received over HTTP, to the given
+/// file system `fs`.
+///
+/// The document has the same format as the stream processed by `run_loop` and its requests are
+/// processed in the same way, except that they are applied in order and that no other
+/// reconfigurations happen in the meantime.  Each document is a separate input stream, so the
+/// prefixes registered by one document are not visible to the next one.
+///
+/// Returns the HTTP status of the response and its body, which is a JSON array with the response
+/// to each request.  The status is 400 if the document cannot be parsed, in which case nothing is
+/// applied and the array contains a single response without identifier, and 422 if any of the
+/// requests failed.
+pub fn handle_document(input: &[u8], fs: &impl ReconfigurableFS) -> (&'static str, String) {
+    let requests = serde_json::Deserializer::from_slice(input).into_iter::<Request>()
+        .collect::<Result<Vec<Request>, serde_json::Error>>();
+    let (status, responses) = match requests {
+        Ok(ref requests) if requests.is_empty() => {
+            let e = format_err!("No reconfiguration requests");
+            ("400 Bad Request", vec!(make_response(None, Err(e))))
+        },
+        Ok(requests) => {
+            let _lock = fs.reconfig_lock().write().unwrap();
+            let mut prefixes = Prefixes::new();
+            let responses = requests.into_iter()
+                .map(|request| {
+                    let used_prefixes = prefixes.register(&request);
+                    let id = request_id(&request);
+                    make_response(Some(id), handle_request(request, fs, used_prefixes))
+                })
+                .collect::<Vec<Response>>();
+            if responses.iter().any(|response| response.error.is_some()) {
+                ("422 Unprocessable Entity", responses)
+            } else {
+                ("200 OK", responses)
+            }
+        },
+        Err(e) => ("400 Bad Request", vec!(make_response(None, Err(e.into())))),
+    };
+    let mut body = serde_json::to_string(&responses).expect("Serializing responses cannot fail");
+    body.push('\n');
+    (status, body)
+}
+
+/// Path to a Unix domain socket that is deleted from the file system when this object is dropped.
+pub struct SocketPath(PathBuf);
+
+impl Drop for SocketPath {
+    fn drop(&mut self) {
+        if let Err(e) = fs::remove_file(&self.0) {
+            warn!("Failed to remove reconfiguration socket {}: {}", self.0.display(), e);
+        }
+    }
+}
+
+/// Creates a Unix domain socket at `path` on which to accept reconfiguration connections.
+///
+/// The socket is only accessible by the current user.  Because this temporarily changes the umask
+/// of the whole process, this must be called before any threads that create files are started.
+/// Returns the listening socket and a guard that deletes the socket when dropped.
+pub fn bind_socket(path: &Path) -> Fallible<(UnixListener, SocketPath)> {
+    let old_mask = stat::umask(stat::Mode::from_bits_truncate(0o177));
+    let listener = UnixListener::bind(path);
+    stat::umask(old_mask);
+    let listener = listener.with_context(
+        |_| format!("Failed to create reconfiguration socket {}", path.display()))?;
+    Ok((listener, SocketPath(path.to_owned())))
+}
+
+/// Runs the reconfiguration loop on every connection accepted by `listener`, one at a time.
+///
+/// Each connection is handled as a separate input stream, so the prefixes registered by one
+/// connection are not visible to the next one.  Errors in the input of a connection only terminate
+/// that connection.  This only returns if accepting new connections fails.
+pub fn serve_socket(
+    listener: UnixListener,
+    threads: usize,
+    fs: &(impl ReconfigurableFS + Send + Sync + Clone + 'static))
+    -> Fallible<()> {
+    for stream in listener.incoming() {
+        let stream = stream.context("Failed to accept reconfiguration connection")?;
+        let writer = stream.try_clone()?;
+        info!("Accepted reconfiguration connection");
+        match run_loop(stream, writer, threads, fs) {
+            Ok(()) => info!("Reconfiguration connection closed"),
+            Err(e) => warn!("Reconfiguration connection terminated due to error: {}", e),
+        }
+    }
+    unreachable!("UnixListener::incoming never returns None");
+}
+
 /// Opens the input file for the reconfiguration loop.
 ///
 /// If `path` is None, this reopens stdin.
@@ -342,9 +717,15 @@ pub fn open_output<P: AsRef<Path>>(path: Option<P>) -> Fallible<fs::File> {
 
 #[cfg(test)]
 mod tests {
+    use nodes;
     use std::collections::HashMap;
+    use std::env;
     use std::io::Seek;
+    use std::net::Shutdown;
+    use std::os::unix::fs::PermissionsExt;
+    use std::os::unix::net::UnixStream;
     use std::sync::Mutex;
+    use std::thread;
     use super::*;
     use tempfile;
 
@@ -357,6 +738,13 @@ mod tests {
             underlying_path: underlying_path.to_owned(),
             underlying_path_prefix: underlying_path_prefix,
             writable: writable,
+            excludes: vec!(),
+            squash: None,
+            noexec: false,
+            perm: None,
+            lazy: false,
+            optional: false,
+            target_type: None,
         }
     }
 
@@ -377,6 +765,16 @@ mod tests {
         Request::DestroySandbox(id.to_owned())
     }
 
+    /// Syntactic sugar to instantiate a new `Request::UnmapPaths` for testing purposes only.
+    fn new_unmap_paths(id: &str, paths: &[&str]) -> Request {
+        Request::UnmapPaths(
+            UnmapPathsRequest {
+                id: id.to_owned(),
+                paths: paths.iter().map(PathBuf::from).collect(),
+            }
+        )
+    }
+
     #[test]
     fn test_prefixes_create_one_sandbox() {
         let mut prefixes = Prefixes::new();
@@ -585,6 +983,9 @@ mod tests {
         /// Map operations are recorded as "map foo" and unmap operations are recorded as "unmap
         /// foo", where "foo" is the path of the mapping.
         log: Arc<Mutex<Vec<String>>>,
+
+        /// Lock returned by `reconfig_lock`.
+        lock: Arc<RwLock<()>>,
     }
 
     impl MockFS {
@@ -598,8 +999,31 @@ mod tests {
         fn create_sandbox(&self, id: &str, mappings: &[Mapping]) -> Fallible<()> {
             for mapping in mappings {
                 let path = make_path(id, &mapping.path).unwrap();
+                let (underlying_path, noexec, perm_mask, lazy, optional, target_type) =
+                    match &mapping.target {
+                        nodes::MappingTarget::Path {
+                            underlying_path, noexec, perm_mask, lazy, optional, target_type,
+                            .. } => {
+                            (underlying_path, *noexec, *perm_mask, *lazy, *optional, *target_type)
+                        },
+                        target => panic!("Reconfigurations cannot create {:?} mappings", target),
+                    };
+                let mut suffix = match (noexec, perm_mask) {
+                    (true, _) => " (noexec)".to_owned(),
+                    (false, Some(perm_mask)) => format!(" (perm={:04o})", perm_mask),
+                    (false, None) => "".to_owned(),
+                };
+                if lazy {
+                    suffix += " (lazy)";
+                }
+                if optional {
+                    suffix += " (optional)";
+                }
+                if let Some(target_type) = target_type {
+                    suffix += &format!(" (type={})", target_type);
+                }
                 self.log.lock().unwrap().push(
-                    format!("map {} -> {}", path.display(), mapping.underlying_path.display()));
+                    format!("map {} -> {}{}", path.display(), underlying_path.display(), suffix));
             }
             Ok(())
         }
@@ -608,6 +1032,43 @@ mod tests {
             self.log.lock().unwrap().push(format!("unmap /{}", id));
             Ok(())
         }
+
+        fn unmap_paths(&self, id: &str, paths: &[PathBuf]) -> Fallible<()> {
+            for path in paths {
+                let path = make_path(id, path)?;
+                self.log.lock().unwrap().push(format!("unmap {}", path.display()));
+            }
+            Ok(())
+        }
+
+        fn list_mappings(&self) -> Vec<MappingInfo> {
+            self.log.lock().unwrap().push(String::from("list"));
+            vec!(
+                MappingInfo {
+                    path: PathBuf::from("/sb/mapped"),
+                    underlying_path: Some(PathBuf::from("/some/dir")),
+                    writable: true,
+                    noexec: true,
+                    perm_mask: Some(0o555),
+                    unresolved: true,
+                },
+                MappingInfo {
+                    path: PathBuf::from("/"), underlying_path: None, writable: false,
+                    noexec: false, perm_mask: None, unresolved: false },
+                MappingInfo {
+                    path: PathBuf::from("/sb"), underlying_path: None, writable: false,
+                    noexec: false, perm_mask: None, unresolved: false },
+            )
+        }
+
+        fn take_reads(&self) -> Fallible<ReadSet> {
+            self.log.lock().unwrap().push(String::from("reads"));
+            Ok(ReadSet { paths: vec!(PathBuf::from("/sb/file")), overflowed: true })
+        }
+
+        fn reconfig_lock(&self) -> &RwLock<()> {
+            &self.lock
+        }
     }
 
     /// A `Response` that matches another `Response`'s error message in a fuzzy manner.
@@ -628,8 +1089,12 @@ mod tests {
         /// Checks if the `FuzzyResponse` matches a given `Response`.
         ///
         /// The two are considered equivalent if the pattern provided in the `FuzzyResponse`'s
-        /// error message matches the error message in `other`.
+        /// error message matches the error message in `other` and if the listed mappings and
+        /// reads, if any, are identical.
         fn eq(&self, other: &Response) -> bool {
+            if self.0.mappings != other.mappings || self.0.reads != other.reads {
+                return false;
+            }
             match (self.0.error.as_ref(), other.error.as_ref()) {
                 (Some(exp_message), Some(message)) => message.contains(exp_message),
                 (None, None) => true,
@@ -707,7 +1172,7 @@ mod tests {
             new_create_sandbox("foo", &[new_mapping("/bar", 0, "/bin", 0, false)], HashMap::new()),
         ];
         let exp_responses = &[
-            Response{ id: Some("foo".to_owned()), error: None },
+            Response{ id: Some("foo".to_owned()), error: None, mappings: None, reads: None },
         ];
         let exp_log = &[
             String::from("map /foo/bar -> /bin"),
@@ -723,9 +1188,9 @@ mod tests {
             new_create_sandbox("baz", &[new_mapping("/z", 0, "/b", 0, false)], HashMap::new()),
         ];
         let exp_responses = &[
-            Response{ id: Some("foo".to_owned()), error: None },
-            Response{ id: Some("a".to_owned()), error: None },
-            Response{ id: Some("baz".to_owned()), error: None },
+            Response{ id: Some("foo".to_owned()), error: None, mappings: None, reads: None },
+            Response{ id: Some("a".to_owned()), error: None, mappings: None, reads: None },
+            Response{ id: Some("baz".to_owned()), error: None, mappings: None, reads: None },
         ];
         let exp_log = &[
             String::from("map /foo/bar -> /bin"),
@@ -745,8 +1210,13 @@ mod tests {
             new_destroy_sandbox("somewhere-else"),
         ];
         let exp_responses = &[
-            Response{ id: Some("sandbox".to_owned()), error: None },
-            Response{ id: Some("somewhere-else".to_owned()), error: None },
+            Response{ id: Some("sandbox".to_owned()), error: None, mappings: None, reads: None },
+            Response{
+                id: Some("somewhere-else".to_owned()),
+                error: None,
+                mappings: None,
+                reads: None,
+            },
         ];
         let exp_log = &[
             String::from("map /sandbox -> /the-root"),
@@ -767,9 +1237,14 @@ mod tests {
             new_create_sandbox("a", &[new_mapping("z", 1, "b", 1, false)], HashMap::new()),
         ];
         let exp_responses = &[
-            Response{ id: Some("a".to_owned()), error: None },
-            Response{ id: Some("a".to_owned()), error: Some("\"bar\" is not absolute".to_owned()) },
-            Response{ id: Some("a".to_owned()), error: None },
+            Response{ id: Some("a".to_owned()), error: None, mappings: None, reads: None },
+            Response{
+                id: Some("a".to_owned()),
+                error: Some("\"bar\" is not absolute".to_owned()),
+                mappings: None,
+                reads: None,
+            },
+            Response{ id: Some("a".to_owned()), error: None, mappings: None, reads: None },
         ];
         let exp_log = &[
             String::from("map /a/foo -> /b"),
@@ -778,6 +1253,171 @@ mod tests {
         do_run_loop_test(requests, exp_responses, exp_log);
     }
 
+    #[test]
+    fn test_run_loop_unmap_paths() {
+        let requests: &[Request] = &[
+            new_unmap_paths("foo", &["/bar", "/baz/nested"]),
+            new_unmap_paths("", &["/bar"]),
+            new_unmap_paths("a", &["relative"]),
+        ];
+        let exp_responses = &[
+            Response{ id: Some("foo".to_owned()), error: None, mappings: None, reads: None },
+            Response{
+                id: Some("".to_owned()),
+                error: Some("cannot be empty".to_owned()),
+                mappings: None,
+                reads: None,
+            },
+            Response{
+                id: Some("a".to_owned()),
+                error: Some("\"relative\" is not absolute".to_owned()),
+                mappings: None,
+                reads: None,
+            },
+        ];
+        let exp_log = &[
+            String::from("unmap /foo/bar"),
+            String::from("unmap /foo/baz/nested"),
+        ];
+        do_run_loop_test(requests, exp_responses, exp_log);
+    }
+
+    #[test]
+    fn test_run_loop_unmap_paths_minimized() {
+        let requests = r#"{"U":{"i":"foo","p":["/a"]}}{"UnmapPaths":{"id":"bar"}}"#;
+        let exp_responses = &[
+            Response{ id: Some("foo".to_owned()), error: None, mappings: None, reads: None },
+            Response{ id: Some("bar".to_owned()), error: None, mappings: None, reads: None },
+        ];
+        let exp_log = &[
+            String::from("unmap /foo/a"),
+        ];
+        do_run_loop_raw_test(&requests, exp_responses, exp_log).unwrap();
+    }
+
+    #[test]
+    fn test_run_loop_list_mappings() {
+        let scaffold = |path| JsonActiveMapping {
+            path: PathBuf::from(path), underlying_path: None, writable: false, scaffold: true,
+            noexec: false, perm: None, unresolved: false };
+        let exp_mappings = || vec!(
+            scaffold("/"),
+            scaffold("/sb"),
+            JsonActiveMapping {
+                path: PathBuf::from("/sb/mapped"),
+                underlying_path: Some(PathBuf::from("/some/dir")),
+                writable: true,
+                scaffold: false,
+                noexec: true,
+                perm: Some(0o555),
+                unresolved: true,
+            },
+        );
+        let requests = r#"{"ListMappings":"first"}{"L":"second"}{"ListMappings":""}"#;
+        let exp_responses = &[
+            Response{
+                id: Some("first".to_owned()),
+                error: None,
+                mappings: Some(exp_mappings()),
+                reads: None,
+            },
+            Response{
+                id: Some("second".to_owned()),
+                error: None,
+                mappings: Some(exp_mappings()),
+                reads: None,
+            },
+            Response{
+                id: Some("".to_owned()),
+                error: Some("cannot be empty".to_owned()),
+                mappings: None,
+                reads: None,
+            },
+        ];
+        let exp_log = &[
+            String::from("list"),
+            String::from("list"),
+        ];
+        do_run_loop_raw_test(requests, exp_responses, exp_log).unwrap();
+    }
+
+    #[test]
+    fn test_run_loop_reads() {
+        let exp_reads = || ReadSet { paths: vec!(PathBuf::from("/sb/file")), overflowed: true };
+        let requests = r#"{"Reads":"first"}{"R":"second"}{"Reads":""}"#;
+        let exp_responses = &[
+            Response{
+                id: Some("first".to_owned()),
+                error: None,
+                mappings: None,
+                reads: Some(exp_reads()),
+            },
+            Response{
+                id: Some("second".to_owned()),
+                error: None,
+                mappings: None,
+                reads: Some(exp_reads()),
+            },
+            Response{
+                id: Some("".to_owned()),
+                error: Some("cannot be empty".to_owned()),
+                mappings: None,
+                reads: None,
+            },
+        ];
+        let exp_log = &[
+            String::from("reads"),
+            String::from("reads"),
+        ];
+        do_run_loop_raw_test(requests, exp_responses, exp_log).unwrap();
+    }
+
+    #[test]
+    fn test_handle_document_ok() {
+        let fs: MockFS = Default::default();
+        let input = r#"{"C":{"i":"sb","m":[{"x":1,"p":"a","y":0,"u":"/b"}],"q":{"1":"/d"}}}
+            {"L":"tag"}"#;
+        let (status, body) = handle_document(input.as_bytes(), &fs);
+        assert_eq!("200 OK", status);
+        let responses: Vec<Response> = serde_json::from_str(&body).unwrap();
+        assert_eq!(2, responses.len());
+        assert_eq!(
+            Response{ id: Some("sb".to_owned()), error: None, mappings: None, reads: None },
+            responses[0]);
+        assert_eq!(Some("tag".to_owned()), responses[1].id);
+        assert!(responses[1].mappings.is_some());
+        assert_eq!(&[String::from("map /sb/d/a -> /b")], fs.get_log().as_slice());
+    }
+
+    #[test]
+    fn test_handle_document_semantic_errors() {
+        let fs: MockFS = Default::default();
+        let input = r#"{"DestroySandbox":"sb"}{"DestroySandbox":""}{"DestroySandbox":"other"}"#;
+        let (status, body) = handle_document(input.as_bytes(), &fs);
+        assert_eq!("422 Unprocessable Entity", status);
+        let responses: Vec<Response> = serde_json::from_str(&body).unwrap();
+        assert_eq!(3, responses.len());
+        assert_eq!(None, responses[0].error);
+        assert!(responses[1].error.as_ref().unwrap().contains("cannot be empty"));
+        assert_eq!(None, responses[2].error);
+        assert_eq!(&[String::from("unmap /sb"), String::from("unmap /other")],
+            fs.get_log().as_slice());
+    }
+
+    #[test]
+    fn test_handle_document_syntax_errors() {
+        let fs: MockFS = Default::default();
+        for input in &[r#"{"DestroySandbox":"sb"}{"Foo"#, "", "  \n"] {
+            let (status, body) = handle_document(input.as_bytes(), &fs);
+            assert_eq!("400 Bad Request", status);
+            let responses: Vec<Response> = serde_json::from_str(&body).unwrap();
+            assert_eq!(1, responses.len());
+            assert_eq!(None, responses[0].id);
+            assert!(responses[0].error.is_some());
+        }
+        assert!(fs.get_log().is_empty());
+    }
+
     #[test]
     fn test_run_loop_prefixes_ok() {
         let mut prefixes1: HashMap<String, PathBuf> = HashMap::new();
@@ -798,8 +1438,8 @@ mod tests {
             ], prefixes2),
         ];
         let exp_responses = &[
-            Response{ id: Some("sandbox1".to_owned()), error: None },
-            Response{ id: Some("sandbox2".to_owned()), error: None },
+            Response{ id: Some("sandbox1".to_owned()), error: None, mappings: None, reads: None },
+            Response{ id: Some("sandbox2".to_owned()), error: None, mappings: None, reads: None },
         ];
         let exp_log = &[
             String::from("map /sandbox1 -> /some/dir/relative/dir"),
@@ -822,29 +1462,240 @@ mod tests {
         ];
         let exp_responses = &[
             Response{
-                id: Some("a".to_owned()), error: Some("Suffix /y must be relative".to_owned()) },
+                id: Some("a".to_owned()),
+                error: Some("Suffix /y must be relative".to_owned()),
+                mappings: None,
+                reads: None,
+            },
             Response{
-                id: Some("b".to_owned()), error: Some("path \"y\" is not absolute".to_owned()) },
+                id: Some("b".to_owned()),
+                error: Some("path \"y\" is not absolute".to_owned()),
+                mappings: None,
+                reads: None,
+            },
             Response{
-                id: Some("c".to_owned()), error: Some("Prefix 2 does not exist".to_owned()) },
+                id: Some("c".to_owned()),
+                error: Some("Prefix 2 does not exist".to_owned()),
+                mappings: None,
+                reads: None,
+            },
             Response{
-                id: Some("d".to_owned()), error: Some("path \"\" is not absolute".to_owned()) },
+                id: Some("d".to_owned()),
+                error: Some("path \"\" is not absolute".to_owned()),
+                mappings: None,
+                reads: None,
+            },
         ];
         let exp_log = &[];
         do_run_loop_test(requests, exp_responses, exp_log);
     }
 
     #[test]
-    fn test_run_loop_fatal_syntax_error_due_to_empty_request() {
+    fn test_run_loop_excludes() {
+        let requests = r#"
+            {"CreateSandbox": {"id": "a", "mappings": [
+                {"path": "/src", "underlying_path": "/home/me/src", "excludes": [".git", "*.o"]}
+            ]}}
+            {"CreateSandbox": {"id": "b", "mappings": [
+                {"p": "/src", "u": "/home/me/src", "e": ["sub/dir"]}
+            ]}}
+        "#;
+        let exp_responses = &[
+            Response{ id: Some("a".to_owned()), error: None, mappings: None, reads: None },
+            Response{
+                id: Some("b".to_owned()),
+                error: Some("exclude pattern \"sub/dir\" must be a non-empty file name".to_owned()),
+                mappings: None,
+                reads: None,
+            },
+        ];
+        let exp_log = &[String::from("map /a/src -> /home/me/src")];
+        do_run_loop_raw_test(&requests, exp_responses, exp_log).unwrap();
+    }
+
+    #[test]
+    fn test_run_loop_noexec() {
+        let requests = r#"
+            {"CreateSandbox": {"id": "a", "mappings": [
+                {"path": "/deps", "underlying_path": "/home/me/deps", "noexec": true}
+            ]}}
+            {"CreateSandbox": {"id": "b", "mappings": [
+                {"p": "/deps", "u": "/home/me/deps", "n": true}
+            ]}}
+        "#;
+        let exp_responses = &[
+            Response{ id: Some("a".to_owned()), error: None, mappings: None, reads: None },
+            Response{ id: Some("b".to_owned()), error: None, mappings: None, reads: None },
+        ];
+        let exp_log = &[
+            String::from("map /a/deps -> /home/me/deps (noexec)"),
+            String::from("map /b/deps -> /home/me/deps (noexec)"),
+        ];
+        do_run_loop_raw_test(&requests, exp_responses, exp_log).unwrap();
+    }
+
+    #[test]
+    fn test_run_loop_perm() {
+        let requests = r#"
+            {"CreateSandbox": {"id": "a", "mappings": [
+                {"path": "/src", "underlying_path": "/home/me/src", "perm": 365}
+            ]}}
+            {"CreateSandbox": {"id": "b", "mappings": [
+                {"p": "/src", "u": "/home/me/src", "k": 438}
+            ]}}
+        "#;
+        let exp_responses = &[
+            Response{ id: Some("a".to_owned()), error: None, mappings: None, reads: None },
+            Response{
+                id: Some("b".to_owned()),
+                error: Some("permissions mask 0666 must be at most 7777".to_owned()),
+                mappings: None,
+                reads: None,
+            },
+        ];
+        let exp_log = &[String::from("map /a/src -> /home/me/src (perm=0555)")];
+        do_run_loop_raw_test(&requests, exp_responses, exp_log).unwrap();
+    }
+
+    #[test]
+    fn test_run_loop_lazy() {
+        let requests = r#"
+            {"CreateSandbox": {"id": "a", "mappings": [
+                {"path": "/src", "underlying_path": "/home/me/src", "lazy": true}
+            ]}}
+            {"CreateSandbox": {"id": "b", "mappings": [
+                {"p": "/src", "u": "/home/me/src", "l": true}
+            ]}}
+        "#;
+        let exp_responses = &[
+            Response{ id: Some("a".to_owned()), error: None, mappings: None, reads: None },
+            Response{ id: Some("b".to_owned()), error: None, mappings: None, reads: None },
+        ];
+        let exp_log = &[
+            String::from("map /a/src -> /home/me/src (lazy)"),
+            String::from("map /b/src -> /home/me/src (lazy)"),
+        ];
+        do_run_loop_raw_test(&requests, exp_responses, exp_log).unwrap();
+    }
+
+    #[test]
+    fn test_run_loop_optional() {
+        let requests = r#"
+            {"CreateSandbox": {"id": "a", "mappings": [
+                {"path": "/out", "underlying_path": "/home/me/out", "optional": true, "type": "dir"}
+            ]}}
+            {"CreateSandbox": {"id": "b", "mappings": [
+                {"p": "/out", "u": "/home/me/out", "o": true}
+            ]}}
+            {"CreateSandbox": {"id": "c", "mappings": [
+                {"p": "/out", "u": "/home/me/out", "o": true, "t": "fifo"}
+            ]}}
+        "#;
+        let exp_responses = &[
+            Response{ id: Some("a".to_owned()), error: None, mappings: None, reads: None },
+            Response{ id: Some("b".to_owned()), error: None, mappings: None, reads: None },
+            Response{
+                id: Some("c".to_owned()),
+                error: Some("invalid target type fifo: must be dir or file".to_owned()),
+                mappings: None,
+                reads: None,
+            },
+        ];
+        let exp_log = &[
+            String::from("map /a/out -> /home/me/out (optional) (type=dir)"),
+            String::from("map /b/out -> /home/me/out (optional)"),
+        ];
+        do_run_loop_raw_test(&requests, exp_responses, exp_log).unwrap();
+    }
+
+    #[test]
+    fn test_run_loop_special_characters_in_paths() {
+        let requests = r#"
+            {"CreateSandbox": {"id": "a", "mappings": [
+                {"path": "/a:b", "underlying_path": "/x:y"},
+                {"path": "/with spaces", "underlying_path": "/back\\slash"},
+                {"path": "/ñandú", "underlying_path": "/tmp/日本語"}
+            ]}}
+        "#;
+        let exp_responses = &[
+            Response{ id: Some("a".to_owned()), error: None, mappings: None, reads: None },
+        ];
+        let exp_log = &[
+            String::from("map /a/a:b -> /x:y"),
+            String::from(r"map /a/with spaces -> /back\slash"),
+            String::from("map /a/ñandú -> /tmp/日本語"),
+        ];
+        do_run_loop_raw_test(&requests, exp_responses, exp_log).unwrap();
+    }
+
+    #[test]
+    fn test_run_loop_relative_underlying_paths() {
+        let cwd = env::current_dir().unwrap();
+        let requests = r#"
+            {"CreateSandbox": {"id": "a", "mappings": [
+                {"path": "/rel", "underlying_path": "some/dir"},
+                {"path": "/dot", "underlying_path": "./other"}
+            ]}}
+            {"CreateSandbox": {"id": "b", "mappings": [
+                {"path": "rel", "underlying_path": "some/dir"}
+            ]}}
+        "#;
+        let exp_responses = &[
+            Response{ id: Some("a".to_owned()), error: None, mappings: None, reads: None },
+            Response{
+                id: Some("b".to_owned()),
+                error: Some("path \"rel\" is not absolute".to_owned()),
+                mappings: None,
+                reads: None,
+            },
+        ];
+        let exp_log = &[
+            format!("map /a/rel -> {}", cwd.join("some/dir").display()),
+            format!("map /a/dot -> {}", cwd.join("other").display()),
+        ];
+        do_run_loop_raw_test(&requests, exp_responses, exp_log).unwrap();
+    }
+
+    #[test]
+    fn test_run_loop_squash() {
+        let requests = r#"
+            {"CreateSandbox": {"id": "a", "mappings": [
+                {"path": "/out", "underlying_path": "/tmp/out", "writable": true,
+                 "squash": {"uid": 1000, "gid": 100, "strict": true}}
+            ]}}
+            {"CreateSandbox": {"id": "b", "mappings": [
+                {"p": "/out", "u": "/tmp/out", "s": {"strict": true}}
+            ]}}
+        "#;
+        let exp_responses = &[
+            Response{ id: Some("a".to_owned()), error: None, mappings: None, reads: None },
+            Response{
+                id: Some("b".to_owned()),
+                error: Some("squashing requires a uid or a gid".to_owned()),
+                mappings: None,
+                reads: None,
+            },
+        ];
+        let exp_log = &[String::from("map /a/out -> /tmp/out")];
+        do_run_loop_raw_test(&requests, exp_responses, exp_log).unwrap();
+    }
+
+    #[test]
+    fn test_run_loop_syntax_error_due_to_empty_request() {
         let requests = r#"{}"#;
         let exp_responses = &[
-            Response{ id: None, error: Some("expected value".to_string()) },
+            Response{
+                id: None,
+                error: Some("expected value".to_string()),
+                mappings: None,
+                reads: None,
+            },
         ];
-        do_run_loop_raw_test(&requests, exp_responses, &[]).unwrap_err();
+        do_run_loop_raw_test(&requests, exp_responses, &[]).unwrap();
     }
 
     #[test]
-    fn test_run_loop_fatal_syntax_error_due_to_conflicting_requests() {
+    fn test_run_loop_syntax_error_due_to_conflicting_requests() {
         let requests = r#"
             {
                 "CreateSandbox": {
@@ -864,13 +1715,18 @@ mod tests {
             }
         "#;
         let exp_responses = &[
-            Response{ id: None, error: Some("expected value".to_string()) },
+            Response{
+                id: None,
+                error: Some("expected value".to_string()),
+                mappings: None,
+                reads: None,
+            },
         ];
-        do_run_loop_raw_test(&requests, exp_responses, &[]).unwrap_err();
+        do_run_loop_raw_test(&requests, exp_responses, &[]).unwrap();
     }
 
     #[test]
-    fn test_run_loop_fatal_syntax_error_stops_processing() {
+    fn test_run_loop_syntax_error_skips_request() {
         let requests = r#"
             {"DestroySandbox": "first"}
             {"CreateSandbox": {
@@ -880,12 +1736,85 @@ mod tests {
             {"DestroySandbox": "third"}
         "#;
         let exp_responses = &[
-            Response{ id: Some("first".to_owned()), error: None },
-            Response{ id: None, error: Some("missing field".to_string()) },
+            Response{ id: Some("first".to_owned()), error: None, mappings: None, reads: None },
+            Response{
+                id: None,
+                error: Some("missing field".to_string()),
+                mappings: None,
+                reads: None,
+            },
+            Response{ id: Some("third".to_owned()), error: None, mappings: None, reads: None },
         ];
         let exp_log = &[
             String::from("unmap /first"),
+            String::from("unmap /third"),
+        ];
+        do_run_loop_raw_test(&requests, exp_responses, exp_log).unwrap();
+    }
+
+    #[test]
+    fn test_run_loop_syntax_error_at_end_of_line() {
+        // The newline is what makes the second request malformed, so resyncing must not skip the
+        // line after it.
+        let requests = "{\"DestroySandbox\": \"first\"}\n\
+            {\"DestroySandbox\": \"second\n\
+            {\"DestroySandbox\": \"third\"}\n";
+        let exp_responses = &[
+            Response{ id: Some("first".to_owned()), error: None, mappings: None, reads: None },
+            Response{
+                id: None,
+                error: Some("control character".to_string()),
+                mappings: None,
+                reads: None,
+            },
+            Response{ id: Some("third".to_owned()), error: None, mappings: None, reads: None },
         ];
-        do_run_loop_raw_test(&requests, exp_responses, exp_log).unwrap_err();
+        let exp_log = &[
+            String::from("unmap /first"),
+            String::from("unmap /third"),
+        ];
+        do_run_loop_raw_test(&requests, exp_responses, exp_log).unwrap();
+    }
+
+    #[test]
+    fn test_run_loop_truncated_request_is_ignored() {
+        let requests = r#"
+            {"DestroySandbox": "first"}
+            {"CreateSandbox": {"id": "second", "mappings": [{"path": "/bar", "underl"#;
+        let exp_responses = &[
+            Response{ id: Some("first".to_owned()), error: None, mappings: None, reads: None },
+        ];
+        let exp_log = &[
+            String::from("unmap /first"),
+        ];
+        do_run_loop_raw_test(&requests, exp_responses, exp_log).unwrap();
+    }
+
+    #[test]
+    fn test_serve_socket() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("socket");
+        let mock_fs: MockFS = Default::default();
+
+        let (listener, socket_path) = bind_socket(&path).unwrap();
+        assert_eq!(0o600, fs::symlink_metadata(&path).unwrap().permissions().mode() & 0o777);
+        {
+            let mock_fs = mock_fs.clone();
+            thread::spawn(move || serve_socket(listener, 1, &mock_fs));
+        }
+
+        for id in &["first", "second"] {
+            let mut stream = UnixStream::connect(&path).unwrap();
+            write!(stream, "{{\"DestroySandbox\": \"{}\"}}", id).unwrap();
+            stream.shutdown(Shutdown::Write).unwrap();
+            let mut response = String::new();
+            stream.read_to_string(&mut response).unwrap();
+            assert_eq!(format!("{{\"id\":\"{}\",\"error\":null}}\n", id), response);
+        }
+        assert_eq!(vec!(String::from("unmap /first"), String::from("unmap /second")),
+            mock_fs.get_log());
+
+        drop(socket_path);
+        assert!(!path.exists());
     }
 }
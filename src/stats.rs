@@ -0,0 +1,448 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License.  You may obtain a copy
+// of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.  See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+use metrics::Op;
+use serde_derive::Serialize;
+use std::fmt::Write as FmtWrite;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::time::{Duration, Instant};
+
+/// Number of bits of the latency, after its most significant bit, that select a bucket within a
+/// power of two.  Percentiles are thus reported with a relative error of at most 1/4.
+const SUB_BUCKET_BITS: u32 = 2;
+
+/// Number of buckets into which each power of two is split.
+const SUB_BUCKETS: usize = 1 << SUB_BUCKET_BITS;
+
+/// Highest power of two, in microseconds, that gets its own buckets.  Latencies of more than about
+/// two hours all fall into the last bucket.
+const MAX_EXPONENT: u32 = 32;
+
+/// Number of buckets in a latency histogram.
+const NUM_BUCKETS: usize = SUB_BUCKETS * (MAX_EXPONENT - SUB_BUCKET_BITS + 2) as usize;
+
+/// Length of each of the periods into which recent samples are grouped.
+const PERIOD_SECS: u64 = 5;
+
+/// Number of periods that make up the recent window, which thus spans about a minute.
+const WINDOW_PERIODS: usize = 12;
+
+/// Percentiles reported for each operation.
+static PERCENTILES: [f64; 3] = [0.50, 0.90, 0.99];
+
+/// Returns the index of the histogram bucket that holds a latency of `micros`.
+fn bucket_of(micros: u64) -> usize {
+    if micros < SUB_BUCKETS as u64 {
+        return micros as usize;
+    }
+    let exponent = 63 - micros.leading_zeros();
+    if exponent > MAX_EXPONENT {
+        return NUM_BUCKETS - 1;
+    }
+    let shift = exponent - SUB_BUCKET_BITS;
+    let mantissa = (micros >> shift) as usize & (SUB_BUCKETS - 1);
+    SUB_BUCKETS * (shift as usize + 1) + mantissa
+}
+
+/// Returns the largest latency, in microseconds, that falls into the bucket at index `i`.
+fn bucket_upper_bound(i: usize) -> u64 {
+    if i < SUB_BUCKETS {
+        return i as u64;
+    }
+    let shift = i / SUB_BUCKETS - 1;
+    let mantissa = (i % SUB_BUCKETS) as u64;
+    ((SUB_BUCKETS as u64 + mantissa + 1) << shift) - 1
+}
+
+/// Converts `duration` to microseconds, saturating on overflow.
+fn as_micros(duration: Duration) -> u64 {
+    duration.as_secs().saturating_mul(1_000_000)
+        .saturating_add(u64::from(duration.subsec_micros()))
+}
+
+/// Lock-free histogram of the latencies of an operation along with its number of failures.
+///
+/// Buckets are log-linear: each power of two is split into `SUB_BUCKETS` equal parts, which keeps
+/// the number of buckets small while bounding the relative error of the computed percentiles.
+struct Histogram {
+    /// Number of samples in each bucket.
+    buckets: Vec<AtomicUsize>,
+
+    /// Number of samples that correspond to failed operations.
+    errors: AtomicUsize,
+}
+
+impl Histogram {
+    /// Creates a new empty histogram.
+    fn new() -> Self {
+        Histogram {
+            buckets: (0..NUM_BUCKETS).map(|_| AtomicUsize::new(0)).collect(),
+            errors: AtomicUsize::new(0),
+        }
+    }
+
+    /// Records a sample of `micros` that failed if `failed` is true.
+    fn observe(&self, micros: u64, failed: bool) {
+        self.buckets[bucket_of(micros)].fetch_add(1, Ordering::Relaxed);
+        if failed {
+            self.errors.fetch_add(1, Ordering::Relaxed);
+        }
+    }
+
+    /// Forgets all samples.
+    fn clear(&self) {
+        for bucket in &self.buckets {
+            bucket.store(0, Ordering::Relaxed);
+        }
+        self.errors.store(0, Ordering::Relaxed);
+    }
+
+    /// Adds the samples in this histogram to the `buckets` and `errors` accumulators.
+    fn add_to(&self, buckets: &mut [usize], errors: &mut usize) {
+        for (total, bucket) in buckets.iter_mut().zip(self.buckets.iter()) {
+            *total += bucket.load(Ordering::Relaxed);
+        }
+        *errors += self.errors.load(Ordering::Relaxed);
+    }
+}
+
+/// Histogram of the samples recorded during one period of the recent window.
+struct Period {
+    /// Number of the period since `LatencyStats::start`, plus one, whose samples are held in
+    /// `histogram`.  0 if the slot has never been used.
+    number: AtomicUsize,
+
+    /// Samples recorded during the period.
+    histogram: Histogram,
+}
+
+/// Latency histograms of a single operation.
+struct OpHistograms {
+    /// Samples recorded since the process started.
+    lifetime: Histogram,
+
+    /// Ring buffer with the samples of the most recent periods, indexed by period number.
+    window: Vec<Period>,
+}
+
+/// Summary of a collection of samples of an operation.
+#[derive(Debug, PartialEq, Serialize)]
+pub struct Summary {
+    /// Number of samples.
+    pub count: usize,
+
+    /// Number of samples that correspond to failed operations.
+    pub errors: usize,
+
+    /// Median latency in microseconds, or none if there are no samples.
+    pub p50_us: Option<u64>,
+
+    /// 90th percentile of the latency in microseconds, or none if there are no samples.
+    pub p90_us: Option<u64>,
+
+    /// 99th percentile of the latency in microseconds, or none if there are no samples.
+    pub p99_us: Option<u64>,
+}
+
+impl Summary {
+    /// Computes the summary of the samples in `buckets` of which `errors` failed.
+    fn new(buckets: &[usize], errors: usize) -> Self {
+        let count = buckets.iter().sum::<usize>();
+        let mut percentiles = PERCENTILES.iter().map(|p| {
+            if count == 0 {
+                return None;
+            }
+            let rank = ((p * count as f64).ceil() as usize).max(1);
+            let mut seen = 0;
+            buckets.iter().position(|n| { seen += n; seen >= rank }).map(bucket_upper_bound)
+        });
+        Summary {
+            count,
+            errors,
+            p50_us: percentiles.next().unwrap(),
+            p90_us: percentiles.next().unwrap(),
+            p99_us: percentiles.next().unwrap(),
+        }
+    }
+}
+
+/// Summaries of the samples of a single operation.
+#[derive(Debug, Serialize)]
+pub struct OpSummary {
+    /// Name of the operation.
+    pub op: &'static str,
+
+    /// Summary of the samples since the process started.
+    pub lifetime: Summary,
+
+    /// Summary of the samples during the recent window.
+    pub last_minute: Summary,
+}
+
+/// Snapshot of the latencies of all operations, as exposed to the user.
+#[derive(Debug, Serialize)]
+pub struct Snapshot {
+    /// Time since the process started, in seconds.
+    pub uptime_seconds: u64,
+
+    /// Span of the recent window, in seconds.
+    pub window_seconds: u64,
+
+    /// Summaries of all operations, in the order of `Op`.
+    pub ops: Vec<OpSummary>,
+}
+
+/// Per-operation latency histograms over the lifetime of the process and over the last minute.
+///
+/// All memory is allocated upfront so that recording a sample, which happens on every FUSE
+/// operation, only involves a few atomic operations.  The recent window is a ring buffer of
+/// `WINDOW_PERIODS` histograms, each covering `PERIOD_SECS`, that are recycled as time passes.
+/// Samples recorded concurrently with the recycling of their period may be lost, which is fine
+/// for the approximate view these statistics provide.
+pub struct LatencyStats {
+    /// Time from which periods are counted.
+    start: Instant,
+
+    /// Histograms of each operation, indexed by `Op`.
+    ops: Vec<OpHistograms>,
+}
+
+impl Default for LatencyStats {
+    fn default() -> Self {
+        let ops = Op::names().iter().map(|_| OpHistograms {
+            lifetime: Histogram::new(),
+            window: (0..WINDOW_PERIODS)
+                .map(|_| Period { number: AtomicUsize::new(0), histogram: Histogram::new() })
+                .collect(),
+        }).collect();
+        LatencyStats { start: Instant::now(), ops }
+    }
+}
+
+impl LatencyStats {
+    /// Returns the number of the period, plus one, that contains `now`.
+    fn period_at(&self, now: Instant) -> usize {
+        (now.duration_since(self.start).as_secs() / PERIOD_SECS) as usize + 1
+    }
+
+    /// Records that an instance of the operation `op` completed at `now` after `elapsed`, and
+    /// whether it `failed`.
+    pub fn record(&self, op: Op, now: Instant, elapsed: Duration, failed: bool) {
+        let micros = as_micros(elapsed);
+        let histograms = &self.ops[op as usize];
+        histograms.lifetime.observe(micros, failed);
+
+        let number = self.period_at(now);
+        let period = &histograms.window[number % WINDOW_PERIODS];
+        let current = period.number.load(Ordering::Acquire);
+        if current < number {
+            let swapped = period.number.compare_exchange(
+                current, number, Ordering::AcqRel, Ordering::Acquire);
+            if swapped.is_ok() {
+                period.histogram.clear();
+            }
+        } else if current > number {
+            // Another thread already moved on to a later period, so our sample is too old to be
+            // part of the recent window.
+            return;
+        }
+        period.histogram.observe(micros, failed);
+    }
+
+    /// Computes the summaries of all operations as of `now`.
+    pub fn snapshot(&self, now: Instant) -> Snapshot {
+        let current = self.period_at(now);
+        let oldest = current.saturating_sub(WINDOW_PERIODS - 1);
+
+        let ops = Op::names().iter().zip(self.ops.iter()).map(|(name, histograms)| {
+            let mut buckets = vec![0; NUM_BUCKETS];
+            let mut errors = 0;
+            histograms.lifetime.add_to(&mut buckets, &mut errors);
+            let lifetime = Summary::new(&buckets, errors);
+
+            let mut buckets = vec![0; NUM_BUCKETS];
+            let mut errors = 0;
+            for period in &histograms.window {
+                let number = period.number.load(Ordering::Acquire);
+                if number >= oldest && number <= current {
+                    period.histogram.add_to(&mut buckets, &mut errors);
+                }
+            }
+            let last_minute = Summary::new(&buckets, errors);
+
+            OpSummary { op: *name, lifetime, last_minute }
+        }).collect();
+
+        Snapshot {
+            uptime_seconds: now.duration_since(self.start).as_secs(),
+            window_seconds: PERIOD_SECS * WINDOW_PERIODS as u64,
+            ops,
+        }
+    }
+}
+
+impl Snapshot {
+    /// Renders the snapshot as a JSON object.
+    pub fn to_json(&self) -> String {
+        let mut out = serde_json::to_string(self).expect("Serializing statistics cannot fail");
+        out.push('\n');
+        out
+    }
+
+    /// Renders the snapshot as an HTML page with one table row per operation.
+    pub fn to_html(&self) -> String {
+        let mut out = String::new();
+        writeln!(out, "<!DOCTYPE html>\n<html>\n<head><title>sandboxfs statistics</title>\
+            </head>\n<body>\n<h1>sandboxfs statistics</h1>").unwrap();
+        writeln!(out, "<p>Uptime: {}s.  Recent statistics cover the last {}s.  Latencies are \
+            in microseconds.</p>", self.uptime_seconds, self.window_seconds).unwrap();
+        writeln!(out, "<table border=\"1\">\n<tr><th rowspan=\"2\">Operation</th>\
+            <th colspan=\"5\">Lifetime</th><th colspan=\"5\">Last minute</th></tr>").unwrap();
+        out.push_str("<tr>");
+        for _ in 0..2 {
+            out.push_str("<th>Count</th><th>Errors</th><th>p50</th><th>p90</th><th>p99</th>");
+        }
+        out.push_str("</tr>\n");
+        for op in &self.ops {
+            write!(out, "<tr><td>{}</td>", op.op).unwrap();
+            for summary in &[&op.lifetime, &op.last_minute] {
+                write!(out, "<td>{}</td><td>{}</td>", summary.count, summary.errors).unwrap();
+                for percentile in &[summary.p50_us, summary.p90_us, summary.p99_us] {
+                    match percentile {
+                        Some(micros) => write!(out, "<td>{}</td>", micros),
+                        None => write!(out, "<td>-</td>"),
+                    }.unwrap();
+                }
+            }
+            out.push_str("</tr>\n");
+        }
+        out.push_str("</table>\n</body>\n</html>\n");
+        out
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_bucket_of_and_upper_bound_agree() {
+        for micros in (0..10_000).chain(vec!(1 << 20, (1 << 33) - 1)) {
+            let i = bucket_of(micros);
+            assert!(micros <= bucket_upper_bound(i), "{} not within bucket {}", micros, i);
+            if i > 0 {
+                assert!(micros > bucket_upper_bound(i - 1), "{} within bucket {}", micros, i - 1);
+            }
+        }
+        assert_eq!(NUM_BUCKETS - 1, bucket_of(1 << 40));
+        assert_eq!(NUM_BUCKETS - 1, bucket_of(u64::max_value()));
+    }
+
+    #[test]
+    fn test_bucket_precision() {
+        assert_eq!(3, bucket_upper_bound(bucket_of(3)));
+        assert_eq!(7, bucket_upper_bound(bucket_of(7)));
+        assert_eq!(1023, bucket_upper_bound(bucket_of(1000)));
+        assert_eq!(1279, bucket_upper_bound(bucket_of(1279)));
+        assert_eq!(1535, bucket_upper_bound(bucket_of(1280)));
+    }
+
+    #[test]
+    fn test_summary() {
+        let mut buckets = vec![0; NUM_BUCKETS];
+        buckets[bucket_of(1)] = 50;
+        buckets[bucket_of(5)] = 40;
+        buckets[bucket_of(100)] = 9;
+        buckets[bucket_of(1000)] = 1;
+        assert_eq!(
+            Summary { count: 100, errors: 3, p50_us: Some(1), p90_us: Some(5), p99_us: Some(111) },
+            Summary::new(&buckets, 3));
+
+        assert_eq!(
+            Summary { count: 0, errors: 0, p50_us: None, p90_us: None, p99_us: None },
+            Summary::new(&vec![0; NUM_BUCKETS], 0));
+    }
+
+    #[test]
+    fn test_record_and_snapshot() {
+        let stats = LatencyStats::default();
+        let start = stats.start;
+        stats.record(Op::Lookup, start, Duration::from_micros(2), false);
+        stats.record(Op::Lookup, start, Duration::from_micros(2), true);
+        stats.record(Op::Read, start, Duration::from_millis(1), false);
+
+        let snapshot = stats.snapshot(start + Duration::from_secs(1));
+        assert_eq!(1, snapshot.uptime_seconds);
+        assert_eq!(60, snapshot.window_seconds);
+        assert_eq!(Op::names().len(), snapshot.ops.len());
+        let lookup = &snapshot.ops[Op::Lookup as usize];
+        assert_eq!("lookup", lookup.op);
+        assert_eq!(
+            Summary { count: 2, errors: 1, p50_us: Some(2), p90_us: Some(2), p99_us: Some(2) },
+            lookup.lifetime);
+        assert_eq!(lookup.lifetime, lookup.last_minute);
+        assert_eq!(Some(1023), snapshot.ops[Op::Read as usize].last_minute.p50_us);
+        assert_eq!(0, snapshot.ops[Op::Write as usize].lifetime.count);
+    }
+
+    #[test]
+    fn test_window_expires_old_periods() {
+        let stats = LatencyStats::default();
+        let start = stats.start;
+        stats.record(Op::Getattr, start, Duration::from_micros(10), false);
+
+        let later = start + Duration::from_secs(PERIOD_SECS * WINDOW_PERIODS as u64);
+        let snapshot = stats.snapshot(later);
+        let getattr = &snapshot.ops[Op::Getattr as usize];
+        assert_eq!(1, getattr.lifetime.count);
+        assert_eq!(0, getattr.last_minute.count);
+
+        // Recording in the same slot of the ring buffer recycles the period.
+        stats.record(Op::Getattr, later, Duration::from_micros(10), false);
+        let getattr = &stats.snapshot(later).ops[Op::Getattr as usize];
+        assert_eq!(2, getattr.lifetime.count);
+        assert_eq!(1, getattr.last_minute.count);
+
+        // Samples from periods that have already been recycled are not added to the window.
+        stats.record(Op::Getattr, start, Duration::from_micros(10), false);
+        let getattr = &stats.snapshot(later).ops[Op::Getattr as usize];
+        assert_eq!(3, getattr.lifetime.count);
+        assert_eq!(1, getattr.last_minute.count);
+    }
+
+    #[test]
+    fn test_to_json() {
+        let stats = LatencyStats::default();
+        stats.record(Op::Statfs, stats.start, Duration::from_micros(3), false);
+        let json = stats.snapshot(stats.start).to_json();
+        assert!(json.starts_with("{\"uptime_seconds\":0,\"window_seconds\":60,\"ops\":["));
+        assert!(json.contains("{\"op\":\"statfs\",\
+            \"lifetime\":{\"count\":1,\"errors\":0,\"p50_us\":3,\"p90_us\":3,\"p99_us\":3},\
+            \"last_minute\":{\"count\":1,\"errors\":0,\"p50_us\":3,\"p90_us\":3,\"p99_us\":3}}"));
+        assert!(json.contains("{\"op\":\"write\",\
+            \"lifetime\":{\"count\":0,\"errors\":0,\"p50_us\":null,\"p90_us\":null,\
+            \"p99_us\":null},"));
+        assert!(json.ends_with("]}\n"));
+    }
+
+    #[test]
+    fn test_to_html() {
+        let stats = LatencyStats::default();
+        stats.record(Op::Statfs, stats.start, Duration::from_micros(3), true);
+        let html = stats.snapshot(stats.start).to_html();
+        assert!(html.contains("<tr><td>statfs</td><td>1</td><td>1</td><td>3</td><td>3</td>\
+            <td>3</td><td>1</td><td>1</td><td>3</td><td>3</td><td>3</td></tr>\n"));
+        assert!(html.contains("<tr><td>write</td><td>0</td><td>0</td><td>-</td>"));
+    }
+}
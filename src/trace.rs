@@ -0,0 +1,353 @@
+// Copyright 2020 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not
+// use this file except in compliance with the License.  You may obtain a copy
+// of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.  See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+use metrics::Op;
+use serde_derive::Serialize;
+use std::fs;
+use std::io::{self, BufWriter, Write};
+use std::path::{Path, PathBuf};
+use std::process;
+use std::sync::{Arc, Mutex};
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::thread;
+use std::time::{Duration, Instant};
+use time;
+
+/// Maximum number of operations to record before dropping new ones, which bounds the memory used
+/// by the trace.
+const MAX_EVENTS: usize = 1 << 22;
+
+/// Source of the identifiers of the threads that appear in the trace.
+static NEXT_TID: AtomicUsize = AtomicUsize::new(1);
+
+thread_local! {
+    /// Identifier of this thread in the trace, assigned on its first traced operation.
+    ///
+    /// We use our own identifiers because `std::thread::ThreadId` cannot be converted to the
+    /// integers the trace format wants.
+    static TID: usize = NEXT_TID.fetch_add(1, Ordering::Relaxed);
+}
+
+/// A completed operation as recorded in memory.  Kept small because there may be many of these.
+#[derive(Clone, Copy)]
+struct Event {
+    /// The operation that ran.
+    op: Op,
+
+    /// Thread that processed the operation.  See `TID`.
+    tid: usize,
+
+    /// Time at which the operation started, relative to the start of the trace.
+    start: Duration,
+
+    /// How long the operation took.
+    elapsed: Duration,
+
+    /// Error code returned by the operation, or 0 if it succeeded.
+    errno: i32,
+}
+
+/// Arguments attached to each event in the trace, shown when selecting the event.
+#[derive(Serialize)]
+struct JsonArgs {
+    errno: i32,
+}
+
+/// External representation of a completed operation, as a "complete" event of the Chrome trace
+/// event format.
+#[derive(Serialize)]
+struct JsonEvent {
+    name: &'static str,
+    cat: &'static str,
+    ph: &'static str,
+    ts: u64,
+    dur: u64,
+    pid: u32,
+    tid: usize,
+    args: JsonArgs,
+}
+
+/// Metadata about the trace itself, which viewers show alongside the events.
+#[derive(Serialize)]
+struct JsonOtherData {
+    dropped_events: usize,
+}
+
+/// External representation of the whole trace.
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct JsonTrace {
+    trace_events: Vec<JsonEvent>,
+    display_time_unit: &'static str,
+    other_data: JsonOtherData,
+}
+
+/// Events recorded so far and the file they will be written to.
+struct State {
+    /// File to write the trace to, or None once the trace has been written.
+    file: Option<fs::File>,
+
+    /// Operations recorded so far, in order of completion.
+    events: Vec<Event>,
+
+    /// Number of operations not recorded because there were too many.
+    dropped: usize,
+}
+
+/// Recorder of the FUSE operations processed by the file system, in a format that can be loaded
+/// into `chrome://tracing` or Perfetto to visualize which operations ran when and on which threads.
+///
+/// Events are kept in memory and written in one go when the trace is finished because the trace
+/// format is a single JSON document.
+pub struct Tracer {
+    /// Path to the trace, for reporting purposes only.
+    path: PathBuf,
+
+    /// Time at which tracing started, to which all event times are relative.
+    start: Instant,
+
+    /// Time at which tracing stops, if bounded.  Operations that start later are not recorded.
+    deadline: Option<Instant>,
+
+    /// Events recorded so far.
+    state: Mutex<State>,
+}
+
+impl Tracer {
+    /// Creates the file at `path` to which the trace will be written once finished.
+    ///
+    /// If `duration` is given, recording stops after that long and the trace is written right
+    /// away from a separate thread instead of when the file system is unmounted.
+    pub fn create(path: &Path, duration: Option<Duration>) -> io::Result<Arc<Tracer>> {
+        let file = fs::File::create(path)?;
+        let start = Instant::now();
+        let tracer = Arc::from(Tracer {
+            path: path.to_owned(),
+            start,
+            deadline: duration.map(|duration| start + duration),
+            state: Mutex::from(State { file: Some(file), events: vec!(), dropped: 0 }),
+        });
+        info!("Writing execution trace to {}", path.display());
+        if let Some(duration) = duration {
+            let tracer = tracer.clone();
+            thread::spawn(move || {
+                thread::sleep(duration);
+                tracer.finish();
+            });
+        }
+        Ok(tracer)
+    }
+
+    /// Records that the operation `op`, which started at `start`, took `elapsed` to complete and
+    /// returned `errno`.
+    pub fn record(&self, op: Op, start: Instant, elapsed: Duration, errno: i32) {
+        if start < self.start || self.deadline.map_or(false, |deadline| start >= deadline) {
+            return;
+        }
+        let event = Event {
+            op,
+            tid: TID.with(|tid| *tid),
+            start: start.duration_since(self.start),
+            elapsed,
+            errno,
+        };
+
+        let mut state = self.state.lock().unwrap();
+        if state.file.is_none() {
+            // Already finished.
+        } else if state.events.len() < MAX_EVENTS {
+            state.events.push(event);
+        } else {
+            state.dropped += 1;
+        }
+    }
+
+    /// Writes the trace to its file and stops recording.  Subsequent calls do nothing.
+    pub fn finish(&self) {
+        let (file, events, dropped) = {
+            let mut state = self.state.lock().unwrap();
+            match state.file.take() {
+                Some(file) => (file, state.events.split_off(0), state.dropped),
+                None => return,
+            }
+        };
+        match write_trace(file, events, dropped) {
+            Ok(()) => info!("Execution trace written to {}", self.path.display()),
+            Err(e) => warn!("Failed to write execution trace to {}: {}", self.path.display(), e),
+        }
+    }
+
+    /// Writes the operations recorded so far to a new file next to the trace, named after the
+    /// trace and the current time, and returns its path.  Returns None if the trace has already
+    /// been written, in which case there is nothing left to snapshot.
+    ///
+    /// Recording continues unaffected, so the trace written by `finish` still contains all
+    /// operations, and this can be called any number of times.
+    pub fn snapshot(&self) -> io::Result<Option<PathBuf>> {
+        let (events, dropped) = {
+            let state = self.state.lock().unwrap();
+            if state.file.is_none() {
+                return Ok(None);
+            }
+            (state.events.clone(), state.dropped)
+        };
+        let timestamp = time::now_utc().strftime("%Y%m%dT%H%M%S.%fZ")
+            .expect("Hardcoded time format must be valid").to_string();
+        let mut path = self.path.clone().into_os_string();
+        path.push(".");
+        path.push(timestamp);
+        let path = PathBuf::from(path);
+        let file = fs::OpenOptions::new().write(true).create_new(true).open(&path)?;
+        write_trace(file, events, dropped)?;
+        info!("Execution trace snapshot written to {}", path.display());
+        Ok(Some(path))
+    }
+}
+
+/// Converts `duration` to whole microseconds, which is the time unit of the trace format.
+fn as_micros(duration: Duration) -> u64 {
+    duration.as_secs() * 1_000_000 + u64::from(duration.subsec_micros())
+}
+
+/// Writes the trace made of `events` to `file`.
+fn write_trace(file: fs::File, events: Vec<Event>, dropped: usize) -> io::Result<()> {
+    let pid = process::id();
+    let trace = JsonTrace {
+        trace_events: events.into_iter().map(|event| JsonEvent {
+            name: event.op.name(),
+            cat: "fuse",
+            ph: "X",
+            ts: as_micros(event.start),
+            dur: as_micros(event.elapsed),
+            pid,
+            tid: event.tid,
+            args: JsonArgs { errno: event.errno },
+        }).collect(),
+        display_time_unit: "ms",
+        other_data: JsonOtherData { dropped_events: dropped },
+    };
+    let mut writer = BufWriter::new(file);
+    serde_json::to_writer(&mut writer, &trace)?;
+    writer.write_all(b"\n")?;
+    writer.flush()
+}
+
+/// Scope guard that writes a trace when dropped.  See `Tracer::finish`.
+pub struct FinishOnDrop(pub Arc<Tracer>);
+
+impl Drop for FinishOnDrop {
+    fn drop(&mut self) {
+        self.0.finish();
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::tempdir;
+
+    /// Reads the trace at `path` and parses it.
+    fn read_trace(path: &Path) -> serde_json::Value {
+        serde_json::from_str(&fs::read_to_string(path).unwrap()).unwrap()
+    }
+
+    #[test]
+    fn test_tracer_writes_events_on_finish() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("trace.json");
+        let tracer = Tracer::create(&path, None).unwrap();
+        assert_eq!("", fs::read_to_string(&path).unwrap());
+
+        let start = tracer.start + Duration::from_micros(1500);
+        tracer.record(Op::Lookup, start, Duration::from_micros(20), 0);
+        tracer.record(Op::Read, start, Duration::from_millis(3), 5);
+        tracer.finish();
+
+        let trace = read_trace(&path);
+        let events = trace["traceEvents"].as_array().unwrap();
+        assert_eq!(2, events.len());
+        assert_eq!("lookup", events[0]["name"]);
+        assert_eq!("X", events[0]["ph"]);
+        assert_eq!(1500, events[0]["ts"]);
+        assert_eq!(20, events[0]["dur"]);
+        assert_eq!(0, events[0]["args"]["errno"]);
+        assert_eq!("read", events[1]["name"]);
+        assert_eq!(3000, events[1]["dur"]);
+        assert_eq!(5, events[1]["args"]["errno"]);
+        assert_eq!(events[0]["tid"], events[1]["tid"]);
+        assert_eq!(0, trace["otherData"]["dropped_events"]);
+
+        // Finishing again must not rewrite the trace, and later events must be ignored.
+        tracer.record(Op::Write, start, Duration::from_micros(1), 0);
+        tracer.finish();
+        assert_eq!(trace, read_trace(&path));
+    }
+
+    #[test]
+    fn test_tracer_ignores_operations_after_deadline() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("trace.json");
+        let tracer = Tracer::create(&path, Some(Duration::from_secs(3600))).unwrap();
+
+        tracer.record(Op::Getattr, tracer.start, Duration::from_micros(1), 0);
+        tracer.record(Op::Getattr, tracer.start + Duration::from_secs(3600),
+            Duration::from_micros(1), 0);
+        tracer.finish();
+        assert_eq!(1, read_trace(&path)["traceEvents"].as_array().unwrap().len());
+    }
+
+    #[test]
+    fn test_tracer_finishes_after_duration() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("trace.json");
+        let tracer = Tracer::create(&path, Some(Duration::from_millis(10))).unwrap();
+        tracer.record(Op::Open, tracer.start, Duration::from_micros(1), 0);
+
+        let mut tries = 0;
+        while !fs::read_to_string(&path).unwrap().ends_with('\n') {
+            assert!(tries < 1000, "Trace was not written after its duration");
+            thread::sleep(Duration::from_millis(10));
+            tries += 1;
+        }
+        assert_eq!(1, read_trace(&path)["traceEvents"].as_array().unwrap().len());
+    }
+
+    #[test]
+    fn test_tracer_snapshot() {
+        let dir = tempdir().unwrap();
+        let path = dir.path().join("trace.json");
+        let tracer = Tracer::create(&path, None).unwrap();
+
+        tracer.record(Op::Lookup, tracer.start, Duration::from_micros(1), 0);
+        let first = tracer.snapshot().unwrap().unwrap();
+        tracer.record(Op::Read, tracer.start, Duration::from_micros(1), 0);
+        let second = tracer.snapshot().unwrap().unwrap();
+        assert_ne!(first, second);
+        assert_eq!(dir.path(), first.parent().unwrap());
+        assert!(first.file_name().unwrap().to_str().unwrap().starts_with("trace.json.2"));
+        assert_eq!(1, read_trace(&first)["traceEvents"].as_array().unwrap().len());
+        assert_eq!(2, read_trace(&second)["traceEvents"].as_array().unwrap().len());
+
+        // Snapshots must not affect the final trace.
+        assert_eq!("", fs::read_to_string(&path).unwrap());
+        tracer.finish();
+        assert_eq!(2, read_trace(&path)["traceEvents"].as_array().unwrap().len());
+        assert!(tracer.snapshot().unwrap().is_none());
+    }
+
+    #[test]
+    fn test_tracer_create_error() {
+        assert!(Tracer::create(Path::new("/non-existent/trace.json"), None).is_err());
+    }
+}